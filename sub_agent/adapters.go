@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// OpenAICompatibleProvider describes an aggregator or vendor that speaks the
+// OpenAI chat completions API. Adding one only takes a base URL and the
+// environment variable holding its key.
+type OpenAICompatibleProvider struct {
+	BaseURL      string            `json:"base_url"`
+	APIKeyEnv    string            `json:"api_key_env,omitempty"`
+	DefaultModel string            `json:"default_model,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	// Candidates means the API honours n, so --candidates needs one call.
+	Candidates bool `json:"candidates,omitempty"`
+	// Grammar means the API takes a GBNF grammar, as llama.cpp's server does.
+	Grammar bool `json:"grammar,omitempty"`
+}
+
+// builtinAdapters are available as provider=<name> without any config.
+var builtinAdapters = map[string]OpenAICompatibleProvider{
+	"openai":     {BaseURL: "https://api.openai.com/v1", APIKeyEnv: "OPENAI_API_KEY", DefaultModel: "gpt-4o-mini", Candidates: true},
+	"openrouter": {BaseURL: "https://openrouter.ai/api/v1", APIKeyEnv: "OPENROUTER_API_KEY", Headers: map[string]string{"X-Title": "helix-os"}},
+	"groq":       {BaseURL: "https://api.groq.com/openai/v1", APIKeyEnv: "GROQ_API_KEY", DefaultModel: "llama-3.3-70b-versatile"},
+	"together":   {BaseURL: "https://api.together.xyz/v1", APIKeyEnv: "TOGETHER_API_KEY"},
+	"deepseek":   {BaseURL: "https://api.deepseek.com/v1", APIKeyEnv: "DEEPSEEK_API_KEY", DefaultModel: "deepseek-chat"},
+}
+
+// lookupAdapter returns the adapter for a provider name; config entries in
+// "openai_compatible" take precedence over the built-ins.
+func lookupAdapter(name string) (OpenAICompatibleProvider, bool) {
+	a, ok := liveConfig().OpenAICompatible[name]
+	if !ok {
+		a, ok = builtinAdapters[name]
+	}
+	a.BaseURL = socketURL(a.BaseURL)
+	return a, ok
+}
+
+// adapterNames lists every adapter provider name, sorted.
+func adapterNames() []string {
+	seen := map[string]bool{}
+	for n := range builtinAdapters {
+		seen[n] = true
+	}
+	for n := range liveConfig().OpenAICompatible {
+		seen[n] = true
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a OpenAICompatibleProvider) chatURL() string {
+	return strings.TrimSuffix(a.BaseURL, "/") + "/chat/completions"
+}
+
+// callAdapter sends g to an OpenAI-compatible provider.
+func callAdapter(ctx context.Context, name string, a OpenAICompatibleProvider, g genRequest) ([]Response, error) {
+	if g.Model == "" {
+		return nil, kindError(ErrConfig, "missing model for provider %s. Pass --model or set default_model in the config", name)
+	}
+	headers, err := a.headers(name)
+	if err != nil {
+		return nil, err
+	}
+	return callOpenAICompatible(ctx, name, a.chatURL(), headers, openAIRequest(g), g.OnText)
+}
+
+// headers are the configured headers plus the API key, if a needs one.
+func (a OpenAICompatibleProvider) headers(name string) (map[string]string, error) {
+	headers := map[string]string{}
+	for k, v := range a.Headers {
+		headers[k] = v
+	}
+	if a.APIKeyEnv != "" {
+		key, err := lookupSecret(name, a.APIKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing API key for provider %s. Set %s or run `helix auth login --provider %s`", name, a.APIKeyEnv, name)
+		}
+		headers["Authorization"] = "Bearer " + key
+	}
+	return headers, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotation is the set of providers an operator took out of service with
+// POST /admin/providers/{name}/disable. Routing skips them and tasks naming
+// one fail, until it is enabled again or the process restarts.
+var rotation = providerRotation{out: map[string]time.Time{}}
+
+type providerRotation struct {
+	mu  sync.Mutex
+	out map[string]time.Time // provider -> when it was disabled
+}
+
+func (pr *providerRotation) disabled(provider string) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	_, ok := pr.out[provider]
+	return ok
+}
+
+func (pr *providerRotation) set(provider string, enabled bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if enabled {
+		delete(pr.out, provider)
+	} else if _, ok := pr.out[provider]; !ok {
+		pr.out[provider] = time.Now()
+	}
+}
+
+// AdminTask is a running task as GET /admin/tasks lists it.
+type AdminTask struct {
+	TaskProgress
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// TenantUsage is a tenant's quota and its use of the current window.
+type TenantUsage struct {
+	Name        string      `json:"name"`
+	Quota       TenantQuota `json:"quota"`
+	Requests    int         `json:"requests"`
+	Tokens      int         `json:"tokens"`
+	WindowStart *time.Time  `json:"window_start,omitempty"` // unset before the first request
+	WindowEnds  *time.Time  `json:"window_ends,omitempty"`
+}
+
+// AdminProvider is a provider's place in rotation.
+type AdminProvider struct {
+	Name        string     `json:"name"`
+	Enabled     bool       `json:"enabled"`
+	Disabled    *time.Time `json:"disabled_at,omitempty"`
+	Unavailable string     `json:"unavailable,omitempty"` // why routing can't use it as configured
+}
+
+// adminAuth reports whether r bears the admin token. Without one, or with a
+// wrong one, it writes a 404 so that the admin API doesn't advertise itself.
+func (s *server) adminAuth(w http.ResponseWriter, r *http.Request) bool {
+	s.authMu.RLock()
+	admin := s.admin
+	s.authMu.RUnlock()
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	h := sha256.Sum256([]byte(token))
+	if admin == nil || subtle.ConstantTimeCompare(h[:], admin[:]) != 1 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return false
+	}
+	return true
+}
+
+// allowMethod writes a 405 unless r uses method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use " + method})
+	return false
+}
+
+// handleAdmin serves the admin API under /admin/:
+//
+//	GET  /admin/tasks                      running tasks of every tenant
+//	GET  /admin/tenants                    each tenant's quota and usage
+//	PUT  /admin/tenants/{name}/quota       replace a tenant's quota
+//	POST /admin/caches/flush               drop the server's caches
+//	GET  /admin/providers                  providers and their rotation
+//	POST /admin/providers/{name}/disable   take a provider out of rotation
+//	POST /admin/providers/{name}/enable    put it back
+//	GET  /admin/latency                    p50/p95 latency per model and SLO breaches
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuth(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "tasks":
+		if allowMethod(w, r, http.MethodGet) {
+			s.adminTasks(w)
+		}
+	case len(parts) == 1 && parts[0] == "tenants":
+		if allowMethod(w, r, http.MethodGet) {
+			s.adminTenants(w, "")
+		}
+	case len(parts) == 3 && parts[0] == "tenants" && parts[2] == "quota":
+		if allowMethod(w, r, http.MethodPut) {
+			s.adminQuota(w, r, parts[1])
+		}
+	case len(parts) == 2 && parts[0] == "caches" && parts[1] == "flush":
+		if allowMethod(w, r, http.MethodPost) {
+			s.flushCaches(w)
+		}
+	case len(parts) == 1 && parts[0] == "providers":
+		if allowMethod(w, r, http.MethodGet) {
+			s.adminProviders(w)
+		}
+	case len(parts) == 3 && parts[0] == "providers" && (parts[2] == "disable" || parts[2] == "enable"):
+		if allowMethod(w, r, http.MethodPost) {
+			rotation.set(parts[1], parts[2] == "enable")
+			statusf("[Sub-Agent] Admin: %sd provider %s\n", parts[2], parts[1])
+			s.adminProviders(w)
+		}
+	case len(parts) == 1 && parts[0] == "latency":
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"window": liveConfig().SLO.window().String(), "models": latency.stats()})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+func (s *server) adminTasks(w http.ResponseWriter) {
+	s.tasks.mu.Lock()
+	trackers := make([]*progressTracker, 0, len(s.tasks.tasks))
+	for _, t := range s.tasks.tasks {
+		trackers = append(trackers, t)
+	}
+	s.tasks.mu.Unlock()
+	out := []AdminTask{}
+	for _, t := range trackers {
+		if p := t.snapshot(); p.Status == StatusRunning || p.Status == StatusAwaitingApproval {
+			out = append(out, AdminTask{TaskProgress: p, Tenant: t.tenant})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tasks": out})
+}
+
+// usage reports t's quota and counters. A window that has run out counts
+// as unused, as reserve would treat it.
+func (t *tenant) usage(now time.Time) TenantUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := TenantUsage{Name: t.Name, Quota: t.Quota}
+	u.Quota.Window = t.window.String()
+	if !t.start.IsZero() && now.Sub(t.start) < t.window {
+		start, ends := t.start, t.start.Add(t.window)
+		u.Requests, u.Tokens, u.WindowStart, u.WindowEnds = t.requests, t.tokens, &start, &ends
+	}
+	return u
+}
+
+// adminTenants lists every tenant's usage, or only the one named.
+func (s *server) adminTenants(w http.ResponseWriter, name string) {
+	s.authMu.RLock()
+	tenants := s.tenants
+	s.authMu.RUnlock()
+	now := time.Now()
+	out := []TenantUsage{}
+	for _, t := range tenants {
+		if name == "" || t.Name == name {
+			out = append(out, t.usage(now))
+		}
+	}
+	if name != "" {
+		writeJSON(w, http.StatusOK, out[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tenants": out})
+}
+
+// adminQuota replaces a tenant's quota until the server restarts or a
+// reload changes the server section. The current window's counters carry
+// over; a new window length starts a new window.
+func (s *server) adminQuota(w http.ResponseWriter, r *http.Request, name string) {
+	var q TenantQuota
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&q); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid quota: %v", err)})
+		return
+	}
+	if q.Requests < 0 || q.Tokens < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "requests and tokens can't be negative"})
+		return
+	}
+	var window time.Duration
+	if q.Window != "" {
+		d, err := time.ParseDuration(q.Window)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid quota window %q", q.Window)})
+			return
+		}
+		window = d
+	}
+	s.authMu.RLock()
+	var found *tenant
+	for _, t := range s.tenants {
+		if t.Name == name {
+			found = t
+		}
+	}
+	s.authMu.RUnlock()
+	if found == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no tenant " + name})
+		return
+	}
+	found.mu.Lock()
+	found.Quota.Requests, found.Quota.Tokens = q.Requests, q.Tokens
+	if window > 0 && window != found.window {
+		found.window, found.Quota.Window = window, q.Window
+		found.start, found.requests, found.tokens = time.Time{}, 0, 0
+	}
+	found.mu.Unlock()
+	statusf("[Sub-Agent] Admin: set the quota of tenant %s to %d request(s) and %d token(s) per %s\n", name, q.Requests, q.Tokens, found.usage(time.Now()).Quota.Window)
+	s.adminTenants(w, name)
+}
+
+// flushCaches drops what the server remembers between requests: finished
+// idempotent responses, the /readyz preflights, provider probes and fetched
+// secret references (fetched again right away).
+func (s *server) flushCaches(w http.ResponseWriter) {
+	var flushed []string
+	if s.idem != nil {
+		n := 0
+		s.idem.mu.Lock()
+		for k, e := range s.idem.entries {
+			if e.finished() {
+				delete(s.idem.entries, k)
+				n++
+			}
+		}
+		s.idem.mu.Unlock()
+		flushed = append(flushed, fmt.Sprintf("idempotency (%d)", n))
+	}
+	s.ready.mu.Lock()
+	s.ready.last = nil
+	s.ready.mu.Unlock()
+	flushed = append(flushed, "readiness")
+
+	forgetCapabilities()
+	flushed = append(flushed, "capabilities")
+
+	secretsMu.Lock()
+	secretRefs = map[string]secretRef{}
+	secretsMu.Unlock()
+	flushed = append(flushed, "secret references")
+	if err := prefetchSecrets(); err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{"flushed": flushed, "error": redactErr(err).Error()})
+		return
+	}
+	statusf("[Sub-Agent] Admin: flushed %s\n", strings.Join(flushed, ", "))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flushed": flushed})
+}
+
+// adminProviders lists the configured providers, and any disabled provider
+// that isn't, with their rotation state.
+func (s *server) adminProviders(w http.ResponseWriter) {
+	names := configuredProviders(s.runner.key)
+	rotation.mu.Lock()
+	out := map[string]time.Time{}
+	for name, at := range rotation.out {
+		out[name] = at
+	}
+	rotation.mu.Unlock()
+	for _, name := range sortedKeys(out) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	list := []AdminProvider{}
+	for _, name := range names {
+		p := AdminProvider{Name: name, Enabled: true, Unavailable: s.runner.unavailable(modelChoice{provider: name})}
+		if at, ok := out[name]; ok {
+			p.Enabled, p.Disabled = false, &at
+		}
+		list = append(list, p)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"providers": list})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"helix-agent-go/orchestrator"
+)
+
+// agent adapts a provider and model to an in-process orchestrator agent,
+// or with --kube-jobs to one run as a Kubernetes Job. Its calls skip the
+// task pipeline (guardrails, audit, post-processing), which applies once
+// to the overall task.
+func (r *runner) agent(provider, model string) orchestrator.Agent {
+	if r.kube != nil {
+		j := *r.kube
+		j.Provider, j.Model = provider, model
+		return j
+	}
+	return orchestrator.Func(func(ctx context.Context, prompt string) (orchestrator.Reply, error) {
+		out, err := generate(ctx, provider, model, prompt, r.key)
+		if err != nil {
+			return orchestrator.Reply{}, err
+		}
+		return orchestrator.Reply{Output: cleanOutput(out), Model: model}, nil
+	})
+}
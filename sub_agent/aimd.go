@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// aimdLimiter bounds the Ollama calls in flight and adapts the bound to
+// how loaded Ollama is, the way TCP adapts its window: it grows by one
+// call per round of calls that went straight through and halves when
+// calls queue. Ollama's total_duration leaves out time spent in its
+// queue, so the wall time of a call minus total_duration is that wait.
+type aimdLimiter struct {
+	min, max float64
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	wake     chan struct{} // closed and replaced when a slot frees up
+	cut      time.Time     // last decrease; one per round of calls
+}
+
+// ollamaLimiter, when set, gates local calls; worker sets it with
+// --adaptive-concurrency.
+var ollamaLimiter *aimdLimiter
+
+// Ollama is overloaded when a call waits longer than this in its queue,
+// or for more than half the time it then takes.
+const aimdMaxWait = 500 * time.Millisecond
+
+func newAIMDLimiter(max int) *aimdLimiter {
+	return &aimdLimiter{min: 1, max: float64(max), limit: 1, wake: make(chan struct{})}
+}
+
+// acquire waits for a slot.
+func (l *aimdLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if float64(l.inFlight) < l.limit {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release gives the slot back, adjusting the limit by how the call went:
+// wait is how long it queued in Ollama, took how long Ollama worked on
+// it, and overloaded whether Ollama turned it away as busy.
+func (l *aimdLimiter) release(wait, took time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	saturated := float64(l.inFlight) >= l.limit
+	l.inFlight--
+	old := int(l.limit)
+	switch {
+	case took == 0 && !overloaded:
+		// Cut short or failed: nothing to learn from.
+	case overloaded || (wait > aimdMaxWait && wait > took/2):
+		// Calls that were already queued report the same congestion;
+		// only the first of a round counts.
+		if time.Since(l.cut) > took+wait {
+			l.limit = max(l.min, l.limit/2)
+			l.cut = time.Now()
+		}
+	case saturated:
+		l.limit = min(l.max, l.limit+1/l.limit)
+	}
+	if n := int(l.limit); n != old {
+		why := "no queueing"
+		if n < old {
+			why = fmt.Sprintf("queued %s", wait.Round(time.Millisecond))
+			if overloaded {
+				why = "Ollama is busy"
+			}
+		}
+		statusf("[Sub-Agent] Local concurrency %d -> %d (%s)\n", old, n, why)
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errPlanRejected is returned when whoever reviews a plan turns it down.
+var errPlanRejected = errors.New("plan rejected")
+
+// readOnlyTool is implemented by tools that can say they change nothing
+// outside helix. Tools that don't implement it are assumed to have side
+// effects: an exec tool, an MCP server or a plugin may do anything.
+type readOnlyTool interface {
+	readOnly() bool
+}
+
+func (scratchpadTool) readOnly() bool { return true }
+func (memoryTool) readOnly() bool     { return true } // only helix's own memory store
+func (t *runCodeTool) readOnly() bool { return !t.writable }
+
+// sideEffectTools names the enabled tools that may change things.
+func (r *runner) sideEffectTools() []string {
+	var names []string
+	for _, t := range r.tools {
+		if ro, ok := t.(readOnlyTool); ok && ro.readOnly() {
+			continue
+		}
+		names = append(names, t.spec().Name)
+	}
+	return names
+}
+
+// planApprover shows plan, whose steps may call tools, to someone and
+// reports whether they approve it.
+type planApprover func(ctx context.Context, plan *Plan, tools []string) (bool, error)
+
+type approverKey struct{}
+
+// withApprover has plans of the run under ctx reviewed by approve.
+func withApprover(ctx context.Context, approve planApprover) context.Context {
+	return context.WithValue(ctx, approverKey{}, approve)
+}
+
+// approvePlan gates a plan before its first step runs. Plans that can't
+// change anything run straight away, as do all plans with --auto-approve;
+// the rest wait for the run's approver, and fail without one.
+func (r *runner) approvePlan(ctx context.Context, plan *Plan) error {
+	tools := r.sideEffectTools()
+	if len(tools) == 0 {
+		return nil
+	}
+	if r.plan.autoApprove {
+		logf(ctx, "Plan of %d step(s) auto-approved (tools with side effects: %s)", len(plan.Steps), strings.Join(tools, ", "))
+		return nil
+	}
+	approve, _ := ctx.Value(approverKey{}).(planApprover)
+	if approve == nil {
+		return kindError(ErrConfig, "the plan may use tools with side effects (%s) and needs approval, but nobody can give it here; pass --auto-approve for trusted pipelines", strings.Join(tools, ", "))
+	}
+	ok, err := approve(ctx, plan, tools)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errPlanRejected
+	}
+	return nil
+}
+
+// terminalApprover asks on the terminal.
+func terminalApprover(ctx context.Context, plan *Plan, tools []string) (bool, error) {
+	if jsonOut {
+		return false, kindError(ErrConfig, "the plan needs approval, which --json can't ask for; pass --auto-approve")
+	}
+	fmt.Fprintf(os.Stderr, "[Sub-Agent] Plan (%d steps via %s), with tools that may change things: %s\n", len(plan.Steps), modelChoice{plan.Provider, plan.Model}, strings.Join(tools, ", "))
+	for i, s := range plan.Steps {
+		fmt.Fprintf(os.Stderr, "  %d. [%s] %s\n", i+1, modelChoice{s.Provider, s.Model}, s.Task)
+	}
+	ok, err := confirm("Run this plan?", "--auto-approve")
+	if err != nil {
+		return false, configError(err)
+	}
+	return ok, nil
+}
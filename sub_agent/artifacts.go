@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Artifact modes accepted per run.
+const (
+	ArtifactsAuto   = "auto"   // upload only when the output exceeds the threshold
+	ArtifactsAlways = "always" // always upload
+	ArtifactsNever  = "never"  // always inline
+)
+
+// artifactStore uploads large results to an S3-compatible bucket (AWS S3,
+// MinIO, R2, ...) using path-style addressing and returns presigned URLs.
+type artifactStore struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	signer   sigV4Signer
+	expiry   time.Duration
+	client   *http.Client
+}
+
+// artifactFlags configure where large results are uploaded.
+type artifactFlags struct {
+	store     *string
+	threshold *int
+	mode      *string
+	expiry    *time.Duration
+}
+
+func addArtifactFlags(fs *flag.FlagSet) *artifactFlags {
+	return &artifactFlags{
+		store:     fs.String("artifact-store", os.Getenv("HELIX_ARTIFACT_STORE"), "Upload large results to s3://bucket/prefix (endpoint from S3_ENDPOINT)"),
+		threshold: fs.Int("artifact-threshold", 256*1024, "Upload results larger than this many bytes instead of inlining them"),
+		mode:      fs.String("artifacts", ArtifactsAuto, "Artifact mode: 'auto', 'always' or 'never'"),
+		expiry:    fs.Duration("artifact-expiry", 24*time.Hour, "Validity of the returned presigned URL (max 168h)"),
+	}
+}
+
+// open returns nil when no store is configured.
+func (f *artifactFlags) open() (*artifactStore, error) {
+	if *f.store == "" {
+		return nil, nil
+	}
+	return openArtifactStore(*f.store, *f.expiry)
+}
+
+// openArtifactStore parses s3://bucket/prefix. The endpoint defaults to AWS
+// for AWS_REGION and can be pointed elsewhere with S3_ENDPOINT. Credentials
+// come from the standard AWS chain (see awsCreds).
+func openArtifactStore(spec string, expiry time.Duration) (*artifactStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid artifact store %q: expected s3://bucket/prefix", spec)
+	}
+
+	region := awsRegion("")
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil || ep.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	if expiry <= 0 || expiry > 7*24*time.Hour {
+		return nil, fmt.Errorf("artifact expiry must be between 1s and 168h, got %s", expiry)
+	}
+
+	return &artifactStore{
+		endpoint: ep,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		signer:   sigV4Signer{creds: awsCreds.retrieve, region: region, service: "s3"},
+		expiry:   expiry,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (a *artifactStore) objectURL(key string) *url.URL {
+	if a.prefix != "" {
+		key = a.prefix + "/" + key
+	}
+	u := *a.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + a.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(a.endpoint.EscapedPath(), "/") + "/" + awsURIEncode(a.bucket, true) + "/" + awsURIEncode(key, false)
+	return &u
+}
+
+// put uploads data under key and returns a presigned GET URL for it.
+func (a *artifactStore) put(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	u := a.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("building artifact upload: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if err := a.signer.sign(req, hexSHA256(data)); err != nil {
+		return "", err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("uploading artifact to %s: %v", a.endpoint.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("artifact store returned status: %s, body: %s", resp.Status, string(body))
+	}
+
+	return a.signer.presign(ctx, http.MethodGet, u, a.expiry)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// atRestMagic starts every file sealed by sealAtRest; files without it are
+// plaintext, as everything written before encryption was turned on is.
+var atRestMagic = []byte("helix-sealed:aes-256-gcm:v1\n")
+
+// defaultEncryptionKeyName is the keyring entry of the at-rest key.
+const defaultEncryptionKeyName = "history-encryption"
+
+var atRest struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// atRestKey returns the key that seals the history, checkpoints and the
+// other stores history.encrypt covers:
+// $HELIX_ENCRYPTION_KEY, else the keyring entry, which is created with a
+// random key the first time encryption needs it. Either is 32 bytes,
+// base64-encoded.
+func atRestKey(create bool) ([]byte, error) {
+	atRest.mu.Lock()
+	defer atRest.mu.Unlock()
+	if atRest.key != nil {
+		return atRest.key, nil
+	}
+	encoded, source := os.Getenv("HELIX_ENCRYPTION_KEY"), "$HELIX_ENCRYPTION_KEY"
+	if encoded == "" {
+		name := liveConfig().History.EncryptionKey
+		if name == "" {
+			name = defaultEncryptionKeyName
+		}
+		source = "keyring entry " + name
+		v, err := keyringGet(name)
+		switch {
+		case err == nil && v != "":
+			encoded = v
+		case !create:
+			return nil, fmt.Errorf("no encryption key: set $HELIX_ENCRYPTION_KEY or restore %s: %v", source, err)
+		default:
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+			encoded = base64.StdEncoding.EncodeToString(key)
+			if err := keyringSet(name, encoded); err != nil {
+				return nil, fmt.Errorf("no encryption key: set $HELIX_ENCRYPTION_KEY or make the keyring available: %v", err)
+			}
+			statusf("[Sub-Agent] Created the history encryption key in the keyring as %s; keep a copy, sealed runs can't be read without it\n", name)
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the encryption key in %s must be 32 bytes, base64-encoded", source)
+	}
+	registerSecret(encoded)
+	atRest.key = key
+	return key, nil
+}
+
+func atRestAEAD(create bool) (cipher.AEAD, error) {
+	key, err := atRestKey(create)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAtRest encrypts data for disk when history.encrypt is on.
+func sealAtRest(data []byte) ([]byte, error) {
+	if !liveConfig().History.Encrypt {
+		return data, nil
+	}
+	return seal(data)
+}
+
+func seal(data []byte) ([]byte, error) {
+	aead, err := atRestAEAD(true)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, atRestMagic...), nonce...)
+	return aead.Seal(out, nonce, data, atRestMagic), nil
+}
+
+// openAtRest decrypts a file sealed by sealAtRest, and passes plaintext
+// through, whether or not encryption is on now.
+func openAtRest(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, atRestMagic) {
+		return data, nil
+	}
+	aead, err := atRestAEAD(false)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(atRestMagic):]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed file is truncated")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], atRestMagic)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: wrong key or a damaged file")
+	}
+	return plain, nil
+}
+
+// readAtRest reads a file that may be sealed.
+func readAtRest(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openAtRest(data)
+}
+
+// historyEncryptCommand implements `history encrypt`: seal, or with
+// --decrypt unseal, the runs, checkpoints and memory namespaces already on
+// disk, as turning history.encrypt on or off leaves them. Queue entries,
+// undo bundles and manifests are short-lived or kept elsewhere and are
+// left as they were written.
+func historyEncryptCommand(fs *flag.FlagSet) func(args []string) {
+	decrypt := fs.Bool("decrypt", false, "Write every run, checkpoint and memory back as plaintext")
+	return func([]string) {
+		var stores []recordStore
+		if store, err := openHistory(); err == nil {
+			stores = append(stores, store.records)
+		}
+		if cps, err := openCheckpoints(); err == nil {
+			stores = append(stores, cps.records)
+		}
+		changed := 0
+		for _, store := range stores {
+			recs, err := store.all()
+			if err != nil {
+				fatal(err)
+			}
+			for _, rec := range recs {
+				data := rec.data
+				if bytes.HasPrefix(data, atRestMagic) != *decrypt {
+					continue
+				}
+				if *decrypt {
+					data, err = openAtRest(data)
+				} else {
+					data, err = seal(data)
+				}
+				if err != nil {
+					fatal(fmt.Errorf("%s in %s: %v", rec.id, store.where(), err))
+				}
+				if err := store.put(rec.id, rec.time, data); err != nil {
+					fatal(err)
+				}
+				changed++
+			}
+		}
+		files := 0
+		if dir, err := memoryDir(); err == nil {
+			paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+			for _, path := range paths {
+				data, err := os.ReadFile(path)
+				if err != nil || bytes.HasPrefix(data, atRestMagic) != *decrypt {
+					continue
+				}
+				if *decrypt {
+					data, err = openAtRest(data)
+				} else {
+					data, err = seal(data)
+				}
+				if err == nil {
+					err = writeFileAtomic(path, data)
+				}
+				if err != nil {
+					fatal(fmt.Errorf("%s: %v", path, err))
+				}
+				files++
+			}
+		}
+		verb := "Encrypted"
+		if *decrypt {
+			verb = "Decrypted"
+		}
+		statusf("[Sub-Agent] %s %d run(s) and checkpoint(s) and %d memory namespace(s)\n", verb, changed, files)
+	}
+}
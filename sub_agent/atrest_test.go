@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sealedStores turns history.encrypt on with a throwaway key for a test.
+func sealedStores(t *testing.T) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		atRest.key = nil
+	})
+	atRest.key = nil
+	t.Setenv("HELIX_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	config.History.Encrypt = true
+}
+
+func assertSealed(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, atRestMagic) {
+		t.Errorf("%s is plaintext", path)
+	}
+}
+
+func TestAtRestStores(t *testing.T) {
+	sealedStores(t)
+	dir := t.TempDir()
+
+	t.Run("memory", func(t *testing.T) {
+		s := &memoryStore{path: filepath.Join(dir, "memory", "default.json"), namespace: "default"}
+		if err := s.write([]Memory{{Text: "the deploy password is hunter2"}}); err != nil {
+			t.Fatal(err)
+		}
+		assertSealed(t, s.path)
+		mems, err := s.load()
+		if err != nil || len(mems) != 1 || mems[0].Text != "the deploy password is hunter2" {
+			t.Fatalf("load = %v, %v", mems, err)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		q, err := openQueue(filepath.Join(dir, "queue"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := q.enqueue(TaskRequest{Task: "summarize the incident report", Priority: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSealed(t, q.path("pending", id))
+		if p, ok := q.topPriority(); !ok || p != 3 {
+			t.Errorf("topPriority = %d, %v", p, ok)
+		}
+		req, err := q.claim()
+		if err != nil || req == nil || req.Task != "summarize the incident report" {
+			t.Fatalf("claim = %+v, %v", req, err)
+		}
+		if err := q.finish(TaskResult{ID: id, Output: "done"}); err != nil {
+			t.Fatal(err)
+		}
+		assertSealed(t, q.path("done", id))
+	})
+
+	t.Run("undo", func(t *testing.T) {
+		root := filepath.Join(dir, "ws")
+		os.MkdirAll(root, 0o755)
+		os.WriteFile(filepath.Join(root, "secret.env"), []byte("TOKEN=abc\n"), 0o600)
+		if err := saveUndo(root, "edit", []string{"secret.env"}); err != nil {
+			t.Fatal(err)
+		}
+		ids, _ := listUndo(root)
+		assertSealed(t, filepath.Join(root, undoDir, ids[0], "bundle.json"))
+		assertSealed(t, filepath.Join(root, undoDir, ids[0], "0"))
+		os.WriteFile(filepath.Join(root, "secret.env"), []byte("changed\n"), 0o600)
+		b, err := readUndo(root, ids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := restoreUndo(root, b); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(root, "secret.env")); string(data) != "TOKEN=abc\n" {
+			t.Errorf("restored %q", data)
+		}
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		r := &runner{manifest: filepath.Join(dir, "manifests")}
+		r.writeManifest(TaskRequest{ID: "run1", Task: "t"}, TaskResult{ID: "run1", Output: "o"}, 0)
+		path := manifestPath(r.manifest, "run1")
+		assertSealed(t, path)
+		m, err := readManifest(path)
+		if err != nil || m.RunID != "run1" {
+			t.Fatalf("readManifest = %+v, %v", m, err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TranscriptionConfig is the speech-to-text backend behind --audio. Both
+// whisper.cpp's server and OpenAI-style /v1/audio/transcriptions APIs take
+// the multipart form sent here and answer {"text": ...}.
+type TranscriptionConfig struct {
+	// Endpoint defaults to a local whisper.cpp server.
+	Endpoint  string `json:"endpoint,omitempty"`
+	Model     string `json:"model,omitempty"` // e.g. whisper-1; whisper.cpp ignores it
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	Language  string `json:"language,omitempty"` // ISO code; default detected
+}
+
+const defaultTranscriptionEndpoint = "http://127.0.0.1:8080/inference"
+
+// AudioInput is a recording attached to a task, transcribed before the
+// task runs. Data is base64 in JSON.
+type AudioInput struct {
+	Name string `json:"name"` // file name; its extension tells the format
+	Data []byte `json:"data"`
+}
+
+var audioExtensions = map[string]bool{
+	".wav": true, ".mp3": true, ".m4a": true, ".ogg": true, ".flac": true,
+	".webm": true, ".mp4": true, ".mpeg": true, ".mpga": true, ".oga": true,
+}
+
+// readAudio loads an audio file.
+func readAudio(path string) (AudioInput, error) {
+	name := filepath.Base(path)
+	if !audioExtensions[strings.ToLower(filepath.Ext(name))] {
+		return AudioInput{}, fmt.Errorf("%s is not a supported audio file (wav, mp3, m4a, ogg, flac or webm)", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AudioInput{}, fmt.Errorf("reading audio: %v", err)
+	}
+	return AudioInput{Name: name, Data: data}, nil
+}
+
+// transcribeAudio transcribes req's recordings into its input, ahead of
+// any piped input.
+func (r *runner) transcribeAudio(ctx context.Context, req *TaskRequest) error {
+	var parts []string
+	for _, a := range req.Audio {
+		text, err := transcribe(ctx, a)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, fmt.Sprintf("Transcript of %s:\n%s", a.Name, strings.TrimSpace(text)))
+	}
+	if strings.TrimSpace(req.Input) != "" {
+		parts = append(parts, req.Input)
+	}
+	req.Input, req.Audio = strings.Join(parts, "\n\n"), nil
+	return nil
+}
+
+func transcribe(ctx context.Context, a AudioInput) (string, error) {
+	c := config.Transcription
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = defaultTranscriptionEndpoint
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fw, err := w.CreateFormFile("file", a.Name)
+	if err != nil {
+		return "", err
+	}
+	fw.Write(a.Data)
+	w.WriteField("response_format", "json")
+	if c.Model != "" {
+		w.WriteField("model", c.Model)
+	}
+	if c.Language != "" {
+		w.WriteField("language", c.Language)
+	}
+	w.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return "", fmt.Errorf("building transcription request: %v", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if c.APIKeyEnv != "" {
+		key, err := lookupSecret("transcription", c.APIKeyEnv)
+		if err != nil {
+			return "", err
+		}
+		if key == "" {
+			return "", kindError(ErrAuth, "missing transcription API key. Set %s or run `helix auth login --provider transcription`", c.APIKeyEnv)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", kindError(ErrUnreachable, "connecting to the transcription endpoint: %w. Is a whisper.cpp server running, or transcription.endpoint set?", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", kindError(statusKind(resp.StatusCode), "transcription endpoint returned status: %s, body: %s", resp.Status, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	var out struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", fmt.Errorf("parsing transcription response: %v", err)
+	}
+	if strings.TrimSpace(out.Text) == "" {
+		return "", fmt.Errorf("transcription of %s is empty", a.Name)
+	}
+	return out.Text, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig is the "audit" config section. An empty Path disables the
+// audit log; --audit-log overrides it.
+type AuditConfig struct {
+	Path string `json:"path,omitempty"`
+	// IncludeTask stores the task text itself rather than only its hash.
+	IncludeTask bool `json:"include_task,omitempty"`
+}
+
+// AuditEntry is one line of the audit log. Hash covers the entry with Hash
+// empty, and Prev is the previous entry's Hash, so editing, dropping or
+// reordering lines breaks the chain.
+type AuditEntry struct {
+	Seq       int               `json:"seq"`
+	Time      string            `json:"time"`
+	TaskID    string            `json:"task_id"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Submitter string            `json:"submitter"`
+	Provider  string            `json:"provider"`
+	Model     string            `json:"model,omitempty"`
+	TaskHash  string            `json:"task_sha256"`
+	Task      string            `json:"task,omitempty"`
+	Status    string            `json:"status"` // ok or error
+	Error     string            `json:"error,omitempty"`
+	// Classification is the decision for a task guardrails.classification
+	// labelled, including overrides.
+	Classification *Classification `json:"classification,omitempty"`
+	Prev           string          `json:"prev"`
+	Hash           string          `json:"hash,omitempty"`
+}
+
+// auditLog appends chained entries to a JSONL file.
+type auditLog struct {
+	mu          sync.Mutex
+	f           *os.File
+	includeTask bool
+	seq         int
+	last        string
+}
+
+// openAuditLog opens path for appending and picks the chain up from its
+// last entry.
+func openAuditLog(path string, includeTask bool) (*auditLog, error) {
+	entries, err := readAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %v", err)
+	}
+	a := &auditLog{f: f, includeTask: includeTask}
+	if n := len(entries); n > 0 {
+		a.seq, a.last = entries[n-1].Seq, entries[n-1].Hash
+	}
+	return a, nil
+}
+
+// record appends an entry for a finished task.
+func (a *auditLog) record(req TaskRequest, res TaskResult) error {
+	sum := sha256.Sum256([]byte(req.Task))
+	e := AuditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		TaskID:    res.ID,
+		Tags:      req.Tags,
+		Submitter: submitter(req),
+		Provider:  res.Provider,
+		Model:     res.Model,
+		TaskHash:  hex.EncodeToString(sum[:]),
+		Status:    "ok",
+
+		Classification: res.Classification,
+	}
+	if a.includeTask {
+		e.Task = req.Task
+	}
+	if res.Error != "" {
+		e.Status, e.Error = "error", res.Error
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq, e.Prev = a.seq+1, a.last
+	e.Hash = auditHash(e)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit log: %v", err)
+	}
+	// Audit entries must survive a crash right after the task returns.
+	if err := a.f.Sync(); err != nil {
+		return fmt.Errorf("writing audit log: %v", err)
+	}
+	a.seq, a.last = e.Seq, e.Hash
+	return nil
+}
+
+// submitter is the tenant for serve tasks, otherwise the local user.
+func submitter(req TaskRequest) string {
+	if req.Tenant != "" {
+		return "tenant:" + req.Tenant
+	}
+	if u, err := user.Current(); err == nil {
+		return "user:" + u.Username
+	}
+	return "unknown"
+}
+
+// auditHash is the hex SHA-256 of e's JSON encoding without its Hash.
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readAuditLog(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("audit log line %d: %v", n, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading audit log: %v", err)
+	}
+	return entries, nil
+}
+
+// verifyAuditChain checks every entry's hash and link to its predecessor.
+func verifyAuditChain(entries []AuditEntry) error {
+	prev := ""
+	for i, e := range entries {
+		if e.Seq != i+1 {
+			return fmt.Errorf("entry %d: sequence number is %d (entries missing or reordered)", i+1, e.Seq)
+		}
+		if e.Prev != prev {
+			return fmt.Errorf("entry %d: does not chain to the previous entry", e.Seq)
+		}
+		if auditHash(e) != e.Hash {
+			return fmt.Errorf("entry %d: hash mismatch (entry was modified)", e.Seq)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// auditVerifyCommand implements `audit verify`.
+func auditVerifyCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", config.Audit.Path, "Audit log to verify (defaults to audit.path from the config)")
+	return func([]string) { verifyAudit(*file) }
+}
+
+func verifyAudit(file string) {
+	if file == "" {
+		fmt.Println("Error: --file flag is required")
+		os.Exit(1)
+	}
+	entries, err := readAuditLog(file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := verifyAuditChain(entries); err != nil {
+		fmt.Printf("Error: audit log %s is not intact: %v\n", file, err)
+		os.Exit(1)
+	}
+	// The chain cannot show lines cut from the end, so print the head hash
+	// for comparison with a copy kept elsewhere.
+	head := ""
+	if n := len(entries); n > 0 {
+		head = entries[n-1].Hash
+	}
+	fmt.Printf("[Sub-Agent] Audit log OK: %d entries, head %s\n", len(entries), head)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials are the credentials used for SigV4 signing. Expires is zero
+// for long-lived keys.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// awsCredentialCache resolves credentials through the standard AWS chain and
+// keeps them until shortly before they expire.
+type awsCredentialCache struct {
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+// awsCreds is shared by everything that signs AWS requests.
+var awsCreds = &awsCredentialCache{}
+
+func (c *awsCredentialCache) retrieve(ctx context.Context) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && (c.creds.Expires.IsZero() || time.Until(c.creds.Expires) > 5*time.Minute) {
+		return c.creds, nil
+	}
+	creds, err := resolveAWSCredentials(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// awsRegion returns the configured region: the explicit value, then
+// AWS_REGION, AWS_DEFAULT_REGION, and finally us-east-1.
+func awsRegion(explicit string) string {
+	for _, r := range []string{explicit, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// resolveAWSCredentials walks the chain the AWS SDKs use: environment, web
+// identity (EKS IRSA), the shared credentials file, the ECS container
+// endpoint, and finally EC2 instance metadata (IMDSv2).
+func resolveAWSCredentials(ctx context.Context) (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && role != "" {
+		return assumeRoleWithWebIdentity(ctx, tokenFile, role)
+	}
+	if creds, ok, err := sharedFileCredentials(); ok || err != nil {
+		return creds, err
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return containerCredentials(ctx)
+	}
+	if !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		if creds, err := instanceMetadataCredentials(ctx); err == nil {
+			return creds, nil
+		}
+	}
+	return awsCredentials{}, kindError(ErrAuth, "missing AWS credentials. Set AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, AWS_PROFILE, or run with an IAM role")
+}
+
+// sharedFileCredentials reads [profile] from ~/.aws/credentials (or
+// AWS_SHARED_CREDENTIALS_FILE). ok is false if the file or profile is absent.
+func sharedFileCredentials() (awsCredentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return awsCredentials{}, false, nil
+	}
+	defer f.Close()
+
+	var creds awsCredentials
+	found, section := false, ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		found = true
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(v)
+		}
+	}
+	if !found {
+		return awsCredentials{}, false, nil
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, true, fmt.Errorf("profile %q in %s has no access key", profile, path)
+	}
+	return creds, true, nil
+}
+
+// assumeRoleWithWebIdentity exchanges a projected service account token for
+// role credentials. The STS call itself is unsigned.
+func assumeRoleWithWebIdentity(ctx context.Context, tokenFile, role string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("reading web identity token: %v", err)
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "helix-agent"
+	}
+	q := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	endpoint := fmt.Sprintf("https://sts.%s.amazonaws.com/", awsRegion(""))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(q.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := doAWSCredentialRequest(req, "STS")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var out struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &out); err != nil {
+		return awsCredentials{}, fmt.Errorf("parsing STS response: %v", err)
+	}
+	c := out.Credentials
+	return awsCredentials{AccessKeyID: c.AccessKeyId, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// roleCredentials is the JSON shape served by the ECS and EC2 endpoints.
+type roleCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (r roleCredentials) credentials() awsCredentials {
+	return awsCredentials{AccessKeyID: r.AccessKeyId, SecretAccessKey: r.SecretAccessKey, SessionToken: r.Token, Expires: r.Expiration}
+}
+
+// containerCredentials fetches task role credentials on ECS/Fargate (and
+// EKS Pod Identity, which uses the same full-URI contract).
+func containerCredentials(ctx context.Context) (awsCredentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("reading container authorization token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	body, err := doAWSCredentialRequest(req, "container credentials endpoint")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var rc roleCredentials
+	if err := json.Unmarshal(body, &rc); err != nil {
+		return awsCredentials{}, fmt.Errorf("parsing container credentials: %v", err)
+	}
+	return rc.credentials(), nil
+}
+
+const imdsBase = "http://169.254.169.254/latest"
+
+// instanceMetadataCredentials fetches the instance profile's credentials via
+// IMDSv2. Short timeouts keep this cheap when not running on EC2.
+func instanceMetadataCredentials(ctx context.Context) (awsCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsBase+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := doAWSCredentialRequest(req, "instance metadata")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsBase+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return doAWSCredentialRequest(req, "instance metadata")
+	}
+	role, err := get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	body, err := get("/meta-data/iam/security-credentials/" + name)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var rc roleCredentials
+	if err := json.Unmarshal(body, &rc); err != nil {
+		return awsCredentials{}, fmt.Errorf("parsing instance credentials: %v", err)
+	}
+	return rc.credentials(), nil
+}
+
+func doAWSCredentialRequest(req *http.Request, name string) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("contacting %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned status: %s, body: %s", name, resp.Status, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AzureOpenAIConfig is the "azure_openai" config section. Environment
+// variables override it: AZURE_OPENAI_ENDPOINT, AZURE_OPENAI_DEPLOYMENT and
+// OPENAI_API_VERSION. The API key is read from AZURE_OPENAI_API_KEY or the
+// "azure-openai" secret.
+type AzureOpenAIConfig struct {
+	Endpoint   string `json:"endpoint,omitempty"` // https://<resource>.openai.azure.com
+	Deployment string `json:"deployment,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+	// Auth is "key", "aad" (client credentials or AZURE_OPENAI_AD_TOKEN) or
+	// "managed-identity". Defaults to key when AZURE_OPENAI_API_KEY is set,
+	// aad otherwise.
+	Auth string `json:"auth,omitempty"`
+}
+
+const defaultAzureAPIVersion = "2024-10-21"
+
+// azureScope is the AAD scope for Azure OpenAI data-plane calls.
+const azureScope = "https://cognitiveservices.azure.com/.default"
+
+func azureConfig() AzureOpenAIConfig {
+	c := liveConfig().AzureOpenAI
+	if v := os.Getenv("AZURE_OPENAI_ENDPOINT"); v != "" {
+		c.Endpoint = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_DEPLOYMENT"); v != "" {
+		c.Deployment = v
+	}
+	if v := os.Getenv("OPENAI_API_VERSION"); v != "" {
+		c.APIVersion = v
+	}
+	if c.APIVersion == "" {
+		c.APIVersion = defaultAzureAPIVersion
+	}
+	if c.Auth == "" {
+		c.Auth = "aad"
+		if key, _ := lookupSecret("azure-openai", "AZURE_OPENAI_API_KEY"); key != "" {
+			c.Auth = "key"
+		}
+	}
+	return c
+}
+
+// callAzureOpenAI sends g to an Azure OpenAI deployment. g.Model is the
+// deployment name.
+func callAzureOpenAI(ctx context.Context, g genRequest) ([]Response, error) {
+	c := azureConfig()
+	if c.Endpoint == "" {
+		return nil, kindError(ErrConfig, "missing Azure OpenAI endpoint. Set AZURE_OPENAI_ENDPOINT or azure_openai.endpoint in the config")
+	}
+	if g.Model == "" {
+		return nil, kindError(ErrConfig, "missing Azure OpenAI deployment. Pass --model or set AZURE_OPENAI_DEPLOYMENT")
+	}
+
+	headers := map[string]string{}
+	switch c.Auth {
+	case "key":
+		key, err := lookupSecret("azure-openai", "AZURE_OPENAI_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing Azure OpenAI API key. Set AZURE_OPENAI_API_KEY")
+		}
+		headers["api-key"] = key
+	case "aad", "managed-identity":
+		token, err := azureTokens.get(ctx, c.Auth)
+		if err != nil {
+			return nil, err
+		}
+		headers["Authorization"] = "Bearer " + token
+	default:
+		return nil, fmt.Errorf("invalid azure_openai.auth %q: expected key, aad or managed-identity", c.Auth)
+	}
+
+	// The deployment in the URL picks the model.
+	oa := openAIRequest(g)
+	oa.Model = ""
+	return callOpenAICompatible(ctx, "Azure OpenAI", azureURL(c, g.Model), headers, oa, g.OnText)
+}
+
+func azureURL(c AzureOpenAIConfig, deployment string) string {
+	return fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+		strings.TrimSuffix(c.Endpoint, "/"), url.PathEscape(deployment), url.QueryEscape(c.APIVersion))
+}
+
+// azureTokenCache holds the current AAD access token so long-running modes
+// don't fetch one per request.
+type azureTokenCache struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var azureTokens = &azureTokenCache{}
+
+// get returns a valid token, refreshing it a few minutes before expiry.
+func (t *azureTokenCache) get(ctx context.Context, mode string) (string, error) {
+	if tok := os.Getenv("AZURE_OPENAI_AD_TOKEN"); tok != "" {
+		return tok, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > 5*time.Minute {
+		return t.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if mode == "managed-identity" {
+		req, err = azureManagedIdentityRequest(ctx)
+	} else {
+		req, err = azureClientCredentialsRequest(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting Azure AD token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", kindError(ErrAuth, "azure AD token endpoint returned status: %s, body: %s", resp.Status, string(body))
+	}
+
+	// expires_in is a number from AAD but a string from IMDS.
+	var tr struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", fmt.Errorf("parsing Azure AD token: %v", err)
+	}
+	secs, _ := tr.ExpiresIn.Int64()
+	if secs == 0 {
+		secs = 3600
+	}
+	t.token = tr.AccessToken
+	t.expires = time.Now().Add(time.Duration(secs) * time.Second)
+	return t.token, nil
+}
+
+// azureClientCredentialsRequest builds the service-principal token request
+// from AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET (or the
+// "azure-client-secret" secret).
+func azureClientCredentialsRequest(ctx context.Context) (*http.Request, error) {
+	tenant, client := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	secret, err := lookupSecret("azure-client-secret", "AZURE_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if tenant == "" || client == "" || secret == "" {
+		return nil, kindError(ErrAuth, "missing Azure AD credentials. Set AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, or AZURE_OPENAI_AD_TOKEN")
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {client},
+		"client_secret": {secret},
+		"scope":         {azureScope},
+	}
+	u := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", url.PathEscape(tenant))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// azureManagedIdentityRequest asks the instance metadata service for a token,
+// using AZURE_CLIENT_ID to pick a user-assigned identity when set.
+func azureManagedIdentityRequest(ctx context.Context) (*http.Request, error) {
+	q := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {strings.TrimSuffix(azureScope, "/.default")},
+	}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		q.Set("client_id", id)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff of a provider that rate-limits a batch without saying for how
+// long: doubling from batchBackoff up to batchMaxBackoff.
+const (
+	batchBackoff    = 5 * time.Second
+	batchMaxBackoff = 2 * time.Minute
+)
+
+// rateGate spaces a batch's calls to each provider. A provider that
+// rate-limits one task is paused for every task, for as long as it asked
+// (or a backoff), and gets half as many tasks at once, growing back by one
+// per round of tasks that go through; so the batch slows down as a whole
+// instead of each task retrying into the limit on its own.
+type rateGate struct {
+	max int
+
+	mu        sync.Mutex
+	providers map[string]*providerGate
+	wake      chan struct{} // closed and replaced when a slot frees up
+}
+
+type providerGate struct {
+	limit    float64
+	inFlight int
+	until    time.Time // paused until
+	strikes  int       // rate limits in a row, for the backoff
+
+	pauses int
+	paused time.Duration
+}
+
+func newRateGate(max int) *rateGate {
+	return &rateGate{max: max, providers: map[string]*providerGate{}, wake: make(chan struct{})}
+}
+
+func (g *rateGate) gate(provider string) *providerGate {
+	p := g.providers[provider]
+	if p == nil {
+		p = &providerGate{limit: float64(g.max)}
+		g.providers[provider] = p
+	}
+	return p
+}
+
+// acquire waits until provider isn't paused and has a slot.
+func (g *rateGate) acquire(ctx context.Context, provider string) error {
+	for {
+		g.mu.Lock()
+		p := g.gate(provider)
+		wait := time.Until(p.until)
+		if wait <= 0 && float64(p.inFlight) < p.limit {
+			p.inFlight++
+			g.mu.Unlock()
+			return nil
+		}
+		wake := g.wake
+		g.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-wake:
+		case <-expired:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// release gives back provider's slot. A rate-limited call pauses the
+// provider, for retry when it said, and returns the pause; calls that were
+// already in flight when it paused only make it longer if they were told
+// to wait longer.
+func (g *rateGate) release(provider string, limited bool, retry time.Duration) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	defer func() {
+		close(g.wake)
+		g.wake = make(chan struct{})
+	}()
+	p := g.gate(provider)
+	p.inFlight--
+	if !limited {
+		p.strikes = 0
+		p.limit = min(float64(g.max), p.limit+1/p.limit)
+		return 0
+	}
+	now := time.Now()
+	if now.Before(p.until) {
+		if end := now.Add(retry); end.After(p.until) {
+			p.paused += end.Sub(p.until)
+			p.until = end
+		}
+		return 0
+	}
+	p.strikes++
+	pause := retry
+	if pause <= 0 {
+		// Capped so that a long run of 429s can't overflow the shift.
+		pause = min(batchBackoff<<min(p.strikes-1, 16), batchMaxBackoff)
+	}
+	p.until = now.Add(pause)
+	p.limit = max(1, p.limit/2)
+	p.pauses++
+	p.paused += pause
+	return pause
+}
+
+// batchItem is a task of the batch and how often it was rate-limited.
+type batchItem struct {
+	index    int
+	req      TaskRequest
+	attempts int
+}
+
+// batchStats counts what a batch did.
+type batchStats struct {
+	ok, failed, notRun int
+	rescheduled        int
+}
+
+// batchScheduler runs a batch's tasks on a runner, at most concurrency at
+// once, rescheduling the rate-limited ones, and hands each result to emit.
+type batchScheduler struct {
+	r           *runner
+	gate        *rateGate
+	concurrency int
+	maxRetries  int
+	emit        func(index int, res TaskResult)
+
+	mu    sync.Mutex
+	stats batchStats
+}
+
+func (s *batchScheduler) run(ctx context.Context, items []batchItem) batchStats {
+	work := make(chan batchItem, len(items))
+	for _, it := range items {
+		work <- it
+	}
+	var left sync.WaitGroup
+	left.Add(len(items))
+	go func() {
+		left.Wait()
+		close(work)
+	}()
+	finish := func(it batchItem, res TaskResult) {
+		s.mu.Lock()
+		switch {
+		case res.Error == "":
+			s.stats.ok++
+		case res.ErrorKind == ErrCancelled && ctx.Err() != nil:
+			s.stats.notRun++
+		default:
+			s.stats.failed++
+		}
+		s.mu.Unlock()
+		s.emit(it.index, res)
+		left.Done()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range work {
+				if ctx.Err() != nil {
+					finish(it, TaskResult{ID: it.req.ID, Provider: it.req.Provider, Error: "not run: the batch was interrupted", ErrorKind: ErrCancelled})
+					continue
+				}
+				provider := it.req.Provider
+				if err := s.gate.acquire(ctx, provider); err != nil {
+					finish(it, TaskResult{ID: it.req.ID, Provider: provider, Error: "not run: the batch was interrupted", ErrorKind: ErrCancelled})
+					continue
+				}
+				res, err := s.r.run(ctx, it.req)
+				limited := errorKind(err) == ErrRateLimited
+				pause := s.gate.release(provider, limited, retryAfter(err))
+				if pause > 0 {
+					statusf("[Sub-Agent] %s rate-limited task %s: %v; pausing %s for %s\n", provider, it.req.ID, err, provider, pause.Round(time.Second))
+				}
+				if limited && it.attempts < s.maxRetries && ctx.Err() == nil {
+					it.attempts++
+					s.mu.Lock()
+					s.stats.rescheduled++
+					s.mu.Unlock()
+					work <- it
+					continue
+				}
+				finish(it, res)
+			}
+		}()
+	}
+	wg.Wait()
+	return s.stats
+}
+
+// readBatch reads one TaskRequest per line of JSONL.
+func readBatch(r io.Reader) ([]TaskRequest, error) {
+	var reqs []TaskRequest
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var req TaskRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if strings.TrimSpace(req.Task) == "" && req.Contract == nil {
+			return nil, fmt.Errorf("line %d: no task", n)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, sc.Err()
+}
+
+// batchCommand implements `batch`: run a file of tasks and write their
+// results in the same order, as JSONL or as a CSV file with the answers in
+// a new column.
+func batchCommand(fs *flag.FlagSet) func(args []string) {
+	in := fs.String("in", "-", "JSONL file of tasks, one TaskRequest per line, or CSV file with a header row ('-' is stdin)")
+	out := fs.String("out", "-", "File to write the results to in the format of --in and the order of the tasks ('-' is stdout)")
+	format := fs.String("batch-format", "", "Format of --in and --out: jsonl or csv (default: csv for a .csv --in, else jsonl)")
+	column := fs.String("column", "", "With CSV, the column that is each row's task")
+	taskTmpl := fs.String("task-template", "", "With CSV, the task as a template over the row's columns ({{.name}}), instead of --column")
+	idColumn := fs.String("id-column", "", "With CSV, the column of each row's task ID")
+	outputColumn := fs.String("output-column", "output", "With CSV, the column added for each row's answer")
+	errorColumn := fs.String("error-column", "error", "With CSV, the column added for each row's error ('' leaves it out)")
+	concurrency := fs.Int("concurrency", 4, "Tasks run at once")
+	maxRetries := fs.Int("max-retries", 5, "How often a rate-limited task is rescheduled before it counts as failed")
+	provider := fs.String("provider", "local", "Provider of the tasks that don't name one")
+	model := fs.String("model", "", "Model of the tasks that don't name a provider")
+	dedupe := fs.String("dedupe", DedupeExact, "Run duplicate tasks once and copy the result to the others: off, exact (the same request up to case and spacing) or similar (also by embedding)")
+	similarity := fs.Float64("similarity", 0.95, "Cosine similarity from 0 to 1 at which --dedupe similar takes two tasks for duplicates")
+	embedProvider := fs.String("embed-provider", "local", "Provider of the embeddings for --dedupe similar")
+	embedModel := fs.String("embed-model", "", "Embedding model for --dedupe similar (default: the provider's)")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		if *concurrency < 1 || *maxRetries < 0 {
+			fatal(kindError(ErrConfig, "--concurrency must be at least 1 and --max-retries not negative"))
+		}
+		if err := validDedupe(*dedupe); err != nil {
+			fatal(configError(err))
+		}
+		if *similarity <= 0 || *similarity > 1 {
+			fatal(kindError(ErrConfig, "--similarity must be above 0 and at most 1"))
+		}
+		bf, err := batchFormat(*format, *in)
+		if err != nil {
+			fatal(configError(err))
+		}
+		var sheet *csvBatch
+		if bf == BatchCSV {
+			if (*column == "") == (*taskTmpl == "") {
+				fatal(kindError(ErrConfig, "a CSV batch needs one of --column and --task-template"))
+			}
+			sheet = &csvBatch{outputColumn: *outputColumn, errorColumn: *errorColumn}
+		}
+		src, err := openBatch(*in)
+		if err != nil {
+			fatal(configError(err))
+		}
+		var reqs []TaskRequest
+		if sheet != nil {
+			reqs, err = readCSVBatch(src, *column, *taskTmpl, *idColumn, sheet)
+		} else {
+			reqs, err = readBatch(src)
+		}
+		src.Close()
+		if err != nil {
+			fatal(kindError(ErrConfig, "reading %s: %v", *in, err))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		w := io.Writer(os.Stdout)
+		if *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				fatal(configError(err))
+			}
+			defer f.Close()
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		write := func(_ int, res *TaskResult) error { return enc.Encode(res) }
+		if sheet != nil {
+			if write, err = sheet.writer(w); err != nil {
+				fatal(fmt.Errorf("writing results: %v", err))
+			}
+		}
+
+		items := make([]batchItem, len(reqs))
+		for i, req := range reqs {
+			if req.Provider == "" {
+				req.Provider = *provider
+				if req.Model == "" {
+					req.Model = *model
+				}
+			}
+			if req.ID == "" {
+				// One ID over the attempts of a rescheduled task.
+				req.ID = newID()
+			}
+			items[i] = batchItem{index: i, req: req}
+		}
+
+		ctx, stop := shutdownSignal()
+		defer stop()
+		// Duplicates are left out of the run and get the result of the
+		// task they duplicate.
+		run := items
+		dups := map[int][]int{}
+		if *dedupe != DedupeOff {
+			d := &batchDedupe{mode: *dedupe, similarity: *similarity, provider: *embedProvider, model: *embedModel, key: key}
+			run = nil
+			for i, of := range d.groups(ctx, items) {
+				if of == i {
+					run = append(run, items[i])
+				} else {
+					dups[of] = append(dups[of], i)
+				}
+			}
+		}
+
+		// Results go out in task order as soon as the ones before are in.
+		var mu sync.Mutex
+		results := make([]*TaskResult, len(items))
+		next := 0
+		var firstErr error
+		var dupStats batchStats
+		put := func(i int, res TaskResult) {
+			results[i] = &res
+			status := "ok"
+			if res.Error != "" {
+				status = "failed: " + res.Error
+				if firstErr == nil {
+					firstErr = &TaskError{Kind: res.ErrorKind, Err: fmt.Errorf("%s", res.Error)}
+				}
+			}
+			if res.DuplicateOf != "" {
+				status += " (duplicate of " + res.DuplicateOf + ")"
+			}
+			statusf("[Sub-Agent] [%d/%d] %s %s\n", i+1, len(items), res.ID, status)
+		}
+		emit := func(i int, res TaskResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			put(i, res)
+			for _, d := range dups[i] {
+				switch {
+				case res.Error == "":
+					dupStats.ok++
+				case res.ErrorKind == ErrCancelled && ctx.Err() != nil:
+					dupStats.notRun++
+				default:
+					dupStats.failed++
+				}
+				put(d, fanOut(res, items[i].req, items[d].req))
+			}
+			for ; next < len(results) && results[next] != nil; next++ {
+				if err := write(next, results[next]); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: writing results: %v\n", err)
+				}
+				results[next] = &TaskResult{} // written; drop the answer
+			}
+		}
+
+		gate := newRateGate(*concurrency)
+		s := &batchScheduler{r: r, gate: gate, concurrency: *concurrency, maxRetries: *maxRetries, emit: emit}
+		start := time.Now()
+		stats := s.run(ctx, run)
+		stats.ok += dupStats.ok
+		stats.failed += dupStats.failed
+		stats.notRun += dupStats.notRun
+
+		statusf("[Sub-Agent] Batch of %d task(s) in %s: %d ok, %d failed", len(items), time.Since(start).Round(time.Second), stats.ok, stats.failed)
+		if stats.notRun > 0 {
+			statusf(", %d not run", stats.notRun)
+		}
+		statusf("\n")
+		if saved := len(items) - len(run); saved > 0 {
+			statusf("[Sub-Agent] %d duplicate task(s) got the result of the task they repeat: saved %d call(s)\n", saved, saved)
+		}
+		if stats.rescheduled > 0 {
+			statusf("[Sub-Agent] Rescheduled %d rate-limited task(s)\n", stats.rescheduled)
+		}
+		for _, name := range sortedKeys(gate.providers) {
+			if p := gate.providers[name]; p.pauses > 0 {
+				statusf("[Sub-Agent]   %-16s paused %d time(s), %s in all\n", name, p.pauses, p.paused.Round(time.Second))
+			}
+		}
+		if firstErr != nil {
+			os.Exit(exitCode(firstErr))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Formats of a batch's tasks and results.
+const (
+	BatchJSONL = "jsonl"
+	BatchCSV   = "csv"
+)
+
+// csvBatch is a batch read from a spreadsheet: each row is a task, and is
+// written back with its result in new columns.
+type csvBatch struct {
+	header []string
+	rows   [][]string
+
+	outputColumn string
+	errorColumn  string // "" leaves errors out
+}
+
+// readCSVBatch reads a CSV file with a header row. Each row's task is the
+// column named column, or else tmpl rendered over the row ({{.name}} or
+// {{index . "a name"}}); idColumn, if set, names the column of its ID.
+func readCSVBatch(r io.Reader, column, tmpl, idColumn string, b *csvBatch) ([]TaskRequest, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // Excel's BOM
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{b.outputColumn, b.errorColumn} {
+		if _, ok := col[name]; ok && name != "" {
+			return nil, fmt.Errorf("the file already has a %s column; pick another with --output-column or --error-column", name)
+		}
+	}
+	for _, name := range []string{column, idColumn} {
+		if _, ok := col[name]; !ok && name != "" {
+			return nil, fmt.Errorf("no column %s among %s", name, strings.Join(header, ", "))
+		}
+	}
+	t := taskTemplate{dir: "."}
+	b.header = header
+	var reqs []TaskRequest
+	for n := 2; ; n++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var req TaskRequest
+		if tmpl != "" {
+			vars := make(map[string]string, len(header))
+			for name, i := range col {
+				vars[name] = row[i]
+			}
+			if req.Task, err = t.render(tmpl, vars); err != nil {
+				return nil, fmt.Errorf("row %d: %v", n, err)
+			}
+		} else {
+			req.Task = row[col[column]]
+		}
+		if strings.TrimSpace(req.Task) == "" {
+			return nil, fmt.Errorf("row %d: no task", n)
+		}
+		if idColumn != "" {
+			req.ID = row[col[idColumn]]
+		}
+		b.rows = append(b.rows, row)
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// writer writes the header and returns a function writing row i with res.
+func (b *csvBatch) writer(w io.Writer) (func(i int, res *TaskResult) error, error) {
+	cw := csv.NewWriter(w)
+	header := append(append([]string(nil), b.header...), b.outputColumn)
+	if b.errorColumn != "" {
+		header = append(header, b.errorColumn)
+	}
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	cw.Flush()
+	return func(i int, res *TaskResult) error {
+		row := append(b.rows[i], res.Output)
+		if b.errorColumn != "" {
+			row = append(row, res.Error)
+		}
+		b.rows[i] = nil
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	}, nil
+}
+
+// batchFormat is format, or else the one --in's extension names.
+func batchFormat(format, in string) (string, error) {
+	switch format {
+	case BatchJSONL, BatchCSV:
+		return format, nil
+	case "":
+		if strings.HasSuffix(strings.ToLower(in), ".csv") {
+			return BatchCSV, nil
+		}
+		return BatchJSONL, nil
+	}
+	return "", fmt.Errorf("unknown --batch-format %q: use jsonl or csv", format)
+}
+
+// openBatch opens --in, '-' being stdin.
+func openBatch(in string) (io.ReadCloser, error) {
+	if in == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(in)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Ways `batch --dedupe` finds duplicate tasks.
+const (
+	DedupeOff     = "off"
+	DedupeExact   = "exact"   // the same request, up to case and spacing of the task
+	DedupeSimilar = "similar" // also tasks whose embeddings are --similarity alike
+)
+
+// batchEmbedBatch is how many tasks --dedupe similar embeds per call.
+const batchEmbedBatch = 64
+
+// batchDedupe finds the duplicates of a batch's tasks.
+type batchDedupe struct {
+	mode       string
+	similarity float64
+	provider   string // of the embeddings
+	model      string
+	key        string
+}
+
+// requestKey hashes what of req shapes the answer: all of it but its ID
+// and tags, with the task normalized like dedupeKey. With task false the
+// task and input are left out, which is what similar tasks must share.
+func requestKey(req TaskRequest, task bool) string {
+	req.ID, req.Tags = "", nil
+	if task {
+		req.Task = dedupeKey(req.Task)
+	} else {
+		req.Task, req.Input = "", ""
+	}
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// groups returns, for each item, the index of the item run for it: itself
+// for the first of each set of duplicates. If the embeddings fail, it
+// warns and keeps to the exact duplicates.
+func (d *batchDedupe) groups(ctx context.Context, items []batchItem) []int {
+	of := make([]int, len(items))
+	first := map[string]int{}
+	for i, it := range items {
+		k := requestKey(it.req, true)
+		if j, ok := first[k]; ok {
+			of[i] = j
+			continue
+		}
+		first[k] = i
+		of[i] = i
+	}
+	if d.mode != DedupeSimilar {
+		return of
+	}
+
+	var pending []int
+	for i := range items {
+		if of[i] == i {
+			pending = append(pending, i)
+		}
+	}
+	vecs := make(map[int][]float32, len(pending))
+	for start := 0; start < len(pending); start += batchEmbedBatch {
+		batch := pending[start:min(start+batchEmbedBatch, len(pending))]
+		texts := make([]string, len(batch))
+		for n, i := range batch {
+			texts[n] = items[i].req.Task
+			if items[i].req.Input != "" {
+				texts[n] += "\n\n" + items[i].req.Input
+			}
+		}
+		got, err := embed(ctx, d.provider, d.model, texts, d.key)
+		if err != nil {
+			statusf("[Sub-Agent] Warning: embedding the tasks for --dedupe similar: %v; only exact duplicates are merged\n", err)
+			return of
+		}
+		for n, i := range batch {
+			vecs[i] = got[n]
+		}
+	}
+	// Each task joins the first kept one it is alike enough, among those
+	// that share everything but the task and input.
+	kept := map[string][]int{}
+	for _, i := range pending {
+		rest := requestKey(items[i].req, false)
+		for _, j := range kept[rest] {
+			if cosine(vecs[i], vecs[j]) >= d.similarity {
+				of[i] = j
+				break
+			}
+		}
+		if of[i] == i {
+			kept[rest] = append(kept[rest], i)
+		}
+	}
+	for i := range of {
+		of[i] = of[of[i]]
+	}
+	return of
+}
+
+// fanOut is res, the result of the task run, as the result of its
+// duplicate dup.
+func fanOut(res TaskResult, runFor, dup TaskRequest) TaskResult {
+	res.ID, res.Tags, res.DuplicateOf = dup.ID, dup.Tags, runFor.ID
+	// The call was paid once, by the task run.
+	res.Usage = nil
+	return res
+}
+
+func validDedupe(mode string) error {
+	switch mode {
+	case DedupeOff, DedupeExact, DedupeSimilar:
+		return nil
+	}
+	return fmt.Errorf("unknown --dedupe %q: use off, exact or similar", mode)
+}
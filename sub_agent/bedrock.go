@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// BedrockConfig is the "bedrock" config section. BEDROCK_MODEL and the
+// usual AWS_REGION variables override it.
+type BedrockConfig struct {
+	Region string `json:"region,omitempty"`
+	Model  string `json:"model,omitempty"` // default model ID
+}
+
+// Data structs for the Bedrock Converse API, which gives Claude, Llama,
+// Titan and friends one request shape.
+type BedrockConverseRequest struct {
+	Messages        []BedrockMessage        `json:"messages"`
+	InferenceConfig *BedrockInferenceConfig `json:"inferenceConfig,omitempty"`
+	// AdditionalModelRequestFields carries model-specific settings such
+	// as Claude's extended thinking.
+	AdditionalModelRequestFields map[string]interface{} `json:"additionalModelRequestFields,omitempty"`
+}
+
+type BedrockInferenceConfig struct {
+	MaxTokens     int      `json:"maxTokens,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+}
+
+type BedrockMessage struct {
+	Role    string                `json:"role"`
+	Content []BedrockContentBlock `json:"content"`
+}
+
+type BedrockContentBlock struct {
+	Text  string        `json:"text,omitempty"`
+	Image *BedrockImage `json:"image,omitempty"`
+	// ReasoningContent is Claude's thinking, in responses only.
+	ReasoningContent *struct {
+		ReasoningText struct {
+			Text string `json:"text"`
+		} `json:"reasoningText"`
+	} `json:"reasoningContent,omitempty"`
+	// ToolUse is a tool call, in responses only.
+	ToolUse *struct {
+		ToolUseID string          `json:"toolUseId"`
+		Name      string          `json:"name"`
+		Input     json.RawMessage `json:"input"`
+	} `json:"toolUse,omitempty"`
+}
+
+type BedrockImage struct {
+	Format string             `json:"format"` // png, jpeg, gif or webp
+	Source BedrockImageSource `json:"source"`
+}
+
+type BedrockImageSource struct {
+	Bytes []byte `json:"bytes"`
+}
+
+type BedrockConverseResponse struct {
+	Output struct {
+		Message BedrockMessage `json:"message"`
+	} `json:"output"`
+	StopReason string `json:"stopReason"`
+	Usage      struct {
+		InputTokens  int `json:"inputTokens"`
+		OutputTokens int `json:"outputTokens"`
+	} `json:"usage"`
+}
+
+func bedrockModel() string {
+	if m := os.Getenv("BEDROCK_MODEL"); m != "" {
+		return m
+	}
+	return liveConfig().Bedrock.Model
+}
+
+func bedrockPayload(g genRequest) BedrockConverseRequest {
+	content := []BedrockContentBlock{{Text: g.Prompt}}
+	for _, img := range g.Images {
+		content = append(content, BedrockContentBlock{Image: &BedrockImage{
+			Format: strings.TrimPrefix(img.MIMEType, "image/"),
+			Source: BedrockImageSource{Bytes: img.Data},
+		}})
+	}
+	req := BedrockConverseRequest{Messages: []BedrockMessage{{Role: "user", Content: content}}}
+	if len(g.Stop) > 0 || g.Temperature != nil {
+		req.InferenceConfig = &BedrockInferenceConfig{StopSequences: g.Stop, Temperature: g.Temperature}
+	}
+	// Claude thinks only when given a budget, which must fit in maxTokens
+	// with room left for the answer.
+	if n, ok := g.Reasoning.thinkingBudget(); ok && n > 0 {
+		if req.InferenceConfig == nil {
+			req.InferenceConfig = &BedrockInferenceConfig{}
+		}
+		req.InferenceConfig.MaxTokens = n + 4096
+		req.AdditionalModelRequestFields = map[string]interface{}{
+			"thinking": map[string]interface{}{"type": "enabled", "budget_tokens": n},
+		}
+	}
+	return req
+}
+
+// bedrockURL is the Converse endpoint for modelID. Model IDs contain ':'
+// which must be percent-encoded in the path for the signature to match.
+func bedrockURL(region, modelID string) *url.URL {
+	return &url.URL{
+		Scheme:  "https",
+		Host:    fmt.Sprintf("bedrock-runtime.%s.amazonaws.com", region),
+		Path:    "/model/" + modelID + "/converse",
+		RawPath: "/model/" + awsURIEncode(modelID, true) + "/converse",
+	}
+}
+
+// callBedrock sends g to a Bedrock model via Converse, signing with SigV4
+// using the standard AWS credential chain (so IAM roles on EC2/EKS work).
+func callBedrock(ctx context.Context, g genRequest) (Response, error) {
+	if g.Model == "" {
+		return Response{}, kindError(ErrConfig, "missing Bedrock model ID. Pass --model (e.g. anthropic.claude-3-5-sonnet-20240620-v1:0) or set BEDROCK_MODEL")
+	}
+	region := awsRegion(liveConfig().Bedrock.Region)
+
+	// 1. Construct Payload
+	jsonData, _ := json.Marshal(bedrockPayload(g))
+
+	// 2. Call Bedrock
+	u := bedrockURL(region, g.Model)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(jsonData))
+	if err != nil {
+		return Response{}, fmt.Errorf("building Bedrock request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signer := sigV4Signer{creds: awsCreds.retrieve, region: region, service: "bedrock"}
+	if err := signer.sign(req, hexSHA256(jsonData)); err != nil {
+		return Response{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if err := cancelledCall(ctx, "Bedrock"); err != nil {
+			return Response{}, err
+		}
+		return Response{}, kindError(ErrUnreachable, "connecting to Bedrock in %s: %w", region, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return Response{}, providerError("bedrock", resp, body)
+	}
+
+	// 3. Parse Response
+	var bResp BedrockConverseResponse
+	if err := json.Unmarshal(body, &bResp); err != nil {
+		return Response{}, fmt.Errorf("parsing Bedrock response: %v", err)
+	}
+	var text, thinking strings.Builder
+	var calls []ProviderToolCall
+	for _, block := range bResp.Output.Message.Content {
+		text.WriteString(block.Text)
+		if tu := block.ToolUse; tu != nil {
+			calls = append(calls, ProviderToolCall{ID: tu.ToolUseID, Name: tu.Name, Arguments: tu.Input})
+		}
+		if rc := block.ReasoningContent; rc != nil {
+			thinking.WriteString(rc.ReasoningText.Text)
+		}
+	}
+	usage := Usage{PromptTokens: bResp.Usage.InputTokens, OutputTokens: bResp.Usage.OutputTokens}
+	if thinking.Len() > 0 {
+		usage.ThinkingTokens = min(estimateTokens(thinking.String()), usage.OutputTokens)
+		usage.OutputTokens -= usage.ThinkingTokens
+	}
+	recordUsage(ctx, usage)
+	if text.Len() == 0 && len(calls) == 0 {
+		if bResp.StopReason == "guardrail_intervened" || bResp.StopReason == "content_filtered" {
+			return Response{}, kindError(ErrSafety, "bedrock blocked the response (%s)", bResp.StopReason)
+		}
+		return Response{}, kindError(ErrEmpty, "empty response from Bedrock")
+	}
+	r := Response{Text: withThinking(thinking.String(), text.String()), FinishReason: bedrockFinish(bResp.StopReason), Usage: usage, ToolCalls: calls, Raw: body}
+	if r.FinishReason == FinishSafety {
+		r.Safety = &SafetyInfo{Blocked: true, Reason: bResp.StopReason}
+	}
+	return r, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What --binary does with binary context files and piped input, which
+// would otherwise waste the window on bytes the model can't read, and once
+// in JSON, come out mangled.
+const (
+	BinaryAuto    = "auto"    // images go to vision models as images; the rest is skipped
+	BinarySkip    = "skip"    // left out, with a warning
+	BinaryStrings = "strings" // the printable strings in it, as strings(1) finds them
+	BinaryHex     = "hex"     // a hex dump of its start
+	BinaryRefuse  = "refuse"  // the task fails
+)
+
+func validBinaryPolicy(p string) bool {
+	switch p {
+	case BinaryAuto, BinarySkip, BinaryStrings, BinaryHex, BinaryRefuse:
+		return true
+	}
+	return false
+}
+
+// BinaryAttachment is a binary context file or input and what became of it.
+type BinaryAttachment struct {
+	Path     string `json:"path"` // "input" for piped input
+	MIMEType string `json:"mime_type"`
+	Bytes    int    `json:"bytes"`
+	Handling string `json:"handling"` // image, strings, hex or skipped
+}
+
+const (
+	// binaryHexBytes is how much of a file --binary hex dumps.
+	binaryHexBytes = 2048
+	// binaryStringsMax caps the text --binary strings extracts.
+	binaryStringsMax = 64 << 10
+	// minStringRun is the shortest run of printable characters kept, as
+	// strings(1) does.
+	minStringRun = 4
+)
+
+// looksBinary reports whether text is binary rather than text: it holds a
+// NUL byte or invalid UTF-8, or has already been through JSON, which
+// replaced invalid bytes with U+FFFD, and is a tenth replacement and
+// control characters.
+func looksBinary(text string) bool {
+	sample := text[:min(len(text), 8000)]
+	if strings.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	// A sample may cut a character in two.
+	for i := 0; i < utf8.UTFMax && len(sample) > 0 && !utf8.ValidString(sample); i++ {
+		sample = sample[:len(sample)-1]
+	}
+	if !utf8.ValidString(sample) {
+		return true
+	}
+	odd, n := 0, 0
+	for _, r := range sample {
+		n++
+		if r == utf8.RuneError || unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' && r != '\f' {
+			odd++
+		}
+	}
+	return n > 0 && odd*10 >= n
+}
+
+// sniffMIME types data by the name's extension and then by its content.
+func sniffMIME(name string, data []byte) string {
+	typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(name))))
+	if typ == "" || typ == "application/octet-stream" {
+		typ, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	return typ
+}
+
+// printableStrings returns the runs of at least minStringRun printable
+// ASCII characters in data, one per line.
+func printableStrings(data []byte) string {
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		if start >= 0 && end-start >= minStringRun && b.Len() < binaryStringsMax {
+			b.Write(data[start:end])
+			b.WriteByte('\n')
+		}
+		start = -1
+	}
+	for i, c := range data {
+		if c >= 0x20 && c < 0x7f || c == '\t' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		flush(i)
+	}
+	flush(len(data))
+	return strings.TrimRight(truncateRunes(b.String(), binaryStringsMax), "\n")
+}
+
+// hexDump formats the start of data as hexdump -C does.
+func hexDump(data []byte) string {
+	var b strings.Builder
+	for off := 0; off < min(len(data), binaryHexBytes); off += 16 {
+		line := data[off:min(off+16, len(data))]
+		fmt.Fprintf(&b, "%08x ", off)
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				b.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(&b, " %02x", line[i])
+			} else {
+				b.WriteString("   ")
+			}
+		}
+		b.WriteString("  |")
+		for _, c := range line {
+			if c < 0x20 || c >= 0x7f {
+				c = '.'
+			}
+			b.WriteByte(c)
+		}
+		b.WriteString("|\n")
+	}
+	if len(data) > binaryHexBytes {
+		fmt.Fprintf(&b, "[... %d more bytes ...]\n", len(data)-binaryHexBytes)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// binaryFor is the --binary policy of req.
+func (r *runner) binaryFor(req TaskRequest) string {
+	if req.Binary != "" {
+		return req.Binary
+	}
+	return r.binary
+}
+
+// handleBinary applies the --binary policy to req's binary context files
+// and input, before they are packed into the prompt.
+func (r *runner) handleBinary(req *TaskRequest, res *TaskResult) error {
+	policy := r.binaryFor(*req)
+	if !validBinaryPolicy(policy) {
+		return kindError(ErrConfig, "invalid binary policy %q: expected auto, skip, strings, hex or refuse", policy)
+	}
+	var skipped []string
+	// handle returns the text to pack in place of data, if any.
+	handle := func(name string, data []byte) (string, bool, error) {
+		a := BinaryAttachment{Path: name, MIMEType: sniffMIME(name, data), Bytes: len(data)}
+		var text string
+		switch policy {
+		case BinaryRefuse:
+			return "", false, kindError(ErrConfig, "%s is binary (%s); pass --binary strings, hex or skip to send it anyway", name, a.MIMEType)
+		case BinaryStrings:
+			a.Handling, text = "strings", fmt.Sprintf("[binary %s, %d bytes; the printable strings in it:]\n%s", a.MIMEType, len(data), printableStrings(data))
+		case BinaryHex:
+			a.Handling, text = "hex", fmt.Sprintf("[binary %s, %d bytes; hex dump:]\n%s", a.MIMEType, len(data), hexDump(data))
+		case BinaryAuto:
+			if info, _ := lookupModel(req.Provider, req.Model); info.Vision && strings.HasPrefix(a.MIMEType, "image/") && http.DetectContentType(data) == a.MIMEType {
+				req.Images = append(req.Images, ImageInput{MIMEType: a.MIMEType, Data: data})
+				a.Handling = "image"
+				break
+			}
+			fallthrough
+		default:
+			a.Handling = "skipped"
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", name, a.MIMEType))
+		}
+		res.Binary = append(res.Binary, a)
+		return text, text != "", nil
+	}
+
+	var files []ContextFile
+	for _, f := range req.ContextFiles {
+		data := f.Data
+		if data == nil {
+			if !looksBinary(f.Content) {
+				files = append(files, f)
+				continue
+			}
+			data = []byte(f.Content)
+		} else if !looksBinary(string(data)) {
+			files = append(files, ContextFile{Path: f.Path, Content: string(data)})
+			continue
+		}
+		text, ok, err := handle(f.Path, data)
+		if err != nil {
+			return err
+		}
+		if ok {
+			files = append(files, ContextFile{Path: f.Path, Content: text})
+		}
+	}
+	req.ContextFiles = files
+	if req.Input != "" && looksBinary(req.Input) {
+		text, _, err := handle("input", []byte(req.Input))
+		if err != nil {
+			return err
+		}
+		req.Input = text
+	}
+	if len(skipped) > 0 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("left out binary %s; see --binary", strings.Join(skipped, ", ")))
+	}
+	return nil
+}
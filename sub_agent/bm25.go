@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Knowledge base search modes.
+const (
+	SearchHybrid  = "hybrid"  // BM25 and vector rankings fused with RRF
+	SearchVector  = "vector"  // embeddings only
+	SearchKeyword = "keyword" // BM25 only
+)
+
+func validSearchMode(m string) bool {
+	switch m {
+	case SearchHybrid, SearchVector, SearchKeyword:
+		return true
+	}
+	return false
+}
+
+// BM25 parameters, and RRF's k, which damps the weight of the top ranks.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+	rrfK   = 60
+)
+
+// termRe keeps identifiers whole: pg_dump, ERR_CONN_RESET, k8s.io/api and
+// E-1234 are single terms, so that they match exactly.
+var termRe = regexp.MustCompile(`[\p{L}\p{N}_]+(?:[.\-:/][\p{L}\p{N}_]+)*`)
+
+func bm25Terms(text string) []string {
+	terms := termRe.FindAllString(strings.ToLower(text), -1)
+	// Also index the parts of compound identifiers, so "pg_restore"
+	// matches a query asking about "restore".
+	for _, t := range terms {
+		if strings.ContainsAny(t, "_.-:/") {
+			for _, p := range strings.FieldsFunc(t, func(r rune) bool { return strings.ContainsRune("_.-:/", r) }) {
+				terms = append(terms, p)
+			}
+		}
+	}
+	return terms
+}
+
+// bm25Index is built from a knowledge base's chunks when it is searched.
+type bm25Index struct {
+	tf     []map[string]int // term counts per chunk
+	length []int
+	avgLen float64
+	df     map[string]int
+}
+
+func newBM25Index(chunks []kbChunk) *bm25Index {
+	ix := &bm25Index{tf: make([]map[string]int, len(chunks)), length: make([]int, len(chunks)), df: map[string]int{}}
+	total := 0
+	for i, c := range chunks {
+		tf := map[string]int{}
+		terms := bm25Terms(c.Text)
+		for _, t := range terms {
+			tf[t]++
+		}
+		for t := range tf {
+			ix.df[t]++
+		}
+		ix.tf[i], ix.length[i] = tf, len(terms)
+		total += len(terms)
+	}
+	if len(chunks) > 0 {
+		ix.avgLen = float64(total) / float64(len(chunks))
+	}
+	return ix
+}
+
+// score is chunk i's BM25 score for the query terms.
+func (ix *bm25Index) score(i int, query []string) float64 {
+	n := float64(len(ix.tf))
+	var s float64
+	for _, t := range query {
+		f := float64(ix.tf[i][t])
+		if f == 0 {
+			continue
+		}
+		df := float64(ix.df[t])
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		s += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(ix.length[i])/ix.avgLen))
+	}
+	return s
+}
+
+// uniqueTerms drops repeated query terms, which would otherwise count twice.
+func uniqueTerms(terms []string) []string {
+	seen := map[string]bool{}
+	out := terms[:0]
+	for _, t := range terms {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// fuseRRF merges rankings of chunk indexes by reciprocal rank fusion:
+// each list adds 1/(rrfK+rank) to a chunk's score. Ties keep the order in
+// which chunks first appear.
+func fuseRRF(rankings ...[]int) ([]int, map[int]float64) {
+	scores := map[int]float64{}
+	var order []int
+	for _, ranking := range rankings {
+		for rank, i := range ranking {
+			if _, ok := scores[i]; !ok {
+				order = append(order, i)
+			}
+			scores[i] += 1 / float64(rrfK+rank+1)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	return order, scores
+}
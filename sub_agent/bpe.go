@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bpeEncoding is a tiktoken-style byte-level BPE vocabulary.
+type bpeEncoding struct {
+	name  string
+	ranks map[string]int
+	split *regexp.Regexp
+}
+
+// The pre-tokenizer patterns of OpenAI's encodings, minus the \s+(?!\S)
+// alternative that RE2 can't express; pieces handles that case instead.
+var bpeEncodings = map[string]string{
+	"cl100k_base": `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`,
+	"o200k_base": `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+`,
+}
+
+// bpeEncodingURL is where a missing vocabulary is downloaded from.
+const bpeEncodingURL = "https://openaipublic.blob.core.windows.net/encodings/%s.tiktoken"
+
+// openAIEncoding picks the encoding of an OpenAI model, "" if it isn't one.
+func openAIEncoding(modelName string) string {
+	m := strings.ToLower(modelName)
+	if i := strings.LastIndex(m, "/"); i >= 0 {
+		m = m[i+1:] // openrouter-style vendor/model
+	}
+	switch {
+	case strings.HasPrefix(m, "gpt-4o"), strings.HasPrefix(m, "gpt-4.1"), strings.HasPrefix(m, "gpt-4.5"),
+		strings.HasPrefix(m, "gpt-5"), strings.HasPrefix(m, "o1"), strings.HasPrefix(m, "o3"), strings.HasPrefix(m, "o4"):
+		return "o200k_base"
+	case strings.HasPrefix(m, "gpt-4"), strings.HasPrefix(m, "gpt-3.5"), strings.HasPrefix(m, "gpt-35"),
+		strings.HasPrefix(m, "text-embedding-"):
+		return "cl100k_base"
+	}
+	return ""
+}
+
+func tokenizerDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("locating tokenizer cache: %v", err)
+	}
+	return filepath.Join(dir, "helix", "tokenizers"), nil
+}
+
+var (
+	bpeMu    sync.Mutex
+	bpeCache = map[string]*bpeEncoding{}
+)
+
+// loadBPE returns the named encoding, reading it from the tokenizer cache
+// and downloading it there on first use.
+func loadBPE(name string) (*bpeEncoding, error) {
+	pattern, ok := bpeEncodings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	bpeMu.Lock()
+	defer bpeMu.Unlock()
+	if enc := bpeCache[name]; enc != nil {
+		return enc, nil
+	}
+	dir, err := tokenizerDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name+".tiktoken")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if data, err = fetchBPE(name); err == nil {
+			if err := os.MkdirAll(dir, 0o755); err == nil {
+				writeFileAtomic(path, data)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading %s (place it at %s to work offline): %v", name, path, err)
+	}
+	ranks, err := parseTiktoken(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	enc := &bpeEncoding{name: name, ranks: ranks, split: regexp.MustCompile(pattern)}
+	bpeCache[name] = enc
+	return enc, nil
+}
+
+func fetchBPE(name string) ([]byte, error) {
+	resp, err := http.Get(fmt.Sprintf(bpeEncodingURL, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("downloading: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseTiktoken(data); err != nil {
+		return nil, fmt.Errorf("downloaded file: %v", err)
+	}
+	return data, nil
+}
+
+// parseTiktoken reads "base64(token) rank" lines.
+func parseTiktoken(data []byte) (map[string]int, error) {
+	ranks := map[string]int{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		tok, rank, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected token and rank", n)
+		}
+		b, err := base64.StdEncoding.DecodeString(tok)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		r, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		ranks[string(b)] = r
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) < 256 {
+		return nil, fmt.Errorf("only %d tokens; not a tiktoken vocabulary", len(ranks))
+	}
+	return ranks, nil
+}
+
+// count returns the number of tokens in text.
+func (e *bpeEncoding) count(text string) int {
+	n := 0
+	for _, p := range e.pieces(text) {
+		if _, ok := e.ranks[p]; ok {
+			n++
+		} else {
+			n += len(e.merge(p))
+		}
+	}
+	return n
+}
+
+// pieces pre-tokenizes text. A whitespace run followed by a non-space gives
+// its last character to the next piece, which is what \s+(?!\S) does in
+// the original pattern.
+func (e *bpeEncoding) pieces(text string) []string {
+	var out []string
+	for start := 0; start < len(text); {
+		loc := e.split.FindStringIndex(text[start:])
+		if loc == nil || loc[0] != 0 || loc[1] == 0 {
+			// Unmatched input (not expected with these patterns): one piece per rune.
+			_, size := utf8.DecodeRuneInString(text[start:])
+			out = append(out, text[start:start+size])
+			start += size
+			continue
+		}
+		end := start + loc[1]
+		piece := text[start+loc[0] : end]
+		if end < len(text) && isSpaceOnly(piece) {
+			if _, last := utf8.DecodeLastRuneInString(piece); last < len(piece) {
+				end -= last
+				piece = piece[:len(piece)-last]
+			}
+		}
+		out = append(out, piece)
+		start = end
+	}
+	return out
+}
+
+// isSpaceOnly reports whether s came from the \s+ alternative: runs with a
+// line break match \s*[\r\n]+ first and are never split.
+func isSpaceOnly(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) || r == '\r' || r == '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// merge byte-pair encodes one piece: starting from single bytes, repeatedly
+// join the adjacent pair with the lowest rank until none is in the vocabulary.
+func (e *bpeEncoding) merge(piece string) []string {
+	parts := make([]string, len(piece))
+	for i := 0; i < len(piece); i++ {
+		parts[i] = piece[i : i+1]
+	}
+	for len(parts) > 1 {
+		best, at := -1, -1
+		for i := 0; i < len(parts)-1; i++ {
+			if r, ok := e.ranks[parts[i]+parts[i+1]]; ok && (best < 0 || r < best) {
+				best, at = r, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		parts[at] += parts[at+1]
+		parts = append(parts[:at+1], parts[at+2:]...)
+	}
+	return parts
+}
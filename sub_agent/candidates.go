@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Selection policies for --candidates.
+const (
+	SelectFirst   = "first"   // the first candidate, as the provider ranked them
+	SelectLongest = "longest" // the longest candidate
+	SelectJudge   = "judge"   // a judge model picks the best
+	// SelectConsistent keeps the answer most candidates agree on; see
+	// selectConsistent.
+	SelectConsistent = "consistent"
+)
+
+// candidateConfig controls n-best sampling of direct answers; n < 2
+// disables it.
+type candidateConfig struct {
+	n      int
+	policy string
+	judge  string // provider/model for SelectJudge; "" uses the task's
+	// For SelectConsistent: how answers are matched and the temperature
+	// they are sampled at.
+	match       string
+	temperature float64
+}
+
+// Candidates records an n-best run: every answer and which one was kept.
+type Candidates struct {
+	Policy  string   `json:"policy"`
+	Chosen  int      `json:"chosen"` // index into Outputs
+	Outputs []string `json:"outputs"`
+	Judge   string   `json:"judge,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	// For --select consistent: how answers were matched, the group of
+	// each output, and the share of outputs in the chosen one's group.
+	Match     string  `json:"match,omitempty"`
+	Groups    []int   `json:"groups,omitempty"`
+	Agreement float64 `json:"agreement,omitempty"`
+}
+
+func validSelectPolicy(p string) bool {
+	switch p {
+	case SelectFirst, SelectLongest, SelectJudge, SelectConsistent:
+		return true
+	}
+	return false
+}
+
+// nativeCandidates reports whether one call to the provider can return
+// several answers: Gemini's candidateCount, Azure OpenAI and adapters that
+// declare n support.
+func nativeCandidates(providerName string) bool {
+	switch providerName {
+	case "cloud", "azure-openai":
+		return true
+	}
+	a, ok := lookupAdapter(providerName)
+	return ok && a.Candidates
+}
+
+// generateCandidates returns up to g.Candidates answers: from one call
+// where the provider supports it, topped up with parallel samples
+// otherwise. It fails only if no call succeeds.
+func generateCandidates(ctx context.Context, g genRequest, key string) ([]string, error) {
+	want := max(g.Candidates, 1)
+	var outs []string
+	if nativeCandidates(g.Provider) {
+		var err error
+		if outs, err = generateAll(ctx, g, key); err != nil {
+			return nil, err
+		}
+	}
+	if len(outs) >= want {
+		return outs[:want], nil
+	}
+
+	one := g
+	one.Candidates = 0
+	samples := make([]string, want-len(outs))
+	errs := make([]error, len(samples))
+	var wg sync.WaitGroup
+	for i := range samples {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g := one
+			if g.Seed != 0 {
+				// The same seed would sample the same answer.
+				g.Seed += int64(len(outs) + i)
+			}
+			samples[i], errs[i] = generateRequest(ctx, g, key)
+		}(i)
+	}
+	wg.Wait()
+	for i, s := range samples {
+		if errs[i] == nil {
+			outs = append(outs, s)
+		}
+	}
+	if len(outs) == 0 {
+		return nil, errs[0]
+	}
+	return outs, nil
+}
+
+// cutAtStop trims out at the first stop sequence, for providers that
+// return it or ignore stop sequences.
+func cutAtStop(out string, stop []string) string {
+	for _, s := range stop {
+		if s == "" {
+			continue
+		}
+		if i := strings.Index(out, s); i >= 0 {
+			out = out[:i]
+		}
+	}
+	return out
+}
+
+// answer makes the direct-answer call for prompt, validating the answer
+// after when its provider couldn't be held to the format.
+func (r *runner) answer(ctx context.Context, req TaskRequest, prompt string, res *TaskResult) (string, error) {
+	out, err := r.sampleAnswer(ctx, req, prompt, res)
+	if err != nil || !r.emulatesFormat(req) {
+		return out, err
+	}
+	return r.validateEmulatedFormat(ctx, req, prompt, out, res, func(p string) (string, error) {
+		return r.sampleAnswer(ctx, req, p, res)
+	})
+}
+
+// sampleAnswer makes the direct-answer call for prompt, sampling
+// candidates and selecting one when configured.
+func (r *runner) sampleAnswer(ctx context.Context, req TaskRequest, prompt string, res *TaskResult) (string, error) {
+	cfg := r.candidates
+	if req.Candidates > 0 {
+		cfg.n = req.Candidates
+	}
+	if req.Select != "" {
+		cfg.policy = req.Select
+	}
+	if req.SelfConsistency > 0 {
+		cfg.n, cfg.policy = req.SelfConsistency, SelectConsistent
+	}
+	stop := r.stop
+	if len(req.Stop) > 0 {
+		stop = req.Stop
+	}
+	g := genRequest{Provider: req.Provider, Model: req.Model, Prompt: prompt, Images: req.Images, Files: req.Files, Stop: stop, Seed: req.Seed, CachedContent: req.GeminiCache, Ground: req.Ground}
+	if err := r.constrainAnswer(&g, req); err != nil {
+		return "", err
+	}
+	if w := r.reason(&g, req); w != "" {
+		res.Warnings = append(res.Warnings, w)
+	}
+	if cfg.n < 2 {
+		// With a deadline, stream so that a cut-off answer can be kept;
+		// a tracked run streams to report tokens as they arrive.
+		var partial string
+		if p := progressFrom(ctx); r.deadlineFor(req) > 0 || p != nil || streamingEvents(ctx) {
+			stream := answerStreamer(ctx)
+			g.OnText = func(text string) {
+				partial = text
+				p.streaming(estimateTokens(text))
+				stream(text)
+			}
+		}
+		out, err := generateRequest(ctx, g, r.key)
+		if err != nil {
+			// An unclosed <think> means the model was still thinking.
+			_, answer := splitThinking(partial)
+			if answer == "" || strings.HasPrefix(answer, "<think>") || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", err
+			}
+			out, res.Truncated = partial, true
+			res.Warnings = append(res.Warnings, fmt.Sprintf("deadline of %s reached; the answer is cut short", r.deadlineFor(req)))
+		}
+		thinking, answer := splitThinking(out)
+		res.Thinking = thinking
+		return cutAtStop(answer, stop), nil
+	}
+	if !validSelectPolicy(cfg.policy) {
+		return "", kindError(ErrConfig, "invalid selection policy %q: expected first, longest, judge or consistent", cfg.policy)
+	}
+	if cfg.policy == SelectConsistent {
+		g.Temperature = &cfg.temperature
+	}
+
+	g.Candidates = cfg.n
+	outs, err := generateCandidates(ctx, g, r.key)
+	if err != nil {
+		return "", err
+	}
+	thinking := make([]string, len(outs))
+	for i, out := range outs {
+		var answer string
+		thinking[i], answer = splitThinking(out)
+		outs[i] = cutAtStop(answer, stop)
+	}
+	c := &Candidates{Policy: cfg.policy, Outputs: outs}
+	res.Candidates = c
+	if len(outs) < cfg.n {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("only %d of %d candidates succeeded", len(outs), cfg.n))
+	}
+
+	switch cfg.policy {
+	case SelectConsistent:
+		r.selectConsistent(ctx, c, cfg.match, res)
+	case SelectLongest:
+		for i, out := range outs {
+			if utf8.RuneCountInString(out) > utf8.RuneCountInString(outs[c.Chosen]) {
+				c.Chosen = i
+			}
+		}
+	case SelectJudge:
+		if len(outs) == 1 {
+			break
+		}
+		provider, model := withDefaults("", "", req)
+		if cfg.judge != "" {
+			choices, err := parseModelChoices(cfg.judge)
+			if err != nil {
+				return "", err
+			}
+			provider, model = withDefaults(choices[0].provider, choices[0].model, req)
+		}
+		c.Judge = modelChoice{provider, model}.String()
+		var ballot strings.Builder
+		for i, out := range outs {
+			fmt.Fprintf(&ballot, "Answer %d:\n%s\n\n", i+1, out)
+		}
+		verdict, err := generate(ctx, provider, model, fmt.Sprintf(debateJudgePrompt, req.Task, ballot.String()), r.key)
+		if err != nil {
+			return "", fmt.Errorf("candidate judge: %w", err)
+		}
+		verdict = cleanOutput(verdict)
+		n, ok := parseChoice(verdict, len(outs))
+		if !ok {
+			return "", fmt.Errorf("candidate judge did not name an answer")
+		}
+		c.Chosen = n
+		if _, reason, found := strings.Cut(strings.TrimSpace(verdict), "\n"); found {
+			c.Reason = strings.TrimSpace(reason)
+		}
+	}
+	res.Thinking = thinking[c.Chosen]
+	return outs[c.Chosen], nil
+}
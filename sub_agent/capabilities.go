@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CapabilitiesConfig controls the probing of providers on first use.
+// Results are cached in the state directory for TTL (a duration, default
+// 24h); helix probe --refresh probes again.
+type CapabilitiesConfig struct {
+	Disabled bool   `json:"disabled,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
+}
+
+const defaultCapabilityTTL = 24 * time.Hour
+
+// ProviderCapabilities is what probing a provider found.
+type ProviderCapabilities struct {
+	Provider string    `json:"provider"`
+	Host     string    `json:"host,omitempty"` // of local, whose cache a host change invalidates
+	Probed   time.Time `json:"probed"`
+	// Models is what the provider serves, nil when it can't be listed.
+	Models  []string                     `json:"models,omitempty"`
+	Details map[string]ModelCapabilities `json:"details,omitempty"` // by model
+}
+
+// ModelCapabilities is what a provider says about one model; unset fields
+// are unknown.
+type ModelCapabilities struct {
+	ContextWindow int   `json:"context_window,omitempty"`
+	Tools         *bool `json:"tools,omitempty"`
+	Embeddings    *bool `json:"embeddings,omitempty"`
+	Vision        *bool `json:"vision,omitempty"`
+}
+
+// capabilityCache holds the probes of this process, loaded from and saved
+// to capabilities.json.
+var capabilityCache struct {
+	once    sync.Once
+	mu      sync.Mutex
+	entries map[string]*ProviderCapabilities
+}
+
+func capabilitiesPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "capabilities.json"), nil
+}
+
+func capabilityTTL() time.Duration {
+	if d, err := time.ParseDuration(config.Capabilities.TTL); err == nil && d > 0 {
+		return d
+	}
+	return defaultCapabilityTTL
+}
+
+// cachedCapabilities returns the cache, loading it on first use. Call with
+// capabilityCache.mu held.
+func cachedCapabilities() map[string]*ProviderCapabilities {
+	capabilityCache.once.Do(func() {
+		capabilityCache.entries = map[string]*ProviderCapabilities{}
+		if path, err := capabilitiesPath(); err == nil {
+			if data, err := os.ReadFile(path); err == nil {
+				json.Unmarshal(data, &capabilityCache.entries)
+			}
+		}
+		for _, pc := range capabilityCache.entries {
+			if pc.Details == nil {
+				pc.Details = map[string]ModelCapabilities{}
+			}
+		}
+	})
+	return capabilityCache.entries
+}
+
+// saveCapabilities writes the cache; failing to is not worth failing a task.
+// Call with capabilityCache.mu held.
+func saveCapabilities() {
+	path, err := capabilitiesPath()
+	if err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(capabilityCache.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		writeFileAtomic(path, data)
+	}
+}
+
+// probeable reports whether provider can be probed: Azure deployments and
+// Bedrock have no model list worth checking against, and a pool of Ollama
+// hosts may serve models the first one lacks.
+func probeable(provider string) bool {
+	switch provider {
+	case "azure-openai", "bedrock", "mock":
+		return false
+	case "local":
+		return len(config.Ollama.Hosts) <= 1
+	}
+	return true
+}
+
+// providerCapabilities probes provider, or returns its cached probe when
+// that is younger than the TTL.
+func providerCapabilities(ctx context.Context, provider, key string, refresh bool) (*ProviderCapabilities, error) {
+	host := ""
+	if provider == "local" {
+		host = ollamaHost()
+	}
+	capabilityCache.mu.Lock()
+	pc := cachedCapabilities()[provider]
+	capabilityCache.mu.Unlock()
+	if pc != nil && !refresh && pc.Host == host && time.Since(pc.Probed) < capabilityTTL() {
+		return pc, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	pc = &ProviderCapabilities{Provider: provider, Host: host, Probed: time.Now().UTC(), Details: map[string]ModelCapabilities{}}
+	var err error
+	switch provider {
+	case "local":
+		pc.Models, err = ollamaModels(ctx, host)
+	case "cloud":
+		err = probeGemini(ctx, key, pc)
+	default:
+		a, ok := lookupAdapter(provider)
+		if !ok {
+			return nil, kindError(ErrConfig, "unknown provider %q", provider)
+		}
+		err = probeAdapter(ctx, provider, a, pc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	capabilityCache.mu.Lock()
+	cachedCapabilities()[provider] = pc
+	saveCapabilities()
+	capabilityCache.mu.Unlock()
+	return pc, nil
+}
+
+// modelDetails returns what provider says about model, asking Ollama for
+// the models it hasn't been asked about yet.
+func modelDetails(ctx context.Context, pc *ProviderCapabilities, model string) ModelCapabilities {
+	capabilityCache.mu.Lock()
+	mc, ok := pc.Details[model]
+	capabilityCache.mu.Unlock()
+	if ok || pc.Provider != "local" || !hasOllamaModel(pc.Models, model) {
+		return mc
+	}
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	mc, err := showOllamaModel(ctx, pc.Host, model)
+	if err != nil {
+		return mc
+	}
+	capabilityCache.mu.Lock()
+	pc.Details[model] = mc
+	saveCapabilities()
+	capabilityCache.mu.Unlock()
+	return mc
+}
+
+// showOllamaModel reads a model's context length and capabilities from
+// /api/show. Ollamas older than 0.6 list no capabilities.
+func showOllamaModel(ctx context.Context, host, model string) (ModelCapabilities, error) {
+	var show struct {
+		Capabilities []string               `json:"capabilities"`
+		ModelInfo    map[string]interface{} `json:"model_info"`
+	}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return ModelCapabilities{}, err
+	}
+	if err := postEmbed(ctx, "Ollama", host+"/api/show", headers, map[string]string{"model": model}, &show); err != nil {
+		return ModelCapabilities{}, err
+	}
+	var mc ModelCapabilities
+	for k, v := range show.ModelInfo {
+		if n, ok := v.(float64); ok && strings.HasSuffix(k, ".context_length") {
+			mc.ContextWindow = int(n)
+		}
+	}
+	if show.Capabilities != nil {
+		has := map[string]bool{}
+		for _, c := range show.Capabilities {
+			has[c] = true
+		}
+		tools, embeddings, vision := has["tools"], has["embedding"], has["vision"]
+		mc.Tools, mc.Embeddings, mc.Vision = &tools, &embeddings, &vision
+	}
+	return mc, nil
+}
+
+// probeGemini reads the input limit and methods of the models helix calls.
+func probeGemini(ctx context.Context, key string, pc *ProviderCapabilities) error {
+	if geminiConfig().Vertex {
+		return nil
+	}
+	key, err := geminiKey(key)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var, or GOOGLE_GENAI_USE_VERTEXAI=true to use Vertex AI")
+	}
+	base := strings.TrimSuffix(GeminiBaseURL, "/"+geminiAPIModel()+":generateContent")
+	for _, model := range []string{geminiAPIModel(), defaultEmbedModel("cloud")} {
+		var m struct {
+			InputTokenLimit            int      `json:"inputTokenLimit"`
+			SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+		}
+		if err := getJSON(ctx, "Gemini API", base+"/"+model+"?key="+key, nil, &m); err != nil {
+			return err
+		}
+		var generates, embeds bool
+		for _, method := range m.SupportedGenerationMethods {
+			generates = generates || method == "generateContent"
+			embeds = embeds || method == "embedContent" || method == "batchEmbedContents"
+		}
+		mc := ModelCapabilities{ContextWindow: m.InputTokenLimit, Embeddings: &embeds}
+		if generates {
+			tools := true
+			mc.Tools = &tools
+		}
+		pc.Details[model] = mc
+	}
+	return nil
+}
+
+// probeAdapter lists an OpenAI-compatible API's models, with the context
+// lengths that vLLM, OpenRouter and Groq add to the list.
+func probeAdapter(ctx context.Context, name string, a OpenAICompatibleProvider, pc *ProviderCapabilities) error {
+	headers, err := a.headers(name)
+	if err != nil {
+		return err
+	}
+	var models struct {
+		Data []struct {
+			ID            string `json:"id"`
+			ContextLength int    `json:"context_length"`
+			MaxModelLen   int    `json:"max_model_len"`
+			ContextWindow int    `json:"context_window"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, name, strings.TrimSuffix(a.BaseURL, "/")+"/models", headers, &models); err != nil {
+		return err
+	}
+	pc.Models = []string{}
+	for _, m := range models.Data {
+		pc.Models = append(pc.Models, m.ID)
+		if w := max(m.ContextLength, m.MaxModelLen, m.ContextWindow); w > 0 {
+			pc.Details[m.ID] = ModelCapabilities{ContextWindow: w}
+		}
+	}
+	return nil
+}
+
+// probeFailure is whether err from probing means the provider can't work
+// at all: unreachable, refusing our credentials or misconfigured. Anything
+// else, such as an API without a model list, leaves the provider unprobed.
+func probeFailure(err error) bool {
+	switch errorKind(err) {
+	case ErrUnreachable, ErrAuth, ErrConfig:
+		return true
+	}
+	return false
+}
+
+// checkProvider probes req's provider on its first use and fails fast on
+// what would otherwise fail mid-task: a model the provider doesn't serve,
+// or tools for a model without tool calling.
+func (r *runner) checkProvider(ctx context.Context, req TaskRequest) error {
+	if config.Capabilities.Disabled || !probeable(req.Provider) {
+		return nil
+	}
+	pc, err := providerCapabilities(ctx, req.Provider, r.key, false)
+	if err != nil {
+		if probeFailure(err) {
+			return err
+		}
+		progressf("Not probing %s: %v", req.Provider, redactErr(err))
+		return nil
+	}
+	if err := pc.serves(req.Model); err != nil {
+		return err
+	}
+	if len(r.tools) > 0 {
+		if mc := modelDetails(ctx, pc, req.Model); mc.Tools != nil && !*mc.Tools {
+			return kindError(ErrConfig, "%s doesn't support tool calling, so --tools can't be used with it; pick a model with tools or drop --tools", modelChoice{req.Provider, req.Model})
+		}
+	}
+	return nil
+}
+
+// checkEmbedder does the same for an embedding model.
+func checkEmbedder(ctx context.Context, provider, model, key string) error {
+	if config.Capabilities.Disabled || !probeable(provider) {
+		return nil
+	}
+	pc, err := providerCapabilities(ctx, provider, key, false)
+	if err != nil {
+		if probeFailure(err) {
+			return err
+		}
+		return nil
+	}
+	if err := pc.serves(model); err != nil {
+		return err
+	}
+	if mc := modelDetails(ctx, pc, model); mc.Embeddings != nil && !*mc.Embeddings {
+		return kindError(ErrConfig, "%s is not an embedding model; use one such as %s", modelChoice{provider, model}, defaultEmbedModel(provider))
+	}
+	return nil
+}
+
+// serves returns an error naming the fix when pc lists its models and model
+// isn't among them.
+func (pc *ProviderCapabilities) serves(model string) error {
+	if pc.Models == nil || model == "" {
+		return nil
+	}
+	if pc.Provider == "local" {
+		if hasOllamaModel(pc.Models, model) {
+			return nil
+		}
+		return kindError(ErrConfig, "model %s is not pulled on the Ollama at %s; run 'ollama pull %s' (pulled: %s)", model, pc.Host, model, listOrNone(pc.Models))
+	}
+	for _, m := range pc.Models {
+		if m == model {
+			return nil
+		}
+	}
+	return kindError(ErrConfig, "provider %s doesn't serve model %s (it serves: %s); fix --model or the provider's default_model", pc.Provider, model, listOrNone(pc.Models))
+}
+
+func listOrNone(models []string) string {
+	if len(models) == 0 {
+		return "none"
+	}
+	if len(models) > 10 {
+		return strings.Join(models[:10], ", ") + fmt.Sprintf(" and %d more", len(models)-10)
+	}
+	return strings.Join(models, ", ")
+}
+
+// forgetCapabilities drops the probes of every provider but local, after
+// their config changed, so that they are probed again on their next use.
+func forgetCapabilities() {
+	capabilityCache.mu.Lock()
+	defer capabilityCache.mu.Unlock()
+	for name := range cachedCapabilities() {
+		if name != "local" {
+			delete(capabilityCache.entries, name)
+		}
+	}
+}
+
+// probedContextWindow is a model's window as its provider reported it, 0 if
+// no probe of this process or the cache knows it.
+func probedContextWindow(provider, model string) int {
+	capabilityCache.mu.Lock()
+	defer capabilityCache.mu.Unlock()
+	if pc := cachedCapabilities()[provider]; pc != nil {
+		return pc.Details[model].ContextWindow
+	}
+	return 0
+}
+
+// probeCommand implements `probe`: probe providers and print what they
+// support.
+func probeCommand(fs *flag.FlagSet) func(args []string) {
+	provider := fs.String("provider", "", "Provider to probe (default: every configured one)")
+	refresh := fs.Bool("refresh", false, "Probe again even if the cached probe is fresh")
+	asJSON := fs.Bool("json", false, "Print the probes as JSON")
+	kf := addKeyFlags(fs)
+	return func([]string) {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		names := configuredProviders(key)
+		if *provider != "" {
+			names = []string{*provider}
+		}
+		ctx := context.Background()
+		var probes []*ProviderCapabilities
+		failed := false
+		for _, name := range names {
+			if !probeable(name) {
+				statusf("[Sub-Agent] %s can't be probed\n", name)
+				continue
+			}
+			pc, err := providerCapabilities(ctx, name, key, *refresh)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: probing %s: %v\n", name, redactErr(err))
+				failed = true
+				continue
+			}
+			if name == "local" {
+				for _, m := range pc.Models {
+					modelDetails(ctx, pc, m)
+				}
+			}
+			probes = append(probes, pc)
+		}
+		if *asJSON {
+			printJSON(probes)
+		} else {
+			for _, pc := range probes {
+				fmt.Printf("%s (probed %s)\n", pc.Provider, pc.Probed.Local().Format("2006-01-02 15:04"))
+				models := pc.Models
+				if models == nil {
+					models = sortedKeys(pc.Details)
+				}
+				for _, m := range models {
+					mc := pc.Details[m]
+					window := "-"
+					if mc.ContextWindow > 0 {
+						window = fmt.Sprint(mc.ContextWindow)
+					}
+					fmt.Printf("  %-40s %10s  tools:%-7s embeddings:%-7s vision:%s\n", m, window, yesNo(mc.Tools), yesNo(mc.Embeddings), yesNo(mc.Vision))
+				}
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
+
+func yesNo(b *bool) string {
+	switch {
+	case b == nil:
+		return "?"
+	case *b:
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults the chaos layer injects into provider calls.
+const (
+	FaultNone      = "ok"
+	FaultTimeout   = "timeout"    // the call hangs for timeout_delay, then times out
+	FaultRateLimit = "rate_limit" // a 429 with Retry-After
+	FaultMalformed = "malformed"  // a 200 whose JSON body is cut short
+	FaultPartial   = "partial"    // the real response, cut off after partial_bytes
+)
+
+// ChaosConfig injects provider failures, for testing how retries, fallback
+// and failover cope. Off unless a rate or a sequence is set, here or in
+// $HELIX_CHAOS, which replaces the section when set, as comma-separated
+// key=value pairs under the same names, with ':' between sequence faults:
+//
+//	HELIX_CHAOS=rate_limit=0.2,timeout=0.1,seed=7,providers=local
+//	HELIX_CHAOS=sequence=rate_limit:rate_limit:ok
+type ChaosConfig struct {
+	// The chance of each fault per call, from 0 to 1. Calls draw from a
+	// generator seeded with Seed, so a run's faults repeat with its seed.
+	Timeout   float64 `json:"timeout,omitempty"`
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	Malformed float64 `json:"malformed,omitempty"`
+	Partial   float64 `json:"partial,omitempty"`
+	Seed      int64   `json:"seed,omitempty"`
+	// Sequence, when set, replaces the rates: the faults of successive
+	// calls, repeating, "ok" for none.
+	Sequence []string `json:"sequence,omitempty"`
+
+	// Providers limits the faults to these providers' calls; empty means
+	// every provider.
+	Providers    []string `json:"providers,omitempty"`
+	TimeoutDelay string   `json:"timeout_delay,omitempty"` // default 0: time out at once
+	RetryAfter   int      `json:"retry_after,omitempty"`   // seconds, default 1
+	PartialBytes int      `json:"partial_bytes,omitempty"` // default 256
+}
+
+// chaosFromEnv parses $HELIX_CHAOS.
+func chaosFromEnv(s string) (ChaosConfig, error) {
+	var c ChaosConfig
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return c, fmt.Errorf("HELIX_CHAOS: expected key=value, got %q", kv)
+		}
+		var err error
+		switch k {
+		case "timeout":
+			c.Timeout, err = strconv.ParseFloat(v, 64)
+		case "rate_limit":
+			c.RateLimit, err = strconv.ParseFloat(v, 64)
+		case "malformed":
+			c.Malformed, err = strconv.ParseFloat(v, 64)
+		case "partial":
+			c.Partial, err = strconv.ParseFloat(v, 64)
+		case "seed":
+			c.Seed, err = strconv.ParseInt(v, 10, 64)
+		case "sequence":
+			c.Sequence = strings.Split(v, ":")
+		case "providers":
+			c.Providers = strings.Split(v, ":")
+		case "timeout_delay":
+			c.TimeoutDelay = v
+		case "retry_after":
+			c.RetryAfter, err = strconv.Atoi(v)
+		case "partial_bytes":
+			c.PartialBytes, err = strconv.Atoi(v)
+		default:
+			return c, fmt.Errorf("HELIX_CHAOS: unknown key %q", k)
+		}
+		if err != nil {
+			return c, fmt.Errorf("HELIX_CHAOS: invalid %s %q", k, v)
+		}
+	}
+	return c, nil
+}
+
+// chaosTransport injects faults into the calls the base transport makes to
+// providers.
+type chaosTransport struct {
+	base http.RoundTripper
+	c    ChaosConfig
+	wait time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	n   int // calls so far, for the sequence
+}
+
+// configureChaos wraps the outbound transport in the configured fault
+// injection, if any.
+func configureChaos(c ChaosConfig) error {
+	if s := os.Getenv("HELIX_CHAOS"); s != "" {
+		var err error
+		if c, err = chaosFromEnv(s); err != nil {
+			return err
+		}
+	}
+	if len(c.Sequence) == 0 && c.Timeout+c.RateLimit+c.Malformed+c.Partial == 0 {
+		return nil
+	}
+	for _, p := range []float64{c.Timeout, c.RateLimit, c.Malformed, c.Partial} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("chaos: rates must be between 0 and 1")
+		}
+	}
+	if c.Timeout+c.RateLimit+c.Malformed+c.Partial > 1 {
+		return fmt.Errorf("chaos: rates add up to more than 1")
+	}
+	for _, f := range c.Sequence {
+		switch f {
+		case FaultNone, FaultTimeout, FaultRateLimit, FaultMalformed, FaultPartial:
+		default:
+			return fmt.Errorf("chaos: unknown fault %q: use ok, timeout, rate_limit, malformed or partial", f)
+		}
+	}
+	for _, p := range c.Providers {
+		if !knownProvider(p) {
+			return fmt.Errorf("chaos.providers: unknown provider %q", p)
+		}
+	}
+	t := &chaosTransport{base: http.DefaultTransport, c: c, rng: rand.New(rand.NewSource(c.Seed))}
+	if c.TimeoutDelay != "" {
+		d, err := time.ParseDuration(c.TimeoutDelay)
+		if err != nil || d < 0 {
+			return fmt.Errorf("chaos.timeout_delay: invalid duration %q", c.TimeoutDelay)
+		}
+		t.wait = d
+	}
+	if t.c.RetryAfter <= 0 {
+		t.c.RetryAfter = 1
+	}
+	if t.c.PartialBytes <= 0 {
+		t.c.PartialBytes = 256
+	}
+	http.DefaultTransport = t
+	fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: injecting provider faults (chaos config or HELIX_CHAOS)\n")
+	return nil
+}
+
+// fault picks the next call's fault, FaultNone for calls to hosts that
+// aren't targeted.
+func (t *chaosTransport) fault(host string) string {
+	targeted := false
+	for _, name := range append([]string{"local", "cloud", "azure-openai", "bedrock"}, adapterNames()...) {
+		if providerOwnsHost(name, host) && (len(t.c.Providers) == 0 || slices.Contains(t.c.Providers, name)) {
+			targeted = true
+			break
+		}
+	}
+	if !targeted {
+		return FaultNone
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.c.Sequence) > 0 {
+		f := t.c.Sequence[t.n%len(t.c.Sequence)]
+		t.n++
+		return f
+	}
+	x := t.rng.Float64()
+	for _, f := range []struct {
+		name string
+		p    float64
+	}{{FaultTimeout, t.c.Timeout}, {FaultRateLimit, t.c.RateLimit}, {FaultMalformed, t.c.Malformed}, {FaultPartial, t.c.Partial}} {
+		if x < f.p {
+			return f.name
+		}
+		x -= f.p
+	}
+	return FaultNone
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := t.fault(req.URL.Hostname())
+	if f != FaultNone {
+		statusf("[Sub-Agent] Chaos: %s on %s %s\n", f, req.Method, redact(req.URL.Redacted()))
+	}
+	switch f {
+	case FaultTimeout:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		select {
+		case <-time.After(t.wait):
+			return nil, fmt.Errorf("chaos: injected timeout: %w", context.DeadlineExceeded)
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	case FaultRateLimit:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		resp := chaosResponse(req, http.StatusTooManyRequests, `{"error":{"code":429,"message":"chaos: injected rate limit","status":"RESOURCE_EXHAUSTED"}}`)
+		resp.Header.Set("Retry-After", strconv.Itoa(t.c.RetryAfter))
+		return resp, nil
+	case FaultMalformed:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return chaosResponse(req, http.StatusOK, `{"response":"chaos: injected malformed bo`), nil
+	case FaultPartial:
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = &partialBody{ReadCloser: resp.Body, left: t.c.PartialBytes}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp, nil
+	}
+	return t.base.RoundTrip(req)
+}
+
+func chaosResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// partialBody passes left bytes through, then fails as a dropped
+// connection would.
+type partialBody struct {
+	io.ReadCloser
+	left int
+}
+
+func (b *partialBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= n
+	return n, err
+}
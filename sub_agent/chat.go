@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const chatHelp = `Commands:
+  /provider [name]  show or switch provider (resets the model to its default)
+  /model [name]     show or switch model
+  /system [text]    show or set the system prompt ("/system clear" removes it)
+  /tokens           estimate the conversation's size against the context window
+  /compact          summarize older messages now instead of when the window fills
+  /save [file]      write the conversation to a markdown file
+  /clear            forget the conversation so far
+  /help             show this help
+  /exit             leave (Ctrl-D also works)`
+
+// chatTurn is one message of the conversation.
+type chatTurn struct {
+	role string // "user" or "assistant"
+	text string
+}
+
+// chatSession is the state of a `chat` REPL.
+type chatSession struct {
+	provider string
+	model    string
+	system   string
+	turns    []chatTurn
+	// The first folded turns are replaced by summary in the prompt; /save
+	// still writes them all.
+	folded  int
+	summary string
+}
+
+// prompt renders the conversation plus the next user message as a single
+// prompt, which every provider accepts.
+func (s *chatSession) prompt(next string) string {
+	var b strings.Builder
+	if s.system != "" {
+		b.WriteString(s.system + "\n\n")
+	}
+	if len(s.turns) == 0 {
+		b.WriteString(next)
+		return b.String()
+	}
+	b.WriteString("Continue this conversation. Reply only as the assistant.\n\n")
+	if s.summary != "" {
+		fmt.Fprintf(&b, "Summary of the earlier conversation:\n%s\n\n", s.summary)
+	}
+	for _, t := range s.turns[s.folded:] {
+		fmt.Fprintf(&b, "%s: %s\n\n", roleLabel(t.role), t.text)
+	}
+	fmt.Fprintf(&b, "User: %s\n\nAssistant:", next)
+	return b.String()
+}
+
+func roleLabel(role string) string {
+	if role == "assistant" {
+		return "Assistant"
+	}
+	return "User"
+}
+
+// chatCommand implements `chat`, an interactive REPL over the task runner.
+func chatCommand(fs *flag.FlagSet) func(args []string) {
+	prov := fs.String("provider", "local", "Provider to start with")
+	mdl := fs.String("model", "", "Model to start with")
+	system := fs.String("system", "", "System prompt")
+	raw := fs.Bool("raw", false, "Print answers as-is instead of rendering markdown")
+	histFile := fs.String("history-file", defaultHistoryFile(), "Where input history is kept ('' to keep it in memory)")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+
+		s := &chatSession{provider: *prov, model: *mdl, system: *system}
+		ed := newLineEditor(*histFile)
+		markdown := useMarkdown(*raw)
+		fmt.Printf("[Sub-Agent] Chatting with %s. Type /help for commands.\n", s.describe())
+
+		for {
+			line, err := ed.readLine("you> ")
+			if errors.Is(err, errInterrupted) {
+				continue
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			ed.remember(line)
+
+			if strings.HasPrefix(line, "/") {
+				if line == "/compact" {
+					s.compact(context.Background(), r, true)
+					continue
+				}
+				if done := s.command(line); done {
+					return
+				}
+				continue
+			}
+
+			// Ctrl-C cancels the generation in flight rather than the REPL.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			if r.shouldCompact(s.request(""), estimateTokens(s.prompt(line))) {
+				s.compact(ctx, r, false)
+			}
+			res, err := r.run(ctx, TaskRequest{Task: s.prompt(line), Provider: s.provider, Model: s.model})
+			stop()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			for _, w := range res.Warnings {
+				fmt.Printf("[Sub-Agent] Warning: %s\n", w)
+			}
+			out := res.Output
+			if res.ArtifactURL != "" {
+				out = fmt.Sprintf("(uploaded %d bytes to %s)", res.OutputBytes, res.ArtifactURL)
+			} else if markdown {
+				out = renderMarkdown(out)
+			}
+			fmt.Printf("%s\n\n", out)
+			s.turns = append(s.turns, chatTurn{"user", line}, chatTurn{"assistant", res.Output})
+		}
+	}
+}
+
+func (s *chatSession) request(task string) TaskRequest {
+	return TaskRequest{Task: task, Provider: s.provider, Model: defaultModel(s.provider, s.model)}
+}
+
+// compact folds older messages into the running summary. forced is /compact,
+// which reports when there is nothing to fold.
+func (s *chatSession) compact(ctx context.Context, r *runner, forced bool) {
+	var turns []string
+	for _, t := range s.turns[s.folded:] {
+		turns = append(turns, roleLabel(t.role)+": "+t.text)
+	}
+	summary, n, err := r.compactTurns(ctx, s.request(""), s.summary, turns)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if n == 0 {
+		if forced {
+			fmt.Printf("[Sub-Agent] Nothing to summarize; the last %d message(s) are always kept\n", r.compact.keep)
+		}
+		return
+	}
+	s.summary, s.folded = summary, s.folded+n
+	fmt.Printf("[Sub-Agent] Summarized %d earlier message(s) to stay within the context window\n", n)
+}
+
+func (s *chatSession) describe() string {
+	return modelChoice{s.provider, defaultModel(s.provider, s.model)}.String()
+}
+
+// command runs a slash command and reports whether the REPL should exit.
+func (s *chatSession) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/exit", "/quit":
+		return true
+	case "/help":
+		fmt.Println(chatHelp)
+	case "/provider":
+		if arg != "" {
+			s.provider, s.model = arg, ""
+		}
+		fmt.Printf("[Sub-Agent] Using %s\n", s.describe())
+	case "/model":
+		if arg != "" {
+			s.model = arg
+		}
+		fmt.Printf("[Sub-Agent] Using %s\n", s.describe())
+	case "/system":
+		switch arg {
+		case "":
+			if s.system == "" {
+				fmt.Println("[Sub-Agent] No system prompt")
+			} else {
+				fmt.Printf("[Sub-Agent] System prompt: %s\n", s.system)
+			}
+		case "clear":
+			s.system = ""
+			fmt.Println("[Sub-Agent] System prompt cleared")
+		default:
+			s.system = arg
+			fmt.Println("[Sub-Agent] System prompt set")
+		}
+	case "/tokens":
+		tokens := estimateTokens(s.prompt(""))
+		window := contextWindow(s.provider, defaultModel(s.provider, s.model))
+		fmt.Printf("[Sub-Agent] ~%d tokens in %d message(s) (%d summarized); %s has a %d-token window\n", tokens, len(s.turns), s.folded, s.describe(), window)
+	case "/save":
+		path := arg
+		if path == "" {
+			path = fmt.Sprintf("helix-chat-%s.md", time.Now().Format("20060102-150405"))
+		}
+		if err := os.WriteFile(path, []byte(s.markdown()), 0644); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			break
+		}
+		fmt.Printf("[Sub-Agent] Saved %d message(s) to %s\n", len(s.turns), path)
+	case "/clear":
+		s.turns, s.folded, s.summary = nil, 0, ""
+		fmt.Println("[Sub-Agent] Conversation cleared")
+	default:
+		fmt.Printf("Unknown command %s. Type /help for commands.\n", name)
+	}
+	return false
+}
+
+// markdown renders the conversation for /save.
+func (s *chatSession) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# helix chat with %s\n\n", s.describe())
+	if s.system != "" {
+		fmt.Fprintf(&b, "**System:** %s\n\n", s.system)
+	}
+	for _, t := range s.turns {
+		fmt.Fprintf(&b, "## %s\n\n%s\n\n", roleLabel(t.role), t.text)
+	}
+	return b.String()
+}
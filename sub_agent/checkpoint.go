@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Checkpoint stages: the multi-step loops whose progress is saved.
+const (
+	checkpointPlan  = "plan"
+	checkpointTools = "tools"
+)
+
+// Checkpoint is the saved progress of a multi-step run, written after every
+// step so that `helix resume <id>` can pick up where a crashed or
+// interrupted run stopped instead of paying for the finished steps again.
+type Checkpoint struct {
+	ID      string      `json:"id"`
+	Created time.Time   `json:"created"`
+	Updated time.Time   `json:"updated"`
+	Stage   string      `json:"stage"`
+	Request TaskRequest `json:"request"` // as the stage received it: input attached, files packed
+
+	// Plan stage: every planned step, of which the first StepsDone have run.
+	Plan      *Plan `json:"plan,omitempty"`
+	StepsDone int   `json:"steps_done,omitempty"`
+
+	// Tools stage: the conversation so far and the calls made.
+	Tools      []string          `json:"tools,omitempty"`
+	Transcript string            `json:"transcript,omitempty"`
+	ToolSteps  int               `json:"tool_steps,omitempty"`
+	ToolCalls  []ToolCall        `json:"tool_calls,omitempty"`
+	Scratchpad map[string]string `json:"scratchpad,omitempty"`
+	Memory     string            `json:"memory,omitempty"` // --memory-namespace, if --memory was on
+}
+
+// checkpointStore keeps one JSON record per unfinished run.
+type checkpointStore struct {
+	records recordStore
+}
+
+// openCheckpoints returns the store on the history backend; files go under
+// the user cache directory.
+func openCheckpoints() (*checkpointStore, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("locating checkpoint directory: %v", err)
+	}
+	records, err := openRecords("checkpoints", filepath.Join(dir, "helix", "runs"))
+	if err != nil {
+		return nil, err
+	}
+	return &checkpointStore{records: records}, nil
+}
+
+func (s *checkpointStore) save(cp *Checkpoint) error {
+	cp.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = sealAtRest(data); err != nil {
+		return fmt.Errorf("encrypting checkpoint %s: %v", cp.ID, err)
+	}
+	return s.records.put(cp.ID, cp.Updated, data)
+}
+
+func (s *checkpointStore) load(id string) (*Checkpoint, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid run ID %q", id)
+	}
+	data, err := s.records.get(id)
+	if err == errNoRecord {
+		return nil, fmt.Errorf("no checkpoint for run %s", id)
+	}
+	if err == nil {
+		data, err = openAtRest(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %v", id, err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %v", id, err)
+	}
+	return &cp, nil
+}
+
+func (s *checkpointStore) has(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, err := s.records.get(id)
+	return err == nil
+}
+
+func (s *checkpointStore) remove(id string) {
+	s.records.remove(id)
+}
+
+// list returns the saved checkpoints, most recently updated first.
+func (s *checkpointStore) list() ([]*Checkpoint, error) {
+	recs, err := s.records.stat()
+	if err != nil {
+		return nil, err
+	}
+	var cps []*Checkpoint
+	for _, r := range recs {
+		cp, err := s.load(r.id)
+		if err != nil {
+			return nil, err
+		}
+		cps = append(cps, cp)
+	}
+	sort.Slice(cps, func(i, j int) bool { return cps[i].Updated.After(cps[j].Updated) })
+	return cps, nil
+}
+
+// checkpoint returns the checkpoint a stage should update: the one being
+// resumed, or a new one. nil means checkpointing is off.
+func (r *runner) checkpoint(req TaskRequest, stage string) *Checkpoint {
+	if r.checkpoints == nil || req.noCheckpoint {
+		return nil
+	}
+	if cp := req.resume; cp != nil && cp.Stage == stage {
+		return cp
+	}
+	req.resume = nil
+	now := time.Now().UTC()
+	return &Checkpoint{ID: req.ID, Created: now, Stage: stage, Request: req}
+}
+
+// saveCheckpoint persists progress; failing to is only worth a warning.
+func (r *runner) saveCheckpoint(cp *Checkpoint) {
+	if cp == nil {
+		return
+	}
+	if err := r.checkpoints.save(cp); err != nil {
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: saving checkpoint: %v\n", err)
+	}
+}
+
+// resumeCommand implements `resume <run-id>`: finish a run from its last
+// checkpoint, with the same runner flags as the original where they matter.
+func resumeCommand(fs *flag.FlagSet) func(args []string) {
+	list := fs.Bool("list", false, "List runs that can be resumed")
+	fs.BoolVar(&jsonOut, "json", false, "Print the result as JSON instead of text")
+	fs.BoolVar(&raw, "raw", false, "Print the answer as-is instead of rendering markdown on a terminal")
+	fs.BoolVar(&verbose, "verbose", false, "Print detailed progress and intermediate transcripts")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the result: no status lines, warnings or progress")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	of := addOutputFlags(fs)
+	return func(args []string) {
+		store, err := openCheckpoints()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if *list {
+			cps, err := store.list()
+			if err != nil {
+				fatal(err)
+			}
+			for _, cp := range cps {
+				progress := fmt.Sprintf("%d tool call(s)", len(cp.ToolCalls))
+				if cp.Stage == checkpointPlan {
+					progress = fmt.Sprintf("%d/%d steps", cp.StepsDone, len(cp.Plan.Steps))
+				}
+				fmt.Printf("%s  %s  %-5s %-16s %s\n", cp.ID, cp.Updated.Local().Format("2006-01-02 15:04:05"), cp.Stage, progress, truncateRunes(cp.Request.Task, 60))
+			}
+			return
+		}
+		if len(args) != 1 {
+			fatal(kindError(ErrConfig, "usage: helix resume <run-id> (see helix resume --list)"))
+		}
+		cp, err := store.load(args[0])
+		if err != nil {
+			fatal(configError(err))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		// The stage must run again even if its flag was not repeated.
+		if cp.Stage == checkpointTools && *rf.tools == "" {
+			*rf.tools = strings.Join(cp.Tools, ",")
+		}
+		if cp.Memory != "" && !flagWasSet(fs, "memory") {
+			*rf.memory, *rf.memoryNamespace = true, cp.Memory
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		r.checkpoints = store
+		req := cp.Request
+		req.resume = cp
+		if cp.Stage == checkpointPlan {
+			req.Plan = true
+		}
+		if !jsonOut {
+			statusf("[Sub-Agent] Resuming run %s (%s stage)\n", cp.ID, cp.Stage)
+		}
+		res, err := r.run(context.Background(), req)
+		if jsonOut {
+			of.emitJSON(res)
+			if err != nil {
+				os.Exit(exitCode(err))
+			}
+			of.deliver(res.Output)
+			return
+		}
+		if err != nil {
+			fatal(err)
+		}
+		of.emit(func(w io.Writer) { printResult(w, res, of.markdown(raw) && !convertsMarkdown(r.answerFormat(req))) })
+		of.deliver(res.Output)
+	}
+}
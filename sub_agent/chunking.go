@@ -0,0 +1,323 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Chunking strategies for `kb ingest`.
+const (
+	ChunkAuto     = "auto"     // by file type: markdown, code or fixed
+	ChunkFixed    = "fixed"    // lines packed up to the size
+	ChunkSentence = "sentence" // sentences packed up to the size
+	ChunkMarkdown = "markdown" // one chunk per section under a heading
+	ChunkCode     = "code"     // top-level functions, types and classes
+)
+
+// ChunkingConfig sets how documents are split for a knowledge base; the
+// kb ingest flags override it.
+type ChunkingConfig struct {
+	Strategy string `json:"strategy,omitempty"` // default auto
+	Tokens   int    `json:"tokens,omitempty"`   // default 400
+	// Overlap is how many tokens of the end of a chunk the next one repeats,
+	// so that a passage cut in two is whole in one of them.
+	Overlap int `json:"overlap,omitempty"`
+}
+
+func validChunkStrategy(s string) bool {
+	switch s {
+	case ChunkAuto, ChunkFixed, ChunkSentence, ChunkMarkdown, ChunkCode:
+		return true
+	}
+	return false
+}
+
+// codeExtensions are the files auto chunking splits as code.
+var codeExtensions = map[string]bool{
+	".go": true, ".py": true, ".js": true, ".jsx": true, ".ts": true, ".tsx": true,
+	".java": true, ".kt": true, ".rs": true, ".rb": true, ".php": true, ".c": true,
+	".h": true, ".cc": true, ".cpp": true, ".hpp": true, ".cs": true, ".swift": true,
+	".scala": true, ".sh": true,
+}
+
+// strategyFor resolves auto for a file.
+func strategyFor(strategy, path string) string {
+	if strategy != ChunkAuto {
+		return strategy
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case ext == ".md" || ext == ".markdown":
+		return ChunkMarkdown
+	case codeExtensions[ext]:
+		return ChunkCode
+	}
+	return ChunkFixed
+}
+
+// textChunk is a chunk with the lines of the document it came from.
+type textChunk struct {
+	text      string
+	startLine int // 1-based
+	endLine   int
+}
+
+// segment is a unit a chunker won't split unless it is too big alone: a
+// line, a sentence, a section or a declaration.
+type segment struct {
+	text string
+	line int // of its first character
+}
+
+func (s segment) endLine() int { return s.line + strings.Count(strings.TrimRight(s.text, "\n"), "\n") }
+
+var (
+	markdownHeadingRe = regexp.MustCompile(`^#{1,6}\s`)
+	markdownFenceRe   = regexp.MustCompile("^(```|~~~)")
+	// codeDeclRe matches the first line of a top-level declaration in the
+	// common languages; nested ones are indented and don't match.
+	codeDeclRe = regexp.MustCompile(`^(?:(?:export|pub|public|private|protected|internal|static|abstract|final|async|default|unsafe|extern)\s+)*(?:func|def|class|function|fn|impl|trait|struct|enum|interface|type|module|object)\b` +
+		`|^(?:export\s+)?(?:const|let|var)\s+\w+\s*=\s*(?:async\s*)?(?:\(|function\b)` +
+		`|^[A-Za-z_][\w<>\[\]*&:, ]*\s+\**[A-Za-z_]\w*\s*\([^;]*$`)
+	// codePreambleRe is what belongs to the declaration below it: comments,
+	// decorators and annotations.
+	codePreambleRe = regexp.MustCompile(`^(?://|#|/\*|\s*\*|@)`)
+	sentenceEndRe  = regexp.MustCompile(`[.!?]["')\]]*\s+`)
+)
+
+// chunkDocument splits text with strategy into chunks of about tokens,
+// repeating about overlap tokens between neighbouring ones.
+func chunkDocument(text, strategy string, tokens, overlap int) []textChunk {
+	lines := strings.SplitAfter(text, "\n")
+	if strategy == ChunkMarkdown {
+		// Sections are never merged, only split when too big, with their
+		// heading repeated so that every piece says what it is about.
+		var out []textChunk
+		starts := make([]bool, len(lines))
+		inFence := false
+		for i, l := range lines {
+			if markdownFenceRe.MatchString(l) {
+				inFence = !inFence
+			}
+			// A "#" in a fenced block is a shell comment, not a heading.
+			starts[i] = !inFence && markdownHeadingRe.MatchString(l)
+		}
+		for _, sec := range splitAt(lines, starts, nil) {
+			heading := ""
+			if markdownHeadingRe.MatchString(sec.text) {
+				heading = strings.TrimSpace(strings.SplitN(sec.text, "\n", 2)[0])
+			}
+			for i, c := range packSegments(lineSegments(sec), tokens, overlap) {
+				if i > 0 && heading != "" {
+					c.text = heading + "\n\n" + c.text
+				}
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+
+	var segs []segment
+	switch strategy {
+	case ChunkSentence:
+		segs = sentenceSegments(text)
+	case ChunkCode:
+		starts := make([]bool, len(lines))
+		for i, l := range lines {
+			starts[i] = codeDeclRe.MatchString(l)
+		}
+		segs = splitAt(lines, starts, codePreambleRe)
+	default:
+		for i, l := range lines {
+			segs = append(segs, segment{l, i + 1})
+		}
+	}
+	return packSegments(segs, tokens, overlap)
+}
+
+// splitAt groups lines into segments that begin at the lines marked in
+// starts, together with the lines right above that match preamble.
+func splitAt(lines []string, starts []bool, preamble *regexp.Regexp) []segment {
+	var segs []segment
+	start := 0
+	for i := range lines {
+		if i == 0 || !starts[i] {
+			continue
+		}
+		cut := i
+		for preamble != nil && cut > start && !starts[cut-1] && preamble.MatchString(lines[cut-1]) {
+			cut--
+		}
+		if cut > start {
+			segs = append(segs, segment{strings.Join(lines[start:cut], ""), start + 1})
+			start = cut
+		}
+	}
+	if start < len(lines) {
+		segs = append(segs, segment{strings.Join(lines[start:], ""), start + 1})
+	}
+	return segs
+}
+
+// lineSegments splits a segment into its lines.
+func lineSegments(s segment) []segment {
+	var segs []segment
+	for i, l := range strings.SplitAfter(s.text, "\n") {
+		if l != "" {
+			segs = append(segs, segment{l, s.line + i})
+		}
+	}
+	return segs
+}
+
+// sentenceSegments splits text into sentences; a blank line also ends one.
+func sentenceSegments(text string) []segment {
+	var segs []segment
+	line := 1
+	add := func(s string) {
+		if s != "" {
+			segs = append(segs, segment{s, line})
+			line += strings.Count(s, "\n")
+		}
+	}
+	for _, para := range strings.SplitAfter(text, "\n\n") {
+		rest := para
+		for {
+			loc := sentenceEndRe.FindStringIndex(rest)
+			if loc == nil {
+				break
+			}
+			add(rest[:loc[1]])
+			rest = rest[loc[1]:]
+		}
+		add(rest)
+	}
+	return segs
+}
+
+// packSegments fills chunks of up to tokens with whole segments, splitting
+// one that is too big alone into lines, and a line into pieces. Each chunk
+// after the first starts with the last segments of the one before, up to
+// overlap tokens.
+func packSegments(segs []segment, tokens, overlap int) []textChunk {
+	var flat []segment
+	for _, s := range segs {
+		flat = append(flat, splitSegment(s, tokens)...)
+	}
+
+	var out []textChunk
+	var cur []segment
+	size, fresh := 0, 0 // fresh counts the segments not carried over
+	flush := func() {
+		if fresh == 0 {
+			return
+		}
+		var b strings.Builder
+		for _, s := range cur {
+			b.WriteString(s.text)
+		}
+		if text := strings.TrimSpace(b.String()); text != "" {
+			// Blank lines at either end don't count towards its lines.
+			first, last := 0, len(cur)-1
+			for strings.TrimSpace(cur[first].text) == "" {
+				first++
+			}
+			for strings.TrimSpace(cur[last].text) == "" {
+				last--
+			}
+			out = append(out, textChunk{text: text, startLine: cur[first].line, endLine: cur[last].endLine()})
+		}
+		keep, kept := len(cur), 0
+		for keep > 0 && kept+estimateTokens(cur[keep-1].text) <= overlap {
+			keep--
+			kept += estimateTokens(cur[keep].text)
+		}
+		cur, size, fresh = append([]segment(nil), cur[keep:]...), kept, 0
+	}
+	for _, s := range flat {
+		t := estimateTokens(s.text)
+		if fresh > 0 && size+t > tokens {
+			flush()
+			// Drop carried segments that leave no room for this one.
+			for len(cur) > 0 && size+t > tokens {
+				size -= estimateTokens(cur[0].text)
+				cur = cur[1:]
+			}
+		}
+		cur = append(cur, s)
+		size += t
+		fresh++
+	}
+	flush()
+	return out
+}
+
+// splitSegment breaks a segment bigger than tokens into its lines, and a
+// line bigger than that into pieces.
+func splitSegment(s segment, tokens int) []segment {
+	if estimateTokens(s.text) <= tokens {
+		return []segment{s}
+	}
+	if lines := lineSegments(s); len(lines) > 1 {
+		var out []segment
+		for _, l := range lines {
+			out = append(out, splitSegment(l, tokens)...)
+		}
+		return out
+	}
+	var out []segment
+	for _, piece := range splitRunes(s.text, tokens*charsPerToken) {
+		out = append(out, segment{piece, s.line})
+	}
+	return out
+}
+
+func splitRunes(s string, n int) []string {
+	r := []rune(s)
+	var out []string
+	for len(r) > n {
+		out = append(out, string(r[:n]))
+		r = r[n:]
+	}
+	return append(out, string(r))
+}
+
+// chunkFlags are kb ingest's chunking settings.
+type chunkFlags struct {
+	strategy *string
+	tokens   *int
+	overlap  *int
+}
+
+func addChunkFlags(fs *flag.FlagSet) *chunkFlags {
+	c := config.Knowledge.Chunking
+	strategy, tokens := c.Strategy, c.Tokens
+	if strategy == "" {
+		strategy = ChunkAuto
+	}
+	if tokens == 0 {
+		tokens = kbChunkTokens
+	}
+	return &chunkFlags{
+		strategy: fs.String("chunk-strategy", strategy, "How documents are split: 'fixed', 'sentence', 'markdown' (by heading), 'code' (by function, type or class) or 'auto' (by file type)"),
+		tokens:   fs.Int("chunk-tokens", tokens, "Approximate tokens per chunk"),
+		overlap:  fs.Int("chunk-overlap", c.Overlap, "Approximate tokens each chunk repeats from the end of the one before"),
+	}
+}
+
+func (f *chunkFlags) config() (ChunkingConfig, error) {
+	c := ChunkingConfig{Strategy: *f.strategy, Tokens: *f.tokens, Overlap: *f.overlap}
+	if !validChunkStrategy(c.Strategy) {
+		return c, fmt.Errorf("invalid --chunk-strategy %q: expected auto, fixed, sentence, markdown or code", c.Strategy)
+	}
+	if c.Tokens < 16 {
+		return c, fmt.Errorf("--chunk-tokens must be at least 16")
+	}
+	if c.Overlap < 0 || c.Overlap >= c.Tokens {
+		return c, fmt.Errorf("--chunk-overlap must be at least 0 and less than --chunk-tokens")
+	}
+	return c, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// citationInstruction asks for the chunk IDs that back each statement.
+const citationInstruction = "Cite the knowledge you use by its chunk ID in square brackets right after the statement it supports, e.g. [%s]; cite several as [id1, id2]. Don't cite chunks you didn't use, and say so when the knowledge doesn't answer the question."
+
+// Source is a knowledge base chunk an answer cites, with where to check it.
+type Source struct {
+	ID        string `json:"id"`
+	Source    string `json:"source"` // the document's path or URL
+	StartLine int    `json:"start_line,omitempty"`
+	EndLine   int    `json:"end_line,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+var (
+	citationRe = regexp.MustCompile(`\[([^\[\]\n]{1,200})\]`)
+	chunkIDRe  = regexp.MustCompile(`\b[0-9a-f]{12}\b`)
+)
+
+// citedSources maps the chunk IDs cited in answer back to the retrieved
+// chunks, in the order they are first cited. IDs that name no retrieved
+// chunk are returned as unknown.
+func citedSources(answer string, chunks []RetrievedChunk) (sources []Source, unknown []string) {
+	byID := make(map[string]RetrievedChunk, len(chunks))
+	for _, c := range chunks {
+		byID[c.ID] = c
+	}
+	seen := map[string]bool{}
+	for _, m := range citationRe.FindAllStringSubmatch(answer, -1) {
+		for _, id := range chunkIDRe.FindAllString(m[1], -1) {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			c, ok := byID[id]
+			if !ok {
+				unknown = append(unknown, id)
+				continue
+			}
+			sources = append(sources, Source{ID: id, Source: c.Source, StartLine: c.StartLine, EndLine: c.EndLine, URL: sourceURL(c)})
+		}
+	}
+	return sources, unknown
+}
+
+// sourceURL links to a chunk: its own URL, or else knowledge.source_url
+// filled in with {path}, {start} and {end}.
+func sourceURL(c RetrievedChunk) string {
+	if strings.HasPrefix(c.Source, "http://") || strings.HasPrefix(c.Source, "https://") {
+		return c.Source
+	}
+	tmpl := config.Knowledge.SourceURL
+	if tmpl == "" {
+		return ""
+	}
+	return strings.NewReplacer("{path}", strings.TrimPrefix(c.Source, "./"), "{start}", strconv.Itoa(c.StartLine), "{end}", strconv.Itoa(c.EndLine)).Replace(tmpl)
+}
+
+// citeSources fills in res.Sources from the answer's citations, warning
+// about uncited answers and unknown IDs; with requireCitations an uncited
+// answer fails the task.
+func (r *runner) citeSources(answer string, res *TaskResult) error {
+	rep := res.Retrieval
+	if rep == nil || len(rep.Chunks) == 0 {
+		return nil
+	}
+	sources, unknown := citedSources(answer, rep.Chunks)
+	res.Sources = sources
+	if len(unknown) > 0 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("the answer cites chunk(s) that were not retrieved: %s", strings.Join(unknown, ", ")))
+	}
+	if len(sources) == 0 {
+		if r.retrieval.requireCitations {
+			return kindError(ErrUncited, "the answer cites none of the %d knowledge base chunk(s) it was given", len(rep.Chunks))
+		}
+		res.Warnings = append(res.Warnings, "the answer cites no knowledge base chunks; it can't be checked against the sources")
+	}
+	return nil
+}
+
+// formatSource is a source as file:lines, with its URL when it has one.
+func formatSource(s Source) string {
+	loc := s.Source
+	if s.StartLine > 0 {
+		loc = fmt.Sprintf("%s:%d-%d", s.Source, s.StartLine, s.EndLine)
+	}
+	if s.URL != "" && s.URL != s.Source {
+		loc += " " + s.URL
+	}
+	return loc
+}
+
+func printSources(sources []Source) {
+	if len(sources) == 0 {
+		return
+	}
+	statusf("--- Sources ---\n")
+	for _, s := range sources {
+		statusf("[%s] %s\n", s.ID, formatSource(s))
+	}
+}
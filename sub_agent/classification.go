@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ClassificationRule labels the tasks whose content matches any of its
+// patterns, or that carry the tag classification=<label>. A labelled task
+// is kept on provider=local.
+type ClassificationRule struct {
+	Label    string   `json:"label"` // e.g. internal-only
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// ClassificationConfig is the "guardrails.classification" config section.
+type ClassificationConfig struct {
+	Rules []ClassificationRule `json:"rules,omitempty"`
+	// NoOverride makes --allow-classified an error, so that classified
+	// tasks can never reach the cloud.
+	NoOverride bool `json:"no_override,omitempty"`
+}
+
+// Classification records a classification decision for the result and
+// the audit log. Matched text is never included, only what matched.
+type Classification struct {
+	Labels    []string `json:"labels"`
+	Matched   []string `json:"matched"`   // "label: pattern N" or "label: tag"
+	Requested string   `json:"requested"` // provider/model before the decision
+	Action    string   `json:"action"`    // forced-local, overridden or none (already local)
+}
+
+// classifier holds the compiled rules.
+type classifier struct {
+	rules []compiledRule
+	allow bool // --allow-classified
+}
+
+type compiledRule struct {
+	label    string
+	patterns []*regexp.Regexp
+}
+
+func newClassifier(c ClassificationConfig, allow bool) (*classifier, error) {
+	if allow && c.NoOverride {
+		return nil, fmt.Errorf("--allow-classified is disabled by guardrails.classification.no_override")
+	}
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	cl := &classifier{allow: allow}
+	for _, rule := range c.Rules {
+		if rule.Label == "" {
+			return nil, fmt.Errorf("a guardrails.classification rule has no label")
+		}
+		cr := compiledRule{label: rule.Label}
+		for _, p := range rule.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid classification pattern for %s: %v", rule.Label, err)
+			}
+			cr.patterns = append(cr.patterns, re)
+		}
+		cl.rules = append(cl.rules, cr)
+	}
+	return cl, nil
+}
+
+// classify labels req by its task, input, context files and tags.
+func (cl *classifier) classify(req TaskRequest) (labels, matched []string) {
+	texts := []string{req.Task, req.Input}
+	for _, f := range req.ContextFiles {
+		texts = append(texts, f.Content)
+	}
+	tag := strings.Split(req.Tags["classification"], ",")
+	for _, rule := range cl.rules {
+		hit := ""
+		if slices.Contains(tag, rule.label) {
+			hit = rule.label + ": tag"
+		}
+		for i, re := range rule.patterns {
+			if hit != "" {
+				break
+			}
+			for _, t := range texts {
+				if t != "" && re.MatchString(t) {
+					hit = fmt.Sprintf("%s: pattern %d", rule.label, i+1)
+					break
+				}
+			}
+		}
+		if hit != "" {
+			labels = append(labels, rule.label)
+			matched = append(matched, hit)
+		}
+	}
+	return labels, matched
+}
+
+// classifyTask keeps a classified task on provider=local unless
+// --allow-classified overrides it. Every call made for the task is then
+// checked by generateAll, so no stage reaches the cloud either.
+func (r *runner) classifyTask(ctx context.Context, req *TaskRequest) (context.Context, *Classification) {
+	if r.classifier == nil {
+		return ctx, nil
+	}
+	labels, matched := r.classifier.classify(*req)
+	if len(labels) == 0 {
+		return ctx, nil
+	}
+	c := &Classification{Labels: labels, Matched: matched, Requested: modelChoice{req.Provider, req.Model}.String()}
+	switch {
+	case r.classifier.allow:
+		c.Action = "overridden"
+		if req.Provider != "local" {
+			statusf("[Sub-Agent] Task classified %s; --allow-classified lets it use %s\n", strings.Join(labels, ", "), c.Requested)
+		}
+		return ctx, c
+	case req.Provider == "local":
+		c.Action = "none"
+	default:
+		c.Action = "forced-local"
+		statusf("[Sub-Agent] Task classified %s; using provider local instead of %s\n", strings.Join(labels, ", "), req.Provider)
+		req.Provider, req.Model = "local", defaultModel("local", "")
+	}
+	return context.WithValue(ctx, localOnlyKey{}, strings.Join(labels, ", ")), c
+}
+
+type localOnlyKey struct{}
+
+// checkLocalOnly fails a call to a non-local provider for a classified task.
+func checkLocalOnly(ctx context.Context, providerName string) error {
+	labels, _ := ctx.Value(localOnlyKey{}).(string)
+	if labels == "" || providerName == "" || providerName == "local" {
+		return nil
+	}
+	return kindError(ErrSafety, "the task is classified %s and may only use provider=local; a call to %s was blocked (see --allow-classified)", labels, providerName)
+}
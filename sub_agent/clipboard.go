@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// PowerShell pipes text as UTF-8 only when told to.
+const (
+	psPaste = "[Console]::OutputEncoding = [Text.Encoding]::UTF8; Get-Clipboard -Raw"
+	psCopy  = "[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())"
+)
+
+// clipboardTools lists the commands that can paste (or copy) on this
+// system, best first; the first one installed is used.
+func clipboardTools(paste bool) [][]string {
+	pick := func(p, c []string) []string {
+		if paste {
+			return p
+		}
+		return c
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{pick([]string{"pbpaste"}, []string{"pbcopy"})}
+	case "windows":
+		return [][]string{pick([]string{"powershell", "-NoProfile", "-Command", psPaste}, []string{"powershell", "-NoProfile", "-Command", psCopy})}
+	}
+	var tools [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append(tools, pick([]string{"wl-paste", "--no-newline"}, []string{"wl-copy"}))
+	}
+	tools = append(tools,
+		pick([]string{"xclip", "-selection", "clipboard", "-out"}, []string{"xclip", "-selection", "clipboard", "-in"}),
+		pick([]string{"xsel", "--clipboard", "--output"}, []string{"xsel", "--clipboard", "--input"}),
+	)
+	if os.Getenv("WSL_DISTRO_NAME") != "" {
+		// Under WSL the Windows clipboard is the one the user sees.
+		tools = append(tools, pick([]string{"powershell.exe", "-NoProfile", "-Command", psPaste}, []string{"powershell.exe", "-NoProfile", "-Command", psCopy}))
+	}
+	return tools
+}
+
+// clipboardTool returns the first of clipboardTools that is installed.
+func clipboardTool(paste bool) ([]string, error) {
+	tools := clipboardTools(paste)
+	for _, t := range tools {
+		if _, err := exec.LookPath(t[0]); err == nil {
+			return t, nil
+		}
+	}
+	var names []string
+	for _, t := range tools {
+		names = append(names, t[0])
+	}
+	return nil, fmt.Errorf("no clipboard command found (tried %s)", strings.Join(names, ", "))
+}
+
+// readClipboard returns the text on the system clipboard.
+func readClipboard() (string, error) {
+	argv, err := clipboardTool(true)
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("reading the clipboard with %s: %v: %s", argv[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.ReplaceAll(string(out), "\r\n", "\n"), nil
+}
+
+// writeClipboard puts text on the system clipboard.
+func writeClipboard(text string) error {
+	argv, err := clipboardTool(false)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("writing the clipboard with %s: %v: %s", argv[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
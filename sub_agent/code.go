@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// codeLanguage is what the code subcommands need to know about a language:
+// how to name and write its tests and doc comments, and how to check that
+// an answer at least parses before it is written.
+type codeLanguage struct {
+	name      string
+	fence     string   // code fence tag
+	exts      []string // first is the one answers are checked under
+	shebangs  []string // interpreters that identify a script without an extension
+	framework string   // test framework test-gen targets
+	docs      string   // doc comment convention
+	// check is a syntax check; "{}" is replaced by the file. A missing
+	// tool skips the check.
+	check []string
+	// testPath is where test-gen puts the tests of path.
+	testPath func(path string) string
+}
+
+var codeLanguages = []codeLanguage{
+	{
+		name: "Go", fence: "go", exts: []string{".go"},
+		framework: `the standard "testing" package with table-driven tests, in the same package as the code`,
+		docs:      "// comments directly above each exported identifier, starting with its name",
+		check:     []string{"gofmt", "-e", "-l", "{}"},
+		testPath: func(p string) string {
+			return strings.TrimSuffix(p, ".go") + "_test.go"
+		},
+	},
+	{
+		name: "Python", fence: "python", exts: []string{".py"}, shebangs: []string{"python", "python3"},
+		framework: "pytest, as plain test_ functions importing the module under test",
+		docs:      `PEP 257 docstrings in triple double quotes on each module, class and function, with Args and Returns sections where useful`,
+		check:     []string{"python3", "-m", "py_compile", "{}"},
+		testPath: func(p string) string {
+			return filepath.Join(filepath.Dir(p), "test_"+filepath.Base(p))
+		},
+	},
+	{
+		name: "JavaScript", fence: "javascript", exts: []string{".js", ".mjs", ".cjs", ".jsx"}, shebangs: []string{"node"},
+		framework: "Jest, with describe and it blocks, requiring or importing the module the way it exports itself",
+		docs:      "JSDoc /** */ blocks with @param and @returns on each function and class",
+		check:     []string{"node", "--check", "{}"},
+		testPath:  dottedTestPath("test"),
+	},
+	{
+		name: "TypeScript", fence: "typescript", exts: []string{".ts", ".tsx"}, shebangs: []string{"ts-node", "deno"},
+		framework: "Jest with ts-jest, with describe and it blocks and typed fixtures",
+		docs:      "TSDoc /** */ blocks with @param and @returns on each exported function, class and type",
+		check:     []string{"tsc", "--noEmit", "--skipLibCheck", "{}"},
+		testPath:  dottedTestPath("test"),
+	},
+	{
+		name: "Rust", fence: "rust", exts: []string{".rs"},
+		framework: "integration tests in tests/ using #[test] functions and the crate's public API",
+		docs:      "/// doc comments on each public item and //! on the module, with # Examples where useful",
+		check:     []string{"rustfmt", "--edition", "2021", "--emit", "stdout", "{}"},
+		testPath: func(p string) string {
+			dir, base := filepath.Dir(p), filepath.Base(p)
+			if filepath.Base(dir) == "src" {
+				dir = filepath.Dir(dir)
+			}
+			return filepath.Join(dir, "tests", base)
+		},
+	},
+	{
+		name: "Java", fence: "java", exts: []string{".java"},
+		framework: "JUnit 5, in a class named after the one under test with Test appended, in the same package",
+		docs:      "Javadoc /** */ blocks with @param, @return and @throws on each public class and method",
+		testPath: func(p string) string {
+			p = strings.TrimSuffix(p, ".java") + "Test.java"
+			sep := string(filepath.Separator)
+			return strings.Replace(p, sep+"main"+sep, sep+"test"+sep, 1)
+		},
+	},
+	{
+		name: "Ruby", fence: "ruby", exts: []string{".rb"}, shebangs: []string{"ruby"},
+		framework: "Minitest, as a Minitest::Test subclass requiring the file under test",
+		docs:      "YARD comments with @param and @return above each public method and class",
+		check:     []string{"ruby", "-c", "{}"},
+		testPath: func(p string) string {
+			return strings.TrimSuffix(p, ".rb") + "_test.rb"
+		},
+	},
+	{
+		name: "Shell", fence: "bash", exts: []string{".sh", ".bash"}, shebangs: []string{"sh", "bash", "zsh"},
+		framework: "bats, with @test blocks that source the script under test",
+		docs:      "# comment blocks above each function describing its arguments, output and exit status",
+		check:     []string{"bash", "-n", "{}"},
+		testPath: func(p string) string {
+			return strings.TrimSuffix(p, filepath.Ext(p)) + ".bats"
+		},
+	},
+}
+
+// dottedTestPath names tests foo.test.js after foo.js.
+func dottedTestPath(infix string) func(string) string {
+	return func(p string) string {
+		ext := filepath.Ext(p)
+		return strings.TrimSuffix(p, ext) + "." + infix + ext
+	}
+}
+
+// detectLanguage picks path's language from its extension, else from the
+// interpreter on its shebang line.
+func detectLanguage(path string, content []byte) (*codeLanguage, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for i, l := range codeLanguages {
+		for _, e := range l.exts {
+			if e == ext {
+				return &codeLanguages[i], nil
+			}
+		}
+	}
+	if line, _, _ := bytes.Cut(content, []byte("\n")); bytes.HasPrefix(line, []byte("#!")) {
+		fields := strings.Fields(string(line[2:]))
+		if len(fields) > 1 && filepath.Base(fields[0]) == "env" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			interp := filepath.Base(fields[0])
+			for i, l := range codeLanguages {
+				for _, s := range l.shebangs {
+					if s == interp {
+						return &codeLanguages[i], nil
+					}
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: can't tell the language; pass --language", path)
+}
+
+// languageNamed looks up --lang by name, fence tag or extension.
+func languageNamed(name string) (*codeLanguage, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "."))
+	match := func(name string) *codeLanguage {
+		for i, l := range codeLanguages {
+			if strings.ToLower(l.name) == name || l.fence == name || strings.TrimPrefix(l.exts[0], ".") == name {
+				return &codeLanguages[i]
+			}
+		}
+		return nil
+	}
+	// The highlighter's aliases fold TypeScript into JavaScript, so they
+	// only apply to names that match nothing by themselves.
+	if l := match(name); l != nil {
+		return l, nil
+	}
+	if alias, ok := languageAliases[name]; ok && alias != "c" {
+		if l := match(alias); l != nil {
+			return l, nil
+		}
+	}
+	var names []string
+	for _, l := range codeLanguages {
+		names = append(names, strings.ToLower(l.name))
+	}
+	return nil, fmt.Errorf("unknown language %q; expected one of %s", name, strings.Join(names, ", "))
+}
+
+// sameLanguage reports whether path is a source file of l.
+func (l *codeLanguage) sameLanguage(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range l.exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// syntaxCheck writes content to a scratch file named like path and runs
+// l's check on it, returning what the checker printed on failure.
+func (l *codeLanguage) syntaxCheck(path, content string) (problem string, checked bool, err error) {
+	if len(l.check) == 0 {
+		return "", false, nil
+	}
+	if _, err := exec.LookPath(l.check[0]); err != nil {
+		return "", false, nil
+	}
+	dir, err := os.MkdirTemp("", "helix-code-")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Base(path)
+	if !l.sameLanguage(name) {
+		name += l.exts[0]
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		return "", false, err
+	}
+	args := make([]string, len(l.check)-1)
+	for i, a := range l.check[1:] {
+		args[i] = strings.ReplaceAll(a, "{}", file)
+	}
+	cmd := exec.Command(l.check[0], args...)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if cmd.Run() == nil {
+		return "", true, nil
+	}
+	return strings.ReplaceAll(out.String(), file, path), true, nil
+}
+
+// siblingContext packs up to n other files of l from path's directory,
+// nearest in name first, for the model to see the surrounding code.
+func siblingContext(l *codeLanguage, path string, n int) []ContextFile {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && e.Name() != filepath.Base(path) && l.sameLanguage(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	// Files sharing the stem (the tests of path, its header) come first.
+	sort.SliceStable(names, func(i, j int) bool {
+		return strings.HasPrefix(names[i], stem) && !strings.HasPrefix(names[j], stem)
+	})
+	var files []ContextFile
+	for _, name := range names {
+		if len(files) == n {
+			break
+		}
+		p := filepath.Join(filepath.Dir(path), name)
+		data, err := os.ReadFile(p)
+		if err != nil || bytes.IndexByte(data, 0) >= 0 {
+			continue
+		}
+		files = append(files, ContextFile{Path: filepath.ToSlash(p), Content: string(data)})
+	}
+	return files
+}
+
+const codeExplainPrompt = `Explain the following %[1]s file for a developer new to the code: what it is for, how its main pieces fit together, and anything surprising or subtle. Refer to functions and types by name. Answer in markdown.
+
+` + "```%[2]s file=%[3]s\n%[4]s\n```"
+
+const codeTestGenPrompt = `Write tests for the following %[1]s file using %[2]s. Cover the main behaviour, edge cases and error paths of its public API. The tests will be saved as %[3]s, so use the imports and package or module names that path needs. Output only the complete test file in one %[4]s code block.
+
+` + "```%[4]s file=%[5]s\n%[6]s\n```"
+
+const codeRefactorPrompt = `Refactor the following %[1]s file: %[2]s. Keep its behaviour and public API unchanged unless the goal says otherwise, and keep its existing style. Output only the complete new file in one %[3]s code block.
+
+` + "```%[3]s file=%[4]s\n%[5]s\n```"
+
+const codeDocstringPrompt = `Add or update the documentation in the following %[1]s file using %[2]s. Document what each item does and anything callers must know; don't restate the code. Change nothing but comments and docstrings. Output only the complete file in one %[3]s code block.
+
+` + "```%[3]s file=%[4]s\n%[5]s\n```"
+
+const codeRepairPrompt = `The %[1]s file you wrote doesn't parse:
+
+%[2]s
+Fix it and output only the complete corrected file in one %[3]s code block.
+
+` + "```%[3]s file=%[4]s\n%[5]s\n```"
+
+// codeAssistant runs the code subcommands' prompts through the task runner.
+type codeAssistant struct {
+	runner   *runner
+	provider string
+	model    string
+	lang     string
+	siblings int
+	context  []ContextFile
+	noCheck  bool
+}
+
+// addCodeFlags registers the flags the code subcommands share and returns a
+// constructor for the assistant, called once they are parsed.
+func addCodeFlags(fs *flag.FlagSet) func() *codeAssistant {
+	prov := fs.String("provider", "local", "Provider: 'local', 'cloud', 'azure-openai', 'bedrock' or an OpenAI-compatible adapter")
+	mdl := fs.String("model", "", "Model name")
+	lang := fs.String("language", "", "Programming language of the files, instead of detecting it from the extension or shebang")
+	siblings := fs.Int("siblings", 8, "Pack up to this many other files of the same language from each file's directory as context")
+	var ctxPaths stringList
+	fs.Var(&ctxPaths, "context", "Also pack this file, directory or glob as context (repeatable)")
+	noCheck := fs.Bool("no-check", false, "Write the answer even if it fails the language's syntax check")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func() *codeAssistant {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		extra, err := collectContextFiles(ctxPaths, false)
+		if err != nil {
+			fatal(configError(err))
+		}
+		return &codeAssistant{
+			runner: r, provider: *prov, model: *mdl,
+			lang: *lang, siblings: *siblings, context: extra, noCheck: *noCheck,
+		}
+	}
+}
+
+// codeFile is an input file of a code subcommand.
+type codeFile struct {
+	path    string
+	content string
+	lang    *codeLanguage
+}
+
+func (c *codeAssistant) load(path string) codeFile {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fatal(kindError(ErrConfig, "%v", err))
+	}
+	var l *codeLanguage
+	if c.lang != "" {
+		l, err = languageNamed(c.lang)
+	} else {
+		l, err = detectLanguage(path, data)
+	}
+	if err != nil {
+		fatal(kindError(ErrConfig, "%v", err))
+	}
+	return codeFile{path: filepath.ToSlash(filepath.Clean(path)), content: strings.TrimRight(string(data), "\n"), lang: l}
+}
+
+func (c *codeAssistant) ask(ctx context.Context, f codeFile, prompt string) (string, error) {
+	req := TaskRequest{Task: prompt, Provider: c.provider, Model: c.model}
+	req.ContextFiles = append(siblingContext(f.lang, f.path, c.siblings), c.context...)
+	res, err := c.runner.run(ctx, req)
+	for _, w := range res.Warnings {
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: %s\n", w)
+	}
+	return res.Output, err
+}
+
+// askCode asks for a whole file and checks it parses, giving the model one
+// chance to repair it. dest is the path the answer will be written to.
+func (c *codeAssistant) askCode(ctx context.Context, f codeFile, dest, prompt string) (string, error) {
+	out, err := c.ask(ctx, f, prompt)
+	if err != nil {
+		return "", err
+	}
+	code := strings.TrimRight(extractFirstCodeBlock(out), "\n") + "\n"
+	if strings.TrimSpace(code) == "" {
+		return "", kindError(ErrEmpty, "%s: the answer has no code", f.path)
+	}
+	if c.noCheck {
+		return code, nil
+	}
+	for attempt := 0; ; attempt++ {
+		problem, checked, err := f.lang.syntaxCheck(dest, code)
+		if err != nil {
+			return "", err
+		}
+		if !checked {
+			statusf("[Sub-Agent] No syntax check for %s available; writing %s unchecked\n", f.lang.name, dest)
+			return code, nil
+		}
+		if problem == "" {
+			return code, nil
+		}
+		if attempt == 1 {
+			return "", kindError(ErrProvider, "%s still doesn't parse after a repair (pass --no-check to write it anyway):\n%s", dest, strings.TrimSpace(problem))
+		}
+		statusf("[Sub-Agent] %s doesn't parse; asking for a fix\n", dest)
+		out, err := c.ask(ctx, f, fmt.Sprintf(codeRepairPrompt, f.lang.name, strings.TrimSpace(problem), f.lang.fence, dest, strings.TrimRight(code, "\n")))
+		if err != nil {
+			return "", err
+		}
+		code = strings.TrimRight(extractFirstCodeBlock(out), "\n") + "\n"
+	}
+}
+
+// writeCode writes code to dest, or with diffOnly prints the diff against
+// what is there now. The previous contents go into an undo bundle.
+func writeCode(task, dest, code string, diffOnly bool) {
+	if diffOnly {
+		old, _ := os.ReadFile(dest)
+		if d := unifiedDiff(string(old), code, dest, dest, 3); d != "" {
+			fmt.Print(d)
+		}
+		return
+	}
+	manifest, err := writeExtractedFiles(".", task, []extractedFile{{path: dest, content: code}}, nil, "")
+	if err != nil {
+		fatal(err)
+	}
+	printFileChanges(manifest)
+}
+
+func requireFiles(args []string) {
+	if len(args) == 0 {
+		fatal(kindError(ErrConfig, "no files given"))
+	}
+}
+
+// codeExplainCommand implements `code explain FILE...`.
+func codeExplainCommand(fs *flag.FlagSet) func(args []string) {
+	assistant := addCodeFlags(fs)
+	return func(args []string) {
+		requireFiles(args)
+		c := assistant()
+		for i, path := range args {
+			f := c.load(path)
+			out, err := c.ask(context.Background(), f, fmt.Sprintf(codeExplainPrompt, f.lang.name, f.lang.fence, f.path, f.content))
+			if err != nil {
+				fatal(err)
+			}
+			if len(args) > 1 {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("## %s\n\n", f.path)
+			}
+			fmt.Println(strings.TrimSpace(out))
+		}
+	}
+}
+
+// codeTestGenCommand implements `code test-gen FILE...`: a test file for
+// each at the language's conventional path.
+func codeTestGenCommand(fs *flag.FlagSet) func(args []string) {
+	out := fs.String("out", "", "Write the tests here instead of the conventional path (one file only)")
+	force := fs.Bool("force", false, "Overwrite an existing test file")
+	diffOnly := fs.Bool("diff", false, "Print the diff instead of writing the file")
+	assistant := addCodeFlags(fs)
+	return func(args []string) {
+		requireFiles(args)
+		if *out != "" && len(args) > 1 {
+			fatal(kindError(ErrConfig, "--out takes one file"))
+		}
+		c := assistant()
+		for _, path := range args {
+			f := c.load(path)
+			dest := *out
+			if dest == "" {
+				dest = filepath.ToSlash(f.lang.testPath(filepath.FromSlash(f.path)))
+			}
+			if _, err := os.Stat(dest); err == nil && !*force && !*diffOnly {
+				fatal(kindError(ErrConfig, "%s exists; pass --force to overwrite it", dest))
+			}
+			code, err := c.askCode(context.Background(), f, dest, fmt.Sprintf(codeTestGenPrompt, f.lang.name, f.lang.framework, dest, f.lang.fence, f.path, f.content))
+			if err != nil {
+				fatal(err)
+			}
+			writeCode("code test-gen "+f.path, dest, code, *diffOnly)
+		}
+	}
+}
+
+// codeRefactorCommand implements `code refactor --goal GOAL FILE...`,
+// rewriting each file in place.
+func codeRefactorCommand(fs *flag.FlagSet) func(args []string) {
+	goal := fs.String("goal", "", "What the refactoring should achieve (required)")
+	diffOnly := fs.Bool("diff", false, "Print the diff instead of writing the file")
+	assistant := addCodeFlags(fs)
+	return func(args []string) {
+		requireFiles(args)
+		if strings.TrimSpace(*goal) == "" {
+			fatal(kindError(ErrConfig, "--goal is required"))
+		}
+		c := assistant()
+		for _, path := range args {
+			f := c.load(path)
+			code, err := c.askCode(context.Background(), f, f.path, fmt.Sprintf(codeRefactorPrompt, f.lang.name, *goal, f.lang.fence, f.path, f.content))
+			if err != nil {
+				fatal(err)
+			}
+			writeCode("code refactor "+f.path, f.path, code, *diffOnly)
+		}
+	}
+}
+
+// codeDocstringCommand implements `code docstring FILE...`: document each
+// file in place in its language's doc comment convention.
+func codeDocstringCommand(fs *flag.FlagSet) func(args []string) {
+	diffOnly := fs.Bool("diff", false, "Print the diff instead of writing the file")
+	assistant := addCodeFlags(fs)
+	return func(args []string) {
+		requireFiles(args)
+		c := assistant()
+		for _, path := range args {
+			f := c.load(path)
+			code, err := c.askCode(context.Background(), f, f.path, fmt.Sprintf(codeDocstringPrompt, f.lang.name, f.lang.docs, f.lang.fence, f.path, f.content))
+			if err != nil {
+				fatal(err)
+			}
+			writeCode("code docstring "+f.path, f.path, code, *diffOnly)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a node of the CLI tree. setup registers the command's flags on
+// fs and returns the function that runs it once they are parsed; commands
+// with children but no setup only dispatch. Completion scripts and the man
+// page are generated from the same tree, so registering a command or flag
+// here is all it takes to make it discoverable.
+type command struct {
+	name     string
+	summary  string
+	setup    func(fs *flag.FlagSet) func(args []string)
+	children []*command
+}
+
+// rootCommand is `helix` itself: one-shot task mode plus the subcommands.
+var rootCommand = &command{
+	name:    "helix",
+	summary: "Run a task on a local or cloud model",
+	setup:   taskCommand,
+}
+
+func init() {
+	// Assigned here because completion and man walk rootCommand.
+	rootCommand.children = []*command{
+		{name: "models", summary: "Print the effective model registry", setup: modelsCommand},
+		{name: "serve", summary: "Serve the HTTP task API", setup: serveCommand},
+		{name: "daemon", summary: "Keep providers, caches and history warm and run tasks for helix client over a local socket", setup: daemonCommand},
+		{name: "client", summary: "Run a task on a running helix daemon", setup: clientCommand},
+		{name: "worker", summary: "Run tasks from a queue directory", setup: workerCommand, children: []*command{
+			{name: "cancel", summary: "Cancel queued or running tasks by leaving tombstones for the workers", setup: workerCancelCommand},
+		}},
+		{name: "batch", summary: "Run a JSONL file of tasks, slowing down for rate limits, and write the results in order", setup: batchCommand},
+		{name: "summarize", summary: "Map-reduce summarize a large document", setup: summarizeCommand},
+		{name: "translate", summary: "Translate a document, detecting its language", setup: translateCommand},
+		{name: "image", summary: "Generate images with Imagen or Stable Diffusion", children: []*command{
+			{name: "generate", summary: "Generate images from a prompt and save them", setup: imageGenerateCommand},
+		}},
+		{name: "chat", summary: "Interactive chat with slash commands", setup: chatCommand},
+		{name: "auth", summary: "Manage provider keys in the OS keyring", children: []*command{
+			{name: "login", summary: "Store a provider key in the keyring", setup: authLoginCommand},
+			{name: "logout", summary: "Remove a provider key from the keyring", setup: authLogoutCommand},
+		}},
+		{name: "audit", summary: "Inspect the audit log", children: []*command{
+			{name: "verify", summary: "Check the audit log's hash chain", setup: auditVerifyCommand},
+		}},
+		{name: "git", summary: "Commit messages, reviews and changelogs from git", children: []*command{
+			{name: "commit-msg", summary: "Write a commit message for the staged diff", setup: gitCommitMsgCommand},
+			{name: "review", summary: "Review a diff or range and report findings", setup: gitReviewCommand},
+			{name: "changelog", summary: "Write a changelog for a range of commits", setup: gitChangelogCommand},
+		}},
+		{name: "logs", summary: "Find anomalies in logs and summarize the incident", children: []*command{
+			{name: "analyze", summary: "Analyze a log window by window and write a structured incident summary", setup: logsAnalyzeCommand},
+		}},
+		{name: "code", summary: "Explain, test, refactor and document source files in their own language", children: []*command{
+			{name: "explain", summary: "Explain what a file does and how it fits together", setup: codeExplainCommand},
+			{name: "test-gen", summary: "Write tests for a file at the language's conventional test path", setup: codeTestGenCommand},
+			{name: "refactor", summary: "Rewrite a file in place towards a --goal", setup: codeRefactorCommand},
+			{name: "docstring", summary: "Add doc comments to a file in its language's convention", setup: codeDocstringCommand},
+		}},
+		{name: "undo", summary: "Revert the last edit made by --apply or --extract-files", setup: undoCommand},
+		{name: "rollback", summary: "Restore the workspace to before the last run whose tools could change it", setup: rollbackCommand},
+		{name: "resume", summary: "Finish an interrupted --plan or --tools run from its checkpoint", setup: resumeCommand},
+		{name: "replay", summary: "Run a recorded task again with the same prompt, settings and seed, and diff the answers", setup: replayCommand},
+		{name: "golden", summary: "Check the agent loop against golden transcripts: scripted model replies and tool results, expected tool calls and answer", setup: goldenCommand},
+		{name: "diff", summary: "Compare the answers, latency, tokens and cost of two recorded runs", setup: diffCommand},
+		{name: "history", summary: "Move recorded runs between machines as JSONL, Markdown or ShareGPT transcripts, and encrypt them at rest", children: []*command{
+			{name: "export", summary: "Write recorded runs as transcripts", setup: historyExportCommand},
+			{name: "import", summary: "Record the runs of transcripts, skipping those already recorded", setup: historyImportCommand},
+			{name: "prune", summary: "Remove the runs the retention policy doesn't keep: by count, age, tag and total size", setup: historyPruneCommand},
+			{name: "encrypt", summary: "Encrypt, or with --decrypt decrypt, the runs, checkpoints and memories already on disk", setup: historyEncryptCommand},
+		}},
+		{name: "dataset", summary: "Build fine-tuning data from recorded runs", children: []*command{
+			{name: "build", summary: "Write the accepted runs, filtered by tag, judge score and date and deduplicated, as instruction-tuning JSONL", setup: datasetBuildCommand},
+		}},
+		{name: "warm", summary: "Preload models on the Ollama hosts, once or on a schedule, to skip cold starts", setup: warmCommand},
+		{name: "perf", summary: "Show local inference speed and cold starts over time from the run history", setup: perfCommand},
+		{name: "report", summary: "Report usage and estimated cost by provider, model, tag and tenant from the run history", setup: reportCommand},
+		{name: "export", summary: "Export recorded runs and their judge scores for experiment tracking (CSV, W&B-style JSONL, MLflow)", setup: exportCommand},
+		{name: "tools", summary: "List the tools --tools can enable", setup: toolsCommand},
+		{name: "drafts", summary: "Review, send and discard the emails drafted by email.draft", children: []*command{
+			{name: "list", summary: "List the drafts waiting to be sent", setup: draftsListCommand},
+			{name: "show", summary: "Print a draft", setup: draftsShowCommand},
+			{name: "send", summary: "Send a draft over SMTP, after showing it and asking", setup: draftsSendCommand},
+			{name: "discard", summary: "Delete drafts without sending them", setup: draftsDiscardCommand},
+		}},
+		{name: "version", summary: "Print the version, commit and build date", setup: versionCommand},
+		{name: "self-update", summary: "Replace this binary with the latest release, verified against its checksums", setup: selfUpdateCommand},
+		{name: "doctor", summary: "Diagnose provider setup and suggest fixes", setup: doctorCommand},
+		{name: "probe", summary: "Probe providers for their models, context windows and tool and embedding support", setup: probeCommand},
+		{name: "tokens", summary: "Count tokens without sending a request", children: []*command{
+			{name: "count", summary: "Count a file's tokens for a provider/model", setup: tokensCountCommand},
+		}},
+		{name: "kb", summary: "Manage knowledge bases retrieved into tasks with --kb", children: []*command{
+			{name: "ingest", summary: "Chunk, embed and store documents", setup: kbIngestCommand},
+			{name: "sync", summary: "Update the chunks of changed and deleted files, once or with --watch", setup: kbSyncCommand},
+			{name: "search", summary: "Show the chunks a query retrieves", setup: kbSearchCommand},
+			{name: "list", summary: "List knowledge bases", setup: kbListCommand},
+		}},
+		{name: "examples", summary: "Manage the few-shot example sets used with --examples", children: []*command{
+			{name: "list", summary: "List example sets", setup: examplesListCommand},
+		}},
+		{name: "pipeline", summary: "Run named multi-stage pipelines defined in YAML", children: []*command{
+			{name: "run", summary: "Run a pipeline's stages in order with --var values", setup: pipelineRunCommand},
+			{name: "dry-run", summary: "Show each stage's resolved prompts and models without calling providers", setup: pipelineDryRunCommand},
+			{name: "graph", summary: "Draw the stages, branches and loops as Mermaid or Graphviz DOT", setup: pipelineGraphCommand},
+			{name: "list", summary: "List pipelines and their stages", setup: pipelineListCommand},
+		}},
+		{name: "cache", summary: "Manage Gemini context caches used with --gemini-cache", children: []*command{
+			{name: "create", summary: "Upload files as a cache", setup: cacheCreateCommand},
+			{name: "list", summary: "List caches and when they expire", setup: cacheListCommand},
+			{name: "extend", summary: "Set a cache's expiry to a new TTL from now", setup: cacheExtendCommand},
+			{name: "delete", summary: "Delete caches before they expire", setup: cacheDeleteCommand},
+		}},
+		{name: "judge", summary: "Score an answer against criteria or a rubric with a judge model", setup: judgeCommand},
+		{name: "memory", summary: "Manage long-term memories saved with --memory", children: []*command{
+			{name: "list", summary: "List the memories in a namespace", setup: memoryListCommand},
+			{name: "add", summary: "Remember a fact", setup: memoryAddCommand},
+			{name: "forget", summary: "Delete memories by ID, or all of them", setup: memoryForgetCommand},
+		}},
+		{name: "mcp-serve", summary: "Serve run and summarize as MCP tools over stdio", setup: mcpServeCommand},
+		{name: "editor-serve", summary: "Serve explain selection, rewrite selection and generate tests to editors over stdio, framed like a language server", setup: editorServeCommand},
+		{name: "completion", summary: "Print a shell completion script", children: []*command{
+			{name: "bash", summary: "Completion for bash", setup: completionCommand("bash")},
+			{name: "zsh", summary: "Completion for zsh", setup: completionCommand("zsh")},
+			{name: "fish", summary: "Completion for fish", setup: completionCommand("fish")},
+		}},
+		{name: "man", summary: "Print the man page (roff)", setup: manCommand},
+	}
+}
+
+// child returns the subcommand called name, or nil.
+func (c *command) child(name string) *command {
+	for _, sub := range c.children {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// execute dispatches args down the tree and runs the command they select.
+// path is the command's full name, e.g. "helix auth login".
+func (c *command) execute(path string, args []string) {
+	if len(args) > 0 {
+		if sub := c.child(args[0]); sub != nil {
+			sub.execute(path+" "+sub.name, args[1:])
+			return
+		}
+	}
+	if c.setup == nil {
+		fmt.Printf("Usage: %s %s\n", path, c.childNames())
+		os.Exit(1)
+	}
+	fs := c.flags(path)
+	run := c.setup(fs)
+	fs.Usage = func() { c.usage(path, fs) }
+	fs.Parse(args)
+	run(fs.Args())
+}
+
+// flags returns a fresh flag set named after path.
+func (c *command) flags(path string) *flag.FlagSet {
+	return flag.NewFlagSet(strings.TrimPrefix(path, "helix "), flag.ExitOnError)
+}
+
+// describe registers c's flags on a throwaway set, without running it, and
+// returns them sorted by name.
+func (c *command) describe(path string) []*flag.Flag {
+	if c.setup == nil {
+		return nil
+	}
+	fs := c.flags(path)
+	c.setup(fs)
+	var out []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { out = append(out, f) })
+	return out
+}
+
+func (c *command) childNames() string {
+	names := make([]string, len(c.children))
+	for i, sub := range c.children {
+		names[i] = sub.name
+	}
+	return strings.Join(names, "|")
+}
+
+func (c *command) usage(path string, fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n\n%s.\n", path, c.summary)
+	if len(c.children) > 0 {
+		fmt.Fprintf(out, "\nCommands:\n")
+		for _, sub := range c.children {
+			fmt.Fprintf(out, "  %-12s %s\n", sub.name, sub.summary)
+		}
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// walk calls fn for c and every command below it, parents first.
+func (c *command) walk(path string, fn func(path string, c *command)) {
+	fn(path, c)
+	for _, sub := range c.children {
+		sub.walk(path+" "+sub.name, fn)
+	}
+}
+
+// isBoolFlag reports whether f takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// compactConfig controls auto-summarization of long conversations in chat
+// and the tool loop: once the prompt passes at of the model's budget, the
+// older turns are folded into a running summary and only the last keep
+// turns stay verbatim.
+type compactConfig struct {
+	at       float64 // 0 disables
+	keep     int
+	provider string // "" uses the task's provider and model
+	model    string
+}
+
+const compactInstructions = `
+The text is a conversation (with any running summary of earlier turns first). Keep what the conversation needs to continue from the summary alone: the user's requests and preferences, facts, names, numbers, decisions, tool results and open questions.`
+
+// promptBudget is the tokens a prompt may use: the model's window minus the
+// output reserve.
+func (r *runner) promptBudget(req TaskRequest) int {
+	window := r.context.window
+	if window == 0 {
+		window = contextWindow(req.Provider, req.Model)
+	}
+	return max(window-r.context.reserveTokens, 256)
+}
+
+// shouldCompact reports whether a prompt of tokens is due for compaction.
+func (r *runner) shouldCompact(req TaskRequest, tokens int) bool {
+	return r.compact.at > 0 && float64(tokens) > r.compact.at*float64(r.promptBudget(req))
+}
+
+// compactTurns folds all but the last keep turns into summary and returns
+// the new summary and how many turns it now covers; 0 means nothing was
+// folded. The configured compaction model is tried first, then the task's.
+func (r *runner) compactTurns(ctx context.Context, req TaskRequest, summary string, turns []string) (string, int, error) {
+	n := len(turns) - r.compact.keep
+	if n <= 0 {
+		return summary, 0, nil
+	}
+	var b strings.Builder
+	if summary != "" {
+		b.WriteString("[Summary of earlier turns]\n" + summary + "\n\n")
+	}
+	b.WriteString(strings.Join(turns[:n], "\n\n"))
+
+	type choice struct{ provider, model string }
+	choices := []choice{{req.Provider, req.Model}}
+	if c := r.compact; c.provider != "" && (c.provider != req.Provider || c.model != req.Model) {
+		choices = append([]choice{{c.provider, defaultModel(c.provider, c.model)}}, choices...)
+	}
+	var err error
+	for i, c := range choices {
+		chunk := min(3000, r.promptBudget(TaskRequest{Provider: c.provider, Model: c.model})/2)
+		s := &summarizer{provider: c.provider, model: c.model, key: r.key, chunkTokens: chunk, concurrency: 4, instructions: compactInstructions}
+		var sum SummaryResult
+		if sum, err = s.summarize(ctx, b.String()); err == nil {
+			return strings.TrimSpace(sum.Output), n, nil
+		}
+		if i < len(choices)-1 {
+			logf(ctx, "Warning: summarizing with %s failed (%v); using %s", modelChoice{c.provider, c.model}, err, modelChoice{req.Provider, req.Model})
+		}
+	}
+	return summary, 0, fmt.Errorf("summarizing conversation: %w", err)
+}
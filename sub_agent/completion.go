@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// completionCommand implements `completion <shell>`.
+func completionCommand(shell string) func(fs *flag.FlagSet) func(args []string) {
+	return func(fs *flag.FlagSet) func(args []string) {
+		return func([]string) {
+			switch shell {
+			case "bash":
+				fmt.Print(bashCompletion())
+			case "zsh":
+				fmt.Print(zshCompletion())
+			case "fish":
+				fmt.Print(fishCompletion())
+			}
+		}
+	}
+}
+
+// completionNode is one command as the completion scripts see it.
+type completionNode struct {
+	path  string // "helix auth login"
+	cmd   *command
+	flags []*flag.Flag
+}
+
+func completionTree() []completionNode {
+	var nodes []completionNode
+	rootCommand.walk("helix", func(path string, c *command) {
+		nodes = append(nodes, completionNode{path, c, c.describe(path)})
+	})
+	return nodes
+}
+
+// providerNames are the values offered for --provider.
+func providerNames() []string {
+	return append([]string{"local", "cloud", "azure-openai", "bedrock"}, adapterNames()...)
+}
+
+// valueFlags lists every flag, across all commands, that takes a value;
+// after one of them the shell falls back to completing files.
+func valueFlags(nodes []completionNode) []string {
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		for _, f := range n.flags {
+			if !isBoolFlag(f) && f.Name != "provider" {
+				seen[f.Name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandPaths is the case pattern matching any known command path.
+func commandPaths(nodes []completionNode) string {
+	var paths []string
+	for _, n := range nodes[1:] {
+		paths = append(paths, fmt.Sprintf("%q", n.path))
+	}
+	return strings.Join(paths, "|")
+}
+
+func bashCompletion() string {
+	nodes := completionTree()
+	var b strings.Builder
+	b.WriteString("# bash completion for helix; generated by `helix completion bash`\n")
+	b.WriteString("_helix() {\n")
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("    local cmd=helix i\n")
+	b.WriteString("    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("        case \"$cmd ${COMP_WORDS[i]}\" in\n")
+	fmt.Fprintf(&b, "            %s) cmd=\"$cmd ${COMP_WORDS[i]}\" ;;\n", commandPaths(nodes))
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n")
+	b.WriteString("    case \"$prev\" in\n")
+	fmt.Fprintf(&b, "        -provider|--provider) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", strings.Join(providerNames(), " "))
+	var vf []string
+	for _, name := range valueFlags(nodes) {
+		vf = append(vf, "-"+name, "--"+name)
+	}
+	fmt.Fprintf(&b, "        %s) return ;;\n", strings.Join(vf, "|"))
+	b.WriteString("    esac\n")
+	b.WriteString("    local words\n")
+	b.WriteString("    case \"$cmd\" in\n")
+	for _, n := range nodes {
+		var words []string
+		for _, sub := range n.cmd.children {
+			words = append(words, sub.name)
+		}
+		for _, f := range n.flags {
+			words = append(words, "--"+f.Name)
+		}
+		fmt.Fprintf(&b, "        %q) words=%q ;;\n", n.path, strings.Join(words, " "))
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("    COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o default -F _helix helix\n")
+	return b.String()
+}
+
+// zshQuote quotes an _describe entry: single quotes, with ':' escaped
+// because it separates the word from its description.
+func zshQuote(word, desc string) string {
+	s := strings.ReplaceAll(word, ":", `\:`) + ":" + desc
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func zshCompletion() string {
+	nodes := completionTree()
+	var b strings.Builder
+	b.WriteString("#compdef helix\n")
+	b.WriteString("# zsh completion for helix; generated by `helix completion zsh`\n")
+	b.WriteString("_helix() {\n")
+	b.WriteString("    local cmd=helix i\n")
+	b.WriteString("    for ((i = 2; i < CURRENT; i++)); do\n")
+	b.WriteString("        case \"$cmd ${words[i]}\" in\n")
+	fmt.Fprintf(&b, "            %s) cmd=\"$cmd ${words[i]}\" ;;\n", commandPaths(nodes))
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n")
+	b.WriteString("    case \"${words[CURRENT-1]}\" in\n")
+	fmt.Fprintf(&b, "        -provider|--provider) compadd -- %s; return ;;\n", strings.Join(providerNames(), " "))
+	var vf []string
+	for _, name := range valueFlags(nodes) {
+		vf = append(vf, "-"+name, "--"+name)
+	}
+	fmt.Fprintf(&b, "        %s) _files; return ;;\n", strings.Join(vf, "|"))
+	b.WriteString("    esac\n")
+	b.WriteString("    local -a entries\n")
+	b.WriteString("    case \"$cmd\" in\n")
+	for _, n := range nodes {
+		var entries []string
+		for _, sub := range n.cmd.children {
+			entries = append(entries, zshQuote(sub.name, sub.summary))
+		}
+		for _, f := range n.flags {
+			_, usage := flag.UnquoteUsage(f)
+			entries = append(entries, zshQuote("--"+f.Name, usage))
+		}
+		fmt.Fprintf(&b, "        %q) entries=(\n", n.path)
+		for _, e := range entries {
+			fmt.Fprintf(&b, "            %s\n", e)
+		}
+		b.WriteString("        ) ;;\n")
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("    _describe helix entries\n")
+	b.WriteString("}\n")
+	b.WriteString("compdef _helix helix\n")
+	return b.String()
+}
+
+// fishQuote single-quotes s for fish, where only \ and ' are special.
+func fishQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+func fishCompletion() string {
+	nodes := completionTree()
+	var b strings.Builder
+	b.WriteString("# fish completion for helix; generated by `helix completion fish`\n")
+	b.WriteString("function __helix_cmd\n")
+	b.WriteString("    set -l cmd helix\n")
+	b.WriteString("    for w in (commandline -opc)[2..-1]\n")
+	b.WriteString("        switch \"$cmd $w\"\n")
+	var paths []string
+	for _, n := range nodes[1:] {
+		paths = append(paths, fishQuote(n.path))
+	}
+	fmt.Fprintf(&b, "            case %s\n", strings.Join(paths, " "))
+	b.WriteString("                set cmd \"$cmd $w\"\n")
+	b.WriteString("        end\n")
+	b.WriteString("    end\n")
+	b.WriteString("    echo $cmd\n")
+	b.WriteString("end\n\n")
+	b.WriteString("complete -c helix -f\n")
+	for _, n := range nodes {
+		cond := fishQuote(fmt.Sprintf("test (__helix_cmd) = %q", n.path))
+		for _, sub := range n.cmd.children {
+			fmt.Fprintf(&b, "complete -c helix -n %s -a %s -d %s\n", cond, sub.name, fishQuote(sub.summary))
+		}
+		for _, f := range n.flags {
+			_, usage := flag.UnquoteUsage(f)
+			arg := ""
+			switch {
+			case f.Name == "provider":
+				arg = " -x -a " + fishQuote(strings.Join(providerNames(), " "))
+			case !isBoolFlag(f):
+				arg = " -r -F"
+			}
+			fmt.Fprintf(&b, "complete -c helix -n %s -l %s%s -d %s\n", cond, f.Name, arg, fishQuote(usage))
+		}
+	}
+	return b.String()
+}
+
+// manCommand implements `man`: helix(1) in roff, covering every command.
+func manCommand(fs *flag.FlagSet) func(args []string) {
+	return func([]string) { fmt.Print(manPage(time.Now())) }
+}
+
+// roffEscape escapes text for use in a roff line.
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+func manPage(now time.Time) string {
+	nodes := completionTree()
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH HELIX 1 %q \"helix\" \"User Commands\"\n", now.Format("2006-01-02"))
+	b.WriteString(".SH NAME\nhelix \\- run tasks on local and cloud models\n")
+	b.WriteString(".SH SYNOPSIS\n.B helix\n[\\fIflags\\fR] \\-\\-task \\fItext\\fR\n.br\n.B helix\n\\fIcommand\\fR [\\fIflags\\fR]\n")
+	b.WriteString(".SH DESCRIPTION\n")
+	b.WriteString("Without a command, helix runs the task given by \\-\\-task on the selected provider and prints the result. ")
+	b.WriteString("Flags may be written with one or two dashes. Defaults for many flags come from the config file.\n")
+	b.WriteString(".SH OPTIONS\n")
+	manFlags(&b, nodes[0].flags)
+	b.WriteString(".SH COMMANDS\n")
+	for _, n := range nodes[1:] {
+		fmt.Fprintf(&b, ".SS %s\n%s.\n", roffEscape(n.path), roffEscape(n.cmd.summary))
+		manFlags(&b, n.flags)
+	}
+	b.WriteString(".SH ENVIRONMENT\n")
+	for _, env := range [][2]string{
+		{"HELIX_CONFIG", "Config file path (default ~/.config/helix/config.json)."},
+		{"HELIX_MODEL", "Default local model."},
+		{"OLLAMA_HOST", "Ollama's address; without it helix tries the usual places for its environment."},
+		{"HELIX_SOCKET", "Socket of helix daemon and helix client (default helix.sock in $XDG_RUNTIME_DIR or the state directory)."},
+		{"GEMINI_API_KEY", "Key for the cloud provider; adapters use their own variables such as OPENAI_API_KEY."},
+		{"NO_COLOR", "Disables markdown rendering on a terminal."},
+		{"XDG_STATE_HOME", "Where chat history and the run history for helix replay are kept."},
+	} {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", env[0], roffEscape(env[1]))
+	}
+	b.WriteString(".SH EXIT STATUS\n")
+	codes := make([]string, 0, len(exitCodes))
+	for kind, code := range exitCodes {
+		codes = append(codes, fmt.Sprintf("%d\t%s", code, kind))
+	}
+	sort.Strings(codes)
+	b.WriteString(".nf\n0\tsuccess\n1\tother failure\n")
+	for _, c := range codes {
+		b.WriteString(roffEscape(c) + "\n")
+	}
+	b.WriteString(".fi\n")
+	return b.String()
+}
+
+func manFlags(b *strings.Builder, flags []*flag.Flag) {
+	for _, f := range flags {
+		name, usage := flag.UnquoteUsage(f)
+		b.WriteString(".TP\n")
+		if name == "" {
+			fmt.Fprintf(b, ".B \\-\\-%s\n", roffEscape(f.Name))
+		} else {
+			fmt.Fprintf(b, ".BI \\-\\-%s \" %s\"\n", roffEscape(f.Name), roffEscape(name))
+		}
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "[]" {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		b.WriteString(roffEscape(usage) + "\n")
+	}
+}
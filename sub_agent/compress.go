@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// compressConfig controls --compress: before a task goes to a provider off
+// the machine, a small local model rewrites its long piped input and .log
+// context files without the boilerplate and repetition, so the expensive
+// model reads fewer tokens.
+type compressConfig struct {
+	enabled   bool
+	provider  string
+	model     string
+	minTokens int // texts shorter than this are sent as they are
+}
+
+// CompressionReport measures a --compress pass.
+type CompressionReport struct {
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	Texts            int     `json:"texts"` // the input and context files compressed
+	OriginalTokens   int     `json:"original_tokens"`
+	CompressedTokens int     `json:"compressed_tokens"`
+	SavedTokens      int     `json:"saved_tokens"`
+	SavedCost        float64 `json:"saved_cost_usd"` // at the task model's prompt price
+	DurationMS       int64   `json:"duration_ms"`
+}
+
+// compressChunkTokens is the size of the pieces the local model rewrites;
+// small models lose track of longer ones.
+const compressChunkTokens = 1500
+
+const compressPrompt = `Rewrite the text below so another model can do the task with fewer tokens. Drop boilerplate, banners, progress output, repeated and near-identical lines and anything the task doesn't need. Keep errors, warnings, stack traces, numbers, timestamps of notable events, identifiers, paths and names exactly as written. Don't summarize in prose, explain or add anything; reply with only the rewritten text.
+
+Task: %s
+
+Text:
+%s`
+
+// similarLine masks digits so log lines that differ only in timestamps,
+// counters or IDs compare equal.
+var similarLine = regexp.MustCompile(`[0-9]+`)
+
+// collapseRepeats replaces runs of similar lines after the first with a
+// count, which costs nothing and is most of the saving on many logs.
+func collapseRepeats(text string) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	for i := 0; i < len(lines); {
+		key := similarLine.ReplaceAllString(lines[i], "#")
+		j := i + 1
+		for j < len(lines) && similarLine.ReplaceAllString(lines[j], "#") == key {
+			j++
+		}
+		out = append(out, lines[i])
+		if n := j - i - 1; n == 1 {
+			out = append(out, lines[i+1])
+		} else if n > 1 {
+			out = append(out, fmt.Sprintf("[... %d similar lines ...]", n))
+		}
+		i = j
+	}
+	return strings.Join(out, "\n")
+}
+
+// compressText collapses and then rewrites text with the local model, a
+// chunk at a time. Chunks the model doesn't shorten are kept.
+func (r *runner) compressText(ctx context.Context, task, text string) (string, error) {
+	chunks := splitByTokens(collapseRepeats(text), compressChunkTokens)
+	// One local model serves the chunks, so there is little to gain from
+	// running many at once.
+	s := &summarizer{provider: r.compress.provider, model: defaultModel(r.compress.provider, r.compress.model), key: r.key, concurrency: 2}
+	out, err := s.mapChunks(ctx, chunks, func(_ int, c string) string {
+		return fmt.Sprintf(compressPrompt, truncateRunes(task, 500), c)
+	})
+	if err != nil {
+		return "", err
+	}
+	for i, o := range out {
+		if o == "" || estimateTokens(o) >= estimateTokens(chunks[i]) {
+			out[i] = chunks[i]
+		}
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// compressInput runs --compress over req's input and .log context files.
+// A failed pass leaves them as they were, with a warning.
+func (r *runner) compressInput(ctx context.Context, req *TaskRequest, res *TaskResult) {
+	if !r.compress.enabled && !req.Compress {
+		return
+	}
+	if req.Provider == "local" || req.Provider == r.compress.provider {
+		return
+	}
+	var texts []*string
+	if estimateTokens(req.Input) >= r.compress.minTokens {
+		texts = append(texts, &req.Input)
+	}
+	for i := range req.ContextFiles {
+		if f := &req.ContextFiles[i]; strings.HasSuffix(f.Path, ".log") && estimateTokens(f.Content) >= r.compress.minTokens {
+			texts = append(texts, &f.Content)
+		}
+	}
+	if len(texts) == 0 {
+		return
+	}
+	if r.dryRun || req.DryRun {
+		res.Warnings = append(res.Warnings, "dry run shows the prompt without --compress")
+		return
+	}
+
+	setStage(ctx, "compress")
+	c := r.compress
+	rep := &CompressionReport{Provider: c.provider, Model: defaultModel(c.provider, c.model)}
+	start := time.Now()
+	for _, t := range texts {
+		short, err := r.compressText(ctx, req.Task, *t)
+		if err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("--compress with %s failed: %v; sent the text uncompressed", modelChoice{rep.Provider, rep.Model}, err))
+			continue
+		}
+		rep.Texts++
+		rep.OriginalTokens += estimateTokens(*t)
+		rep.CompressedTokens += estimateTokens(short)
+		*t = short
+	}
+	if rep.Texts == 0 {
+		return
+	}
+	rep.DurationMS = time.Since(start).Milliseconds()
+	rep.SavedTokens = rep.OriginalTokens - rep.CompressedTokens
+	if info, ok := lookupModel(req.Provider, req.Model); ok {
+		rep.SavedCost = estimateCost(info, rep.SavedTokens, 0)
+	}
+	res.Compression = rep
+}
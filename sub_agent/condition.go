@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// condition is a parsed if or until expression of a pipeline stage, such
+// as `review.score < 7 && !draft.valid`: comparisons (<, <=, >, >=, ==, !=
+// and contains) joined by &&, || and ! with parentheses. Operands are
+// numbers, quoted strings, true and false, and references: stage.field
+// (output, score, valid, approved, attempts), vars.name and attempt. A
+// reference to a stage that hasn't run is null, which is false and equals
+// nothing.
+type condition struct {
+	text string
+	root condNode
+}
+
+type condNode interface {
+	eval(lookup func(ref string) interface{}) interface{}
+}
+
+type (
+	condOr  struct{ a, b condNode }
+	condAnd struct{ a, b condNode }
+	condNot struct{ a condNode }
+	condCmp struct {
+		op   string
+		a, b condNode
+	}
+	condRef struct{ ref string }
+	condLit struct{ v interface{} }
+)
+
+func (n condOr) eval(l func(string) interface{}) interface{} {
+	return truthy(n.a.eval(l)) || truthy(n.b.eval(l))
+}
+
+func (n condAnd) eval(l func(string) interface{}) interface{} {
+	return truthy(n.a.eval(l)) && truthy(n.b.eval(l))
+}
+
+func (n condNot) eval(l func(string) interface{}) interface{} { return !truthy(n.a.eval(l)) }
+func (n condRef) eval(l func(string) interface{}) interface{} { return l(n.ref) }
+func (n condLit) eval(func(string) interface{}) interface{}   { return n.v }
+
+func (n condCmp) eval(l func(string) interface{}) interface{} {
+	a, b := n.a.eval(l), n.b.eval(l)
+	if a == nil || b == nil {
+		return n.op == "!=" && (a == nil) != (b == nil)
+	}
+	if n.op == "contains" {
+		return strings.Contains(fmt.Sprint(a), fmt.Sprint(b))
+	}
+	x, xok := condNumber(a)
+	y, yok := condNumber(b)
+	if xok && yok {
+		switch n.op {
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		}
+	}
+	switch n.op {
+	case "==":
+		return fmt.Sprint(a) == fmt.Sprint(b)
+	case "!=":
+		return fmt.Sprint(a) != fmt.Sprint(b)
+	}
+	// Ordering something that isn't a number.
+	return false
+}
+
+func condNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return x != "" && x != "false" && x != "0"
+	}
+	if f, ok := condNumber(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// holds evaluates c with lookup resolving its references.
+func (c *condition) holds(lookup func(ref string) interface{}) bool {
+	return truthy(c.root.eval(lookup))
+}
+
+// refs lists the references c makes.
+func (c *condition) refs() []string {
+	var out []string
+	var walk func(condNode)
+	walk = func(n condNode) {
+		switch x := n.(type) {
+		case condOr:
+			walk(x.a)
+			walk(x.b)
+		case condAnd:
+			walk(x.a)
+			walk(x.b)
+		case condNot:
+			walk(x.a)
+		case condCmp:
+			walk(x.a)
+			walk(x.b)
+		case condRef:
+			out = append(out, x.ref)
+		}
+	}
+	walk(c.root)
+	return out
+}
+
+func (c *condition) String() string { return c.text }
+
+// parseCondition parses an if or until expression.
+func parseCondition(text string) (*condition, error) {
+	toks, err := condTokens(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{toks: toks}
+	root, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %v", text, err)
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("condition %q: unexpected %q", text, p.toks[p.pos])
+	}
+	return &condition{text: text, root: root}, nil
+}
+
+var condOps = []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "!", "(", ")"}
+
+func condTokens(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("condition %q: unclosed quote", s)
+			}
+			toks = append(toks, s[i:i+end+2])
+			i += end + 2
+			continue
+		}
+		op := ""
+		for _, o := range condOps {
+			if strings.HasPrefix(s[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			toks = append(toks, op)
+			i += len(op)
+			continue
+		}
+		j := i
+		for j < len(s) && !strings.ContainsRune(" \t\"'&|<>=!()", rune(s[j])) {
+			j++
+		}
+		toks = append(toks, s[i:j])
+		i = j
+	}
+	return toks, nil
+}
+
+type condParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *condParser) or() (condNode, error) {
+	a, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		var b condNode
+		if b, err = p.and(); err == nil {
+			a = condOr{a, b}
+		}
+	}
+	return a, err
+}
+
+func (p *condParser) and() (condNode, error) {
+	a, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		var b condNode
+		if b, err = p.unary(); err == nil {
+			a = condAnd{a, b}
+		}
+	}
+	return a, err
+}
+
+func (p *condParser) unary() (condNode, error) {
+	if p.peek() == "!" {
+		p.pos++
+		a, err := p.unary()
+		return condNot{a}, err
+	}
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "<", "<=", ">", ">=", "==", "!=", "contains":
+		p.pos++
+		b, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return condCmp{op, a, b}, nil
+	}
+	return a, nil
+}
+
+func (p *condParser) operand() (condNode, error) {
+	tok := p.peek()
+	p.pos++
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case tok == "(":
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	case tok[0] == '"' || tok[0] == '\'':
+		return condLit{tok[1 : len(tok)-1]}, nil
+	case tok == "true" || tok == "false":
+		return condLit{tok == "true"}, nil
+	}
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return condLit{f}, nil
+	}
+	if strings.ContainsAny(tok, "&|<>=!()") || !namespaceRe.MatchString(tok) {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return condRef{tok}, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// abstainMessage replaces an answer below --min-confidence.
+const abstainMessage = "Insufficient information to answer this reliably."
+
+// Confidence is how likely the answer is to be right, from 0 to 1: the
+// model's own estimate, weighed with how much of the answer the retrieved
+// knowledge covers and lowered by hedging, an unapproved verification and
+// truncation.
+type Confidence struct {
+	Score    float64  `json:"score"`
+	Self     float64  `json:"self"`               // the model's estimate
+	Coverage *float64 `json:"coverage,omitempty"` // share of the answer's terms in the retrieved knowledge
+	Signals  []string `json:"signals,omitempty"`  // what lowered the score
+	Judge    string   `json:"judge"`              // provider/model of the estimate
+
+	// Abstained is set when Score fell below Threshold and the answer was
+	// replaced with abstainMessage; Withheld is the answer.
+	Threshold float64 `json:"threshold,omitempty"`
+	Abstained bool    `json:"abstained,omitempty"`
+	Withheld  string  `json:"withheld,omitempty"`
+}
+
+// confidenceConfig enables --confidence. A min above 0 enables it too, and
+// abstains below it.
+type confidenceConfig struct {
+	enabled bool
+	min     float64
+	judge   string // provider/model of the estimate, "" for the task's
+}
+
+func (r *runner) confidenceFor(req TaskRequest) confidenceConfig {
+	c := r.confidence
+	if req.MinConfidence > 0 {
+		c.min = req.MinConfidence
+	}
+	if c.min > 0 {
+		c.enabled = true
+	}
+	return c
+}
+
+const confidencePrompt = `You are estimating how likely an answer is to be correct.
+
+Task:
+%s
+
+Answer:
+%s
+
+How likely is the answer to be correct and supported by the task and any knowledge it gives, rather than guessed? Be calibrated: an answer resting on specifics that are neither given nor common knowledge is unlikely to be right.
+Reply with "CONFIDENCE: " and a number from 0 to 100 on the first line, and nothing else.`
+
+var confidenceRe = regexp.MustCompile(`(?i)confidence\W*(\d+(?:\.\d+)?)`)
+
+// assessConfidence scores answer to req. A reply without a number counts
+// as an even chance.
+func (r *runner) assessConfidence(ctx context.Context, req TaskRequest, answer string, res *TaskResult, cfg confidenceConfig) (*Confidence, error) {
+	provider, model := withDefaults("", "", req)
+	if cfg.judge != "" {
+		choices, err := parseModelChoices(cfg.judge)
+		if err != nil {
+			return nil, err
+		}
+		provider, model = withDefaults(choices[0].provider, choices[0].model, req)
+	}
+	c := &Confidence{Judge: modelChoice{provider, model}.String(), Threshold: cfg.min}
+	out, err := generate(ctx, provider, model, fmt.Sprintf(confidencePrompt, req.Task, answer), r.key)
+	if err != nil {
+		return nil, fmt.Errorf("confidence estimate: %w", err)
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(cleanOutput(out)), "\n")
+	c.Self = 0.5
+	if m := confidenceRe.FindStringSubmatch(first); m != nil {
+		c.Self, _ = strconv.ParseFloat(m[1], 64)
+		if c.Self > 1 {
+			c.Self /= 100
+		}
+		c.Self = min(c.Self, 1)
+	} else {
+		c.Signals = append(c.Signals, "no self-estimate")
+	}
+
+	c.Score = c.Self
+	if res.Retrieval != nil {
+		cov := coverage(answer, knowledgeOf(req.Knowledge))
+		c.Coverage = &cov
+		c.Score = 0.6*c.Self + 0.4*cov
+		if cov < 0.5 {
+			c.Signals = append(c.Signals, "low retrieval coverage")
+		}
+	}
+	if refusalRe.MatchString(answer) {
+		c.Score *= 0.7
+		c.Signals = append(c.Signals, "hedged")
+	}
+	if res.Verification != nil && res.Verification.Verdict != "approved" {
+		c.Score *= 0.8
+		c.Signals = append(c.Signals, "unapproved")
+	}
+	if res.Truncated {
+		c.Score *= 0.8
+		c.Signals = append(c.Signals, "truncated")
+	}
+	c.Score = math.Round(c.Score*100) / 100
+	return c, nil
+}
+
+// knowledgeOf is the excerpts in a retrieved knowledge block, "" if none.
+func knowledgeOf(knowledge string) string {
+	_, rest, ok := strings.Cut(knowledge, "<knowledge>")
+	if !ok {
+		return ""
+	}
+	k, _, _ := strings.Cut(rest, "</knowledge>")
+	return k
+}
+
+// coverage is the share of answer's distinct words of four letters or more
+// that knowledge contains; 1 for an answer without any.
+func coverage(answer, knowledge string) float64 {
+	known := map[string]bool{}
+	for _, w := range contentWords(knowledge) {
+		known[w] = true
+	}
+	words := map[string]bool{}
+	for _, w := range contentWords(answer) {
+		words[w] = true
+	}
+	if len(words) == 0 {
+		return 1
+	}
+	n := 0
+	for w := range words {
+		if known[w] {
+			n++
+		}
+	}
+	return math.Round(float64(n)/float64(len(words))*100) / 100
+}
+
+func contentWords(s string) []string {
+	var out []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if len([]rune(w)) >= 4 {
+			out = append(out, w)
+		}
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config is the optional JSON configuration file. It is read from
+// $HELIX_CONFIG, or ~/.config/helix/config.json when that exists.
+type Config struct {
+	// Models adds to or replaces entries of the built-in model registry,
+	// keyed by model name prefix.
+	Models map[string]ModelInfo `json:"models,omitempty"`
+	// PromptAdapters adds or replaces prompt adapters, keyed by model
+	// name prefix.
+	PromptAdapters map[string]PromptAdapter `json:"prompt_adapters,omitempty"`
+
+	// Styles adds --style profiles or replaces the built-in ones, and
+	// DefaultStyle is the profile used when --style isn't given.
+	Styles       map[string]StyleProfile `json:"styles,omitempty"`
+	DefaultStyle string                  `json:"default_style,omitempty"`
+	// Locale is the caller's locale and time zone.
+	Locale LocaleConfig `json:"locale"`
+	// Examples is the few-shot library of --examples.
+	Examples ExamplesConfig `json:"examples"`
+	// Pipelines is where helix pipeline finds pipelines.
+	Pipelines PipelinesConfig `json:"pipelines"`
+
+	Routing RoutingConfig `json:"routing"`
+	Server  ServerConfig  `json:"server"`
+	Audit   AuditConfig   `json:"audit"`
+	History HistoryConfig `json:"history"`
+
+	Guardrails GuardrailsConfig `json:"guardrails"`
+	Tools      ToolsConfig      `json:"tools"`
+	Memory     MemoryConfig     `json:"memory"`
+	Knowledge  KnowledgeConfig  `json:"knowledge"`
+	Judge      JudgeConfig      `json:"judge"`
+
+	Ollama      OllamaConfig      `json:"ollama"`
+	AzureOpenAI AzureOpenAIConfig `json:"azure_openai"`
+	Bedrock     BedrockConfig     `json:"bedrock"`
+	Gemini      GeminiConfig      `json:"gemini"`
+
+	// Capabilities controls probing providers on first use.
+	Capabilities CapabilitiesConfig `json:"capabilities"`
+
+	Kubernetes KubernetesConfig `json:"kubernetes"`
+	Network    NetworkConfig    `json:"network"`
+	// Chaos injects provider failures, for testing.
+	Chaos ChaosConfig `json:"chaos"`
+	// SLO sets latency objectives for provider calls.
+	SLO SLOConfig `json:"slo"`
+
+	Transcription TranscriptionConfig `json:"transcription"`
+	Speech        SpeechConfig        `json:"speech"`
+	Documents     DocumentsConfig     `json:"documents"`
+	ImageGen      ImageGenConfig      `json:"image"`
+
+	// OpenAICompatible adds or overrides OpenAI-shaped providers, keyed by
+	// the provider name used with --provider.
+	OpenAICompatible map[string]OpenAICompatibleProvider `json:"openai_compatible,omitempty"`
+
+	// Secrets supplies provider credentials by name ("gemini",
+	// "azure-openai", "azure-client-secret" or an adapter name) as a
+	// literal, a vault://path#field reference or an exec:command whose
+	// stdout is the secret. References are re-fetched every SecretRefresh
+	// (a duration, default 5m) so rotation needs no config edit.
+	Secrets       map[string]string `json:"secrets,omitempty"`
+	SecretRefresh string            `json:"secret_refresh,omitempty"`
+}
+
+// RoutingConfig lists the models --route may choose from, as provider/model
+// (e.g. "local/llama3.2", "cloud"). Defaults to the local default and cloud.
+type RoutingConfig struct {
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+// config is loaded once at startup; the zero value means "no config file".
+var config Config
+
+// configPath returns the config file location and whether it was requested
+// explicitly (in which case it must exist).
+func configPath() (string, bool) {
+	if p := os.Getenv("HELIX_CONFIG"); p != "" {
+		return p, true
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(dir, "helix", "config.json"), false
+}
+
+// loadConfig reads the config file into config.
+func loadConfig() error {
+	c, err := readConfig()
+	if err != nil {
+		return err
+	}
+	config = c
+	return nil
+}
+
+// readConfig reads and validates the config file; no file is the zero
+// Config.
+func readConfig() (Config, error) {
+	var c Config
+	path, explicit := configPath()
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("reading config: %v", err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("parsing config %s: %v", path, err)
+	}
+	if err := validateOllamaConfig(c.Ollama); err != nil {
+		return c, fmt.Errorf("config %s: %v", path, err)
+	}
+	if err := validateGeminiKeys(c.Gemini.Keys); err != nil {
+		return c, fmt.Errorf("config %s: %v", path, err)
+	}
+	if err := validateSLOConfig(c.SLO); err != nil {
+		return c, fmt.Errorf("config %s: %v", path, err)
+	}
+	return c, nil
+}
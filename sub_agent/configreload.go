@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often serve, worker and daemon look for
+// changes to the config file by default.
+const configPollInterval = 2 * time.Second
+
+// configMu guards the sections of config that reloadConfig replaces while
+// tasks run; liveConfig reads them.
+var configMu sync.RWMutex
+
+// liveSections are the config sections a reload applies without a restart:
+// routing, the model registry, provider endpoints and credentials, and the
+// server's tenants, quotas and limits, and the latency SLOs. The rest are read once at startup.
+var liveSections = map[string]bool{
+	"routing": true, "models": true, "openai_compatible": true,
+	"secrets": true, "secret_refresh": true,
+	"gemini": true, "azure_openai": true, "bedrock": true,
+	"server": true, "slo": true,
+}
+
+// liveConfig is config as of now, for reading the sections a reload may
+// replace. Tasks in flight keep what they already read.
+func liveConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// configReload is what a reload did.
+type configReload struct {
+	Applied []string `json:"applied,omitempty"`
+	Restart []string `json:"restart,omitempty"` // changed, but only read at startup
+}
+
+// reloadConfig reads the config file again and applies its live sections.
+// A file that doesn't parse or validate changes nothing.
+func reloadConfig() (configReload, error) {
+	var rl configReload
+	c, err := readConfig()
+	if err != nil {
+		return rl, err
+	}
+	if len(c.Routing.Candidates) > 0 {
+		if _, err := parseModelChoices(strings.Join(c.Routing.Candidates, ",")); err != nil {
+			return rl, fmt.Errorf("routing candidates: %v", err)
+		}
+	}
+	old := liveConfig()
+	if old.Server.IdempotencyWindow != c.Server.IdempotencyWindow {
+		rl.Restart = append(rl.Restart, "server.idempotency_window")
+		c.Server.IdempotencyWindow = old.Server.IdempotencyWindow
+	}
+
+	configMu.Lock()
+	ov, nv, cv := reflect.ValueOf(old), reflect.ValueOf(c), reflect.ValueOf(&config).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(nv.Type().Field(i).Tag.Get("json"), ",")
+		if liveSections[name] {
+			cv.Field(i).Set(nv.Field(i))
+			rl.Applied = append(rl.Applied, name)
+		} else {
+			rl.Restart = append(rl.Restart, name)
+		}
+	}
+	configMu.Unlock()
+	sort.Strings(rl.Applied)
+	sort.Strings(rl.Restart)
+
+	changed := map[string]bool{}
+	for _, name := range rl.Applied {
+		changed[name] = true
+	}
+	if changed["secrets"] || changed["secret_refresh"] {
+		// Fetch references again instead of serving the old values until
+		// they expire.
+		secretsMu.Lock()
+		secretRefs = map[string]secretRef{}
+		secretsMu.Unlock()
+		if err := prefetchSecrets(); err != nil {
+			statusf("[Sub-Agent] Warning: after reloading the config: %v\n", redactErr(err))
+		}
+	}
+	if changed["openai_compatible"] || changed["gemini"] || changed["secrets"] {
+		forgetCapabilities()
+	}
+	return rl, nil
+}
+
+// report prints what a reload did.
+func (rl configReload) report(path string) {
+	if len(rl.Applied) == 0 && len(rl.Restart) == 0 {
+		statusf("[Sub-Agent] Reloaded %s: no changes\n", path)
+		return
+	}
+	if len(rl.Applied) > 0 {
+		statusf("[Sub-Agent] Reloaded %s: applied %s\n", path, strings.Join(rl.Applied, ", "))
+	}
+	if len(rl.Restart) > 0 {
+		statusf("[Sub-Agent] Warning: %s changed in %s; restart to apply\n", strings.Join(rl.Restart, ", "), path)
+	}
+}
+
+// configStamp identifies a version of the config file by size and mtime.
+func configStamp() string {
+	path, _ := configPath()
+	if path == "" {
+		return ""
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// watchConfig reloads the config on SIGHUP and, every poll unless 0, when
+// the file changes, then calls applied with the result, until ctx ends.
+func watchConfig(ctx context.Context, poll time.Duration, applied func(configReload)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if poll > 0 {
+		t := time.NewTicker(poll)
+		defer t.Stop()
+		tick = t.C
+	}
+	stamp := configStamp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if s := configStamp(); s == stamp || s == "" {
+				continue
+			}
+		}
+		stamp = configStamp()
+		path, _ := configPath()
+		rl, err := reloadConfig()
+		if err != nil {
+			statusf("[Sub-Agent] Warning: not reloading %s: %v\n", path, err)
+			continue
+		}
+		rl.report(path)
+		if applied != nil {
+			applied(rl)
+		}
+	}
+}
+
+// loadAuth sets the server's tenants and admin token from the config. A
+// tenant that is still configured keeps its quota counters.
+func (s *server) loadAuth() error {
+	sc := liveConfig().Server
+	tenants, err := loadTenants(sc.Tenants)
+	if err != nil {
+		return err
+	}
+	var admin *[32]byte
+	if sc.AdminToken != "" {
+		token, err := resolveSecretValue(sc.AdminToken)
+		if err != nil {
+			return fmt.Errorf("admin token: %v", err)
+		}
+		h := sha256.Sum256([]byte(token))
+		admin = &h
+	}
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	for _, t := range tenants {
+		for _, old := range s.tenants {
+			if old.Name != t.Name {
+				continue
+			}
+			old.mu.Lock()
+			if old.window == t.window {
+				t.start, t.requests, t.tokens = old.start, old.requests, old.tokens
+			}
+			old.mu.Unlock()
+		}
+	}
+	s.tenants, s.admin = tenants, admin
+	return nil
+}
+
+// applyReload puts a reloaded server section into effect.
+func (s *server) applyReload(rl configReload) {
+	if s.socketAuth {
+		return
+	}
+	for _, name := range rl.Applied {
+		if name == "server" || name == "secrets" {
+			if err := s.loadAuth(); err != nil {
+				statusf("[Sub-Agent] Warning: keeping the previous tenants: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// handleReload serves POST /admin/reload: reload the config now and reply
+// with what was applied.
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuth(w, r) || !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path, _ := configPath()
+	rl, err := reloadConfig()
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": redactErr(err).Error()})
+		return
+	}
+	rl.report(path)
+	s.applyReload(rl)
+	writeJSON(w, http.StatusOK, rl)
+}
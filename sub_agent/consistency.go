@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Sampled above temperature zero, a model's answers to a reasoning task
+// scatter, and the right one is the one most of them reach. --select
+// consistent groups the candidates that agree, by their final answer or,
+// with --consistency-match embedding, by the similarity of the whole
+// answers, and keeps one from the largest group.
+
+// Ways --select consistent tells that answers agree.
+const (
+	MatchExact     = "exact"     // the same final answer, ignoring case and punctuation
+	MatchEmbedding = "embedding" // embeddings at least consistencySimilarity alike
+)
+
+// consistencySimilarity is the cosine similarity at which two answers agree
+// with --consistency-match embedding.
+const consistencySimilarity = 0.9
+
+// defaultConsistencyTemperature samples answers varied enough to disagree
+// when the model is unsure.
+const defaultConsistencyTemperature = 0.8
+
+func validConsistencyMatch(m string) bool {
+	return m == MatchExact || m == MatchEmbedding
+}
+
+// finalAnswerLine finds a stated answer, such as "Answer: 42" or "the final
+// answer is B".
+var finalAnswerLine = regexp.MustCompile(`(?im)\b(?:final )?answer\s*(?:is\b|:|=)\s*(.+)$`)
+
+// finalAnswer is what out concludes: its last stated answer or else its
+// last line, in lower case without punctuation, so that formatting doesn't
+// split answers that agree.
+func finalAnswer(out string) string {
+	line := ""
+	if m := finalAnswerLine.FindAllStringSubmatch(out, -1); len(m) > 0 {
+		line = m[len(m)-1][1]
+	} else {
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		line = lines[len(lines)-1]
+	}
+	words := strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '-'
+	})
+	var kept []string
+	for _, w := range words {
+		if w = strings.Trim(w, "."); w != "" {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// groupAnswers numbers the agreeing outputs alike, in order of first
+// appearance. For embedding matching it also returns each output's mean
+// similarity to the rest of its group.
+func groupAnswers(ctx context.Context, outs []string, match, key string) ([]int, []float64, error) {
+	groups := make([]int, len(outs))
+	if match != MatchEmbedding {
+		ids := map[string]int{}
+		for i, out := range outs {
+			k := finalAnswer(out)
+			if _, ok := ids[k]; !ok {
+				ids[k] = len(ids)
+			}
+			groups[i] = ids[k]
+		}
+		return groups, nil, nil
+	}
+
+	vecs, err := embed(ctx, config.Knowledge.Provider, config.Knowledge.Model, outs, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Each output joins the first group whose first member it is like.
+	var firsts []int
+	for i, v := range vecs {
+		groups[i] = -1
+		for g, f := range firsts {
+			if cosine(v, vecs[f]) >= consistencySimilarity {
+				groups[i] = g
+				break
+			}
+		}
+		if groups[i] < 0 {
+			groups[i] = len(firsts)
+			firsts = append(firsts, i)
+		}
+	}
+	scores := make([]float64, len(outs))
+	for i := range vecs {
+		n := 0
+		for j := range vecs {
+			if j != i && groups[j] == groups[i] {
+				scores[i] += cosine(vecs[i], vecs[j])
+				n++
+			}
+		}
+		if n > 0 {
+			scores[i] /= float64(n)
+		}
+	}
+	return groups, scores, nil
+}
+
+// selectConsistent keeps an answer from the largest group of c's outputs,
+// the earliest group on a tie: with embedding matching the one most like
+// the rest, else the first. It warns on res when few answers agree.
+func (r *runner) selectConsistent(ctx context.Context, c *Candidates, match string, res *TaskResult) {
+	groups, scores, err := groupAnswers(ctx, c.Outputs, match, r.key)
+	if err != nil {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("--consistency-match embedding failed: %v; compared final answers instead", err))
+		match = MatchExact
+		groups, scores, _ = groupAnswers(ctx, c.Outputs, match, r.key)
+	}
+	c.Match, c.Groups = match, groups
+
+	size := map[int]int{}
+	for _, g := range groups {
+		size[g]++
+	}
+	best := 0
+	for g := range size {
+		if size[g] > size[best] || size[g] == size[best] && g < best {
+			best = g
+		}
+	}
+	c.Chosen = -1
+	for i, g := range groups {
+		if g == best && (c.Chosen < 0 || scores != nil && scores[i] > scores[c.Chosen]) {
+			c.Chosen = i
+		}
+	}
+	c.Agreement = float64(size[best]) / float64(len(groups))
+	if len(groups) > 1 && c.Agreement <= 0.5 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("only %d of %d answers agree; the answer is uncertain", size[best], len(groups)))
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ContextFile is a source file packed into the prompt with --context.
+type ContextFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// Data holds a binary file instead, base64 in JSON; --binary decides
+	// what is sent of it.
+	Data []byte `json:"data,omitempty"`
+}
+
+// PackReport says which context files made it into the prompt.
+type PackReport struct {
+	Included []string `json:"included"`
+	Omitted  []string `json:"omitted,omitempty"` // did not fit the window
+	Tokens   int      `json:"tokens"`
+}
+
+// helixIgnoreFile lists paths --context skips, one gitignore-style pattern
+// per line.
+const helixIgnoreFile = ".helixignore"
+
+// alwaysIgnored are never worth packing.
+var alwaysIgnored = []string{".git/", ".helix/", "node_modules/", ".helixignore"}
+
+// ignoreRule is one .helixignore line.
+type ignoreRule struct {
+	pattern  string
+	negate   bool // "!pattern" re-includes
+	dirOnly  bool // "dir/"
+	anchored bool // contains a slash, so matches from the root only
+}
+
+// loadIgnoreRules reads .helixignore from the working directory, if any.
+func loadIgnoreRules() ([]ignoreRule, error) {
+	lines := append([]string(nil), alwaysIgnored...)
+	f, err := os.Open(helixIgnoreFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", helixIgnoreFile, err)
+		}
+	}
+
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// ignored reports whether the slash-separated relative path p is excluded.
+// Later rules win, as in .gitignore.
+func ignored(rules []ignoreRule, p string, isDir bool) bool {
+	out := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		target := p
+		if !r.anchored {
+			target = path.Base(p)
+		}
+		if globMatch(r.pattern, target) {
+			out = !r.negate
+		}
+	}
+	return out
+}
+
+// globMatch is path.Match plus "**", which matches any number of segments.
+func globMatch(pattern, name string) bool {
+	if !strings.Contains(pattern, "**") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	pats, parts := strings.Split(pattern, "/"), strings.Split(name, "/")
+	var match func(pi, ni int) bool
+	match = func(pi, ni int) bool {
+		if pi == len(pats) {
+			return ni == len(parts)
+		}
+		if pats[pi] == "**" {
+			for k := ni; k <= len(parts); k++ {
+				if match(pi+1, k) {
+					return true
+				}
+			}
+			return false
+		}
+		if ni == len(parts) {
+			return false
+		}
+		ok, _ := path.Match(pats[pi], parts[ni])
+		return ok && match(pi+1, ni+1)
+	}
+	return match(0, 0)
+}
+
+// collectContextFiles expands --context arguments (files, directories or
+// globs, "**" included) into files, skipping ignored ones. PDFs, docx and
+// xlsx files are packed as their extracted text; other binary files are
+// kept as Data for --binary.
+func collectContextFiles(args []string, ocr bool) ([]ContextFile, error) {
+	rules, err := loadIgnoreRules()
+	if err != nil {
+		return nil, err
+	}
+	var files []ContextFile
+	seen := map[string]bool{}
+	for _, arg := range args {
+		paths, err := expandContextArg(rules, arg)
+		if err != nil {
+			return nil, fmt.Errorf("--context %s: %v", arg, err)
+		}
+		before := len(files)
+		for _, p := range paths {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return nil, fmt.Errorf("--context %s: %v", arg, err)
+			}
+			f, ok, err := readContextFile(p, data, ocr)
+			if err != nil {
+				return nil, fmt.Errorf("--context %s: %v", arg, err)
+			}
+			if !ok {
+				f = ContextFile{Path: p, Data: data}
+			}
+			files = append(files, f)
+		}
+		if len(files) == before {
+			return nil, fmt.Errorf("--context %s matched no files", arg)
+		}
+	}
+	return files, nil
+}
+
+// readContextFile turns a file's contents into text: extracted from a
+// document, or as it is. ok is false for binary files.
+func readContextFile(p string, data []byte, ocr bool) (ContextFile, bool, error) {
+	if text, ok, err := extractDocument(p, data, ocr); ok {
+		if err != nil {
+			return ContextFile{}, false, err
+		}
+		return ContextFile{Path: p, Content: text}, true, nil
+	}
+	// Binary files would only waste the window.
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return ContextFile{}, false, nil
+	}
+	return ContextFile{Path: p, Content: string(data)}, true, nil
+}
+
+// expandContextArg lists the regular files a file, directory or glob
+// argument names, as clean slash-separated paths, leaving out ignored ones.
+func expandContextArg(rules []ignoreRule, arg string) ([]string, error) {
+	var paths []string
+	walk := func(root string, keep func(string) bool) error {
+		return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := filepath.ToSlash(filepath.Clean(p))
+			if rel != "." && ignored(rules, rel, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() || !d.Type().IsRegular() || !keep(rel) {
+				return nil
+			}
+			paths = append(paths, rel)
+			return nil
+		})
+	}
+
+	if strings.Contains(arg, "**") {
+		// Walk from the longest wildcard-free prefix.
+		root := arg[:strings.Index(arg, "**")]
+		if i := strings.LastIndex(root, "/"); i >= 0 {
+			root = root[:i]
+		} else {
+			root = "."
+		}
+		pattern := filepath.ToSlash(filepath.Clean(arg))
+		return paths, walk(root, func(p string) bool { return globMatch(pattern, p) })
+	}
+	matches, err := filepath.Glob(arg)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			if err := walk(m, func(string) bool { return true }); err != nil {
+				return nil, err
+			}
+		} else if p := filepath.ToSlash(filepath.Clean(m)); !ignored(rules, p, false) {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// packContext appends as many of req.ContextFiles as fit the window after
+// the task and the output reserve, most relevant to the task first.
+func (r *runner) packContext(req *TaskRequest) *PackReport {
+	if len(req.ContextFiles) == 0 {
+		return nil
+	}
+	window := r.context.window
+	if window == 0 {
+		window = contextWindow(req.Provider, req.Model)
+	}
+	budget := window - r.context.reserveTokens - estimateTokens(req.Task) - inputReserveTokens
+
+	files := rankContextFiles(req.Task, req.ContextFiles)
+	rep := &PackReport{}
+	var b strings.Builder
+	for _, f := range files {
+		block := fmt.Sprintf("<file path=%q>\n%s\n</file>\n", f.Path, strings.TrimRight(f.Content, "\n"))
+		tokens := estimateTokens(block)
+		if tokens > budget {
+			rep.Omitted = append(rep.Omitted, f.Path)
+			continue
+		}
+		budget -= tokens
+		rep.Tokens += tokens
+		rep.Included = append(rep.Included, f.Path)
+		b.WriteString(block)
+	}
+	if b.Len() > 0 {
+		req.attach("<files>\n" + b.String() + "</files>")
+	}
+	req.ContextFiles = nil
+	return rep
+}
+
+// rankContextFiles orders files by how many of the task's words they
+// mention, counting a hit in the path three times; ties keep smaller files
+// first so more of them fit, then go by path.
+func rankContextFiles(task string, files []ContextFile) []ContextFile {
+	terms := taskTerms(task)
+	score := make(map[string]int, len(files))
+	for _, f := range files {
+		p, content := strings.ToLower(f.Path), strings.ToLower(f.Content)
+		for _, t := range terms {
+			if strings.Contains(p, t) {
+				score[f.Path] += 3
+			}
+			if strings.Contains(content, t) {
+				score[f.Path]++
+			}
+		}
+	}
+	ranked := append([]ContextFile(nil), files...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		si, sj := score[ranked[i].Path], score[ranked[j].Path]
+		if si != sj {
+			return si > sj
+		}
+		if li, lj := len(ranked[i].Content), len(ranked[j].Content); li != lj {
+			return li < lj
+		}
+		// Byte order, not the locale's, so ties rank the same everywhere.
+		return ranked[i].Path < ranked[j].Path
+	})
+	return ranked
+}
+
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "this": true, "that": true, "with": true, "what": true,
+	"how": true, "why": true, "does": true, "are": true, "from": true, "into": true, "can": true,
+	"you": true, "our": true, "all": true, "any": true, "add": true, "fix": true, "code": true,
+	"file": true, "files": true, "explain": true, "please": true, "make": true, "use": true,
+}
+
+func taskTerms(task string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(task), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		if len(w) < 3 || stopWords[w] || seen[w] {
+			continue
+		}
+		seen[w] = true
+		terms = append(terms, w)
+	}
+	return terms
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Context strategies for prompts that exceed the model's window.
+const (
+	ContextError          = "error"           // fail before calling the provider
+	ContextTruncateHead   = "truncate-head"   // drop the beginning, keep the end
+	ContextTruncateMiddle = "truncate-middle" // keep the beginning and the end
+	ContextSummarize      = "summarize"       // replace the middle with a summary of it
+)
+
+// ollamaDefaultNumCtx is what Ollama uses when a request sets no num_ctx;
+// anything past it is silently dropped.
+const ollamaDefaultNumCtx = 2048
+
+// contextWindow returns the registry's window for a provider/model, or for
+// a model the registry doesn't know, the one its provider reported.
+func contextWindow(providerName, modelName string) int {
+	info, known := lookupModel(providerName, modelName)
+	if !known {
+		if w := probedContextWindow(providerName, registryName(providerName, modelName)); w > 0 {
+			return w
+		}
+	}
+	return info.ContextWindow
+}
+
+// ollamaNumCtx sizes num_ctx for a prompt: large enough for the prompt plus
+// room to answer, rounded up, but never beyond the model's window. It returns
+// 0 when Ollama's default already suffices.
+func ollamaNumCtx(modelName, prompt string) int {
+	need := estimateTokens(prompt) + 1024
+	if need <= ollamaDefaultNumCtx {
+		return 0
+	}
+	need = (need + 1023) / 1024 * 1024
+	if w := contextWindow("local", modelName); need > w {
+		need = w
+	}
+	return need
+}
+
+// ContextReport describes how a prompt was fitted into the window.
+type ContextReport struct {
+	Window          int    `json:"window"`
+	PromptTokens    int    `json:"prompt_tokens"` // estimated, before fitting
+	Strategy        string `json:"strategy,omitempty"`
+	TruncatedTokens int    `json:"truncated_tokens,omitempty"`
+}
+
+// contextConfig configures fitPrompt. window overrides the registry when set.
+type contextConfig struct {
+	strategy      string
+	window        int
+	reserveTokens int
+}
+
+func validContextStrategy(s string) bool {
+	switch s {
+	case ContextError, ContextTruncateHead, ContextTruncateMiddle, ContextSummarize:
+		return true
+	}
+	return false
+}
+
+// fitPrompt makes prompt fit the model's window minus the output reserve,
+// applying the configured strategy. The report is nil when nothing was done.
+func (r *runner) fitPrompt(ctx context.Context, req TaskRequest, prompt string) (string, *ContextReport, error) {
+	cfg := r.context
+	window := cfg.window
+	if window == 0 {
+		window = contextWindow(req.Provider, req.Model)
+	}
+	budget := r.promptBudget(req)
+
+	tokens := estimateTokens(prompt)
+	if tokens <= budget {
+		return prompt, nil, nil
+	}
+	rep := &ContextReport{Window: window, PromptTokens: tokens, Strategy: cfg.strategy}
+
+	runes := []rune(prompt)
+	keep := budget * charsPerToken
+	switch cfg.strategy {
+	case ContextTruncateHead:
+		rep.TruncatedTokens = tokens - budget
+		marker := fmt.Sprintf("[... %d tokens truncated ...]\n", rep.TruncatedTokens)
+		return marker + string(runes[len(runes)-keep:]), rep, nil
+
+	case ContextTruncateMiddle:
+		rep.TruncatedTokens = tokens - budget
+		marker := fmt.Sprintf("\n[... %d tokens truncated ...]\n", rep.TruncatedTokens)
+		return string(runes[:keep/2]) + marker + string(runes[len(runes)-keep/2:]), rep, nil
+
+	case ContextSummarize:
+		// Keep a quarter of the budget verbatim at each end and give the
+		// rest to a summary of what falls in between.
+		edge := keep / 4
+		middle := string(runes[edge : len(runes)-edge])
+		s := &summarizer{provider: req.Provider, model: req.Model, key: r.key, chunkTokens: budget / 2, concurrency: 4}
+		sum, err := s.summarize(ctx, middle)
+		if err != nil {
+			return "", rep, fmt.Errorf("summarizing prompt overflow: %w", err)
+		}
+		rep.TruncatedTokens = estimateTokens(middle) - estimateTokens(sum.Output)
+		return string(runes[:edge]) + "\n[Summary of omitted section]\n" + sum.Output + "\n[End of summary]\n" + string(runes[len(runes)-edge:]), rep, nil
+	}
+
+	return "", rep, fmt.Errorf("prompt is ~%d tokens but %s allows %d (window %d minus %d reserved for output); use --context-strategy to truncate or summarize",
+		tokens, modelChoice{req.Provider, req.Model}, budget, window, cfg.reserveTokens)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TaskContract is a task given as a document instead of a sentence: what
+// to achieve, under which constraints, how the answer is judged done and
+// what it may spend. --contract reads one from JSON or YAML; the API takes
+// one as "contract".
+type TaskContract struct {
+	Goal        string   `json:"goal"`
+	Context     string   `json:"context,omitempty"`
+	Constraints []string `json:"constraints,omitempty"`
+	// AcceptanceCriteria are what the answer must meet; the model assesses
+	// its answer against each.
+	AcceptanceCriteria []string `json:"acceptance_criteria,omitempty"`
+	// OutputFormat describes the answer's form; Schema, when set, is a
+	// JSON schema (or "json") the answer must follow, as format does.
+	OutputFormat string          `json:"output_format,omitempty"`
+	Schema       json.RawMessage `json:"schema,omitempty"`
+	// Tools limits the tool loop to these of the runner's tools.
+	Tools []string `json:"tools,omitempty"`
+	// Env sets variables in the processes the tools start, over tools.env
+	// and --tool-env; give secrets as references.
+	Env    map[string]string `json:"env,omitempty"`
+	Budget ContractBudget    `json:"budget"`
+}
+
+// ContractBudget caps the run; zero fields leave the runner's settings.
+type ContractBudget struct {
+	MaxToolSteps int    `json:"max_tool_steps,omitempty"`
+	MaxWords     int    `json:"max_words,omitempty"`
+	Deadline     string `json:"deadline,omitempty"` // a duration
+}
+
+// ContractResult echoes the contract with the answer's self-assessment.
+type ContractResult struct {
+	Contract   TaskContract          `json:"contract"`
+	Assessment []CriterionAssessment `json:"assessment,omitempty"`
+	Met        bool                  `json:"met"` // every criterion is met
+	Assessor   string                `json:"assessor,omitempty"`
+}
+
+// CriterionAssessment is the model's view of whether the answer meets one
+// acceptance criterion; a score of 7 or more out of 10 counts as met.
+type CriterionAssessment struct {
+	Criterion string  `json:"criterion"`
+	Met       bool    `json:"met"`
+	Score     float64 `json:"score"`
+	Reason    string  `json:"reason,omitempty"`
+}
+
+// contractMetScore is the lowest self-assessment score of a met criterion.
+const contractMetScore = 7
+
+// readContract reads a contract file, YAML when it ends in .yaml or .yml.
+func readContract(path string) (*TaskContract, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading contract: %v", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("parsing contract %s: %v", path, err)
+		}
+	}
+	var c TaskContract
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing contract %s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// applyContract writes req's contract into its task and budget. A task
+// already rendered from the contract, as a replay's is, is kept.
+func applyContract(req *TaskRequest) error {
+	c := req.Contract
+	if strings.TrimSpace(c.Goal) == "" {
+		return fmt.Errorf("the contract has no goal")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Goal:\n%s\n", strings.TrimSpace(c.Goal))
+	if c.Context != "" {
+		fmt.Fprintf(&b, "\nContext:\n%s\n", strings.TrimSpace(c.Context))
+	}
+	if len(c.Constraints) > 0 {
+		b.WriteString("\nConstraints (never break these):\n")
+		for _, s := range c.Constraints {
+			fmt.Fprintf(&b, "- %s\n", s)
+		}
+	}
+	if len(c.AcceptanceCriteria) > 0 {
+		b.WriteString("\nAcceptance criteria (the answer must meet every one):\n")
+		for i, s := range c.AcceptanceCriteria {
+			fmt.Fprintf(&b, "%d. %s\n", i+1, s)
+		}
+	}
+	if c.OutputFormat != "" {
+		fmt.Fprintf(&b, "\nOutput format:\n%s\n", strings.TrimSpace(c.OutputFormat))
+	}
+	task := strings.TrimRight(b.String(), "\n")
+	if req.Task != "" && req.Task != task {
+		return fmt.Errorf("a task with a contract takes its task from the contract's goal; leave task empty")
+	}
+	req.Task = task
+
+	if len(c.Schema) > 0 {
+		req.Format = c.Schema
+	}
+	if c.Budget.MaxToolSteps > 0 {
+		req.MaxToolSteps = c.Budget.MaxToolSteps
+	}
+	if c.Budget.MaxWords > 0 {
+		req.MaxWords = c.Budget.MaxWords
+	}
+	if c.Budget.Deadline != "" {
+		d, err := time.ParseDuration(c.Budget.Deadline)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid contract budget deadline %q", c.Budget.Deadline)
+		}
+		req.DeadlineMS = int(d.Milliseconds())
+	}
+	return nil
+}
+
+// checkContractTools reports a contract tool the runner doesn't have.
+func (r *runner) checkContractTools(c *TaskContract) error {
+	for _, name := range c.Tools {
+		if !slices.ContainsFunc(r.tools, func(t tool) bool { return t.spec().Name == name }) {
+			return fmt.Errorf("the contract allows tool %s, which isn't enabled (see --tools)", name)
+		}
+	}
+	return nil
+}
+
+// contractTools keeps the tools a contract allows; without a list, all.
+func contractTools(req TaskRequest, tools []tool) []tool {
+	if req.Contract == nil || len(req.Contract.Tools) == 0 {
+		return tools
+	}
+	var out []tool
+	for _, t := range tools {
+		if slices.Contains(req.Contract.Tools, t.spec().Name) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// assessContract has the task's model grade its answer against each
+// acceptance criterion.
+func (r *runner) assessContract(ctx context.Context, req TaskRequest, answer string) (*ContractResult, error) {
+	cr := &ContractResult{Contract: *req.Contract, Met: true}
+	if len(req.Contract.AcceptanceCriteria) == 0 {
+		return cr, nil
+	}
+	setStage(ctx, "assess contract")
+	j := judge{provider: req.Provider, model: req.Model, key: r.key}
+	criteria := make([]Criterion, len(req.Contract.AcceptanceCriteria))
+	for i, s := range req.Contract.AcceptanceCriteria {
+		criteria[i] = Criterion{Name: fmt.Sprintf("criterion %d", i+1), Description: s}
+	}
+	jm, err := j.score(ctx, req.Task, answer, "", criteria)
+	if err != nil {
+		return nil, fmt.Errorf("contract self-assessment: %w", err)
+	}
+	cr.Assessor = jm.Judge
+	for i, s := range jm.Scores {
+		a := CriterionAssessment{Criterion: req.Contract.AcceptanceCriteria[i], Score: s.Score, Reason: s.Reason, Met: s.Score >= contractMetScore}
+		cr.Met = cr.Met && a.Met
+		cr.Assessment = append(cr.Assessment, a)
+	}
+	return cr, nil
+}
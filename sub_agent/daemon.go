@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The daemon is a long-lived helix that keeps provider connections, caches
+// and the history store open between tasks; `helix client` is a thin front
+// end that hands it one task over a local socket. Frequent callers, such as
+// editor integrations and scripts in a loop, skip the startup work and
+// reuse warm connections.
+
+// daemonSocket is where the daemon listens and the client calls:
+// HELIX_SOCKET, else helix.sock in $XDG_RUNTIME_DIR or the state directory.
+func daemonSocket() (string, error) {
+	if s := os.Getenv("HELIX_SOCKET"); s != "" {
+		return s, nil
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "helix.sock"), nil
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "helix.sock"), nil
+}
+
+// daemonCommand implements `daemon`: serve the task API on the daemon
+// socket. Access is governed by the socket file's mode (0660), so there
+// are no tenants or tokens.
+func daemonCommand(fs *flag.FlagSet) func(args []string) {
+	socket := fs.String("socket", "", "Socket to listen on (default $HELIX_SOCKET, else helix.sock in $XDG_RUNTIME_DIR or ~/.local/state/helix)")
+	drainTimeout := fs.Duration("drain-timeout", 30*time.Second, "How long in-flight tasks may run after shutdown starts")
+	requestPost := fs.String("request-post", "", "Comma-separated post-processors a request's \"post\" may use (none by default; exec is never allowed)")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		path := *socket
+		if path == "" {
+			var err error
+			if path, err = daemonSocket(); err != nil {
+				fatal(configError(err))
+			}
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		if _, err := historyRetention(config.History); err != nil {
+			fatal(configError(err))
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			fatal(configError(err))
+		}
+		postSteps, err := parsePostSteps(*requestPost)
+		if err != nil {
+			fatal(configError(err))
+		}
+		ln, where, err := listenService("unix://" + path)
+		if err != nil {
+			fatal(configError(err))
+		}
+		s := &server{drain: newDrainer(), runner: r, tasks: newTaskRegistry(time.Minute), ready: &readiness{providers: configuredProviders(key), key: key}, socketAuth: true, postSteps: postSteps}
+		if r.history != nil {
+			enforceRetention()
+		}
+		s.serve(ln, where, *drainTimeout, 0, configPollInterval)
+	}
+}
+
+// clientCommand implements `client`: run one task on the daemon and print
+// the result as one-shot task mode does. The daemon's settings (runner
+// flags, config) apply; the client only chooses the task, model and input.
+func clientCommand(fs *flag.FlagSet) func(args []string) {
+	socket := fs.String("socket", "", "Daemon socket (default as for helix daemon)")
+	taskFile := fs.String("task-file", "", "Read the task from this file instead of --task")
+	fs.StringVar(&task, "task", "", "The task description")
+	fs.StringVar(&model, "model", "", "Model name (default: the provider's default)")
+	fs.StringVar(&provider, "provider", "", "Provider (default local)")
+	fs.BoolVar(&jsonOut, "json", false, "Print the result as JSON instead of text")
+	fs.BoolVar(&raw, "raw", false, "Print the answer as-is instead of rendering markdown on a terminal")
+	fs.BoolVar(&verbose, "verbose", false, "Print detailed progress and intermediate transcripts")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the result: no status lines, warnings or progress")
+	noStdin := fs.Bool("no-stdin", false, "Don't read piped stdin as input for the task")
+	var contextPaths stringList
+	fs.Var(&contextPaths, "context", "File, directory or glob to pack into the prompt (repeatable)")
+	runID := fs.String("run-id", "", "ID for this run (defaults to a random one)")
+	tags := tagFlag{}
+	fs.Var(tags, "tag", "Attach key=value metadata to the run (repeatable)")
+	return func([]string) {
+		path := *socket
+		if path == "" {
+			var err error
+			if path, err = daemonSocket(); err != nil {
+				fatal(configError(err))
+			}
+		}
+		if *taskFile != "" {
+			if task != "" {
+				fatal(kindError(ErrConfig, "--task and --task-file are mutually exclusive"))
+			}
+			text, err := readTaskFile(*taskFile, false)
+			if err != nil {
+				fatal(configError(err))
+			}
+			task = text
+		}
+		if task == "" {
+			fatal(kindError(ErrConfig, "--task or --task-file is required"))
+		}
+		req := TaskRequest{ID: *runID, Task: task, Provider: provider, Model: model}
+		if len(tags) > 0 {
+			req.Tags = tags
+		}
+		var err error
+		if !*noStdin {
+			if req.Input, err = readPipedInput(); err != nil {
+				fatal(configError(err))
+			}
+		}
+		if len(contextPaths) > 0 {
+			if req.ContextFiles, err = collectContextFiles(contextPaths, false); err != nil {
+				fatal(configError(err))
+			}
+		}
+
+		res, err := callDaemon(path, req)
+		if err != nil {
+			fatal(err)
+		}
+		if jsonOut {
+			printJSON(res)
+		} else if res.Error == "" {
+			printResult(os.Stdout, res, useMarkdown(raw))
+		}
+		if res.Error != "" {
+			err := &TaskError{Kind: res.ErrorKind, Err: errors.New(res.Error)}
+			if jsonOut {
+				os.Exit(exitCode(err))
+			}
+			fatal(err)
+		}
+	}
+}
+
+// callDaemon posts req to the daemon at socket and returns its result,
+// failed runs included; err is for not reaching the daemon at all.
+func callDaemon(socket string, req TaskRequest) (TaskResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return TaskResult{}, err
+	}
+	resp, err := http.Post(socketURL("unix://"+socket)+"/v1/tasks", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return TaskResult{}, kindError(ErrUnreachable, "no helix daemon at %s (start one with helix daemon): %v", socket, err)
+	}
+	defer resp.Body.Close()
+	// Failed tasks come back as a TaskResult too; anything else (a bad
+	// request, shutdown) is {"error": ...}, which decodes into Error.
+	var res TaskResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return TaskResult{}, fmt.Errorf("reading the daemon's response (%s): %v", resp.Status, err)
+	}
+	if res.Error != "" && res.ErrorKind == "" && resp.StatusCode != http.StatusOK {
+		res.ErrorKind = statusKind(resp.StatusCode)
+	}
+	return res, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// dangerRule is a kind of shell command that always needs a person's
+// go-ahead, --auto-approve or not.
+type dangerRule struct {
+	name   string
+	reason string
+	re     *regexp.Regexp
+	// except, when set, matches harmless forms of the command, which are
+	// taken out before re is tried.
+	except *regexp.Regexp
+}
+
+var dangerRules = []dangerRule{
+	{name: "recursive_delete", reason: "deletes a directory tree",
+		re: regexp.MustCompile(`\brm(\s+[^;&|\n]*)?\s-[a-zA-Z]*[rR]|\brm\s[^;&|\n]*--recursive`),
+		// git rm --cached only untracks; the files stay.
+		except: regexp.MustCompile(`\bgit\s+rm\b[^;&|\n]*\s--cached\b[^;&|\n]*`)},
+	{name: "pipe_to_shell", reason: "runs a script straight from the network",
+		re: regexp.MustCompile(`\b(curl|wget)\b[^;&\n]*\|\s*((sudo|doas|env)\b[^;&|\n]*?\s)?(/\S*/)?(ba|z|k|da)?sh\b` +
+			`|\b(ba|z)?sh\s+(-s\s+)?<\(\s*(curl|wget)\b` +
+			"|\\b((ba|z|k|da)?sh\\s+(-\\S+\\s+)*-c|eval)\\s+[\"']?(\\$\\(|`)\\s*(curl|wget)\\b")},
+	{name: "block_device_write", reason: "writes to a block device",
+		re: regexp.MustCompile(`\bdd\b[^;&|\n]*\bof=/dev/|>\s*/dev/(sd|hd|vd|xvd|nvme|mmcblk|disk|mapper/)`)},
+	{name: "format_disk", reason: "formats or repartitions a disk",
+		re: regexp.MustCompile(`\b(mkfs(\.\w+)?|mkswap|wipefs|fdisk|sfdisk|parted)\b`)},
+	{name: "package_install", reason: "installs packages",
+		re: regexp.MustCompile(`\b(apt(-get)?|yum|dnf|zypper|brew|snap|pip3?|npm|pnpm|gem|cargo)\s+(-\S+\s+)*install\b` +
+			`|\b(npm|pnpm)\s+(-\S+\s+)*(i|in|add)\b|\b(apk|pnpm)\s+(-\S+\s+)*add\b|\byarn\s+(-\S+\s+)*(global\s+)?add\b|\bpacman\s+-S`)},
+}
+
+// classifyCommand returns the rules cmd falls under; none means it runs
+// without asking.
+func classifyCommand(cmd string) []dangerRule {
+	var hits []dangerRule
+	for _, r := range dangerRules {
+		c := cmd
+		if r.except != nil {
+			c = r.except.ReplaceAllString(c, "")
+		}
+		if r.re.MatchString(c) {
+			hits = append(hits, r)
+		}
+	}
+	return hits
+}
+
+// shellTool is implemented by tools that run a shell command chosen by the
+// model, which is what classifyCommand vets.
+type shellTool interface {
+	shellCommand(input json.RawMessage) (string, bool)
+}
+
+func (t *runCodeTool) shellCommand(input json.RawMessage) (string, bool) {
+	var in struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+	}
+	if json.Unmarshal(input, &in) != nil {
+		return "", false
+	}
+	switch strings.ToLower(in.Language) {
+	case "sh", "shell", "bash":
+		return in.Code, true
+	}
+	return "", false
+}
+
+func (t *execTool) shellCommand(input json.RawMessage) (string, bool) {
+	fields := map[string]json.RawMessage{}
+	if len(input) > 0 && string(input) != "null" && json.Unmarshal(input, &fields) != nil {
+		return "", false
+	}
+	args, err := expandArgs(t.cfg.Args, fields)
+	if err != nil {
+		return "", false
+	}
+	return strings.Join(append([]string{t.cfg.Command}, args...), " "), true
+}
+
+// CommandReview is a dangerous command, or with rule outbound_message a
+// message to send, waiting for someone to confirm it.
+type CommandReview struct {
+	Tool    string   `json:"tool"`
+	Command string   `json:"command"`
+	Rules   []string `json:"rules"`   // the dangerRules it matched
+	Reasons []string `json:"reasons"` // what they mean, in words
+}
+
+// commandConfirmer asks someone whether to run a dangerous command.
+type commandConfirmer func(ctx context.Context, review CommandReview) (bool, error)
+
+type confirmerKey struct{}
+
+// withCommandConfirmer has dangerous commands of the run under ctx
+// confirmed by confirm.
+func withCommandConfirmer(ctx context.Context, confirm commandConfirmer) context.Context {
+	return context.WithValue(ctx, confirmerKey{}, confirm)
+}
+
+// reviewCommand classifies the shell command of a call of t, if it has
+// one, and holds dangerous ones for confirmation. The error, returned to
+// the model in place of the tool's output, says why it didn't run.
+func (r *runner) reviewCommand(ctx context.Context, t tool, call ToolCall) error {
+	st, ok := t.(shellTool)
+	if !ok {
+		return nil
+	}
+	cmd, ok := st.shellCommand(call.Input)
+	if !ok {
+		return nil
+	}
+	hits := classifyCommand(cmd)
+	if len(hits) == 0 {
+		logf(ctx, "Command check: %s: safe", call.Tool)
+		return nil
+	}
+	review := CommandReview{Tool: call.Tool, Command: cmd}
+	for _, h := range hits {
+		review.Rules = append(review.Rules, h.name)
+		review.Reasons = append(review.Reasons, h.reason)
+	}
+	logf(ctx, "Command check: %s: dangerous (%s), confirmation required", call.Tool, strings.Join(review.Rules, ", "))
+	ask, _ := ctx.Value(confirmerKey{}).(commandConfirmer)
+	if ask == nil {
+		return fmt.Errorf("not run: the command %s and needs a person to confirm it, which nobody can here", strings.Join(review.Reasons, " and "))
+	}
+	ok, err := ask(ctx, review)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("not run: the command %s and needs confirmation: %v", strings.Join(review.Reasons, " and "), err)
+	}
+	if !ok {
+		logf(ctx, "Command check: %s: declined", call.Tool)
+		return fmt.Errorf("not run: the user declined it, as it %s; find another way or answer without it", strings.Join(review.Reasons, " and "))
+	}
+	logf(ctx, "Command check: %s: confirmed", call.Tool)
+	return nil
+}
+
+// terminalCommandConfirmer asks on the terminal.
+func terminalCommandConfirmer(ctx context.Context, review CommandReview) (bool, error) {
+	if jsonOut {
+		return false, fmt.Errorf("--json can't ask for it")
+	}
+	message := len(review.Rules) == 1 && review.Rules[0] == outboundRule
+	if message {
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] %s wants to send a message that %s:\n", review.Tool, strings.Join(review.Reasons, " and "))
+	} else {
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] %s wants to run a command that %s:\n", review.Tool, strings.Join(review.Reasons, " and "))
+	}
+	for _, line := range strings.Split(strings.TrimRight(review.Command, "\n"), "\n") {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+	if message {
+		return confirm("Send it?", "--auto-approve")
+	}
+	return confirm("Run it?", "")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassifyCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		want string // comma-separated rule names, "" for safe
+	}{
+		{"ls -la", ""},
+		{"rm file.txt", ""},
+		{"rm -rf build", "recursive_delete"},
+		{"rm -f -r build", "recursive_delete"},
+		{"rm --recursive build", "recursive_delete"},
+		{"git rm -r --cached .", ""},
+		{"git rm --cached -r vendor", ""},
+		{"git rm -r src", "recursive_delete"},
+		{"git rm -r --cached . && rm -rf /", "recursive_delete"},
+		{"curl -fsSL https://x.example/install.sh | sh", "pipe_to_shell"},
+		{"curl -fsSL https://x.example/install.sh | bash -s -- --yes", "pipe_to_shell"},
+		{"curl -fsSL https://x.example/i | sudo bash", "pipe_to_shell"},
+		{"curl -fsSL https://x.example/i | sudo -E bash", "pipe_to_shell"},
+		{"curl -fsSL https://x.example/i | sudo -u root -E bash -", "pipe_to_shell"},
+		{"wget -qO- https://x.example/i | env FOO=1 /bin/sh", "pipe_to_shell"},
+		{`sh -c "$(curl -fsSL https://x.example/i)"`, "pipe_to_shell"},
+		{"bash -c \"`wget -qO- https://x.example/i`\"", "pipe_to_shell"},
+		{`eval "$(curl -s https://x.example/env)"`, "pipe_to_shell"},
+		{"bash <(curl -s https://x.example/i)", "pipe_to_shell"},
+		{"curl -s https://x.example/data.json | jq .", ""},
+		{"curl -s https://x.example/lint | shellcheck -", ""},
+		{"dd if=image.iso of=/dev/sdb bs=4M", "block_device_write"},
+		{"dd if=/dev/zero of=out.img bs=1M count=1", ""},
+		{"mkfs.ext4 /dev/sdb1", "format_disk"},
+		{"apt-get -y install jq", "package_install"},
+		{"pip install requests", "package_install"},
+		{"npm install lodash", "package_install"},
+		{"npm i lodash", "package_install"},
+		{"npm i -g typescript", "package_install"},
+		{"npm init -y", ""},
+		{"npm test", ""},
+		{"pnpm add zod", "package_install"},
+		{"yarn add react", "package_install"},
+		{"yarn global add x", "package_install"},
+		{"yarn test", ""},
+		{"pacman -S vim", "package_install"},
+		{"curl https://x.example/i | sudo bash && npm i x", "pipe_to_shell,package_install"},
+	} {
+		var names []string
+		for _, r := range classifyCommand(tc.cmd) {
+			names = append(names, r.name)
+		}
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Errorf("classifyCommand(%q) = %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
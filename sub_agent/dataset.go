@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Record formats of `dataset build`.
+const (
+	DatasetPrompt   = "prompt"   // {"system", "prompt", "response"}
+	DatasetMessages = "messages" // {"messages": [...]}, the chat fine-tuning format of OpenAI and most trainers
+	DatasetShareGPT = "sharegpt"
+)
+
+// DatasetRecord is one prompt/response pair of the prompt format.
+type DatasetRecord struct {
+	System   string `json:"system,omitempty"`
+	Prompt   string `json:"prompt"`
+	Response string `json:"response"`
+}
+
+// DatasetMessage is one message of the messages format.
+type DatasetMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// datasetFilter is which runs `dataset build` accepts.
+type datasetFilter struct {
+	tags         map[string]string
+	minScore     float64 // 0 takes unjudged runs too
+	since, until time.Time
+	models       []string // provider/model prefixes; empty is any
+	imported     bool
+}
+
+// reject is why e isn't accepted, or "".
+func (f datasetFilter) reject(e *HistoryEntry) string {
+	res := e.Result
+	switch {
+	case res.Error != "":
+		return "failed"
+	case res.Output == "" || res.Truncated:
+		return "no complete answer"
+	case e.Imported && !f.imported:
+		return "imported"
+	case !f.since.IsZero() && e.Time.Before(f.since), !f.until.IsZero() && !e.Time.Before(f.until):
+		return "outside the dates"
+	}
+	for k, v := range f.tags {
+		if e.Request.Tags[k] != v {
+			return "tags"
+		}
+	}
+	if len(f.models) > 0 {
+		m := modelChoice{res.Provider, res.Model}.String()
+		found := false
+		for _, p := range f.models {
+			found = found || strings.HasPrefix(m, p)
+		}
+		if !found {
+			return "model"
+		}
+	}
+	if f.minScore > 0 {
+		if e.Judgement == nil {
+			return "not judged"
+		}
+		if e.Judgement.Overall < f.minScore {
+			return "judge score"
+		}
+	}
+	return ""
+}
+
+// datasetSystem is the system prompt of a run: system, or else the style
+// and language instructions the run's task was sent with.
+func datasetSystem(system string, req TaskRequest) string {
+	if system != "" {
+		return system
+	}
+	var parts []string
+	if req.Style != "" {
+		if p, err := lookupStyle(req.Style); err == nil {
+			parts = append(parts, p.instruction())
+		}
+	}
+	if req.Lang != "" {
+		parts = append(parts, languageInstruction(req.Lang))
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// dedupeKey is the prompt with case and spacing normalized.
+func dedupeKey(prompt string) string {
+	return strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+}
+
+// betterDuplicate reports whether a beats b as the kept run of a
+// duplicated prompt: judged higher, or else newer.
+func betterDuplicate(a, b *HistoryEntry) bool {
+	sa, sb := -1.0, -1.0
+	if a.Judgement != nil {
+		sa = a.Judgement.Overall
+	}
+	if b.Judgement != nil {
+		sb = b.Judgement.Overall
+	}
+	if sa != sb {
+		return sa > sb
+	}
+	return a.Time.After(b.Time)
+}
+
+// parseSince reads a date filter: a duration back from now, in days as
+// "7d" too, or a date or time.
+func parseSince(s string) (time.Time, error) {
+	if d, err := parseAge(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected a duration (e.g. 7d or 12h), a date (2006-01-02) or an RFC 3339 time, got %q", s)
+}
+
+// datasetBuildCommand implements `dataset build`: turn the accepted runs of
+// the history into instruction-tuning JSONL.
+func datasetBuildCommand(fs *flag.FlagSet) func(args []string) {
+	format := fs.String("format", DatasetPrompt, "Record format: 'prompt' (system/prompt/response), 'messages' (chat fine-tuning) or 'sharegpt'")
+	out := fs.String("out", "", "File to write (default stdout)")
+	minScore := fs.Float64("min-score", 0, "Only runs helix judge --run scored at least this, from 0 to 10; 0 also takes unjudged runs")
+	since := fs.String("since", "", "Only runs from this date or time, or this long ago (e.g. 720h)")
+	until := fs.String("until", "", "Only runs before this date or time, or this long ago")
+	system := fs.String("system", "", "System prompt of every record (default: the style and language instructions of each run)")
+	models := stringList{}
+	fs.Var(&models, "model", "Only runs answered by this provider/model, or a prefix of it (repeatable)")
+	imported := fs.Bool("imported", false, "Also take runs recorded by helix history import")
+	noDedupe := fs.Bool("no-dedupe", false, "Keep every run of the same prompt instead of the best-judged, newest one")
+	tagFilter := tagFlag{}
+	fs.Var(tagFilter, "tag", "Only runs with this key=value tag (repeatable)")
+	return func([]string) {
+		switch *format {
+		case DatasetPrompt, DatasetMessages, DatasetShareGPT:
+		default:
+			fatal(kindError(ErrConfig, "invalid --format %q: expected prompt, messages or sharegpt", *format))
+		}
+		if *minScore < 0 || *minScore > 10 {
+			fatal(kindError(ErrConfig, "invalid --min-score %v: expected 0 to 10", *minScore))
+		}
+		f := datasetFilter{tags: tagFilter, minScore: *minScore, models: models, imported: *imported}
+		var err error
+		if *since != "" {
+			if f.since, err = parseSince(*since); err != nil {
+				fatal(kindError(ErrConfig, "invalid --since: %v", err))
+			}
+		}
+		if *until != "" {
+			if f.until, err = parseSince(*until); err != nil {
+				fatal(kindError(ErrConfig, "invalid --until: %v", err))
+			}
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		entries, err := selectEntries(store, nil, nil)
+		if err != nil {
+			fatal(err)
+		}
+
+		rejected := map[string]int{}
+		var accepted []*HistoryEntry
+		index := map[string]int{}
+		dupes := 0
+		for _, e := range entries {
+			if why := f.reject(e); why != "" {
+				rejected[why]++
+				continue
+			}
+			if !*noDedupe {
+				key := dedupeKey(e.Request.Task)
+				if i, ok := index[key]; ok {
+					dupes++
+					if betterDuplicate(e, accepted[i]) {
+						accepted[i] = e
+					}
+					continue
+				}
+				index[key] = len(accepted)
+			}
+			accepted = append(accepted, e)
+		}
+
+		w := io.Writer(os.Stdout)
+		if *out != "" && *out != "-" {
+			file, err := os.Create(*out)
+			if err != nil {
+				fatal(configError(err))
+			}
+			defer file.Close()
+			w = file
+		}
+		enc := json.NewEncoder(w)
+		for _, e := range accepted {
+			sys := datasetSystem(*system, e.Request)
+			prompt := e.Request.Task
+			if k := e.Request.Knowledge; k != "" {
+				prompt = k + "\n\n" + prompt
+			}
+			var rec interface{}
+			switch *format {
+			case DatasetPrompt:
+				rec = DatasetRecord{System: sys, Prompt: prompt, Response: e.Result.Output}
+			case DatasetMessages:
+				var msgs []DatasetMessage
+				if sys != "" {
+					msgs = append(msgs, DatasetMessage{"system", sys})
+				}
+				rec = struct {
+					Messages []DatasetMessage `json:"messages"`
+				}{append(msgs, DatasetMessage{"user", prompt}, DatasetMessage{"assistant", e.Result.Output})}
+			case DatasetShareGPT:
+				var msgs []ShareGPTMessage
+				if sys != "" {
+					msgs = append(msgs, ShareGPTMessage{"system", sys})
+				}
+				rec = ShareGPTRecord{ID: e.ID, Model: modelChoice{e.Result.Provider, e.Result.Model}.String(),
+					Conversations: append(msgs, ShareGPTMessage{"human", prompt}, ShareGPTMessage{"gpt", e.Result.Output})}
+			}
+			if err := enc.Encode(rec); err != nil {
+				fatal(err)
+			}
+		}
+
+		statusf("[Sub-Agent] %d of %d run(s) accepted", len(accepted), len(entries))
+		if dupes > 0 {
+			statusf(", %d duplicate prompt(s) merged", dupes)
+		}
+		statusf("\n")
+		for _, why := range sortedKeys(rejected) {
+			statusf("[Sub-Agent]   %-20s %d rejected\n", why, rejected[why])
+		}
+		if *out != "" && *out != "-" {
+			statusf("[Sub-Agent] Wrote %d record(s) to %s\n", len(accepted), *out)
+		}
+	}
+}
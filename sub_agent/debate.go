@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"helix-agent-go/orchestrator"
+)
+
+// Debate records a --debate run: independent answers, critique rounds and
+// the judge's pick.
+type Debate struct {
+	Agents []DebateAgent  `json:"agents"`
+	Rounds int            `json:"rounds"`
+	Judge  string         `json:"judge"` // "vote" or provider/model
+	Winner string         `json:"winner,omitempty"`
+	Votes  map[string]int `json:"votes,omitempty"`
+	Reason string         `json:"reason,omitempty"`
+
+	Transcript []orchestrator.Entry `json:"transcript"`
+}
+
+// DebateAgent is one participant and its final answer.
+type DebateAgent struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Answer   string `json:"answer,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// debateConfig controls the --debate stage; agents < 2 disables it.
+type debateConfig struct {
+	agents  int
+	choices []modelChoice // cycled over the agents; empty uses the task's model
+	rounds  int
+	judge   string // "vote", provider/model, or "" for the task's model
+}
+
+const debateJudgeVote = "vote"
+
+const debateCritiquePrompt = `You answered the task below, and so did other assistants. Critique their answers and your own: point out errors, omissions, and anything they got right that you missed. Then give your revised answer.
+
+Task:
+%s
+
+Your answer:
+%s
+
+Other answers:
+%s
+Reply with your critique, then a line containing only "REVISED ANSWER:", then your complete revised answer.`
+
+const debateJudgePrompt = `Several assistants answered the task below. Pick the best answer: the most correct, complete and clear.
+
+Task:
+%s
+
+%s
+Reply with the number of the best answer on the first line, then one sentence saying why.`
+
+// runDebate has the agents answer independently, critique each other for
+// the configured rounds, then lets the judge (or a vote among the agents)
+// pick the final answer. The returned Debate is populated even on failure.
+func (r *runner) runDebate(ctx context.Context, req TaskRequest, cfg debateConfig) (*Debate, string, error) {
+	g := orchestrator.New()
+	d := &Debate{Rounds: cfg.rounds, Judge: cfg.judge}
+	defer func() { d.Transcript = g.Transcript() }()
+
+	for i := 0; i < cfg.agents; i++ {
+		a := DebateAgent{Name: fmt.Sprintf("agent-%d", i+1)}
+		a.Provider, a.Model = withDefaults("", "", req)
+		if len(cfg.choices) > 0 {
+			c := cfg.choices[i%len(cfg.choices)]
+			a.Provider, a.Model = withDefaults(c.provider, c.model, req)
+		}
+		if err := g.Add(orchestrator.Spec{Name: a.Name, Agent: r.agent(a.Provider, a.Model)}); err != nil {
+			return d, "", err
+		}
+		d.Agents = append(d.Agents, a)
+	}
+
+	// Round 0: independent answers. Agents that fail drop out.
+	msgs := make([]orchestrator.Message, len(d.Agents))
+	for i, a := range d.Agents {
+		msgs[i] = orchestrator.Message{To: a.Name, Content: req.Task}
+	}
+	for i, res := range g.Parallel(ctx, msgs) {
+		if res.Err != nil {
+			d.Agents[i].Error = res.Err.Error()
+		} else {
+			d.Agents[i].Answer = res.Reply
+		}
+	}
+	live := d.live()
+	if len(live) == 0 {
+		return d, "", fmt.Errorf("debate: every agent failed: %s", d.Agents[0].Error)
+	}
+
+	for round := 0; round < cfg.rounds && len(live) > 1; round++ {
+		msgs = msgs[:0]
+		for _, i := range live {
+			var others strings.Builder
+			n := 0
+			for _, j := range live {
+				if j != i {
+					n++
+					fmt.Fprintf(&others, "\nAnswer %d:\n%s\n", n, d.Agents[j].Answer)
+				}
+			}
+			msgs = append(msgs, orchestrator.Message{To: d.Agents[i].Name,
+				Content: fmt.Sprintf(debateCritiquePrompt, req.Task, d.Agents[i].Answer, others.String())})
+		}
+		// A failed critique keeps the agent's previous answer.
+		for k, res := range g.Parallel(ctx, msgs) {
+			if res.Err == nil {
+				d.Agents[live[k]].Answer = revisedAnswer(res.Reply)
+			}
+		}
+		if ctx.Err() != nil {
+			return d, "", ctx.Err()
+		}
+	}
+
+	if len(live) == 1 {
+		d.Winner = d.Agents[live[0]].Name
+		return d, d.Agents[live[0]].Answer, nil
+	}
+
+	var candidates strings.Builder
+	for n, i := range live {
+		fmt.Fprintf(&candidates, "Answer %d:\n%s\n\n", n+1, d.Agents[i].Answer)
+	}
+	ballot := fmt.Sprintf(debateJudgePrompt, req.Task, candidates.String())
+
+	pick := -1
+	if cfg.judge == debateJudgeVote {
+		d.Votes = map[string]int{}
+		msgs = msgs[:0]
+		for _, i := range live {
+			msgs = append(msgs, orchestrator.Message{To: d.Agents[i].Name, Content: ballot})
+		}
+		counts := make([]int, len(live))
+		for _, res := range g.Parallel(ctx, msgs) {
+			if n, ok := parseChoice(res.Reply, len(live)); res.Err == nil && ok {
+				counts[n]++
+				d.Votes[d.Agents[live[n]].Name]++
+			}
+		}
+		// Ties go to the earlier agent.
+		for n, c := range counts {
+			if c > 0 && (pick < 0 || c > counts[pick]) {
+				pick = n
+			}
+		}
+		if pick < 0 {
+			return d, "", fmt.Errorf("debate: no valid votes")
+		}
+	} else {
+		provider, model := withDefaults("", "", req)
+		if cfg.judge != "" {
+			c, _ := parseModelChoices(cfg.judge)
+			provider, model = withDefaults(c[0].provider, c[0].model, req)
+		}
+		d.Judge = modelChoice{provider, model}.String()
+		if err := g.Add(orchestrator.Spec{Name: "judge", Agent: r.agent(provider, model)}); err != nil {
+			return d, "", err
+		}
+		verdict, err := g.Ask(ctx, "judge", ballot)
+		if err != nil {
+			return d, "", fmt.Errorf("debate judge: %w", err)
+		}
+		n, ok := parseChoice(verdict, len(live))
+		if !ok {
+			return d, "", fmt.Errorf("debate judge did not name an answer")
+		}
+		pick = n
+		if _, reason, found := strings.Cut(strings.TrimSpace(verdict), "\n"); found {
+			d.Reason = strings.TrimSpace(reason)
+		}
+	}
+	winner := d.Agents[live[pick]]
+	d.Winner = winner.Name
+	return d, winner.Answer, nil
+}
+
+// live returns the indexes of the agents that answered.
+func (d *Debate) live() []int {
+	var idx []int
+	for i, a := range d.Agents {
+		if a.Error == "" {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// revisedAnswer takes what follows the last REVISED ANSWER: marker, or the
+// whole reply if the model left it out.
+func revisedAnswer(reply string) string {
+	if i := strings.LastIndex(reply, "REVISED ANSWER:"); i >= 0 {
+		if rest := strings.TrimSpace(reply[i+len("REVISED ANSWER:"):]); rest != "" {
+			return rest
+		}
+	}
+	return reply
+}
+
+var choiceRe = regexp.MustCompile(`\d+`)
+
+// parseChoice reads the 1-based answer number the judge or a voter picked
+// and returns it 0-based.
+func parseChoice(reply string, n int) (int, bool) {
+	for _, m := range choiceRe.FindAllString(reply, 3) {
+		if v, err := strconv.Atoi(m); err == nil && v >= 1 && v <= n {
+			return v - 1, true
+		}
+	}
+	return 0, false
+}
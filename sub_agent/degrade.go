@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// The degradation matrix: what a task gets when its provider lacks a
+// feature it needs, instead of an error from deep in the provider's API.
+//
+//	feature  native on                               without it
+//	tools    -                                       prompt-based tool calling: the tool loop describes the tools in the prompt on every provider
+//	format   local, azure-openai, OpenAI-compatible  emulated: the schema is asked for in the prompt and the answer validated after, asking once more with the errors
+//	grammar  OpenAI-compatible with "grammar": true  fails fast: a grammar can't be enforced after the fact
+//	vision   models the registry marks "vision"      fails fast
+//	files    cloud                                   fails fast
+//
+// --degrade fail turns emulation into failing fast too. Failing fast
+// returns an error of kind unsupported that names the feature and what
+// does have it.
+
+// FeatureFormat is the feature of Degradation for an emulated --format.
+const FeatureFormat = "format"
+
+// --degrade policies.
+const (
+	DegradeEmulate = "emulate"
+	DegradeFail    = "fail"
+)
+
+func validDegrade(p string) bool {
+	return p == DegradeEmulate || p == DegradeFail
+}
+
+// Degradation is a feature a task needed that its provider lacks, and how
+// it was made up for.
+type Degradation struct {
+	Feature  string `json:"feature"`
+	Provider string `json:"provider"`
+	Strategy string `json:"strategy"`
+	// Error is why the answer still fails post-hoc validation.
+	Error string `json:"error,omitempty"`
+}
+
+// nativeFormat reports whether the provider constrains answers to JSON or
+// a schema itself.
+func nativeFormat(provider string) bool {
+	switch provider {
+	case "cloud", "bedrock":
+		return false
+	}
+	return true
+}
+
+// degradeFor is the --degrade policy of req.
+func (r *runner) degradeFor(req TaskRequest) string {
+	if req.Degrade != "" {
+		return req.Degrade
+	}
+	return r.degrade
+}
+
+// emulatesFormat reports whether req's JSON format has to be asked for in
+// the prompt and checked after.
+func (r *runner) emulatesFormat(req TaskRequest) bool {
+	f := r.answerFormat(req)
+	return f != nil && textFormat(f) == "" && !nativeFormat(req.Provider)
+}
+
+// formatInstruction asks for an answer in format, "json" or a schema, for
+// providers that can't be made to give one.
+func formatInstruction(format json.RawMessage) string {
+	if bytes.Equal(format, formatJSON) {
+		return "Reply with only a valid JSON value: no prose and no code fences."
+	}
+	return "Reply with only a JSON value, with no prose and no code fences, that is valid against this JSON schema:\n" + string(format)
+}
+
+const formatRetryPrompt = "Your previous answer was not valid: %v. Answer again, following the format exactly."
+
+// noteDegraded adds d to res once per feature.
+func noteDegraded(res *TaskResult, d Degradation) {
+	for i, e := range res.Degraded {
+		if e.Feature == d.Feature {
+			res.Degraded[i] = d
+			return
+		}
+	}
+	res.Degraded = append(res.Degraded, d)
+}
+
+// validateEmulatedFormat checks an answer whose format was only asked for
+// in the prompt, asking once more with the errors when it doesn't match.
+// sample gives the answer to a prompt.
+func (r *runner) validateEmulatedFormat(ctx context.Context, req TaskRequest, prompt, answer string, res *TaskResult, sample func(prompt string) (string, error)) (string, error) {
+	format := r.answerFormat(req)
+	d := Degradation{Feature: FeatureFormat, Provider: req.Provider, Strategy: "schema in the prompt, answer validated after"}
+	verr := checkFormat(format, answer)
+	if verr != nil {
+		logf(ctx, "The answer doesn't match --format (%v); asking again", verr)
+		again, err := sample(prompt + "\n\n" + fmt.Sprintf(formatRetryPrompt, verr))
+		if err != nil {
+			return "", err
+		}
+		if verr = checkFormat(format, again); verr == nil {
+			answer = again
+		}
+	}
+	if verr != nil {
+		d.Error = verr.Error()
+		res.Warnings = append(res.Warnings, fmt.Sprintf("%s can't enforce --format and the answer still doesn't match it: %v", req.Provider, verr))
+	}
+	noteDegraded(res, d)
+	return answer, nil
+}
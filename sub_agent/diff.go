@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// RunSummary is one side of `helix diff`.
+type RunSummary struct {
+	ID         string  `json:"id"`
+	Model      string  `json:"model"` // provider/model
+	DurationMS int64   `json:"duration_ms"`
+	Usage      *Usage  `json:"usage,omitempty"`
+	Cost       float64 `json:"estimated_cost_usd"` // from registry prices; 0 when unpriced
+	Error      string  `json:"error,omitempty"`
+}
+
+// RunDiff is the JSON output of `helix diff`.
+type RunDiff struct {
+	A         RunSummary `json:"a"`
+	B         RunSummary `json:"b"`
+	Identical bool       `json:"identical"`
+	Diff      string     `json:"diff,omitempty"` // unified, or word-level with --word
+}
+
+func summarizeRun(e *HistoryEntry) RunSummary {
+	res := e.Result
+	s := RunSummary{ID: e.ID, Model: modelChoice{res.Provider, res.Model}.String(), DurationMS: e.DurationMS, Usage: res.Usage, Error: res.Error}
+	if u := res.Usage; u != nil {
+		if info, ok := lookupModel(res.Provider, res.Model); ok {
+			// Thinking is billed as output.
+			s.Cost = estimateCost(info, u.PromptTokens, u.OutputTokens+u.ThinkingTokens)
+		}
+	}
+	return s
+}
+
+// diffCommand implements `diff`: compare the answers and the latency, tokens
+// and cost of two recorded runs, such as one task on two models.
+func diffCommand(fs *flag.FlagSet) func(args []string) {
+	word := fs.Bool("word", false, "Mark changed words inline instead of showing a unified diff of lines")
+	contextLines := fs.Int("context-lines", 3, "Unchanged lines shown around each change in a unified diff")
+	fs.BoolVar(&jsonOut, "json", false, "Print both runs' metadata and the diff as JSON")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the diff, without the metadata comparison")
+	return func(args []string) {
+		if len(args) != 2 {
+			fatal(kindError(ErrConfig, "usage: helix diff [--word] <run-a> <run-b> (see helix replay --list)"))
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		var entries [2]*HistoryEntry
+		for i, id := range args {
+			if entries[i], err = store.load(id); err != nil {
+				fatal(configError(err))
+			}
+		}
+		a, b := entries[0].Result, entries[1].Result
+		for _, e := range entries {
+			if e.Result.ArtifactURL != "" {
+				statusf("[Sub-Agent] Warning: run %s's answer was uploaded to %s and is compared as empty\n", e.ID, e.Result.ArtifactURL)
+			}
+		}
+		d := RunDiff{A: summarizeRun(entries[0]), B: summarizeRun(entries[1])}
+		if *word {
+			d.Diff = wordDiff(a.Output, b.Output)
+		} else {
+			d.Diff = unifiedDiff(a.Output, b.Output, fmt.Sprintf("%s (%s)", d.A.ID, d.A.Model), fmt.Sprintf("%s (%s)", d.B.ID, d.B.Model), *contextLines)
+		}
+		d.Identical = d.Diff == ""
+		if jsonOut {
+			printJSON(d)
+			return
+		}
+		printRunComparison(d.A, d.B)
+		if d.Identical {
+			statusf("[Sub-Agent] The answers are identical\n")
+			return
+		}
+		fmt.Print(d.Diff)
+		if *word {
+			fmt.Println()
+		}
+	}
+}
+
+// printRunComparison prints the two runs' metadata side by side with the
+// change from a to b.
+func printRunComparison(a, b RunSummary) {
+	var ua, ub Usage
+	if a.Usage != nil {
+		ua = *a.Usage
+	}
+	if b.Usage != nil {
+		ub = *b.Usage
+	}
+	row := func(name, va, vb, change string) {
+		statusf("%s\n", strings.TrimRight(fmt.Sprintf("%-16s %-28s %-28s %s", name, va, vb, change), " "))
+	}
+	row("", a.ID, b.ID, "")
+	row("model", a.Model, b.Model, "")
+	row("latency", fmt.Sprintf("%dms", a.DurationMS), fmt.Sprintf("%dms", b.DurationMS), relativeChange(float64(a.DurationMS), float64(b.DurationMS)))
+	for _, c := range []struct {
+		name   string
+		va, vb int
+	}{
+		{"calls", ua.Calls, ub.Calls},
+		{"prompt tokens", ua.PromptTokens, ub.PromptTokens},
+		{"output tokens", ua.OutputTokens, ub.OutputTokens},
+		{"thinking tokens", ua.ThinkingTokens, ub.ThinkingTokens},
+	} {
+		if c.va != 0 || c.vb != 0 {
+			row(c.name, fmt.Sprint(c.va), fmt.Sprint(c.vb), relativeChange(float64(c.va), float64(c.vb)))
+		}
+	}
+	row("estimated cost", fmt.Sprintf("$%.4f", a.Cost), fmt.Sprintf("$%.4f", b.Cost), relativeChange(a.Cost, b.Cost))
+	if a.Error != "" || b.Error != "" {
+		row("error", truncateRunes(a.Error, 28), truncateRunes(b.Error, 28), "")
+	}
+	statusf("\n")
+}
+
+// relativeChange is b's change from a as a signed percentage, "" when a is 0.
+func relativeChange(a, b float64) string {
+	if a == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%+.0f%%", (b-a)/a*100)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// doctorCheck is one finding of `helix doctor`, with a fix when it failed.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// doctorCommand implements `doctor`: it checks that each provider is
+// reachable, accepts its credentials and has its default model, optionally
+// times a tiny generation, and says how to fix what fails.
+func doctorCommand(fs *flag.FlagSet) func(args []string) {
+	providers := fs.String("providers", "", "Comma-separated providers to check (default: local plus every configured provider)")
+	roundTrip := fs.Bool("round-trip", true, "Time a one-word answer from each provider that passes (cloud calls are billed)")
+	asJSON := fs.Bool("json", false, "Print the checks as JSON")
+	kf := addKeyFlags(fs)
+	return func([]string) {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		names := configuredProviders(key)
+		if *providers != "" {
+			names = nil
+			for _, p := range strings.Split(*providers, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					names = append(names, p)
+				}
+			}
+		}
+
+		ctx := context.Background()
+		checks := []doctorCheck{doctorConfig()}
+		for _, name := range names {
+			var pc []doctorCheck
+			if name == "local" || name == "" {
+				pc = doctorOllama(ctx)
+			} else {
+				pc = doctorProvider(ctx, name, key)
+			}
+			checks = append(checks, pc...)
+			if *roundTrip && allOK(pc) {
+				checks = append(checks, doctorRoundTrip(ctx, name, key))
+			}
+		}
+
+		if *asJSON {
+			printJSON(checks)
+		} else {
+			for _, c := range checks {
+				mark := "[ok]  "
+				if !c.OK {
+					mark = "[FAIL]"
+				}
+				fmt.Printf("%s %s: %s\n", mark, c.Name, c.Detail)
+				if c.Fix != "" {
+					fmt.Printf("       fix: %s\n", c.Fix)
+				}
+			}
+		}
+		if !allOK(checks) {
+			os.Exit(1)
+		}
+	}
+}
+
+func allOK(checks []doctorCheck) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func doctorConfig() doctorCheck {
+	path, _ := configPath()
+	if _, err := os.Stat(path); path == "" || err != nil {
+		return doctorCheck{Name: "config", OK: true, Detail: "no config file; using defaults"}
+	}
+	return doctorCheck{Name: "config", OK: true, Detail: path}
+}
+
+// doctorOllama tells apart the usual reasons Ollama can't be reached:
+// host.docker.internal not resolving outside Docker, Ollama listening on
+// loopback only, or Ollama not running at all.
+func doctorOllama(ctx context.Context) []doctorCheck {
+	inDocker := inContainer()
+	where := "outside a container (" + runtime.GOOS + ")"
+	if inDocker {
+		where = "inside a container"
+	}
+	checks := []doctorCheck{{Name: "environment", OK: true, Detail: "running " + where}}
+	if p := localPool(); p != nil {
+		for _, s := range p.status() {
+			c := doctorCheck{Name: "Ollama pool", OK: s.Healthy, Detail: fmt.Sprintf("%s: %d model(s), loaded: %s", s.URL, s.Models, strings.Join(s.Loaded, ", "))}
+			if len(s.Loaded) == 0 {
+				c.Detail = fmt.Sprintf("%s: %d model(s), none loaded", s.URL, s.Models)
+			}
+			if !s.Healthy {
+				c.Detail, c.Fix = s.URL+": "+s.Err, "check that Ollama runs there and listens beyond loopback; calls go to the other hosts meanwhile"
+			}
+			checks = append(checks, c)
+		}
+	}
+
+	host := ollamaHost()
+	u, _ := url.Parse(host)
+	if socket, ok := unixSocketFor(u.Hostname()); ok {
+		if _, err := os.Stat(socket); err != nil {
+			return append(checks, doctorCheck{Name: "Ollama host", Detail: fmt.Sprintf("socket %v", err), Fix: "check the socket path in ollama.host or OLLAMA_HOST, and that the server behind it runs"})
+		}
+		checks = append(checks, doctorCheck{Name: "Ollama host", OK: true, Detail: fmt.Sprintf("unix socket %s (%s)", socket, ollamaHostSource)})
+	} else {
+		lctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+		_, err := net.DefaultResolver.LookupHost(lctx, u.Hostname())
+		cancel()
+		if err != nil {
+			fix := "set ollama.host in the config or OLLAMA_HOST to where Ollama runs"
+			if inDocker && u.Hostname() == "host.docker.internal" {
+				fix = "start the container with --add-host=host.docker.internal:host-gateway (Docker Desktop does this by itself), or set OLLAMA_HOST"
+			}
+			return append(checks, doctorCheck{Name: "Ollama host", Detail: fmt.Sprintf("%s does not resolve: %v", u.Hostname(), err), Fix: fix})
+		}
+		checks = append(checks, doctorCheck{Name: "Ollama host", OK: true, Detail: fmt.Sprintf("%s (%s)", host, ollamaHostSource)})
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	start := time.Now()
+	models, err := ollamaModels(pctx, host)
+	if err != nil {
+		c := doctorCheck{Name: "Ollama", Detail: redactErr(err).Error()}
+		switch {
+		case inDocker:
+			c.Fix = "check that Ollama runs on the Docker host and listens beyond loopback: start it with OLLAMA_HOST=0.0.0.0:11434"
+		case ollamaOnLoopback(pctx):
+			c.Fix = fmt.Sprintf("Ollama answers on 127.0.0.1 but %s is used; unset OLLAMA_HOST or ollama.host", host)
+		default:
+			c.Fix = "start Ollama with 'ollama serve' (install it from https://ollama.com first if needed)"
+		}
+		return append(checks, c)
+	}
+	checks = append(checks, doctorCheck{Name: "Ollama", OK: true,
+		Detail: fmt.Sprintf("%s answered in %s with %d models", host, time.Since(start).Round(time.Millisecond), len(models))})
+
+	want := defaultModel("local", "")
+	if !hasOllamaModel(models, want) {
+		return append(checks, doctorCheck{Name: "local model", Detail: want + " is not pulled", Fix: "ollama pull " + want})
+	}
+	return append(checks, doctorCheck{Name: "local model", OK: true, Detail: want + " is pulled"})
+}
+
+// ollamaOnLoopback reports whether an Ollama answers on this machine's
+// loopback, where Ollama listens by default.
+func ollamaOnLoopback(ctx context.Context) bool {
+	_, err := ollamaModels(ctx, "http://127.0.0.1:11434")
+	return err == nil
+}
+
+// doctorProvider checks a provider's reachability and credentials, and an
+// OpenAI-compatible provider's default model.
+func doctorProvider(ctx context.Context, name, key string) []doctorCheck {
+	pc := preflight(ctx, name, key)
+	c := doctorCheck{Name: name, OK: pc.OK, Detail: pc.Detail}
+	if !pc.OK {
+		c.Detail, c.Fix = pc.Error, doctorFix(name, pc.Kind)
+		return []doctorCheck{c}
+	}
+	c.Detail = fmt.Sprintf("credentials accepted in %dms", pc.LatencyMS)
+	if pc.Detail != "" {
+		c.Detail += " (" + pc.Detail + ")"
+	}
+	checks := []doctorCheck{c}
+
+	a, ok := lookupAdapter(name)
+	if !ok || a.DefaultModel == "" {
+		return checks
+	}
+	mctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	models, err := adapterModels(mctx, name, a)
+	if err != nil || len(models) == 0 {
+		return checks // listed above; some servers don't list models
+	}
+	for _, m := range models {
+		if m == a.DefaultModel {
+			return append(checks, doctorCheck{Name: name + " model", OK: true, Detail: a.DefaultModel + " is available"})
+		}
+	}
+	sample := models[:min(len(models), 5)]
+	return append(checks, doctorCheck{Name: name + " model", Detail: a.DefaultModel + " is not offered",
+		Fix: fmt.Sprintf("set default_model for %s to one it lists, e.g. %s", name, strings.Join(sample, ", "))})
+}
+
+// doctorFix suggests what to do about a failed preflight.
+func doctorFix(name string, kind ErrorKind) string {
+	switch kind {
+	case ErrAuth:
+		env := "GEMINI_API_KEY"
+		if a, ok := lookupAdapter(name); ok {
+			env = a.APIKeyEnv
+		}
+		switch {
+		case name == "azure-openai" || name == "bedrock":
+			return "check the " + name + " credentials in the environment and config"
+		case env == "":
+			return fmt.Sprintf("the server of %s wants a key; set api_key_env in its openai_compatible entry", name)
+		}
+		return fmt.Sprintf("check the key: set %s or run 'helix auth login --provider %s'", env, name)
+	case ErrUnreachable:
+		if a, ok := lookupAdapter(name); ok {
+			return fmt.Sprintf("check base_url (%s) and network access to it (proxy, firewall, DNS)", a.BaseURL)
+		}
+		return "check network access to the provider (proxy, firewall, DNS)"
+	case ErrRateLimited:
+		return "the credentials work but are rate limited; wait or raise the quota"
+	case ErrConfig:
+		return fmt.Sprintf("fix the %s settings in the config", name)
+	}
+	return ""
+}
+
+// doctorRoundTrip times a one-word answer.
+func doctorRoundTrip(ctx context.Context, name, key string) doctorCheck {
+	if a, ok := lookupAdapter(name); ok && a.DefaultModel == "" {
+		return doctorCheck{Name: name + " round trip", OK: true, Detail: "skipped: no default_model"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	model := defaultModel(name, "")
+	start := time.Now()
+	out, err := generate(ctx, name, model, "Reply with the single word OK.", key)
+	took := time.Since(start).Round(time.Millisecond)
+	c := doctorCheck{Name: name + " round trip"}
+	if err != nil {
+		c.Detail, c.Fix = redactErr(err).Error(), doctorFix(name, errorKind(err))
+		return c
+	}
+	if _, answer := splitThinking(out); strings.TrimSpace(answer) == "" {
+		c.Detail = fmt.Sprintf("%s returned an empty answer after %s", modelChoice{name, model}, took)
+		return c
+	}
+	c.OK, c.Detail = true, fmt.Sprintf("%s answered in %s", modelChoice{name, model}, took)
+	return c
+}
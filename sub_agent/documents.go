@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DocumentsConfig sets how --context and --task-file read PDFs. Text is
+// extracted with poppler's pdftotext; a PDF without a text layer (a scan)
+// is rendered with pdftoppm and read by tesseract when OCR is on.
+type DocumentsConfig struct {
+	OCR         bool   `json:"ocr,omitempty"`
+	OCRLanguage string `json:"ocr_language,omitempty"` // tesseract's, e.g. "eng+deu"; default eng
+}
+
+// documentTimeout bounds the external tools run on one document.
+const documentTimeout = 2 * time.Minute
+
+// extractDocument returns the text of a PDF, docx or xlsx file; ok is
+// false for any other file, which is read as it is.
+func extractDocument(name string, data []byte, ocr bool) (text string, ok bool, err error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pdf":
+		text, err = pdfText(data, ocr)
+	case ".docx":
+		text, err = docxText(data)
+	case ".xlsx":
+		text, err = xlsxText(data)
+	default:
+		return "", false, nil
+	}
+	if err != nil {
+		return "", true, fmt.Errorf("extracting text from %s: %v", name, err)
+	}
+	return text, true, nil
+}
+
+// readTaskFile reads --task-file, extracting the text of documents.
+func readTaskFile(path string, ocr bool) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading task file: %v", err)
+	}
+	if text, ok, err := extractDocument(path, data, ocr); ok {
+		return text, err
+	}
+	return string(data), nil
+}
+
+func pdfText(data []byte, ocr bool) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), documentTimeout)
+	defer cancel()
+	dir, err := os.MkdirTemp("", "helix-pdf-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	pdf := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(pdf, data, 0600); err != nil {
+		return "", err
+	}
+	out, err := runTool(ctx, "pdftotext", "install poppler-utils", "-layout", "-enc", "UTF-8", pdf, "-")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(out) != "" {
+		return out, nil
+	}
+	if !ocr {
+		return "", fmt.Errorf("the PDF has no text layer (a scan?); pass --ocr or set documents.ocr to read it with tesseract")
+	}
+
+	if _, err := runTool(ctx, "pdftoppm", "install poppler-utils", "-r", "300", "-png", pdf, filepath.Join(dir, "page")); err != nil {
+		return "", err
+	}
+	pages, _ := filepath.Glob(filepath.Join(dir, "page*.png"))
+	if len(pages) == 0 {
+		return "", fmt.Errorf("pdftoppm rendered no pages")
+	}
+	// pdftoppm pads page numbers to the same width, so names sort in order.
+	sort.Strings(pages)
+	lang := config.Documents.OCRLanguage
+	if lang == "" {
+		lang = "eng"
+	}
+	var b strings.Builder
+	for _, p := range pages {
+		text, err := runTool(ctx, "tesseract", "install tesseract-ocr", p, "-", "-l", lang)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(strings.TrimSpace(text) + "\n\f")
+	}
+	return strings.TrimSuffix(b.String(), "\f"), nil
+}
+
+// runTool runs a document tool and returns its stdout.
+func runTool(ctx context.Context, name, install string, args ...string) (string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", fmt.Errorf("%s not found on PATH (%s)", name, install)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", name, err, truncateRunes(strings.TrimSpace(stderr.String()), 200))
+	}
+	return stdout.String(), nil
+}
+
+func openZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	f, err := zr.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// docxText reads the paragraphs and tables of word/document.xml: a
+// paragraph per line, table cells separated by tabs.
+func docxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	doc, err := openZipFile(zr, "word/document.xml")
+	if err != nil {
+		return "", fmt.Errorf("not a Word document: %v", err)
+	}
+	var b bytes.Buffer
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	inText := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				b.WriteString("\t")
+			case "br", "cr":
+				b.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				b.WriteString("\n")
+			case "tc":
+				// A cell's last paragraph ended the line; separate cells instead.
+				trimLastByte(&b, '\n')
+				b.WriteString("\t")
+			case "tr":
+				trimLastByte(&b, '\t')
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func trimLastByte(b *bytes.Buffer, c byte) {
+	if n := b.Len(); n > 0 && b.Bytes()[n-1] == c {
+		b.Truncate(n - 1)
+	}
+}
+
+// xlsxText reads every worksheet as tab-separated rows under a heading
+// with the sheet's name.
+func xlsxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	wbData, err := openZipFile(zr, "xl/workbook.xml")
+	if err != nil {
+		return "", fmt.Errorf("not an Excel workbook: %v", err)
+	}
+	var wb struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(wbData, &wb); err != nil {
+		return "", err
+	}
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if relData, err := openZipFile(zr, "xl/_rels/workbook.xml.rels"); err == nil {
+		xml.Unmarshal(relData, &rels)
+	}
+	targets := map[string]string{}
+	for _, r := range rels.Rels {
+		t := strings.TrimPrefix(r.Target, "/")
+		if !strings.HasPrefix(t, "xl/") {
+			t = path.Join("xl", t)
+		}
+		targets[r.ID] = t
+	}
+
+	var shared []string
+	if ssData, err := openZipFile(zr, "xl/sharedStrings.xml"); err == nil {
+		var sst struct {
+			SI []struct {
+				T string `xml:"t"`
+				R []struct {
+					T string `xml:"t"`
+				} `xml:"r"`
+			} `xml:"si"`
+		}
+		if err := xml.Unmarshal(ssData, &sst); err != nil {
+			return "", err
+		}
+		for _, si := range sst.SI {
+			s := si.T
+			for _, r := range si.R {
+				s += r.T
+			}
+			shared = append(shared, s)
+		}
+	}
+
+	var b strings.Builder
+	for i, sheet := range wb.Sheets {
+		target, ok := targets[sheet.RID]
+		if !ok {
+			target = fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1)
+		}
+		wsData, err := openZipFile(zr, target)
+		if err != nil {
+			return "", fmt.Errorf("sheet %s: %v", sheet.Name, err)
+		}
+		var ws struct {
+			Rows []struct {
+				Cells []struct {
+					Ref    string `xml:"r,attr"`
+					Type   string `xml:"t,attr"`
+					Value  string `xml:"v"`
+					Inline string `xml:"is>t"`
+				} `xml:"c"`
+			} `xml:"sheetData>row"`
+		}
+		if err := xml.Unmarshal(wsData, &ws); err != nil {
+			return "", fmt.Errorf("sheet %s: %v", sheet.Name, err)
+		}
+		fmt.Fprintf(&b, "## %s\n", sheet.Name)
+		for _, row := range ws.Rows {
+			var cells []string
+			for _, c := range row.Cells {
+				// Empty cells are left out of the XML; keep the columns aligned.
+				for len(cells) < columnIndex(c.Ref) {
+					cells = append(cells, "")
+				}
+				v := c.Value
+				switch c.Type {
+				case "s":
+					if n, err := strconv.Atoi(v); err == nil && n < len(shared) {
+						v = shared[n]
+					}
+				case "inlineStr":
+					v = c.Inline
+				}
+				cells = append(cells, v)
+			}
+			b.WriteString(strings.Join(cells, "\t") + "\n")
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// columnIndex is the zero-based column of a cell reference such as "C7",
+// or -1 when there is none.
+func columnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
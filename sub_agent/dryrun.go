@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DryRun is reported by --dry-run in place of an answer: the request that
+// would have been sent, and what it would roughly cost.
+type DryRun struct {
+	Endpoint      string          `json:"endpoint"`
+	Prompt        string          `json:"prompt"`
+	Payload       json.RawMessage `json:"payload"`
+	PromptTokens  int             `json:"prompt_tokens"`
+	OutputTokens  int             `json:"output_tokens"` // assumed: the reserve
+	EstimatedCost float64         `json:"estimated_cost_usd"`
+	// PromptSHA256 hashes the prompt as sent; Sections are the parts it
+	// was assembled from, in promptOrder, before any fitting to the window.
+	PromptSHA256 string          `json:"prompt_sha256"`
+	Sections     []PromptSection `json:"sections,omitempty"`
+}
+
+// preview assembles the final prompt for req exactly as execute would and
+// renders the provider request without sending it.
+func (r *runner) preview(ctx context.Context, req TaskRequest, sections []PromptSection, res *TaskResult) error {
+	if r.plan.enabled || req.Plan {
+		res.Warnings = append(res.Warnings, "dry run shows a single direct call; planner stages are not previewed")
+	}
+	// Summarizing an overflow would call the model, so preview the
+	// truncation that takes its place.
+	fr := r
+	if r.context.strategy == ContextSummarize {
+		cp := *r
+		cp.context.strategy = ContextTruncateMiddle
+		fr = &cp
+		res.Warnings = append(res.Warnings, "dry run previews truncate-middle instead of summarize")
+	}
+	prompt, report, err := fr.fitPrompt(ctx, req, req.Task)
+	res.Context = report
+	if err != nil {
+		return err
+	}
+
+	g := genRequest{Provider: req.Provider, Model: req.Model, Prompt: prompt, Images: req.Images, Files: req.Files, Stop: r.stop, Seed: req.Seed, CachedContent: req.GeminiCache, Ground: req.Ground}
+	if len(req.Stop) > 0 {
+		g.Stop = req.Stop
+	}
+	if err := r.constrainAnswer(&g, req); err != nil {
+		return err
+	}
+	if w := r.reason(&g, req); w != "" {
+		res.Warnings = append(res.Warnings, w)
+	}
+	endpoint, payload := previewRequest(g)
+	data, _ := json.Marshal(payload)
+
+	info, _ := lookupModel(req.Provider, req.Model)
+	d := &DryRun{
+		Endpoint:     endpoint,
+		Prompt:       prompt,
+		Payload:      data,
+		PromptTokens: estimateTokens(prompt),
+		OutputTokens: r.context.reserveTokens,
+		PromptSHA256: sha256Hex(prompt),
+		Sections:     sections,
+	}
+	d.EstimatedCost = estimateCost(info, d.PromptTokens, d.OutputTokens)
+	res.DryRun = d
+	return nil
+}
+
+// previewRequest returns the endpoint and JSON body generateRequest would
+// send for g. Credentials are never included.
+func previewRequest(g genRequest) (string, any) {
+	g.Model = defaultModel(g.Provider, g.Model)
+	g = adaptPrompt(g)
+	openAI := openAIRequest(g)
+	switch g.Provider {
+	case "cloud":
+		gc := geminiConfig()
+		if gc.Vertex {
+			project := gc.Project
+			if project == "" {
+				project = "<project from ADC>"
+			}
+			return vertexURL(gc.Location, project, g.Model), geminiPayload(g)
+		}
+		return GeminiBaseURL + "?key=[REDACTED]", geminiPayload(g)
+	case "azure-openai":
+		c := azureConfig()
+		openAI.Model = ""
+		return azureURL(c, g.Model), openAI
+	case "bedrock":
+		return bedrockURL(awsRegion(liveConfig().Bedrock.Region), g.Model).String(), bedrockPayload(g)
+	}
+	if a, ok := lookupAdapter(g.Provider); ok {
+		return a.chatURL(), openAI
+	}
+	g.Model = resolveModel(g.Model)
+	return fmt.Sprintf("%s/api/generate", ollamaHost()), ollamaPayload(g)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// LSP's own error codes, next to JSON-RPC's.
+const (
+	rpcInvalidRequest   = -32600
+	lspRequestCancelled = -32800
+	lspRequestFailed    = -32803
+)
+
+// editorMethods are the requests editor-serve answers besides the LSP
+// lifecycle; each is also a workspace/executeCommand command, with "."
+// for "/" (helix.explain), for clients that only send those.
+var editorMethods = []string{"helix/explain", "helix/rewrite", "helix/generateTests"}
+
+// lspLanguageIDs maps the LSP languageIds that differ from helix's
+// language names.
+var lspLanguageIDs = map[string]string{
+	"javascriptreact": "javascript", "typescriptreact": "typescript", "shellscript": "shell",
+}
+
+const editorExplainPrompt = `Explain the following %[1]s code, selected from %[2]s, for a developer reading it: what it does, how it works and anything subtle. The whole file is in the context. Answer briefly in markdown.
+
+` + "```%[3]s\n%[4]s\n```"
+
+const editorRewritePrompt = `Rewrite the following %[1]s code, selected from %[2]s: %[3]s. Your code replaces the selection as-is, so keep its indentation and add nothing around it; the whole file is in the context. Output only the new code in one %[4]s code block.
+
+` + "```%[4]s\n%[5]s\n```"
+
+// editorServer speaks JSON-RPC with LSP's Content-Length framing on
+// stdin/stdout, so editors can spawn it like a language server. Requests
+// run concurrently and honour $/cancelRequest.
+type editorServer struct {
+	code *codeAssistant
+
+	out     *bufio.Writer
+	outMu   sync.Mutex
+	cancels sync.Map // request ID -> context.CancelFunc
+	wg      sync.WaitGroup
+
+	docsMu sync.Mutex
+	docs   map[string]editorDoc // open documents by URI
+
+	shutdown bool
+}
+
+// editorDoc is a document the editor has open, which may differ from the
+// file on disk.
+type editorDoc struct {
+	languageID string
+	text       string
+}
+
+// editorServeCommand implements `editor-serve`.
+func editorServeCommand(fs *flag.FlagSet) func(args []string) {
+	prov := fs.String("provider", "local", "Default provider for requests that don't name one")
+	mdl := fs.String("model", "", "Default model")
+	siblings := fs.Int("siblings", 8, "Pack up to this many other files of the same language from the file's directory as context")
+	noCheck := fs.Bool("no-check", false, "Return generated tests even if they fail the language's syntax check")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		provider := *prov
+		if *rf.route != "" && *mdl == "" && !flagWasSet(fs, "provider") {
+			provider = "" // the router picks
+		}
+		s := &editorServer{
+			code: &codeAssistant{runner: r, provider: provider, model: *mdl, siblings: *siblings, noCheck: *noCheck},
+			out:  bufio.NewWriter(os.Stdout),
+			docs: map[string]editorDoc{},
+		}
+		fmt.Fprintln(os.Stderr, "[Sub-Agent] Editor server ready on stdio")
+		if !s.serve(bufio.NewReader(os.Stdin)) {
+			os.Exit(1) // LSP: exit without shutdown is an error
+		}
+	}
+}
+
+// serve handles messages until exit or the end of stdin, then waits for
+// running requests. It reports whether shutdown came first.
+func (s *editorServer) serve(in *bufio.Reader) bool {
+	defer s.wg.Wait()
+	for {
+		body, err := readLSPMessage(in)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error: reading editor message: %v\n", err)
+			}
+			return s.shutdown
+		}
+		if !s.handle(body) {
+			return s.shutdown
+		}
+	}
+}
+
+// readLSPMessage reads one message: headers, a blank line, then
+// Content-Length bytes of JSON.
+func readLSPMessage(in *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && strings.TrimSpace(line) != "" {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if length >= 0 {
+				break
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", strings.TrimSpace(value))
+			}
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *editorServer) send(msg rpcMessage) {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: encoding editor response: %v\n", err)
+		return
+	}
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(data))
+	s.out.Write(data)
+	if err := s.out.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: writing editor response: %v\n", err)
+	}
+}
+
+func (s *editorServer) reply(id json.RawMessage, result any) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		s.fail(id, rpcInternalError, err.Error())
+		return
+	}
+	s.send(rpcMessage{ID: id, Result: data})
+}
+
+func (s *editorServer) fail(id json.RawMessage, code int, message string) {
+	s.send(rpcMessage{ID: id, Error: &rpcError{Code: code, Message: message}})
+}
+
+// handle answers one message; it returns false on exit.
+func (s *editorServer) handle(body []byte) bool {
+	var msg rpcMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		s.fail(json.RawMessage("null"), rpcParseError, err.Error())
+		return true
+	}
+	notification := len(msg.ID) == 0
+	if s.shutdown && msg.Method != "exit" {
+		if !notification {
+			s.fail(msg.ID, rpcInvalidRequest, "the server is shutting down")
+		}
+		return true
+	}
+	switch msg.Method {
+	case "initialize":
+		var commands []string
+		for _, m := range editorMethods {
+			commands = append(commands, strings.Replace(m, "/", ".", 1))
+		}
+		s.reply(msg.ID, map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // full: every change sends the whole text
+				"executeCommandProvider": map[string]any{"commands": commands},
+				"experimental":           map[string]any{"helix": map[string]any{"methods": editorMethods}},
+			},
+			"serverInfo": mcpImplementation,
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.reply(msg.ID, nil)
+	case "exit":
+		return false
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		s.track(msg.Method, msg.Params)
+	case "$/cancelRequest":
+		var p struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			if cancel, ok := s.cancels.Load(string(p.ID)); ok {
+				cancel.(context.CancelFunc)()
+			}
+		}
+	case "workspace/executeCommand":
+		var p struct {
+			Command   string            `json:"command"`
+			Arguments []json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			s.fail(msg.ID, rpcInvalidParams, err.Error())
+			return true
+		}
+		method := strings.Replace(p.Command, ".", "/", 1)
+		if !isEditorMethod(method) {
+			s.fail(msg.ID, rpcInvalidParams, "unknown command: "+p.Command)
+			return true
+		}
+		var params json.RawMessage
+		if len(p.Arguments) > 0 {
+			params = p.Arguments[0]
+		}
+		s.start(msg.ID, method, params)
+	default:
+		if isEditorMethod(msg.Method) && !notification {
+			s.start(msg.ID, msg.Method, msg.Params)
+		} else if !notification && !strings.HasPrefix(msg.Method, "$/") {
+			s.fail(msg.ID, rpcMethodNotFound, "method not found: "+msg.Method)
+		}
+	}
+	return true
+}
+
+func isEditorMethod(method string) bool {
+	for _, m := range editorMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// track keeps the text of open documents, so requests see unsaved edits.
+func (s *editorServer) track(method string, params json.RawMessage) {
+	var p struct {
+		TextDocument struct {
+			URI        string `json:"uri"`
+			LanguageID string `json:"languageId"`
+			Text       string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	if json.Unmarshal(params, &p) != nil {
+		return
+	}
+	uri := p.TextDocument.URI
+	s.docsMu.Lock()
+	defer s.docsMu.Unlock()
+	switch method {
+	case "textDocument/didOpen":
+		s.docs[uri] = editorDoc{languageID: p.TextDocument.LanguageID, text: p.TextDocument.Text}
+	case "textDocument/didChange":
+		if doc, ok := s.docs[uri]; ok && len(p.ContentChanges) > 0 {
+			doc.text = p.ContentChanges[len(p.ContentChanges)-1].Text
+			s.docs[uri] = doc
+		}
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+	}
+}
+
+// start runs a request in the background.
+func (s *editorServer) start(id json.RawMessage, method string, params json.RawMessage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels.Store(string(id), cancel)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.cancels.Delete(string(id))
+		defer cancel()
+		result, err := s.call(ctx, method, params)
+		switch {
+		case ctx.Err() != nil:
+			s.fail(id, lspRequestCancelled, "request cancelled")
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", method, redactErr(err))
+			code := lspRequestFailed
+			if errorKind(err) == ErrConfig {
+				code = rpcInvalidParams
+			}
+			s.fail(id, code, redactErr(err).Error())
+		default:
+			s.reply(id, result)
+		}
+	}()
+}
+
+// editorParams are the parameters of the helix requests. The document is
+// named by uri (or path); the selection is given as text, or as a range
+// in the document.
+type editorParams struct {
+	URI         string    `json:"uri"`
+	Path        string    `json:"path"`
+	Text        string    `json:"text"`
+	Range       *lspRange `json:"range"`
+	Language    string    `json:"language"` // LSP languageId or helix language name
+	Instruction string    `json:"instruction"`
+	Provider    string    `json:"provider"`
+	Model       string    `json:"model"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+// lspPosition counts characters in UTF-16 code units, as LSP does.
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// editorDocument is what a request is about.
+type editorDocument struct {
+	uri, path string
+	content   string
+	known     bool // content is the document's: open or read from disk
+	lang      *codeLanguage
+}
+
+// document resolves p's document: the open buffer, else the file.
+func (s *editorServer) document(p editorParams) (editorDocument, error) {
+	var d editorDocument
+	switch {
+	case p.URI != "":
+		u, err := url.Parse(p.URI)
+		if err != nil || u.Scheme != "file" {
+			if err == nil {
+				s.docsMu.Lock()
+				doc, ok := s.docs[p.URI]
+				s.docsMu.Unlock()
+				if ok {
+					// An untitled buffer: only its text is known.
+					d.uri, d.content, d.known = p.URI, doc.text, true
+					return d, s.detect(&d, p.Language, doc.languageID)
+				}
+			}
+			return d, kindError(ErrConfig, "uri %q: expected a file:// URI", p.URI)
+		}
+		d.uri, d.path = p.URI, filepath.FromSlash(u.Path)
+	case p.Path != "":
+		abs, err := filepath.Abs(p.Path)
+		if err != nil {
+			return d, kindError(ErrConfig, "%v", err)
+		}
+		d.uri, d.path = (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), abs
+	default:
+		if p.Text == "" {
+			return d, kindError(ErrConfig, "uri, path or text is required")
+		}
+		return d, s.detect(&d, p.Language, "")
+	}
+	s.docsMu.Lock()
+	doc, open := s.docs[d.uri]
+	s.docsMu.Unlock()
+	if open {
+		d.content, d.known = doc.text, true
+	} else if data, err := os.ReadFile(d.path); err == nil {
+		d.content, d.known = string(data), true
+	} else if p.Text == "" {
+		return d, kindError(ErrConfig, "%v", err)
+	}
+	return d, s.detect(&d, p.Language, doc.languageID)
+}
+
+// detect sets d's language from the request, the editor's languageId or
+// the file. An unknown language is fine for explain and rewrite.
+func (s *editorServer) detect(d *editorDocument, names ...string) error {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if alias, ok := lspLanguageIDs[name]; ok {
+			name = alias
+		}
+		if l, err := languageNamed(name); err == nil {
+			d.lang = l
+			return nil
+		}
+	}
+	if d.path != "" {
+		d.lang, _ = detectLanguage(d.path, []byte(d.content))
+	}
+	return nil
+}
+
+// selection returns the text p selects: given, or cut from the document
+// by its range.
+func (d editorDocument) selection(p editorParams) (string, error) {
+	if p.Text != "" || p.Range == nil {
+		if p.Text == "" {
+			return "", kindError(ErrConfig, "text or range is required")
+		}
+		return p.Text, nil
+	}
+	if !d.known {
+		return "", kindError(ErrConfig, "range given, but the document's text is unknown")
+	}
+	start, end := lspOffset(d.content, p.Range.Start), lspOffset(d.content, p.Range.End)
+	if start > end {
+		return "", kindError(ErrConfig, "range ends before it starts")
+	}
+	return d.content[start:end], nil
+}
+
+// lspOffset is the byte offset of pos in text, clamped to it.
+func lspOffset(text string, pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		offset += i + 1
+	}
+	units := 0
+	for i, r := range text[offset:] {
+		if units >= pos.Character || r == '\n' {
+			return offset + i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(text)
+}
+
+// call runs one helix request.
+func (s *editorServer) call(ctx context.Context, method string, raw json.RawMessage) (any, error) {
+	var p editorParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, kindError(ErrConfig, "params: %v", err)
+		}
+	}
+	d, err := s.document(p)
+	if err != nil {
+		return nil, err
+	}
+	c := *s.code
+	if p.Provider != "" {
+		c.provider, c.model = p.Provider, p.Model
+	} else if p.Model != "" {
+		c.model = p.Model
+	}
+	name, fence := "source", ""
+	if d.lang != nil {
+		name, fence = d.lang.name, d.lang.fence
+	}
+	where := "the editor"
+	if d.path != "" {
+		where = filepath.Base(d.path)
+	}
+	if d.known {
+		name := d.uri
+		if d.path != "" {
+			name = filepath.ToSlash(d.path)
+		}
+		c.context = []ContextFile{{Path: name, Content: d.content}}
+	}
+
+	switch method {
+	case "helix/explain":
+		sel, err := d.selection(p)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Editor explain via %s: %s, %d bytes\n", modelChoice{c.provider, c.model}, where, len(sel))
+		out, err := s.ask(ctx, &c, d, fmt.Sprintf(editorExplainPrompt, name, where, fence, strings.TrimRight(sel, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"text": out}, nil
+
+	case "helix/rewrite":
+		if strings.TrimSpace(p.Instruction) == "" {
+			return nil, kindError(ErrConfig, "instruction is required")
+		}
+		sel, err := d.selection(p)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Editor rewrite via %s: %s: %s\n", modelChoice{c.provider, c.model}, where, truncateRunes(p.Instruction, 80))
+		out, err := s.ask(ctx, &c, d, fmt.Sprintf(editorRewritePrompt, name, where, p.Instruction, fence, strings.TrimRight(sel, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		code := extractFirstCodeBlock(out)
+		if strings.TrimSpace(code) == "" {
+			return nil, kindError(ErrEmpty, "the answer has no code")
+		}
+		// Keep the selection's trailing newline, or its absence.
+		code = strings.TrimRight(code, "\n")
+		if strings.HasSuffix(sel, "\n") {
+			code += "\n"
+		}
+		result := map[string]any{"text": code}
+		if p.Range != nil && d.uri != "" {
+			result["edit"] = map[string]any{"changes": map[string]any{d.uri: []map[string]any{{"range": p.Range, "newText": code}}}}
+		}
+		return result, nil
+
+	case "helix/generateTests":
+		if !d.known || d.path == "" {
+			return nil, kindError(ErrConfig, "uri or path of a file is required")
+		}
+		if d.lang == nil {
+			return nil, kindError(ErrConfig, "%s: can't tell the language; pass language", where)
+		}
+		c.context = nil // the file is in the prompt
+		f := codeFile{path: filepath.ToSlash(d.path), content: strings.TrimRight(d.content, "\n"), lang: d.lang}
+		dest := d.lang.testPath(f.path)
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Editor test generation via %s: %s -> %s\n", modelChoice{c.provider, c.model}, where, filepath.Base(dest))
+		code, err := c.askCode(ctx, f, dest, fmt.Sprintf(codeTestGenPrompt, d.lang.name, d.lang.framework, dest, d.lang.fence, f.path, f.content))
+		if err != nil {
+			return nil, err
+		}
+		_, statErr := os.Stat(dest)
+		return map[string]any{
+			"path":   dest,
+			"uri":    (&url.URL{Scheme: "file", Path: filepath.ToSlash(dest)}).String(),
+			"text":   code,
+			"exists": statErr == nil,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown method %s", method)
+}
+
+// ask runs prompt with the document's siblings as context when its
+// language is known.
+func (s *editorServer) ask(ctx context.Context, c *codeAssistant, d editorDocument, prompt string) (string, error) {
+	if d.lang != nil && d.path != "" {
+		return c.ask(ctx, codeFile{path: d.path, lang: d.lang}, prompt)
+	}
+	res, err := c.runner.run(ctx, TaskRequest{Task: prompt, Provider: c.provider, Model: c.model, ContextFiles: c.context})
+	for _, w := range res.Warnings {
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: %s\n", w)
+	}
+	return res.Output, err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// GeminiEmbedURL is the batch endpoint of Gemini's embedding model.
+const GeminiEmbedURL = "https://generativelanguage.googleapis.com/v1beta/models/text-embedding-004:batchEmbedContents"
+
+// defaultEmbedModel is the embedding model used when none is configured.
+func defaultEmbedModel(providerName string) string {
+	switch providerName {
+	case "", "local":
+		return "nomic-embed-text"
+	case "cloud":
+		return "text-embedding-004"
+	}
+	return "text-embedding-3-small"
+}
+
+// embed returns one vector per text from the provider's embedding API:
+// Ollama for local, Gemini for cloud, or an OpenAI-compatible adapter.
+func embed(ctx context.Context, providerName, modelName string, texts []string, key string) ([][]float32, error) {
+	if modelName == "" {
+		modelName = defaultEmbedModel(providerName)
+	}
+	if providerName == "" {
+		providerName = "local"
+	}
+	if err := checkEmbedder(ctx, providerName, modelName, key); err != nil {
+		return nil, err
+	}
+	var (
+		vecs [][]float32
+		err  error
+	)
+	switch providerName {
+	case "", "local":
+		vecs, err = embedOllama(ctx, modelName, texts)
+	case "cloud":
+		vecs, err = embedGemini(ctx, texts, key)
+	default:
+		a, ok := lookupAdapter(providerName)
+		if !ok {
+			return nil, kindError(ErrConfig, "provider %s has no embeddings API; use local, cloud or an OpenAI-compatible provider", providerName)
+		}
+		vecs, err = embedAdapter(ctx, providerName, a, modelName, texts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) != len(texts) {
+		return nil, fmt.Errorf("embedding %d texts returned %d vectors", len(texts), len(vecs))
+	}
+	return vecs, nil
+}
+
+// postEmbed posts payload and decodes the reply into out.
+func postEmbed(ctx context.Context, name, url string, headers map[string]string, payload, out interface{}) error {
+	jsonData, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("building %s embeddings request: %v", name, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return kindError(ErrUnreachable, "connecting to %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return providerError(name+" embeddings", resp, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("parsing %s embeddings response: %v", name, err)
+	}
+	return nil
+}
+
+func embedOllama(ctx context.Context, modelName string, texts []string) ([][]float32, error) {
+	var out struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	payload := map[string]interface{}{"model": modelName, "input": texts}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if err := postEmbed(ctx, "Ollama", ollamaHost()+"/api/embed", headers, payload, &out); err != nil {
+		return nil, err
+	}
+	return out.Embeddings, nil
+}
+
+func embedAdapter(ctx context.Context, name string, a OpenAICompatibleProvider, modelName string, texts []string) ([][]float32, error) {
+	headers := map[string]string{}
+	for k, v := range a.Headers {
+		headers[k] = v
+	}
+	if a.APIKeyEnv != "" {
+		key, err := lookupSecret(name, a.APIKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing API key for provider %s. Set %s or run `helix auth login --provider %s`", name, a.APIKeyEnv, name)
+		}
+		headers["Authorization"] = "Bearer " + key
+	}
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	url := strings.TrimSuffix(a.BaseURL, "/") + "/embeddings"
+	if err := postEmbed(ctx, name, url, headers, map[string]interface{}{"model": modelName, "input": texts}, &out); err != nil {
+		return nil, err
+	}
+	vecs := make([][]float32, len(out.Data))
+	for i, d := range out.Data {
+		if d.Index < 0 || d.Index >= len(vecs) {
+			return nil, fmt.Errorf("%s embeddings: index %d out of range", name, d.Index)
+		}
+		vecs[d.Index] = out.Data[i].Embedding
+	}
+	return vecs, nil
+}
+
+func embedGemini(ctx context.Context, texts []string, key string) ([][]float32, error) {
+	key, err := geminiKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var")
+	}
+	type part struct {
+		Text string `json:"text"`
+	}
+	type request struct {
+		Model   string `json:"model"`
+		Content struct {
+			Parts []part `json:"parts"`
+		} `json:"content"`
+	}
+	var payload struct {
+		Requests []request `json:"requests"`
+	}
+	for _, t := range texts {
+		r := request{Model: "models/text-embedding-004"}
+		r.Content.Parts = []part{{Text: t}}
+		payload.Requests = append(payload.Requests, r)
+	}
+	var out struct {
+		Embeddings []struct {
+			Values []float32 `json:"values"`
+		} `json:"embeddings"`
+	}
+	if err := postEmbed(ctx, "Gemini", GeminiEmbedURL+"?key="+key, nil, payload, &out); err != nil {
+		return nil, err
+	}
+	vecs := make([][]float32, len(out.Embeddings))
+	for i, e := range out.Embeddings {
+		vecs[i] = e.Values
+	}
+	return vecs, nil
+}
+
+// cosine is the cosine similarity of two vectors, 0 if their sizes differ.
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ErrorKind classifies why a task failed. It is reported as error_kind in
+// JSON results and selects the process exit status.
+type ErrorKind string
+
+const (
+	ErrConfig      ErrorKind = "config" // also bad flags and unreadable inputs
+	ErrUnreachable ErrorKind = "provider_unreachable"
+	ErrAuth        ErrorKind = "auth"
+	ErrRateLimited ErrorKind = "rate_limited"
+	ErrSafety      ErrorKind = "safety_blocked"
+	ErrEmpty       ErrorKind = "empty_response"
+	ErrTimeout     ErrorKind = "timeout"
+	ErrProvider    ErrorKind = "provider_error"    // any other API failure
+	ErrUncited     ErrorKind = "uncited"           // --require-citations and no citations
+	ErrTooLarge    ErrorKind = "request_too_large" // over a serve request limit
+	ErrCancelled   ErrorKind = "cancelled"         // by DELETE, a queue tombstone or a signal
+	ErrUnsupported ErrorKind = "unsupported"       // the provider lacks a feature the task needs
+)
+
+// exitCodes maps kinds to exit statuses; anything unclassified exits 1.
+var exitCodes = map[ErrorKind]int{
+	ErrConfig:      2,
+	ErrUnreachable: 3,
+	ErrAuth:        4,
+	ErrRateLimited: 5,
+	ErrSafety:      6,
+	ErrEmpty:       7,
+	ErrTimeout:     8,
+	ErrProvider:    9,
+	ErrUncited:     10,
+	ErrTooLarge:    11,
+	ErrCancelled:   12,
+	ErrUnsupported: 13,
+}
+
+// TaskError is an error with a known kind. RetryAfter is how long a
+// provider that rate-limited the call asked to be left alone, when it said.
+type TaskError struct {
+	Kind       ErrorKind
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *TaskError) Error() string { return e.Err.Error() }
+func (e *TaskError) Unwrap() error { return e.Err }
+
+// kindError formats an error of the given kind; %w verbs keep the cause.
+func kindError(kind ErrorKind, format string, args ...any) error {
+	return &TaskError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// statusKind classifies a provider's HTTP error status.
+func statusKind(code int) ErrorKind {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAuth
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrTimeout
+	}
+	return ErrProvider
+}
+
+// errorKind returns err's kind, or "" if it is unclassified. A deadline
+// anywhere in the chain counts as a timeout and a cancellation as
+// cancelled, whatever it interrupted.
+func errorKind(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrCancelled
+	}
+	var te *TaskError
+	if errors.As(err, &te) {
+		return te.Kind
+	}
+	return ""
+}
+
+func exitCode(err error) int {
+	if code, ok := exitCodes[errorKind(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// fatal prints err and exits with the status for its kind.
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(exitCode(err))
+}
+
+// cancelledCall is the error of a provider call cut off because ctx was
+// cancelled, or nil if it wasn't, so that an abort isn't taken for the
+// provider being down.
+func cancelledCall(ctx context.Context, name string) error {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return nil
+	}
+	return fmt.Errorf("%s call cancelled: %w", name, context.Canceled)
+}
+
+// configError marks err as a configuration or usage problem.
+func configError(err error) error {
+	if err == nil || errorKind(err) != "" {
+		return err
+	}
+	return &TaskError{Kind: ErrConfig, Err: err}
+}
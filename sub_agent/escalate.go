@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// escalateConfig retries a direct answer that fails validation on the next
+// model of a chain, usually from local up to cloud: the cheap model
+// answers what it can and the strong one only what it can't. An empty
+// chain disables it.
+type escalateConfig struct {
+	chain    string  // provider/model choices, tried in order after the task's own
+	minScore float64 // judge score an answer needs; 0 skips judging
+	judge    string  // provider/model of the judge; "" uses judge.model or the answering model
+}
+
+// Escalation is the path a task took up the --escalate chain.
+type Escalation struct {
+	Path []EscalationStep `json:"path"`
+}
+
+// EscalationStep is one model's attempt.
+type EscalationStep struct {
+	Model  string  `json:"model"`
+	Passed bool    `json:"passed"`
+	Reason string  `json:"reason,omitempty"` // why it failed validation
+	Score  float64 `json:"score,omitempty"`  // the judge's, when judged
+}
+
+// escalateFor is req's escalation settings, or else the runner's.
+func (r *runner) escalateFor(req TaskRequest) escalateConfig {
+	cfg := r.escalate
+	if req.Escalate != "" {
+		cfg.chain = req.Escalate
+	}
+	if req.EscalateMinScore > 0 {
+		cfg.minScore = req.EscalateMinScore
+	}
+	return cfg
+}
+
+// answerEscalating answers on the task's model and then on each model of
+// the chain in turn until an answer passes validation. A chain model the
+// task may not use, as run would refuse it, is skipped with a warning.
+// When no answer passes, the last one is kept with a warning. It returns
+// the model that answered.
+func (r *runner) answerEscalating(ctx context.Context, req TaskRequest, prompt string, res *TaskResult) (string, modelChoice, error) {
+	cfg := r.escalateFor(req)
+	chain, err := parseModelChoices(cfg.chain)
+	if err != nil {
+		return "", modelChoice{}, kindError(ErrConfig, "invalid --escalate: %v", err)
+	}
+	models := []modelChoice{{req.Provider, req.Model}}
+	for _, c := range chain {
+		p, m := withDefaults(c.provider, c.model, req)
+		models = append(models, modelChoice{p, m})
+	}
+	esc := &Escalation{}
+	res.Escalation = esc
+	var answer, reason string
+	var answered modelChoice
+	for i, c := range models {
+		sreq := req
+		sreq.Provider, sreq.Model = c.provider, c.model
+		if i > 0 {
+			if err := r.checkModel(ctx, sreq); err != nil {
+				res.Warnings = append(res.Warnings, fmt.Sprintf("skipped %s of the --escalate chain: %v", c, err))
+				continue
+			}
+		}
+		step := EscalationStep{Model: c.String()}
+		out, err := r.answer(ctx, sreq, prompt, res)
+		switch {
+		case err != nil && errorKind(err) != ErrEmpty:
+			return "", c, err
+		case err != nil:
+			step.Reason = "empty answer"
+		default:
+			answer, answered = out, c
+			step.Passed, step.Reason, step.Score = r.validateAnswer(ctx, sreq, c, out, cfg)
+			reason = step.Reason
+		}
+		esc.Path = append(esc.Path, step)
+		if step.Passed || res.Truncated {
+			return answer, c, nil
+		}
+		if i+1 < len(models) {
+			logf(ctx, "Answer from %s failed validation (%s); escalating to %s", c, step.Reason, models[i+1])
+		}
+	}
+	if answer == "" {
+		return "", models[0], kindError(ErrEmpty, "no model of the --escalate chain gave an answer")
+	}
+	res.Warnings = append(res.Warnings, fmt.Sprintf("every model of the --escalate chain failed validation; kept the answer of %s (%s)", answered, reason))
+	return answer, answered, nil
+}
+
+// validateAnswer checks an answer of c: passing the --speculate heuristics
+// (not empty, refusing or degenerate), matching the task's format, and
+// scored at least cfg.minScore by the judge.
+func (r *runner) validateAnswer(ctx context.Context, req TaskRequest, c modelChoice, answer string, cfg escalateConfig) (bool, string, float64) {
+	if ok, why := heuristicGate(req.Task, answer); !ok {
+		return false, why, 0
+	}
+	if err := checkFormat(r.answerFormat(req), answer); err != nil {
+		return false, err.Error(), 0
+	}
+	if cfg.minScore <= 0 {
+		return true, "", 0
+	}
+	j, err := newJudge(cfg.judge, c.provider, c.model, r.key)
+	if err != nil {
+		return false, fmt.Sprintf("invalid --escalate-judge: %v", err), 0
+	}
+	jm, err := j.score(ctx, req.Task, answer, "", nil)
+	if err != nil {
+		return false, err.Error(), 0
+	}
+	if jm.Overall < cfg.minScore {
+		return false, fmt.Sprintf("judge scored it %.1f, below %.1f", jm.Overall, cfg.minScore), jm.Overall
+	}
+	return true, "", jm.Overall
+}
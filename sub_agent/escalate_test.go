@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"helix-agent-go/internal/golden"
+)
+
+func TestAnswerEscalatingSkipsDisallowedModels(t *testing.T) {
+	m := golden.NewScript(golden.Transcript{Replies: []golden.Reply{{Text: "I'm sorry, I can't help."}, {Text: "Paris."}}})
+	ctx := context.WithValue(context.Background(), mockKey{}, m)
+	r := &runner{}
+	req := TaskRequest{
+		Task: "What is the capital of France?", Provider: "mock", Model: "small",
+		Escalate: "mock/blocked,mock/large",
+		allow: func(_, model string) error {
+			if model == "blocked" {
+				return errors.New("model blocked is not allowed")
+			}
+			return nil
+		},
+	}
+	var res TaskResult
+	out, c, err := r.answerEscalating(ctx, req, req.Task, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Paris." || c.model != "large" {
+		t.Errorf("answer %q from %s, want Paris. from mock/large", out, c)
+	}
+	if m.Calls() != 2 {
+		t.Errorf("%d provider calls, want 2", m.Calls())
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "skipped mock/blocked") {
+		t.Errorf("warnings %q, want one about skipping mock/blocked", res.Warnings)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Event types of a streamed run.
+const (
+	EventText       = "text"        // more of the answer
+	EventToolCall   = "tool_call"   // a tool is about to run
+	EventToolResult = "tool_result" // it finished
+	EventResult     = "result"      // the run is over; the last event
+)
+
+// maxEventOutput bounds a tool_result's output; the result has it all.
+const maxEventOutput = 2000
+
+// TaskEvent is something that happened during a run, streamed to the
+// caller with --stream or as server-sent events, so that a UI can show the
+// answer arriving and what the agent is doing before it does.
+type TaskEvent struct {
+	Type       string          `json:"type"`
+	Text       string          `json:"text,omitempty"`    // text: the new part of the answer
+	Step       int             `json:"step,omitempty"`    // tool events: the tool step, from 1
+	Tool       string          `json:"tool,omitempty"`    // tool events
+	Summary    string          `json:"summary,omitempty"` // tool_call: what it does, e.g. "Running sh code"
+	Input      json.RawMessage `json:"input,omitempty"`   // tool_call
+	Output     string          `json:"output,omitempty"`  // tool_result, cut to maxEventOutput
+	Error      string          `json:"error,omitempty"`   // tool_result
+	DurationMS int64           `json:"duration_ms,omitempty"`
+	Result     *TaskResult     `json:"result,omitempty"` // result
+}
+
+// eventSink receives a run's events. It is called from the run's
+// goroutines one at a time.
+type eventSink func(TaskEvent)
+
+type eventSinkKey struct{}
+
+// withEvents has the run under ctx report its events to sink.
+func withEvents(ctx context.Context, sink eventSink) context.Context {
+	var mu sync.Mutex
+	return context.WithValue(ctx, eventSinkKey{}, eventSink(func(e TaskEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		sink(e)
+	}))
+}
+
+// emitEvent sends e to the run's sink, if it has one.
+func emitEvent(ctx context.Context, e TaskEvent) {
+	if sink, _ := ctx.Value(eventSinkKey{}).(eventSink); sink != nil {
+		sink(e)
+	}
+}
+
+func streamingEvents(ctx context.Context) bool {
+	return ctx.Value(eventSinkKey{}) != nil
+}
+
+// answerStreamer turns the cumulative text of a streaming call into text
+// events carrying only what is new, holding back thinking.
+func answerStreamer(ctx context.Context) func(text string) {
+	sent := 0
+	return func(text string) {
+		_, answer := splitThinking(text)
+		if strings.HasPrefix(answer, "<think>") || len(answer) <= sent {
+			return
+		}
+		emitEvent(ctx, TaskEvent{Type: EventText, Text: answer[sent:]})
+		sent = len(answer)
+	}
+}
+
+// toolDescriber is implemented by tools that can say in words what a
+// call will do.
+type toolDescriber interface {
+	describe(input json.RawMessage) string
+}
+
+// describeToolCall is a one-line summary of a tool call for progress
+// displays.
+func describeToolCall(t tool, name string, input json.RawMessage) string {
+	if d, ok := t.(toolDescriber); ok {
+		if s := d.describe(input); s != "" {
+			return s
+		}
+	}
+	return fmt.Sprintf("Calling %s %s", name, truncateRunes(string(input), 80))
+}
+
+// toolCallEvent and toolResultEvent report one tool step.
+func toolCallEvent(step int, t tool, call ToolCall) TaskEvent {
+	return TaskEvent{Type: EventToolCall, Step: step, Tool: call.Tool, Summary: describeToolCall(t, call.Tool, call.Input), Input: call.Input}
+}
+
+func toolResultEvent(step int, call ToolCall) TaskEvent {
+	return TaskEvent{Type: EventToolResult, Step: step, Tool: call.Tool, Output: truncateRunes(call.Output, maxEventOutput), Error: call.Error, DurationMS: call.DurationMS}
+}
+
+// sseWriter writes events as server-sent events named by their type.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f, _ := w.(http.Flusher)
+	return &sseWriter{w: w, flusher: f}
+}
+
+// send writes one event with v as its JSON data.
+func (s *sseWriter) send(event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
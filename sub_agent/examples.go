@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExamplesConfig is the few-shot library --examples draws on: sets in the
+// config, and files in Dir (default ~/.config/helix/examples), either
+// <name>.json holding an ExampleSet or <name>.jsonl with one Example per
+// line. A file replaces a config set of the same name.
+type ExamplesConfig struct {
+	Dir  string                `json:"dir,omitempty"`
+	Sets map[string]ExampleSet `json:"sets,omitempty"`
+}
+
+// ExampleSet is the curated exemplars of one kind of task.
+type ExampleSet struct {
+	Description string    `json:"description,omitempty"`
+	Examples    []Example `json:"examples"`
+}
+
+// Example is an input and the output expected for it.
+type Example struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+func examplesDir() string {
+	if d := config.Examples.Dir; d != "" {
+		return d
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "helix", "examples")
+}
+
+// lookupExamples loads the named set from the examples directory or the
+// config.
+func lookupExamples(name string) (ExampleSet, error) {
+	if !namespaceRe.MatchString(name) {
+		return ExampleSet{}, fmt.Errorf("invalid example set name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	if dir := examplesDir(); dir != "" {
+		if data, err := os.ReadFile(filepath.Join(dir, name+".json")); err == nil {
+			var set ExampleSet
+			if err := json.Unmarshal(data, &set); err != nil {
+				return ExampleSet{}, fmt.Errorf("example set %s: %v", name, err)
+			}
+			return set, nil
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, name+".jsonl")); err == nil {
+			return parseExampleLines(name, data)
+		}
+	}
+	if set, ok := config.Examples.Sets[name]; ok {
+		return set, nil
+	}
+	names := exampleSetNames()
+	if len(names) == 0 {
+		return ExampleSet{}, fmt.Errorf("unknown example set %q: none are defined (add them to %s or examples.sets in the config)", name, examplesDir())
+	}
+	return ExampleSet{}, fmt.Errorf("unknown example set %q: expected one of %s", name, strings.Join(names, ", "))
+}
+
+func parseExampleLines(name string, data []byte) (ExampleSet, error) {
+	var set ExampleSet
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var e Example
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return ExampleSet{}, fmt.Errorf("example set %s, line %d: %v", name, n, err)
+		}
+		set.Examples = append(set.Examples, e)
+	}
+	return set, sc.Err()
+}
+
+// exampleSetNames lists the sets of the directory and the config, sorted.
+func exampleSetNames() []string {
+	seen := map[string]bool{}
+	for n := range config.Examples.Sets {
+		seen[n] = true
+	}
+	if dir := examplesDir(); dir != "" {
+		for _, ext := range []string{".json", ".jsonl"} {
+			paths, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+			for _, p := range paths {
+				seen[strings.TrimSuffix(filepath.Base(p), ext)] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exampleBlock renders the exemplars of the comma-separated sets, which go
+// just before the task, and returns how many there are.
+func exampleBlock(spec string) (string, int, error) {
+	var b strings.Builder
+	n := 0
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		set, err := lookupExamples(name)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, e := range set.Examples {
+			fmt.Fprintf(&b, "<example>\nInput:\n%s\n\nOutput:\n%s\n</example>\n\n", strings.TrimSpace(e.Input), strings.TrimSpace(e.Output))
+			n++
+		}
+	}
+	if n == 0 {
+		return "", 0, nil
+	}
+	return "Examples of inputs and the outputs expected for them; answer in the same way:\n\n" + strings.TrimSuffix(b.String(), "\n\n"), n, nil
+}
+
+// examplesListCommand implements `examples list`.
+func examplesListCommand(fs *flag.FlagSet) func(args []string) {
+	return func([]string) {
+		names := exampleSetNames()
+		if len(names) == 0 {
+			fmt.Printf("No example sets; add <name>.json or <name>.jsonl files to %s.\n", examplesDir())
+			return
+		}
+		for _, name := range names {
+			set, err := lookupExamples(name)
+			if err != nil {
+				fatal(configError(err))
+			}
+			fmt.Printf("%-24s %3d example(s)  %s\n", name, len(set.Examples), set.Description)
+		}
+	}
+}
+
+// examplesFor is req's example sets, or else the runner's.
+func (r *runner) examplesFor(req TaskRequest) string {
+	if req.Examples != "" {
+		return req.Examples
+	}
+	return r.examples
+}
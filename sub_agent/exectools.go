@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ExecToolConfig declares a tool backed by a local executable:
+//
+//	"exec": {"search": {"description": "Search the repo", "command": "rg",
+//	  "args": ["-n", "{pattern}", "{path}"],
+//	  "input_schema": {"type": "object", "properties": {"pattern": {"type": "string"},
+//	    "path": {"type": "string"}}, "required": ["pattern"]}}}
+//
+// Each {field} in args is replaced by that input field; an argument that is
+// only a placeholder for a missing field is dropped. Arguments are passed
+// directly, never through a shell. The command runs in --workspace.
+type ExecToolConfig struct {
+	Description string          `json:"description"`
+	Command     string          `json:"command"`
+	Args        []string        `json:"args,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+	Timeout     string          `json:"timeout,omitempty"` // default 30s
+	// Stdin also sends the whole input as JSON on standard input.
+	Stdin bool `json:"stdin,omitempty"`
+}
+
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type execTool struct {
+	name      string
+	cfg       ExecToolConfig
+	timeout   time.Duration
+	required  []string
+	workspace string
+}
+
+func newExecTool(name string, c ExecToolConfig, workspace string) (tool, error) {
+	if c.Command == "" {
+		return nil, fmt.Errorf("no command configured")
+	}
+	t := &execTool{name: name, cfg: c, timeout: 30 * time.Second, workspace: workspace}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+		}
+		t.timeout = d
+	}
+	if len(c.InputSchema) == 0 {
+		t.cfg.InputSchema = json.RawMessage(`{"type":"object"}`)
+	} else {
+		var schema struct {
+			Required []string `json:"required"`
+		}
+		if err := json.Unmarshal(c.InputSchema, &schema); err != nil {
+			return nil, fmt.Errorf("input_schema: %v", err)
+		}
+		t.required = schema.Required
+	}
+	if _, err := exec.LookPath(c.Command); err != nil {
+		return nil, fmt.Errorf("%s not found", c.Command)
+	}
+	return t, nil
+}
+
+func (t *execTool) spec() toolSpec {
+	return toolSpec{Name: t.name, Description: t.cfg.Description, InputSchema: t.cfg.InputSchema}
+}
+
+// program is the executable the tool runs, for its version in a manifest.
+func (t *execTool) program() string {
+	p, _ := exec.LookPath(t.cfg.Command)
+	return p
+}
+
+func (t *execTool) describe(input json.RawMessage) string {
+	fields := map[string]json.RawMessage{}
+	if len(input) > 0 && string(input) != "null" && json.Unmarshal(input, &fields) != nil {
+		return ""
+	}
+	args, err := expandArgs(t.cfg.Args, fields)
+	if err != nil {
+		return ""
+	}
+	return "Running " + truncateRunes(strings.Join(append([]string{t.cfg.Command}, args...), " "), 80)
+}
+
+func (t *execTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	fields := map[string]json.RawMessage{}
+	if len(input) > 0 && string(input) != "null" {
+		if err := json.Unmarshal(input, &fields); err != nil {
+			return "", fmt.Errorf("invalid input: expected a JSON object: %v", err)
+		}
+	}
+	for _, r := range t.required {
+		if _, ok := fields[r]; !ok {
+			return "", fmt.Errorf("missing required input %q", r)
+		}
+	}
+	args, err := expandArgs(t.cfg.Args, fields)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.cfg.Command, args...)
+	cmd.Dir = t.workspace
+	cmd.Env = toolProcessEnv(ctx)
+	if t.cfg.Stdin {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	stdout, stderr := &cappedBuffer{max: maxToolOutput}, &cappedBuffer{max: maxToolOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("timed out after %s", t.timeout)
+		}
+		return "", fmt.Errorf("%v\nstdout:\n%s\nstderr:\n%s", err, stdout, stderr)
+	}
+	return toolOutput(stdout.String())
+}
+
+// expandArgs fills {field} placeholders from the input. Strings are
+// inserted as is, other values as JSON.
+func expandArgs(tmpl []string, fields map[string]json.RawMessage) ([]string, error) {
+	value := func(name string) (string, bool) {
+		raw, ok := fields[name]
+		if !ok || string(raw) == "null" {
+			return "", false
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s, true
+		}
+		return string(raw), true
+	}
+	var args []string
+	for _, a := range tmpl {
+		if m := placeholderRe.FindStringSubmatch(a); m != nil && m[0] == a {
+			if v, ok := value(m[1]); ok {
+				args = append(args, v)
+			}
+			continue
+		}
+		var missing string
+		expanded := placeholderRe.ReplaceAllStringFunc(a, func(p string) string {
+			v, ok := value(strings.Trim(p, "{}"))
+			if !ok && missing == "" {
+				missing = p
+			}
+			return v
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("argument %q needs input %s", a, missing)
+		}
+		args = append(args, expanded)
+	}
+	return args, nil
+}
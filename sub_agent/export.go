@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats for `helix export`.
+const (
+	ExportCSV    = "csv"
+	ExportJSONL  = "jsonl"  // one {"id", "name", "config", "summary"} per run, as W&B takes them
+	ExportMLflow = "mlflow" // an MLflow file store directory, as mlflow ui --backend-store-uri reads
+)
+
+// ExperimentRun is a recorded run as experiment trackers see it: the
+// settings it ran with and the numbers it produced.
+type ExperimentRun struct {
+	ID      string             `json:"id"`
+	Name    string             `json:"name"`
+	Time    time.Time          `json:"time"`
+	Status  string             `json:"status"` // finished or failed
+	Params  map[string]string  `json:"config"`
+	Metrics map[string]float64 `json:"summary"`
+	Tags    map[string]string  `json:"tags,omitempty"`
+}
+
+// metricNameRe matches what can't be in a metric name, which MLflow keeps
+// as a file name.
+var metricNameRe = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// promptVersion identifies a prompt by content, so that runs of the same
+// prompt group together whatever they were called.
+func promptVersion(task string) string {
+	sum := sha256.Sum256([]byte(task))
+	return hex.EncodeToString(sum[:6])
+}
+
+func experimentRun(e *HistoryEntry) ExperimentRun {
+	req, res := e.Request, e.Result
+	x := ExperimentRun{
+		ID:     e.ID,
+		Name:   fmt.Sprintf("%s %s", modelChoice{res.Provider, res.Model}, e.ID),
+		Time:   e.Time,
+		Status: "finished",
+		Params: map[string]string{
+			"prompt_version": promptVersion(req.Task),
+			"provider":       res.Provider,
+			"model":          res.Model,
+			"seed":           strconv.FormatInt(req.Seed, 10),
+		},
+		Metrics: map[string]float64{"latency_ms": float64(e.DurationMS)},
+		Tags:    req.Tags,
+	}
+	if res.Error != "" {
+		x.Status = "failed"
+		x.Params["error_kind"] = string(res.ErrorKind)
+	}
+	set := func(name, v string) {
+		if v != "" && v != "0" && v != "false" {
+			x.Params[name] = v
+		}
+	}
+	set("route", req.Route)
+	set("candidates", strconv.Itoa(req.Candidates))
+	set("select", req.Select)
+	set("format", string(req.Format))
+	set("think_budget", strconv.Itoa(req.ThinkBudget))
+	set("reasoning_effort", req.ReasoningEffort)
+	set("lang", req.Lang)
+	set("style", req.Style)
+	set("debate", strconv.Itoa(req.Debate))
+	set("plan", strconv.FormatBool(req.Plan))
+	set("verify_rounds", strconv.Itoa(req.VerifyRounds))
+	set("speculate", strconv.FormatBool(req.Speculate))
+	set("ground", strconv.FormatBool(req.Ground))
+	set("tools", strings.Join(e.Tools, ","))
+	set("replay_of", e.ReplayOf)
+	if u := res.Usage; u != nil {
+		x.Metrics["calls"] = float64(u.Calls)
+		x.Metrics["prompt_tokens"] = float64(u.PromptTokens)
+		x.Metrics["output_tokens"] = float64(u.OutputTokens)
+		x.Metrics["thinking_tokens"] = float64(u.ThinkingTokens)
+		if l := u.Local; l != nil {
+			x.Metrics["tokens_per_sec"] = l.TokensPerSec
+			x.Metrics["load_ms"] = float64(l.LoadMS)
+		}
+		if info, ok := lookupModel(res.Provider, res.Model); ok {
+			x.Metrics["cost_usd"] = estimateCost(info, u.PromptTokens, u.OutputTokens+u.ThinkingTokens)
+		}
+	}
+	if jm := e.Judgement; jm != nil {
+		x.Params["judge"] = jm.Judge
+		x.Metrics["score_overall"] = jm.Overall
+		for _, s := range jm.Scores {
+			x.Metrics["score_"+metricNameRe.ReplaceAllString(strings.ToLower(s.Name), "_")] = s.Score
+		}
+	}
+	return x
+}
+
+// writeExperimentCSV writes one row per run; params and metrics become
+// columns of their own, empty where a run has none.
+func writeExperimentCSV(w io.Writer, runs []ExperimentRun) error {
+	var params, metrics []string
+	seenP, seenM := map[string]bool{}, map[string]bool{}
+	for _, x := range runs {
+		for k := range x.Params {
+			if !seenP[k] {
+				seenP[k] = true
+				params = append(params, k)
+			}
+		}
+		for k := range x.Metrics {
+			if !seenM[k] {
+				seenM[k] = true
+				metrics = append(metrics, k)
+			}
+		}
+	}
+	sort.Strings(params)
+	sort.Strings(metrics)
+	cw := csv.NewWriter(w)
+	header := []string{"run_id", "time", "status"}
+	header = append(header, params...)
+	header = append(header, metrics...)
+	cw.Write(header)
+	for _, x := range runs {
+		row := []string{x.ID, x.Time.Format(time.RFC3339), x.Status}
+		for _, k := range params {
+			row = append(row, x.Params[k])
+		}
+		for _, k := range metrics {
+			v, ok := x.Metrics[k]
+			if !ok {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeMLflow lays runs out as an MLflow file store: an experiment
+// directory holding one directory per run with its meta.yaml, params,
+// metrics and tags. Existing runs of the experiment are overwritten.
+func writeMLflow(root, experiment string, runs []ExperimentRun) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	// The file store wants numeric experiment IDs; derive a stable one
+	// from the name so that repeated exports land in the same experiment.
+	h := fnv.New32a()
+	h.Write([]byte(experiment))
+	expID := strconv.FormatUint(uint64(h.Sum32()), 10)
+	expDir := filepath.Join(abs, expID)
+	if err := os.MkdirAll(expDir, 0o755); err != nil {
+		return err
+	}
+	meta := fmt.Sprintf("artifact_location: file://%s\nexperiment_id: '%s'\nlifecycle_stage: active\nname: %s\n", expDir, expID, yamlString(experiment))
+	if err := os.WriteFile(filepath.Join(expDir, "meta.yaml"), []byte(meta), 0o644); err != nil {
+		return err
+	}
+	userName := "helix"
+	if u, err := user.Current(); err == nil {
+		userName = u.Username
+	}
+	for _, x := range runs {
+		dir := filepath.Join(expDir, x.ID)
+		for _, sub := range []string{"params", "metrics", "tags", "artifacts"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+				return err
+			}
+		}
+		start := x.Time.UnixMilli()
+		end := start + int64(x.Metrics["latency_ms"])
+		status := 3 // FINISHED
+		if x.Status == "failed" {
+			status = 4
+		}
+		meta := fmt.Sprintf("artifact_uri: file://%s\nend_time: %d\nentry_point_name: ''\nexperiment_id: '%s'\nlifecycle_stage: active\nrun_id: %s\nrun_name: %s\nrun_uuid: %s\nsource_name: ''\nsource_type: 4\nsource_version: ''\nstart_time: %d\nstatus: %d\ntags: []\nuser_id: %s\n",
+			filepath.Join(dir, "artifacts"), end, expID, x.ID, yamlString(x.Name), x.ID, start, status, yamlString(userName))
+		files := map[string]string{"meta.yaml": meta, filepath.Join("tags", "mlflow.runName"): x.Name}
+		for k, v := range x.Params {
+			files[filepath.Join("params", k)] = v
+		}
+		for k, v := range x.Metrics {
+			files[filepath.Join("metrics", k)] = fmt.Sprintf("%d %s 0\n", end, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		for k, v := range x.Tags {
+			files[filepath.Join("tags", k)] = v
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlString quotes s as a YAML scalar.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// exportCommand implements `export`: write recorded runs, with their judge
+// scores, in a format experiment trackers import.
+func exportCommand(fs *flag.FlagSet) func(args []string) {
+	format := fs.String("format", ExportCSV, "Output format: 'csv', 'jsonl' (W&B-style config and summary per run) or 'mlflow' (an MLflow file store directory)")
+	out := fs.String("out", "", "File to write, or the MLflow store directory (default stdout, or ./mlruns for mlflow)")
+	experiment := fs.String("experiment", "helix", "Experiment name for mlflow")
+	tagFilter := tagFlag{}
+	fs.Var(tagFilter, "tag", "Only export runs with this key=value tag (repeatable)")
+	return func(args []string) {
+		switch *format {
+		case ExportCSV, ExportJSONL, ExportMLflow:
+		default:
+			fatal(kindError(ErrConfig, "invalid --format %q: expected csv, jsonl or mlflow", *format))
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		entries, err := selectEntries(store, args, tagFilter)
+		if err != nil {
+			fatal(err)
+		}
+		var runs []ExperimentRun
+		for _, e := range entries {
+			runs = append(runs, experimentRun(e))
+		}
+
+		if *format == ExportMLflow {
+			dir := *out
+			if dir == "" {
+				dir = "mlruns"
+			}
+			if err := writeMLflow(dir, *experiment, runs); err != nil {
+				fatal(fmt.Errorf("writing the MLflow store: %v", err))
+			}
+			statusf("[Sub-Agent] Exported %d run(s) to experiment %q in %s\n", len(runs), *experiment, dir)
+			return
+		}
+		w := io.Writer(os.Stdout)
+		if *out != "" && *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				fatal(configError(err))
+			}
+			defer f.Close()
+			w = f
+		}
+		if *format == ExportCSV {
+			err = writeExperimentCSV(w, runs)
+		} else {
+			enc := json.NewEncoder(w)
+			for _, x := range runs {
+				if err = enc.Encode(x); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if *out != "" && *out != "-" {
+			statusf("[Sub-Agent] Exported %d run(s) to %s\n", len(runs), *out)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FileChange is one entry of the --extract-files manifest.
+type FileChange struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // created, updated or unchanged
+	Bytes  int    `json:"bytes"`
+}
+
+// extractedFile is a fenced block that named its destination.
+type extractedFile struct {
+	path    string
+	content string
+}
+
+var (
+	// filename=main.go, file="cmd/x.go", path=a.py, title=README.md
+	fenceAttrRe = regexp.MustCompile(`(?:filename|file|path|title)=["']?([^"'\s]+)`)
+	// A line above the fence that is just a path, optionally decorated:
+	// `main.go`, **main.go**, ### main.go, File: main.go
+	headingPathRe = regexp.MustCompile("^(?:#+\\s*)?(?:[Ff]ile(?:name)?:\\s*)?[*`_]*([\\w./-]+\\.[\\w]+)[*`_:]*$")
+)
+
+// parseFileBlocks finds fenced code blocks that carry a filename, either in
+// the fence info string or on the line right above the fence.
+func parseFileBlocks(text string) []extractedFile {
+	var files []extractedFile
+	lines := strings.Split(text, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		fence := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(fence, "```") {
+			continue
+		}
+		name := fenceFilename(strings.TrimPrefix(fence, "```"))
+		if name == "" && i > 0 {
+			if m := headingPathRe.FindStringSubmatch(strings.TrimSpace(lines[i-1])); m != nil {
+				name = m[1]
+			}
+		}
+
+		var body []string
+		j := i + 1
+		for ; j < len(lines); j++ {
+			if strings.HasPrefix(strings.TrimSpace(lines[j]), "```") {
+				break
+			}
+			body = append(body, lines[j])
+		}
+		i = j
+		if name != "" {
+			files = append(files, extractedFile{path: name, content: strings.Join(body, "\n") + "\n"})
+		}
+	}
+	return files
+}
+
+// fenceFilename pulls a filename out of a fence info string such as
+// "go filename=main.go" or "main.go".
+func fenceFilename(info string) string {
+	if m := fenceAttrRe.FindStringSubmatch(info); m != nil {
+		return m[1]
+	}
+	for _, tok := range strings.Fields(info) {
+		if strings.ContainsAny(tok, "./") && !strings.Contains(tok, "=") {
+			return tok
+		}
+	}
+	return ""
+}
+
+// workspaceRel validates a model-supplied path and returns it relative to
+// the workspace; absolute paths and paths that escape it are refused, as
+// are paths in .git or .helix, where a written hook or undo bundle would
+// run or restore whatever the model liked.
+func workspaceRel(p string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(p))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to write %q outside the workspace", p)
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.EqualFold(part, ".git") || strings.EqualFold(part, ".helix") {
+			return "", fmt.Errorf("refusing to write %q inside %s", p, part)
+		}
+	}
+	return rel, nil
+}
+
+// writeExtractedFiles writes each block under workspace and returns the
+// manifest. All paths are validated up front so a block that is absolute or
+// escapes the workspace aborts the extraction before anything is written.
+// The previous contents are kept in an undo bundle labelled with task.
+func writeExtractedFiles(workspace, task string, files []extractedFile, prov *Provenance, provMode string) ([]FileChange, error) {
+	root, err := filepath.Abs(workspace)
+	if err != nil {
+		return nil, fmt.Errorf("resolving workspace: %v", err)
+	}
+
+	rels := make([]string, len(files))
+	var changing []string
+	for i, f := range files {
+		rel, err := workspaceRel(f.path)
+		if err != nil {
+			return nil, err
+		}
+		rels[i] = rel
+		if existing, err := os.ReadFile(filepath.Join(root, rel)); err != nil || stripProvenance(string(existing)) != f.content {
+			changing = append(changing, rel)
+			if prov != nil && usesSidecar(provMode, rel) {
+				changing = append(changing, rel+provenanceSidecarExt)
+			}
+		}
+	}
+	if err := saveUndo(root, task, changing); err != nil {
+		return nil, err
+	}
+
+	var manifest []FileChange
+	for i, f := range files {
+		rel := rels[i]
+		dest := filepath.Join(root, rel)
+
+		action := "created"
+		if existing, err := os.ReadFile(dest); err == nil {
+			action = "updated"
+			if stripProvenance(string(existing)) == f.content {
+				action = "unchanged"
+			}
+		}
+		if action != "unchanged" {
+			if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+				return manifest, fmt.Errorf("creating directory for %s: %v", rel, err)
+			}
+			content, err := prov.mark(provMode, dest, f.content)
+			if err != nil {
+				return manifest, err
+			}
+			if err := writeFileAtomic(dest, []byte(content)); err != nil {
+				return manifest, fmt.Errorf("writing %s: %v", rel, err)
+			}
+		}
+		manifest = append(manifest, FileChange{Path: filepath.ToSlash(rel), Action: action, Bytes: len(f.content)})
+	}
+	return manifest, nil
+}
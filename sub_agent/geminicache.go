@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// GeminiCache is a Gemini cachedContents resource: context uploaded once
+// and then referenced by tasks run with --gemini-cache, which are billed
+// for those tokens at the cached rate.
+type GeminiCache struct {
+	Name          string    `json:"name"` // cachedContents/..., or a Vertex resource path
+	DisplayName   string    `json:"displayName,omitempty"`
+	Model         string    `json:"model"`
+	CreateTime    time.Time `json:"createTime"`
+	ExpireTime    time.Time `json:"expireTime"`
+	UsageMetadata struct {
+		TotalTokenCount int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// geminiCacheAPI addresses the cachedContents API of the Gemini API or,
+// with gemini.vertex, of Vertex AI.
+type geminiCacheAPI struct {
+	root   string // cache names are relative to it
+	parent string // the collection's parent, "" on the Gemini API
+	model  string // the model resource caches are made for
+	key    string
+	bearer string
+}
+
+// geminiAPIModel is the model GeminiBaseURL calls; a cache only serves the
+// model it was created for.
+func geminiAPIModel() string {
+	return strings.TrimSuffix(GeminiBaseURL[strings.LastIndex(GeminiBaseURL, "/")+1:], ":generateContent")
+}
+
+func newGeminiCacheAPI(ctx context.Context, key, modelName string) (geminiCacheAPI, error) {
+	gc := geminiConfig()
+	if gc.Vertex {
+		tok, project, err := gcpTokens.get(ctx)
+		if err != nil {
+			return geminiCacheAPI{}, err
+		}
+		if gc.Project != "" {
+			project = gc.Project
+		}
+		if project == "" {
+			return geminiCacheAPI{}, kindError(ErrConfig, "missing GCP project for Vertex AI. Set GOOGLE_CLOUD_PROJECT or gemini.project in the config")
+		}
+		if modelName == "" {
+			modelName = geminiModel
+		}
+		host := gc.Location + "-aiplatform.googleapis.com"
+		if gc.Location == "global" {
+			host = "aiplatform.googleapis.com"
+		}
+		parent := fmt.Sprintf("projects/%s/locations/%s/", project, gc.Location)
+		return geminiCacheAPI{root: "https://" + host + "/v1/", parent: parent, model: parent + "publishers/google/models/" + modelName, bearer: tok}, nil
+	}
+	key, err := geminiKey(key)
+	if err != nil {
+		return geminiCacheAPI{}, err
+	}
+	if key == "" {
+		return geminiCacheAPI{}, kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var, or GOOGLE_GENAI_USE_VERTEXAI=true to use Vertex AI")
+	}
+	return geminiCacheAPI{root: "https://generativelanguage.googleapis.com/v1beta/", model: "models/" + geminiAPIModel(), key: key}, nil
+}
+
+func (a geminiCacheAPI) do(ctx context.Context, method, u string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, _ := json.Marshal(in)
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return fmt.Errorf("building cache request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.key != "" {
+		req.Header.Set("x-goog-api-key", a.key)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+a.bearer)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return kindError(ErrUnreachable, "connecting to Gemini API: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return providerError("gemini cachedContents API", resp, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("parsing cachedContents response: %v", err)
+	}
+	return nil
+}
+
+func ttlString(d time.Duration) string { return fmt.Sprintf("%ds", int(d.Seconds())) }
+
+func (a geminiCacheAPI) create(ctx context.Context, displayName, text string, ttl time.Duration) (GeminiCache, error) {
+	payload := map[string]interface{}{
+		"model":       a.model,
+		"displayName": displayName,
+		"contents":    []GeminiContent{{Role: "user", Parts: []GeminiPart{{Text: text}}}},
+		"ttl":         ttlString(ttl),
+	}
+	var c GeminiCache
+	return c, a.do(ctx, http.MethodPost, a.root+a.parent+"cachedContents", payload, &c)
+}
+
+func (a geminiCacheAPI) list(ctx context.Context) ([]GeminiCache, error) {
+	var all []GeminiCache
+	token := ""
+	for {
+		u := a.root + a.parent + "cachedContents?pageSize=100"
+		if token != "" {
+			u += "&pageToken=" + url.QueryEscape(token)
+		}
+		var page struct {
+			CachedContents []GeminiCache `json:"cachedContents"`
+			NextPageToken  string        `json:"nextPageToken"`
+		}
+		if err := a.do(ctx, http.MethodGet, u, nil, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.CachedContents...)
+		if token = page.NextPageToken; token == "" {
+			return all, nil
+		}
+	}
+}
+
+func (a geminiCacheAPI) extend(ctx context.Context, name string, ttl time.Duration) (GeminiCache, error) {
+	var c GeminiCache
+	return c, a.do(ctx, http.MethodPatch, a.root+name+"?updateMask=ttl", map[string]string{"ttl": ttlString(ttl)}, &c)
+}
+
+func (a geminiCacheAPI) delete(ctx context.Context, name string) error {
+	return a.do(ctx, http.MethodDelete, a.root+name, nil, nil)
+}
+
+// resolve turns a cache's name or display name into its name. Of several
+// caches with the display name, the one that expires last wins.
+func (a geminiCacheAPI) resolve(ctx context.Context, ref string) (string, error) {
+	if strings.Contains(ref, "cachedContents/") {
+		return ref, nil
+	}
+	caches, err := a.list(ctx)
+	if err != nil {
+		return "", err
+	}
+	var best *GeminiCache
+	for i, c := range caches {
+		if c.DisplayName == ref && (best == nil || c.ExpireTime.After(best.ExpireTime)) {
+			best = &caches[i]
+		}
+	}
+	if best == nil {
+		return "", kindError(ErrConfig, "no Gemini cache named %q; create it with `helix cache create --name %s <files>` (caches expire after their TTL)", ref, ref)
+	}
+	return best.Name, nil
+}
+
+// geminiCacheFor is req's cache, or else the runner's.
+func (r *runner) geminiCacheFor(req TaskRequest) string {
+	if req.GeminiCache != "" {
+		return req.GeminiCache
+	}
+	return r.geminiCache
+}
+
+// resolveGeminiCache checks that a task given a cache runs on Gemini and
+// resolves the cache's display name once for all of the task's calls.
+func (r *runner) resolveGeminiCache(ctx context.Context, req *TaskRequest) error {
+	ref := r.geminiCacheFor(*req)
+	if ref == "" {
+		return nil
+	}
+	if req.Provider != "cloud" {
+		return kindError(ErrConfig, "--gemini-cache needs --provider cloud, not %s", req.Provider)
+	}
+	a, err := newGeminiCacheAPI(ctx, r.key, req.Model)
+	if err != nil {
+		return err
+	}
+	name, err := a.resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+	req.GeminiCache = name
+	return nil
+}
+
+// cacheAPIFor sets up the API behind a cache subcommand.
+func cacheAPIFor(fs *flag.FlagSet) func() geminiCacheAPI {
+	kf := addKeyFlags(fs)
+	mdl := fs.String("model", "", "Vertex AI model the cache is for (the Gemini API uses the cloud provider's model)")
+	return func() geminiCacheAPI {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		a, err := newGeminiCacheAPI(context.Background(), key, *mdl)
+		if err != nil {
+			fatal(configError(err))
+		}
+		return a
+	}
+}
+
+func printCache(c GeminiCache) {
+	label := c.DisplayName
+	if label == "" {
+		label = "-"
+	}
+	fmt.Printf("%s  %s  %d tokens  expires %s\n", c.Name, label, c.UsageMetadata.TotalTokenCount, c.ExpireTime.Local().Format(time.RFC3339))
+}
+
+// cacheCreateCommand implements `cache create --name corpus <files>...`.
+func cacheCreateCommand(fs *flag.FlagSet) func(args []string) {
+	api := cacheAPIFor(fs)
+	name := fs.String("name", "", "Display name tasks refer to the cache by with --gemini-cache")
+	ttl := fs.Duration("ttl", time.Hour, "How long the cache lives; storage is billed per hour")
+	ocr := fs.Bool("ocr", config.Documents.OCR, "OCR PDFs that have no text layer with tesseract")
+	fs.BoolVar(&jsonOut, "json", false, "Print the cache as JSON")
+	return func(args []string) {
+		if len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix cache create --name <name> <file, directory or glob>..."))
+		}
+		if *ttl < time.Minute {
+			fatal(kindError(ErrConfig, "--ttl must be at least 1m"))
+		}
+		files, err := collectContextFiles(args, *ocr)
+		if err != nil {
+			fatal(configError(err))
+		}
+		var b strings.Builder
+		cached := 0
+		for _, f := range files {
+			if f.Data != nil {
+				statusf("[Sub-Agent] Skipping binary file %s\n", f.Path)
+				continue
+			}
+			fmt.Fprintf(&b, "<file path=%q>\n%s\n</file>\n", f.Path, strings.TrimRight(f.Content, "\n"))
+			cached++
+		}
+		text := "<files>\n" + b.String() + "</files>"
+		if found := scanSecrets(text); len(found) > 0 {
+			fatal(kindError(ErrSafety, "the files appear to contain secrets (%s); not uploading them to Gemini", strings.Join(found, ", ")))
+		}
+		c, err := api().create(context.Background(), *name, text, *ttl)
+		if err != nil {
+			fatal(redactErr(err))
+		}
+		if jsonOut {
+			printJSON(c)
+			return
+		}
+		statusf("[Sub-Agent] Cached %d file(s)\n", cached)
+		printCache(c)
+	}
+}
+
+// cacheListCommand implements `cache list`.
+func cacheListCommand(fs *flag.FlagSet) func(args []string) {
+	api := cacheAPIFor(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the caches as JSON")
+	return func(args []string) {
+		caches, err := api().list(context.Background())
+		if err != nil {
+			fatal(redactErr(err))
+		}
+		if jsonOut {
+			printJSON(caches)
+			return
+		}
+		if len(caches) == 0 {
+			fmt.Println("No Gemini caches.")
+			return
+		}
+		for _, c := range caches {
+			printCache(c)
+		}
+	}
+}
+
+// cacheExtendCommand implements `cache extend --ttl 2h <name>...`, which
+// sets a new expiry counted from now.
+func cacheExtendCommand(fs *flag.FlagSet) func(args []string) {
+	api := cacheAPIFor(fs)
+	ttl := fs.Duration("ttl", time.Hour, "New lifetime, counted from now")
+	return func(args []string) {
+		if len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix cache extend --ttl <duration> <name>..."))
+		}
+		a, ctx := api(), context.Background()
+		for _, ref := range args {
+			name, err := a.resolve(ctx, ref)
+			if err != nil {
+				fatal(redactErr(err))
+			}
+			c, err := a.extend(ctx, name, *ttl)
+			if err != nil {
+				fatal(redactErr(err))
+			}
+			printCache(c)
+		}
+	}
+}
+
+// cacheDeleteCommand implements `cache delete <name>... | --all`. Caches
+// are deleted when they expire anyway; deleting stops the storage bill now.
+func cacheDeleteCommand(fs *flag.FlagSet) func(args []string) {
+	api := cacheAPIFor(fs)
+	all := fs.Bool("all", false, "Delete every cache")
+	return func(args []string) {
+		if len(args) == 0 && !*all {
+			fatal(kindError(ErrConfig, "usage: helix cache delete <name>... (or --all)"))
+		}
+		if len(args) > 0 && *all {
+			fatal(kindError(ErrConfig, "pass cache names or --all, not both"))
+		}
+		a, ctx := api(), context.Background()
+		names := args
+		if *all {
+			caches, err := a.list(ctx)
+			if err != nil {
+				fatal(redactErr(err))
+			}
+			names = nil
+			for _, c := range caches {
+				names = append(names, c.Name)
+			}
+		}
+		failed := false
+		for _, ref := range names {
+			name, err := a.resolve(ctx, ref)
+			if err == nil {
+				err = a.delete(ctx, name)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", ref, redactErr(err))
+				failed = true
+				continue
+			}
+			fmt.Printf("Deleted %s\n", name)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileInput is a document or media file sent to the model as-is rather
+// than read into the prompt as text: a PDF, a video, a recording or an
+// image. Only Gemini takes them. Data is base64 in JSON.
+type FileInput struct {
+	Name     string `json:"name"`
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+// readFileInput loads a file for --file, typing it by extension and then
+// by content.
+func readFileInput(path string) (FileInput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FileInput{}, fmt.Errorf("reading file: %v", err)
+	}
+	typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(path))))
+	if typ == "" {
+		typ, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	switch {
+	case typ == "application/pdf", strings.HasPrefix(typ, "video/"), strings.HasPrefix(typ, "audio/"),
+		strings.HasPrefix(typ, "image/"), strings.HasPrefix(typ, "text/"):
+	default:
+		return FileInput{}, fmt.Errorf("%s is %s; --file takes PDFs, video, audio, images and text", path, typ)
+	}
+	return FileInput{Name: filepath.Base(path), MIMEType: typ, Data: data}, nil
+}
+
+// geminiInlineLimit is how many bytes of attachments a Gemini request
+// inlines; past it they go through the Files API, since base64 makes them
+// a third bigger and requests are capped at 20 MB.
+const geminiInlineLimit = 14 << 20
+
+// attachment is an image or file in the order geminiPayload sends them.
+type attachment struct {
+	name     string
+	mimeType string
+	data     []byte
+}
+
+func (g genRequest) attachments() []attachment {
+	var out []attachment
+	for i, img := range g.Images {
+		out = append(out, attachment{fmt.Sprintf("image-%d", i+1), img.MIMEType, img.Data})
+	}
+	for _, f := range g.Files {
+		out = append(out, attachment{f.Name, f.MIMEType, f.Data})
+	}
+	return out
+}
+
+// geminiFile is a file uploaded with the Files API. Uploads are kept for
+// 48 hours, so a process reuses them across calls and candidates.
+type geminiFile struct {
+	Name           string    `json:"name"` // files/...
+	URI            string    `json:"uri"`
+	MIMEType       string    `json:"mimeType"`
+	State          string    `json:"state"` // PROCESSING, ACTIVE or FAILED
+	ExpirationTime time.Time `json:"expirationTime"`
+	Error          *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+var geminiUploads = struct {
+	sync.Mutex
+	files map[[32]byte]geminiFile
+}{files: map[[32]byte]geminiFile{}}
+
+const geminiFilesURL = "https://generativelanguage.googleapis.com/v1beta/"
+
+// uploadAttachments uploads g's attachments when they are too big to
+// inline, returning their file references in attachments order; nil means
+// they are inlined.
+func uploadAttachments(ctx context.Context, gc GeminiConfig, key string, g genRequest) ([]*GeminiFileData, error) {
+	atts := g.attachments()
+	total := 0
+	for _, a := range atts {
+		total += len(a.data)
+	}
+	if total <= geminiInlineLimit {
+		return nil, nil
+	}
+	if gc.Vertex {
+		return nil, kindError(ErrConfig, "attachments of %d MB are too big to inline, and Vertex AI has no Files API; use the Gemini API (unset gemini.vertex) or make them smaller than %d MB", total>>20, geminiInlineLimit>>20)
+	}
+	refs := make([]*GeminiFileData, len(atts))
+	for i, a := range atts {
+		f, err := uploadGeminiFile(ctx, key, a)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = &GeminiFileData{MimeType: f.MIMEType, FileURI: f.URI}
+	}
+	return refs, nil
+}
+
+// uploadGeminiFile uploads a, or returns its earlier upload, and waits for
+// Gemini to finish processing it, which videos take a while for.
+func uploadGeminiFile(ctx context.Context, key string, a attachment) (geminiFile, error) {
+	sum := sha256.Sum256(a.data)
+	geminiUploads.Lock()
+	f, ok := geminiUploads.files[sum]
+	geminiUploads.Unlock()
+	if ok && time.Until(f.ExpirationTime) > time.Hour {
+		return f, nil
+	}
+
+	statusf("[Sub-Agent] Uploading %s (%d MB) to the Gemini Files API\n", a.name, len(a.data)>>20)
+	meta, _ := json.Marshal(map[string]interface{}{"file": map[string]string{"display_name": a.name}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://generativelanguage.googleapis.com/upload/v1beta/files", bytes.NewReader(meta))
+	if err != nil {
+		return f, fmt.Errorf("building upload request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", key)
+	req.Header.Set("X-Goog-Upload-Protocol", "resumable")
+	req.Header.Set("X-Goog-Upload-Command", "start")
+	req.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.Itoa(len(a.data)))
+	req.Header.Set("X-Goog-Upload-Header-Content-Type", a.mimeType)
+	resp, err := geminiFilesDo(req, nil)
+	if err != nil {
+		return f, err
+	}
+	uploadURL := resp.Header.Get("X-Goog-Upload-URL")
+	if uploadURL == "" {
+		return f, fmt.Errorf("gemini Files API returned no upload URL")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(a.data))
+	if err != nil {
+		return f, fmt.Errorf("building upload request: %v", err)
+	}
+	req.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+	req.Header.Set("X-Goog-Upload-Offset", "0")
+	var out struct {
+		File geminiFile `json:"file"`
+	}
+	if _, err := geminiFilesDo(req, &out); err != nil {
+		return f, err
+	}
+	f = out.File
+
+	for f.State == "PROCESSING" {
+		select {
+		case <-ctx.Done():
+			return f, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, geminiFilesURL+f.Name, nil)
+		if err != nil {
+			return f, fmt.Errorf("building file status request: %v", err)
+		}
+		req.Header.Set("x-goog-api-key", key)
+		if _, err := geminiFilesDo(req, &f); err != nil {
+			return f, err
+		}
+	}
+	if f.State == "FAILED" {
+		msg := "unknown error"
+		if f.Error != nil {
+			msg = f.Error.Message
+		}
+		return f, fmt.Errorf("gemini could not process %s: %s", a.name, msg)
+	}
+
+	geminiUploads.Lock()
+	geminiUploads.files[sum] = f
+	geminiUploads.Unlock()
+	return f, nil
+}
+
+// geminiFilesDo sends a Files API request and decodes its JSON into out.
+func geminiFilesDo(req *http.Request, out interface{}) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, kindError(ErrUnreachable, "connecting to the Gemini Files API: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, providerError("gemini Files API", resp, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("parsing Files API response: %v", err)
+		}
+	}
+	return resp, nil
+}
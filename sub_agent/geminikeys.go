@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GeminiKey is one of the API keys, or with Vertex AI one of the projects
+// and regions, that Gemini calls rotate over by weight. A key that hits
+// its quota sits out until the provider's retry delay has passed while
+// calls fail over to the others.
+type GeminiKey struct {
+	Name string `json:"name"`
+	// Key is the API key or a vault:// or exec: reference to one; Secret
+	// names a secret to look up instead, as the "gemini" secret is.
+	Key    string `json:"key,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	// Vertex AI: the project and location to call instead of gemini's.
+	Project  string `json:"project,omitempty"`
+	Location string `json:"location,omitempty"`
+	Weight   int    `json:"weight,omitempty"` // share of the calls, default 1
+}
+
+// Cooldowns of a key that failed without a retry delay.
+const (
+	keyQuotaCooldown = time.Minute
+	keyAuthCooldown  = 10 * time.Minute
+)
+
+func validateGeminiKeys(keys []GeminiKey) error {
+	seen := map[string]bool{}
+	for i, k := range keys {
+		if k.Name == "" {
+			return fmt.Errorf("gemini.keys[%d]: name is required", i)
+		}
+		if seen[k.Name] {
+			return fmt.Errorf("gemini.keys: duplicate name %q", k.Name)
+		}
+		seen[k.Name] = true
+		if k.Weight < 0 {
+			return fmt.Errorf("gemini.keys[%d]: weight can't be negative", i)
+		}
+		if k.Key != "" && k.Secret != "" {
+			return fmt.Errorf("gemini.keys[%d]: set key or secret, not both", i)
+		}
+		if k.Key == "" && k.Secret == "" && k.Project == "" && k.Location == "" {
+			return fmt.Errorf("gemini.keys[%d]: set key or secret, or for Vertex AI project or location", i)
+		}
+	}
+	return nil
+}
+
+func (k GeminiKey) weight() int {
+	if k.Weight == 0 {
+		return 1
+	}
+	return k.Weight
+}
+
+// apiKey resolves k's API key.
+func (k GeminiKey) apiKey() (string, error) {
+	if k.Secret != "" {
+		v, err := lookupSecret(k.Secret, "")
+		if err == nil && v == "" {
+			err = fmt.Errorf("secret %s is not set", k.Secret)
+		}
+		return v, err
+	}
+	return resolveSecretValue(k.Key)
+}
+
+// keyRotation spreads calls over the configured keys by smooth weighted
+// round robin and keeps the cooldowns of those that failed.
+type keyRotation struct {
+	mu      sync.Mutex
+	current map[string]int
+	cooling map[string]time.Time
+}
+
+var geminiKeys = keyRotation{current: map[string]int{}, cooling: map[string]time.Time{}}
+
+// pick returns the next key not cooling down and not in skip. Without
+// one, wait is how long until the first cooldown ends.
+func (kr *keyRotation) pick(keys []GeminiKey, skip map[string]bool) (k GeminiKey, ok bool, wait time.Duration) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	now := time.Now()
+	total, best := 0, -1
+	for i, key := range keys {
+		if until, cooling := kr.cooling[key.Name]; cooling && now.Before(until) {
+			if w := until.Sub(now); wait == 0 || w < wait {
+				wait = w
+			}
+			continue
+		}
+		if skip[key.Name] || key.weight() == 0 {
+			continue
+		}
+		kr.current[key.Name] += key.weight()
+		total += key.weight()
+		if best < 0 || kr.current[key.Name] > kr.current[keys[best].Name] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return GeminiKey{}, false, wait
+	}
+	kr.current[keys[best].Name] -= total
+	return keys[best], true, 0
+}
+
+// cool takes a key out of the rotation for d.
+func (kr *keyRotation) cool(name string, d time.Duration) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.cooling[name] = time.Now().Add(d)
+}
+
+// rotatedGeminiKey is the API key of the next key in the rotation, for
+// calls that don't fail over, or "" without keys.
+func rotatedGeminiKey() (string, error) {
+	keys := geminiConfig().Keys
+	if len(keys) == 0 {
+		return "", nil
+	}
+	k, ok, _ := geminiKeys.pick(keys, nil)
+	if !ok {
+		k = keys[0]
+	}
+	if k.Key == "" && k.Secret == "" {
+		return "", nil
+	}
+	return k.apiKey()
+}
+
+// callGeminiRotating makes a Gemini call with each configured key in turn
+// until one isn't out of quota or rejected.
+func callGeminiRotating(ctx context.Context, g genRequest, gc GeminiConfig) ([]Response, error) {
+	tried := map[string]bool{}
+	var lastErr error
+	for {
+		k, ok, wait := geminiKeys.pick(gc.Keys, tried)
+		if !ok {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, &TaskError{Kind: ErrRateLimited, Err: fmt.Errorf("every Gemini key is cooling down after hitting its quota"), RetryAfter: wait}
+		}
+		tried[k.Name] = true
+		c, key := gc, ""
+		if k.Project != "" {
+			c.Project = k.Project
+		}
+		if k.Location != "" {
+			c.Location = k.Location
+		}
+		if k.Key != "" || k.Secret != "" {
+			var err error
+			if key, err = k.apiKey(); err != nil {
+				return nil, kindError(ErrAuth, "gemini key %s: %v", k.Name, err)
+			}
+		}
+		outs, err := callGeminiWith(ctx, g, c, key)
+		cooldown := keyQuotaCooldown
+		switch errorKind(err) {
+		case ErrRateLimited:
+			if d := retryAfter(err); d > 0 {
+				cooldown = d
+			}
+		case ErrAuth:
+			cooldown = keyAuthCooldown
+		default:
+			return outs, err
+		}
+		geminiKeys.cool(k.Name, cooldown)
+		statusf("[Sub-Agent] Gemini key %s: %v; sitting it out for %s\n", k.Name, redactErr(err), cooldown.Round(time.Second))
+		lastErr = err
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const commitMsgPrompt = `Write a git commit message for the following staged changes. Use an imperative subject line of at most 72 characters, then a blank line and a short body explaining what changed and why, if that is not obvious from the subject. Output only the message, without code fences.
+
+%s`
+
+const reviewPrompt = `Review the following diff for bugs, security problems, performance issues and anything else a careful reviewer would flag. Report each problem as an object with the fields "file", "line" (in the new version; 0 if unknown), "severity" ("high", "medium" or "low"), "category" ("bug", "security", "performance", "style", "test" or "docs") and "message". Output only a JSON array of these objects, or [] if there are no problems.
+
+%s`
+
+const changelogPrompt = `Write a changelog in markdown for the following commits, grouping entries under "### Added", "### Changed" and "### Fixed" and leaving out empty groups. Write one bullet per user-visible change and skip purely internal commits such as refactors or CI tweaks. Output only the changelog.
+
+%s`
+
+// gitPartPrompt condenses one chunk of an oversized diff or log; the notes
+// for every chunk then stand in for the whole in the final prompt.
+const gitPartPrompt = `The following is part %d of %d of a larger %s. List the changes it makes as terse bullet points, naming files and functions. Output only the bullets.
+
+%s`
+
+// ReviewFinding is one problem reported by `git review`.
+type ReviewFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// gitAssistant runs git-derived prompts through the task runner, so the
+// guardrails and secret scan apply to diffs too.
+type gitAssistant struct {
+	runner      *runner
+	provider    string
+	model       string
+	chunkTokens int
+}
+
+// addGitFlags registers the flags the git subcommands share and returns a
+// constructor for the assistant, called once they are parsed.
+func addGitFlags(fs *flag.FlagSet) func() *gitAssistant {
+	prov := fs.String("provider", "local", "Provider: 'local', 'cloud', 'azure-openai', 'bedrock' or an OpenAI-compatible adapter")
+	mdl := fs.String("model", "", "Model name")
+	chunkTokens := fs.Int("chunk-tokens", 6000, "Diffs or logs larger than this many tokens are condensed chunk by chunk first")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func() *gitAssistant {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		return &gitAssistant{runner: r, provider: *prov, model: *mdl, chunkTokens: *chunkTokens}
+	}
+}
+
+// gitCommitMsgCommand implements `git commit-msg`: a message for the staged diff.
+func gitCommitMsgCommand(fs *flag.FlagSet) func(args []string) {
+	assistant := addGitFlags(fs)
+	return func([]string) {
+		diff, err := gitOutput("diff", "--cached")
+		if err != nil {
+			fatal(configError(err))
+		}
+		if strings.TrimSpace(diff) == "" {
+			fatal(kindError(ErrConfig, "nothing is staged; use git add first"))
+		}
+		g := assistant()
+		msg, err := g.askChunked(context.Background(), commitMsgPrompt, "diff", splitDiff(diff))
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(stripFences(msg))
+	}
+}
+
+// gitReviewCommand implements `git review [range]`. Without a range it
+// reviews uncommitted changes against HEAD.
+func gitReviewCommand(fs *flag.FlagSet) func(args []string) {
+	asJSON := fs.Bool("json", false, "Print the findings as JSON")
+	assistant := addGitFlags(fs)
+	return func(args []string) {
+		diffArgs := append([]string{"diff"}, args...)
+		if len(args) == 0 {
+			diffArgs = append(diffArgs, "HEAD")
+		}
+		diff, err := gitOutput(diffArgs...)
+		if err != nil {
+			fatal(configError(err))
+		}
+		if strings.TrimSpace(diff) == "" {
+			fatal(kindError(ErrConfig, "no changes to review"))
+		}
+
+		// Each chunk is reviewed on its own; condensing would lose the
+		// line-level detail findings need.
+		g := assistant()
+		var findings []ReviewFinding
+		chunks := groupByTokens(splitDiff(diff), g.chunkTokens)
+		for i, chunk := range chunks {
+			out, err := g.ask(context.Background(), fmt.Sprintf(reviewPrompt, chunk))
+			if err != nil {
+				fatal(err)
+			}
+			found, err := parseFindings(out)
+			if err != nil {
+				fatal(kindError(ErrProvider, "chunk %d of %d: %v", i+1, len(chunks), err))
+			}
+			findings = append(findings, found...)
+		}
+
+		if *asJSON {
+			if findings == nil {
+				findings = []ReviewFinding{}
+			}
+			printJSON(findings)
+			return
+		}
+		if len(findings) == 0 {
+			fmt.Println("[Sub-Agent] No findings")
+			return
+		}
+		for _, f := range findings {
+			loc := f.File
+			if f.Line > 0 {
+				loc = fmt.Sprintf("%s:%d", f.File, f.Line)
+			}
+			fmt.Printf("%-6s %-11s %s: %s\n", strings.ToUpper(f.Severity), f.Category, loc, f.Message)
+		}
+	}
+}
+
+// gitChangelogCommand implements `git changelog [range]`. The default range
+// runs from the latest tag, or covers the whole history if there is none.
+func gitChangelogCommand(fs *flag.FlagSet) func(args []string) {
+	assistant := addGitFlags(fs)
+	return func(args []string) {
+		rng := "HEAD"
+		if len(args) > 0 {
+			rng = args[0]
+		} else if tag, err := gitOutput("describe", "--tags", "--abbrev=0"); err == nil {
+			rng = strings.TrimSpace(tag) + "..HEAD"
+		}
+		log, err := gitOutput("log", "--no-merges", "--format=%h %s%n%b%x00", rng)
+		if err != nil {
+			fatal(configError(err))
+		}
+		var commits []string
+		for _, c := range strings.Split(log, "\x00") {
+			if c = strings.TrimSpace(c); c != "" {
+				commits = append(commits, c)
+			}
+		}
+		if len(commits) == 0 {
+			fatal(kindError(ErrConfig, "no commits in %s", rng))
+		}
+		g := assistant()
+		out, err := g.askChunked(context.Background(), changelogPrompt, "commit log", commits)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(stripFences(out))
+	}
+}
+
+// gitOutput runs git and returns its stdout, or an error carrying stderr.
+func gitOutput(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return string(out), nil
+}
+
+func (g *gitAssistant) ask(ctx context.Context, prompt string) (string, error) {
+	res, err := g.runner.run(ctx, TaskRequest{Task: prompt, Provider: g.provider, Model: g.model})
+	for _, w := range res.Warnings {
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: %s\n", w)
+	}
+	return res.Output, err
+}
+
+// askChunked fills prompt with pieces joined. If they are too large for one
+// prompt, each chunk is first condensed to notes and the notes used instead.
+func (g *gitAssistant) askChunked(ctx context.Context, prompt, what string, pieces []string) (string, error) {
+	chunks := groupByTokens(pieces, g.chunkTokens)
+	if len(chunks) == 1 {
+		return g.ask(ctx, fmt.Sprintf(prompt, chunks[0]))
+	}
+	notes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		out, err := g.ask(ctx, fmt.Sprintf(gitPartPrompt, i+1, len(chunks), what, chunk))
+		if err != nil {
+			return "", fmt.Errorf("chunk %d of %d: %w", i+1, len(chunks), err)
+		}
+		notes[i] = strings.TrimSpace(out)
+	}
+	return g.ask(ctx, fmt.Sprintf(prompt, "Notes on each part of the "+what+":\n\n"+strings.Join(notes, "\n\n")))
+}
+
+// splitDiff splits a unified diff into one piece per file.
+func splitDiff(diff string) []string {
+	var pieces []string
+	for _, part := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(part, "diff --git ") || len(pieces) == 0 {
+			pieces = append(pieces, part)
+			continue
+		}
+		pieces[len(pieces)-1] += part
+	}
+	return pieces
+}
+
+// groupByTokens packs pieces, in order, into chunks of at most maxTokens;
+// a piece that is too large on its own is split by splitByTokens.
+func groupByTokens(pieces []string, maxTokens int) []string {
+	var chunks []string
+	var cur strings.Builder
+	for _, p := range pieces {
+		if estimateTokens(p) > maxTokens {
+			if cur.Len() > 0 {
+				chunks = append(chunks, cur.String())
+				cur.Reset()
+			}
+			chunks = append(chunks, splitByTokens(p, maxTokens)...)
+			continue
+		}
+		if cur.Len() > 0 && estimateTokens(cur.String())+estimateTokens(p) > maxTokens {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+		if cur.Len() > 0 && !strings.HasSuffix(cur.String(), "\n") {
+			cur.WriteString("\n")
+		}
+		cur.WriteString(p)
+	}
+	if cur.Len() > 0 {
+		chunks = append(chunks, cur.String())
+	}
+	return chunks
+}
+
+// parseFindings decodes the JSON array in a review answer, tolerating code
+// fences or prose around it.
+func parseFindings(out string) ([]ReviewFinding, error) {
+	start, end := strings.Index(out, "["), strings.LastIndex(out, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("review answer contains no JSON array")
+	}
+	var findings []ReviewFinding
+	if err := json.Unmarshal([]byte(out[start:end+1]), &findings); err != nil {
+		return nil, fmt.Errorf("review answer is not a valid findings array: %v", err)
+	}
+	return findings, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"helix-agent-go/internal/golden"
+)
+
+// Golden transcripts (see internal/golden) check the agent loop against
+// the mock provider, which answers from a transcript's script.
+
+type mockKey struct{}
+
+// callMock answers a provider call of a golden run, under provider "mock",
+// from its script.
+func callMock(ctx context.Context, g genRequest) ([]Response, error) {
+	s, _ := ctx.Value(mockKey{}).(*golden.Script)
+	if s == nil {
+		return nil, kindError(ErrConfig, "the mock provider only answers golden transcripts (helix golden)")
+	}
+	text, err := s.Reply()
+	if err != nil {
+		return nil, kindError(ErrProvider, "%v: %s", err, truncateRunes(firstLine(g.Prompt), 80))
+	}
+	return []Response{{Text: text, FinishReason: FinishStop, Usage: Usage{PromptTokens: estimateTokens(g.Prompt), OutputTokens: estimateTokens(text)}}}, nil
+}
+
+// scriptedTool is a transcript's tool as the tool loop sees it.
+type scriptedTool struct {
+	name   string
+	desc   string
+	script *golden.Script
+}
+
+func (s *scriptedTool) spec() toolSpec {
+	desc := s.desc
+	if desc == "" {
+		desc = "A scripted tool."
+	}
+	return toolSpec{Name: s.name, Description: desc, InputSchema: json.RawMessage(`{"type":"object"}`)}
+}
+
+func (s *scriptedTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	return s.script.ToolResult(s.name)
+}
+
+// runGolden runs t and returns what differs from its expectations, and
+// what the run did.
+func runGolden(ctx context.Context, t golden.Transcript) ([]string, golden.Outcome, error) {
+	fs := flag.NewFlagSet("golden", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	rf := addRunnerFlags(fs)
+	if err := fs.Parse(t.Args); err != nil {
+		return nil, golden.Outcome{}, fmt.Errorf("args: %v", err)
+	}
+	r, err := newRunner("", rf)
+	if err != nil {
+		return nil, golden.Outcome{}, err
+	}
+	// A golden run leaves no trace.
+	r.history, r.audit, r.checkpoints = nil, nil, nil
+	s := golden.NewScript(t)
+	for _, name := range sortedKeys(t.Tools) {
+		r.tools = append(r.tools, &scriptedTool{name: name, desc: t.Tools[name].Description, script: s})
+	}
+	res, err := r.run(context.WithValue(ctx, mockKey{}, s), TaskRequest{Task: t.Task, Provider: "mock", Model: "golden"})
+	o := golden.Outcome{Answer: res.Output, Err: err}
+	for _, c := range res.ToolCalls {
+		o.ToolCalls = append(o.ToolCalls, golden.Call{Tool: c.Tool, Input: c.Input})
+	}
+	return golden.Check(t, s, o), o, nil
+}
+
+// goldenCommand implements `golden`: run golden transcripts through the
+// agent loop against the mock provider and report where they differ.
+func goldenCommand(fs *flag.FlagSet) func(args []string) {
+	update := fs.Bool("update", false, "Rewrite each transcript's expectations from what the run did")
+	fs.BoolVar(&jsonOut, "json", false, "Print the reports as JSON")
+	fs.BoolVar(&verbose, "verbose", false, "Print detailed progress")
+	return func(args []string) {
+		if len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix golden [--update] <transcript.json|dir>..."))
+		}
+		files, err := golden.Files(args)
+		if err != nil {
+			fatal(configError(err))
+		}
+		quiet = !verbose
+		ctx, stop := shutdownSignal()
+		defer stop()
+		var reports []golden.Report
+		failed := 0
+		for _, file := range files {
+			t, err := golden.Read(file)
+			if err != nil {
+				fatal(configError(err))
+			}
+			diffs, o, err := runGolden(ctx, t)
+			if err != nil {
+				fatal(kindError(ErrConfig, "%s: %v", file, err))
+			}
+			rep := golden.Report{Name: t.Name, File: file, Passed: len(diffs) == 0, Diffs: diffs, ToolCalls: len(o.ToolCalls)}
+			if *update && len(diffs) > 0 {
+				t.Update(o)
+				out, _ := json.MarshalIndent(t, "", "  ")
+				if err := writeFileAtomic(file, append(out, '\n')); err != nil {
+					fatal(err)
+				}
+				rep.Passed, rep.Updated = true, true
+			}
+			if !rep.Passed {
+				failed++
+			}
+			reports = append(reports, rep)
+			if jsonOut {
+				continue
+			}
+			switch {
+			case rep.Updated:
+				fmt.Printf("UPDATED %s (%s)\n", t.Name, file)
+			case rep.Passed:
+				fmt.Printf("PASS    %s (%d tool call(s))\n", t.Name, rep.ToolCalls)
+			default:
+				fmt.Printf("FAIL    %s (%s)\n", t.Name, file)
+				for _, d := range diffs {
+					fmt.Printf("        - %s\n", d)
+				}
+			}
+		}
+		if jsonOut {
+			printJSON(reports)
+		} else {
+			fmt.Printf("%d passed, %d failed\n", len(reports)-failed, failed)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"helix-agent-go/internal/golden"
+)
+
+// TestGolden runs the transcripts in contrib/golden through the agent
+// loop, as helix golden contrib/golden does.
+func TestGolden(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	quiet = !testing.Verbose()
+	files, err := golden.Files([]string{"contrib/golden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no transcripts in contrib/golden")
+	}
+	for _, file := range files {
+		g, err := golden.Read(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(g.Name, func(t *testing.T) {
+			diffs, _, err := runGolden(context.Background(), g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range diffs {
+				t.Error(d)
+			}
+		})
+	}
+}
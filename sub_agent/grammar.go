@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// constraints restrict the shape of the direct answer: Format is "json" or
+// a JSON schema, Grammar a GBNF grammar.
+type constraints struct {
+	format  json.RawMessage
+	grammar string
+}
+
+// formatJSON is the --format value that asks for any JSON value.
+var formatJSON = json.RawMessage(`"json"`)
+
+// parseFormat reads a --format value: "json", a text format (md, plain,
+// html), or the path of a JSON schema.
+func parseFormat(v string) (json.RawMessage, error) {
+	switch v {
+	case "":
+		return nil, nil
+	case "json":
+		return formatJSON, nil
+	case FormatMarkdown, FormatPlain, FormatHTML:
+		return json.RawMessage(strconv.Quote(v)), nil
+	}
+	data, err := os.ReadFile(v)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %v", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON schema: %v", v, err)
+	}
+	return json.RawMessage(data), nil
+}
+
+// readGrammar reads a --grammar file.
+func readGrammar(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading grammar: %v", err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("grammar %s is empty", path)
+	}
+	return string(data), nil
+}
+
+// checkConstraints reports whether g's provider can honour its format and
+// grammar. Ollama takes a format; OpenAI-compatible APIs take it as
+// response_format, and a grammar only where the adapter declares it (as
+// llama.cpp's server does).
+func checkConstraints(g genRequest) error {
+	if g.Format == nil && g.Grammar == "" {
+		return nil
+	}
+	switch g.Provider {
+	case "", "local":
+		if g.Grammar != "" {
+			return kindError(ErrUnsupported, "Ollama does not accept GBNF grammars; use --format, or an OpenAI-compatible provider with \"grammar\": true such as llama.cpp's server")
+		}
+		return nil
+	case "cloud", "bedrock", "azure-openai":
+		if g.Grammar != "" {
+			return kindError(ErrUnsupported, "provider %s does not accept GBNF grammars; use an OpenAI-compatible provider with \"grammar\": true such as llama.cpp's server", g.Provider)
+		}
+		if g.Format != nil && !nativeFormat(g.Provider) {
+			return kindError(ErrUnsupported, "provider %s can't constrain answers to --format; use local, azure-openai or an OpenAI-compatible provider, or leave out --degrade fail to have the format asked for in the prompt and checked after", g.Provider)
+		}
+		return nil
+	}
+	if a, ok := lookupAdapter(g.Provider); ok && g.Grammar != "" && !a.Grammar {
+		return kindError(ErrUnsupported, "provider %s does not accept GBNF grammars; set \"grammar\": true in its openai_compatible entry if it does", g.Provider)
+	}
+	return nil
+}
+
+// openAIResponseFormat maps a format to OpenAI's response_format.
+func openAIResponseFormat(format json.RawMessage) *OpenAIResponseFormat {
+	if format == nil {
+		return nil
+	}
+	if string(format) == string(formatJSON) {
+		return &OpenAIResponseFormat{Type: "json_object"}
+	}
+	return &OpenAIResponseFormat{Type: "json_schema", JSONSchema: &OpenAIJSONSchema{Name: "answer", Schema: format}}
+}
+
+// constrainAnswer sets g's format and grammar from req, or else the
+// runner's, and checks that g's provider takes them. A text format is
+// asked for in the prompt instead, which every provider takes, and so is a
+// JSON format the provider can't enforce, unless --degrade fail.
+func (r *runner) constrainAnswer(g *genRequest, req TaskRequest) error {
+	g.Format, g.Grammar = r.answerFormat(req), r.constraints.grammar
+	if req.Grammar != "" {
+		g.Grammar = req.Grammar
+	}
+	if f := textFormat(g.Format); f != "" {
+		g.Format = nil
+		g.Prompt += "\n\n" + formatInstructions[f]
+	}
+	if r.emulatesFormat(req) && r.degradeFor(req) != DegradeFail {
+		g.Prompt += "\n\n" + formatInstruction(g.Format)
+		g.Format = nil
+	}
+	return checkConstraints(*g)
+}
+
+// answerFormat is req's format, or else the runner's.
+func (r *runner) answerFormat(req TaskRequest) json.RawMessage {
+	if req.Format != nil {
+		return req.Format
+	}
+	return r.constraints.format
+}
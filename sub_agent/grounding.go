@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// GeminiGroundingMetadata is what Gemini reports about a --ground answer's
+// searches.
+type GeminiGroundingMetadata struct {
+	WebSearchQueries []string `json:"webSearchQueries,omitempty"`
+	GroundingChunks  []struct {
+		Web *struct {
+			URI   string `json:"uri"`
+			Title string `json:"title"`
+		} `json:"web,omitempty"`
+	} `json:"groundingChunks,omitempty"`
+	SearchEntryPoint *struct {
+		RenderedContent string `json:"renderedContent"`
+	} `json:"searchEntryPoint,omitempty"`
+}
+
+// Grounding reports the Google searches behind a --ground answer.
+type Grounding struct {
+	Queries []string          `json:"queries,omitempty"`
+	Sources []GroundingSource `json:"sources,omitempty"`
+	// SearchEntryPoint is the HTML search suggestions Google asks grounded
+	// answers to be shown with.
+	SearchEntryPoint string `json:"search_entry_point,omitempty"`
+}
+
+type GroundingSource struct {
+	Title string `json:"title,omitempty"`
+	URI   string `json:"uri"`
+}
+
+// groundingLog collects the grounding of one run's calls, which may be
+// concurrent.
+type groundingLog struct {
+	mu sync.Mutex
+	g  Grounding
+}
+
+type groundingKey struct{}
+
+func withGrounding(ctx context.Context, l *groundingLog) context.Context {
+	return context.WithValue(ctx, groundingKey{}, l)
+}
+
+// recordGrounding adds a call's grounding to the run's, dropping repeated
+// queries and sources.
+func recordGrounding(ctx context.Context, m *GeminiGroundingMetadata) {
+	l, _ := ctx.Value(groundingKey{}).(*groundingLog)
+	if l == nil || m == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, q := range m.WebSearchQueries {
+		if !slices.Contains(l.g.Queries, q) {
+			l.g.Queries = append(l.g.Queries, q)
+		}
+	}
+	for _, c := range m.GroundingChunks {
+		if c.Web == nil || slices.ContainsFunc(l.g.Sources, func(s GroundingSource) bool { return s.URI == c.Web.URI }) {
+			continue
+		}
+		l.g.Sources = append(l.g.Sources, GroundingSource{Title: c.Web.Title, URI: c.Web.URI})
+	}
+	if m.SearchEntryPoint != nil && l.g.SearchEntryPoint == "" {
+		l.g.SearchEntryPoint = m.SearchEntryPoint.RenderedContent
+	}
+}
+
+func (l *groundingLog) grounding() *Grounding {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.g.Queries) == 0 && len(l.g.Sources) == 0 {
+		return nil
+	}
+	g := l.g
+	return &g
+}
+
+// checkGrounding rejects --ground where Gemini can't search.
+func (r *runner) checkGrounding(req TaskRequest) error {
+	if !req.Ground && !r.ground {
+		return nil
+	}
+	if req.Provider != "cloud" {
+		return kindError(ErrConfig, "--ground needs --provider cloud, not %s", req.Provider)
+	}
+	if r.geminiCacheFor(req) != "" {
+		return kindError(ErrConfig, "--ground can't be combined with --gemini-cache; Gemini takes no tools alongside a cache")
+	}
+	return nil
+}
+
+func printGrounding(g *Grounding) {
+	if g == nil {
+		return
+	}
+	statusf("--- Search ---\n")
+	for _, q := range g.Queries {
+		statusf("Query: %s\n", q)
+	}
+	for i, s := range g.Sources {
+		statusf("[%d] %s %s\n", i+1, s.Title, s.URI)
+	}
+}
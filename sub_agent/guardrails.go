@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactConfig is the "guardrails.redact" config section. The --redact
+// flags override Entities, Scope and Responses.
+type RedactConfig struct {
+	// Entities to mask: email, phone, credit_card, secret, or the name of a
+	// custom pattern. "all" selects every built-in and custom entity.
+	Entities []string `json:"entities,omitempty"`
+	// Patterns adds custom entities as name -> regular expression.
+	Patterns map[string]string `json:"patterns,omitempty"`
+	// Scope is "cloud" (only tasks leaving the machine, the default) or "all".
+	Scope string `json:"scope,omitempty"`
+	// Responses also masks the answer before it is returned or stored.
+	Responses bool `json:"responses,omitempty"`
+}
+
+// GuardrailsConfig is the "guardrails" config section.
+type GuardrailsConfig struct {
+	Redact RedactConfig `json:"redact"`
+	// SecretScan is the default --secret-scan mode: block, warn or off.
+	SecretScan string           `json:"secret_scan,omitempty"`
+	Moderation ModerationConfig `json:"moderation"`
+
+	Classification ClassificationConfig `json:"classification"`
+}
+
+// RedactionReport counts what was masked, per entity.
+type RedactionReport struct {
+	Prompt   map[string]int `json:"prompt,omitempty"`
+	Response map[string]int `json:"response,omitempty"`
+}
+
+// entity is a detector; valid, when set, filters regex matches (e.g. by
+// Luhn checksum).
+type entity struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// secretPattern is one kind of credential that is commonly pasted by mistake.
+type secretPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+var secretPatterns = []secretPattern{
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[0-9A-Za-z]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[0-9A-Za-z-]{10,}\b`)},
+	{"API key", regexp.MustCompile(`\bsk-(?:proj-|ant-)?[0-9A-Za-z_\-]{20,}\b`)},
+	{"JWT", regexp.MustCompile(`\beyJ[0-9A-Za-z_-]{10,}\.[0-9A-Za-z_-]{10,}\.[0-9A-Za-z_-]{10,}\b`)},
+	// KEY=value lines as found in .env files, for names that look secret.
+	{".env secret", regexp.MustCompile(`(?im)^\s*(?:export\s+)?[A-Z0-9_]*(?:SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|PRIVATE_KEY|ACCESS_KEY)[A-Z0-9_]*\s*=\s*\S+.*$`)},
+}
+
+var builtinEntities = []entity{
+	// Secrets go first so that keys are not partially claimed by other entities.
+	{name: "secret", re: regexp.MustCompile(joinPatterns(secretPatterns))},
+	{name: "credit_card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	{name: "email", re: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+	{name: "phone", re: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\)[ .-]?|\b\d{2,4}[ .-])\d{3,4}[ .-]\d{3,4}\b`)},
+}
+
+func joinPatterns(pats []secretPattern) string {
+	parts := make([]string, len(pats))
+	for i, p := range pats {
+		parts[i] = "(?:" + p.re.String() + ")"
+	}
+	return strings.Join(parts, "|")
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// redactor masks the selected entities.
+type redactor struct {
+	entities  []entity
+	allScopes bool // mask local tasks too
+	responses bool
+}
+
+// newRedactor builds a redactor for the comma-separated entity list, or
+// returns nil when the list is empty.
+func newRedactor(list, scope string, responses bool) (*redactor, error) {
+	if list == "" {
+		return nil, nil
+	}
+	switch scope {
+	case "", "cloud", "all":
+	default:
+		return nil, fmt.Errorf("invalid --redact-scope %q: expected cloud or all", scope)
+	}
+
+	available := append([]entity{}, builtinEntities...)
+	names := make([]string, 0, len(config.Guardrails.Redact.Patterns))
+	for name := range config.Guardrails.Redact.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(config.Guardrails.Redact.Patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %s: %v", name, err)
+		}
+		available = append(available, entity{name: name, re: re})
+	}
+
+	rd := &redactor{allScopes: scope == "all", responses: responses}
+	want := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		want[strings.TrimSpace(name)] = true
+	}
+	for _, e := range available {
+		if want["all"] || want[e.name] {
+			rd.entities = append(rd.entities, e)
+			delete(want, e.name)
+		}
+	}
+	delete(want, "all")
+	for name := range want {
+		return nil, fmt.Errorf("unknown redact entity %q", name)
+	}
+	return rd, nil
+}
+
+// appliesTo reports whether the task's prompt is masked: always with scope
+// "all", otherwise when it leaves the machine.
+func (rd *redactor) appliesTo(r *runner, req TaskRequest) bool {
+	return rd.allScopes || r.leavesMachine(req)
+}
+
+// leavesMachine reports whether any stage of the task may call a non-local
+// provider: the answer and its escalations, speculation, debate, planning,
+// verification and the judges. Judges left to judge.model count as that.
+// guardCall enforces the guardrails on the calls themselves.
+func (r *runner) leavesMachine(req TaskRequest) bool {
+	providers := []string{req.Provider, r.verify.provider, r.plan.provider}
+	var choices []modelChoice
+	choices = append(choices, r.plan.choices...)
+	specs := []string{r.escalateFor(req).chain, r.escalate.judge, r.candidates.judge, r.confidence.judge}
+	if r.speculate.enabled || req.Speculate {
+		specs = append(specs, r.speculate.models, r.speculate.judge)
+	}
+	if r.debate.agents > 1 || req.Debate > 1 {
+		choices = append(choices, r.debate.choices...)
+		if r.debate.judge != debateJudgeVote {
+			specs = append(specs, r.debate.judge)
+		}
+	}
+	if config.Judge.Model != "" {
+		specs = append(specs, config.Judge.Model)
+	}
+	for _, spec := range specs {
+		if cs, err := parseModelChoices(spec); err == nil {
+			choices = append(choices, cs...)
+		}
+	}
+	for _, c := range choices {
+		providers = append(providers, c.provider)
+	}
+	for _, p := range providers {
+		if p != "" && p != "local" {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudGuard applies a run's redaction and secret scan to each provider
+// call that leaves the machine, whichever stage makes it.
+type cloudGuard struct {
+	redact     *redactor // nil masks nothing
+	secretScan string
+
+	mu sync.Mutex
+	// counts is the most of each entity masked in one prompt, as the tool
+	// loop sends what it masked again with each call.
+	counts map[string]int
+	// warning is the secret scan's, given once a run.
+	warned  bool
+	warning string
+}
+
+type cloudGuardKey struct{}
+
+// withCloudGuard has the provider calls made under ctx guarded by cg.
+func withCloudGuard(ctx context.Context, cg *cloudGuard) context.Context {
+	return context.WithValue(ctx, cloudGuardKey{}, cg)
+}
+
+// guardCall masks and scans the prompt of g, when the run under ctx has a
+// guard and g is for a non-local provider. It fails a call the secret
+// scan blocks.
+func guardCall(ctx context.Context, g *genRequest) error {
+	cg, _ := ctx.Value(cloudGuardKey{}).(*cloudGuard)
+	if cg == nil || g.Provider == "" || g.Provider == "local" {
+		return nil
+	}
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+	if cg.redact != nil {
+		counts := map[string]int{}
+		g.Prompt = cg.redact.mask(g.Prompt, counts)
+		for name, n := range counts {
+			cg.counts[name] = max(cg.counts[name], n)
+		}
+	}
+	if cg.secretScan == SecretScanOff {
+		return nil
+	}
+	found := scanSecrets(g.Prompt)
+	if len(found) == 0 {
+		return nil
+	}
+	msg := "a prompt for " + g.Provider + " appears to contain secrets: " + strings.Join(found, ", ")
+	if cg.secretScan == SecretScanBlock {
+		return kindError(ErrSafety, "%s; not sending it (pass --allow-secrets to override or --redact secret to mask them)", msg)
+	}
+	if !cg.warned {
+		cg.warned, cg.warning = true, msg
+	}
+	return nil
+}
+
+// report adds what cg masked and warned of to res.
+func (cg *cloudGuard) report(res *TaskResult) {
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+	if len(cg.counts) > 0 {
+		if res.Redactions == nil {
+			res.Redactions = &RedactionReport{}
+		}
+		if res.Redactions.Prompt == nil {
+			res.Redactions.Prompt = map[string]int{}
+		}
+		for name, n := range cg.counts {
+			res.Redactions.Prompt[name] += n
+		}
+	}
+	if cg.warning != "" {
+		res.Warnings = append(res.Warnings, cg.warning)
+	}
+}
+
+// formatCounts renders counts as "email=2, phone=1", sorted by name.
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mask replaces every detected entity in text with [NAME] and counts the
+// replacements, adding them to counts.
+func (rd *redactor) mask(text string, counts map[string]int) string {
+	for _, e := range rd.entities {
+		placeholder := "[" + strings.ToUpper(e.name) + "]"
+		text = e.re.ReplaceAllStringFunc(text, func(m string) string {
+			if e.valid != nil && !e.valid(m) {
+				return m
+			}
+			counts[e.name]++
+			return placeholder
+		})
+	}
+	return text
+}
+
+// Secret scan modes for --secret-scan.
+const (
+	SecretScanBlock = "block"
+	SecretScanWarn  = "warn"
+	SecretScanOff   = "off"
+)
+
+func secretScanDefault() string {
+	if config.Guardrails.SecretScan != "" {
+		return config.Guardrails.SecretScan
+	}
+	return SecretScanBlock
+}
+
+// scanSecrets lists the credentials found in text as "kind (line N)", in
+// the order they appear.
+func scanSecrets(text string) []string {
+	type hit struct {
+		pos  int
+		kind string
+	}
+	var hits []hit
+	for _, p := range secretPatterns {
+		for _, loc := range p.re.FindAllStringIndex(text, -1) {
+			hits = append(hits, hit{loc[0], p.kind})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].pos < hits[j].pos })
+	found := make([]string, len(hits))
+	for i, h := range hits {
+		found[i] = fmt.Sprintf("%s (line %d)", h.kind, strings.Count(text[:h.pos], "\n")+1)
+	}
+	return found
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryConfig is the "history" config section.
+type HistoryConfig struct {
+	Disabled bool `json:"disabled,omitempty"` // the default of --no-history
+	Keep     int  `json:"keep,omitempty"`     // runs kept, default 200
+
+	// Backend is where runs and checkpoints are kept: "file" (the default)
+	// or "postgres", which every server and worker given the same database
+	// shares, so that one instance can replay, report on and resume the
+	// runs of another. Postgres is a postgres:// URL or a secret reference
+	// to one; $HELIX_HISTORY_DSN overrides it.
+	Backend  string `json:"backend,omitempty"`
+	Postgres string `json:"postgres,omitempty"`
+
+	// Retention beyond keep, applied by helix history prune and hourly by
+	// the daemon: runs older than MaxAge (e.g. "90d"), or than the MaxAge
+	// of the first Retention rule whose tag they have, and the oldest
+	// past MaxBytes of files.
+	MaxAge    string             `json:"max_age,omitempty"`
+	MaxBytes  int64              `json:"max_bytes,omitempty"`
+	Retention []HistoryRetention `json:"retention,omitempty"`
+
+	// Encrypt seals what helix keeps on disk with AES-256-GCM under a key
+	// from the keyring (see atRestKey): each run and each checkpoint of an
+	// unfinished one, the memory store, the worker queue's tasks and
+	// results, undo bundles and --write-manifest manifests. Scratchpads are
+	// kept in the runs and checkpoints. There is no response cache.
+	Encrypt       bool   `json:"encrypt,omitempty"`
+	EncryptionKey string `json:"encryption_key,omitempty"` // keyring entry, default history-encryption
+}
+
+const defaultHistoryKeep = 200
+
+// HistoryEntry is a finished run as `helix replay` needs it.
+type HistoryEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms"`
+	// Request is as execute received it: input attached, files packed,
+	// knowledge retrieved and the runner's settings filled in, so that
+	// replaying it needs none of the original flags.
+	Request  TaskRequest `json:"request"`
+	Tools    []string    `json:"tools,omitempty"` // --tools, which is not part of the request
+	Result   TaskResult  `json:"result"`
+	ReplayOf string      `json:"replay_of,omitempty"`
+	// Judgement is the latest helix judge --run scoring of the answer.
+	Judgement *Judgement `json:"judgement,omitempty"`
+	// Imported means the run came from helix history import of a
+	// transcript, which records only the task and answer.
+	Imported bool `json:"imported,omitempty"`
+}
+
+// historyStore keeps one JSON record per run, pruning the oldest past keep.
+type historyStore struct {
+	records recordStore
+	keep    int
+}
+
+// stateDir is $XDG_STATE_HOME/helix, falling back to ~/.local/state/helix.
+func stateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "helix"), nil
+}
+
+func openHistory() (*historyStore, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, fmt.Errorf("locating history directory: %v", err)
+	}
+	keep := config.History.Keep
+	if keep <= 0 {
+		keep = defaultHistoryKeep
+	}
+	records, err := openRecords("runs", filepath.Join(dir, "history"))
+	if err != nil {
+		return nil, err
+	}
+	return &historyStore{records: records, keep: keep}, nil
+}
+
+func (s *historyStore) save(e *HistoryEntry) error {
+	return s.saveAt(e, time.Now())
+}
+
+// saveAt records e as written at t, which pruning goes by.
+func (s *historyStore) saveAt(e *HistoryEntry, t time.Time) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = sealAtRest(data); err != nil {
+		return fmt.Errorf("encrypting run %s: %v", e.ID, err)
+	}
+	if err := s.records.put(e.ID, t, data); err != nil {
+		return err
+	}
+	s.prune()
+	return nil
+}
+
+// prune removes the oldest entries past s.keep, by when they were written.
+func (s *historyStore) prune() {
+	recs, err := s.records.stat()
+	if err != nil || len(recs) <= s.keep {
+		return
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].time.After(recs[j].time) })
+	for _, r := range recs[s.keep:] {
+		s.records.remove(r.id)
+	}
+}
+
+// validRunID reports whether id is safe as a file name in the history.
+func validRunID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && !strings.HasPrefix(id, ".")
+}
+
+func (s *historyStore) load(id string) (*HistoryEntry, error) {
+	if !validRunID(id) {
+		return nil, fmt.Errorf("invalid run ID %q", id)
+	}
+	data, err := s.records.get(id)
+	if err == errNoRecord {
+		return nil, fmt.Errorf("no run %s in the history (see helix replay --list)", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("history entry %s: %v", id, err)
+	}
+	return decodeEntry(id, data)
+}
+
+func decodeEntry(id string, data []byte) (*HistoryEntry, error) {
+	data, err := openAtRest(data)
+	if err != nil {
+		return nil, fmt.Errorf("history entry %s: %v", id, err)
+	}
+	var e HistoryEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("history entry %s: %v", id, err)
+	}
+	return &e, nil
+}
+
+// list returns the recorded runs, newest first.
+func (s *historyStore) list() ([]*HistoryEntry, error) {
+	recs, err := s.records.all()
+	if err != nil {
+		return nil, err
+	}
+	var es []*HistoryEntry
+	for _, r := range recs {
+		if !validRunID(r.id) {
+			continue
+		}
+		e, err := decodeEntry(r.id, r.data)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Time.After(es[j].Time) })
+	return es, nil
+}
+
+// newSeed picks a sampling seed for a run that wasn't given one. It stays
+// within 31 bits, which every provider's seed field takes.
+func newSeed() int64 {
+	return rand.Int63n(1<<31-1) + 1
+}
+
+// effectiveRequest is req with every runner setting that shapes the answer
+// copied into its fields, which take precedence over the flags on replay.
+func (r *runner) effectiveRequest(req TaskRequest) TaskRequest {
+	if len(req.Stop) == 0 {
+		req.Stop = r.stop
+	}
+	if req.Candidates == 0 {
+		req.Candidates = r.candidates.n
+	}
+	if req.Select == "" {
+		req.Select = r.candidates.policy
+	}
+	if req.Format == nil {
+		req.Format = r.constraints.format
+	}
+	if req.Grammar == "" {
+		req.Grammar = r.constraints.grammar
+	}
+	if req.ThinkBudget == 0 {
+		req.ThinkBudget = r.reasoning.budget
+	}
+	if req.ReasoningEffort == "" {
+		req.ReasoningEffort = r.reasoning.effort
+	}
+	if req.Lang == "" {
+		req.Lang = r.lang
+	}
+	if req.Style == "" {
+		req.Style = r.style
+	}
+	if req.Examples == "" {
+		req.Examples = r.examples
+	}
+	if req.MaxWords == 0 {
+		req.MaxWords = r.length.words
+	}
+	if req.MaxLines == 0 {
+		req.MaxLines = r.length.lines
+	}
+	if req.LengthEnforce == "" && (req.MaxWords > 0 || req.MaxLines > 0) {
+		req.LengthEnforce = r.length.enforce
+	}
+	if req.Debate == 0 {
+		req.Debate = r.debate.agents
+	}
+	if req.VerifyRounds == 0 {
+		req.VerifyRounds = r.verify.rounds
+	}
+	if req.Post == "" {
+		req.Post = r.postSpec
+	}
+	req.Plan = req.Plan || r.plan.enabled
+	req.Speculate = req.Speculate || r.speculate.enabled
+	if req.Escalate == "" {
+		req.Escalate = r.escalate.chain
+	}
+	if req.EscalateMinScore == 0 {
+		req.EscalateMinScore = r.escalate.minScore
+	}
+	// The knowledge is recorded with the request.
+	req.KB = ""
+	return req
+}
+
+// recordHistory saves a finished run for helix replay.
+func (r *runner) recordHistory(req TaskRequest, res TaskResult, took time.Duration) {
+	e := &HistoryEntry{ID: req.ID, Time: time.Now().UTC(), DurationMS: took.Milliseconds(), Request: req, Result: res, ReplayOf: req.replayOf}
+	for _, t := range r.tools {
+		if _, ok := t.(memoryTool); !ok {
+			e.Tools = append(e.Tools, t.spec().Name)
+		}
+	}
+	if err := r.history.save(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: history: %v\n", err)
+	}
+}
+
+// Replay is the JSON output of `helix replay`.
+type Replay struct {
+	Original   TaskResult `json:"original"`
+	Replay     TaskResult `json:"replay"`
+	Seed       int64      `json:"seed"`
+	OriginalMS int64      `json:"original_ms"`
+	ReplayMS   int64      `json:"replay_ms"`
+	Identical  bool       `json:"identical"`
+	Diff       string     `json:"diff,omitempty"` // unified, original to replay
+}
+
+// replayCommand implements `replay`: run a recorded task again with the same
+// prompt, settings and seed, optionally on another model, and diff the
+// answers. The run comes from the history or from a --write-manifest
+// manifest.
+func replayCommand(fs *flag.FlagSet) func(args []string) {
+	list := fs.Bool("list", false, "List the recorded runs")
+	manifestFile := fs.String("manifest", "", "Replay the run in this --write-manifest manifest instead of one from the history")
+	replayProvider := fs.String("provider", "", "Replay on this provider instead of the recorded one")
+	replayModel := fs.String("model", "", "Replay with this model instead of the recorded one")
+	contextLines := fs.Int("context-lines", 3, "Unchanged lines shown around each change in the diff")
+	fs.BoolVar(&jsonOut, "json", false, "Print both results and the diff as JSON")
+	fs.BoolVar(&verbose, "verbose", false, "Print detailed progress")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the diff: no status lines, warnings or progress")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func(args []string) {
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if *list {
+			es, err := store.list()
+			if err != nil {
+				fatal(err)
+			}
+			for _, e := range es {
+				status := "ok"
+				if e.Result.Error != "" {
+					status = "error"
+				}
+				fmt.Printf("%s  %s  %-5s %-28s %s\n", e.ID, e.Time.Local().Format("2006-01-02 15:04:05"), status, modelChoice{e.Result.Provider, e.Result.Model}, truncateRunes(e.Request.Task, 60))
+			}
+			return
+		}
+		var e *HistoryEntry
+		var m *RunManifest
+		switch {
+		case *manifestFile != "" && len(args) == 0:
+			if m, err = readManifest(*manifestFile); err != nil {
+				fatal(configError(err))
+			}
+			e = m.entry()
+		case *manifestFile == "" && len(args) == 1:
+			if e, err = store.load(args[0]); err != nil {
+				fatal(configError(err))
+			}
+		default:
+			fatal(kindError(ErrConfig, "usage: helix replay [--provider p] [--model m] <run-id> | --manifest FILE (see helix replay --list)"))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if *rf.tools == "" {
+			*rf.tools = strings.Join(e.Tools, ",")
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		r.history = store
+
+		req := e.Request
+		req.ID, req.replayOf = "", e.ID
+		if flagWasSet(fs, "seed") {
+			req.Seed = *rf.seed
+		}
+		if *replayProvider != "" || *replayModel != "" {
+			if *replayProvider != "" && *replayProvider != req.Provider {
+				req.Provider, req.Model = *replayProvider, ""
+			}
+			if *replayModel != "" {
+				req.Model = *replayModel
+			}
+			// The race would pick its own models.
+			req.Speculate = false
+		}
+		// Compare the answers themselves, not artifact links.
+		req.Artifacts = ArtifactsNever
+		if req.Provider == "bedrock" {
+			statusf("[Sub-Agent] Warning: Bedrock takes no seed, so the replay may differ by chance alone\n")
+		}
+		if m != nil {
+			for _, d := range m.compare(context.Background(), r, req) {
+				statusf("[Sub-Agent] Warning: %s, so the replay may differ\n", d)
+			}
+		}
+		if !jsonOut {
+			statusf("[Sub-Agent] Replaying run %s from %s (seed %d)\n", e.ID, e.Time.Local().Format("2006-01-02 15:04:05"), req.Seed)
+		}
+		start := time.Now()
+		res, err := r.run(context.Background(), req)
+		if m != nil {
+			if sections := m.promptDiff(res); len(sections) > 0 {
+				res.Warnings = append(res.Warnings, "the prompt differs from the manifest's in: "+strings.Join(sections, ", "))
+			}
+		}
+		out := Replay{Original: e.Result, Replay: res, Seed: req.Seed, OriginalMS: e.DurationMS, ReplayMS: time.Since(start).Milliseconds()}
+		out.Diff = unifiedDiff(e.Result.Output, res.Output, fmt.Sprintf("%s (%s)", e.ID, modelChoice{e.Result.Provider, e.Result.Model}), fmt.Sprintf("%s (%s)", res.ID, modelChoice{res.Provider, res.Model}), *contextLines)
+		out.Identical = out.Diff == "" && e.Result.ArtifactURL == ""
+		if jsonOut {
+			printJSON(out)
+			if err != nil {
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+		if err != nil {
+			fatal(err)
+		}
+		for _, w := range res.Warnings {
+			statusf("[Sub-Agent] Warning: %s\n", w)
+		}
+		if e.Result.ArtifactURL != "" {
+			statusf("[Sub-Agent] The recorded answer was uploaded to %s and can't be compared\n", e.Result.ArtifactURL)
+		}
+		statusf("[Sub-Agent] Original: %s, %dms; replay %s: %s, %dms\n", modelChoice{e.Result.Provider, e.Result.Model}, out.OriginalMS, res.ID, modelChoice{res.Provider, res.Model}, out.ReplayMS)
+		switch {
+		case out.Identical:
+			statusf("[Sub-Agent] The answer is identical\n")
+		case out.Diff != "":
+			fmt.Print(out.Diff)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyWindow is how long serve remembers an Idempotency-Key.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKey bounds the header, as the IETF draft suggests.
+const maxIdempotencyKey = 255
+
+// idempotencyStore remembers the responses to POST /v1/tasks requests that
+// carried an Idempotency-Key, so that a client retrying after a timeout or
+// a dropped connection gets the first answer instead of paying for a
+// second generation. Keys are per tenant.
+type idempotencyStore struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte // of the request body; a key names one request
+	created     time.Time
+	done        chan struct{} // closed once status and body are set
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// parseIdempotencyWindow reads server.idempotency_window: a duration, by
+// default 24h; 0 turns Idempotency-Key handling off.
+func parseIdempotencyWindow(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultIdempotencyWindow, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("server.idempotency_window: invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	if window == 0 {
+		return nil
+	}
+	return &idempotencyStore{window: window, entries: map[string]*idempotentResponse{}}
+}
+
+// begin claims key for body. A new key returns the entry to fill in with
+// finish and first; a known one returns its entry, which may still be in
+// flight. A key reused with a different body is an error.
+func (st *idempotencyStore) begin(tenant, key string, body []byte) (e *idempotentResponse, first bool, err error) {
+	fp := sha256.Sum256(body)
+	id := tenant + "\x00" + key
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for k, old := range st.entries {
+		if now.Sub(old.created) > st.window && old.finished() {
+			delete(st.entries, k)
+		}
+	}
+	if e := st.entries[id]; e != nil {
+		if e.fingerprint != fp {
+			return nil, false, fmt.Errorf("Idempotency-Key %q was already used for a different request", key)
+		}
+		return e, false, nil
+	}
+	e = &idempotentResponse{fingerprint: fp, created: now, done: make(chan struct{})}
+	st.entries[id] = e
+	return e, true, nil
+}
+
+// finish records rec's response on e, or forgets key when the response
+// says the task didn't run to an outcome (rate limited, cancelled,
+// interrupted by shutdown): retrying those should run the task.
+func (st *idempotencyStore) finish(tenant, key string, e *idempotentResponse, rec *recordingWriter) {
+	switch rec.status {
+	case http.StatusTooManyRequests, http.StatusConflict, http.StatusServiceUnavailable:
+		st.mu.Lock()
+		delete(st.entries, tenant+"\x00"+key)
+		st.mu.Unlock()
+	}
+	e.status, e.header, e.body = rec.status, rec.Header().Clone(), rec.buf.Bytes()
+	close(e.done)
+}
+
+func (e *idempotentResponse) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// replay writes the recorded response, marked as a replay.
+func (e *idempotentResponse) replay(w http.ResponseWriter) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// recordingWriter passes a response through while keeping a copy.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (r *recordingWriter) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recordingWriter) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.buf.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageGenConfig points `helix image generate` at local Stable Diffusion
+// servers. ComfyUIWorkflow is a workflow in ComfyUI's API format whose
+// strings may hold {{prompt}}, {{negative}}, {{seed}}, {{width}},
+// {{height}}, {{steps}}, {{batch}} and {{model}}; by default a plain
+// checkpoint text-to-image graph is used.
+type ImageGenConfig struct {
+	A1111URL        string `json:"a1111_url,omitempty"`   // default http://127.0.0.1:7860
+	ComfyUIURL      string `json:"comfyui_url,omitempty"` // default http://127.0.0.1:8188
+	ComfyUIWorkflow string `json:"comfyui_workflow,omitempty"`
+}
+
+// ImageResult is the JSON output of `image generate`.
+type ImageResult struct {
+	Provider string   `json:"provider"`
+	Model    string   `json:"model,omitempty"`
+	Seed     int64    `json:"seed,omitempty"`
+	Files    []string `json:"files"`
+}
+
+// imageRequest is what every image provider is asked for.
+type imageRequest struct {
+	Prompt   string
+	Negative string
+	Model    string
+	N        int
+	Width    int
+	Height   int
+	Steps    int
+	Seed     int64
+}
+
+// generatedImage is one image a provider returned.
+type generatedImage struct {
+	data []byte
+	ext  string // ".png", ".jpg"...
+}
+
+const defaultImagenModel = "imagen-3.0-generate-002"
+
+// imageGenerateCommand implements `image generate --prompt ...`.
+func imageGenerateCommand(fs *flag.FlagSet) func(args []string) {
+	prompt := fs.String("prompt", "", "What to draw")
+	negative := fs.String("negative", "", "What to keep out of the image (Stable Diffusion)")
+	prov := fs.String("provider", "cloud", "Provider: 'cloud' (Imagen on Gemini or Vertex AI), 'a1111' (AUTOMATIC1111) or 'comfyui'")
+	mdl := fs.String("model", "", "Model: an Imagen model, or the Stable Diffusion checkpoint (defaults to the server's)")
+	n := fs.Int("n", 1, "Number of images")
+	size := fs.String("size", "1024x1024", "Image size as WIDTHxHEIGHT; Imagen keeps the aspect ratio only")
+	steps := fs.Int("steps", 30, "Sampling steps (Stable Diffusion)")
+	seed := fs.Int64("seed", -1, "Seed for reproducible images (Stable Diffusion; -1 for random)")
+	outDir := fs.String("out-dir", ".", "Directory the images are saved in")
+	prefix := fs.String("name", "helix-image", "File name prefix; files are named PREFIX-TIMESTAMP-N.EXT")
+	asJSON := fs.Bool("json", false, "Print the result as JSON instead of the file paths")
+	kf := addKeyFlags(fs)
+	return func([]string) {
+		if *prompt == "" {
+			fatal(kindError(ErrConfig, "--prompt flag is required"))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		w, h, err := parseImageSize(*size)
+		if err != nil {
+			fatal(configError(err))
+		}
+		req := imageRequest{Prompt: *prompt, Negative: *negative, Model: *mdl, N: max(*n, 1), Width: w, Height: h, Steps: *steps, Seed: *seed}
+		if req.Seed < 0 && *prov != "cloud" {
+			req.Seed = rand.Int63n(1 << 32)
+		}
+
+		ctx := context.Background()
+		var images []generatedImage
+		switch *prov {
+		case "cloud":
+			if req.Model == "" {
+				req.Model = defaultImagenModel
+			}
+			images, err = generateImagen(ctx, req, key)
+		case "a1111":
+			images, err = generateA1111(ctx, req)
+		case "comfyui":
+			images, err = generateComfyUI(ctx, req)
+		default:
+			err = kindError(ErrConfig, "unknown image provider %q: expected cloud, a1111 or comfyui", *prov)
+		}
+		if err != nil {
+			fatal(redactErr(err))
+		}
+		if len(images) == 0 {
+			fatal(fmt.Errorf("%s returned no images (blocked by its safety filter?)", *prov))
+		}
+
+		res := ImageResult{Provider: *prov, Model: req.Model, Files: []string{}}
+		if req.Seed >= 0 {
+			res.Seed = req.Seed
+		}
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			fatal(configError(err))
+		}
+		stamp := time.Now().Format("20060102-150405")
+		seq := 1
+		for _, img := range images {
+			// Never overwrite: runs within the same second share a stamp.
+			var path string
+			for ; ; seq++ {
+				path = filepath.Join(*outDir, fmt.Sprintf("%s-%s-%d%s", *prefix, stamp, seq, img.ext))
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					break
+				}
+			}
+			seq++
+			if err := os.WriteFile(path, img.data, 0644); err != nil {
+				fatal(fmt.Errorf("writing %s: %v", path, err))
+			}
+			res.Files = append(res.Files, path)
+		}
+		if *asJSON {
+			printJSON(res)
+			return
+		}
+		statusf("[Sub-Agent] Generated %d image(s) with %s\n", len(res.Files), *prov)
+		for _, f := range res.Files {
+			fmt.Println(f)
+		}
+	}
+}
+
+func parseImageSize(s string) (int, int, error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	w, werr := strconv.Atoi(ws)
+	h, herr := strconv.Atoi(hs)
+	if !ok || werr != nil || herr != nil || w < 64 || h < 64 {
+		return 0, 0, fmt.Errorf("invalid --size %q: expected WIDTHxHEIGHT such as 1024x768", s)
+	}
+	return w, h, nil
+}
+
+// imagenAspectRatio picks the aspect ratio Imagen offers closest to w:h.
+func imagenAspectRatio(w, h int) string {
+	ratios := map[string]float64{"1:1": 1, "3:4": 0.75, "4:3": 4.0 / 3, "9:16": 9.0 / 16, "16:9": 16.0 / 9}
+	want := float64(w) / float64(h)
+	best, diff := "1:1", math.Inf(1)
+	for name, r := range ratios {
+		if d := math.Abs(r - want); d < diff {
+			best, diff = name, d
+		}
+	}
+	return best
+}
+
+func generateImagen(ctx context.Context, req imageRequest, key string) ([]generatedImage, error) {
+	var endpoint string
+	headers := map[string]string{}
+	if c := geminiConfig(); c.Vertex {
+		u, tok, err := vertexEndpoint(ctx, c, req.Model)
+		if err != nil {
+			return nil, err
+		}
+		endpoint = strings.TrimSuffix(u, ":generateContent") + ":predict"
+		headers["Authorization"] = "Bearer " + tok
+	} else {
+		key, err := geminiKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var, or GOOGLE_GENAI_USE_VERTEXAI=true to use Vertex AI")
+		}
+		endpoint = fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:predict", url.PathEscape(req.Model))
+		headers["x-goog-api-key"] = key
+	}
+	payload := map[string]interface{}{
+		"instances":  []map[string]string{{"prompt": req.Prompt}},
+		"parameters": map[string]interface{}{"sampleCount": req.N, "aspectRatio": imagenAspectRatio(req.Width, req.Height)},
+	}
+	var out struct {
+		Predictions []struct {
+			Data     string `json:"bytesBase64Encoded"`
+			MIMEType string `json:"mimeType"`
+		} `json:"predictions"`
+	}
+	if err := postJSON(ctx, "Imagen", endpoint, headers, payload, &out); err != nil {
+		return nil, err
+	}
+	var images []generatedImage
+	for _, p := range out.Predictions {
+		data, err := base64.StdEncoding.DecodeString(p.Data)
+		if err != nil {
+			return nil, fmt.Errorf("decoding Imagen image: %v", err)
+		}
+		ext := ".png"
+		if p.MIMEType == "image/jpeg" {
+			ext = ".jpg"
+		}
+		images = append(images, generatedImage{data, ext})
+	}
+	return images, nil
+}
+
+func generateA1111(ctx context.Context, req imageRequest) ([]generatedImage, error) {
+	base := strings.TrimRight(config.ImageGen.A1111URL, "/")
+	if base == "" {
+		base = "http://127.0.0.1:7860"
+	}
+	payload := map[string]interface{}{
+		"prompt":          req.Prompt,
+		"negative_prompt": req.Negative,
+		"width":           req.Width,
+		"height":          req.Height,
+		"steps":           req.Steps,
+		"seed":            req.Seed,
+		"batch_size":      req.N,
+	}
+	if req.Model != "" {
+		payload["override_settings"] = map[string]string{"sd_model_checkpoint": req.Model}
+	}
+	var out struct {
+		Images []string `json:"images"`
+	}
+	if err := postJSON(ctx, "AUTOMATIC1111", base+"/sdapi/v1/txt2img", nil, payload, &out); err != nil {
+		return nil, err
+	}
+	var images []generatedImage
+	for _, s := range out.Images {
+		// Some builds prefix a data URL header.
+		if i := strings.Index(s, ","); strings.HasPrefix(s, "data:") && i >= 0 {
+			s = s[i+1:]
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("decoding AUTOMATIC1111 image: %v", err)
+		}
+		images = append(images, generatedImage{data, ".png"})
+	}
+	return images, nil
+}
+
+// defaultComfyUIWorkflow is ComfyUI's basic checkpoint text-to-image graph.
+const defaultComfyUIWorkflow = `{
+  "4": {"class_type": "CheckpointLoaderSimple", "inputs": {"ckpt_name": "{{model}}"}},
+  "5": {"class_type": "EmptyLatentImage", "inputs": {"width": "{{width}}", "height": "{{height}}", "batch_size": "{{batch}}"}},
+  "6": {"class_type": "CLIPTextEncode", "inputs": {"text": "{{prompt}}", "clip": ["4", 1]}},
+  "7": {"class_type": "CLIPTextEncode", "inputs": {"text": "{{negative}}", "clip": ["4", 1]}},
+  "3": {"class_type": "KSampler", "inputs": {"seed": "{{seed}}", "steps": "{{steps}}", "cfg": 7, "sampler_name": "euler", "scheduler": "normal", "denoise": 1,
+        "model": ["4", 0], "positive": ["6", 0], "negative": ["7", 0], "latent_image": ["5", 0]}},
+  "8": {"class_type": "VAEDecode", "inputs": {"samples": ["3", 0], "vae": ["4", 2]}},
+  "9": {"class_type": "SaveImage", "inputs": {"filename_prefix": "helix", "images": ["8", 0]}}
+}`
+
+// comfyWorkflow fills the placeholders of the configured or default
+// workflow. A string that is only a numeric placeholder becomes a number.
+func comfyWorkflow(req imageRequest) (map[string]interface{}, error) {
+	text := defaultComfyUIWorkflow
+	if p := config.ImageGen.ComfyUIWorkflow; p != "" {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("reading ComfyUI workflow: %v", err)
+		}
+		text = string(data)
+	} else if req.Model == "" {
+		return nil, kindError(ErrConfig, "--model is required with comfyui: the checkpoint file name, such as sd_xl_base_1.0.safetensors")
+	}
+	var graph map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &graph); err != nil {
+		return nil, fmt.Errorf("parsing ComfyUI workflow: %v", err)
+	}
+	numbers := map[string]int64{"{{seed}}": req.Seed, "{{width}}": int64(req.Width), "{{height}}": int64(req.Height), "{{steps}}": int64(req.Steps), "{{batch}}": int64(req.N)}
+	strs := strings.NewReplacer("{{prompt}}", req.Prompt, "{{negative}}", req.Negative, "{{model}}", req.Model)
+	var fill func(v interface{}) interface{}
+	fill = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case string:
+			if n, ok := numbers[v]; ok {
+				return n
+			}
+			return strs.Replace(v)
+		case map[string]interface{}:
+			for k, e := range v {
+				v[k] = fill(e)
+			}
+		case []interface{}:
+			for i, e := range v {
+				v[i] = fill(e)
+			}
+		}
+		return v
+	}
+	fill(graph)
+	return graph, nil
+}
+
+func generateComfyUI(ctx context.Context, req imageRequest) ([]generatedImage, error) {
+	base := strings.TrimRight(config.ImageGen.ComfyUIURL, "/")
+	if base == "" {
+		base = "http://127.0.0.1:8188"
+	}
+	graph, err := comfyWorkflow(req)
+	if err != nil {
+		return nil, err
+	}
+	var queued struct {
+		PromptID string `json:"prompt_id"`
+	}
+	if err := postJSON(ctx, "ComfyUI", base+"/prompt", nil, map[string]interface{}{"prompt": graph}, &queued); err != nil {
+		return nil, err
+	}
+
+	type comfyImage struct {
+		Filename  string `json:"filename"`
+		Subfolder string `json:"subfolder"`
+		Type      string `json:"type"`
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	for {
+		var history map[string]struct {
+			Outputs map[string]struct {
+				Images []comfyImage `json:"images"`
+			} `json:"outputs"`
+			Status struct {
+				Completed bool   `json:"completed"`
+				Status    string `json:"status_str"`
+			} `json:"status"`
+		}
+		if err := getJSON(ctx, "ComfyUI", base+"/history/"+url.PathEscape(queued.PromptID), nil, &history); err != nil {
+			return nil, err
+		}
+		if h, ok := history[queued.PromptID]; ok {
+			if h.Status.Status == "error" {
+				return nil, fmt.Errorf("ComfyUI failed to run the workflow; see its log")
+			}
+			if h.Status.Completed || len(h.Outputs) > 0 {
+				var nodes []string
+				for id := range h.Outputs {
+					nodes = append(nodes, id)
+				}
+				sort.Strings(nodes)
+				var images []generatedImage
+				for _, id := range nodes {
+					for _, img := range h.Outputs[id].Images {
+						if img.Type == "temp" {
+							continue // previews, not saved outputs
+						}
+						q := url.Values{"filename": {img.Filename}, "subfolder": {img.Subfolder}, "type": {img.Type}}
+						data, err := getBytes(ctx, base+"/view?"+q.Encode())
+						if err != nil {
+							return nil, fmt.Errorf("fetching ComfyUI image: %v", err)
+						}
+						images = append(images, generatedImage{data, strings.ToLower(filepath.Ext(img.Filename))})
+					}
+				}
+				return images, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, kindError(ErrTimeout, "ComfyUI did not finish prompt %s in time", queued.PromptID)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func postJSON(ctx context.Context, name, url string, headers map[string]string, payload, out interface{}) error {
+	data, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("building %s request: %v", name, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return kindError(ErrUnreachable, "connecting to %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return providerError(name, resp, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("parsing %s response: %v", name, err)
+	}
+	return nil
+}
+
+func getBytes(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
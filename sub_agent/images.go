@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ImageInput is an image attached to a task. Data is base64 in JSON.
+type ImageInput struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+// readImage loads an image file and sniffs its MIME type.
+func readImage(path string) (ImageInput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ImageInput{}, fmt.Errorf("reading image: %v", err)
+	}
+	mime := http.DetectContentType(data)
+	if !strings.HasPrefix(mime, "image/") {
+		return ImageInput{}, fmt.Errorf("%s does not look like an image (detected %s)", path, mime)
+	}
+	return ImageInput{MIMEType: mime, Data: data}, nil
+}
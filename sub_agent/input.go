@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// inputReserveTokens is kept free for the task text and delimiters when
+// sizing the input block.
+const inputReserveTokens = 64
+
+// readPipedInput returns stdin when it is a pipe or file rather than a
+// terminal, or "" when there is none.
+func readPipedInput() (string, error) {
+	if isTerminal(os.Stdin) {
+		return "", nil
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("reading stdin: %v", err)
+	}
+	return string(data), nil
+}
+
+// attachInput appends req.Input to the task as a delimited block, trimming
+// it to what the window leaves after the task and the output reserve. It
+// returns a warning when the input had to be cut.
+func (r *runner) attachInput(req *TaskRequest) string {
+	if strings.TrimSpace(req.Input) == "" {
+		req.Input = ""
+		return ""
+	}
+	window := r.context.window
+	if window == 0 {
+		window = contextWindow(req.Provider, req.Model)
+	}
+	budget := window - r.context.reserveTokens - estimateTokens(req.Task) - inputReserveTokens
+	if budget < 256 {
+		budget = 256
+	}
+
+	input, warning := strings.TrimRight(req.Input, "\n"), ""
+	if tokens := estimateTokens(input); tokens > budget {
+		// Logs and stack traces usually matter most at the end, so keep a
+		// third of the budget from the start and the rest from the end.
+		runes := []rune(input)
+		keep := budget * charsPerToken
+		head := keep / 3
+		cut := tokens - budget
+		input = string(runes[:head]) + fmt.Sprintf("\n[... %d tokens truncated ...]\n", cut) + string(runes[len(runes)-(keep-head):])
+		warning = fmt.Sprintf("input is ~%d tokens; truncated %d to fit the %d-token window", tokens, cut, window)
+	}
+	req.attach("<input>\n" + input + "\n</input>")
+	req.Input = ""
+	return warning
+}
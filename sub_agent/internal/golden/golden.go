@@ -0,0 +1,257 @@
+// Package golden checks an agent loop against golden transcripts: a task,
+// the reply a mock provider gives to each call in order, what each
+// scripted tool returns, and the tool calls and answer the run must come
+// to. Running the loop is left to the caller; see Script and Check.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transcript is one golden run.
+type Transcript struct {
+	Name string `json:"name,omitempty"` // default: the file name
+	Task string `json:"task"`
+	// Args are runner flags for the run, such as ["--max-tool-steps", "2"].
+	Args    []string        `json:"args,omitempty"`
+	Replies []Reply         `json:"replies"`
+	Tools   map[string]Tool `json:"tools,omitempty"`
+	Expect  Expect          `json:"expect"`
+}
+
+// Reply is one mock provider reply: text, or a tool call, which is
+// written as the model would write it. A plain JSON string is text.
+type Reply struct {
+	Text     string `json:"text,omitempty"`
+	ToolCall *Call  `json:"tool_call,omitempty"`
+}
+
+func (r *Reply) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &r.Text)
+	}
+	type plain Reply
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// Message is the reply as the model's output, with a tool call in a
+// tool_call fence.
+func (r Reply) Message() string {
+	if r.ToolCall == nil {
+		return r.Text
+	}
+	call, _ := json.Marshal(r.ToolCall)
+	return strings.TrimSpace(r.Text + "\n```tool_call\n" + string(call) + "\n```")
+}
+
+// Tool is a scripted tool: successive calls return successive results.
+type Tool struct {
+	Description string       `json:"description,omitempty"`
+	Results     []ToolResult `json:"results"`
+}
+
+type ToolResult struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Expect is what the run must do. ToolCalls must match in order; an
+// input, when given, must be equal as JSON.
+type Expect struct {
+	ToolCalls      []Call   `json:"tool_calls"`
+	Answer         string   `json:"answer,omitempty"`
+	AnswerContains []string `json:"answer_contains,omitempty"`
+	Error          string   `json:"error,omitempty"` // a substring of the run's error
+}
+
+type Call struct {
+	Tool  string          `json:"tool"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// Script plays a transcript's replies and tool results back in order, to
+// a run that may call it from several goroutines.
+type Script struct {
+	t Transcript
+
+	mu    sync.Mutex
+	calls int
+	tools map[string]int
+}
+
+func NewScript(t Transcript) *Script {
+	return &Script{t: t, tools: map[string]int{}}
+}
+
+// Reply returns the text of the next provider call.
+func (s *Script) Reply() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls > len(s.t.Replies) {
+		return "", fmt.Errorf("the transcript has no reply for provider call %d", s.calls)
+	}
+	return s.t.Replies[s.calls-1].Message(), nil
+}
+
+// Calls is how many provider calls the run has made.
+func (s *Script) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// ToolResult returns the result of the next call of the named tool.
+func (s *Script) ToolResult(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := s.t.Tools[name].Results
+	n := s.tools[name]
+	if n >= len(results) {
+		return "", fmt.Errorf("the transcript has no result for call %d of %s", n+1, name)
+	}
+	s.tools[name]++
+	r := results[n]
+	if r.Error != "" {
+		return "", fmt.Errorf("%s", r.Error)
+	}
+	return r.Output, nil
+}
+
+// Outcome is what a run did.
+type Outcome struct {
+	ToolCalls []Call
+	Answer    string
+	Err       error
+}
+
+// Check returns what o, the outcome of t's run with script s, has
+// different from t's expectations.
+func Check(t Transcript, s *Script, o Outcome) []string {
+	var diffs []string
+	e := t.Expect
+	for i := 0; i < max(len(e.ToolCalls), len(o.ToolCalls)); i++ {
+		switch {
+		case i >= len(o.ToolCalls):
+			diffs = append(diffs, fmt.Sprintf("tool call %d: expected %s, but the run made only %d", i+1, e.ToolCalls[i].Tool, len(o.ToolCalls)))
+		case i >= len(e.ToolCalls):
+			diffs = append(diffs, fmt.Sprintf("tool call %d: unexpected call to %s %s", i+1, o.ToolCalls[i].Tool, o.ToolCalls[i].Input))
+		case e.ToolCalls[i].Tool != o.ToolCalls[i].Tool:
+			diffs = append(diffs, fmt.Sprintf("tool call %d: expected %s, got %s", i+1, e.ToolCalls[i].Tool, o.ToolCalls[i].Tool))
+		case len(e.ToolCalls[i].Input) > 0 && !sameJSON(e.ToolCalls[i].Input, o.ToolCalls[i].Input):
+			diffs = append(diffs, fmt.Sprintf("tool call %d: %s got input %s, expected %s", i+1, e.ToolCalls[i].Tool, o.ToolCalls[i].Input, e.ToolCalls[i].Input))
+		}
+	}
+	switch {
+	case o.Err != nil && e.Error == "":
+		diffs = append(diffs, "the run failed: "+o.Err.Error())
+	case o.Err == nil && e.Error != "":
+		diffs = append(diffs, fmt.Sprintf("expected an error containing %q, the run succeeded", e.Error))
+	case o.Err != nil && !strings.Contains(o.Err.Error(), e.Error):
+		diffs = append(diffs, fmt.Sprintf("expected an error containing %q, got %q", e.Error, o.Err.Error()))
+	}
+	if e.Answer != "" && strings.TrimSpace(o.Answer) != strings.TrimSpace(e.Answer) {
+		diffs = append(diffs, fmt.Sprintf("answer: expected %q, got %q", e.Answer, o.Answer))
+	}
+	for _, sub := range e.AnswerContains {
+		if !strings.Contains(o.Answer, sub) {
+			diffs = append(diffs, fmt.Sprintf("answer doesn't contain %q: %q", sub, o.Answer))
+		}
+	}
+	if o.Err != nil {
+		return diffs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(t.Replies) - s.calls; n > 0 {
+		diffs = append(diffs, fmt.Sprintf("%d reply(ies) unused: the run made %d provider call(s)", n, s.calls))
+	}
+	for _, name := range sortedKeys(t.Tools) {
+		if n := len(t.Tools[name].Results) - s.tools[name]; n > 0 {
+			diffs = append(diffs, fmt.Sprintf("%d result(s) of %s unused", n, name))
+		}
+	}
+	return diffs
+}
+
+// Update rewrites t's expectations to what o did.
+func (t *Transcript) Update(o Outcome) {
+	t.Expect.ToolCalls = append([]Call{}, o.ToolCalls...)
+	t.Expect.Answer, t.Expect.Error = o.Answer, ""
+	if o.Err != nil {
+		t.Expect.Error = o.Err.Error()
+	}
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Files expands transcript arguments: files, and the .json files of
+// directories.
+func Files(args []string) ([]string, error) {
+	var files []string
+	for _, a := range args {
+		fi, err := os.Stat(a)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, a)
+			continue
+		}
+		found, err := filepath.Glob(filepath.Join(a, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// Read reads a transcript, named after its file unless it has a name.
+func Read(file string) (Transcript, error) {
+	var t Transcript
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, fmt.Errorf("%s: %v", file, err)
+	}
+	if t.Name == "" {
+		t.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return t, nil
+}
+
+// Report is the outcome of one transcript, for helix golden --json.
+type Report struct {
+	Name      string   `json:"name"`
+	File      string   `json:"file"`
+	Passed    bool     `json:"passed"`
+	Diffs     []string `json:"diffs,omitempty"`
+	ToolCalls int      `json:"tool_calls"`
+	Updated   bool     `json:"updated,omitempty"`
+}
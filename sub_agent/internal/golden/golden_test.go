@@ -0,0 +1,116 @@
+package golden
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadAndNameFromFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "lookup.json")
+	os.WriteFile(file, []byte(`{"task": "t", "replies": ["plain", {"text": "calling", "tool_call": {"tool": "search", "input": {"q": "x"}}}], "expect": {"tool_calls": []}}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a transcript"), 0o644)
+
+	files, err := Files([]string{dir})
+	if err != nil || len(files) != 1 || files[0] != file {
+		t.Fatalf("Files = %v, %v", files, err)
+	}
+	tr, err := Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Name != "lookup" {
+		t.Errorf("name %q, want lookup", tr.Name)
+	}
+	if got := tr.Replies[0].Message(); got != "plain" {
+		t.Errorf("reply 1 %q", got)
+	}
+	want := "calling\n```tool_call\n{\"tool\":\"search\",\"input\":{\"q\":\"x\"}}\n```"
+	if got := tr.Replies[1].Message(); got != want {
+		t.Errorf("reply 2 %q, want %q", got, want)
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := NewScript(Transcript{
+		Replies: []Reply{{Text: "one"}},
+		Tools:   map[string]Tool{"search": {Results: []ToolResult{{Output: "hit"}, {Error: "timeout"}}}},
+	})
+	if text, err := s.Reply(); err != nil || text != "one" {
+		t.Errorf("Reply = %q, %v", text, err)
+	}
+	if _, err := s.Reply(); err == nil {
+		t.Error("a second Reply succeeded")
+	}
+	if out, err := s.ToolResult("search"); err != nil || out != "hit" {
+		t.Errorf("ToolResult 1 = %q, %v", out, err)
+	}
+	if _, err := s.ToolResult("search"); err == nil || err.Error() != "timeout" {
+		t.Errorf("ToolResult 2 error = %v, want timeout", err)
+	}
+	if _, err := s.ToolResult("search"); err == nil {
+		t.Error("ToolResult 3 succeeded")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tr := Transcript{
+		Replies: []Reply{{Text: "a"}, {Text: "b"}},
+		Tools:   map[string]Tool{"search": {Results: []ToolResult{{Output: "x"}}}},
+		Expect: Expect{
+			ToolCalls:      []Call{{Tool: "search", Input: json.RawMessage(`{"q": "go"}`)}},
+			Answer:         "Go is a language.",
+			AnswerContains: []string{"language"},
+		},
+	}
+	search := Call{Tool: "search", Input: json.RawMessage(`{"q":"go"}`)}
+	for _, tc := range []struct {
+		name  string
+		calls int // provider calls the run made; all of them use up the tool result too
+		o     Outcome
+		want  []string // substrings of the diffs, in order
+	}{
+		{"pass", 2, Outcome{ToolCalls: []Call{search}, Answer: "Go is a language.\n"}, nil},
+		{"wrong input", 2, Outcome{ToolCalls: []Call{{Tool: "search", Input: json.RawMessage(`{"q":"rust"}`)}}, Answer: "Go is a language."}, []string{"got input"}},
+		{"missing call", 2, Outcome{Answer: "Go is a language."}, []string{"but the run made only 0"}},
+		{"extra call", 2, Outcome{ToolCalls: []Call{search, {Tool: "fetch"}}, Answer: "Go is a language."}, []string{"unexpected call to fetch"}},
+		{"wrong answer", 2, Outcome{ToolCalls: []Call{search}, Answer: "No idea."}, []string{"answer: expected", "doesn't contain"}},
+		{"failed", 1, Outcome{ToolCalls: []Call{search}, Answer: "Go is a language.", Err: errors.New("boom")}, []string{"the run failed: boom"}},
+		{"unused", 1, Outcome{ToolCalls: []Call{search}, Answer: "Go is a language."}, []string{"1 reply(ies) unused", "1 result(s) of search unused"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewScript(tr)
+			for i := 0; i < tc.calls; i++ {
+				s.Reply()
+			}
+			if tc.calls == len(tr.Replies) {
+				s.ToolResult("search")
+			}
+			diffs := Check(tr, s, tc.o)
+			if len(diffs) != len(tc.want) {
+				t.Fatalf("diffs %q, want %d", diffs, len(tc.want))
+			}
+			for i, w := range tc.want {
+				if !strings.Contains(diffs[i], w) {
+					t.Errorf("diff %q doesn't contain %q", diffs[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tr := Transcript{Expect: Expect{Answer: "old", Error: "old"}}
+	o := Outcome{ToolCalls: []Call{{Tool: "search"}}, Answer: "new", Err: errors.New("step limit")}
+	tr.Update(o)
+	if len(tr.Expect.ToolCalls) != 1 || tr.Expect.Answer != "new" || tr.Expect.Error != "step limit" {
+		t.Errorf("Update left %+v", tr.Expect)
+	}
+	if diffs := Check(tr, NewScript(tr), o); len(diffs) != 0 {
+		t.Errorf("an updated transcript fails: %q", diffs)
+	}
+}
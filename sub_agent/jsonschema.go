@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// checkFormat reports whether answer is what format asks for: JSON for
+// "json", or JSON valid against a schema. Text formats and no format
+// always pass. Code fences around the JSON are ignored.
+func checkFormat(format json.RawMessage, answer string) error {
+	if format == nil || textFormat(format) != "" {
+		return nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(stripFences(answer)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("the answer is not JSON: %v", err)
+	}
+	if bytes.Equal(format, formatJSON) {
+		return nil
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(format, &schema); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	return validateSchema(schema, v, "$")
+}
+
+// validateSchema checks v against the parts of JSON Schema that answers are
+// usually constrained with: type, enum, const, properties, required,
+// additionalProperties, items, min/maxItems, min/maxLength and
+// minimum/maximum.
+func validateSchema(s map[string]interface{}, v interface{}, path string) error {
+	if t, ok := s["type"]; ok && !schemaTypeMatches(t, v) {
+		return fmt.Errorf("%s: expected %v, got %s", path, t, jsonTypeName(v))
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, v) {
+		return fmt.Errorf("%s: expected %v", path, c)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jsonEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		required, _ := s["required"].([]interface{})
+		for _, r := range required {
+			if name, _ := r.(string); name != "" {
+				if _, ok := v[name]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]interface{})
+		for _, k := range sortedKeys(v) {
+			if ps, ok := props[k].(map[string]interface{}); ok {
+				if err := validateSchema(ps, v[k], path+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			switch ap := s["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					return fmt.Errorf("%s: unexpected property %q", path, k)
+				}
+			case map[string]interface{}:
+				if err := validateSchema(ap, v[k], path+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if n, ok := schemaNumber(s["minItems"]); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %v items, got %d", path, n, len(v))
+		}
+		if n, ok := schemaNumber(s["maxItems"]); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %v items, got %d", path, n, len(v))
+		}
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := float64(len([]rune(v)))
+		if min, ok := schemaNumber(s["minLength"]); ok && n < min {
+			return fmt.Errorf("%s: shorter than %v characters", path, min)
+		}
+		if max, ok := schemaNumber(s["maxLength"]); ok && n > max {
+			return fmt.Errorf("%s: longer than %v characters", path, max)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if min, ok := schemaNumber(s["minimum"]); ok && f < min {
+			return fmt.Errorf("%s: %v is below the minimum %v", path, v, min)
+		}
+		if max, ok := schemaNumber(s["maximum"]); ok && f > max {
+			return fmt.Errorf("%s: %v is above the maximum %v", path, v, max)
+		}
+	}
+	return nil
+}
+
+// schemaTypeMatches checks v against a type keyword, a name or a list.
+func schemaTypeMatches(t, v interface{}) bool {
+	if list, ok := t.([]interface{}); ok {
+		for _, t := range list {
+			if schemaTypeMatches(t, v) {
+				return true
+			}
+		}
+		return false
+	}
+	name, _ := t.(string)
+	got := jsonTypeName(v)
+	if name == "number" && got == "integer" {
+		return true
+	}
+	return name == got
+}
+
+func jsonTypeName(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// schemaNumber reads a numeric keyword of a schema parsed without
+// UseNumber.
+func schemaNumber(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// jsonEqual compares a schema value with an answer value, whose numbers
+// are json.Numbers.
+func jsonEqual(schemaVal, v interface{}) bool {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		sf, isNum := schemaVal.(float64)
+		return err == nil && isNum && f == sf
+	}
+	return reflect.DeepEqual(schemaVal, v)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Criterion is one thing a judge scores answers on.
+type Criterion struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Weight      float64 `json:"weight,omitempty"` // default 1
+}
+
+// JudgeConfig is the "judge" config section: the default judge model and
+// named rubrics for --rubric.
+type JudgeConfig struct {
+	Model   string                 `json:"model,omitempty"` // provider/model
+	Rubrics map[string][]Criterion `json:"rubrics,omitempty"`
+}
+
+// defaultCriteria are scored when no rubric or criteria are given.
+var defaultCriteria = []Criterion{
+	{Name: "correctness", Description: "The answer is factually and technically right."},
+	{Name: "completeness", Description: "The answer covers everything the task asks for."},
+	{Name: "clarity", Description: "The answer is clear, well organized and to the point."},
+}
+
+// Judgement is a judge's scoring of one answer.
+type Judgement struct {
+	Judge   string           `json:"judge"`
+	Scores  []CriterionScore `json:"scores"`
+	Overall float64          `json:"overall"` // the weighted mean, 0 to 10
+}
+
+type CriterionScore struct {
+	Name   string  `json:"name"`
+	Score  float64 `json:"score"` // 0 to 10
+	Reason string  `json:"reason,omitempty"`
+}
+
+// judge scores answers with a model. It is shared by helix judge and the
+// features that grade answers, such as --speculate-gate judge.
+type judge struct {
+	provider string
+	model    string
+	key      string
+}
+
+// newJudge makes a judge from a provider/model spec; "" is judge.model in
+// the config, or else the fallback provider and model.
+func newJudge(spec, provider, model, key string) (judge, error) {
+	if spec == "" {
+		spec = config.Judge.Model
+	}
+	if spec != "" {
+		choices, err := parseModelChoices(spec)
+		if err != nil {
+			return judge{}, err
+		}
+		if len(choices) != 1 {
+			return judge{}, fmt.Errorf("the judge must be one provider/model, not %q", spec)
+		}
+		provider, model = choices[0].provider, choices[0].model
+	}
+	if provider == "" {
+		provider = "local"
+	}
+	return judge{provider: provider, model: defaultModel(provider, model), key: key}, nil
+}
+
+func (j judge) name() string { return modelChoice{j.provider, j.model}.String() }
+
+const judgePrompt = `You are grading an assistant's answer to a task. Score it from 0 (worst) to 10 (best) on each criterion, independently of the others.
+
+Task:
+%s
+%s
+Answer:
+%s
+
+Criteria:
+%s
+Reply with only a JSON object of the form {"scores": [{"name": "<criterion>", "score": <0-10>, "reason": "<one sentence>"}]}, with one entry per criterion in the order given.`
+
+// score grades answer to task on criteria; reference, when set, is a known
+// good answer to grade against.
+func (j judge) score(ctx context.Context, task, answer, reference string, criteria []Criterion) (*Judgement, error) {
+	if len(criteria) == 0 {
+		criteria = defaultCriteria
+	}
+	var list strings.Builder
+	for _, c := range criteria {
+		fmt.Fprintf(&list, "- %s", c.Name)
+		if c.Description != "" {
+			fmt.Fprintf(&list, ": %s", c.Description)
+		}
+		list.WriteString("\n")
+	}
+	ref := ""
+	if reference != "" {
+		ref = "\nReference answer (known to be good):\n" + reference + "\n"
+	}
+	g := genRequest{Provider: j.provider, Model: j.model, Prompt: fmt.Sprintf(judgePrompt, task, ref, answer, list.String()), Format: formatJSON}
+	if checkConstraints(g) != nil {
+		// The prompt asks for JSON anyway.
+		g.Format = nil
+	}
+	out, err := generateRequest(ctx, g, j.key)
+	if err != nil {
+		return nil, fmt.Errorf("judge %s: %w", j.name(), err)
+	}
+	var reply struct {
+		Scores []CriterionScore `json:"scores"`
+	}
+	if err := json.Unmarshal([]byte(jsonObject(cleanOutput(out))), &reply); err != nil {
+		return nil, fmt.Errorf("judge %s did not reply with scores: %v", j.name(), err)
+	}
+	byName := map[string]CriterionScore{}
+	for _, s := range reply.Scores {
+		byName[strings.ToLower(strings.TrimSpace(s.Name))] = s
+	}
+	jm := &Judgement{Judge: j.name()}
+	var total, weights float64
+	for _, c := range criteria {
+		s, ok := byName[strings.ToLower(c.Name)]
+		if !ok {
+			return nil, fmt.Errorf("judge %s did not score %q", j.name(), c.Name)
+		}
+		s.Name, s.Score = c.Name, min(max(s.Score, 0), 10)
+		jm.Scores = append(jm.Scores, s)
+		w := c.Weight
+		if w <= 0 {
+			w = 1
+		}
+		total += w * s.Score
+		weights += w
+	}
+	jm.Overall = total / weights
+	return jm, nil
+}
+
+// jsonObject is the outermost {...} in s, which models often wrap in a
+// code fence or a sentence.
+func jsonObject(s string) string {
+	start, end := strings.Index(s, "{"), strings.LastIndex(s, "}")
+	if start < 0 || end < start {
+		return s
+	}
+	return s[start : end+1]
+}
+
+// loadCriteria resolves helix judge's --criteria, --rubric and --rubric-file.
+func loadCriteria(names, rubric, rubricFile string) ([]Criterion, error) {
+	set := 0
+	for _, s := range []string{names, rubric, rubricFile} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("--criteria, --rubric and --rubric-file are mutually exclusive")
+	}
+	switch {
+	case names != "":
+		var cs []Criterion
+		for _, n := range strings.Split(names, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				cs = append(cs, Criterion{Name: n})
+			}
+		}
+		return cs, nil
+	case rubric != "":
+		cs, ok := config.Judge.Rubrics[rubric]
+		if !ok {
+			return nil, fmt.Errorf("no rubric %q in the config's judge.rubrics", rubric)
+		}
+		return cs, nil
+	case rubricFile != "":
+		data, err := os.ReadFile(rubricFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading rubric: %v", err)
+		}
+		var cs []Criterion
+		if err := json.Unmarshal(data, &cs); err != nil {
+			return nil, fmt.Errorf("parsing rubric %s: expected a JSON array of {\"name\", \"description\", \"weight\"}: %v", rubricFile, err)
+		}
+		return cs, nil
+	}
+	return nil, nil
+}
+
+// judgeCommand implements `judge`: score an answer to a task.
+func judgeCommand(fs *flag.FlagSet) func(args []string) {
+	kf := addKeyFlags(fs)
+	judgeSpec := fs.String("judge", "", "Provider/model that scores the answer (defaults to judge.model in the config, or the local model)")
+	runID := fs.String("run", "", "Score the answer of this recorded run (see helix replay --list) and save the scores with it for helix export")
+	taskText := fs.String("task", "", "The task the answer is for")
+	taskFile := fs.String("task-file", "", "File holding the task")
+	answerFile := fs.String("answer-file", "-", "File holding the answer ('-' for stdin)")
+	refFile := fs.String("reference-file", "", "File holding a known good answer to score against")
+	criteria := fs.String("criteria", "", "Comma-separated criteria to score (default correctness, completeness and clarity)")
+	rubric := fs.String("rubric", "", "Named rubric from judge.rubrics in the config")
+	rubricFile := fs.String("rubric-file", "", "JSON file with a list of criteria, each with a name, description and weight")
+	minScore := fs.Float64("min-score", 0, "Exit with status 1 if the overall score is below this")
+	fs.BoolVar(&jsonOut, "json", false, "Print the scores as JSON")
+	return func(args []string) {
+		var entry *HistoryEntry
+		var store *historyStore
+		if *runID != "" {
+			if *taskText != "" || *taskFile != "" || flagWasSet(fs, "answer-file") {
+				fatal(kindError(ErrConfig, "--run takes the task and the answer from the run; drop --task, --task-file and --answer-file"))
+			}
+			var err error
+			if store, err = openHistory(); err != nil {
+				fatal(configError(err))
+			}
+			if entry, err = store.load(*runID); err != nil {
+				fatal(configError(err))
+			}
+			if entry.Result.Output == "" {
+				fatal(kindError(ErrConfig, "run %s has no answer to score", entry.ID))
+			}
+		}
+		task := *taskText
+		if entry != nil {
+			task = entry.Request.Task
+		}
+		if *taskFile != "" {
+			if task != "" {
+				fatal(kindError(ErrConfig, "--task and --task-file are mutually exclusive"))
+			}
+			var err error
+			if task, err = readInput(*taskFile); err != nil {
+				fatal(configError(err))
+			}
+		}
+		if task == "" {
+			fatal(kindError(ErrConfig, "--task or --task-file is required"))
+		}
+		var answer string
+		var err error
+		if entry != nil {
+			answer = entry.Result.Output
+		} else if answer, err = readInput(*answerFile); err != nil {
+			fatal(configError(err))
+		}
+		reference := ""
+		if *refFile != "" {
+			if reference, err = readInput(*refFile); err != nil {
+				fatal(configError(err))
+			}
+		}
+		cs, err := loadCriteria(*criteria, *rubric, *rubricFile)
+		if err != nil {
+			fatal(configError(err))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		j, err := newJudge(*judgeSpec, "", "", key)
+		if err != nil {
+			fatal(configError(err))
+		}
+		jm, err := j.score(context.Background(), task, answer, reference, cs)
+		if err != nil {
+			fatal(redactErr(err))
+		}
+		if entry != nil {
+			entry.Judgement = jm
+			if err := store.save(entry); err != nil {
+				fatal(fmt.Errorf("saving the scores with run %s: %v", entry.ID, err))
+			}
+		}
+		if jsonOut {
+			printJSON(jm)
+		} else {
+			statusf("[Sub-Agent] Judge: %s\n", jm.Judge)
+			for _, s := range jm.Scores {
+				fmt.Printf("%-16s %4.1f  %s\n", s.Name, s.Score, s.Reason)
+			}
+			fmt.Printf("%-16s %4.1f\n", "overall", jm.Overall)
+		}
+		if jm.Overall < *minScore {
+			statusf("[Sub-Agent] Overall score %.1f is below --min-score %.1f\n", jm.Overall, *minScore)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"helix-agent-go/orchestrator"
+)
+
+// KubernetesConfig runs sub-agents (debate agents, plan steps) as
+// Kubernetes Jobs when --kube-jobs is set. The pods get provider
+// credentials from EnvSecrets, not from this process.
+type KubernetesConfig struct {
+	Image          string                     `json:"image"`
+	Namespace      string                     `json:"namespace,omitempty"` // default: this pod's, else "default"
+	ServiceAccount string                     `json:"service_account,omitempty"`
+	Resources      orchestrator.KubeResources `json:"resources"`
+	Env            map[string]string          `json:"env,omitempty"`
+	EnvSecrets     []string                   `json:"env_secrets,omitempty"`
+	Args           []string                   `json:"args,omitempty"` // extra helix flags for every Job
+
+	// APIServer, TokenFile and CAFile reach the cluster from outside it
+	// (api_server "http://127.0.0.1:8001" with kubectl proxy); by default
+	// the pod's service account is used.
+	APIServer string `json:"api_server,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+	CAFile    string `json:"ca_file,omitempty"`
+}
+
+// newKubeJob returns the Job template sub-agents are launched from.
+func newKubeJob(c KubernetesConfig) (*orchestrator.KubeJob, error) {
+	if c.Image == "" {
+		return nil, fmt.Errorf("--kube-jobs needs kubernetes.image in the config")
+	}
+	var client *orchestrator.KubeClient
+	var err error
+	if c.APIServer != "" {
+		client, err = orchestrator.NewKubeClient(c.APIServer, c.TokenFile, c.CAFile)
+	} else {
+		client, err = orchestrator.InClusterClient()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ns := c.Namespace
+	if ns == "" {
+		ns = orchestrator.InClusterNamespace()
+	}
+	if ns == "" {
+		ns = "default"
+	}
+	return &orchestrator.KubeJob{
+		Client:         client,
+		Namespace:      ns,
+		Image:          c.Image,
+		Args:           c.Args,
+		Env:            c.Env,
+		EnvSecrets:     c.EnvSecrets,
+		ServiceAccount: c.ServiceAccount,
+		Resources:      c.Resources,
+	}, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KubectlToolConfig scopes the kubectl tools, which --tools kubectl (or
+// kubectl.get and so on) enables. They only read: get, describe and logs.
+type KubectlToolConfig struct {
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	// Namespaces the model may look at; the first is the default. Empty
+	// confines it to the context's namespace, "*" allows every one.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Secrets lets get and describe read Secrets, which are refused
+	// otherwise since their data would go to the model.
+	Secrets bool   `json:"secrets,omitempty"`
+	Timeout string `json:"timeout,omitempty"` // default 30s
+}
+
+// Logs returned when the model doesn't ask for a number of lines, and the
+// most it may ask for.
+const (
+	kubectlDefaultTail = 200
+	kubectlMaxTail     = 2000
+)
+
+var (
+	kubeNameRe     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	kubeResourceRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9.-]*(/[a-z0-9]([-a-z0-9.]*[a-z0-9])?)?$`)
+	kubeSelectorRe = regexp.MustCompile(`^[a-zA-Z0-9_./=!,() -]+$`)
+)
+
+// kubectlTools builds the tool pack.
+func kubectlTools(string) ([]tool, error) {
+	c := config.Tools.Kubectl
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return nil, fmt.Errorf("kubectl not found")
+	}
+	timeout := 30 * time.Second
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+		}
+		timeout = d
+	}
+	for _, ns := range c.Namespaces {
+		if ns != "*" && !kubeNameRe.MatchString(ns) {
+			return nil, fmt.Errorf("tools.kubectl.namespaces: invalid namespace %q", ns)
+		}
+	}
+	k := &kubectl{cfg: c, timeout: timeout}
+	return []tool{
+		&kubectlTool{k: k, verb: "get"},
+		&kubectlTool{k: k, verb: "describe"},
+		&kubectlTool{k: k, verb: "logs"},
+	}, nil
+}
+
+type kubectl struct {
+	cfg     KubectlToolConfig
+	timeout time.Duration
+}
+
+// kubectlTool is one verb of the pack.
+type kubectlTool struct {
+	k    *kubectl
+	verb string
+}
+
+func (*kubectlTool) readOnly() bool { return true }
+
+const kubectlScopeSchema = `"namespace": {"type": "string", "description": "Namespace (defaults to the configured one)"}`
+
+func (t *kubectlTool) spec() toolSpec {
+	s := toolSpec{Name: "kubectl." + t.verb}
+	switch t.verb {
+	case "get":
+		s.Description = "List Kubernetes resources or show one, as kubectl get does. Use resource \"events\" to see recent events."
+		s.InputSchema = json.RawMessage(`{"type": "object", "properties": {
+  "resource": {"type": "string", "description": "Resource type, e.g. pods, deployments, events, or type/name"},
+  "name": {"type": "string"},
+  ` + kubectlScopeSchema + `,
+  "all_namespaces": {"type": "boolean"},
+  "selector": {"type": "string", "description": "Label selector, e.g. app=web"},
+  "output": {"type": "string", "enum": ["", "wide", "yaml", "json"]}
+}, "required": ["resource"]}`)
+	case "describe":
+		s.Description = "Describe Kubernetes resources in detail, with their recent events, as kubectl describe does."
+		s.InputSchema = json.RawMessage(`{"type": "object", "properties": {
+  "resource": {"type": "string", "description": "Resource type, e.g. pod, node, or type/name"},
+  "name": {"type": "string"},
+  ` + kubectlScopeSchema + `,
+  "selector": {"type": "string", "description": "Label selector, e.g. app=web"}
+}, "required": ["resource"]}`)
+	case "logs":
+		s.Description = "Show the last lines of a pod's container logs, as kubectl logs does."
+		s.InputSchema = json.RawMessage(`{"type": "object", "properties": {
+  "pod": {"type": "string", "description": "Pod name, or type/name such as deployment/web"},
+  ` + kubectlScopeSchema + `,
+  "container": {"type": "string"},
+  "previous": {"type": "boolean", "description": "Logs of the previous, crashed instance"},
+  "tail": {"type": "integer", "description": "Number of lines (default ` + strconv.Itoa(kubectlDefaultTail) + `, at most ` + strconv.Itoa(kubectlMaxTail) + `)"},
+  "since": {"type": "string", "description": "Only lines newer than this, e.g. 10m"}
+}, "required": ["pod"]}`)
+	}
+	return s
+}
+
+type kubectlInput struct {
+	Resource      string `json:"resource"`
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace"`
+	AllNamespaces bool   `json:"all_namespaces"`
+	Selector      string `json:"selector"`
+	Output        string `json:"output"`
+	Pod           string `json:"pod"`
+	Container     string `json:"container"`
+	Previous      bool   `json:"previous"`
+	Tail          int    `json:"tail"`
+	Since         string `json:"since"`
+}
+
+// args validates the model's input and turns it into kubectl arguments.
+// Nothing the model passes can start with "-", so it can't add flags.
+func (t *kubectlTool) args(input json.RawMessage) ([]string, error) {
+	var in kubectlInput
+	if len(input) > 0 && string(input) != "null" {
+		if err := json.Unmarshal(input, &in); err != nil {
+			return nil, fmt.Errorf("invalid input: %v", err)
+		}
+	}
+	args := []string{t.verb}
+	switch t.verb {
+	case "get", "describe":
+		if !kubeResourceRe.MatchString(in.Resource) {
+			return nil, fmt.Errorf("invalid resource %q", in.Resource)
+		}
+		if !t.k.cfg.Secrets && isKubeSecret(in.Resource) {
+			return nil, fmt.Errorf("reading Secrets is not allowed (tools.kubectl.secrets)")
+		}
+		args = append(args, in.Resource)
+		if in.Name != "" {
+			if !kubeNameRe.MatchString(in.Name) {
+				return nil, fmt.Errorf("invalid name %q", in.Name)
+			}
+			args = append(args, in.Name)
+		}
+		if in.Selector != "" {
+			if !kubeSelectorRe.MatchString(in.Selector) {
+				return nil, fmt.Errorf("invalid selector %q", in.Selector)
+			}
+			args = append(args, "--selector="+in.Selector)
+		}
+		if t.verb == "get" {
+			switch in.Output {
+			case "":
+			case "wide", "yaml", "json":
+				args = append(args, "--output="+in.Output)
+			default:
+				return nil, fmt.Errorf("invalid output %q: expected wide, yaml or json", in.Output)
+			}
+		}
+	case "logs":
+		if !kubeResourceRe.MatchString(in.Pod) {
+			return nil, fmt.Errorf("invalid pod %q", in.Pod)
+		}
+		args = append(args, in.Pod)
+		if in.Container != "" {
+			if !kubeNameRe.MatchString(in.Container) {
+				return nil, fmt.Errorf("invalid container %q", in.Container)
+			}
+			args = append(args, "--container="+in.Container)
+		}
+		if in.Previous {
+			args = append(args, "--previous")
+		}
+		tail := in.Tail
+		if tail <= 0 {
+			tail = kubectlDefaultTail
+		}
+		if tail > kubectlMaxTail {
+			tail = kubectlMaxTail
+		}
+		args = append(args, "--tail="+strconv.Itoa(tail))
+		if in.Since != "" {
+			if _, err := time.ParseDuration(in.Since); err != nil {
+				return nil, fmt.Errorf("invalid since %q: %v", in.Since, err)
+			}
+			args = append(args, "--since="+in.Since)
+		}
+	}
+	scope, err := t.k.namespace(in.Namespace, in.AllNamespaces && t.verb == "get")
+	if err != nil {
+		return nil, err
+	}
+	return append(t.k.globalArgs(), append(args, scope...)...), nil
+}
+
+// isKubeSecret reports whether resource names Secrets, by any of the names
+// kubectl accepts for them.
+func isKubeSecret(resource string) bool {
+	kind, _, _ := strings.Cut(strings.ToLower(resource), "/")
+	kind, _, _ = strings.Cut(kind, ".")
+	return kind == "secret" || kind == "secrets"
+}
+
+// namespace checks ns against the configured namespaces and returns the
+// flag selecting it.
+func (k *kubectl) namespace(ns string, all bool) ([]string, error) {
+	allowed := k.cfg.Namespaces
+	every := len(allowed) == 1 && allowed[0] == "*"
+	if all {
+		if !every {
+			return nil, fmt.Errorf("listing every namespace is not allowed; use one of %s", k.namespaces())
+		}
+		return []string{"--all-namespaces"}, nil
+	}
+	if ns == "" {
+		if len(allowed) == 0 || every {
+			return nil, nil
+		}
+		ns = allowed[0]
+	}
+	if !kubeNameRe.MatchString(ns) {
+		return nil, fmt.Errorf("invalid namespace %q", ns)
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("only the context's default namespace is allowed; leave namespace out")
+	}
+	if !every && !slices.Contains(allowed, ns) {
+		return nil, fmt.Errorf("namespace %s is not allowed; use one of %s", ns, k.namespaces())
+	}
+	return []string{"--namespace=" + ns}, nil
+}
+
+func (k *kubectl) namespaces() string {
+	if len(k.cfg.Namespaces) == 0 {
+		return "the context's default"
+	}
+	return strings.Join(k.cfg.Namespaces, ", ")
+}
+
+func (k *kubectl) globalArgs() []string {
+	var args []string
+	if k.cfg.Kubeconfig != "" {
+		args = append(args, "--kubeconfig="+k.cfg.Kubeconfig)
+	}
+	if k.cfg.Context != "" {
+		args = append(args, "--context="+k.cfg.Context)
+	}
+	return args
+}
+
+func (t *kubectlTool) describe(input json.RawMessage) string {
+	args, err := t.args(input)
+	if err != nil {
+		return ""
+	}
+	return "Running " + truncateRunes("kubectl "+strings.Join(args, " "), 80)
+}
+
+func (t *kubectlTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	args, err := t.args(input)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.k.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	stdout, stderr := &cappedBuffer{max: maxToolOutput}, &cappedBuffer{max: maxToolOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("timed out after %s", t.k.timeout)
+		}
+		return "", fmt.Errorf("kubectl %s: %v: %s", t.verb, err, strings.TrimSpace(stderr.String()))
+	}
+	if strings.TrimSpace(stdout.String()) == "" {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return msg, nil // "No resources found in default namespace."
+		}
+	}
+	return toolOutput(stdout.String())
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// How an answer over its length limit is brought under it.
+const (
+	LengthTruncate = "truncate" // cut it off at the limit, with a marker
+	LengthCondense = "condense" // have the model shorten it, truncating if still over
+)
+
+// lengthLimit caps the answer at words and lines; 0 is no cap. The model
+// is told the limit, as "a one-paragraph summary" often comes back as
+// three pages anyway; an answer still over it is dealt with per enforce.
+type lengthLimit struct {
+	words, lines int
+	enforce      string
+}
+
+// LengthReport is how an answer measured up to --max-words and
+// --max-lines.
+type LengthReport struct {
+	Words    int    `json:"words"` // of the answer as the model first gave it
+	Lines    int    `json:"lines"`
+	MaxWords int    `json:"max_words,omitempty"`
+	MaxLines int    `json:"max_lines,omitempty"`
+	Action   string `json:"action,omitempty"` // condensed and/or truncated, when it was over
+}
+
+const condensePrompt = "Shorten the following answer to at most %s, keeping what matters most for the task. Output only the shortened answer.\n\nTask:\n%s\n\nAnswer:\n%s"
+
+// truncationMarker ends an answer cut off at the limit.
+const truncationMarker = "[…truncated to the length limit]"
+
+func validLengthEnforce(s string) bool {
+	return s == LengthTruncate || s == LengthCondense
+}
+
+// lengthFor is req's limit, or else the runner's.
+func (r *runner) lengthFor(req TaskRequest) lengthLimit {
+	l := r.length
+	if req.MaxWords > 0 {
+		l.words = req.MaxWords
+	}
+	if req.MaxLines > 0 {
+		l.lines = req.MaxLines
+	}
+	if req.LengthEnforce != "" {
+		l.enforce = req.LengthEnforce
+	}
+	return l
+}
+
+func (l lengthLimit) set() bool { return l.words > 0 || l.lines > 0 }
+
+// describe is the limit in words, as in "120 words and 10 lines".
+func (l lengthLimit) describe() string {
+	var parts []string
+	if l.words > 0 {
+		parts = append(parts, fmt.Sprintf("%d words", l.words))
+	}
+	if l.lines > 0 {
+		parts = append(parts, fmt.Sprintf("%d lines", l.lines))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// instruction is the hint appended to the task.
+func (l lengthLimit) instruction() string {
+	return fmt.Sprintf("Length: answer in at most %s. Longer answers will be cut off.", l.describe())
+}
+
+func (l lengthLimit) fits(text string) bool {
+	return (l.words == 0 || countWords(text) <= l.words) && (l.lines == 0 || countLines(text) <= l.lines)
+}
+
+func countWords(s string) int { return len(strings.Fields(s)) }
+
+// countLines counts lines, not counting a trailing newline.
+func countLines(s string) int {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return 0
+	}
+	return strings.Count(s, "\n") + 1
+}
+
+var nonSpaceRe = regexp.MustCompile(`\S+`)
+
+// truncate cuts text to the limit, keeping its layout up to the cut, and
+// marks the cut. The marker doesn't count against the limit.
+func (l lengthLimit) truncate(text string) string {
+	if l.fits(text) {
+		return text
+	}
+	if l.lines > 0 {
+		text = trimLines(strings.TrimRight(text, "\n"), l.lines)
+	}
+	if l.words > 0 {
+		if locs := nonSpaceRe.FindAllStringIndex(text, l.words+1); len(locs) > l.words {
+			text = text[:locs[l.words-1][1]]
+		}
+	}
+	return strings.TrimRight(text, " \t\n") + "\n" + truncationMarker
+}
+
+// enforceLength brings answer under req's limit, condensing it with the
+// task's model or truncating it.
+func (r *runner) enforceLength(ctx context.Context, req TaskRequest, answer string) (string, *LengthReport, error) {
+	l := r.lengthFor(req)
+	if !l.set() {
+		return answer, nil, nil
+	}
+	rep := &LengthReport{Words: countWords(answer), Lines: countLines(answer), MaxWords: l.words, MaxLines: l.lines}
+	if l.fits(answer) {
+		return answer, rep, nil
+	}
+	var actions []string
+	if l.enforce == LengthCondense {
+		setStage(ctx, "condense")
+		logf(ctx, "Answer is %d words, %d lines; condensing it to %s", rep.Words, rep.Lines, l.describe())
+		out, err := generate(ctx, req.Provider, req.Model, fmt.Sprintf(condensePrompt, l.describe(), req.Task, answer), r.key)
+		if err != nil {
+			return "", rep, fmt.Errorf("condensing the answer: %w", err)
+		}
+		answer = cleanOutput(out)
+		actions = append(actions, "condensed")
+	}
+	if !l.fits(answer) {
+		answer = l.truncate(answer)
+		actions = append(actions, "truncated")
+	}
+	rep.Action = strings.Join(actions, ", ")
+	return answer, rep, nil
+}
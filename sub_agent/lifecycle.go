@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainer tracks in-flight generations for the long-running modes. Once
+// draining starts no new work is admitted; running work gets until the drain
+// timeout to finish before its context is cancelled.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+
+	base   context.Context
+	cancel context.CancelFunc
+}
+
+func newDrainer() *drainer {
+	base, cancel := context.WithCancel(context.Background())
+	return &drainer{base: base, cancel: cancel}
+}
+
+// begin admits a unit of work. The returned context is cancelled if either
+// parent is cancelled or the drain timeout expires; done must be called when
+// the work finishes. ok is false once draining has started.
+func (d *drainer) begin(parent context.Context) (ctx context.Context, done func(), ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, nil, false
+	}
+	d.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(d.base, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		d.wg.Done()
+	}, true
+}
+
+// isDraining reports whether shutdown has started.
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// aborted reports whether in-flight work was cut off by the drain timeout.
+func (d *drainer) aborted() bool {
+	return d.base.Err() != nil
+}
+
+// drain stops admitting work and waits for in-flight work to finish. If the
+// timeout passes first, the remaining work is cancelled and drain waits for
+// it to unwind. It returns false if anything had to be cancelled.
+func (d *drainer) drain(timeout time.Duration) bool {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		d.cancel()
+		<-finished
+		return false
+	}
+}
+
+// shutdownSignal returns a context that is cancelled on SIGINT or SIGTERM.
+func shutdownSignal() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultMaxBodyBytes bounds a POST /v1/tasks body when server.limits
+// doesn't; attachments arrive base64-encoded inside it.
+const defaultMaxBodyBytes = 32 << 20
+
+// RequestLimits caps what one serve request may ask for, so that a single
+// runaway client can't tie up the service. Zero means the default for
+// MaxBodyBytes and unlimited for the rest.
+type RequestLimits struct {
+	MaxBodyBytes       int64 `json:"max_body_bytes,omitempty"`       // the whole JSON body (default 32 MiB)
+	MaxPromptBytes     int   `json:"max_prompt_bytes,omitempty"`     // task, input and context files together
+	MaxPromptTokens    int   `json:"max_prompt_tokens,omitempty"`    // the same, estimated in tokens
+	MaxAttachmentBytes int   `json:"max_attachment_bytes,omitempty"` // each image, file or audio clip
+	MaxAttachments     int   `json:"max_attachments,omitempty"`      // images, files and audio together
+	MaxToolSteps       int   `json:"max_tool_steps,omitempty"`       // tool calls per task, capping --max-tool-steps
+}
+
+// LimitError is the body of a response rejecting a request over a limit.
+type LimitError struct {
+	Error     string    `json:"error"`
+	ErrorKind ErrorKind `json:"error_kind"`
+	Limit     string    `json:"limit"` // the server.limits field, e.g. max_prompt_tokens
+	Max       int64     `json:"max"`
+	Actual    int64     `json:"actual"`
+	Field     string    `json:"field,omitempty"` // the part of the request, e.g. images[2]
+}
+
+func (l RequestLimits) bodyBytes() int64 {
+	if l.MaxBodyBytes > 0 {
+		return l.MaxBodyBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+// check vets req against l, returning why it is rejected or nil. A request
+// leaving MaxToolSteps unset gets the cap when toolSteps, the runner's
+// --max-tool-steps, is over it.
+func (l RequestLimits) check(req *TaskRequest, toolSteps int) *LimitError {
+	over := func(limit string, max, actual int64, field, what string) *LimitError {
+		return &LimitError{
+			Error:     fmt.Sprintf("%s: %d, over the server's limit of %d", what, actual, max),
+			ErrorKind: ErrTooLarge, Limit: limit, Max: max, Actual: actual, Field: field,
+		}
+	}
+	bytes, tokens := len(req.Task)+len(req.Input), estimateTokens(req.Task)+estimateTokens(req.Input)
+	for _, f := range req.ContextFiles {
+		bytes += len(f.Content)
+		tokens += estimateTokens(f.Content)
+	}
+	if l.MaxPromptBytes > 0 && bytes > l.MaxPromptBytes {
+		return over("max_prompt_bytes", int64(l.MaxPromptBytes), int64(bytes), "", "prompt bytes")
+	}
+	if l.MaxPromptTokens > 0 && tokens > l.MaxPromptTokens {
+		return over("max_prompt_tokens", int64(l.MaxPromptTokens), int64(tokens), "", "estimated prompt tokens")
+	}
+
+	type attachment struct {
+		field string
+		size  int
+	}
+	var attachments []attachment
+	for i, a := range req.Images {
+		attachments = append(attachments, attachment{fmt.Sprintf("images[%d]", i), len(a.Data)})
+	}
+	for i, a := range req.Files {
+		attachments = append(attachments, attachment{fmt.Sprintf("files[%d]", i), len(a.Data)})
+	}
+	for i, a := range req.Audio {
+		attachments = append(attachments, attachment{fmt.Sprintf("audio[%d]", i), len(a.Data)})
+	}
+	if l.MaxAttachments > 0 && len(attachments) > l.MaxAttachments {
+		return over("max_attachments", int64(l.MaxAttachments), int64(len(attachments)), "", "attachments")
+	}
+	if l.MaxAttachmentBytes > 0 {
+		for _, a := range attachments {
+			if a.size > l.MaxAttachmentBytes {
+				return over("max_attachment_bytes", int64(l.MaxAttachmentBytes), int64(a.size), a.field, a.field+" bytes")
+			}
+		}
+	}
+
+	if l.MaxToolSteps > 0 {
+		if req.MaxToolSteps > l.MaxToolSteps {
+			return over("max_tool_steps", int64(l.MaxToolSteps), int64(req.MaxToolSteps), "max_tool_steps", "max_tool_steps")
+		}
+		if req.MaxToolSteps == 0 && toolSteps > l.MaxToolSteps {
+			req.MaxToolSteps = l.MaxToolSteps
+		}
+	}
+	return nil
+}
+
+// status is the HTTP status for e: 413 for sizes, 422 for the rest.
+func (e *LimitError) status() int {
+	if e.Limit == "max_tool_steps" || e.Limit == "max_attachments" {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusRequestEntityTooLarge
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// errInterrupted is returned by readLine when the user presses Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from the terminal with readline-style editing
+// (arrows, Home/End, Ctrl-A/E/U/W) and history. When stdin is not a terminal
+// it falls back to plain line reads.
+type lineEditor struct {
+	in       *bufio.Reader
+	tty      bool
+	history  []string
+	histFile string // "" keeps history in memory only
+}
+
+const maxHistory = 1000
+
+func newLineEditor(histFile string) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(os.Stdin), histFile: histFile}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		e.tty = true
+	}
+	if data, err := os.ReadFile(histFile); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				e.history = append(e.history, line)
+			}
+		}
+		if n := len(e.history); n > maxHistory {
+			e.history = e.history[n-maxHistory:]
+		}
+	}
+	return e
+}
+
+// defaultHistoryFile is $XDG_STATE_HOME/helix/chat_history, falling back
+// to ~/.local/state.
+func defaultHistoryFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "chat_history")
+}
+
+// remember adds line to the history and appends it to the history file.
+func (e *lineEditor) remember(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if e.histFile == "" {
+		return
+	}
+	os.MkdirAll(filepath.Dir(e.histFile), 0700)
+	f, err := os.OpenFile(e.histFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(f, line)
+	f.Close()
+}
+
+// readLine prints prompt and returns the entered line. It returns io.EOF
+// on Ctrl-D at an empty line and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if !e.tty {
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	saved, err := exec.Command("stty", "-g").Output()
+	if err != nil || stty("raw", "-echo") != nil {
+		e.tty = false
+		return e.readLine("")
+	}
+	defer stty(strings.TrimSpace(string(saved)))
+
+	var buf []rune
+	pos := 0
+	hist := len(e.history) // index into history; len means the new line
+	draft := ""
+	redraw := func() {
+		fmt.Printf("\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Printf("\x1b[%dD", back)
+		}
+	}
+	setLine := func(s string) {
+		buf = []rune(s)
+		pos = len(buf)
+		redraw()
+	}
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Print("^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Print("\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+				redraw()
+			}
+		case 1: // Ctrl-A
+			pos = 0
+			redraw()
+		case 5: // Ctrl-E
+			pos = len(buf)
+			redraw()
+		case 21: // Ctrl-U
+			buf, pos = buf[pos:], 0
+			redraw()
+		case 23: // Ctrl-W: delete the word before the cursor
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+			redraw()
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+				redraw()
+			}
+		case 27: // escape sequence
+			seq := e.readEscape()
+			switch seq {
+			case "[A": // up
+				if hist > 0 {
+					if hist == len(e.history) {
+						draft = string(buf)
+					}
+					hist--
+					setLine(e.history[hist])
+				}
+			case "[B": // down
+				if hist < len(e.history) {
+					hist++
+					if hist == len(e.history) {
+						setLine(draft)
+					} else {
+						setLine(e.history[hist])
+					}
+				}
+			case "[C":
+				if pos < len(buf) {
+					pos++
+					redraw()
+				}
+			case "[D":
+				if pos > 0 {
+					pos--
+					redraw()
+				}
+			case "[H", "[1~", "OH":
+				pos = 0
+				redraw()
+			case "[F", "[4~", "OF":
+				pos = len(buf)
+				redraw()
+			case "[3~": // Delete
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+					redraw()
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+				redraw()
+			}
+		}
+	}
+}
+
+// readEscape reads the rest of a CSI or SS3 sequence after ESC.
+func (e *lineEditor) readEscape() string {
+	first, _, err := e.in.ReadRune()
+	if err != nil || (first != '[' && first != 'O') {
+		return ""
+	}
+	seq := []rune{first}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, r)
+		// Final bytes of a control sequence are in @..~; digits and ';'
+		// are parameters.
+		if (r >= 'A' && r <= 'Z') || r == '~' || (r >= 'a' && r <= 'z') {
+			return string(seq)
+		}
+	}
+}
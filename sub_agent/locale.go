@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// LocaleConfig is the caller's locale and time zone, told to the model with
+// the current time so relative dates ("tomorrow morning") mean the
+// caller's. Both default to the environment's: $LC_ALL, $LC_TIME or $LANG,
+// and $TZ or the system zone.
+type LocaleConfig struct {
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	// Inject is false to leave the context out unless --time-context asks.
+	Inject *bool `json:"inject,omitempty"`
+}
+
+// localeContext is the locale, zone and clock a runner tells tasks.
+type localeContext struct {
+	on       bool
+	locale   string
+	timezone string // "" for the local zone
+}
+
+// defaultLocale is the configured locale, or else the one the environment
+// sets, such as en_GB, or "".
+func defaultLocale() string {
+	if config.Locale.Locale != "" {
+		return config.Locale.Locale
+	}
+	for _, name := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		v, _, _ = strings.Cut(v, ".")
+		v, _, _ = strings.Cut(v, "@")
+		if v == "C" || v == "POSIX" {
+			return ""
+		}
+		return v
+	}
+	return ""
+}
+
+// localeFor is req's locale context: its own locale and time zone over the
+// runner's.
+func (r *runner) localeFor(req TaskRequest) localeContext {
+	lc := r.locale
+	if req.Locale != "" {
+		lc.locale, lc.on = req.Locale, true
+	}
+	if req.Timezone != "" {
+		lc.timezone, lc.on = req.Timezone, true
+	}
+	return lc
+}
+
+// instruction states the locale, the zone and the time now in it.
+func (lc localeContext) instruction(now time.Time) (string, error) {
+	loc := time.Local
+	name := os.Getenv("TZ")
+	if lc.timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(lc.timezone); err != nil {
+			return "", fmt.Errorf("invalid time zone %q: %v", lc.timezone, err)
+		}
+		name = lc.timezone
+	}
+	now = now.In(loc)
+	abbr, _ := now.Zone()
+	zone := "UTC" + now.Format("-07:00")
+	if name != "" && name != "Local" {
+		zone = fmt.Sprintf("%s (%s, %s)", name, abbr, zone)
+	} else if abbr != "" && !strings.HasPrefix(abbr, "+") && !strings.HasPrefix(abbr, "-") {
+		zone = fmt.Sprintf("%s (%s)", abbr, zone)
+	}
+	var b strings.Builder
+	b.WriteString("Context: the user's ")
+	if lc.locale != "" {
+		fmt.Fprintf(&b, "locale is %s and ", lc.locale)
+	}
+	fmt.Fprintf(&b, "time zone is %s; it is now %s there. ", zone, now.Format("Monday, 2 January 2006, 15:04"))
+	b.WriteString(`Read relative dates and times such as "tomorrow morning" in that zone`)
+	if lc.locale != "" {
+		b.WriteString(", and write dates, times and numbers the way that locale does")
+	}
+	b.WriteString(".")
+	return b.String(), nil
+}
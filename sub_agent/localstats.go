@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LocalStats is how Ollama spent a run's calls, from the timings it returns
+// with every response. Recorded in the history, it shows a GPU box slowing
+// down or models being evicted long before anyone complains.
+type LocalStats struct {
+	LoadMS       int64 `json:"load_ms"`        // loading the model; seconds after a cold start
+	PromptEvalMS int64 `json:"prompt_eval_ms"` // reading the prompt
+	EvalMS       int64 `json:"eval_ms"`        // generating
+	TotalMS      int64 `json:"total_ms"`
+	PromptTokens int   `json:"prompt_tokens"`
+	EvalTokens   int   `json:"eval_tokens"` // generated, thinking included
+	// TokensPerSec is the generation speed, PromptTokensPerSec that of
+	// reading the prompt.
+	TokensPerSec       float64 `json:"tokens_per_sec"`
+	PromptTokensPerSec float64 `json:"prompt_tokens_per_sec,omitempty"`
+
+	// The durations in nanoseconds, which the rates are worked out from:
+	// in milliseconds, a short eval would round to nothing.
+	promptEvalNS, evalNS int64
+}
+
+// ollamaStats reads the timings of a response, which Ollama gives in
+// nanoseconds.
+func ollamaStats(r OllamaResponse) *LocalStats {
+	if r.TotalDuration == 0 {
+		return nil
+	}
+	s := &LocalStats{}
+	s.add(LocalStats{
+		LoadMS:       r.LoadDuration / 1e6,
+		PromptEvalMS: r.PromptEvalDuration / 1e6,
+		EvalMS:       r.EvalDuration / 1e6,
+		TotalMS:      r.TotalDuration / 1e6,
+		PromptTokens: r.PromptEvalCount,
+		EvalTokens:   r.EvalCount,
+		promptEvalNS: r.PromptEvalDuration,
+		evalNS:       r.EvalDuration,
+	})
+	return s
+}
+
+// add sums o into s and works the rates out again. Stats read back from
+// JSON have only the milliseconds to go by.
+func (s *LocalStats) add(o LocalStats) {
+	if o.promptEvalNS == 0 {
+		o.promptEvalNS = o.PromptEvalMS * 1e6
+	}
+	if o.evalNS == 0 {
+		o.evalNS = o.EvalMS * 1e6
+	}
+	s.promptEvalNS += o.promptEvalNS
+	s.evalNS += o.evalNS
+	s.LoadMS += o.LoadMS
+	s.PromptEvalMS += o.PromptEvalMS
+	s.EvalMS += o.EvalMS
+	s.TotalMS += o.TotalMS
+	s.PromptTokens += o.PromptTokens
+	s.EvalTokens += o.EvalTokens
+	s.TokensPerSec, s.PromptTokensPerSec = 0, 0
+	if s.evalNS > 0 {
+		s.TokensPerSec = float64(s.EvalTokens) / (float64(s.evalNS) / 1e9)
+	}
+	if s.promptEvalNS > 0 {
+		s.PromptTokensPerSec = float64(s.PromptTokens) / (float64(s.promptEvalNS) / 1e9)
+	}
+}
+
+// perfRow is one period and model of `helix perf`.
+type perfRow struct {
+	Period             string  `json:"period"`
+	Model              string  `json:"model"`
+	Runs               int     `json:"runs"`
+	TokensPerSec       float64 `json:"tokens_per_sec"`        // median
+	PromptTokensPerSec float64 `json:"prompt_tokens_per_sec"` // median
+	LoadMS             int64   `json:"load_ms"`               // median
+	ColdStarts         int     `json:"cold_starts"`           // runs that spent 1s or more loading the model
+}
+
+// perfCommand implements `perf`: local inference speed over time, from the
+// run history.
+func perfCommand(fs *flag.FlagSet) func(args []string) {
+	by := fs.String("by", "day", "Period to group runs by: 'hour', 'day' or 'week'")
+	since := fs.Duration("since", 30*24*time.Hour, "How far back to look")
+	mdl := fs.String("model", "", "Only this model")
+	fs.BoolVar(&jsonOut, "json", false, "Print the rows as JSON")
+	return func([]string) {
+		var period func(t time.Time) string
+		switch *by {
+		case "hour":
+			period = func(t time.Time) string { return t.Local().Format("2006-01-02 15:00") }
+		case "day":
+			period = func(t time.Time) string { return t.Local().Format("2006-01-02") }
+		case "week":
+			period = func(t time.Time) string {
+				y, w := t.Local().ISOWeek()
+				return fmt.Sprintf("%d-W%02d", y, w)
+			}
+		default:
+			fatal(kindError(ErrConfig, "invalid --by %q: expected hour, day or week", *by))
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		entries, err := store.list()
+		if err != nil {
+			fatal(err)
+		}
+		type key struct{ period, model string }
+		groups := map[key][]*LocalStats{}
+		cutoff := time.Now().Add(-*since)
+		for _, e := range entries {
+			u := e.Result.Usage
+			if u == nil || u.Local == nil || e.Time.Before(cutoff) || (*mdl != "" && e.Result.Model != *mdl) {
+				continue
+			}
+			k := key{period(e.Time), e.Result.Model}
+			groups[k] = append(groups[k], u.Local)
+		}
+		var rows []perfRow
+		for k, stats := range groups {
+			row := perfRow{Period: k.period, Model: k.model, Runs: len(stats)}
+			var gen, prompt, load []float64
+			for _, s := range stats {
+				gen = append(gen, s.TokensPerSec)
+				prompt = append(prompt, s.PromptTokensPerSec)
+				load = append(load, float64(s.LoadMS))
+				if s.LoadMS >= 1000 {
+					row.ColdStarts++
+				}
+			}
+			row.TokensPerSec, row.PromptTokensPerSec, row.LoadMS = median(gen), median(prompt), int64(median(load))
+			rows = append(rows, row)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Period != rows[j].Period {
+				return rows[i].Period < rows[j].Period
+			}
+			return rows[i].Model < rows[j].Model
+		})
+		if jsonOut {
+			printJSON(rows)
+			return
+		}
+		if len(rows) == 0 {
+			fmt.Println("No local runs recorded in that time.")
+			return
+		}
+		fmt.Printf("%-16s %-24s %5s %8s %13s %8s %5s\n", "PERIOD", "MODEL", "RUNS", "TOK/S", "PROMPT TOK/S", "LOAD MS", "COLD")
+		for _, r := range rows {
+			fmt.Printf("%-16s %-24s %5d %8.1f %13.1f %8d %5d\n", r.Period, r.Model, r.Runs, r.TokensPerSec, r.PromptTokensPerSec, r.LoadMS, r.ColdStarts)
+		}
+	}
+}
+
+// median of xs, which it sorts; 0 for none.
+func median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	sort.Float64s(xs)
+	if n := len(xs); n%2 == 0 {
+		return (xs[n/2-1] + xs[n/2]) / 2
+	}
+	return xs[len(xs)/2]
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const logWindowPrompt = `The following are log lines from %s to %s, part %d of %d of %s. Find the anomalies in them: errors, crashes, timeouts, retries piling up, sudden changes in what is logged, and anything else an on-call engineer would look into. Report each as an object with the fields "time" (RFC 3339, of the first line showing it), "severity" ("high", "medium" or "low"), "summary" (one sentence) and "evidence" (the most telling line, verbatim). Output only a JSON array of these objects, or [] if nothing stands out.
+
+%s`
+
+const logReducePrompt = `The following anomalies were found in %s, window by window, between %s and %s, and below them the most frequent error and warning messages overall. Write an incident summary as a JSON object with the fields "title", "severity" ("high", "medium" or "low"), "start" and "end" (RFC 3339, of the incident rather than the log), "summary" (a short paragraph), "timeline" (an array of {"time", "event"} in order), "suspected_causes" (an array of {"cause", "confidence" ("high", "medium" or "low"), "evidence" (an array of log lines)}, most likely first) and "next_steps" (an array of concrete things to check or do). Output only the JSON object.
+
+Anomalies:
+%s
+
+Frequent messages:
+%s`
+
+// LogAnomaly is something odd `logs analyze` found in one time window.
+type LogAnomaly struct {
+	Time     string `json:"time"`
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Evidence string `json:"evidence,omitempty"`
+}
+
+// LogCluster is a message that recurs with only numbers, IDs and addresses
+// varying, counted before any model sees the log.
+type LogCluster struct {
+	Pattern string    `json:"pattern"`
+	Level   string    `json:"level"`
+	Count   int       `json:"count"`
+	First   time.Time `json:"first,omitempty"`
+	Last    time.Time `json:"last,omitempty"`
+	Sample  string    `json:"sample"`
+}
+
+// IncidentSummary is the result of `logs analyze`.
+type IncidentSummary struct {
+	Title           string           `json:"title"`
+	Severity        string           `json:"severity"`
+	Start           string           `json:"start,omitempty"`
+	End             string           `json:"end,omitempty"`
+	Summary         string           `json:"summary"`
+	Timeline        []IncidentEvent  `json:"timeline"`
+	SuspectedCauses []SuspectedCause `json:"suspected_causes"`
+	NextSteps       []string         `json:"next_steps"`
+
+	// Filled in from the log itself rather than by the model.
+	Source    string       `json:"source"`
+	Lines     int          `json:"lines"`
+	Windows   int          `json:"windows"`
+	Analyzed  int          `json:"analyzed"` // windows sent to the model
+	Anomalies []LogAnomaly `json:"anomalies"`
+	Clusters  []LogCluster `json:"clusters"`
+}
+
+// IncidentEvent is one step of an incident's timeline.
+type IncidentEvent struct {
+	Time  string `json:"time"`
+	Event string `json:"event"`
+}
+
+// SuspectedCause is a possible cause of an incident and the lines behind it.
+type SuspectedCause struct {
+	Cause      string   `json:"cause"`
+	Confidence string   `json:"confidence"`
+	Evidence   []string `json:"evidence,omitempty"`
+}
+
+// logEntry is a log line with the unstamped lines after it (a stack trace,
+// a wrapped message) folded in.
+type logEntry struct {
+	time  time.Time // zero if the line has no timestamp
+	text  string
+	level string // "error", "warn" or ""
+}
+
+var (
+	logStampRes = []*regexp.Regexp{
+		regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`),
+		regexp.MustCompile(`\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?`),
+		regexp.MustCompile(`\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`),
+		regexp.MustCompile(`[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}`),
+	}
+	logStampLayouts = []string{
+		"2006-01-02T15:04:05.999999999Z07:00", "2006-01-02T15:04:05.999999999Z0700", "2006-01-02T15:04:05.999999999",
+		"2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z0700", "2006-01-02 15:04:05.999999999",
+		"2006/01/02 15:04:05.999999999", "02/Jan/2006:15:04:05 -0700", "Jan _2 15:04:05",
+	}
+	logErrorRe = regexp.MustCompile(`(?i)\b(fatal|crit(ical)?|error|err|panic|exception|traceback|level=(error|fatal))\b|\bE[0-9]{4} `)
+	logWarnRe  = regexp.MustCompile(`(?i)\b(warn(ing)?|level=warn(ing)?)\b|\bW[0-9]{4} `)
+
+	// Parts of a message that vary between occurrences of the same one.
+	logVariableRes = []*regexp.Regexp{
+		regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+		regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b`),
+		regexp.MustCompile(`\b0x[0-9a-fA-F]+\b|\b[0-9a-fA-F]{12,}\b`),
+		regexp.MustCompile(`"[^"]*"|'[^']*'`),
+		regexp.MustCompile(`\b\d+(?:\.\d+)?(?:ms|s|µs|ns|m|h|b|kb|mb|%)?\b`),
+	}
+)
+
+// parseLogTime finds the timestamp near the start of line. Syslog stamps
+// carry no year and get year's.
+func parseLogTime(line string, year int) (time.Time, bool) {
+	if strings.HasPrefix(line, "{") {
+		var fields map[string]any
+		if json.Unmarshal([]byte(line), &fields) == nil {
+			for _, k := range []string{"time", "ts", "timestamp", "@timestamp", "t"} {
+				switch v := fields[k].(type) {
+				case string:
+					if t, ok := parseLogTime(v, year); ok {
+						return t, true
+					}
+				case float64:
+					return epochTime(v), true
+				}
+			}
+		}
+	}
+	head := line
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	for _, re := range logStampRes {
+		s := re.FindString(head)
+		if s == "" {
+			continue
+		}
+		s = strings.Replace(s, ",", ".", 1)
+		for _, layout := range logStampLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				if t.Year() == 0 {
+					t = t.AddDate(year, 0, 0)
+				}
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// epochTime reads seconds, milliseconds or microseconds since the epoch.
+func epochTime(v float64) time.Time {
+	switch {
+	case v > 1e14:
+		return time.UnixMicro(int64(v)).UTC()
+	case v > 1e11:
+		return time.UnixMilli(int64(v)).UTC()
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9)).UTC()
+}
+
+func logLevel(line string) string {
+	switch {
+	case logErrorRe.MatchString(line):
+		return "error"
+	case logWarnRe.MatchString(line):
+		return "warn"
+	}
+	return ""
+}
+
+// readLogEntries splits a log into entries. A line is a new entry when it
+// has a timestamp, or when the log has none at all.
+func readLogEntries(r io.Reader, year int) ([]logEntry, int, error) {
+	var entries []logEntry
+	lines := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 4<<20)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines++
+		t, ok := parseLogTime(line, year)
+		if !ok && len(entries) > 0 && !entries[len(entries)-1].time.IsZero() {
+			last := &entries[len(entries)-1]
+			last.text += "\n" + line
+			if last.level != "error" {
+				if lv := logLevel(line); lv != "" {
+					last.level = lv
+				}
+			}
+			continue
+		}
+		entries = append(entries, logEntry{time: t, text: line, level: logLevel(line)})
+	}
+	return entries, lines, sc.Err()
+}
+
+// logTemplate is the first line of text with its variable parts masked.
+func logTemplate(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	for _, re := range logStampRes {
+		if loc := re.FindStringIndex(line); loc != nil && loc[0] < 32 {
+			line = line[:loc[0]] + line[loc[1]:]
+			break
+		}
+	}
+	for _, re := range logVariableRes {
+		line = re.ReplaceAllString(line, "<*>")
+	}
+	return strings.Join(strings.Fields(line), " ")
+}
+
+// clusterLogEntries counts the error and warning messages by template,
+// most frequent first.
+func clusterLogEntries(entries []logEntry, max int) []LogCluster {
+	byPattern := map[string]*LogCluster{}
+	var order []*LogCluster
+	for _, e := range entries {
+		if e.level == "" {
+			continue
+		}
+		p := logTemplate(e.text)
+		c := byPattern[p]
+		if c == nil {
+			first, _, _ := strings.Cut(e.text, "\n")
+			c = &LogCluster{Pattern: p, Level: e.level, Sample: truncateRunes(first, 300)}
+			byPattern[p] = c
+			order = append(order, c)
+		}
+		c.Count++
+		if !e.time.IsZero() {
+			if c.First.IsZero() || e.time.Before(c.First) {
+				c.First = e.time
+			}
+			if e.time.After(c.Last) {
+				c.Last = e.time
+			}
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].Level != order[j].Level {
+			return order[i].Level == "error"
+		}
+		return order[i].Count > order[j].Count
+	})
+	if len(order) > max {
+		order = order[:max]
+	}
+	clusters := make([]LogCluster, len(order))
+	for i, c := range order {
+		clusters[i] = *c
+	}
+	return clusters
+}
+
+// logWindow is the entries logged within one --window.
+type logWindow struct {
+	start, end time.Time
+	entries    []logEntry
+}
+
+func (w logWindow) flagged() bool {
+	for _, e := range w.entries {
+		if e.level != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// windowLogEntries groups entries into windows of size by timestamp. An
+// unstamped entry joins the window of the one before it, so a log with no
+// timestamps at all is one window.
+func windowLogEntries(entries []logEntry, size time.Duration) []logWindow {
+	var windows []logWindow
+	for _, e := range entries {
+		n := len(windows)
+		if n == 0 || (!e.time.IsZero() && (windows[n-1].start.IsZero() || !e.time.Before(windows[n-1].start.Add(size)))) {
+			start := e.time
+			if !start.IsZero() {
+				start = start.Truncate(size)
+			}
+			if n > 0 && windows[n-1].start.IsZero() {
+				// Leading unstamped lines belong with the first stamped one.
+				windows[n-1].start = start
+			} else {
+				windows = append(windows, logWindow{start: start})
+				n++
+			}
+		}
+		w := &windows[n-1]
+		w.entries = append(w.entries, e)
+		if e.time.After(w.end) {
+			w.end = e.time
+		}
+	}
+	return windows
+}
+
+// renderLogWindow writes a window for the prompt whole, or when it is over
+// maxTokens as its counts and frequent messages followed by as many lines
+// as fit, errors and warnings first.
+func renderLogWindow(w logWindow, maxTokens int) string {
+	var whole strings.Builder
+	for _, e := range w.entries {
+		whole.WriteString(e.text + "\n")
+	}
+	if estimateTokens(whole.String()) <= maxTokens {
+		return whole.String()
+	}
+	errs, warns := 0, 0
+	for _, e := range w.entries {
+		switch e.level {
+		case "error":
+			errs++
+		case "warn":
+			warns++
+		}
+	}
+	var head strings.Builder
+	fmt.Fprintf(&head, "[%d entries, %d errors, %d warnings; too many to show all. Most frequent error and warning messages:]\n", len(w.entries), errs, warns)
+	for _, c := range clusterLogEntries(w.entries, 15) {
+		fmt.Fprintf(&head, "%6d× %s\n", c.Count, c.Sample)
+	}
+	head.WriteString("[Errors and warnings, then other lines, in order:]\n")
+	var flagged, rest []string
+	for _, e := range w.entries {
+		if e.level != "" {
+			flagged = append(flagged, e.text)
+		} else {
+			rest = append(rest, e.text)
+		}
+	}
+	body := head.String()
+	for _, line := range append(flagged, rest...) {
+		if estimateTokens(body)+estimateTokens(line) > maxTokens {
+			break
+		}
+		body += line + "\n"
+	}
+	return body
+}
+
+// parseLogAnomalies reads the JSON array of a window's answer.
+func parseLogAnomalies(out string) ([]LogAnomaly, error) {
+	start, end := strings.Index(out, "["), strings.LastIndex(out, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("answer contains no JSON array")
+	}
+	var found []LogAnomaly
+	if err := json.Unmarshal([]byte(out[start:end+1]), &found); err != nil {
+		return nil, fmt.Errorf("answer is not a valid anomalies array: %v", err)
+	}
+	return found, nil
+}
+
+func parseIncidentSummary(out string) (IncidentSummary, error) {
+	var s IncidentSummary
+	start, end := strings.Index(out, "{"), strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return s, fmt.Errorf("answer contains no JSON object")
+	}
+	if err := json.Unmarshal([]byte(out[start:end+1]), &s); err != nil {
+		return s, fmt.Errorf("answer is not a valid incident summary: %v", err)
+	}
+	return s, nil
+}
+
+func formatLogTime(t time.Time) string {
+	if t.IsZero() {
+		return "?"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// logsAnalyzeCommand implements `logs analyze`: find the anomalies in a log
+// window by window, then reduce them to one incident summary.
+func logsAnalyzeCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "-", "Log file to analyze ('-' for stdin)")
+	window := fs.Duration("window", 5*time.Minute, "Length of the time windows the log is analyzed in")
+	all := fs.Bool("all", false, "Also analyze windows without errors or warnings")
+	maxClusters := fs.Int("clusters", 20, "Report at most this many error and warning clusters")
+	fs.BoolVar(&jsonOut, "json", false, "Print the incident summary as JSON")
+	assistant := addGitFlags(fs)
+	return func(args []string) {
+		if *window <= 0 {
+			fatal(kindError(ErrConfig, "--window must be positive"))
+		}
+		r, name := io.Reader(os.Stdin), "stdin"
+		year := time.Now().Year()
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				fatal(kindError(ErrConfig, "%v", err))
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil {
+				year = fi.ModTime().Year()
+			}
+			r, name = f, *file
+		}
+		entries, lines, err := readLogEntries(r, year)
+		if err != nil {
+			fatal(kindError(ErrConfig, "reading %s: %v", name, err))
+		}
+		if len(entries) == 0 {
+			fatal(kindError(ErrConfig, "%s is empty", name))
+		}
+
+		summary := IncidentSummary{Source: name, Lines: lines, Anomalies: []LogAnomaly{}, Clusters: clusterLogEntries(entries, *maxClusters)}
+		windows := windowLogEntries(entries, *window)
+		summary.Windows = len(windows)
+		g := assistant()
+		ctx := context.Background()
+		var parts []logWindow
+		for _, w := range windows {
+			if *all || w.flagged() {
+				parts = append(parts, w)
+			}
+		}
+		summary.Analyzed = len(parts)
+		for i, w := range parts {
+			statusf("[Sub-Agent] Analyzing %s to %s (%d of %d)\n", formatLogTime(w.start), formatLogTime(w.end), i+1, len(parts))
+			out, err := g.ask(ctx, fmt.Sprintf(logWindowPrompt, formatLogTime(w.start), formatLogTime(w.end), i+1, len(parts), name, renderLogWindow(w, g.chunkTokens)))
+			if err != nil {
+				fatal(err)
+			}
+			found, err := parseLogAnomalies(out)
+			if err != nil {
+				fatal(kindError(ErrProvider, "window %d of %d: %v", i+1, len(parts), err))
+			}
+			summary.Anomalies = append(summary.Anomalies, found...)
+		}
+
+		if len(summary.Anomalies) == 0 {
+			summary.Title, summary.Severity = "No anomalies found", "none"
+			summary.Summary = fmt.Sprintf("%d of %d windows had errors or warnings; none stood out.", summary.Analyzed, summary.Windows)
+		} else {
+			anomalies, _ := json.MarshalIndent(summary.Anomalies, "", "  ")
+			var freq strings.Builder
+			for _, c := range summary.Clusters {
+				fmt.Fprintf(&freq, "%d× [%s] %s (%s to %s)\n", c.Count, c.Level, c.Sample, formatLogTime(c.First), formatLogTime(c.Last))
+			}
+			start, end := windows[0].start, windows[len(windows)-1].end
+			out, err := g.ask(ctx, fmt.Sprintf(logReducePrompt, name, formatLogTime(start), formatLogTime(end), anomalies, freq.String()))
+			if err != nil {
+				fatal(err)
+			}
+			reduced, err := parseIncidentSummary(out)
+			if err != nil {
+				fatal(kindError(ErrProvider, "incident summary: %v", err))
+			}
+			reduced.Source, reduced.Lines, reduced.Windows, reduced.Analyzed = summary.Source, summary.Lines, summary.Windows, summary.Analyzed
+			reduced.Anomalies, reduced.Clusters = summary.Anomalies, summary.Clusters
+			summary = reduced
+		}
+		if summary.Timeline == nil {
+			summary.Timeline = []IncidentEvent{}
+		}
+		if summary.SuspectedCauses == nil {
+			summary.SuspectedCauses = []SuspectedCause{}
+		}
+		if summary.NextSteps == nil {
+			summary.NextSteps = []string{}
+		}
+		if summary.Clusters == nil {
+			summary.Clusters = []LogCluster{}
+		}
+
+		if jsonOut {
+			printJSON(summary)
+			return
+		}
+		writeIncidentSummary(os.Stdout, summary)
+	}
+}
+
+func writeIncidentSummary(w io.Writer, s IncidentSummary) {
+	fmt.Fprintf(w, "%s [%s]\n", s.Title, strings.ToUpper(s.Severity))
+	if s.Start != "" || s.End != "" {
+		fmt.Fprintf(w, "%s to %s\n", s.Start, s.End)
+	}
+	fmt.Fprintf(w, "%s: %d lines, %d of %d windows analyzed, %d anomalies\n", s.Source, s.Lines, s.Analyzed, s.Windows, len(s.Anomalies))
+	if s.Summary != "" {
+		fmt.Fprintf(w, "\n%s\n", s.Summary)
+	}
+	if len(s.Timeline) > 0 {
+		fmt.Fprintln(w, "\nTimeline:")
+		for _, e := range s.Timeline {
+			fmt.Fprintf(w, "  %-25s %s\n", e.Time, e.Event)
+		}
+	}
+	if len(s.SuspectedCauses) > 0 {
+		fmt.Fprintln(w, "\nSuspected causes:")
+		for i, c := range s.SuspectedCauses {
+			fmt.Fprintf(w, "  %d. %s (%s confidence)\n", i+1, c.Cause, c.Confidence)
+			for _, ev := range c.Evidence {
+				fmt.Fprintf(w, "       %s\n", truncateRunes(ev, 200))
+			}
+		}
+	}
+	if len(s.NextSteps) > 0 {
+		fmt.Fprintln(w, "\nNext steps:")
+		for _, step := range s.NextSteps {
+			fmt.Fprintf(w, "  - %s\n", step)
+		}
+	}
+	if len(s.Clusters) > 0 {
+		fmt.Fprintln(w, "\nError and warning clusters:")
+		for _, c := range s.Clusters {
+			fmt.Fprintf(w, "  %6s %-5s %s\n", strconv.Itoa(c.Count)+"×", c.Level, truncateRunes(c.Pattern, 120))
+		}
+	}
+}
@@ -2,193 +2,1091 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
 // Config flags
 var (
 	task     string
 	model    string
 	provider string
-	apiKey   string
+	jsonOut  bool
+	raw      bool
+	verbose  bool
+	quiet    bool
 )
 
-// Ollama Config
-const DefaultOllamaHost = "http://host.docker.internal:11434"
+// statusf prints a status line. Status goes to stderr so that stdout
+// carries only the result, and --quiet drops it.
+func statusf(format string, args ...interface{}) {
+	if !quiet {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
 
 // Gemini Config
 const GeminiBaseURL = "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-flash-preview-09-2025:generateContent"
 
 // Data structs for Ollama
 type OllamaRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Stream  bool            `json:"stream"`
+	Images  []string        `json:"images,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"` // "json" or a JSON schema
+	Think   interface{}     `json:"think,omitempty"`  // false, true or an effort
+	Raw     bool            `json:"raw,omitempty"`    // the prompt is already templated
+	Options *OllamaOptions  `json:"options,omitempty"`
+}
+
+type OllamaOptions struct {
+	NumCtx      int      `json:"num_ctx,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        int64    `json:"seed,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
 }
 
 type OllamaResponse struct {
-	Response string `json:"response"`
+	Response        string `json:"response"`
+	Thinking        string `json:"thinking,omitempty"`
+	DoneReason      string `json:"done_reason,omitempty"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	// Timings, in nanoseconds.
+	TotalDuration      int64 `json:"total_duration"`
+	LoadDuration       int64 `json:"load_duration"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration"`
+	EvalDuration       int64 `json:"eval_duration"`
 }
 
 // Data structs for Gemini
 type GeminiRequest struct {
 	Contents []GeminiContent `json:"contents"`
+	// CachedContent names a cachedContents resource the prompt continues.
+	CachedContent    string                  `json:"cachedContent,omitempty"`
+	Tools            []GeminiTool            `json:"tools,omitempty"`
+	GenerationConfig *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// GeminiTool enables one of Gemini's built-in tools.
+type GeminiTool struct {
+	GoogleSearch *struct{} `json:"googleSearch,omitempty"`
+}
+
+type GeminiGenerationConfig struct {
+	StopSequences  []string              `json:"stopSequences,omitempty"`
+	CandidateCount int                   `json:"candidateCount,omitempty"`
+	Seed           int64                 `json:"seed,omitempty"`
+	Temperature    *float64              `json:"temperature,omitempty"`
+	ThinkingConfig *GeminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type GeminiThinkingConfig struct {
+	ThinkingBudget  int  `json:"thinkingBudget"` // 0 turns thinking off
+	IncludeThoughts bool `json:"includeThoughts,omitempty"`
 }
 
 type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
 	Parts []GeminiPart `json:"parts"`
 }
 
 type GeminiPart struct {
-	Text string `json:"text"`
+	Text       string          `json:"text,omitempty"`
+	Thought    bool            `json:"thought,omitempty"` // a summary of the model's thinking
+	InlineData *GeminiBlob     `json:"inline_data,omitempty"`
+	FileData   *GeminiFileData `json:"file_data,omitempty"` // uploaded with the Files API
+	// FunctionCall is a call of a function declared to Gemini.
+	FunctionCall *GeminiFunctionCall `json:"functionCall,omitempty"`
+}
+
+type GeminiFunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type GeminiBlob struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mime_type"`
+	FileURI  string `json:"file_uri"`
 }
 
 type GeminiResponse struct {
-	Candidates []GeminiCandidate `json:"candidates"`
+	Candidates     []GeminiCandidate     `json:"candidates"`
+	PromptFeedback *GeminiPromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+		// CachedContentTokenCount is the part of the prompt served from a cache.
+		CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	} `json:"usageMetadata"`
 }
 
 type GeminiCandidate struct {
-	Content GeminiContent `json:"content"`
+	Content           GeminiContent            `json:"content"`
+	FinishReason      string                   `json:"finishReason,omitempty"`
+	GroundingMetadata *GeminiGroundingMetadata `json:"groundingMetadata,omitempty"`
+	SafetyRatings     []GeminiSafetyRating     `json:"safetyRatings,omitempty"`
+}
+
+type GeminiSafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+type GeminiPromptFeedback struct {
+	BlockReason string `json:"blockReason,omitempty"`
 }
 
 func main() {
-	flag.StringVar(&task, "task", "", "The task description")
-	flag.StringVar(&model, "model", "", "Ollama model name (e.g., deepseek-r1:8b)")
-	flag.StringVar(&provider, "provider", "local", "Provider: 'local' (Ollama) or 'cloud' (Gemini)")
-	flag.StringVar(&apiKey, "api-key", "", "Gemini API Key (required for cloud provider)")
+	if err := loadConfig(); err != nil {
+		fatal(configError(err))
+	}
+	if err := configureHTTP(config.Network); err != nil {
+		fatal(configError(err))
+	}
+	if err := configureChaos(config.Chaos); err != nil {
+		fatal(configError(err))
+	}
+	// Subcommands are dispatched on the first argument; anything else falls
+	// through to the one-shot task mode driven by --task.
+	rootCommand.execute("helix", os.Args[1:])
+}
+
+// taskCommand implements one-shot task mode.
+func taskCommand(fs *flag.FlagSet) func(args []string) {
+	fs.StringVar(&task, "task", "", "The task description")
+	taskFile := fs.String("task-file", "", "Read the task from this file instead of --task (text, PDF, docx or xlsx)")
+	contractFile := fs.String("contract", "", "Read the task from a contract (JSON or YAML: goal, constraints, acceptance criteria, output format, tools, budget) and assess the answer against it")
+	fs.StringVar(&model, "model", "", "Ollama model name (e.g., deepseek-r1:8b)")
+	fs.StringVar(&provider, "provider", "local", "Provider: 'local' (Ollama), 'cloud' (Gemini), 'azure-openai', 'bedrock', or an OpenAI-compatible adapter (openai, openrouter, groq, together, deepseek, ...)")
+	kf := addKeyFlags(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the result as JSON instead of text")
+	fs.BoolVar(&raw, "raw", false, "Print the answer as-is instead of rendering markdown on a terminal")
+	fs.BoolVar(&verbose, "verbose", false, "Print detailed progress and intermediate transcripts, such as a debate's")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the result: no status lines, warnings or progress")
+	noStdin := fs.Bool("no-stdin", false, "Don't read piped stdin as input for the task")
+	fromClipboard := fs.Bool("from-clipboard", false, "Use the text on the system clipboard as input for the task, instead of piped stdin")
+	pf := &patchFlags{
+		apply: fs.Bool("apply", false, "Apply unified diffs in the answer to the workspace after showing them ('helix undo' reverts)"),
+		yes:   fs.Bool("yes", false, "With --apply, don't ask for confirmation"),
+	}
+	var images, files, audio, contextPaths stringList
+	fs.Var(&images, "image", "Image file to send with the task (repeatable; requires a vision model)")
+	fs.Var(&files, "file", "PDF, video, audio or image file Gemini reads as-is (repeatable; provider=cloud; large files go through the Files API)")
+	fs.Var(&audio, "audio", "Audio file to transcribe into the task's input (repeatable; see transcription in the config)")
+	fs.Var(&contextPaths, "context", "File, directory or glob (** allowed) to pack into the prompt (repeatable; honours .helixignore; PDFs, docx and xlsx are read as text)")
+	ocr := fs.Bool("ocr", config.Documents.OCR, "Read scanned PDFs in --context and --task-file with tesseract OCR")
+	useTemplate := fs.Bool("template", false, "Render the task as a Go text/template first, with include, sh, truncateTokens, json and now functions and --var values as {{.name}}")
+	vars := varFlag{}
+	fs.Var(vars, "var", "Template variable as key=value for --template (repeatable)")
+	templateShell := fs.Bool("template-shell", false, "Let --template tasks run shell commands with sh")
+	runID := fs.String("run-id", "", "ID for this run, such as the caller's job ID (defaults to a random one)")
+	tags := tagFlag{}
+	fs.Var(tags, "tag", "Attach key=value metadata to the run's result and audit record (repeatable)")
+	rf := addRunnerFlags(fs)
+	of := addOutputFlags(fs)
+	wf := addWatchFlags(fs)
+	return func([]string) {
+		if len(wf.paths) > 0 {
+			watchTask(fs, wf, of)
+			return
+		}
+		req := TaskRequest{ID: *runID}
+		if len(tags) > 0 {
+			req.Tags = tags
+		}
+		if *contractFile != "" {
+			if task != "" || *taskFile != "" || *useTemplate {
+				fatal(kindError(ErrConfig, "--contract can't be used with --task, --task-file or --template"))
+			}
+			c, err := readContract(*contractFile)
+			if err != nil {
+				fatal(configError(err))
+			}
+			req.Contract = c
+		}
+		if *taskFile != "" {
+			if task != "" {
+				fatal(kindError(ErrConfig, "--task and --task-file are mutually exclusive"))
+			}
+			text, err := readTaskFile(*taskFile, *ocr)
+			if err != nil {
+				fatal(configError(err))
+			}
+			task = text
+		}
+		if *useTemplate {
+			tt := taskTemplate{dir: ".", shell: *templateShell}
+			if *taskFile != "" {
+				tt.dir = filepath.Dir(*taskFile)
+			}
+			text, err := tt.render(task, vars)
+			if err != nil {
+				fatal(configError(err))
+			}
+			task = text
+		} else if len(vars) > 0 || *templateShell {
+			fatal(kindError(ErrConfig, "--var and --template-shell need --template"))
+		}
+		if *fromClipboard {
+			text, err := readClipboard()
+			if err != nil {
+				fatal(configError(err))
+			}
+			if strings.TrimSpace(text) == "" {
+				fatal(kindError(ErrConfig, "--from-clipboard: the clipboard holds no text"))
+			}
+			req.Input = text
+		}
+		runTask(fs, kf, rf, pf, of, req, images, files, audio, contextPaths, *noStdin || *fromClipboard, *ocr)
+	}
+}
 
-	// Parse flags first
-	flag.Parse()
-    
-    // Check ENV for API Key if not passed via flag
-    if apiKey == "" {
-        apiKey = os.Getenv("GEMINI_API_KEY")
-    }
+func runTask(fs *flag.FlagSet, kf *keyFlags, rf *runnerFlags, pf *patchFlags, of *outputFlags, req TaskRequest, images, files, audio, contextPaths stringList, noStdin, ocr bool) {
+	apiKey, err := kf.resolve()
+	if err != nil {
+		fatal(configError(err))
+	}
 
-	if task == "" {
-		fmt.Println("Error: --task flag is required")
-		os.Exit(1)
+	if task == "" && req.Contract == nil {
+		fatal(kindError(ErrConfig, "--task, --task-file or --contract is required"))
+	}
+	if _, err := of.speech.format(); err != nil {
+		fatal(err)
 	}
 
-	fmt.Printf("[Sub-Agent] Provider: %s\n", provider)
-	fmt.Printf("[Sub-Agent] Received Task: %s\n", task)
+	// With --route and no explicit --provider/--model the router decides;
+	// an explicit --provider still restricts it to that provider.
+	routing := *rf.route != "" && model == ""
+	if routing && !flagWasSet(fs, "provider") {
+		provider = ""
+	}
 
-	var result string
-	var err error
+	// Banners would corrupt the JSON document, so they are text-mode only.
+	if !jsonOut {
+		if routing {
+			statusf("[Sub-Agent] Routing: %s\n", *rf.route)
+		} else {
+			statusf("[Sub-Agent] Provider: %s\n", provider)
+		}
+		if req.Contract != nil {
+			statusf("[Sub-Agent] Received Contract: %s\n", firstLine(req.Contract.Goal))
+		} else {
+			statusf("[Sub-Agent] Received Task: %s\n", task)
+		}
+	}
+
+	if !routing && provider != "cloud" {
+		model = defaultModel(provider, model)
+		if !jsonOut {
+			statusf("[Sub-Agent] Using Model: %s\n", model)
+		}
+	}
 
-	if provider == "cloud" {
-		result, err = callGemini(task, apiKey)
+	r, err := newRunner(apiKey, rf)
+	if err != nil {
+		fatal(configError(err))
+	}
+	req.Task, req.Provider, req.Model = task, provider, model
+	if !noStdin {
+		if req.Input, err = readPipedInput(); err != nil {
+			fatal(configError(err))
+		}
+	}
+	if len(contextPaths) > 0 {
+		if req.ContextFiles, err = collectContextFiles(contextPaths, ocr); err != nil {
+			fatal(configError(err))
+		}
+	}
+	for _, path := range images {
+		img, err := readImage(path)
+		if err != nil {
+			fatal(configError(err))
+		}
+		req.Images = append(req.Images, img)
+	}
+	for _, path := range files {
+		f, err := readFileInput(path)
+		if err != nil {
+			fatal(configError(err))
+		}
+		req.Files = append(req.Files, f)
+	}
+	for _, path := range audio {
+		a, err := readAudio(path)
+		if err != nil {
+			fatal(configError(err))
+		}
+		req.Audio = append(req.Audio, a)
+	}
+
+	// SIGINT or SIGTERM cancels the run, which aborts the provider call
+	// (stopping an Ollama generation) and records it; a second one kills.
+	ctx, stop := shutdownSignal()
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	streamed := false
+	if *of.stream {
+		if *of.path != "" {
+			fatal(kindError(ErrConfig, "--stream prints to stdout and can't be used with --output-file"))
+		}
+		ctx = withEvents(ctx, of.streamEvents(&streamed))
+	}
+	ctx = withApprover(ctx, terminalApprover)
+	ctx = withCommandConfirmer(ctx, terminalCommandConfirmer)
+	// The runner also cleans the output (removes <think> tags if present)
+	res, err := r.run(ctx, req)
+	if jsonOut {
+		if err == nil && *pf.apply {
+			if err = pf.applyAnswer(&res, *rf.workspace, task, false); err != nil {
+				err = configError(err)
+				res.Error, res.ErrorKind = err.Error(), errorKind(err)
+			}
+		}
+		if *of.stream {
+			json.NewEncoder(os.Stdout).Encode(TaskEvent{Type: EventResult, Result: &res})
+		} else {
+			of.emitJSON(res)
+		}
+		if err != nil {
+			os.Exit(exitCode(err))
+		}
+		of.deliver(res.Output)
+		return
+	}
+	if err != nil {
+		if r.checkpoints != nil && r.checkpoints.has(res.ID) {
+			statusf("[Sub-Agent] Resume with: helix resume %s\n", res.ID)
+		}
+		fatal(err)
+	}
+	if streamed {
+		// The answer is out already; the final text may differ a little
+		// once post-processing has run, as --json shows.
+		fmt.Println()
+		printResultStatus(res)
+		printFileChanges(res.Files)
+		printGrounding(res.Grounding)
+		printSources(res.Sources)
 	} else {
-		// Default to Local
-		if model == "" {
-			model = os.Getenv("HELIX_MODEL")
-			if model == "" {
-				model = "deepseek-r1:8b" 
+		of.provenance, of.provenanceMode = res.Provenance, *rf.provenance
+		of.emit(func(w io.Writer) { printResult(w, res, of.markdown(raw) && !convertsMarkdown(r.answerFormat(req))) })
+	}
+	of.deliver(res.Output)
+	if *pf.apply {
+		files, warnings := len(res.Files), len(res.Warnings)
+		if err := pf.applyAnswer(&res, *rf.workspace, task, true); err != nil {
+			fatal(configError(err))
+		}
+		for _, w := range res.Warnings[warnings:] {
+			statusf("[Sub-Agent] Warning: %s\n", w)
+		}
+		printFileChanges(res.Files[files:])
+	}
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// printResult renders a TaskResult for text mode: status lines via statusf
+// and the result to w. With markdown the answer is styled for a terminal.
+func printResult(w io.Writer, res TaskResult, markdown bool) {
+	printResultStatus(res)
+
+	if d := res.DryRun; d != nil {
+		fmt.Fprintln(w, "--- Dry Run ---")
+		fmt.Fprintf(w, "Endpoint: %s\n", d.Endpoint)
+		fmt.Fprintf(w, "Tokens:   ~%d prompt + ~%d output\n", d.PromptTokens, d.OutputTokens)
+		fmt.Fprintf(w, "Cost:     ~$%.4f\n", d.EstimatedCost)
+		fmt.Fprintf(w, "SHA-256:  %s\n", d.PromptSHA256)
+		for _, s := range d.Sections {
+			fmt.Fprintf(w, "  %-12s %s  ~%d tokens\n", s.Name, s.SHA256, s.Tokens)
+		}
+		fmt.Fprintln(w, "--- Prompt ---")
+		fmt.Fprintln(w, d.Prompt)
+		fmt.Fprintln(w, "--- Payload ---")
+		var buf bytes.Buffer
+		json.Indent(&buf, d.Payload, "", "  ")
+		fmt.Fprintln(w, buf.String())
+		return
+	}
+
+	printFileChanges(res.Files)
+	defer printSources(res.Sources)
+	defer printGrounding(res.Grounding)
+
+	statusf("--- Result ---\n")
+	if res.ArtifactURL != "" {
+		fmt.Fprintf(w, "Uploaded %d bytes to artifact store: %s\n", res.OutputBytes, res.ArtifactURL)
+		return
+	}
+	if markdown {
+		fmt.Fprintln(w, renderMarkdown(res.Output))
+		return
+	}
+	fmt.Fprintln(w, res.Output)
+}
+
+// printResultStatus prints what a result says about how it was reached:
+// routing, warnings, tools, usage and the like.
+func printResultStatus(res TaskResult) {
+	if d := res.Route; d != nil {
+		statusf("[Sub-Agent] Routed to %s: %s\n", d.Chosen, d.Reason)
+	}
+	for _, w := range res.Warnings {
+		statusf("[Sub-Agent] Warning: %s\n", w)
+	}
+	if rr := res.Redactions; rr != nil {
+		if len(rr.Prompt) > 0 {
+			statusf("[Sub-Agent] Redacted from task: %s\n", formatCounts(rr.Prompt))
+		}
+		if len(rr.Response) > 0 {
+			statusf("[Sub-Agent] Redacted from response: %s\n", formatCounts(rr.Response))
+		}
+	}
+	for _, d := range res.Degraded {
+		statusf("[Sub-Agent] Emulated %s on %s: %s\n", d.Feature, d.Provider, d.Strategy)
+	}
+	for _, b := range res.Binary {
+		if b.Handling != "skipped" {
+			statusf("[Sub-Agent] Sent binary %s (%s, %d bytes) as %s\n", b.Path, b.MIMEType, b.Bytes, map[string]string{"image": "an image", "strings": "its strings", "hex": "a hex dump"}[b.Handling])
+		}
+	}
+	if p := res.Packed; p != nil {
+		statusf("[Sub-Agent] Packed %d context file(s), ~%d tokens\n", len(p.Included), p.Tokens)
+		if len(p.Omitted) > 0 {
+			statusf("[Sub-Agent] Omitted (did not fit the window): %s\n", strings.Join(p.Omitted, ", "))
+		}
+	}
+	if c := res.Compression; c != nil {
+		saved := ""
+		if c.SavedCost > 0 {
+			saved = fmt.Sprintf(", ~$%.4f saved", c.SavedCost)
+		}
+		statusf("[Sub-Agent] Compressed %d text(s) from ~%d to ~%d tokens with %s in %s%s\n", c.Texts, c.OriginalTokens, c.CompressedTokens,
+			modelChoice{c.Provider, c.Model}, time.Duration(c.DurationMS)*time.Millisecond, saved)
+	}
+	if c := res.Context; c != nil {
+		statusf("[Sub-Agent] Prompt ~%d tokens exceeded the %d-token window; applied %s (%d tokens removed)\n", c.PromptTokens, c.Window, c.Strategy, c.TruncatedTokens)
+	}
+	if e := res.Escalation; e != nil && len(e.Path) > 1 && e.Path[len(e.Path)-1].Passed {
+		statusf("[Sub-Agent] Escalated to %s after %d answer(s) failed validation\n", e.Path[len(e.Path)-1].Model, len(e.Path)-1)
+	}
+	if c := res.Confidence; c != nil {
+		signals := ""
+		if len(c.Signals) > 0 {
+			signals = " (" + strings.Join(c.Signals, ", ") + ")"
+		}
+		statusf("[Sub-Agent] Confidence: %.2f via %s%s\n", c.Score, c.Judge, signals)
+		if c.Abstained {
+			statusf("[Sub-Agent] Abstained: confidence below %.2f; the answer was withheld\n", c.Threshold)
+		}
+	}
+	if c := res.Contract; c != nil && len(c.Assessment) > 0 {
+		verdict := "met"
+		if !c.Met {
+			verdict = "not met"
+		}
+		statusf("[Sub-Agent] Contract %s (self-assessed by %s):\n", verdict, c.Assessor)
+		for _, a := range c.Assessment {
+			mark := "x"
+			if !a.Met {
+				mark = " "
+			}
+			statusf("  [%s] %s (%.0f/10) %s\n", mark, a.Criterion, a.Score, a.Reason)
+		}
+	}
+	if l := res.Length; l != nil && l.Action != "" {
+		statusf("[Sub-Agent] Answer of %d words, %d lines was over the length limit: %s\n", l.Words, l.Lines, l.Action)
+	}
+	if p := res.Plan; p != nil {
+		statusf("[Sub-Agent] Plan (%d steps via %s):\n", len(p.Steps), modelChoice{p.Provider, p.Model})
+		for i, s := range p.Steps {
+			statusf("  %d. [%s] %s\n", i+1, modelChoice{s.Provider, s.Model}, s.Task)
+		}
+	}
+	for _, c := range res.ToolCalls {
+		status := "ok"
+		if c.Error != "" {
+			status = "error: " + c.Error
+		}
+		statusf("[Sub-Agent] Tool %s (%dms): %s\n", c.Tool, c.DurationMS, status)
+	}
+	if len(res.Scratchpad) > 0 && verbose {
+		statusf("[Sub-Agent] Scratchpad:\n")
+		for _, k := range newScratchpad(res.Scratchpad).keys() {
+			statusf("  %s: %s\n", k, res.Scratchpad[k])
+		}
+	}
+	if s := res.Speculation; s != nil {
+		took := s.FastMS
+		if s.Winner == "strong" {
+			took = s.StrongMS
+		}
+		why := ""
+		if s.Reason != "" {
+			why = ": " + s.Reason
+		}
+		statusf("[Sub-Agent] Speculation: kept the %s answer (%s, %dms)%s\n", s.Winner, map[string]string{"fast": s.Fast, "strong": s.Strong}[s.Winner], took, why)
+	}
+	if c := res.Candidates; c != nil {
+		how := c.Policy
+		if c.Judge != "" {
+			how += " via " + c.Judge
+		}
+		if c.Policy == SelectConsistent {
+			how += fmt.Sprintf(" by %s match, %.0f%% agree", c.Match, c.Agreement*100)
+		}
+		statusf("[Sub-Agent] Candidates: kept %d of %d (%s)\n", c.Chosen+1, len(c.Outputs), how)
+		if c.Reason != "" {
+			statusf("  %s\n", c.Reason)
+		}
+		if verbose {
+			for i, out := range c.Outputs {
+				statusf("  --- Candidate %d ---\n%s\n", i+1, out)
+			}
+		}
+	}
+	if res.Thinking != "" && verbose {
+		statusf("--- Thinking ---\n%s\n", res.Thinking)
+	}
+	if u := res.Usage; u != nil {
+		thinking := ""
+		if u.ThinkingTokens > 0 {
+			thinking = fmt.Sprintf(" + %d thinking", u.ThinkingTokens)
+		}
+		cached := ""
+		if u.CachedTokens > 0 {
+			cached = fmt.Sprintf(" (%d cached)", u.CachedTokens)
+		}
+		statusf("[Sub-Agent] Usage: %d prompt%s + %d output%s tokens over %d call(s)\n", u.PromptTokens, cached, u.OutputTokens, thinking, u.Calls)
+		if l := u.Local; l != nil {
+			statusf("[Sub-Agent] Local inference: %.1f tokens/s generating, %.1f reading the prompt; load %dms, eval %dms, total %dms\n", l.TokensPerSec, l.PromptTokensPerSec, l.LoadMS, l.EvalMS, l.TotalMS)
+		}
+	}
+	if d := res.Debate; d != nil {
+		statusf("[Sub-Agent] Debate (%d agents, %d round(s), judged by %s): %s won\n", len(d.Agents), d.Rounds, d.Judge, d.Winner)
+		for _, a := range d.Agents {
+			status := ""
+			if a.Error != "" {
+				status = " (failed: " + a.Error + ")"
+			} else if n, ok := d.Votes[a.Name]; ok {
+				status = fmt.Sprintf(" (%d vote(s))", n)
 			}
+			statusf("  %s [%s]%s\n", a.Name, modelChoice{a.Provider, a.Model}, status)
 		}
-		fmt.Printf("[Sub-Agent] Using Model: %s\n", model)
-		result, err = callLocalOllama(task, model)
+		if d.Reason != "" {
+			statusf("[Sub-Agent] Judge: %s\n", d.Reason)
+		}
+		if verbose {
+			statusf("--- Debate transcript ---\n")
+			for _, e := range d.Transcript {
+				statusf("[%d] %s -> %s", e.Seq, e.From, e.To)
+				if e.Error != "" {
+					statusf(" (error: %s)", e.Error)
+				}
+				statusf("\n%s\n\n", e.Content)
+			}
+		}
+	}
+	if v := res.Verification; v != nil {
+		statusf("[Sub-Agent] Verification: %s after %d round(s), %d revision(s)\n", v.Verdict, v.Rounds, v.Revisions)
+	}
+}
+
+func printFileChanges(files []FileChange) {
+	if len(files) == 0 {
+		return
+	}
+	statusf("--- Files ---\n")
+	for _, f := range files {
+		statusf("%-9s %s (%d bytes)\n", f.Action, f.Path, f.Bytes)
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// flagWasSet reports whether a flag was given on the command line rather
+// than left at its default.
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolveModel applies the local model fallbacks: flag, HELIX_MODEL, the
+// ollama.auto_select pick, then the built-in default.
+func resolveModel(name string) string {
+	if name != "" {
+		return name
+	}
+	if env := os.Getenv("HELIX_MODEL"); env != "" {
+		return env
+	}
+	if m := autoSelectModel(); m != "" {
+		return m
+	}
+	return "deepseek-r1:8b"
+}
+
+// defaultModel fills in a provider's default model when none was given:
+// HELIX_MODEL or the built-in default for Ollama, the configured deployment
+// for Azure OpenAI, BEDROCK_MODEL for Bedrock, and the adapter's default for
+// OpenAI-compatible providers. Gemini's model is fixed by GeminiBaseURL.
+func defaultModel(providerName, modelName string) string {
+	if modelName != "" {
+		return modelName
+	}
+	switch providerName {
+	case "cloud":
+		return ""
+	case "azure-openai":
+		return azureConfig().Deployment
+	case "bedrock":
+		return bedrockModel()
+	}
+	if a, ok := lookupAdapter(providerName); ok {
+		return a.DefaultModel
 	}
+	return resolveModel("")
+}
+
+// genRequest is a single provider call.
+type genRequest struct {
+	Provider string
+	Model    string
+	Prompt   string
+	Images   []ImageInput
+	Files    []FileInput // Gemini only, after the images
+	Stop     []string    // generation ends before any of these
+	// Candidates > 1 asks providers that can for that many answers in one
+	// call; generateCandidates samples the rest.
+	Candidates int
+	// Format ("json" or a JSON schema) and Grammar (GBNF) constrain the
+	// answer; see checkConstraints for who supports them.
+	Format  json.RawMessage
+	Grammar string
+	// Reasoning caps the thinking of reasoning models, where the API can.
+	Reasoning reasoningConfig
+	// Seed makes sampling repeatable on Ollama, Gemini and OpenAI-compatible
+	// providers; 0 leaves it to the provider.
+	Seed int64
+	// Temperature, when set, overrides the provider's sampling temperature.
+	Temperature *float64
+	// CachedContent is a Gemini context cache the prompt follows on from.
+	CachedContent string
+	// Ground lets Gemini search Google for the answer.
+	Ground bool
+	// uploaded are the Files API references callGemini sends instead of
+	// inlining the attachments.
+	uploaded []*GeminiFileData
+	// raw means the prompt is rendered with a chat template already, so
+	// Ollama must not apply the model's own.
+	raw bool
+	// OnText, when set, asks for a streamed answer and is called with the
+	// text so far as it arrives. Bedrock doesn't stream and ignores it.
+	OnText func(text string)
+}
+
+// generate routes a text-only prompt to the selected provider.
+func generate(ctx context.Context, providerName, modelName, prompt, key string) (string, error) {
+	return generateRequest(ctx, genRequest{Provider: providerName, Model: modelName, Prompt: prompt}, key)
+}
 
+// generateRequest routes a call to the selected provider. It is shared by the
+// one-shot CLI and the long-running serve/worker modes.
+func generateRequest(ctx context.Context, g genRequest, key string) (string, error) {
+	rs, err := generateResponses(ctx, g, key)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		os.Exit(1)
+		return "", err
 	}
+	return rs[0].Text, nil
+}
 
-	// Clean output (remove <think> tags if present)
-	cleaned := cleanOutput(result)
+// generateAll makes one provider call and returns the text of every answer
+// it gave.
+func generateAll(ctx context.Context, g genRequest, key string) ([]string, error) {
+	rs, err := generateResponses(ctx, g, key)
+	if err != nil {
+		return nil, err
+	}
+	return texts(rs), nil
+}
 
-	fmt.Println("--- Result ---")
-	fmt.Println(cleaned)
+// generateResponses makes one provider call and returns every answer it
+// gave, normalized: one, or up to g.Candidates where the provider supports
+// that.
+func generateResponses(ctx context.Context, g genRequest, key string) ([]Response, error) {
+	if err := checkLocalOnly(ctx, g.Provider); err != nil {
+		return nil, err
+	}
+	if err := guardCall(ctx, &g); err != nil {
+		return nil, err
+	}
+	g = adaptPrompt(g)
+	if verbose {
+		defer func(start time.Time) {
+			progressf("Called %s in %s", modelChoice{g.Provider, g.Model}, time.Since(start).Round(time.Millisecond))
+		}(time.Now())
+	}
+	start := time.Now()
+	var firstToken atomic.Int64
+	if onText := g.OnText; onText != nil {
+		g.OnText = func(text string) {
+			firstToken.CompareAndSwap(0, int64(time.Since(start)))
+			onText(text)
+		}
+	}
+	rs, err := callProvider(ctx, g, key)
+	if err == nil && g.Provider != "mock" {
+		latency.observe(modelChoice{g.Provider, defaultModel(g.Provider, g.Model)}.String(), time.Duration(firstToken.Load()), time.Since(start))
+	}
+	if err == nil && rs[0].FinishReason == FinishLength {
+		logf(ctx, "Warning: %s stopped at its output token limit; the answer is cut off", modelChoice{g.Provider, g.Model})
+	}
+	return rs, err
 }
 
-func callLocalOllama(prompt, modelName string) (string, error) {
-	// 1. Construct Payload
+// callProvider sends g to its provider.
+func callProvider(ctx context.Context, g genRequest, key string) ([]Response, error) {
+	single := func(r Response, err error) ([]Response, error) {
+		if err != nil {
+			return nil, err
+		}
+		return []Response{r}, nil
+	}
+	switch g.Provider {
+	case "mock":
+		return callMock(ctx, g)
+	case "cloud":
+		return callGemini(ctx, g, key)
+	case "azure-openai":
+		g.Model = defaultModel(g.Provider, g.Model)
+		return callAzureOpenAI(ctx, g)
+	case "bedrock":
+		g.Model = defaultModel(g.Provider, g.Model)
+		return single(callBedrock(ctx, g))
+	}
+	if a, ok := lookupAdapter(g.Provider); ok {
+		g.Model = defaultModel(g.Provider, g.Model)
+		return callAdapter(ctx, g.Provider, a, g)
+	}
+	// Default to Local
+	g.Model = resolveModel(g.Model)
+	return single(callLocalOllama(ctx, g))
+}
+
+func ollamaPayload(g genRequest) OllamaRequest {
 	payload := OllamaRequest{
-		Model:  modelName,
-		Prompt: prompt,
-		Stream: false,
+		Model:  g.Model,
+		Prompt: g.Prompt,
+		Stream: g.OnText != nil,
+		Format: g.Format,
+		Raw:    g.raw,
+	}
+	// Only gpt-oss takes effort levels; other thinking models a boolean.
+	switch e := g.Reasoning.effort; {
+	case e == "":
+	case e == EffortNone:
+		payload.Think = false
+	case strings.Contains(g.Model, "gpt-oss"):
+		payload.Think = e
+	default:
+		payload.Think = true
 	}
-	jsonData, _ := json.Marshal(payload)
+	for _, img := range g.Images {
+		payload.Images = append(payload.Images, base64.StdEncoding.EncodeToString(img.Data))
+	}
+	// Without num_ctx Ollama silently drops everything past its default window
+	if n := ollamaNumCtx(g.Model, g.Prompt); n > 0 || len(g.Stop) > 0 || g.Seed != 0 || g.Temperature != nil {
+		payload.Options = &OllamaOptions{NumCtx: n, Stop: g.Stop, Seed: g.Seed, Temperature: g.Temperature}
+	}
+	return payload
+}
+
+// ollamaCancelled is cancelledCall for Ollama, noting the generation was
+// stopped. Ollama has no call to stop one; it stops when the connection
+// closes, which is what the HTTP client does to a cancelled request, and
+// so frees the GPU for the next task.
+func ollamaCancelled(ctx context.Context, base string) error {
+	err := cancelledCall(ctx, "Ollama")
+	if err != nil {
+		logf(ctx, "Cancelled; closed the connection to %s to stop the generation", base)
+	}
+	return err
+}
+
+func callLocalOllama(ctx context.Context, g genRequest) (out Response, err error) {
+	// 1. Construct Payload
+	jsonData, _ := json.Marshal(ollamaPayload(g))
 
 	// 2. Call Ollama
-	resp, err := http.Post(DefaultOllamaHost+"/api/generate", "application/json", bytes.NewBuffer(jsonData))
+	base, release := ollamaBase(g.Model)
+	defer func() { release(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/api/generate", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return out, fmt.Errorf("building Ollama request: %v", err)
+	}
+	headers, err := ollamaHeaders()
 	if err != nil {
-		return "", fmt.Errorf("connecting to Ollama at %s/api/generate: %v\nEnsure Ollama is running on the host and accessible.", DefaultOllamaHost, err)
+		return out, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if l := ollamaLimiter; l != nil {
+		if err := l.acquire(ctx); err != nil {
+			return out, err
+		}
+	}
+	start := time.Now()
+	var oResp OllamaResponse
+	var body []byte
+	overloaded := false
+	defer func() {
+		if l := ollamaLimiter; l != nil {
+			took := time.Duration(oResp.TotalDuration)
+			l.release(time.Since(start)-took, took, overloaded)
+		}
+	}()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if err := ollamaCancelled(ctx, base); err != nil {
+			return out, err
+		}
+		return out, kindError(ErrUnreachable, "connecting to Ollama at %s/api/generate: %w\nEnsure Ollama is running on the host and accessible; run 'helix doctor' to find out why it isn't.", base, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("ollama returned status: %s", resp.Status)
+		overloaded = isBusyStatus(resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		return out, providerError("ollama", resp, body)
 	}
 
 	// 3. Parse Response
-	body, _ := io.ReadAll(resp.Body)
-	var oResp OllamaResponse
-	if err := json.Unmarshal(body, &oResp); err != nil {
-		return "", fmt.Errorf("parsing response: %v", err)
+	if g.OnText != nil {
+		if oResp, err = readOllamaStream(resp.Body, g.OnText); err != nil {
+			if cerr := ollamaCancelled(ctx, base); cerr != nil {
+				err = cerr
+			}
+			return out, err
+		}
+	} else {
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			if err := ollamaCancelled(ctx, base); err != nil {
+				return out, err
+			}
+			return out, fmt.Errorf("reading Ollama response: %v", err)
+		}
+		if err := json.Unmarshal(body, &oResp); err != nil {
+			return out, fmt.Errorf("parsing response: %v", err)
+		}
 	}
+	// With think set, Ollama returns the thinking apart from the response.
+	text := withThinking(oResp.Thinking, oResp.Response)
 
-	return oResp.Response, nil
+	// Ollama counts thinking as output; split it off by estimate.
+	u := Usage{PromptTokens: oResp.PromptEvalCount, OutputTokens: oResp.EvalCount, Local: ollamaStats(oResp)}
+	if thinking, _ := splitThinking(text); thinking != "" {
+		u.ThinkingTokens = min(estimateTokens(thinking), u.OutputTokens)
+		u.OutputTokens -= u.ThinkingTokens
+	}
+	recordUsage(ctx, u)
+
+	return Response{Text: text, FinishReason: ollamaFinish(oResp.DoneReason), Usage: u, Raw: rawJSON(body, oResp)}, nil
 }
 
-func callGemini(prompt, key string) (string, error) {
-	if key == "" {
-		return "", fmt.Errorf("missing Gemini API Key. Set GEMINI_API_KEY env var")
+func geminiPayload(g genRequest) GeminiRequest {
+	parts := []GeminiPart{{Text: g.Prompt}}
+	for i, a := range g.attachments() {
+		if g.uploaded != nil {
+			parts = append(parts, GeminiPart{FileData: g.uploaded[i]})
+			continue
+		}
+		parts = append(parts, GeminiPart{InlineData: &GeminiBlob{
+			MimeType: a.mimeType,
+			Data:     base64.StdEncoding.EncodeToString(a.data),
+		}})
+	}
+	req := GeminiRequest{
+		Contents:      []GeminiContent{{Role: "user", Parts: parts}},
+		CachedContent: g.CachedContent,
+	}
+	if g.Ground {
+		req.Tools = []GeminiTool{{GoogleSearch: &struct{}{}}}
+	}
+	gen := &GeminiGenerationConfig{StopSequences: g.Stop, Seed: g.Seed, Temperature: g.Temperature}
+	if g.Candidates > 1 {
+		gen.CandidateCount = g.Candidates
+	}
+	if n, ok := g.Reasoning.thinkingBudget(); ok {
+		gen.ThinkingConfig = &GeminiThinkingConfig{ThinkingBudget: n, IncludeThoughts: n > 0}
+	}
+	if len(gen.StopSequences) > 0 || gen.CandidateCount > 0 || gen.Seed != 0 || gen.Temperature != nil || gen.ThinkingConfig != nil {
+		req.GenerationConfig = gen
+	}
+	return req
+}
+
+// callGemini returns every candidate Gemini produced.
+func callGemini(ctx context.Context, g genRequest, key string) ([]Response, error) {
+	gc := geminiConfig()
+	if key == "" && len(gc.Keys) > 0 {
+		return callGeminiRotating(ctx, g, gc)
+	}
+	return callGeminiWith(ctx, g, gc, key)
+}
+
+func callGeminiWith(ctx context.Context, g genRequest, gc GeminiConfig, key string) ([]Response, error) {
+	key, err := geminiKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && !gc.Vertex {
+		return nil, kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var, or GOOGLE_GENAI_USE_VERTEXAI=true to use Vertex AI")
 	}
 
 	// 1. Construct Payload
-	payload := GeminiRequest{
-		Contents: []GeminiContent{
-			{
-				Parts: []GeminiPart{
-					{Text: prompt},
-				},
-			},
-		},
-	}
-	jsonData, _ := json.Marshal(payload)
-
-	// 2. Call Gemini API
+	if g.uploaded, err = uploadAttachments(ctx, gc, key, g); err != nil {
+		return nil, err
+	}
+	jsonData, _ := json.Marshal(geminiPayload(g))
+
+	// 2. Call Gemini API (or Vertex AI with ADC)
 	url := fmt.Sprintf("%s?key=%s", GeminiBaseURL, key)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	var bearer string
+	if gc.Vertex {
+		var err error
+		if url, bearer, err = vertexEndpoint(ctx, gc, g.Model); err != nil {
+			return nil, err
+		}
+	}
+	if g.OnText != nil {
+		url = geminiStreamURL(url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("building Gemini request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("connecting to Gemini API: %v", err)
+		if err := cancelledCall(ctx, "Gemini"); err != nil {
+			return nil, err
+		}
+		return nil, kindError(ErrUnreachable, "connecting to Gemini API: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("gemini API returned status: %s, body: %s", resp.Status, string(body))
+		return nil, providerError("gemini API", resp, body)
 	}
 
 	// 3. Parse Response
-	body, _ := io.ReadAll(resp.Body)
 	var gResp GeminiResponse
-	if err := json.Unmarshal(body, &gResp); err != nil {
-		return "", fmt.Errorf("parsing Gemini response: %v", err)
+	var body []byte
+	if g.OnText != nil {
+		if gResp, err = readGeminiStream(resp.Body, g.OnText); err != nil {
+			return nil, err
+		}
+	} else {
+		body, _ = io.ReadAll(resp.Body)
+		if err := json.Unmarshal(body, &gResp); err != nil {
+			return nil, fmt.Errorf("parsing Gemini response: %v", err)
+		}
 	}
+	um := gResp.UsageMetadata
+	u := Usage{PromptTokens: um.PromptTokenCount, OutputTokens: um.CandidatesTokenCount, ThinkingTokens: um.ThoughtsTokenCount, CachedTokens: um.CachedContentTokenCount}
+	recordUsage(ctx, u)
 
-	if len(gResp.Candidates) > 0 && len(gResp.Candidates[0].Content.Parts) > 0 {
-		return gResp.Candidates[0].Content.Parts[0].Text, nil
+	raw := rawJSON(body, gResp)
+	var outs []Response
+	for _, c := range gResp.Candidates {
+		recordGrounding(ctx, c.GroundingMetadata)
+		r := Response{FinishReason: geminiFinish(c.FinishReason), Usage: u, Safety: geminiSafety(c), Raw: raw}
+		var thought, text strings.Builder
+		for _, p := range c.Content.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				r.ToolCalls = append(r.ToolCalls, ProviderToolCall{Name: p.FunctionCall.Name, Arguments: p.FunctionCall.Args})
+			case p.Thought:
+				thought.WriteString(p.Text)
+			default:
+				text.WriteString(p.Text)
+			}
+		}
+		if len(r.ToolCalls) > 0 {
+			r.FinishReason = FinishToolCalls
+		}
+		if text.Len() > 0 || len(r.ToolCalls) > 0 {
+			r.Text = withThinking(thought.String(), text.String())
+			outs = append(outs, r)
+		}
+	}
+	if len(outs) > 0 {
+		return outs, nil
+	}
+	if f := gResp.PromptFeedback; f != nil && f.BlockReason != "" {
+		return nil, kindError(ErrSafety, "gemini blocked the prompt: %s", f.BlockReason)
+	}
+	if len(gResp.Candidates) > 0 && gResp.Candidates[0].FinishReason == "SAFETY" {
+		return nil, kindError(ErrSafety, "gemini blocked the response for safety")
 	}
 
-	return "", fmt.Errorf("empty response from Gemini")
+	return nil, kindError(ErrEmpty, "empty response from Gemini")
 }
 
 func cleanOutput(text string) string {
-	// Simple removal of <think>...</think> blocks common in reasoning models
-	// Note: A robust implementation would use a regex or parser
+	_, answer := splitThinking(text)
+	return answer
+}
+
+// splitThinking separates the <think>...</think> block common in reasoning
+// models from the answer that follows it.
+func splitThinking(text string) (thinking, answer string) {
 	if start := strings.Index(text, "<think>"); start != -1 {
-		if end := strings.Index(text, "</think>"); end != -1 {
-			return strings.TrimSpace(text[end+8:])
+		if end := strings.Index(text, "</think>"); end > start {
+			return strings.TrimSpace(text[start+7 : end]), strings.TrimSpace(text[end+8:])
 		}
 	}
-	return text
+	return "", text
 }
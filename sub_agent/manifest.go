@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A run manifest is everything needed to run a task again elsewhere and
+// to tell why the answer differs when it does: the request as sent, with
+// its knowledge and files in it, the seed, the versions of helix, the
+// model and the tools, and the config they ran under. --write-manifest
+// writes one per run; helix replay --manifest runs it again, warning of
+// whatever this machine has different.
+
+// manifestFormat is the version of RunManifest; replay refuses newer ones.
+const manifestFormat = 1
+
+// RunManifest is what --write-manifest writes.
+type RunManifest struct {
+	Format     int       `json:"format"`
+	RunID      string    `json:"run_id"`
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms"`
+	Helix      BuildInfo `json:"helix"`
+	Provider   string    `json:"provider"`
+	Model      string    `json:"model"`
+	// ModelDigest is the digest Ollama reports for a local model; hosted
+	// models are known by their name alone.
+	ModelDigest string `json:"model_digest,omitempty"`
+	// Seed is the answer's; candidates sample with the ones after it.
+	Seed int64 `json:"seed"`
+	// PromptSHA256 hashes the prompt as assembled, before any fitting to
+	// the window, and Sections the parts of it.
+	PromptSHA256 string          `json:"prompt_sha256,omitempty"`
+	Sections     []PromptSection `json:"sections,omitempty"`
+	Tools        []ToolVersion   `json:"tools,omitempty"`
+	Chunks       []string        `json:"chunks,omitempty"` // IDs of the knowledge base chunks retrieved
+	// Config is the config in effect, with secrets masked.
+	Config  json.RawMessage `json:"config"`
+	Request TaskRequest     `json:"request"`
+	Result  TaskResult      `json:"result"`
+}
+
+// ToolVersion identifies a tool by what the model sees of it and, for exec
+// and Wasm tools, the program it runs.
+type ToolVersion struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// programTool is a tool that runs a local program, which is part of its
+// version.
+type programTool interface {
+	program() string
+}
+
+func toolVersion(t tool) ToolVersion {
+	h := sha256.New()
+	spec, _ := json.Marshal(t.spec())
+	h.Write(spec)
+	if p, ok := t.(programTool); ok {
+		if f, err := os.Open(p.program()); err == nil {
+			io.Copy(h, f)
+			f.Close()
+		}
+	}
+	return ToolVersion{Name: t.spec().Name, SHA256: hex.EncodeToString(h.Sum(nil))}
+}
+
+// toolVersions are the versions of r's tools, as recordHistory lists them.
+func (r *runner) toolVersions() []ToolVersion {
+	var vs []ToolVersion
+	for _, t := range r.tools {
+		if _, ok := t.(memoryTool); !ok {
+			vs = append(vs, toolVersion(t))
+		}
+	}
+	return vs
+}
+
+// ollamaDigest is the digest of a pulled model, or "" if it can't be
+// found out.
+func ollamaDigest(ctx context.Context, model string) string {
+	var tags struct {
+		Models []struct {
+			Name   string `json:"name"`
+			Digest string `json:"digest"`
+		} `json:"models"`
+	}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := getJSON(ctx, "Ollama", ollamaHost()+"/api/tags", headers, &tags); err != nil {
+		return ""
+	}
+	model = resolveModel(model)
+	for _, m := range tags.Models {
+		if hasOllamaModel([]string{m.Name}, model) {
+			return m.Digest
+		}
+	}
+	return ""
+}
+
+// secretKeyRe matches the config keys whose values are credentials.
+var secretKeyRe = regexp.MustCompile(`(?i)(key|token|password|secret|secrets|dsn|postgres|credentials)$`)
+
+// manifestConfig is the config in effect as JSON, its credentials masked
+// unless they are references.
+func manifestConfig() json.RawMessage {
+	data, err := json.Marshal(liveConfig())
+	if err != nil {
+		return nil
+	}
+	var v any
+	if json.Unmarshal(data, &v) != nil {
+		return nil
+	}
+	data, _ = json.Marshal(maskSecrets(v, false))
+	return json.RawMessage(redact(string(data)))
+}
+
+func maskSecrets(v any, secret bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = maskSecrets(e, secret || secretKeyRe.MatchString(k))
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = maskSecrets(e, secret)
+		}
+	case string:
+		if secret && v != "" && !isSecretRef(v) {
+			return "[REDACTED]"
+		}
+	}
+	return v
+}
+
+// manifestPath is where --write-manifest spec puts run id's manifest: spec
+// itself when it names a .json file, else id.json in the directory spec.
+func manifestPath(spec, id string) string {
+	if strings.HasSuffix(spec, ".json") {
+		return spec
+	}
+	return filepath.Join(spec, id+".json")
+}
+
+// writeManifest writes the manifest of a finished run, whose request is
+// as recordHistory takes it.
+func (r *runner) writeManifest(req TaskRequest, res TaskResult, took time.Duration) {
+	m := RunManifest{
+		Format:       manifestFormat,
+		RunID:        req.ID,
+		Time:         time.Now().UTC(),
+		DurationMS:   took.Milliseconds(),
+		Helix:        buildInfo(),
+		Provider:     res.Provider,
+		Model:        res.Model,
+		Seed:         res.Seed,
+		PromptSHA256: res.promptSHA256,
+		Sections:     res.sections,
+		Tools:        r.toolVersions(),
+		Config:       manifestConfig(),
+		Request:      req,
+		Result:       res,
+	}
+	if m.Provider == "local" {
+		m.ModelDigest = ollamaDigest(context.Background(), m.Model)
+	}
+	if res.Retrieval != nil {
+		for _, c := range res.Retrieval.Chunks {
+			m.Chunks = append(m.Chunks, c.ID)
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		data, err = sealAtRest(append(data, '\n'))
+	}
+	if err == nil {
+		path := manifestPath(r.manifest, req.ID)
+		if err = os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+			err = os.WriteFile(path, data, 0o600)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: manifest: %v\n", err)
+	}
+}
+
+// readManifest reads a manifest --write-manifest wrote.
+func readManifest(path string) (*RunManifest, error) {
+	data, err := readAtRest(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %v", err)
+	}
+	var m RunManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+	if m.Format < 1 || m.Format > manifestFormat {
+		return nil, fmt.Errorf("manifest %s has format %d; this helix reads up to %d", path, m.Format, manifestFormat)
+	}
+	return &m, nil
+}
+
+// entry is m as the history would have recorded the run.
+func (m *RunManifest) entry() *HistoryEntry {
+	e := &HistoryEntry{ID: m.RunID, Time: m.Time, DurationMS: m.DurationMS, Request: m.Request, Result: m.Result}
+	for _, t := range m.Tools {
+		e.Tools = append(e.Tools, t.Name)
+	}
+	return e
+}
+
+// compare lists what r, on this machine, has different from the run m
+// records, which may make the replay differ.
+func (m *RunManifest) compare(ctx context.Context, r *runner, req TaskRequest) []string {
+	var diffs []string
+	if b := buildInfo(); b.Version != m.Helix.Version || b.Commit != m.Helix.Commit {
+		diffs = append(diffs, fmt.Sprintf("the run was made by helix %s (%.12s), this is %s (%.12s)", m.Helix.Version, m.Helix.Commit, b.Version, b.Commit))
+	}
+	if m.ModelDigest != "" && req.Provider == m.Provider && req.Model == m.Model {
+		if d := ollamaDigest(ctx, m.Model); d != m.ModelDigest {
+			if d == "" {
+				d = "unknown"
+			}
+			diffs = append(diffs, fmt.Sprintf("model %s has digest %.12s here, %.12s in the manifest", m.Model, d, m.ModelDigest))
+		}
+	}
+	have := map[string]string{}
+	for _, t := range r.toolVersions() {
+		have[t.Name] = t.SHA256
+	}
+	for _, t := range m.Tools {
+		if sum, ok := have[t.Name]; ok && sum != t.SHA256 {
+			diffs = append(diffs, fmt.Sprintf("tool %s is not the version in the manifest", t.Name))
+		}
+	}
+	if sections := configDiff(m.Config, manifestConfig()); len(sections) > 0 {
+		diffs = append(diffs, "the config differs in: "+strings.Join(sections, ", "))
+	}
+	return diffs
+}
+
+// configDiff lists the top-level sections that differ between two
+// manifest configs.
+func configDiff(a, b json.RawMessage) []string {
+	var ma, mb map[string]json.RawMessage
+	if json.Unmarshal(a, &ma) != nil || json.Unmarshal(b, &mb) != nil {
+		return nil
+	}
+	keys := map[string]bool{}
+	for k := range ma {
+		keys[k] = true
+	}
+	for k := range mb {
+		keys[k] = true
+	}
+	var diff []string
+	for k := range keys {
+		va, vb := ma[k], mb[k]
+		if va == nil {
+			va = json.RawMessage("null")
+		}
+		if vb == nil {
+			vb = json.RawMessage("null")
+		}
+		if !sameJSON(va, vb) {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// promptDiff names the sections of the replayed prompt that differ from
+// the manifest's.
+func (m *RunManifest) promptDiff(res TaskResult) []string {
+	if m.PromptSHA256 == "" || res.promptSHA256 == "" || res.promptSHA256 == m.PromptSHA256 {
+		return nil
+	}
+	was := map[string]string{}
+	for _, s := range m.Sections {
+		was[s.Name] = s.SHA256
+	}
+	var diff []string
+	for _, s := range res.sections {
+		if was[s.Name] != s.SHA256 {
+			diff = append(diff, s.Name)
+		}
+		delete(was, s.Name)
+	}
+	for name := range was {
+		diff = append(diff, name)
+	}
+	sort.Strings(diff)
+	return diff
+}
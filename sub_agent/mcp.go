@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mcpProtocolVersion is the Model Context Protocol revision spoken here.
+const mcpProtocolVersion = "2024-11-05"
+
+// mcpImplementation identifies helix in the initialize handshake.
+var mcpImplementation = map[string]string{"name": "helix", "version": version}
+
+// MCPServerConfig is one MCP server: either a command speaking JSON-RPC on
+// stdio, or the URL of an HTTP+SSE endpoint.
+type MCPServerConfig struct {
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"` // added to the environment; values may be secret references
+
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // values may be secret references
+
+	Timeout string `json:"timeout,omitempty"` // per request, default 60s
+}
+
+// rpcMessage is any JSON-RPC 2.0 message: a request (ID and Method), a
+// notification (Method only) or a response (ID with Result or Error).
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string { return fmt.Sprintf("%s (code %d)", e.Message, e.Code) }
+
+const rpcMethodNotFound = -32601
+
+// mcpContent is an item of a tool result or resource.
+type mcpContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Resource *struct {
+		URI  string `json:"uri"`
+		Text string `json:"text,omitempty"`
+		Blob string `json:"blob,omitempty"`
+	} `json:"resource,omitempty"`
+}
+
+// mcpText flattens content to text for the model.
+func mcpText(content []mcpContent) string {
+	var parts []string
+	for _, c := range content {
+		switch {
+		case c.Type == "text":
+			parts = append(parts, c.Text)
+		case c.Resource != nil && c.Resource.Text != "":
+			parts = append(parts, fmt.Sprintf("[resource %s]\n%s", c.Resource.URI, c.Resource.Text))
+		case c.Resource != nil:
+			parts = append(parts, fmt.Sprintf("[binary resource %s]", c.Resource.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content, %s]", c.Type, c.MimeType))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// mcpTransport carries JSON-RPC messages; incoming ones are handed to the
+// function given to start, which is called from a single goroutine.
+type mcpTransport interface {
+	start(deliver func([]byte)) error
+	send(ctx context.Context, msg []byte) error
+	close() error
+}
+
+// mcpClient is a connection to one server. Requests may be made
+// concurrently; responses are matched by ID.
+type mcpClient struct {
+	name      string
+	transport mcpTransport
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[string]chan rpcMessage
+	err     error // set once the connection is gone
+
+	capabilities struct {
+		Tools     *struct{} `json:"tools"`
+		Resources *struct{} `json:"resources"`
+	}
+}
+
+var (
+	mcpClientsMu sync.Mutex
+	// mcpClients are shared by every runner in the process, so serve and
+	// worker modes keep one connection per server.
+	mcpClients = map[string]*mcpClient{}
+)
+
+// connectMCP returns the connection to the named server, starting it
+// and running the initialize handshake the first time.
+func connectMCP(name string, c MCPServerConfig) (*mcpClient, error) {
+	mcpClientsMu.Lock()
+	defer mcpClientsMu.Unlock()
+	if cl := mcpClients[name]; cl != nil && cl.alive() {
+		return cl, nil
+	}
+	cl := &mcpClient{name: name, timeout: 60 * time.Second, pending: map[string]chan rpcMessage{}}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+		}
+		cl.timeout = d
+	}
+	switch {
+	case c.Command != "" && c.URL != "":
+		return nil, fmt.Errorf("set either command or url, not both")
+	case c.Command != "":
+		env := os.Environ()
+		for k, v := range c.Env {
+			v, err := resolveSecretValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("env %s: %v", k, err)
+			}
+			env = append(env, k+"="+v)
+		}
+		cmd := exec.Command(c.Command, c.Args...)
+		cmd.Env = env
+		cl.transport = &mcpStdio{cmd: cmd}
+	case c.URL != "":
+		headers := map[string]string{}
+		for k, v := range c.Headers {
+			v, err := resolveSecretValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %v", k, err)
+			}
+			headers[k] = v
+		}
+		cl.transport = &mcpSSE{url: c.URL, headers: headers}
+	default:
+		return nil, fmt.Errorf("needs a command or a url")
+	}
+	if err := cl.transport.start(cl.deliver); err != nil {
+		return nil, err
+	}
+
+	var init struct {
+		ProtocolVersion string          `json:"protocolVersion"`
+		Capabilities    json.RawMessage `json:"capabilities"`
+	}
+	err := cl.call(context.Background(), "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      mcpImplementation,
+	}, &init)
+	if err == nil {
+		err = json.Unmarshal(init.Capabilities, &cl.capabilities)
+	}
+	if err == nil {
+		err = cl.notify(context.Background(), "notifications/initialized", nil)
+	}
+	if err != nil {
+		cl.transport.close()
+		return nil, fmt.Errorf("initializing: %v", err)
+	}
+	mcpClients[name] = cl
+	return cl, nil
+}
+
+func (c *mcpClient) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// deliver routes one incoming message.
+func (c *mcpClient) deliver(data []byte) {
+	if data == nil {
+		c.fail(fmt.Errorf("MCP server %s closed the connection", c.name))
+		return
+	}
+	var msg rpcMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	if msg.Method != "" {
+		if len(msg.ID) > 0 {
+			c.answerServer(msg)
+		}
+		return
+	}
+	c.mu.Lock()
+	ch := c.pending[string(msg.ID)]
+	delete(c.pending, string(msg.ID))
+	c.mu.Unlock()
+	if ch != nil {
+		ch <- msg
+	}
+}
+
+// answerServer replies to requests the server makes of the client; only
+// ping is supported.
+func (c *mcpClient) answerServer(req rpcMessage) {
+	resp := rpcMessage{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "ping" {
+		resp.Result = json.RawMessage(`{}`)
+	} else {
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "method not supported: " + req.Method}
+	}
+	data, _ := json.Marshal(resp)
+	go c.transport.send(context.Background(), data)
+}
+
+// fail ends every pending request with err.
+func (c *mcpClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// call makes a request and decodes its result into out.
+func (c *mcpClient) call(ctx context.Context, method string, params, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := json.RawMessage(fmt.Sprint(c.nextID))
+	ch := make(chan rpcMessage, 1)
+	c.pending[string(id)] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, string(id))
+		c.mu.Unlock()
+	}()
+
+	msg := rpcMessage{JSONRPC: "2.0", ID: id, Method: method}
+	if params != nil {
+		p, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		msg.Params = p
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := c.transport.send(ctx, data); err != nil {
+		return err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if out != nil {
+			return json.Unmarshal(resp.Result, out)
+		}
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s: no response from MCP server %s within %s", method, c.name, c.timeout)
+		}
+		return ctx.Err()
+	}
+}
+
+func (c *mcpClient) notify(ctx context.Context, method string, params any) error {
+	msg := rpcMessage{JSONRPC: "2.0", Method: method}
+	if params != nil {
+		p, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		msg.Params = p
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.transport.send(ctx, data)
+}
+
+// mcpTools discovers a server's tools, plus a read_resource tool when it
+// has resources.
+func mcpTools(name string, c MCPServerConfig) ([]tool, error) {
+	cl, err := connectMCP(name, c)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	var tools []tool
+	if cl.capabilities.Tools != nil {
+		cursor := ""
+		for {
+			var page struct {
+				Tools []struct {
+					Name        string          `json:"name"`
+					Description string          `json:"description"`
+					InputSchema json.RawMessage `json:"inputSchema"`
+				} `json:"tools"`
+				NextCursor string `json:"nextCursor"`
+			}
+			params := map[string]any{}
+			if cursor != "" {
+				params["cursor"] = cursor
+			}
+			if err := cl.call(ctx, "tools/list", params, &page); err != nil {
+				return nil, fmt.Errorf("listing tools: %v", err)
+			}
+			for _, t := range page.Tools {
+				tools = append(tools, &mcpTool{client: cl, remote: t.Name,
+					toolSpec: toolSpec{Name: name + "." + t.Name, Description: t.Description, InputSchema: t.InputSchema}})
+			}
+			if cursor = page.NextCursor; cursor == "" {
+				break
+			}
+		}
+	}
+	if cl.capabilities.Resources != nil {
+		var list struct {
+			Resources []struct {
+				URI         string `json:"uri"`
+				Name        string `json:"name"`
+				Description string `json:"description"`
+			} `json:"resources"`
+		}
+		if err := cl.call(ctx, "resources/list", map[string]any{}, &list); err != nil {
+			return nil, fmt.Errorf("listing resources: %v", err)
+		}
+		if len(list.Resources) > 0 {
+			var desc strings.Builder
+			fmt.Fprintf(&desc, "Read a resource from %s by URI. Available resources:", name)
+			for i, r := range list.Resources {
+				if i == 50 {
+					fmt.Fprintf(&desc, "\n  ... and %d more", len(list.Resources)-i)
+					break
+				}
+				fmt.Fprintf(&desc, "\n  %s (%s)", r.URI, strings.TrimSpace(r.Name+" "+r.Description))
+			}
+			tools = append(tools, &mcpResourceTool{client: cl, toolSpec: toolSpec{
+				Name:        name + ".read_resource",
+				Description: desc.String(),
+				InputSchema: json.RawMessage(`{"type":"object","properties":{"uri":{"type":"string"}},"required":["uri"]}`),
+			}})
+		}
+	}
+	if len(tools) == 0 {
+		return nil, fmt.Errorf("MCP server %s offers no tools or resources", name)
+	}
+	return tools, nil
+}
+
+// mcpTool is one tool of an MCP server.
+type mcpTool struct {
+	toolSpec
+	client *mcpClient
+	remote string
+}
+
+func (t *mcpTool) spec() toolSpec { return t.toolSpec }
+
+func (t *mcpTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	args := input
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage(`{}`)
+	}
+	var res struct {
+		Content []mcpContent `json:"content"`
+		IsError bool         `json:"isError"`
+	}
+	if err := t.client.call(ctx, "tools/call", map[string]any{"name": t.remote, "arguments": args}, &res); err != nil {
+		return "", err
+	}
+	text := mcpText(res.Content)
+	if res.IsError {
+		return "", fmt.Errorf("%s", text)
+	}
+	return text, nil
+}
+
+type mcpResourceTool struct {
+	toolSpec
+	client *mcpClient
+}
+
+func (t *mcpResourceTool) spec() toolSpec { return t.toolSpec }
+
+func (t *mcpResourceTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	var in struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil || in.URI == "" {
+		return "", fmt.Errorf("invalid input: expected {\"uri\": ...}")
+	}
+	var res struct {
+		Contents []struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+			Blob string `json:"blob"`
+		} `json:"contents"`
+	}
+	if err := t.client.call(ctx, "resources/read", map[string]string{"uri": in.URI}, &res); err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, c := range res.Contents {
+		if c.Blob != "" && c.Text == "" {
+			parts = append(parts, fmt.Sprintf("[binary content of %s]", c.URI))
+		} else {
+			parts = append(parts, c.Text)
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// mcpStdio runs the server as a child process, one JSON message per line.
+type mcpStdio struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *cappedBuffer
+	mu     sync.Mutex
+}
+
+func (s *mcpStdio) start(deliver func([]byte)) error {
+	var err error
+	if s.stdin, err = s.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	s.stderr = &cappedBuffer{max: 4096}
+	s.cmd.Stderr = s.stderr
+	if err := s.cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		r := bufio.NewReaderSize(stdout, 64<<10)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				deliver(line)
+			}
+			if err != nil {
+				s.cmd.Wait()
+				deliver(nil)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *mcpStdio) send(_ context.Context, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.stdin.Write(append(msg, '\n'))
+	if err != nil {
+		return fmt.Errorf("writing to MCP server: %v %s", err, strings.TrimSpace(s.stderr.String()))
+	}
+	return nil
+}
+
+func (s *mcpStdio) close() error {
+	s.stdin.Close()
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// mcpSSE is the HTTP+SSE transport: a long-lived GET receives messages as
+// server-sent events, and the first "endpoint" event says where to POST.
+type mcpSSE struct {
+	url      string
+	headers  map[string]string
+	endpoint string
+	resp     *http.Response
+}
+
+func (s *mcpSSE) start(deliver func([]byte)) error {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("connecting to %s: %s", s.url, resp.Status)
+	}
+	s.resp = resp
+
+	endpoint := make(chan string, 1)
+	go func() {
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 64<<10), 16<<20)
+		event, data := "", []string{}
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				payload := strings.Join(data, "\n")
+				if event == "endpoint" {
+					select {
+					case endpoint <- payload:
+					default:
+					}
+				} else if event == "" || event == "message" {
+					deliver([]byte(payload))
+				}
+				event, data = "", data[:0]
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			}
+		}
+		close(endpoint)
+		deliver(nil)
+	}()
+
+	select {
+	case ep, ok := <-endpoint:
+		if !ok {
+			return fmt.Errorf("%s closed the stream before sending its endpoint", s.url)
+		}
+		base, err := url.Parse(s.url)
+		if err != nil {
+			return err
+		}
+		ref, err := url.Parse(ep)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint %q: %v", ep, err)
+		}
+		s.endpoint = base.ResolveReference(ref).String()
+		return nil
+	case <-time.After(30 * time.Second):
+		resp.Body.Close()
+		return fmt.Errorf("%s sent no endpoint event", s.url)
+	}
+}
+
+func (s *mcpSSE) send(ctx context.Context, msg []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("posting to %s: %s %s", s.endpoint, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *mcpSSE) close() error {
+	if s.resp != nil {
+		return s.resp.Body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	rpcParseError    = -32700
+	rpcInvalidParams = -32602
+	rpcInternalError = -32603
+)
+
+// mcpServeTools are the tools `mcp-serve` offers.
+var mcpServeTools = []toolSpec{
+	{
+		Name:        "run",
+		Description: "Run a task with the helix sub-agent and return its answer.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"task":{"type":"string","description":"What to do"},"input":{"type":"string","description":"Text the task works on"},"provider":{"type":"string"},"model":{"type":"string"}},"required":["task"]}`),
+	},
+	{
+		Name:        "summarize",
+		Description: "Summarize a document of any length, chunking it to fit the model's window.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"},"instructions":{"type":"string","description":"Focus, length or format of the summary"},"provider":{"type":"string"},"model":{"type":"string"}},"required":["text"]}`),
+	},
+}
+
+// mcpServer answers MCP requests on stdin/stdout. Tool calls run
+// concurrently and can be cancelled by the client.
+type mcpServer struct {
+	runner      *runner
+	provider    string
+	model       string
+	chunkTokens int
+
+	out     *json.Encoder
+	outMu   sync.Mutex
+	cancels sync.Map // request ID -> context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// mcpServeCommand implements `mcp-serve`: expose helix as an MCP server over
+// stdio, for editors and other agents. Logs go to stderr.
+func mcpServeCommand(fs *flag.FlagSet) func(args []string) {
+	prov := fs.String("provider", "local", "Default provider for tool calls that do not name one")
+	mdl := fs.String("model", "", "Default model")
+	chunkTokens := fs.Int("chunk-tokens", 3000, "Approximate tokens per chunk for summarize")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		s := &mcpServer{runner: r, provider: *prov, model: *mdl, chunkTokens: *chunkTokens, out: json.NewEncoder(os.Stdout)}
+		fmt.Fprintln(os.Stderr, "[Sub-Agent] MCP server ready on stdio")
+		s.serve(bufio.NewReader(os.Stdin))
+	}
+}
+
+// serve handles requests until stdin closes, then waits for running calls.
+func (s *mcpServer) serve(in *bufio.Reader) {
+	defer s.wg.Wait()
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(line) > 0 {
+			s.handle(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *mcpServer) send(msg rpcMessage) {
+	msg.JSONRPC = "2.0"
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if err := s.out.Encode(msg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: writing MCP response: %v\n", err)
+	}
+}
+
+func (s *mcpServer) reply(id json.RawMessage, result any) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		s.send(rpcMessage{ID: id, Error: &rpcError{Code: rpcInternalError, Message: err.Error()}})
+		return
+	}
+	s.send(rpcMessage{ID: id, Result: data})
+}
+
+func (s *mcpServer) handle(line []byte) {
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.send(rpcMessage{ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+		}
+		return
+	}
+	notification := len(msg.ID) == 0
+	switch msg.Method {
+	case "initialize":
+		s.reply(msg.ID, map[string]any{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      mcpImplementation,
+		})
+	case "ping":
+		s.reply(msg.ID, map[string]any{})
+	case "tools/list":
+		s.reply(msg.ID, map[string]any{"tools": mcpToolList()})
+	case "tools/call":
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancels.Store(string(msg.ID), cancel)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.cancels.Delete(string(msg.ID))
+			defer cancel()
+			s.callTool(ctx, msg)
+		}()
+	case "notifications/cancelled":
+		var p struct {
+			RequestID json.RawMessage `json:"requestId"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			if cancel, ok := s.cancels.Load(string(p.RequestID)); ok {
+				cancel.(context.CancelFunc)()
+			}
+		}
+	default:
+		if !notification {
+			s.send(rpcMessage{ID: msg.ID, Error: &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method}})
+		}
+	}
+}
+
+// mcpToolList renders mcpServeTools in MCP's field names.
+func mcpToolList() []map[string]any {
+	var list []map[string]any
+	for _, t := range mcpServeTools {
+		list = append(list, map[string]any{"name": t.Name, "description": t.Description, "inputSchema": t.InputSchema})
+	}
+	return list
+}
+
+// callTool runs one tools/call. Task failures are tool results with
+// isError set, so the calling model sees them; bad requests are protocol
+// errors.
+func (s *mcpServer) callTool(ctx context.Context, msg rpcMessage) {
+	var p struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		s.send(rpcMessage{ID: msg.ID, Error: &rpcError{Code: rpcInvalidParams, Message: err.Error()}})
+		return
+	}
+	var args struct {
+		Task         string `json:"task"`
+		Input        string `json:"input"`
+		Text         string `json:"text"`
+		Instructions string `json:"instructions"`
+		Provider     string `json:"provider"`
+		Model        string `json:"model"`
+	}
+	if len(p.Arguments) > 0 {
+		if err := json.Unmarshal(p.Arguments, &args); err != nil {
+			s.send(rpcMessage{ID: msg.ID, Error: &rpcError{Code: rpcInvalidParams, Message: "arguments: " + err.Error()}})
+			return
+		}
+	}
+	provider, model := s.provider, s.model
+	if args.Provider != "" {
+		provider, model = args.Provider, args.Model
+	} else if args.Model != "" {
+		model = args.Model
+	}
+
+	var text string
+	var err error
+	switch p.Name {
+	case "run":
+		if args.Task == "" {
+			s.send(rpcMessage{ID: msg.ID, Error: &rpcError{Code: rpcInvalidParams, Message: "task is required"}})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] MCP run via %s: %s\n", provider, truncateRunes(args.Task, 80))
+		var res TaskResult
+		res, err = s.runner.run(ctx, TaskRequest{Task: args.Task, Input: args.Input, Provider: provider, Model: model})
+		text = res.Output
+		if res.ArtifactURL != "" {
+			text = fmt.Sprintf("The result (%d bytes) was uploaded to %s", res.OutputBytes, res.ArtifactURL)
+		}
+	case "summarize":
+		if args.Text == "" {
+			s.send(rpcMessage{ID: msg.ID, Error: &rpcError{Code: rpcInvalidParams, Message: "text is required"}})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] MCP summarize via %s: %d bytes\n", provider, len(args.Text))
+		sum := &summarizer{provider: provider, model: defaultModel(provider, model), key: s.runner.key, chunkTokens: s.chunkTokens, concurrency: 4}
+		if args.Instructions != "" {
+			sum.instructions = "\n" + args.Instructions
+		}
+		var res SummaryResult
+		res, err = sum.summarize(ctx, args.Text)
+		text = res.Output
+	default:
+		s.send(rpcMessage{ID: msg.ID, Error: &rpcError{Code: rpcInvalidParams, Message: "unknown tool: " + p.Name}})
+		return
+	}
+
+	result := map[string]any{}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", redactErr(err))
+		text, result["isError"] = redactErr(err).Error(), true
+	}
+	result["content"] = []mcpContent{{Type: "text", Text: text}}
+	s.reply(msg.ID, result)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryConfig configures long-term memory (see --memory).
+type MemoryConfig struct {
+	// Enabled is the default for --memory.
+	Enabled bool `json:"enabled,omitempty"`
+	// Namespace is the default for --memory-namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Provider and Model pick the embedding API; the default is Ollama's
+	// nomic-embed-text, so memories stay on the machine.
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// Dir holds one file per namespace; defaults to ~/.config/helix/memory.
+	Dir string `json:"dir,omitempty"`
+	// MinScore is the cosine similarity a memory needs to be recalled for
+	// a task (default 0.35); raise it if unrelated facts show up.
+	MinScore float64 `json:"min_score,omitempty"`
+}
+
+// Memory is one remembered fact.
+type Memory struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	Created   time.Time `json:"created"`
+	Model     string    `json:"model"` // embedding model of Embedding
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+// Recall settings: how many memories are put in front of a task, and how
+// similar a memory must be to count as relevant or as a duplicate.
+const (
+	memoryRecall    = 5
+	memoryMinScore  = 0.35
+	memoryDuplicate = 0.95
+)
+
+var namespaceRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// memoryStore is one namespace of memories. Namespaces are separate files,
+// so one never sees another's facts.
+type memoryStore struct {
+	path      string
+	namespace string
+	provider  string
+	model     string
+	key       string
+	minScore  float64
+
+	mu sync.Mutex
+}
+
+func memoryDir() (string, error) {
+	if config.Memory.Dir != "" {
+		return config.Memory.Dir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("locating memory directory: %v", err)
+	}
+	return filepath.Join(dir, "helix", "memory"), nil
+}
+
+// openMemory returns the store for namespace, embedding with the
+// configured provider.
+func openMemory(namespace, key string) (*memoryStore, error) {
+	if !namespaceRe.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid memory namespace %q: use letters, digits, '.', '_' and '-'", namespace)
+	}
+	dir, err := memoryDir()
+	if err != nil {
+		return nil, err
+	}
+	c := config.Memory
+	model := c.Model
+	if model == "" {
+		model = defaultEmbedModel(c.Provider)
+	}
+	minScore := c.MinScore
+	if minScore == 0 {
+		minScore = memoryMinScore
+	}
+	return &memoryStore{path: filepath.Join(dir, namespace+".json"), namespace: namespace, provider: c.Provider, model: model, key: key, minScore: minScore}, nil
+}
+
+func (s *memoryStore) load() ([]Memory, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = openAtRest(data); err != nil {
+		return nil, fmt.Errorf("memory %s: %v", s.namespace, err)
+	}
+	var mems []Memory
+	if err := json.Unmarshal(data, &mems); err != nil {
+		return nil, fmt.Errorf("memory %s: %v", s.namespace, err)
+	}
+	return mems, nil
+}
+
+func (s *memoryStore) write(mems []Memory) error {
+	// Memories are about the user, so keep them to the user.
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(mems, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = sealAtRest(data); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// add remembers text, replacing a near-identical memory instead of keeping
+// both. It reports the memory's ID and whether it replaced one.
+func (s *memoryStore) add(ctx context.Context, text string) (string, bool, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", false, fmt.Errorf("nothing to remember")
+	}
+	vecs, err := embed(ctx, s.provider, s.model, []string{text}, s.key)
+	if err != nil {
+		return "", false, fmt.Errorf("embedding memory: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mems, err := s.load()
+	if err != nil {
+		return "", false, err
+	}
+	m := Memory{ID: newID()[:8], Text: text, Created: time.Now().UTC(), Model: s.model, Embedding: vecs[0]}
+	replaced := false
+	for i, old := range mems {
+		if old.Model == m.Model && cosine(old.Embedding, m.Embedding) >= memoryDuplicate {
+			m.ID = old.ID
+			mems[i], replaced = m, true
+			break
+		}
+	}
+	if !replaced {
+		mems = append(mems, m)
+	}
+	return m.ID, replaced, s.write(mems)
+}
+
+// scoredMemory is a search hit.
+type scoredMemory struct {
+	Memory
+	Score float64
+}
+
+// search returns up to n memories relevant to query, best first. Memories
+// embedded by a different model can't be compared and are skipped.
+func (s *memoryStore) search(ctx context.Context, query string, n int) ([]scoredMemory, error) {
+	s.mu.Lock()
+	mems, err := s.load()
+	s.mu.Unlock()
+	if err != nil || len(mems) == 0 {
+		return nil, err
+	}
+	vecs, err := embed(ctx, s.provider, s.model, []string{query}, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("embedding query: %w", err)
+	}
+	var hits []scoredMemory
+	for _, m := range mems {
+		if m.Model != s.model {
+			continue
+		}
+		if score := cosine(m.Embedding, vecs[0]); score >= s.minScore {
+			hits = append(hits, scoredMemory{m, score})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > n {
+		hits = hits[:n]
+	}
+	return hits, nil
+}
+
+// forget deletes the memories with the given IDs, or all of them when ids
+// is empty, and returns how many were deleted.
+func (s *memoryStore) forget(ids []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mems, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return len(mems), os.Remove(s.path)
+	}
+	drop := map[string]bool{}
+	for _, id := range ids {
+		drop[id] = true
+	}
+	kept := mems[:0]
+	for _, m := range mems {
+		if drop[m.ID] {
+			delete(drop, m.ID)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	if len(drop) > 0 {
+		var missing []string
+		for id := range drop {
+			missing = append(missing, id)
+		}
+		sort.Strings(missing)
+		return 0, fmt.Errorf("no memory with ID %s in namespace %s", strings.Join(missing, ", "), s.namespace)
+	}
+	return len(mems) - len(kept), s.write(kept)
+}
+
+// recall lists the memories relevant to task for the start of the prompt.
+// Failing to embed only drops the memories, so a stopped embedding server
+// doesn't fail every task.
+func (s *memoryStore) recall(ctx context.Context, task string) string {
+	hits, err := s.search(ctx, task, memoryRecall)
+	if err != nil {
+		logf(ctx, "Warning: recalling memories: %v", err)
+		return ""
+	}
+	if len(hits) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Things you remember from earlier sessions:\n")
+	for _, h := range hits {
+		fmt.Fprintf(&b, "- %s\n", h.Text)
+	}
+	return b.String() + "\n"
+}
+
+// memoryTool lets the model save and look up long-term memories.
+type memoryTool struct {
+	store *memoryStore
+}
+
+func (t memoryTool) spec() toolSpec {
+	return toolSpec{
+		Name:        "memory",
+		Description: "Long-term memory that persists across sessions. save stores a durable fact or preference about the user or their environment (e.g. \"the user's cluster is on GKE\"); search finds saved facts related to a query. Don't save secrets or details that only matter to this task.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"action":{"type":"string","enum":["save","search"]},"text":{"type":"string","description":"The fact to save, or the search query"}},"required":["action","text"]}`),
+	}
+}
+
+func (t memoryTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	var in struct {
+		Action string `json:"action"`
+		Text   string `json:"text"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %v", err)
+	}
+	switch in.Action {
+	case "save":
+		if found := scanSecrets(in.Text); len(found) > 0 {
+			return "", fmt.Errorf("not saving a memory that appears to contain secrets: %s", strings.Join(found, ", "))
+		}
+		id, replaced, err := t.store.add(ctx, in.Text)
+		if err != nil {
+			return "", err
+		}
+		if replaced {
+			return "Updated memory " + id + ".", nil
+		}
+		return "Saved memory " + id + ".", nil
+	case "search":
+		hits, err := t.store.search(ctx, in.Text, memoryRecall)
+		if err != nil {
+			return "", err
+		}
+		if len(hits) == 0 {
+			return "No related memories.", nil
+		}
+		var b strings.Builder
+		for _, h := range hits {
+			fmt.Fprintf(&b, "- %s\n", h.Text)
+		}
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("unknown action %q: expected save or search", in.Action)
+}
+
+func memoryNamespaceDefault() string {
+	if config.Memory.Namespace != "" {
+		return config.Memory.Namespace
+	}
+	return "default"
+}
+
+// memoryStoreFor opens the namespace named by the --namespace flag of a
+// memory subcommand.
+func memoryStoreFor(fs *flag.FlagSet) func() *memoryStore {
+	ns := fs.String("namespace", memoryNamespaceDefault(), "Memory namespace")
+	kf := addKeyFlags(fs)
+	return func() *memoryStore {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		s, err := openMemory(*ns, key)
+		if err != nil {
+			fatal(configError(err))
+		}
+		return s
+	}
+}
+
+// memoryListCommand implements `memory list`.
+func memoryListCommand(fs *flag.FlagSet) func(args []string) {
+	open := memoryStoreFor(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the memories as JSON")
+	return func(args []string) {
+		s := open()
+		mems, err := s.load()
+		if err != nil {
+			fatal(err)
+		}
+		if jsonOut {
+			for i := range mems {
+				mems[i].Embedding = nil
+			}
+			printJSON(mems)
+			return
+		}
+		if len(mems) == 0 {
+			fmt.Printf("No memories in namespace %s.\n", s.namespace)
+			return
+		}
+		for _, m := range mems {
+			fmt.Printf("%s  %s  %s\n", m.ID, m.Created.Local().Format("2006-01-02"), m.Text)
+		}
+	}
+}
+
+// memoryAddCommand implements `memory add <text>`.
+func memoryAddCommand(fs *flag.FlagSet) func(args []string) {
+	open := memoryStoreFor(fs)
+	return func(args []string) {
+		if len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix memory add <text>"))
+		}
+		id, replaced, err := open().add(context.Background(), strings.Join(args, " "))
+		if err != nil {
+			fatal(err)
+		}
+		verb := "Saved"
+		if replaced {
+			verb = "Updated"
+		}
+		fmt.Printf("%s memory %s\n", verb, id)
+	}
+}
+
+// memoryForgetCommand implements `memory forget <id>... | --all`.
+func memoryForgetCommand(fs *flag.FlagSet) func(args []string) {
+	open := memoryStoreFor(fs)
+	all := fs.Bool("all", false, "Forget every memory in the namespace")
+	return func(args []string) {
+		if len(args) == 0 && !*all {
+			fatal(kindError(ErrConfig, "usage: helix memory forget <id>... (or --all)"))
+		}
+		if len(args) > 0 && *all {
+			fatal(kindError(ErrConfig, "pass memory IDs or --all, not both"))
+		}
+		s := open()
+		n, err := s.forget(args)
+		if err != nil && !os.IsNotExist(err) {
+			fatal(err)
+		}
+		fmt.Printf("Forgot %d memory(ies) in namespace %s\n", n, s.namespace)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ModelInfo is the registry's metadata for a model family.
+type ModelInfo struct {
+	ContextWindow int  `json:"context_window"`
+	Vision        bool `json:"vision,omitempty"`
+	Tools         bool `json:"tools,omitempty"`
+	// Prices are USD per million tokens; zero for local models.
+	InputPrice  float64 `json:"input_price,omitempty"`
+	OutputPrice float64 `json:"output_price,omitempty"`
+	// Relative 1-10 ratings used by the router.
+	Quality int `json:"quality,omitempty"`
+	Speed   int `json:"speed,omitempty"`
+}
+
+// builtinModels maps model name prefixes to their metadata. The longest
+// matching prefix wins, so "llama3.2-vision" overrides "llama3.2". Entries in
+// the config's "models" section replace these wholesale.
+var builtinModels = map[string]ModelInfo{
+	"deepseek-r1":                 {ContextWindow: 131072, Quality: 6, Speed: 3},
+	"llama3":                      {ContextWindow: 8192, Quality: 4, Speed: 7},
+	"llama3.1":                    {ContextWindow: 131072, Tools: true, Quality: 5, Speed: 7},
+	"llama3.2":                    {ContextWindow: 131072, Tools: true, Quality: 4, Speed: 9},
+	"llama3.2-vision":             {ContextWindow: 131072, Vision: true, Quality: 5, Speed: 5},
+	"llama3.3":                    {ContextWindow: 131072, Tools: true, Quality: 7, Speed: 3},
+	"llava":                       {ContextWindow: 4096, Vision: true, Quality: 3, Speed: 6},
+	"minicpm-v":                   {ContextWindow: 32768, Vision: true, Quality: 4, Speed: 6},
+	"qwen2.5":                     {ContextWindow: 32768, Tools: true, Quality: 6, Speed: 6},
+	"qwen2.5vl":                   {ContextWindow: 131072, Vision: true, Quality: 6, Speed: 5},
+	"qwen3":                       {ContextWindow: 40960, Tools: true, Quality: 7, Speed: 5},
+	"mistral":                     {ContextWindow: 32768, Tools: true, Quality: 5, Speed: 7},
+	"mixtral":                     {ContextWindow: 32768, Tools: true, Quality: 6, Speed: 4},
+	"gemma2":                      {ContextWindow: 8192, Quality: 5, Speed: 6},
+	"gemma3":                      {ContextWindow: 131072, Vision: true, Quality: 6, Speed: 5},
+	"phi3":                        {ContextWindow: 4096, Quality: 3, Speed: 9},
+	"phi4":                        {ContextWindow: 16384, Quality: 6, Speed: 6},
+	"codellama":                   {ContextWindow: 16384, Quality: 4, Speed: 6},
+	"gpt-4o":                      {ContextWindow: 128000, Vision: true, Tools: true, InputPrice: 2.50, OutputPrice: 10.00, Quality: 9, Speed: 7},
+	"gpt-4o-mini":                 {ContextWindow: 128000, Vision: true, Tools: true, InputPrice: 0.15, OutputPrice: 0.60, Quality: 7, Speed: 9},
+	"gpt-4.1":                     {ContextWindow: 1047576, Vision: true, Tools: true, InputPrice: 2.00, OutputPrice: 8.00, Quality: 9, Speed: 7},
+	"gpt-4.1-mini":                {ContextWindow: 1047576, Vision: true, Tools: true, InputPrice: 0.40, OutputPrice: 1.60, Quality: 7, Speed: 9},
+	"o3-mini":                     {ContextWindow: 200000, Tools: true, InputPrice: 1.10, OutputPrice: 4.40, Quality: 9, Speed: 4},
+	"anthropic.claude-3-5-sonnet": {ContextWindow: 200000, Vision: true, Tools: true, InputPrice: 3.00, OutputPrice: 15.00, Quality: 9, Speed: 6},
+	"anthropic.claude-3-haiku":    {ContextWindow: 200000, Vision: true, Tools: true, InputPrice: 0.25, OutputPrice: 1.25, Quality: 6, Speed: 9},
+	"meta.llama3-1":               {ContextWindow: 128000, Tools: true, InputPrice: 0.22, OutputPrice: 0.22, Quality: 6, Speed: 7},
+	"amazon.titan-text":           {ContextWindow: 8192, InputPrice: 0.15, OutputPrice: 0.20, Quality: 4, Speed: 8},
+	"gemini-2.5-flash":            {ContextWindow: 1048576, Vision: true, Tools: true, InputPrice: 0.30, OutputPrice: 2.50, Quality: 8, Speed: 8},
+	"gemini-2.5-pro":              {ContextWindow: 1048576, Vision: true, Tools: true, InputPrice: 1.25, OutputPrice: 10.00, Quality: 10, Speed: 4},
+}
+
+// unknownModel is assumed for models the registry has never heard of.
+var unknownModel = ModelInfo{ContextWindow: 8192, Quality: 3, Speed: 5}
+
+// geminiModel is the model behind GeminiBaseURL.
+const geminiModel = "gemini-2.5-flash"
+
+// registryName maps a provider/model pair onto the registry's naming.
+func registryName(providerName, modelName string) string {
+	if providerName == "cloud" && modelName == "" {
+		return geminiModel
+	}
+	return modelName
+}
+
+// lookupModel returns the registry entry for a model and whether one matched.
+func lookupModel(providerName, modelName string) (ModelInfo, bool) {
+	name := registryName(providerName, modelName)
+	best := ""
+	var info ModelInfo
+	for prefix, mi := range registryEntries() {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(best) {
+			best, info = prefix, mi
+		}
+	}
+	if best == "" {
+		return unknownModel, false
+	}
+	return info, true
+}
+
+// registryEntries merges the built-in registry with the config overrides.
+func registryEntries() map[string]ModelInfo {
+	models := liveConfig().Models
+	entries := make(map[string]ModelInfo, len(builtinModels)+len(models))
+	for k, v := range builtinModels {
+		entries[k] = v
+	}
+	for k, v := range models {
+		entries[k] = v
+	}
+	return entries
+}
+
+// validateCapabilities rejects requests the model cannot serve.
+func validateCapabilities(req TaskRequest) error {
+	info, known := lookupModel(req.Provider, req.Model)
+	name := modelChoice{req.Provider, registryName(req.Provider, req.Model)}
+	if len(req.Images) > 0 && !info.Vision {
+		if !known {
+			return kindError(ErrUnsupported, "%s is not in the model registry, so image input is not allowed; declare it with \"vision\": true in the config's models section", name)
+		}
+		return kindError(ErrUnsupported, "%s does not support image input; use a vision model such as llama3.2-vision or provider=cloud", name)
+	}
+	if len(req.Files) > 0 && req.Provider != "cloud" {
+		return kindError(ErrUnsupported, "%s can't take --file attachments; only provider=cloud (Gemini) reads PDFs, video and audio as-is. Use --context for text", name)
+	}
+	return nil
+}
+
+// modelsCommand implements `models`: print the effective registry.
+func modelsCommand(fs *flag.FlagSet) func(args []string) {
+	asJSON := fs.Bool("json", false, "Print the registry as JSON")
+	return func([]string) {
+		entries := registryEntries()
+		if *asJSON {
+			printJSON(entries)
+			return
+		}
+
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stdout, "%-20s %10s  %-6s %-5s %s\n", "MODEL", "CONTEXT", "VISION", "TOOLS", "PRICE (IN/OUT PER 1M)")
+		for _, name := range names {
+			mi := entries[name]
+			price := "-"
+			if mi.InputPrice > 0 || mi.OutputPrice > 0 {
+				price = fmt.Sprintf("$%.2f / $%.2f", mi.InputPrice, mi.OutputPrice)
+			}
+			fmt.Fprintf(os.Stdout, "%-20s %10d  %-6v %-5v %s\n", name, mi.ContextWindow, mi.Vision, mi.Tools, price)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ModerationConfig is the "guardrails.moderation" config section; the
+// --moderation flags override Provider and Action.
+type ModerationConfig struct {
+	// Provider is "keywords", "openai" or "exec:<command>". Empty disables
+	// moderation.
+	Provider string `json:"provider,omitempty"`
+	// Action is "block" (fail the task), "flag" (add a warning) or "log"
+	// (note it on stderr). All three report the verdict in the result.
+	Action string `json:"action,omitempty"`
+	// Keywords maps a category to the words that put text in it, for the
+	// keywords provider.
+	Keywords map[string][]string `json:"keywords,omitempty"`
+	// Model is the OpenAI moderation model.
+	Model string `json:"model,omitempty"`
+}
+
+// Moderation actions.
+const (
+	ModerationBlock = "block"
+	ModerationFlag  = "flag"
+	ModerationLog   = "log"
+)
+
+func moderationActionDefault() string {
+	if config.Guardrails.Moderation.Action != "" {
+		return config.Guardrails.Moderation.Action
+	}
+	return ModerationBlock
+}
+
+// ModerationVerdict is a moderator's decision on one piece of text.
+type ModerationVerdict struct {
+	Flagged    bool     `json:"flagged"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// ModerationReport is set on the result when input or output was flagged.
+type ModerationReport struct {
+	Provider string             `json:"provider"`
+	Action   string             `json:"action"`
+	Input    *ModerationVerdict `json:"input,omitempty"`
+	Output   *ModerationVerdict `json:"output,omitempty"`
+}
+
+// moderator classifies text.
+type moderator interface {
+	moderate(ctx context.Context, text string) (ModerationVerdict, error)
+}
+
+// newModerator builds the moderator named by spec, or returns nil for "" or "off".
+func newModerator(spec string) (moderator, error) {
+	switch {
+	case spec == "" || spec == "off":
+		return nil, nil
+	case spec == "keywords":
+		return newKeywordModerator(config.Guardrails.Moderation.Keywords)
+	case spec == "openai":
+		return openAIModerator{model: config.Guardrails.Moderation.Model}, nil
+	case strings.HasPrefix(spec, "exec:"):
+		cmd := strings.TrimPrefix(spec, "exec:")
+		if cmd == "" {
+			return nil, fmt.Errorf("moderation exec: needs a command")
+		}
+		return execModerator{cmd: cmd}, nil
+	}
+	return nil, fmt.Errorf("invalid --moderation %q: expected keywords, openai, exec:<command> or off", spec)
+}
+
+// keywordModerator flags text containing any configured word, matched
+// case-insensitively on word boundaries.
+type keywordModerator struct {
+	categories []string
+	res        map[string]*regexp.Regexp
+}
+
+func newKeywordModerator(keywords map[string][]string) (moderator, error) {
+	if len(keywords) == 0 {
+		return nil, fmt.Errorf("keyword moderation needs guardrails.moderation.keywords in the config")
+	}
+	m := keywordModerator{res: map[string]*regexp.Regexp{}}
+	for cat, words := range keywords {
+		quoted := make([]string, len(words))
+		for i, w := range words {
+			quoted[i] = regexp.QuoteMeta(w)
+		}
+		m.res[cat] = regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+		m.categories = append(m.categories, cat)
+	}
+	sort.Strings(m.categories)
+	return m, nil
+}
+
+func (m keywordModerator) moderate(_ context.Context, text string) (ModerationVerdict, error) {
+	var v ModerationVerdict
+	for _, cat := range m.categories {
+		if m.res[cat].MatchString(text) {
+			v.Flagged = true
+			v.Categories = append(v.Categories, cat)
+		}
+	}
+	return v, nil
+}
+
+// openAIModerator uses the OpenAI moderation endpoint with the "openai"
+// adapter's key.
+type openAIModerator struct {
+	model string
+}
+
+type openAIModerationResponse struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+func (m openAIModerator) moderate(ctx context.Context, text string) (ModerationVerdict, error) {
+	key, err := lookupSecret("openai", "OPENAI_API_KEY")
+	if err != nil {
+		return ModerationVerdict{}, err
+	}
+	if key == "" {
+		return ModerationVerdict{}, kindError(ErrAuth, "missing OpenAI API key for moderation. Set OPENAI_API_KEY")
+	}
+	base := builtinAdapters["openai"].BaseURL
+	if a, ok := lookupAdapter("openai"); ok {
+		base = a.BaseURL
+	}
+	model := m.model
+	if model == "" {
+		model = "omni-moderation-latest"
+	}
+
+	body, _ := json.Marshal(map[string]string{"model": model, "input": text})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/moderations", bytes.NewReader(body))
+	if err != nil {
+		return ModerationVerdict{}, fmt.Errorf("building moderation request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ModerationVerdict{}, fmt.Errorf("connecting to moderation API: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return ModerationVerdict{}, fmt.Errorf("moderation API returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var mr openAIModerationResponse
+	if err := json.Unmarshal(data, &mr); err != nil || len(mr.Results) == 0 {
+		return ModerationVerdict{}, fmt.Errorf("parsing moderation response: %v", err)
+	}
+	var v ModerationVerdict
+	for _, r := range mr.Results {
+		v.Flagged = v.Flagged || r.Flagged
+		for cat, hit := range r.Categories {
+			if hit && !slices.Contains(v.Categories, cat) {
+				v.Categories = append(v.Categories, cat)
+			}
+		}
+	}
+	sort.Strings(v.Categories)
+	return v, nil
+}
+
+// execModerator pipes the text to a command, which prints the flagged
+// categories one per line; no output means the text is clean.
+type execModerator struct {
+	cmd string
+}
+
+func (m execModerator) moderate(ctx context.Context, text string) (ModerationVerdict, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", m.cmd)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return ModerationVerdict{}, fmt.Errorf("moderation command: %v", err)
+	}
+	var v ModerationVerdict
+	for _, line := range strings.Split(string(out), "\n") {
+		if cat := strings.TrimSpace(line); cat != "" {
+			v.Flagged = true
+			v.Categories = append(v.Categories, cat)
+		}
+	}
+	return v, nil
+}
+
+// moderateStage checks text ("input" or "output") and applies the action.
+// It returns an error only for blocked or unmoderatable text.
+func (r *runner) moderateStage(ctx context.Context, stage, text string, res *TaskResult) error {
+	v, err := r.moderation.moderate(ctx, text)
+	if err != nil {
+		return err
+	}
+	if !v.Flagged {
+		return nil
+	}
+	if res.Moderation == nil {
+		res.Moderation = &ModerationReport{Provider: r.moderationName, Action: r.moderationAction}
+	}
+	if stage == "input" {
+		res.Moderation.Input = &v
+	} else {
+		res.Moderation.Output = &v
+	}
+
+	msg := fmt.Sprintf("%s flagged by moderation (%s)", stage, strings.Join(v.Categories, ", "))
+	switch r.moderationAction {
+	case ModerationBlock:
+		return kindError(ErrSafety, "%s blocked by moderation (%s)", stage, strings.Join(v.Categories, ", "))
+	case ModerationFlag:
+		res.Warnings = append(res.Warnings, msg)
+	default:
+		fmt.Fprintf(os.Stderr, "[Sub-Agent] Task %s: %s\n", res.ID, msg)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NetworkConfig tunes outbound HTTP. Proxies come from HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY, except for providers listed in Proxies.
+type NetworkConfig struct {
+	// CAFiles are PEM root certificates trusted on top of the system's,
+	// such as an inspecting proxy's CA.
+	CAFiles []string `json:"ca_files,omitempty"`
+	// Proxies maps a provider name to the proxy URL its requests go
+	// through, or to "direct" to bypass any proxy.
+	Proxies map[string]string `json:"proxies,omitempty"`
+	// ClientTLS and Signing map a provider name to the client certificate
+	// (mutual TLS) and the HMAC key its requests are sent with, for
+	// self-hosted gateways that require them.
+	ClientTLS map[string]ClientTLSConfig `json:"client_tls,omitempty"`
+	Signing   map[string]SigningConfig   `json:"signing,omitempty"`
+
+	// Connection pooling. Go keeps only 2 idle connections per host by
+	// default, so concurrent tasks against one Ollama or API keep opening
+	// new ones; these default to values sized for serve and the worker.
+	MaxIdleConns        int    `json:"max_idle_conns,omitempty"`          // default 256
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty"` // default 64
+	MaxConnsPerHost     int    `json:"max_conns_per_host,omitempty"`      // default unlimited
+	IdleConnTimeout     string `json:"idle_conn_timeout,omitempty"`       // default 90s
+	// DisableHTTP2 keeps HTTPS on HTTP/1.1, for proxies that mishandle
+	// HTTP/2. Plain-HTTP endpoints such as Ollama always use HTTP/1.1.
+	DisableHTTP2 bool `json:"disable_http2,omitempty"`
+
+	// UserAgent replaces helix-subagent/<version> as the User-Agent of
+	// every request. Attribution headers go with provider calls only, for
+	// usage dashboards and proxies to tell whose traffic it is: an org or
+	// team header, or OpenRouter's HTTP-Referer and X-Title.
+	UserAgent   string            `json:"user_agent,omitempty"`
+	Attribution map[string]string `json:"attribution,omitempty"`
+}
+
+const (
+	defaultMaxIdleConns        = 256
+	defaultMaxIdleConnsPerHost = 64
+)
+
+// proxyRoute sends one provider's requests through proxy (nil: direct).
+type proxyRoute struct {
+	provider string
+	proxy    *url.URL
+}
+
+// stdTransport is Go's default transport, which configureHTTP starts from.
+var stdTransport = http.DefaultTransport.(*http.Transport)
+
+// configureHTTP installs the transport every outbound request uses:
+// http.DefaultClient and the clients without a Transport fall back to it.
+func configureHTTP(c NetworkConfig) error {
+	t := stdTransport.Clone()
+	t.MaxIdleConns, t.MaxIdleConnsPerHost = defaultMaxIdleConns, defaultMaxIdleConnsPerHost
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = c.MaxConnsPerHost
+	}
+	if c.IdleConnTimeout != "" {
+		d, err := time.ParseDuration(c.IdleConnTimeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("network.idle_conn_timeout: invalid duration %q", c.IdleConnTimeout)
+		}
+		t.IdleConnTimeout = d
+	}
+	if c.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if len(c.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, f := range c.CAFiles {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("reading CA file: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("CA file %s holds no PEM certificate", f)
+			}
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	names := make([]string, 0, len(c.Proxies))
+	for name := range c.Proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var routes []proxyRoute
+	for _, name := range names {
+		if !knownProvider(name) {
+			return fmt.Errorf("network.proxies: unknown provider %q", name)
+		}
+		r := proxyRoute{provider: name}
+		if v := c.Proxies[name]; v != "direct" {
+			u, err := url.Parse(v)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("network.proxies.%s: invalid proxy URL %q", name, v)
+			}
+			switch u.Scheme {
+			case "http", "https", "socks5":
+			default:
+				return fmt.Errorf("network.proxies.%s: proxy scheme must be http, https or socks5", name)
+			}
+			r.proxy = u
+		}
+		routes = append(routes, r)
+	}
+	if len(routes) > 0 {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			host := req.URL.Hostname()
+			for _, r := range routes {
+				if providerOwnsHost(r.provider, host) {
+					return r.proxy, nil
+				}
+			}
+			return http.ProxyFromEnvironment(req)
+		}
+	}
+	t.Proxy = skipProxyForSockets(t.Proxy)
+	t.DialContext = dialUnixAware(t.DialContext)
+	ua := c.UserAgent
+	if ua == "" {
+		ua = "helix-subagent/" + version
+	}
+	var base http.RoundTripper = t
+	pt, err := providerTransports(t, c)
+	if err != nil {
+		return err
+	}
+	if pt != nil {
+		base = pt
+	}
+	http.DefaultTransport = &headerTransport{base: base, userAgent: ua, attribution: c.Attribution}
+	return nil
+}
+
+// headerTransport adds the User-Agent to every request and the
+// attribution headers to those bound for a provider.
+type headerTransport struct {
+	base        http.RoundTripper
+	userAgent   string
+	attribution map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given.
+	req = req.Clone(req.Context())
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if len(t.attribution) > 0 && isProviderHost(req.URL.Hostname()) {
+		for k, v := range t.attribution {
+			if req.Header.Get(k) == "" {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// isProviderHost reports whether host belongs to any provider.
+func isProviderHost(host string) bool {
+	for _, name := range append([]string{"local", "cloud", "azure-openai", "bedrock"}, adapterNames()...) {
+		if providerOwnsHost(name, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func knownProvider(name string) bool {
+	switch name {
+	case "local", "cloud", "azure-openai", "bedrock":
+		return true
+	}
+	_, ok := lookupAdapter(name)
+	return ok
+}
+
+// providerOwnsHost reports whether requests to host belong to a provider,
+// including its sign-in endpoints (Google and Microsoft OAuth).
+func providerOwnsHost(providerName, host string) bool {
+	switch providerName {
+	case "local":
+		return slices.Contains(ollamaHostnames(), host)
+	case "cloud":
+		return host == "generativelanguage.googleapis.com" || host == "oauth2.googleapis.com" ||
+			strings.HasSuffix(host, "aiplatform.googleapis.com")
+	case "azure-openai":
+		return host == hostOf(liveConfig().AzureOpenAI.Endpoint) || host == "login.microsoftonline.com"
+	case "bedrock":
+		return strings.HasSuffix(host, ".amazonaws.com") && (strings.HasPrefix(host, "bedrock") || strings.HasPrefix(host, "sts."))
+	}
+	a, ok := lookupAdapter(providerName)
+	return ok && host == hostOf(a.BaseURL)
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkGenerateOllama runs generations against a fake Ollama in waves
+// of 16 at once, as a batch or a busy server sends them, with Go's default
+// transport, which keeps 2 idle connections per host, and with the one
+// configureHTTP installs. conns/op is how many TCP connections each
+// generation cost.
+func BenchmarkGenerateOllama(b *testing.B) {
+	var conns atomic.Int64
+	const wave = 16
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond) // a very short generation
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"llama3.2","response":"ok","done":true,"total_duration":1000000,"eval_count":1,"eval_duration":500000}`))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	savedConfig, savedTransport := config, http.DefaultTransport
+	defer func() {
+		config, http.DefaultTransport = savedConfig, savedTransport
+		ollamaHostOnce = sync.Once{}
+	}()
+	config.Ollama.Host = srv.URL
+	ollamaHostOnce = sync.Once{}
+
+	for _, bc := range []struct {
+		name  string
+		setup func() error
+	}{
+		{"default", func() error { http.DefaultTransport = stdTransport.Clone(); return nil }},
+		{"pooled", func() error { return configureHTTP(NetworkConfig{}) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			if err := bc.setup(); err != nil {
+				b.Fatal(err)
+			}
+			conns.Store(0)
+			g := genRequest{Provider: "local", Model: "llama3.2", Prompt: "hi"}
+			b.ResetTimer()
+			for n := 0; n < b.N; n += wave {
+				var wg sync.WaitGroup
+				for i := 0; i < min(wave, b.N-n); i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if _, err := callLocalOllama(context.Background(), g); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
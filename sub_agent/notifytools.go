@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SlackToolConfig is a channel slack.post may post to, through one of
+// its incoming webhooks.
+type SlackToolConfig struct {
+	Webhook string `json:"webhook"` // may be a secret reference
+	// Description says what the channel is for, so the model picks the
+	// right one.
+	Description string `json:"description,omitempty"`
+}
+
+// EmailToolConfig configures email.draft and `helix drafts send`. The model
+// only drafts; a person reviews each draft and sends it.
+type EmailToolConfig struct {
+	From     string `json:"from,omitempty"`
+	SMTP     string `json:"smtp,omitempty"` // host:port; 465 is implicit TLS, others use STARTTLS when offered
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"` // may be a secret reference
+	// To lists the recipients drafts may address, as globs such as
+	// "*@example.com"; empty allows any.
+	To []string `json:"to,omitempty"`
+}
+
+// maxMessageBytes bounds a Slack post or email body written by the model.
+const maxMessageBytes = 32 << 10
+
+// outboundRule marks a CommandReview of a message rather than a command.
+const outboundRule = "outbound_message"
+
+// messageTool is implemented by tools that send a message on the user's
+// behalf. Each message is confirmed before it goes, unless --auto-approve
+// is given.
+type messageTool interface {
+	message(input json.RawMessage) (to, text string, err error)
+}
+
+// reviewMessage holds a message of a call of t, if it sends one, for
+// confirmation. Like reviewCommand's, the error says why it wasn't sent.
+func (r *runner) reviewMessage(ctx context.Context, t tool, call ToolCall) error {
+	mt, ok := t.(messageTool)
+	if !ok {
+		return nil
+	}
+	to, text, err := mt.message(call.Input)
+	if err != nil {
+		return err
+	}
+	if r.plan.autoApprove {
+		logf(ctx, "Message check: %s: to %s, auto-approved", call.Tool, to)
+		return nil
+	}
+	review := CommandReview{Tool: call.Tool, Command: text, Rules: []string{outboundRule}, Reasons: []string{"posts to " + to}}
+	logf(ctx, "Message check: %s: to %s, confirmation required", call.Tool, to)
+	ask, _ := ctx.Value(confirmerKey{}).(commandConfirmer)
+	if ask == nil {
+		return fmt.Errorf("not sent: posting to %s needs a person to confirm it, which nobody can here", to)
+	}
+	ok, err = ask(ctx, review)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("not sent: posting to %s needs confirmation: %v", to, err)
+	}
+	if !ok {
+		logf(ctx, "Message check: %s: declined", call.Tool)
+		return fmt.Errorf("not sent: the user declined the message; revise it or answer without posting")
+	}
+	logf(ctx, "Message check: %s: confirmed", call.Tool)
+	return nil
+}
+
+// slackTools builds slack.post over the configured channels.
+func slackTools(string) ([]tool, error) {
+	channels := config.Tools.Slack
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("no channels configured (tools.slack)")
+	}
+	t := &slackTool{webhooks: map[string]string{}, client: &http.Client{Timeout: 30 * time.Second}}
+	for name, c := range channels {
+		if c.Webhook == "" {
+			return nil, fmt.Errorf("tools.slack.%s: no webhook", name)
+		}
+		t.channels = append(t.channels, name)
+	}
+	sort.Strings(t.channels)
+	return []tool{t}, nil
+}
+
+type slackTool struct {
+	channels []string
+	webhooks map[string]string // resolved on first use
+	client   *http.Client
+}
+
+func (t *slackTool) spec() toolSpec {
+	var list []string
+	for _, name := range t.channels {
+		if d := config.Tools.Slack[name].Description; d != "" {
+			name += " (" + d + ")"
+		}
+		list = append(list, name)
+	}
+	enum, _ := json.Marshal(t.channels)
+	return toolSpec{
+		Name:        "slack.post",
+		Description: "Post a message to a Slack channel. Each post is shown to the user to confirm before it is sent. Channels: " + strings.Join(list, ", ") + ".",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+  "channel": {"type": "string", "enum": ` + string(enum) + `},
+  "text": {"type": "string", "description": "The message, in Slack mrkdwn"}
+}, "required": ["text"]}`),
+	}
+}
+
+type slackInput struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+}
+
+func (t *slackTool) input(input json.RawMessage) (slackInput, error) {
+	var in slackInput
+	if err := json.Unmarshal(input, &in); err != nil {
+		return in, fmt.Errorf("invalid input: %v", err)
+	}
+	if in.Channel == "" && len(t.channels) == 1 {
+		in.Channel = t.channels[0]
+	}
+	if _, ok := config.Tools.Slack[in.Channel]; !ok {
+		return in, fmt.Errorf("unknown channel %q: use one of %s", in.Channel, strings.Join(t.channels, ", "))
+	}
+	if strings.TrimSpace(in.Text) == "" {
+		return in, fmt.Errorf("empty message")
+	}
+	if len(in.Text) > maxMessageBytes {
+		return in, fmt.Errorf("message of %d bytes is over the limit of %d", len(in.Text), maxMessageBytes)
+	}
+	return in, nil
+}
+
+func (t *slackTool) message(input json.RawMessage) (string, string, error) {
+	in, err := t.input(input)
+	return "Slack channel " + in.Channel, in.Text, err
+}
+
+func (t *slackTool) describe(input json.RawMessage) string {
+	var in slackInput
+	json.Unmarshal(input, &in)
+	return "Posting to Slack channel " + in.Channel
+}
+
+func (t *slackTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	in, err := t.input(input)
+	if err != nil {
+		return "", err
+	}
+	hook, ok := t.webhooks[in.Channel]
+	if !ok {
+		if hook, err = resolveSecretValue(config.Tools.Slack[in.Channel].Webhook); err != nil {
+			return "", fmt.Errorf("tools.slack.%s.webhook: %v", in.Channel, err)
+		}
+		t.webhooks[in.Channel] = hook
+	}
+	body, _ := json.Marshal(map[string]string{"text": in.Text})
+	req, err := http.NewRequestWithContext(ctx, "POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("tools.slack.%s.webhook: %v", in.Channel, redactErr(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("posting to %s: %v", in.Channel, redactErr(err))
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("posting to %s: %s: %s", in.Channel, resp.Status, strings.TrimSpace(string(reply)))
+	}
+	return "Posted to " + in.Channel + ".", nil
+}
+
+// EmailDraft is an email written by the model, waiting in the drafts
+// directory for a person to send or discard it.
+type EmailDraft struct {
+	ID      string     `json:"id"`
+	Created time.Time  `json:"created"`
+	To      []string   `json:"to"`
+	Cc      []string   `json:"cc,omitempty"`
+	Subject string     `json:"subject"`
+	Body    string     `json:"body"`
+	Sent    *time.Time `json:"sent,omitempty"`
+}
+
+func draftsDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", fmt.Errorf("locating drafts directory: %v", err)
+	}
+	return filepath.Join(dir, "drafts"), nil
+}
+
+func saveDraft(d *EmailDraft) error {
+	dir, err := draftsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("creating drafts directory: %v", err)
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, d.ID+".json"), data)
+}
+
+func loadDraft(id string) (*EmailDraft, error) {
+	dir, err := draftsDir()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, kindError(ErrConfig, "invalid draft ID %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, kindError(ErrConfig, "no draft %s (see helix drafts list)", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d EmailDraft
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("draft %s: %v", id, err)
+	}
+	return &d, nil
+}
+
+// listDrafts returns the drafts, oldest first.
+func listDrafts() ([]*EmailDraft, error) {
+	dir, err := draftsDir()
+	if err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var drafts []*EmailDraft
+	for _, name := range names {
+		d, err := loadDraft(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i].Created.Before(drafts[j].Created) })
+	return drafts, nil
+}
+
+// checkRecipients parses addrs and checks them against tools.email.to.
+func checkRecipients(addrs []string) ([]string, error) {
+	var out []string
+	for _, a := range addrs {
+		m, err := mail.ParseAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", a, err)
+		}
+		if allowed := config.Tools.Email.To; len(allowed) > 0 {
+			ok := false
+			for _, pat := range allowed {
+				if match, _ := path.Match(strings.ToLower(pat), strings.ToLower(m.Address)); match {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("%s is not an allowed recipient; allowed: %s", m.Address, strings.Join(allowed, ", "))
+			}
+		}
+		out = append(out, m.String())
+	}
+	return out, nil
+}
+
+// newEmailTool builds email.draft.
+func newEmailTool(string) (tool, error) {
+	for _, pat := range config.Tools.Email.To {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("tools.email.to: bad pattern %q", pat)
+		}
+	}
+	return emailTool{}, nil
+}
+
+type emailTool struct{}
+
+// readOnly: a draft only goes to helix's own drafts directory.
+func (emailTool) readOnly() bool { return true }
+
+func (emailTool) spec() toolSpec {
+	desc := "Draft an email for the user to review. It is not sent: the user sends it, or discards it, with helix drafts."
+	if to := config.Tools.Email.To; len(to) > 0 {
+		desc += " Recipients must match " + strings.Join(to, ", ") + "."
+	}
+	return toolSpec{
+		Name:        "email.draft",
+		Description: desc,
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+  "to": {"type": "array", "items": {"type": "string"}, "description": "Recipient addresses"},
+  "cc": {"type": "array", "items": {"type": "string"}},
+  "subject": {"type": "string"},
+  "body": {"type": "string", "description": "Plain text"}
+}, "required": ["to", "subject", "body"]}`),
+	}
+}
+
+func (emailTool) describe(input json.RawMessage) string {
+	var in struct {
+		Subject string `json:"subject"`
+	}
+	json.Unmarshal(input, &in)
+	return "Drafting email " + truncateRunes(fmt.Sprintf("%q", in.Subject), 60)
+}
+
+func (emailTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	var in struct {
+		To      []string `json:"to"`
+		Cc      []string `json:"cc"`
+		Subject string   `json:"subject"`
+		Body    string   `json:"body"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %v", err)
+	}
+	if len(in.To) == 0 {
+		return "", fmt.Errorf("no recipients")
+	}
+	if strings.TrimSpace(in.Subject) == "" || strings.ContainsAny(in.Subject, "\r\n") {
+		return "", fmt.Errorf("subject must be one non-empty line")
+	}
+	if len(in.Body) > maxMessageBytes {
+		return "", fmt.Errorf("body of %d bytes is over the limit of %d", len(in.Body), maxMessageBytes)
+	}
+	d := &EmailDraft{ID: newID()[:12], Created: time.Now().UTC(), Subject: in.Subject, Body: in.Body}
+	var err error
+	if d.To, err = checkRecipients(in.To); err != nil {
+		return "", err
+	}
+	if d.Cc, err = checkRecipients(in.Cc); err != nil {
+		return "", err
+	}
+	if err := saveDraft(d); err != nil {
+		return "", err
+	}
+	logf(ctx, "Email draft %s saved for review", d.ID)
+	return fmt.Sprintf("Saved draft %s to %s. It has not been sent: tell the user it is waiting for them (helix drafts show %s).", d.ID, strings.Join(d.To, ", "), d.ID), nil
+}
+
+// buildEmail renders d as an RFC 5322 message from from.
+func buildEmail(d *EmailDraft, from string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(d.To, ", "))
+	if len(d.Cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s\r\n", strings.Join(d.Cc, ", "))
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", d.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	host := "helix.local"
+	if m, err := mail.ParseAddress(from); err == nil {
+		if _, h, ok := strings.Cut(m.Address, "@"); ok {
+			host = h
+		}
+	}
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", d.ID, host)
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(d.Body, "\r\n", "\n"), "\n", "\r\n")))
+	w.Close()
+	return b.Bytes()
+}
+
+// sendEmail delivers d over tools.email.smtp.
+func sendEmail(d *EmailDraft) error {
+	c := config.Tools.Email
+	if c.SMTP == "" || c.From == "" {
+		return kindError(ErrConfig, "sending needs tools.email.smtp and tools.email.from")
+	}
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return kindError(ErrConfig, "tools.email.from: %v", err)
+	}
+	host, port, err := net.SplitHostPort(c.SMTP)
+	if err != nil {
+		return kindError(ErrConfig, "tools.email.smtp: %v", err)
+	}
+	// Recipients are checked again, in case tools.email.to changed.
+	to, err := checkRecipients(d.To)
+	if err != nil {
+		return configError(err)
+	}
+	cc, err := checkRecipients(d.Cc)
+	if err != nil {
+		return configError(err)
+	}
+	var auth smtp.Auth
+	if c.Username != "" {
+		password, err := resolveSecretValue(c.Password)
+		if err != nil {
+			return kindError(ErrConfig, "tools.email.password: %v", err)
+		}
+		auth = smtp.PlainAuth("", c.Username, password, host)
+	}
+	var rcpt []string
+	for _, a := range append(to, cc...) {
+		m, _ := mail.ParseAddress(a)
+		rcpt = append(rcpt, m.Address)
+	}
+	msg := buildEmail(d, from.String())
+	if port == "465" {
+		err = sendImplicitTLS(c.SMTP, host, auth, from.Address, rcpt, msg)
+	} else {
+		err = smtp.SendMail(c.SMTP, auth, from.Address, rcpt, msg)
+	}
+	if err != nil {
+		return fmt.Errorf("sending draft %s through %s: %v", d.ID, c.SMTP, err)
+	}
+	return nil
+}
+
+// sendImplicitTLS is smtp.SendMail for servers that speak TLS from the
+// start, as on port 465.
+func sendImplicitTLS(addr, host string, auth smtp.Auth, from string, rcpt []string, msg []byte) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, a := range rcpt {
+		if err := client.Rcpt(a); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func printDraft(d *EmailDraft) {
+	fmt.Printf("Draft:   %s (%s)\n", d.ID, d.Created.Local().Format("2006-01-02 15:04"))
+	if d.Sent != nil {
+		fmt.Printf("Sent:    %s\n", d.Sent.Local().Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("To:      %s\n", strings.Join(d.To, ", "))
+	if len(d.Cc) > 0 {
+		fmt.Printf("Cc:      %s\n", strings.Join(d.Cc, ", "))
+	}
+	fmt.Printf("Subject: %s\n\n%s\n", d.Subject, strings.TrimRight(d.Body, "\n"))
+}
+
+// draftsListCommand implements `drafts list`.
+func draftsListCommand(fs *flag.FlagSet) func(args []string) {
+	fs.BoolVar(&jsonOut, "json", false, "Print the drafts as JSON")
+	all := fs.Bool("all", false, "Include drafts already sent")
+	return func(args []string) {
+		drafts, err := listDrafts()
+		if err != nil {
+			fatal(err)
+		}
+		if !*all {
+			kept := drafts[:0]
+			for _, d := range drafts {
+				if d.Sent == nil {
+					kept = append(kept, d)
+				}
+			}
+			drafts = kept
+		}
+		if jsonOut {
+			printJSON(drafts)
+			return
+		}
+		if len(drafts) == 0 {
+			fmt.Println("No drafts.")
+			return
+		}
+		for _, d := range drafts {
+			state := "draft"
+			if d.Sent != nil {
+				state = "sent"
+			}
+			fmt.Printf("%s  %s  %-5s  %s  %s\n", d.ID, d.Created.Local().Format("2006-01-02"), state, truncateRunes(strings.Join(d.To, ", "), 40), d.Subject)
+		}
+	}
+}
+
+// draftsShowCommand implements `drafts show <id>`.
+func draftsShowCommand(fs *flag.FlagSet) func(args []string) {
+	return func(args []string) {
+		if len(args) != 1 {
+			fatal(kindError(ErrConfig, "usage: helix drafts show <id>"))
+		}
+		d, err := loadDraft(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		printDraft(d)
+	}
+}
+
+// draftsSendCommand implements `drafts send <id>`.
+func draftsSendCommand(fs *flag.FlagSet) func(args []string) {
+	yes := fs.Bool("yes", false, "Send without showing the draft and asking")
+	return func(args []string) {
+		if len(args) != 1 {
+			fatal(kindError(ErrConfig, "usage: helix drafts send <id>"))
+		}
+		d, err := loadDraft(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		if d.Sent != nil {
+			fatal(kindError(ErrConfig, "draft %s was already sent on %s", d.ID, d.Sent.Local().Format("2006-01-02 15:04")))
+		}
+		if !*yes {
+			printDraft(d)
+			fmt.Println()
+			ok, err := confirm("Send it?", "--yes")
+			if err != nil {
+				fatal(configError(err))
+			}
+			if !ok {
+				statusf("[Sub-Agent] Not sent.\n")
+				return
+			}
+		}
+		if err := sendEmail(d); err != nil {
+			fatal(redactErr(err))
+		}
+		now := time.Now().UTC()
+		d.Sent = &now
+		if err := saveDraft(d); err != nil {
+			statusf("[Sub-Agent] Warning: draft %s was sent but not marked as sent: %v\n", d.ID, err)
+		}
+		fmt.Printf("Sent draft %s to %s\n", d.ID, strings.Join(append(d.To, d.Cc...), ", "))
+	}
+}
+
+// draftsDiscardCommand implements `drafts discard <id>...`.
+func draftsDiscardCommand(fs *flag.FlagSet) func(args []string) {
+	return func(args []string) {
+		if len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix drafts discard <id>..."))
+		}
+		dir, err := draftsDir()
+		if err != nil {
+			fatal(err)
+		}
+		for _, id := range args {
+			if _, err := loadDraft(id); err != nil {
+				fatal(err)
+			}
+			if err := os.Remove(filepath.Join(dir, id+".json")); err != nil {
+				fatal(err)
+			}
+		}
+		fmt.Printf("Discarded %d draft(s)\n", len(args))
+	}
+}
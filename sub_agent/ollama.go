@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+)
+
+// OllamaConfig says where Ollama is and how to reach one behind a reverse
+// proxy that wants credentials. Headers are sent with every request. APIKeyEnv names a
+// bearer token, or BasicAuthUser and BasicAuthPasswordEnv a basic-auth
+// login; either secret is looked up like a provider key under the name
+// "ollama" (see lookupSecret and 'helix auth login --provider local').
+type OllamaConfig struct {
+	Headers              map[string]string `json:"headers,omitempty"`
+	APIKeyEnv            string            `json:"api_key_env,omitempty"`
+	BasicAuthUser        string            `json:"basic_auth_user,omitempty"`
+	BasicAuthPasswordEnv string            `json:"basic_auth_password_env,omitempty"`
+
+	// Host is Ollama's address, such as http://gpu-box:11434; OLLAMA_HOST
+	// sets it too. Unset, the Probe addresses are tried in order (see
+	// ollamaCandidates for the default list).
+	Host  string   `json:"host,omitempty"`
+	Probe []string `json:"probe,omitempty"`
+
+	// Hosts pools several Ollama servers into the local provider, taking
+	// precedence over Host for generation. Balance is least_loaded (the
+	// default) or round_robin; hosts are health-checked every
+	// HealthInterval (default 10s).
+	Hosts          []string `json:"hosts,omitempty"`
+	Balance        string   `json:"balance,omitempty"`
+	HealthInterval string   `json:"health_interval,omitempty"`
+
+	// AutoSelect, when no model is given, picks the first of these models
+	// that fits the memory free on a host (see autoSelectModel), so list
+	// them largest first. VRAMGB is the GPU memory of the hosts when it
+	// can't be detected, as for a remote host.
+	AutoSelect []string `json:"auto_select,omitempty"`
+	VRAMGB     float64  `json:"vram_gb,omitempty"`
+}
+
+// ollamaHeaders are the headers every Ollama request carries.
+func ollamaHeaders() (map[string]string, error) {
+	c := config.Ollama
+	headers := map[string]string{}
+	for k, v := range c.Headers {
+		headers[k] = v
+	}
+	switch {
+	case c.APIKeyEnv != "":
+		key, err := lookupSecret("ollama", c.APIKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing API key for Ollama. Set %s or run `helix auth login --provider local`", c.APIKeyEnv)
+		}
+		headers["Authorization"] = "Bearer " + key
+	case c.BasicAuthUser != "":
+		password, err := lookupSecret("ollama", c.BasicAuthPasswordEnv)
+		if err != nil {
+			return nil, err
+		}
+		if password == "" {
+			return nil, kindError(ErrAuth, "missing password for Ollama user %s. Set basic_auth_password_env or run `helix auth login --provider local`", c.BasicAuthUser)
+		}
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.BasicAuthUser+":"+password))
+	}
+	return headers, nil
+}
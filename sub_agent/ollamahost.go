@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ollamaProbeTimeout bounds each address tried while detecting Ollama.
+const ollamaProbeTimeout = 400 * time.Millisecond
+
+// inContainer reports whether helix runs in a Docker, Podman or Kubernetes
+// container, where Ollama is usually on the host or a sibling service.
+func inContainer() bool {
+	for _, f := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// ollamaCandidates are the addresses tried in order when none is set:
+// ollama.probe from the config, or else the usual places for the
+// environment. Natively (Linux, macOS, Windows) Ollama is on loopback;
+// 127.0.0.1 rather than localhost, which may resolve to ::1 where Ollama
+// doesn't listen. In a container it is a docker-compose service named
+// ollama, the Docker host, or the default bridge's gateway on Linux.
+func ollamaCandidates() []string {
+	list := config.Ollama.Probe
+	if len(list) == 0 {
+		if inContainer() {
+			list = []string{"ollama", "host.docker.internal", "172.17.0.1", "127.0.0.1"}
+		} else {
+			list = []string{"127.0.0.1", "host.docker.internal"}
+		}
+	}
+	out := make([]string, len(list))
+	for i, h := range list {
+		out[i] = normalizeOllamaHost(h)
+	}
+	return out
+}
+
+// normalizeOllamaHost turns an address as OLLAMA_HOST takes it (a host,
+// host:port or URL) into a base URL. 0.0.0.0 is where a server listens, not
+// an address to call, so it becomes loopback. A unix: socket address
+// becomes its placeholder URL.
+func normalizeOllamaHost(h string) string {
+	h = strings.TrimRight(strings.TrimSpace(h), "/")
+	if isUnixURL(h) {
+		return socketURL(h)
+	}
+	if !strings.Contains(h, "://") {
+		h = "http://" + h
+	}
+	u, err := url.Parse(h)
+	if err != nil || u.Host == "" {
+		return h
+	}
+	host, port := u.Hostname(), u.Port()
+	if host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	if port == "" {
+		port = "11434"
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u.Host = host + ":" + port
+	return u.String()
+}
+
+var (
+	ollamaHostOnce   sync.Once
+	ollamaHostURL    string
+	ollamaHostSource string // how ollamaHostURL was chosen, for helix doctor
+)
+
+// ollamaHost is the Ollama base URL: the first of ollama.hosts, which
+// generation balances over, else ollama.host in the config, else
+// OLLAMA_HOST, else the first of ollamaCandidates that answers. It is
+// worked out once per process; when nothing answers it is the first
+// candidate, so that errors name the likeliest address.
+func ollamaHost() string {
+	ollamaHostOnce.Do(func() {
+		switch {
+		case len(config.Ollama.Hosts) > 0:
+			ollamaHostURL, ollamaHostSource = normalizeOllamaHost(config.Ollama.Hosts[0]), "the first of ollama.hosts"
+		case config.Ollama.Host != "":
+			ollamaHostURL, ollamaHostSource = normalizeOllamaHost(config.Ollama.Host), "ollama.host in the config"
+		case os.Getenv("OLLAMA_HOST") != "":
+			ollamaHostURL, ollamaHostSource = normalizeOllamaHost(os.Getenv("OLLAMA_HOST")), "OLLAMA_HOST"
+		default:
+			candidates := ollamaCandidates()
+			if found := probeOllama(candidates); found != "" {
+				ollamaHostURL, ollamaHostSource = found, "detected"
+			} else {
+				ollamaHostURL, ollamaHostSource = candidates[0], "nothing answered at "+strings.Join(candidates, ", ")
+			}
+		}
+	})
+	return ollamaHostURL
+}
+
+// probeOllama asks every candidate at once and returns the first in
+// order that answers, without waiting on the ones after it.
+func probeOllama(candidates []string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), ollamaProbeTimeout)
+	defer cancel()
+	answered := make([]chan bool, len(candidates))
+	for i, c := range candidates {
+		answered[i] = make(chan bool, 1)
+		go func(i int, base string) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/version", nil)
+			if err != nil {
+				answered[i] <- false
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				answered[i] <- false
+				return
+			}
+			resp.Body.Close()
+			// Any answer will do: a proxy asking for credentials, say, is
+			// still the right place.
+			answered[i] <- true
+		}(i, c)
+	}
+	for i, ch := range answered {
+		if <-ch {
+			return candidates[i]
+		}
+	}
+	return ""
+}
+
+// ollamaHostnames are the hostnames Ollama may be reached at, which
+// providerOwnsHost matches without probing.
+func ollamaHostnames() []string {
+	var names []string
+	for _, h := range append(append([]string{config.Ollama.Host, os.Getenv("OLLAMA_HOST")}, config.Ollama.Hosts...), ollamaCandidates()...) {
+		if h != "" {
+			names = append(names, hostOf(normalizeOllamaHost(h)))
+		}
+	}
+	return names
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancing policies for ollama.hosts.
+const (
+	BalanceLeastLoaded = "least_loaded" // fewest calls in flight
+	BalanceRoundRobin  = "round_robin"
+)
+
+// defaultOllamaHealthInterval is how often pooled hosts are checked.
+const defaultOllamaHealthInterval = 10 * time.Second
+
+// ollamaSpill is how many more calls in flight a host that has the model
+// in place may have than the least busy one before calls go elsewhere
+// (and load it there too).
+const ollamaSpill = 2
+
+// ollamaPool spreads local calls over the servers in ollama.hosts, so a few
+// GPU boxes look like one provider. Each call goes to a healthy host that
+// has the model, preferring hosts that already have it loaded, then the
+// host the model last ran on, so models stay put instead of being loaded
+// everywhere.
+type ollamaPool struct {
+	policy   string
+	interval time.Duration
+	hosts    []*ollamaBackend
+
+	checkOnce sync.Once
+	mu        sync.Mutex
+	next      int
+	placed    map[string]*ollamaBackend // model -> host it last ran on
+}
+
+// ollamaBackend is one pooled host, with what the last health check found.
+type ollamaBackend struct {
+	url string
+
+	inFlight int
+	healthy  bool
+	err      string
+	models   map[string]bool // installed
+	loaded   map[string]bool // in memory
+}
+
+var (
+	ollamaPoolOnce sync.Once
+	ollamaPoolInst *ollamaPool
+)
+
+// localPool returns the pool of ollama.hosts, or nil when there is one
+// Ollama.
+func localPool() *ollamaPool {
+	ollamaPoolOnce.Do(func() {
+		c := config.Ollama
+		if len(c.Hosts) == 0 {
+			return
+		}
+		p := &ollamaPool{policy: c.Balance, interval: defaultOllamaHealthInterval, placed: map[string]*ollamaBackend{}}
+		if p.policy == "" {
+			p.policy = BalanceLeastLoaded
+		}
+		if d, err := time.ParseDuration(c.HealthInterval); err == nil && d > 0 {
+			p.interval = d
+		}
+		for _, h := range c.Hosts {
+			// Unchecked hosts count as healthy until the first check says
+			// otherwise.
+			p.hosts = append(p.hosts, &ollamaBackend{url: normalizeOllamaHost(h), healthy: true})
+		}
+		ollamaPoolInst = p
+	})
+	return ollamaPoolInst
+}
+
+// validateOllamaConfig rejects an ollama section the pool can't use.
+func validateOllamaConfig(c OllamaConfig) error {
+	switch c.Balance {
+	case "", BalanceLeastLoaded, BalanceRoundRobin:
+	default:
+		return fmt.Errorf("ollama.balance: invalid policy %q: expected %s or %s", c.Balance, BalanceLeastLoaded, BalanceRoundRobin)
+	}
+	if c.HealthInterval != "" {
+		if d, err := time.ParseDuration(c.HealthInterval); err != nil || d <= 0 {
+			return fmt.Errorf("ollama.health_interval: invalid duration %q", c.HealthInterval)
+		}
+	}
+	return nil
+}
+
+// acquire picks the host for a call of model and counts the call against
+// it; release must be called with the call's error when it is done.
+func (p *ollamaPool) acquire(model string) (host string, release func(err error)) {
+	p.checkOnce.Do(func() {
+		p.check()
+		go func() {
+			for range time.Tick(p.interval) {
+				p.check()
+			}
+		}()
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.pick(model)
+	b.inFlight++
+	p.placed[model] = b
+	return b.url, func(err error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		b.inFlight--
+		if err != nil && errorKind(err) == ErrUnreachable {
+			// Out of rotation until a health check finds it again.
+			b.healthy, b.err = false, redactErr(err).Error()
+		}
+	}
+}
+
+// pick chooses among the healthy hosts with model, narrowed to those with
+// it loaded, or else to where it last ran, unless they are ollamaSpill
+// calls busier than the rest. With no healthy host the call goes to the
+// first, which fails with the reason.
+func (p *ollamaPool) pick(model string) *ollamaBackend {
+	var healthy, installed, loaded []*ollamaBackend
+	for _, b := range p.hosts {
+		if !b.healthy {
+			continue
+		}
+		healthy = append(healthy, b)
+		// A host not checked yet may have any model.
+		if b.models == nil || hasModel(b.models, model) {
+			installed = append(installed, b)
+		}
+		if hasModel(b.loaded, model) {
+			loaded = append(loaded, b)
+		}
+	}
+	if len(installed) == 0 {
+		if len(healthy) > 0 {
+			return p.balance(healthy)
+		}
+		return p.hosts[0]
+	}
+	least := leastInFlight(installed)
+	if len(loaded) > 0 {
+		if b := p.balance(loaded); b.inFlight-least < ollamaSpill {
+			return b
+		}
+	}
+	if b := p.placed[model]; b != nil && b.healthy && b.models != nil && hasModel(b.models, model) && b.inFlight-least < ollamaSpill {
+		return b
+	}
+	return p.balance(installed)
+}
+
+func leastInFlight(hosts []*ollamaBackend) int {
+	n := hosts[0].inFlight
+	for _, b := range hosts[1:] {
+		n = min(n, b.inFlight)
+	}
+	return n
+}
+
+func (p *ollamaPool) balance(hosts []*ollamaBackend) *ollamaBackend {
+	if p.policy == BalanceRoundRobin {
+		p.next++
+		return hosts[p.next%len(hosts)]
+	}
+	best := hosts[0]
+	for _, b := range hosts[1:] {
+		if b.inFlight < best.inFlight {
+			best = b
+		}
+	}
+	return best
+}
+
+// hasModel matches names the way Ollama does, an untagged name meaning
+// :latest.
+func hasModel(models map[string]bool, name string) bool {
+	return models[name] || (!strings.Contains(name, ":") && models[name+":latest"])
+}
+
+// check asks every host for its installed and loaded models.
+func (p *ollamaPool) check() {
+	var wg sync.WaitGroup
+	for _, b := range p.hosts {
+		wg.Add(1)
+		go func(b *ollamaBackend) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+			defer cancel()
+			models, err := ollamaModels(ctx, b.url)
+			var loaded []string
+			if err == nil {
+				loaded, err = ollamaLoaded(ctx, b.url)
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if err != nil {
+				b.healthy, b.err = false, redactErr(err).Error()
+				return
+			}
+			b.healthy, b.err = true, ""
+			b.models, b.loaded = map[string]bool{}, map[string]bool{}
+			for _, m := range models {
+				b.models[m] = true
+			}
+			for _, m := range loaded {
+				b.loaded[m] = true
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// ollamaLoaded lists the models a host has in memory (/api/ps).
+func ollamaLoaded(ctx context.Context, host string) ([]string, error) {
+	var ps struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if err := getJSON(ctx, "Ollama", host+"/api/ps", headers, &ps); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ps.Models))
+	for i, m := range ps.Models {
+		names[i] = m.Name
+	}
+	return names, nil
+}
+
+// ollamaPoolStatus is a pooled host as helix doctor reports it.
+type ollamaPoolStatus struct {
+	URL      string
+	Healthy  bool
+	Err      string
+	InFlight int
+	Models   int
+	Loaded   []string
+}
+
+// status checks every host now and reports them.
+func (p *ollamaPool) status() []ollamaPoolStatus {
+	p.check()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []ollamaPoolStatus
+	for _, b := range p.hosts {
+		s := ollamaPoolStatus{URL: b.url, Healthy: b.healthy, Err: b.err, InFlight: b.inFlight, Models: len(b.models)}
+		for m := range b.loaded {
+			s.Loaded = append(s.Loaded, m)
+		}
+		sort.Strings(s.Loaded)
+		out = append(out, s)
+	}
+	return out
+}
+
+// ollamaBase is where a call of model goes: a host of the pool, or the one
+// Ollama. release is to be called with the call's error.
+func ollamaBase(model string) (string, func(error)) {
+	if p := localPool(); p != nil {
+		return p.acquire(model)
+	}
+	return ollamaHost(), func(error) {}
+}
+
+// isBusyStatus reports whether an Ollama status means it turned the call
+// away for load.
+func isBusyStatus(code int) bool {
+	return code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests
+}
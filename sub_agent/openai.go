@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Data structs for OpenAI-compatible chat completion APIs
+type OpenAIChatRequest struct {
+	Model    string          `json:"model,omitempty"`
+	Messages []OpenAIMessage `json:"messages"`
+	Stop     []string        `json:"stop,omitempty"`
+	N        int             `json:"n,omitempty"`
+	Seed     int64           `json:"seed,omitempty"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	ResponseFormat *OpenAIResponseFormat `json:"response_format,omitempty"`
+	// Grammar is a GBNF grammar, an extension of llama.cpp's server.
+	Grammar string `json:"grammar,omitempty"`
+
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"` // json_object or json_schema
+	JSONSchema *OpenAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type OpenAIJSONSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+type OpenAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string for text-only messages, or []OpenAIContentPart
+	// when images are attached.
+	Content interface{} `json:"content"`
+}
+
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+}
+
+type OpenAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type OpenAIChatResponse struct {
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   struct {
+		PromptTokens            int `json:"prompt_tokens"`
+		CompletionTokens        int `json:"completion_tokens"`
+		CompletionTokensDetails struct {
+			ReasoningTokens int `json:"reasoning_tokens"`
+		} `json:"completion_tokens_details"`
+	} `json:"usage"`
+}
+
+type OpenAIChoice struct {
+	Message      OpenAIResponseMessage `json:"message"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+type OpenAIResponseMessage struct {
+	Content string `json:"content"`
+	// Reasoning models on some hosts return their thinking apart:
+	// reasoning_content on DeepSeek and vLLM, reasoning on OpenRouter.
+	ReasoningContent string           `json:"reasoning_content,omitempty"`
+	Reasoning        string           `json:"reasoning,omitempty"`
+	ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	Index    int    `json:"index"` // which call a streamed delta continues
+	ID       string `json:"id,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"` // JSON, as a string
+	} `json:"function"`
+}
+
+// text is the message's content with any separate reasoning in front.
+func (m OpenAIResponseMessage) text() string {
+	thinking := m.ReasoningContent
+	if thinking == "" {
+		thinking = m.Reasoning
+	}
+	return withThinking(thinking, m.Content)
+}
+
+// openAIMessages builds the single user message for g, inlining images as
+// data URIs.
+func openAIMessages(g genRequest) []OpenAIMessage {
+	if len(g.Images) == 0 {
+		return []OpenAIMessage{{Role: "user", Content: g.Prompt}}
+	}
+	parts := []OpenAIContentPart{{Type: "text", Text: g.Prompt}}
+	for _, img := range g.Images {
+		uri := fmt.Sprintf("data:%s;base64,%s", img.MIMEType, base64.StdEncoding.EncodeToString(img.Data))
+		parts = append(parts, OpenAIContentPart{Type: "image_url", ImageURL: &OpenAIImageURL{URL: uri}})
+	}
+	return []OpenAIMessage{{Role: "user", Content: parts}}
+}
+
+// openAIRequest builds the chat completion request for g.
+func openAIRequest(g genRequest) OpenAIChatRequest {
+	req := OpenAIChatRequest{Model: g.Model, Messages: openAIMessages(g), Stop: g.Stop, ResponseFormat: openAIResponseFormat(g.Format), Grammar: g.Grammar, ReasoningEffort: g.Reasoning.effort, Seed: g.Seed, Temperature: g.Temperature}
+	if g.Candidates > 1 {
+		req.N = g.Candidates
+	}
+	if g.OnText != nil {
+		req.Stream, req.StreamOptions = true, &OpenAIStreamOptions{IncludeUsage: true}
+	}
+	return req
+}
+
+// callOpenAICompatible posts a chat completion and returns every choice.
+// name labels the backend in error messages; headers carry its auth. A
+// streamed payload hands the text so far to onText.
+func callOpenAICompatible(ctx context.Context, name, url string, headers map[string]string, payload OpenAIChatRequest, onText func(string)) ([]Response, error) {
+	jsonData, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("building %s request: %v", name, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if err := cancelledCall(ctx, name); err != nil {
+			return nil, err
+		}
+		return nil, kindError(ErrUnreachable, "connecting to %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, providerError(name, resp, body)
+	}
+
+	var oResp OpenAIChatResponse
+	var body []byte
+	if payload.Stream {
+		if oResp, err = readOpenAIStream(name, resp.Body, onText); err != nil {
+			return nil, err
+		}
+	} else {
+		body, _ = io.ReadAll(resp.Body)
+		if err := json.Unmarshal(body, &oResp); err != nil {
+			return nil, fmt.Errorf("parsing %s response: %v", name, err)
+		}
+	}
+	// Reasoning tokens are part of completion_tokens; models that think
+	// inline (deepseek-r1 on most hosts) don't report them, so estimate.
+	ou := oResp.Usage
+	u := Usage{PromptTokens: ou.PromptTokens, OutputTokens: ou.CompletionTokens, ThinkingTokens: ou.CompletionTokensDetails.ReasoningTokens}
+	if u.ThinkingTokens == 0 && len(oResp.Choices) > 0 {
+		if t, _ := splitThinking(oResp.Choices[0].Message.text()); t != "" {
+			u.ThinkingTokens = estimateTokens(t)
+		}
+	}
+	u.ThinkingTokens = min(u.ThinkingTokens, u.OutputTokens)
+	u.OutputTokens -= u.ThinkingTokens
+	recordUsage(ctx, u)
+	raw := rawJSON(body, oResp)
+	var outs []Response
+	for _, c := range oResp.Choices {
+		if c.Message.Content == "" && len(c.Message.ToolCalls) == 0 {
+			continue
+		}
+		r := Response{Text: c.Message.text(), FinishReason: openAIFinish(c.FinishReason), Usage: u, Raw: raw}
+		for _, tc := range c.Message.ToolCalls {
+			args := json.RawMessage(tc.Function.Arguments)
+			if !json.Valid(args) {
+				args, _ = json.Marshal(tc.Function.Arguments)
+			}
+			r.ToolCalls = append(r.ToolCalls, ProviderToolCall{ID: tc.ID, Name: tc.Function.Name, Arguments: args})
+		}
+		outs = append(outs, r)
+	}
+	if len(outs) > 0 {
+		return outs, nil
+	}
+	if len(oResp.Choices) > 0 && oResp.Choices[0].FinishReason == "content_filter" {
+		return nil, kindError(ErrSafety, "%s content filter blocked the response", name)
+	}
+	return nil, kindError(ErrEmpty, "empty response from %s", name)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenAPIToolConfig turns the operations of an OpenAPI 3 spec into tools,
+// named <entry>.<operationId>:
+//
+//	"openapi": {"billing": {"spec": "specs/billing.yaml",
+//	  "base_url": "https://billing.internal/api", "bearer": "vault://kv/billing#token",
+//	  "operations": ["getInvoice", "GET /customers/*"]}}
+//
+// Operations lists the operationIds, or "METHOD /path" globs, the model
+// may call; without it only GET operations are offered.
+type OpenAPIToolConfig struct {
+	Spec    string `json:"spec"`               // file or http(s) URL, JSON or YAML
+	BaseURL string `json:"base_url,omitempty"` // default: the spec's first server
+	// Bearer is sent as "Authorization: Bearer ..."; it, Headers and Query
+	// values may be secret references.
+	Bearer     string            `json:"bearer,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Query      map[string]string `json:"query,omitempty"` // e.g. an api_key parameter
+	Operations []string          `json:"operations,omitempty"`
+	Timeout    string            `json:"timeout,omitempty"` // per call, default 30s
+}
+
+// openAPISpec is the part of an OpenAPI 3 document the tools use.
+type openAPISpec struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+type openAPIOperation struct {
+	OperationID string             `json:"operationId"`
+	Summary     string             `json:"summary"`
+	Description string             `json:"description"`
+	Parameters  []openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool                       `json:"required"`
+		Content  map[string]json.RawMessage `json:"content"`
+	} `json:"requestBody"`
+}
+
+type openAPIParameter struct {
+	Ref         string          `json:"$ref"`
+	Name        string          `json:"name"`
+	In          string          `json:"in"` // path, query or header
+	Required    bool            `json:"required"`
+	Description string          `json:"description"`
+	Schema      json.RawMessage `json:"schema"`
+}
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "patch", "head", "options"}
+
+var operationNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// maxSchemaDepth bounds $ref expansion, so recursive schemas end.
+const maxSchemaDepth = 8
+
+// openAPITools builds the tools for one openapi entry.
+func openAPITools(name string, c OpenAPIToolConfig) ([]tool, error) {
+	if c.Spec == "" {
+		return nil, fmt.Errorf("no spec configured")
+	}
+	timeout := 30 * time.Second
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+		}
+		timeout = d
+	}
+	for _, op := range c.Operations {
+		if _, err := path.Match(op, ""); err != nil {
+			return nil, fmt.Errorf("operations: bad pattern %q", op)
+		}
+	}
+	data, err := readOpenAPISpec(c.Spec)
+	if err != nil {
+		return nil, err
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("spec %s: %v", c.Spec, err)
+	}
+	var root any
+	json.Unmarshal(data, &root)
+
+	base := c.BaseURL
+	if base == "" && len(spec.Servers) > 0 {
+		base = spec.Servers[0].URL
+	}
+	u, err := url.Parse(base)
+	if err == nil && !u.IsAbs() && strings.HasPrefix(c.Spec, "http") {
+		// A relative server URL is relative to where the spec came from.
+		specURL, _ := url.Parse(c.Spec)
+		u = specURL.ResolveReference(u)
+	}
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("no absolute base URL: set base_url, or servers in the spec")
+	}
+	api := &openAPIClient{base: strings.TrimSuffix(u.String(), "/"), headers: map[string]string{}, query: url.Values{}, client: &http.Client{Timeout: timeout}}
+	if c.Bearer != "" {
+		v, err := resolveSecretValue(c.Bearer)
+		if err != nil {
+			return nil, fmt.Errorf("bearer: %v", err)
+		}
+		api.headers["Authorization"] = "Bearer " + v
+	}
+	for k, v := range c.Headers {
+		v, err := resolveSecretValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", k, err)
+		}
+		api.headers[k] = v
+	}
+	for k, v := range c.Query {
+		v, err := resolveSecretValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %v", k, err)
+		}
+		api.query.Set(k, v)
+	}
+
+	var tools []tool
+	seen := map[string]bool{}
+	for _, p := range sortedKeys(spec.Paths) {
+		item := spec.Paths[p]
+		var shared []openAPIParameter
+		if raw, ok := item["parameters"]; ok {
+			json.Unmarshal(raw, &shared)
+		}
+		for _, method := range openAPIMethods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var op openAPIOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("spec %s: %s %s: %v", c.Spec, strings.ToUpper(method), p, err)
+			}
+			id := op.OperationID
+			if id == "" {
+				id = method + strings.Trim(operationNameRe.ReplaceAllString(p, "_"), "_")
+			}
+			id = operationNameRe.ReplaceAllString(id, "_")
+			if !operationAllowed(c.Operations, id, method, p) {
+				continue
+			}
+			if seen[id] {
+				return nil, fmt.Errorf("spec %s: duplicate operationId %q", c.Spec, id)
+			}
+			seen[id] = true
+			t := &openAPITool{api: api, name: name + "." + id, method: strings.ToUpper(method), path: p}
+			if err := t.build(op, shared, root); err != nil {
+				return nil, fmt.Errorf("spec %s: %s: %v", c.Spec, id, err)
+			}
+			tools = append(tools, t)
+		}
+	}
+	if len(tools) == 0 {
+		return nil, fmt.Errorf("no operations allowed in %s", c.Spec)
+	}
+	return tools, nil
+}
+
+// readOpenAPISpec reads a spec from a file or URL, converting YAML to JSON.
+func readOpenAPISpec(src string) ([]byte, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var resp *http.Response
+		if resp, err = (&http.Client{Timeout: 30 * time.Second}).Get(src); err != nil {
+			return nil, fmt.Errorf("fetching spec: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching spec %s: %s", src, resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading spec: %v", err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("spec %s: %v", src, err)
+		}
+	}
+	return data, nil
+}
+
+// operationAllowed checks an operation against the operations setting.
+func operationAllowed(allowed []string, id, method, p string) bool {
+	if len(allowed) == 0 {
+		return method == "get"
+	}
+	route := strings.ToUpper(method) + " " + p
+	for _, a := range allowed {
+		if a == "*" || a == id {
+			return true
+		}
+		if ok, _ := path.Match(a, route); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRef follows a local "#/components/..." reference in root.
+func resolveRef(root any, ref string) (any, error) {
+	frag, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil, fmt.Errorf("only local $refs are supported, not %q", ref)
+	}
+	node := root
+	for _, part := range strings.Split(frag, "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// inlineRefs replaces the $refs in a schema with what they point to, so
+// the model sees the whole input schema.
+func inlineRefs(root, v any, depth int) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if ref, ok := v["$ref"].(string); ok {
+			if depth >= maxSchemaDepth {
+				return map[string]any{"type": "object"}
+			}
+			target, err := resolveRef(root, ref)
+			if err != nil {
+				return map[string]any{}
+			}
+			return inlineRefs(root, target, depth+1)
+		}
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = inlineRefs(root, e, depth)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = inlineRefs(root, e, depth)
+		}
+		return out
+	}
+	return v
+}
+
+// openAPIClient is what the tools of one spec share.
+type openAPIClient struct {
+	base    string
+	headers map[string]string
+	query   url.Values
+	client  *http.Client
+}
+
+// openAPITool calls one operation.
+type openAPITool struct {
+	api         *openAPIClient
+	name        string
+	method      string
+	path        string
+	description string
+	params      []openAPIParameter
+	hasBody     bool
+	bodyType    string
+	schema      json.RawMessage
+}
+
+func (t *openAPITool) build(op openAPIOperation, shared []openAPIParameter, root any) error {
+	t.description = strings.TrimSpace(op.Summary)
+	if d := strings.TrimSpace(op.Description); d != "" && d != t.description {
+		t.description = strings.TrimSpace(t.description + "\n" + d)
+	}
+	t.description = strings.TrimSpace(truncateRunes(t.description, 1000) + " (" + t.method + " " + t.path + ")")
+
+	// Operation parameters override path-level ones of the same name and place.
+	byKey := map[string]openAPIParameter{}
+	var order []string
+	for _, group := range [][]openAPIParameter{shared, op.Parameters} {
+		for _, p := range group {
+			if p.Ref != "" {
+				target, err := resolveRef(root, p.Ref)
+				if err != nil {
+					return err
+				}
+				raw, _ := json.Marshal(target)
+				if err := json.Unmarshal(raw, &p); err != nil {
+					return err
+				}
+			}
+			if p.In == "cookie" {
+				continue
+			}
+			key := p.In + ":" + p.Name
+			if _, ok := byKey[key]; !ok {
+				order = append(order, key)
+			}
+			byKey[key] = p
+		}
+	}
+	props := map[string]any{}
+	var required []string
+	for _, key := range order {
+		p := byKey[key]
+		var schema any = map[string]any{"type": "string"}
+		if len(p.Schema) > 0 {
+			json.Unmarshal(p.Schema, &schema)
+			schema = inlineRefs(root, schema, 0)
+		}
+		if m, ok := schema.(map[string]any); ok && p.Description != "" {
+			m["description"] = p.Description
+		}
+		if _, taken := props[p.Name]; taken {
+			return fmt.Errorf("parameter %s is both in %s and elsewhere", p.Name, p.In)
+		}
+		props[p.Name] = schema
+		if p.Required || p.In == "path" {
+			required = append(required, p.Name)
+		}
+		t.params = append(t.params, p)
+	}
+	if op.RequestBody != nil {
+		for _, ct := range append([]string{"application/json"}, sortedKeys(op.RequestBody.Content)...) {
+			raw, ok := op.RequestBody.Content[ct]
+			if !ok {
+				continue
+			}
+			var media struct {
+				Schema any `json:"schema"`
+			}
+			json.Unmarshal(raw, &media)
+			if media.Schema == nil {
+				media.Schema = map[string]any{}
+			}
+			if _, taken := props["body"]; taken {
+				return fmt.Errorf("a parameter named body clashes with the request body")
+			}
+			props["body"] = inlineRefs(root, media.Schema, 0)
+			t.hasBody, t.bodyType = true, ct
+			if op.RequestBody.Required {
+				required = append(required, "body")
+			}
+			break
+		}
+	}
+	sort.Strings(required)
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	var err error
+	t.schema, err = json.Marshal(schema)
+	return err
+}
+
+func (t *openAPITool) spec() toolSpec {
+	return toolSpec{Name: t.name, Description: t.description, InputSchema: t.schema}
+}
+
+func (t *openAPITool) readOnly() bool { return t.method == "GET" || t.method == "HEAD" }
+
+func (t *openAPITool) describe(json.RawMessage) string {
+	return "Calling " + t.method + " " + t.path
+}
+
+// request builds the HTTP request for input.
+func (t *openAPITool) request(ctx context.Context, input json.RawMessage) (*http.Request, error) {
+	fields := map[string]json.RawMessage{}
+	if len(input) > 0 && string(input) != "null" {
+		if err := json.Unmarshal(input, &fields); err != nil {
+			return nil, fmt.Errorf("invalid input: expected a JSON object: %v", err)
+		}
+	}
+	value := func(raw json.RawMessage) string {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s
+		}
+		return string(raw)
+	}
+	p := t.path
+	query := url.Values{}
+	for k, vs := range t.api.query {
+		query[k] = vs
+	}
+	header := http.Header{}
+	for _, param := range t.params {
+		raw, ok := fields[param.Name]
+		if !ok || string(raw) == "null" {
+			if param.Required || param.In == "path" {
+				return nil, fmt.Errorf("missing required input %q", param.Name)
+			}
+			continue
+		}
+		switch param.In {
+		case "path":
+			p = strings.ReplaceAll(p, "{"+param.Name+"}", url.PathEscape(value(raw)))
+		case "query":
+			var list []json.RawMessage
+			if json.Unmarshal(raw, &list) == nil {
+				for _, e := range list {
+					query.Add(param.Name, value(e))
+				}
+			} else {
+				query.Set(param.Name, value(raw))
+			}
+		case "header":
+			header.Set(param.Name, value(raw))
+		}
+	}
+	var body io.Reader
+	if raw, ok := fields["body"]; ok && t.hasBody {
+		if t.bodyType == "application/json" || strings.HasSuffix(t.bodyType, "+json") {
+			body = bytes.NewReader(raw)
+		} else {
+			body = strings.NewReader(value(raw))
+		}
+		header.Set("Content-Type", t.bodyType)
+	}
+	target := t.api.base + p
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, t.method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Header.Set("Accept", "application/json, */*;q=0.5")
+	for k, v := range t.api.headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+func (t *openAPITool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	req, err := t.request(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.api.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", t.method, t.path, redactErr(err))
+	}
+	defer resp.Body.Close()
+	out := &cappedBuffer{max: maxToolOutput}
+	io.Copy(out, resp.Body)
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("%s %s: %s\n%s", t.method, t.path, resp.Status, out)
+	}
+	text := out.String()
+	if strings.TrimSpace(text) == "" {
+		text = resp.Status
+	}
+	return toolOutput(text)
+}
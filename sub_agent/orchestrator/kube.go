@@ -0,0 +1,316 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KubeJob is an agent that runs the helix CLI as a Kubernetes Job per
+// prompt, so agents can be spread over a cluster. The pod's log is read as
+// helix's --json output, and the Job is deleted once it has been read.
+type KubeJob struct {
+	Client    *KubeClient
+	Namespace string
+	Image     string // runs helix as its entrypoint, like the sub_agent Dockerfile
+	Provider  string
+	Model     string
+	Args      []string // extra helix flags
+	// Env is set in the pod; the keys of each Secret in EnvSecrets are too,
+	// which is how provider credentials reach it.
+	Env            map[string]string
+	EnvSecrets     []string
+	ServiceAccount string
+	Resources      KubeResources
+	Poll           time.Duration // how often the Job is checked; default 2s
+}
+
+// KubeResources are the container's resource limits, in Kubernetes
+// quantities ("500m", "2Gi"); GPU requests nvidia.com/gpu.
+type KubeResources struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+	GPU    string `json:"gpu,omitempty"`
+}
+
+func (j KubeJob) Ask(ctx context.Context, prompt string) (Reply, error) {
+	// --quiet keeps status lines out of the log the result is read from.
+	name, err := j.create(ctx, helixArgs(j.Provider, j.Model, append([]string{"--quiet"}, j.Args...), prompt))
+	if err != nil {
+		return Reply{}, err
+	}
+	// Cleanup must run even when ctx is what ended the wait.
+	defer j.Client.do(context.WithoutCancel(ctx), http.MethodDelete,
+		fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s?propagationPolicy=Background", j.Namespace, name), nil, nil)
+
+	failed, err := j.wait(ctx, name)
+	if err != nil {
+		return Reply{}, err
+	}
+	log, err := j.log(ctx, name)
+	if err != nil {
+		return Reply{}, err
+	}
+	res, err := parseHelixLog(log)
+	if err != nil {
+		if failed {
+			return Reply{}, fmt.Errorf("job %s failed: %s", name, strings.TrimSpace(log))
+		}
+		return Reply{}, fmt.Errorf("job %s: %v", name, err)
+	}
+	return res.reply()
+}
+
+// create submits the Job and returns its name.
+func (j KubeJob) create(ctx context.Context, args []string) (string, error) {
+	labels := map[string]string{"app.kubernetes.io/managed-by": "helix"}
+	var env []map[string]interface{}
+	names := make([]string, 0, len(j.Env))
+	for k := range j.Env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		env = append(env, map[string]interface{}{"name": k, "value": j.Env[k]})
+	}
+	var envFrom []map[string]interface{}
+	for _, s := range j.EnvSecrets {
+		envFrom = append(envFrom, map[string]interface{}{"secretRef": map[string]string{"name": s}})
+	}
+	limits := map[string]string{}
+	if j.Resources.CPU != "" {
+		limits["cpu"] = j.Resources.CPU
+	}
+	if j.Resources.Memory != "" {
+		limits["memory"] = j.Resources.Memory
+	}
+	if j.Resources.GPU != "" {
+		limits["nvidia.com/gpu"] = j.Resources.GPU
+	}
+	container := map[string]interface{}{
+		"name":    "helix",
+		"image":   j.Image,
+		"args":    args,
+		"env":     env,
+		"envFrom": envFrom,
+	}
+	if len(limits) > 0 {
+		container["resources"] = map[string]interface{}{"limits": limits, "requests": limits}
+	}
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []interface{}{container},
+	}
+	if j.ServiceAccount != "" {
+		podSpec["serviceAccountName"] = j.ServiceAccount
+	}
+	job := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]interface{}{"generateName": "helix-agent-", "labels": labels},
+		"spec": map[string]interface{}{
+			// Agents are asked again by the caller if they fail; the TTL
+			// covers Jobs a crashed caller never deleted.
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 3600,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec":     podSpec,
+			},
+		},
+	}
+	var created struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := j.Client.do(ctx, http.MethodPost, fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", j.Namespace), job, &created); err != nil {
+		return "", fmt.Errorf("creating job: %v", err)
+	}
+	return created.Metadata.Name, nil
+}
+
+// wait polls the Job until it succeeds or fails.
+func (j KubeJob) wait(ctx context.Context, name string) (failed bool, err error) {
+	poll := j.Poll
+	if poll <= 0 {
+		poll = 2 * time.Second
+	}
+	for {
+		var job struct {
+			Status struct {
+				Succeeded int `json:"succeeded"`
+				Failed    int `json:"failed"`
+			} `json:"status"`
+		}
+		if err := j.Client.do(ctx, http.MethodGet, fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", j.Namespace, name), nil, &job); err != nil {
+			return false, fmt.Errorf("checking job %s: %v", name, err)
+		}
+		switch {
+		case job.Status.Succeeded > 0:
+			return false, nil
+		case job.Status.Failed > 0:
+			return true, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// log returns the log of the Job's pod.
+func (j KubeJob) log(ctx context.Context, name string) (string, error) {
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	q := url.Values{"labelSelector": {"job-name=" + name}}
+	if err := j.Client.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods?%s", j.Namespace, q.Encode()), nil, &pods); err != nil {
+		return "", fmt.Errorf("finding pod of job %s: %v", name, err)
+	}
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("job %s has no pod", name)
+	}
+	var log bytes.Buffer
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?container=helix", j.Namespace, pods.Items[0].Metadata.Name)
+	if err := j.Client.do(ctx, http.MethodGet, path, nil, &log); err != nil {
+		return "", fmt.Errorf("reading log of job %s: %v", name, err)
+	}
+	return log.String(), nil
+}
+
+// parseHelixLog finds helix's JSON result in a pod log, which also holds
+// anything helix wrote to stderr.
+func parseHelixLog(log string) (helixResult, error) {
+	var res helixResult
+	for i := 0; i < len(log); i++ {
+		if log[i] != '{' || (i > 0 && log[i-1] != '\n') {
+			continue
+		}
+		if err := json.NewDecoder(strings.NewReader(log[i:])).Decode(&res); err == nil {
+			return res, nil
+		}
+	}
+	return res, fmt.Errorf("no JSON result in log")
+}
+
+// KubeClient calls the Kubernetes API.
+type KubeClient struct {
+	Host  string // e.g. https://10.0.0.1:443; http://127.0.0.1:8001 for kubectl proxy
+	Token string // bearer token; "" sends none
+	HTTP  *http.Client
+}
+
+// Where a pod's service account is mounted.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// InClusterClient uses the service account of the pod it runs in.
+func InClusterClient() (*KubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	return NewKubeClient("https://"+net.JoinHostPort(host, port), serviceAccountDir+"/token", serviceAccountDir+"/ca.crt")
+}
+
+// NewKubeClient returns a client for host, reading a bearer token and a CA
+// certificate from the given files; either may be "".
+func NewKubeClient(host, tokenFile, caFile string) (*KubeClient, error) {
+	c := &KubeClient{Host: strings.TrimRight(host, "/"), HTTP: &http.Client{Timeout: time.Minute}}
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Kubernetes token: %v", err)
+		}
+		c.Token = strings.TrimSpace(string(data))
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Kubernetes CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s holds no PEM certificate", caFile)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+		c.HTTP.Transport = t
+	}
+	return c, nil
+}
+
+// InClusterNamespace is the namespace of the pod it runs in, or "".
+func InClusterNamespace() string {
+	data, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// do sends body as JSON and decodes the response into out: a
+// *bytes.Buffer receives it raw, nil discards it.
+func (c *KubeClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Host+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) == nil && status.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, status.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *bytes.Buffer:
+		out.Write(data)
+		return nil
+	default:
+		return json.Unmarshal(data, out)
+	}
+}
@@ -0,0 +1,286 @@
+// Package orchestrator supervises a group of sub-agents: it gives each a
+// name and role, routes messages between them, enforces per-agent budgets
+// and keeps one merged transcript of everything that was said.
+//
+// Agents are anything that can answer a prompt. Func wraps an in-process
+// call (the helix binary adapts its task runner this way), Process runs an
+// arbitrary command, Helix runs the helix CLI as a child process and
+// KubeJob runs it as a Kubernetes Job.
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Agent answers one prompt at a time. Implementations must be safe for
+// concurrent use if they are asked in parallel.
+type Agent interface {
+	Ask(ctx context.Context, prompt string) (Reply, error)
+}
+
+// Reply is an agent's answer.
+type Reply struct {
+	Output string
+	// Tokens used, if the agent knows; otherwise the supervisor estimates.
+	Tokens int
+	// Model that answered, if known, for the transcript.
+	Model string
+}
+
+// Func adapts an in-process function to Agent.
+type Func func(ctx context.Context, prompt string) (Reply, error)
+
+func (f Func) Ask(ctx context.Context, prompt string) (Reply, error) { return f(ctx, prompt) }
+
+// Budget limits what one agent may consume; zero fields are unlimited.
+// It is checked before each call, so the call that crosses a limit still
+// completes.
+type Budget struct {
+	MaxCalls  int
+	MaxTokens int
+	MaxTime   time.Duration // total time spent answering
+}
+
+// Usage is what an agent has consumed so far.
+type Usage struct {
+	Calls   int
+	Tokens  int
+	Elapsed time.Duration
+}
+
+// ErrBudgetExceeded is returned (wrapped) when an agent is asked after
+// using up its budget.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Supervisor is the name messages from the caller are attributed to.
+const Supervisor = "supervisor"
+
+// Spec declares an agent.
+type Spec struct {
+	Name  string
+	Role  string // instructions prepended to every prompt, e.g. "You are the critic."
+	Agent Agent
+	Budget
+	// Remember includes the agent's earlier exchanges in each prompt, since
+	// agents themselves are stateless.
+	Remember bool
+}
+
+// Entry is one message in the transcript.
+type Entry struct {
+	Seq     int           `json:"seq"`
+	Time    time.Time     `json:"time"`
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Content string        `json:"content"`
+	Model   string        `json:"model,omitempty"`
+	Tokens  int           `json:"tokens,omitempty"`
+	Elapsed time.Duration `json:"elapsed_ns,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type member struct {
+	Spec
+	mu      sync.Mutex
+	usage   Usage
+	history []Entry
+}
+
+// Group is a set of agents under one supervisor.
+type Group struct {
+	mu         sync.Mutex
+	members    map[string]*member
+	order      []string
+	transcript []Entry
+}
+
+// New returns an empty group.
+func New() *Group {
+	return &Group{members: map[string]*member{}}
+}
+
+// Add registers an agent. Names must be unique and not "supervisor".
+func (g *Group) Add(s Spec) error {
+	if s.Name == "" || s.Name == Supervisor {
+		return fmt.Errorf("invalid agent name %q", s.Name)
+	}
+	if s.Agent == nil {
+		return fmt.Errorf("agent %s: no Agent", s.Name)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.members[s.Name]; ok {
+		return fmt.Errorf("agent %s already exists", s.Name)
+	}
+	g.members[s.Name] = &member{Spec: s}
+	g.order = append(g.order, s.Name)
+	return nil
+}
+
+// Names lists the agents in the order they were added.
+func (g *Group) Names() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.order...)
+}
+
+// Ask sends content from the supervisor to an agent.
+func (g *Group) Ask(ctx context.Context, to, content string) (string, error) {
+	return g.Send(ctx, Supervisor, to, content)
+}
+
+// Send delivers content from one agent (or the supervisor) to another and
+// returns the reply. Both are recorded in the transcript.
+func (g *Group) Send(ctx context.Context, from, to, content string) (string, error) {
+	g.mu.Lock()
+	m, ok := g.members[to]
+	_, fromOK := g.members[from]
+	g.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no agent named %s", to)
+	}
+	if from != Supervisor && !fromOK {
+		return "", fmt.Errorf("no agent named %s", from)
+	}
+
+	m.mu.Lock()
+	if err := m.check(); err != nil {
+		m.mu.Unlock()
+		return "", err
+	}
+	prompt := m.prompt(from, content)
+	m.mu.Unlock()
+
+	sent := g.record(Entry{From: from, To: to, Content: content})
+	start := time.Now()
+	reply, err := m.Agent.Ask(ctx, prompt)
+	elapsed := time.Since(start)
+	tokens := reply.Tokens
+	if tokens == 0 {
+		tokens = estimateTokens(prompt) + estimateTokens(reply.Output)
+	}
+
+	m.mu.Lock()
+	m.usage.Calls++
+	m.usage.Tokens += tokens
+	m.usage.Elapsed += elapsed
+	answer := Entry{From: to, To: from, Content: reply.Output, Model: reply.Model, Tokens: tokens, Elapsed: elapsed}
+	if err != nil {
+		answer.Error = err.Error()
+	} else {
+		m.history = append(m.history, sent, answer)
+	}
+	m.mu.Unlock()
+	g.record(answer)
+	if err != nil {
+		return "", fmt.Errorf("agent %s: %w", to, err)
+	}
+	return reply.Output, nil
+}
+
+// check fails once any budget is used up; called with m.mu held.
+func (m *member) check() error {
+	b, u := m.Budget, m.usage
+	switch {
+	case b.MaxCalls > 0 && u.Calls >= b.MaxCalls:
+		return fmt.Errorf("agent %s: %w (%d calls)", m.Name, ErrBudgetExceeded, b.MaxCalls)
+	case b.MaxTokens > 0 && u.Tokens >= b.MaxTokens:
+		return fmt.Errorf("agent %s: %w (%d tokens)", m.Name, ErrBudgetExceeded, b.MaxTokens)
+	case b.MaxTime > 0 && u.Elapsed >= b.MaxTime:
+		return fmt.Errorf("agent %s: %w (%s)", m.Name, ErrBudgetExceeded, b.MaxTime)
+	}
+	return nil
+}
+
+// prompt builds what the agent sees; called with m.mu held.
+func (m *member) prompt(from, content string) string {
+	var b strings.Builder
+	if m.Role != "" {
+		b.WriteString(m.Role)
+		b.WriteString("\n\n")
+	}
+	if m.Remember && len(m.history) > 0 {
+		b.WriteString("Conversation so far:\n")
+		for _, e := range m.history {
+			fmt.Fprintf(&b, "[%s -> %s]\n%s\n\n", e.From, e.To, e.Content)
+		}
+	}
+	if from != Supervisor {
+		fmt.Fprintf(&b, "Message from %s:\n", from)
+	}
+	b.WriteString(content)
+	return b.String()
+}
+
+func (g *Group) record(e Entry) Entry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e.Seq = len(g.transcript) + 1
+	e.Time = time.Now().UTC()
+	g.transcript = append(g.transcript, e)
+	return e
+}
+
+// Message is one delivery for Parallel.
+type Message struct {
+	From, To, Content string
+}
+
+// Result is the outcome of one Message.
+type Result struct {
+	Message
+	Reply string
+	Err   error
+}
+
+// Parallel delivers msgs concurrently and returns results in the same
+// order. Failures are per message; the others still complete.
+func (g *Group) Parallel(ctx context.Context, msgs []Message) []Result {
+	results := make([]Result, len(msgs))
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		wg.Add(1)
+		go func(i int, msg Message) {
+			defer wg.Done()
+			from := msg.From
+			if from == "" {
+				from = Supervisor
+			}
+			reply, err := g.Send(ctx, from, msg.To, msg.Content)
+			results[i] = Result{Message: msg, Reply: reply, Err: err}
+		}(i, msg)
+	}
+	wg.Wait()
+	return results
+}
+
+// Usage reports what the named agent has consumed.
+func (g *Group) Usage(name string) Usage {
+	g.mu.Lock()
+	m := g.members[name]
+	g.mu.Unlock()
+	if m == nil {
+		return Usage{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage
+}
+
+// Transcript returns every message so far, in the order they were sent.
+func (g *Group) Transcript() []Entry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Entry(nil), g.transcript...)
+}
+
+// estimateTokens is the usual four characters per token.
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
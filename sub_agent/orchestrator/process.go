@@ -0,0 +1,99 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Process is an agent that runs a command per prompt, writing the prompt
+// to its stdin and taking its stdout as the reply.
+type Process struct {
+	Path string
+	Args []string
+	Env  []string // added to the inherited environment
+	Dir  string
+}
+
+func (p Process) Ask(ctx context.Context, prompt string) (Reply, error) {
+	cmd := exec.CommandContext(ctx, p.Path, p.Args...)
+	cmd.Stdin = strings.NewReader(prompt)
+	cmd.Dir = p.Dir
+	if len(p.Env) > 0 {
+		cmd.Env = append(cmd.Environ(), p.Env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return Reply{}, fmt.Errorf("%s: %v: %s", p.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	return Reply{Output: strings.TrimSpace(stdout.String())}, nil
+}
+
+// Helix is an agent that runs the helix CLI as a child process with --json,
+// so each agent can use its own binary, provider, model and flags.
+type Helix struct {
+	Path     string // default "helix"
+	Provider string
+	Model    string
+	Args     []string // extra flags, e.g. --verify
+	Env      []string
+}
+
+// helixResult is the part of helix's --json output used here.
+type helixResult struct {
+	Model       string `json:"model"`
+	Output      string `json:"output"`
+	ArtifactURL string `json:"artifact_url"`
+	Error       string `json:"error"`
+}
+
+func (h Helix) Ask(ctx context.Context, prompt string) (Reply, error) {
+	path := h.Path
+	if path == "" {
+		path = "helix"
+	}
+	cmd := exec.CommandContext(ctx, path, helixArgs(h.Provider, h.Model, h.Args, prompt)...)
+	if len(h.Env) > 0 {
+		cmd.Env = append(cmd.Environ(), h.Env...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// helix prints the JSON result even when the task fails.
+	out, runErr := cmd.Output()
+	var res helixResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		if runErr != nil {
+			return Reply{}, fmt.Errorf("%s: %v: %s", path, runErr, strings.TrimSpace(string(out)+stderr.String()))
+		}
+		return Reply{}, fmt.Errorf("%s: unexpected output: %v", path, err)
+	}
+	return res.reply()
+}
+
+// helixArgs are the flags that make helix answer prompt as JSON.
+func helixArgs(provider, model string, extra []string, prompt string) []string {
+	args := []string{"--json", "--no-stdin"}
+	if provider != "" {
+		args = append(args, "--provider", provider)
+	}
+	if model != "" {
+		args = append(args, "--model", model)
+	}
+	args = append(args, extra...)
+	return append(args, "--task", prompt)
+}
+
+func (res helixResult) reply() (Reply, error) {
+	if res.Error != "" {
+		return Reply{Model: res.Model}, fmt.Errorf("%s", res.Error)
+	}
+	reply := Reply{Output: res.Output, Model: res.Model}
+	if res.ArtifactURL != "" {
+		reply.Output = "The result was uploaded to " + res.ArtifactURL
+	}
+	return reply, nil
+}
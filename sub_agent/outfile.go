@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// outputFlags send the result to a file instead of stdout, and the answer
+// to speech or the clipboard.
+type outputFlags struct {
+	path      *string
+	append    *bool
+	stream    *bool
+	clipboard *bool
+	speech    *speechFlags
+
+	// provenance, when set, is recorded in the output file under
+	// provenanceMode.
+	provenance     *Provenance
+	provenanceMode string
+}
+
+func addOutputFlags(fs *flag.FlagSet) *outputFlags {
+	return &outputFlags{
+		path:      fs.String("output-file", "", "Write the result to this file instead of stdout, replacing it atomically"),
+		append:    fs.Bool("append", false, "With --output-file, add the result to the end of the file (JSON results one per line)"),
+		stream:    fs.Bool("stream", false, "Print the answer as it is generated and tool calls as they happen; with --json, one event per line ending with the result"),
+		clipboard: fs.Bool("to-clipboard", false, "Also copy the answer to the system clipboard"),
+		speech:    addSpeechFlags(fs),
+	}
+}
+
+// deliver hands the answer, once the result is out, to speech and the
+// clipboard when asked to.
+func (o *outputFlags) deliver(answer string) {
+	if *o.clipboard {
+		if err := writeClipboard(answer); err != nil {
+			fatal(err)
+		}
+		statusf("[Sub-Agent] Copied the answer to the clipboard\n")
+	}
+	o.speech.deliver(answer)
+}
+
+// emit runs write against stdout, or against a buffer that is then stored
+// in the output file, so a killed process never leaves half a result.
+func (o *outputFlags) emit(write func(w io.Writer)) {
+	if *o.path == "" {
+		write(os.Stdout)
+		return
+	}
+	var buf bytes.Buffer
+	write(&buf)
+	data, err := o.provenance.mark(o.provenanceMode, *o.path, buf.String())
+	if err != nil {
+		fatal(err)
+	}
+	if err := writeOutputFile(*o.path, []byte(data), *o.append); err != nil {
+		fatal(fmt.Errorf("writing %s: %v", *o.path, err))
+	}
+	statusf("[Sub-Agent] Wrote result to %s\n", *o.path)
+}
+
+// emitJSON emits v as JSON: indented, or one line per result when
+// appending so the file stays JSONL.
+func (o *outputFlags) emitJSON(v interface{}) {
+	o.emit(func(w io.Writer) {
+		enc := json.NewEncoder(w)
+		if *o.path == "" || !*o.append {
+			enc.SetIndent("", "  ")
+		}
+		enc.Encode(v)
+	})
+}
+
+// streamEvents is the event sink for --stream. In text mode the answer's
+// text goes to stdout as it arrives and tool calls become status lines;
+// streamed is set once any answer text was printed. With --json each
+// event is a line of JSON.
+func (o *outputFlags) streamEvents(streamed *bool) eventSink {
+	enc := json.NewEncoder(os.Stdout)
+	return func(e TaskEvent) {
+		if jsonOut {
+			enc.Encode(e)
+			return
+		}
+		switch e.Type {
+		case EventText:
+			if !*streamed {
+				statusf("--- Result ---\n")
+				*streamed = true
+			}
+			fmt.Print(e.Text)
+		case EventToolCall:
+			statusf("[Sub-Agent] %s...\n", e.Summary)
+		}
+	}
+}
+
+// markdown reports whether the answer should be styled for a terminal.
+func (o *outputFlags) markdown(raw bool) bool {
+	return *o.path == "" && useMarkdown(raw)
+}
+
+// writeOutputFile replaces path with data, or with its old content plus
+// data when appending; either way via a temp file and rename.
+func writeOutputFile(path string, data []byte, appendTo bool) error {
+	if appendTo {
+		old, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		data = append(old, data...)
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// patchFlags configure applying diffs found in an answer (task mode only,
+// since it may ask for confirmation).
+type patchFlags struct {
+	apply *bool
+	yes   *bool
+}
+
+// applyAnswer applies the diffs in res.Output under workspace, after
+// showing them and asking unless --yes was given, and adds the changes to
+// res.Files. interactive is false in JSON mode, where nothing is shown.
+func (pf *patchFlags) applyAnswer(res *TaskResult, workspace, task string, interactive bool) error {
+	patches := parsePatches(res.Output)
+	if len(patches) == 0 {
+		res.Warnings = append(res.Warnings, "--apply: the answer contains no unified diff")
+		return nil
+	}
+	root, err := filepath.Abs(workspace)
+	if err != nil {
+		return fmt.Errorf("resolving workspace: %v", err)
+	}
+	files, err := preparePatches(root, patches)
+	if err != nil {
+		return err
+	}
+	if !*pf.yes {
+		if !interactive {
+			return fmt.Errorf("--apply needs --yes when the result is printed as JSON")
+		}
+		fmt.Println("--- Patch ---")
+		printPatches(patches, isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "")
+		ok, err := confirm(fmt.Sprintf("Apply changes to %d file(s) in %s?", len(files), workspace), "--yes")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("[Sub-Agent] Patch not applied")
+			return nil
+		}
+	}
+	changes, err := writePatches(root, task, files)
+	res.Files = append(res.Files, changes...)
+	return err
+}
+
+// filePatch is the part of a unified diff that changes one file.
+type filePatch struct {
+	oldPath string // "" for a new file
+	newPath string // "" for a deleted file
+	hunks   []hunk
+}
+
+// hunk is one @@ section; lines keep their ' ', '-' or '+' prefix.
+type hunk struct {
+	oldStart int
+	newStart int
+	lines    []string
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// path returns the file the patch applies to.
+func (p filePatch) path() string {
+	if p.newPath != "" {
+		return p.newPath
+	}
+	return p.oldPath
+}
+
+// parsePatches finds unified diffs in a model's answer: in ```diff or
+// ```patch fences if there are any, otherwise anywhere in the text.
+func parsePatches(text string) []filePatch {
+	var fenced []string
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		info := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(info, "```") {
+			continue
+		}
+		lang := strings.TrimSpace(strings.TrimPrefix(info, "```"))
+		j := i + 1
+		for ; j < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[j]), "```"); j++ {
+		}
+		if lang == "diff" || lang == "patch" || strings.HasPrefix(lang, "diff ") {
+			fenced = append(fenced, lines[i+1:min(j, len(lines))]...)
+		}
+		i = j
+	}
+	if len(fenced) > 0 {
+		lines = fenced
+	}
+
+	var patches []filePatch
+	var cur *filePatch
+	var h *hunk
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			patches = append(patches, filePatch{oldPath: diffPath(line[4:]), newPath: diffPath(lines[i+1][4:])})
+			cur, h = &patches[len(patches)-1], nil
+			i++
+		case cur == nil:
+		case hunkHeaderRe.MatchString(line):
+			m := hunkHeaderRe.FindStringSubmatch(line)
+			oldStart, _ := strconv.Atoi(m[1])
+			newStart, _ := strconv.Atoi(m[2])
+			cur.hunks = append(cur.hunks, hunk{oldStart: oldStart, newStart: newStart})
+			h = &cur.hunks[len(cur.hunks)-1]
+		case h == nil:
+		case line == "":
+			// Models often drop the space in front of blank context lines.
+			h.lines = append(h.lines, " ")
+		case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+			h.lines = append(h.lines, line)
+		case line[0] == '\\': // "\ No newline at end of file"
+		default:
+			h = nil
+		}
+	}
+
+	// Blank lines collected after the last real change are just spacing.
+	var out []filePatch
+	for _, p := range patches {
+		for i := range p.hunks {
+			l := p.hunks[i].lines
+			for len(l) > 0 && l[len(l)-1] == " " {
+				l = l[:len(l)-1]
+			}
+			p.hunks[i].lines = l
+		}
+		if len(p.hunks) > 0 || p.newPath == "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// diffPath strips a/ b/ prefixes and timestamps; /dev/null becomes "".
+func diffPath(s string) string {
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(s, "a/") || strings.HasPrefix(s, "b/") {
+		s = s[2:]
+	}
+	return s
+}
+
+// applyPatch returns the new content of p's file, given its current
+// content. Hunks are located near their stated line first and then
+// anywhere after the previous hunk, so stale line numbers still apply.
+func applyPatch(p filePatch, content string) (string, error) {
+	if p.newPath == "" {
+		return "", nil
+	}
+	trailingNewline := content == "" || strings.HasSuffix(content, "\n")
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+
+	pos := 0
+	for n, h := range p.hunks {
+		var old, repl []string
+		for _, l := range h.lines {
+			switch l[0] {
+			case ' ':
+				old, repl = append(old, l[1:]), append(repl, l[1:])
+			case '-':
+				old = append(old, l[1:])
+			case '+':
+				repl = append(repl, l[1:])
+			}
+		}
+		at := findLines(lines, old, max(h.oldStart-1, pos), pos)
+		if at < 0 {
+			return "", fmt.Errorf("hunk %d of %s does not apply", n+1, p.path())
+		}
+		lines = append(lines[:at], append(repl, lines[at+len(old):]...)...)
+		pos = at + len(repl)
+	}
+
+	out := strings.Join(lines, "\n")
+	if trailingNewline && len(lines) > 0 {
+		out += "\n"
+	}
+	return out, nil
+}
+
+// findLines returns where want occurs in lines at or after from, preferring
+// the position closest to hint; trailing whitespace is ignored.
+func findLines(lines, want []string, hint, from int) int {
+	matches := func(at int) bool {
+		if at < from || at+len(want) > len(lines) {
+			return false
+		}
+		for i, w := range want {
+			if strings.TrimRight(lines[at+i], " \t") != strings.TrimRight(w, " \t") {
+				return false
+			}
+		}
+		return true
+	}
+	if len(want) == 0 {
+		return min(max(hint, from), len(lines))
+	}
+	for d := 0; d <= len(lines); d++ {
+		if matches(hint + d) {
+			return hint + d
+		}
+		if d > 0 && matches(hint-d) {
+			return hint - d
+		}
+	}
+	return -1
+}
+
+// patchedFile is a fully computed change, ready to be written.
+type patchedFile struct {
+	rel     string
+	content string
+	deleted bool
+	existed bool
+}
+
+// preparePatches applies every patch in memory so that nothing is written
+// unless all of them apply.
+func preparePatches(root string, patches []filePatch) ([]patchedFile, error) {
+	var out []patchedFile
+	for _, p := range patches {
+		rel, err := workspaceRel(p.path())
+		if err != nil {
+			return nil, err
+		}
+		var current string
+		existed := false
+		if p.oldPath != "" {
+			src, err := workspaceRel(p.oldPath)
+			if err != nil {
+				return nil, err
+			}
+			data, err := os.ReadFile(filepath.Join(root, src))
+			if err != nil {
+				return nil, fmt.Errorf("patching %s: %v", p.oldPath, err)
+			}
+			current, existed = string(data), true
+		}
+		content, err := applyPatch(p, current)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, patchedFile{rel: rel, content: content, deleted: p.newPath == "", existed: existed})
+	}
+	return out, nil
+}
+
+// writePatches saves an undo bundle and then writes the changes.
+func writePatches(root, task string, files []patchedFile) ([]FileChange, error) {
+	rels := make([]string, len(files))
+	for i, f := range files {
+		rels[i] = f.rel
+	}
+	if err := saveUndo(root, task, rels); err != nil {
+		return nil, err
+	}
+	var manifest []FileChange
+	for _, f := range files {
+		dest := filepath.Join(root, f.rel)
+		change := FileChange{Path: filepath.ToSlash(f.rel), Action: "updated", Bytes: len(f.content)}
+		switch {
+		case f.deleted:
+			change.Action = "deleted"
+			if err := os.Remove(dest); err != nil {
+				return manifest, fmt.Errorf("deleting %s: %v", f.rel, err)
+			}
+		default:
+			if !f.existed {
+				change.Action = "created"
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+				return manifest, fmt.Errorf("creating directory for %s: %v", f.rel, err)
+			}
+			if err := writeFileAtomic(dest, []byte(f.content)); err != nil {
+				return manifest, fmt.Errorf("writing %s: %v", f.rel, err)
+			}
+		}
+		manifest = append(manifest, change)
+	}
+	return manifest, nil
+}
+
+// printPatches shows the patches about to be applied, coloured on a terminal.
+func printPatches(patches []filePatch, color bool) {
+	paint := func(style, s string) string {
+		if !color {
+			return s
+		}
+		return style + s + ansiReset
+	}
+	for _, p := range patches {
+		from, to := "a/"+p.oldPath, "b/"+p.newPath
+		if p.oldPath == "" {
+			from = "/dev/null"
+		}
+		if p.newPath == "" {
+			to = "/dev/null"
+		}
+		fmt.Println(paint(ansiBold, "--- "+from))
+		fmt.Println(paint(ansiBold, "+++ "+to))
+		for _, h := range p.hunks {
+			oldCount, newCount := 0, 0
+			for _, l := range h.lines {
+				if l[0] != '+' {
+					oldCount++
+				}
+				if l[0] != '-' {
+					newCount++
+				}
+			}
+			fmt.Println(paint(ansiCyan, fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.oldStart, oldCount, h.newStart, newCount)))
+			for _, l := range h.lines {
+				switch l[0] {
+				case '-':
+					fmt.Println(paint(ansiRed, l))
+				case '+':
+					fmt.Println(paint(ansiGreen, l))
+				default:
+					fmt.Println(l)
+				}
+			}
+		}
+	}
+}
+
+// confirm asks a yes/no question on the terminal, even when stdin is a
+// pipe. bypass is the flag that answers yes without asking, if any.
+func confirm(question, bypass string) (bool, error) {
+	in := os.Stdin
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		in = tty
+	} else if !isTerminal(os.Stdin) {
+		if bypass == "" {
+			return false, fmt.Errorf("no terminal to confirm on")
+		}
+		return false, fmt.Errorf("no terminal to confirm on; pass %s to go ahead without asking", bypass)
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
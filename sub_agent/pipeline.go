@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PipelinesConfig says where helix pipeline looks for pipelines: Dir
+// (default ~/.config/helix/pipelines) holds <name>.yaml, <name>.yml or
+// <name>.json files.
+type PipelinesConfig struct {
+	Dir string `json:"dir,omitempty"`
+}
+
+// Stage types of a pipeline.
+const (
+	StageRetrieve = "retrieve" // search a knowledge base; the output is the chunks
+	StageGenerate = "generate" // run a task
+	StageVerify   = "verify"   // have a model check the input and correct it
+	StageJudge    = "judge"    // score the input; the output is the input
+	StagePost     = "post"     // run the input through a --post chain
+)
+
+// Pipeline is a named sequence of stages, each working on what the earlier
+// ones produced, run with helix pipeline run.
+type Pipeline struct {
+	Description string `json:"description,omitempty"`
+	// Provider and Model are the defaults of the stages.
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// Vars are the defaults of the --var values.
+	Vars   map[string]interface{} `json:"vars,omitempty"`
+	Stages []PipelineStage        `json:"stages"`
+}
+
+// PipelineStage is one step of a pipeline. Prompt, Input and Reference
+// are templates like --template's, over {{.vars.x}}, the output of an
+// earlier stage {{.stages.name.output}} (and a judge's {{.stages.name.score}}),
+// the previous stage's output {{.prev}} and the stage's attempt {{.attempt}}.
+type PipelineStage struct {
+	Name     string `json:"name"` // default the type
+	Type     string `json:"type"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// Prompt is the task of a generate stage, the query of a retrieve
+	// stage, and the task a verify or judge stage checks the input against
+	// (default the last generate stage's).
+	Prompt string `json:"prompt,omitempty"`
+	// Input is the text a verify, judge or post stage works on (default
+	// the previous stage's output), and the --input of a generate stage.
+	Input string `json:"input,omitempty"`
+	// Params are TaskRequest fields of a generate stage, such as style,
+	// format or max_words.
+	Params json.RawMessage `json:"params,omitempty"`
+
+	KB        string      `json:"kb,omitempty"`  // retrieve: default --kb
+	Top       int         `json:"top,omitempty"` // retrieve: default --kb-top
+	Rounds    int         `json:"rounds,omitempty"`
+	Criteria  []Criterion `json:"criteria,omitempty"`  // judge
+	Reference string      `json:"reference,omitempty"` // judge: a known good answer
+	Post      string      `json:"post,omitempty"`      // post: the chain, as --post
+
+	// If skips the stage unless it holds, e.g. "review.score < 7" (see
+	// condition). Until reruns the stage, or the stages from RetryFrom on,
+	// until it holds or MaxAttempts (default 3) runs are done, e.g.
+	// "draft.valid" to retry an answer that doesn't match its format.
+	If          string `json:"if,omitempty"`
+	Until       string `json:"until,omitempty"`
+	MaxAttempts int    `json:"max_attempts,omitempty"`
+	RetryFrom   string `json:"retry_from,omitempty"`
+
+	post        []postStep
+	cond, until *condition
+}
+
+// maxPipelineAttempts bounds max_attempts, so that a loop can't run away.
+const maxPipelineAttempts = 10
+
+// stageFields are what conditions may reference of a stage.
+var stageFields = map[string]bool{"output": true, "score": true, "valid": true, "approved": true, "attempts": true}
+
+// PipelineResult is what helix pipeline run --json prints.
+type PipelineResult struct {
+	Pipeline   string        `json:"pipeline"`
+	Stages     []StageResult `json:"stages"`
+	Output     string        `json:"output"`
+	DurationMS int64         `json:"duration_ms"`
+	Error      string        `json:"error,omitempty"`
+	ErrorKind  ErrorKind     `json:"error_kind,omitempty"`
+}
+
+// StageResult is the outcome of one stage.
+type StageResult struct {
+	Name         string           `json:"name"`
+	Type         string           `json:"type"`
+	RunID        string           `json:"run_id,omitempty"` // generate
+	Model        string           `json:"model,omitempty"`
+	Attempt      int              `json:"attempt,omitempty"` // of a rerun stage
+	Skipped      bool             `json:"skipped,omitempty"` // its if was false
+	Output       string           `json:"output"`
+	Invalid      string           `json:"invalid,omitempty"` // why a generate stage's answer doesn't match its format
+	Retrieval    *RetrievalReport `json:"retrieval,omitempty"`
+	Verification *Verification    `json:"verification,omitempty"`
+	Judgement    *Judgement       `json:"judgement,omitempty"`
+	DurationMS   int64            `json:"duration_ms"`
+	Error        string           `json:"error,omitempty"`
+}
+
+func pipelinesDir() string {
+	if d := config.Pipelines.Dir; d != "" {
+		return d
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "helix", "pipelines")
+}
+
+var pipelineExts = []string{".yaml", ".yml", ".json"}
+
+// pipelinePath finds the file of the named pipeline.
+func pipelinePath(name string) (string, error) {
+	if !namespaceRe.MatchString(name) {
+		return "", fmt.Errorf("invalid pipeline name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	dir := pipelinesDir()
+	for _, ext := range pipelineExts {
+		p := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	names := pipelineNames()
+	if len(names) == 0 {
+		return "", fmt.Errorf("unknown pipeline %q: none are defined (add <name>.yaml files to %s)", name, dir)
+	}
+	return "", fmt.Errorf("unknown pipeline %q: expected one of %s", name, strings.Join(names, ", "))
+}
+
+// pipelineNames lists the pipelines of the directory, sorted.
+func pipelineNames() []string {
+	dir := pipelinesDir()
+	if dir == "" {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, ext := range pipelineExts {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+		for _, p := range paths {
+			seen[strings.TrimSuffix(filepath.Base(p), ext)] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadPipeline reads and checks a pipeline file, YAML unless it ends in
+// .json.
+func loadPipeline(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".json" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var p Pipeline
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &p, nil
+}
+
+func (p *Pipeline) validate() error {
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("no stages")
+	}
+	seen := map[string]bool{}
+	for i := range p.Stages {
+		st := &p.Stages[i]
+		if st.Name == "" {
+			st.Name = st.Type
+		}
+		if !namespaceRe.MatchString(st.Name) {
+			return fmt.Errorf("stage %d: invalid name %q: use letters, digits, '.', '_' and '-'", i+1, st.Name)
+		}
+		if seen[st.Name] {
+			return fmt.Errorf("stage %d: another stage is named %q", i+1, st.Name)
+		}
+		seen[st.Name] = true
+		switch st.Type {
+		case StageRetrieve, StageGenerate:
+			if strings.TrimSpace(st.Prompt) == "" {
+				return fmt.Errorf("stage %s: a %s stage needs a prompt", st.Name, st.Type)
+			}
+		case StageVerify, StageJudge:
+		case StagePost:
+			steps, err := parsePostChain(st.Post)
+			if err != nil {
+				return fmt.Errorf("stage %s: %v", st.Name, err)
+			}
+			if len(steps) == 0 {
+				return fmt.Errorf("stage %s: a post stage needs a post chain", st.Name)
+			}
+			st.post = steps
+		default:
+			return fmt.Errorf("stage %s: unknown type %q: expected retrieve, generate, verify, judge or post", st.Name, st.Type)
+		}
+		if len(st.Params) > 0 {
+			if st.Type != StageGenerate {
+				return fmt.Errorf("stage %s: only generate stages take params", st.Name)
+			}
+			dec := json.NewDecoder(bytes.NewReader(st.Params))
+			dec.DisallowUnknownFields()
+			var req TaskRequest
+			if err := dec.Decode(&req); err != nil {
+				return fmt.Errorf("stage %s: params: %v", st.Name, err)
+			}
+		}
+		if st.Rounds < 0 || st.Top < 0 {
+			return fmt.Errorf("stage %s: rounds and top must not be negative", st.Name)
+		}
+	}
+	// Conditions come after every name is known, so that they can name
+	// later stages of a loop.
+	loopOf := map[string]string{}
+	for i := range p.Stages {
+		st := &p.Stages[i]
+		var err error
+		if st.If != "" {
+			if st.cond, err = p.parseCondition(st.If); err != nil {
+				return fmt.Errorf("stage %s: if: %v", st.Name, err)
+			}
+		}
+		if st.Until == "" {
+			if st.MaxAttempts != 0 || st.RetryFrom != "" {
+				return fmt.Errorf("stage %s: max_attempts and retry_from need until", st.Name)
+			}
+			continue
+		}
+		if st.until, err = p.parseCondition(st.Until); err != nil {
+			return fmt.Errorf("stage %s: until: %v", st.Name, err)
+		}
+		if st.MaxAttempts == 0 {
+			st.MaxAttempts = 3
+		}
+		if st.MaxAttempts < 1 || st.MaxAttempts > maxPipelineAttempts {
+			return fmt.Errorf("stage %s: max_attempts must be 1 to %d", st.Name, maxPipelineAttempts)
+		}
+		from := i
+		if st.RetryFrom != "" {
+			if from = p.stageIndex(st.RetryFrom); from < 0 || from > i {
+				return fmt.Errorf("stage %s: retry_from %q is not this or an earlier stage", st.Name, st.RetryFrom)
+			}
+		}
+		// Loops may not overlap: an inner loop's attempts would never
+		// start over.
+		for _, inner := range p.Stages[from : i+1] {
+			if other, ok := loopOf[inner.Name]; ok {
+				return fmt.Errorf("stage %s: its loop overlaps the loop of %s", st.Name, other)
+			}
+			loopOf[inner.Name] = st.Name
+		}
+	}
+	return nil
+}
+
+// stageIndex is the index of the stage called name, or -1.
+func (p *Pipeline) stageIndex(name string) int {
+	for i, st := range p.Stages {
+		if st.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseCondition parses a condition and checks that what it references
+// exists.
+func (p *Pipeline) parseCondition(text string) (*condition, error) {
+	c, err := parseCondition(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range c.refs() {
+		if ref == "attempt" || strings.HasPrefix(ref, "vars.") {
+			continue
+		}
+		i := strings.LastIndex(ref, ".")
+		if i < 0 || p.stageIndex(ref[:i]) < 0 || !stageFields[ref[i+1:]] {
+			return nil, fmt.Errorf("unknown reference %q: expected stage.output, .score, .valid, .approved or .attempts, vars.name or attempt", ref)
+		}
+	}
+	return c, nil
+}
+
+// pipelineRun is the state of one run of a pipeline.
+type pipelineRun struct {
+	r    *runner
+	name string
+	p    *Pipeline
+	tmpl taskTemplate
+	vars map[string]interface{}
+
+	stages  map[string]map[string]interface{} // by name: output, attempts, and a judge's score and so on
+	prev    string
+	attempt int // of the running stage
+	// The task, provider and model of the last generate stage, which
+	// verify and judge stages check against by default.
+	task            string
+	provider, model string
+}
+
+func newPipelineRun(r *runner, name string, p *Pipeline, tmpl taskTemplate, vars map[string]string) *pipelineRun {
+	pr := &pipelineRun{r: r, name: name, p: p, tmpl: tmpl, vars: map[string]interface{}{}, stages: map[string]map[string]interface{}{}}
+	for k, v := range p.Vars {
+		pr.vars[k] = v
+	}
+	for k, v := range vars {
+		pr.vars[k] = v
+	}
+	return pr
+}
+
+func (pr *pipelineRun) render(text string) (string, error) {
+	return pr.tmpl.execute("pipeline", text, map[string]interface{}{"vars": pr.vars, "stages": pr.stages, "prev": pr.prev, "attempt": pr.attempt})
+}
+
+// input is what a stage works on: its input template, or the previous
+// stage's output.
+func (pr *pipelineRun) input(st PipelineStage) (string, error) {
+	if st.Input == "" {
+		return pr.prev, nil
+	}
+	return pr.render(st.Input)
+}
+
+// checkedTask is the task a verify or judge stage checks against.
+func (pr *pipelineRun) checkedTask(st PipelineStage) (string, error) {
+	if st.Prompt != "" {
+		return pr.render(st.Prompt)
+	}
+	if pr.task == "" {
+		return "", kindError(ErrConfig, "a %s stage needs a prompt when no generate stage comes before it", st.Type)
+	}
+	return pr.task, nil
+}
+
+// modelOf is a stage's provider and model, defaulting to the pipeline's.
+func (pr *pipelineRun) modelOf(st PipelineStage) (string, string) {
+	if st.Provider == "" && st.Model == "" {
+		return pr.p.Provider, pr.p.Model
+	}
+	return st.Provider, st.Model
+}
+
+// run runs the stages in order, skipping those whose if is false and
+// going back to retry_from while an until is false, and stops at the first
+// that fails.
+func (pr *pipelineRun) run(ctx context.Context) (PipelineResult, error) {
+	res := PipelineResult{Pipeline: pr.name}
+	start := time.Now()
+	defer func() { res.DurationMS = time.Since(start).Milliseconds() }()
+	stages := pr.p.Stages
+	runs := map[string]int{}
+	for i := 0; i < len(stages); i++ {
+		st := stages[i]
+		if err := ctx.Err(); err != nil {
+			return res, fmt.Errorf("pipeline %s: %w", pr.name, err)
+		}
+		runs[st.Name]++
+		pr.attempt = runs[st.Name]
+		stageStart := time.Now()
+		sr := StageResult{Name: st.Name, Type: st.Type}
+		if pr.attempt > 1 {
+			sr.Attempt = pr.attempt
+		}
+		if st.cond != nil && !st.cond.holds(pr.lookup) {
+			sr.Skipped = true
+			res.Stages = append(res.Stages, sr)
+			delete(pr.stages, st.Name)
+			statusf("[Sub-Agent] Stage %d/%d %s (%s) skipped: %s is false\n", i+1, len(stages), st.Name, st.Type, st.cond)
+		} else {
+			err := pr.runStage(ctx, st, &sr)
+			sr.DurationMS = time.Since(stageStart).Milliseconds()
+			res.Stages = append(res.Stages, sr)
+			if err != nil {
+				res.Stages[len(res.Stages)-1].Error = err.Error()
+				return res, fmt.Errorf("stage %s: %w", st.Name, err)
+			}
+			out := map[string]interface{}{"output": sr.Output, "attempts": pr.attempt}
+			switch {
+			case sr.Judgement != nil:
+				out["score"] = sr.Judgement.Overall
+			case sr.Verification != nil:
+				out["approved"] = sr.Verification.Verdict == "approved"
+			case st.Type == StageGenerate:
+				out["valid"] = sr.Invalid == ""
+			}
+			pr.stages[st.Name], pr.prev, res.Output = out, sr.Output, sr.Output
+			statusf("[Sub-Agent] Stage %d/%d %s (%s) done in %.1fs%s\n", i+1, len(stages), st.Name, st.Type, time.Since(stageStart).Seconds(), stageDetail(sr))
+		}
+
+		if st.until == nil || st.until.holds(pr.lookup) {
+			continue
+		}
+		if pr.attempt >= st.MaxAttempts {
+			statusf("[Sub-Agent] Warning: %s is still false after %d attempt(s) of %s; going on\n", st.until, pr.attempt, st.Name)
+			continue
+		}
+		from := st.Name
+		if st.RetryFrom != "" {
+			from = st.RetryFrom
+		}
+		statusf("[Sub-Agent] %s is false; retrying from %s (attempt %d of %d)\n", st.until, from, pr.attempt+1, st.MaxAttempts)
+		i = pr.p.stageIndex(from) - 1
+	}
+	return res, nil
+}
+
+// stageDetail is what a stage's status line says of its result.
+func stageDetail(sr StageResult) string {
+	detail := ""
+	switch {
+	case sr.Retrieval != nil:
+		detail = fmt.Sprintf(", %d chunk(s)", len(sr.Retrieval.Chunks))
+	case sr.Verification != nil:
+		detail = fmt.Sprintf(", %s after %d round(s)", sr.Verification.Verdict, sr.Verification.Rounds)
+	case sr.Judgement != nil:
+		detail = fmt.Sprintf(", scored %.1f", sr.Judgement.Overall)
+	case sr.Invalid != "":
+		detail = ", invalid: " + sr.Invalid
+	}
+	if sr.Model != "" {
+		detail = " on " + sr.Model + detail
+	}
+	return detail
+}
+
+// lookup resolves a reference of an if or until condition.
+func (pr *pipelineRun) lookup(ref string) interface{} {
+	if ref == "attempt" {
+		return pr.attempt
+	}
+	if name, ok := strings.CutPrefix(ref, "vars."); ok {
+		return pr.vars[name]
+	}
+	i := strings.LastIndex(ref, ".")
+	return pr.stages[ref[:i]][ref[i+1:]]
+}
+
+func (pr *pipelineRun) runStage(ctx context.Context, st PipelineStage, sr *StageResult) error {
+	r := pr.r
+	provider, model := pr.modelOf(st)
+	switch st.Type {
+	case StageRetrieve:
+		query, err := pr.render(st.Prompt)
+		if err != nil {
+			return kindError(ErrConfig, "%v", err)
+		}
+		name := st.KB
+		if name == "" {
+			name = r.retrieval.kb
+		}
+		if name == "" {
+			return kindError(ErrConfig, "no knowledge base: set kb on the stage or pass --kb")
+		}
+		s, err := openKB(name, r.key)
+		if err != nil {
+			return kindError(ErrConfig, "%v", err)
+		}
+		rc := r.retrieval
+		if st.Top > 0 {
+			rc.topN, rc.topK = st.Top, max(rc.topK, st.Top)
+		}
+		hits, rep, err := rc.retrieve(ctx, s, query, func(w string) { statusf("[Sub-Agent] Warning: %s\n", w) })
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		for _, h := range hits {
+			fmt.Fprintf(&b, "<chunk id=%q source=%q>\n%s\n</chunk>\n", h.ID, formatSource(Source{Source: h.Source, StartLine: h.StartLine, EndLine: h.EndLine}), h.Text)
+		}
+		sr.Output, sr.Retrieval = b.String(), rep
+
+	case StageGenerate:
+		req, err := pr.stageRequest(st)
+		if err != nil {
+			return err
+		}
+		res, err := r.run(ctx, req)
+		sr.RunID, sr.Model = res.ID, modelChoice{res.Provider, res.Model}.String()
+		if err != nil {
+			return err
+		}
+		sr.Output = res.Output
+		if err := checkFormat(r.answerFormat(req), res.Output); err != nil {
+			sr.Invalid = err.Error()
+		}
+		pr.task, pr.provider, pr.model = req.Task, res.Provider, res.Model
+
+	case StageVerify:
+		input, err := pr.input(st)
+		if err != nil {
+			return kindError(ErrConfig, "%v", err)
+		}
+		task, err := pr.checkedTask(st)
+		if err != nil {
+			return err
+		}
+		rounds := st.Rounds
+		if rounds == 0 {
+			rounds = 1
+		}
+		// An unset verifier is the model that wrote the answer.
+		base := TaskRequest{Provider: pr.provider, Model: pr.model}
+		if base.Provider == "" {
+			base.Provider = "local"
+		}
+		out, v, err := r.verifyAnswer(ctx, task, input, base, verifyConfig{rounds: rounds, provider: provider, model: model})
+		sr.Verification = v
+		if err != nil {
+			return err
+		}
+		sr.Output, sr.Model = out, modelChoice{v.Provider, v.Model}.String()
+
+	case StageJudge:
+		input, err := pr.input(st)
+		if err != nil {
+			return kindError(ErrConfig, "%v", err)
+		}
+		task, err := pr.checkedTask(st)
+		if err != nil {
+			return err
+		}
+		ref := ""
+		if st.Reference != "" {
+			if ref, err = pr.render(st.Reference); err != nil {
+				return kindError(ErrConfig, "%v", err)
+			}
+		}
+		spec := ""
+		if provider != "" {
+			spec = modelChoice{provider, model}.String()
+		}
+		j, err := newJudge(spec, pr.provider, pr.model, r.key)
+		if err != nil {
+			return kindError(ErrConfig, "%v", err)
+		}
+		jm, err := j.score(ctx, task, input, ref, st.Criteria)
+		if err != nil {
+			return err
+		}
+		sr.Output, sr.Judgement, sr.Model = input, jm, j.name()
+
+	case StagePost:
+		input, err := pr.input(st)
+		if err != nil {
+			return kindError(ErrConfig, "%v", err)
+		}
+		if sr.Output, err = applyPostChain(ctx, st.post, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageRequest is the task a generate stage runs.
+func (pr *pipelineRun) stageRequest(st PipelineStage) (TaskRequest, error) {
+	var req TaskRequest
+	if len(st.Params) > 0 {
+		if err := json.Unmarshal(st.Params, &req); err != nil {
+			return req, kindError(ErrConfig, "params: %v", err)
+		}
+	}
+	task, err := pr.render(st.Prompt)
+	if err != nil {
+		return req, kindError(ErrConfig, "%v", err)
+	}
+	if st.Input != "" {
+		if req.Input, err = pr.render(st.Input); err != nil {
+			return req, kindError(ErrConfig, "%v", err)
+		}
+	}
+	req.Task = task
+	if provider, model := pr.modelOf(st); provider != "" || model != "" {
+		req.Provider, req.Model = provider, model
+	}
+	if req.Tags == nil {
+		req.Tags = map[string]string{}
+	}
+	req.Tags["pipeline"], req.Tags["stage"] = pr.name, st.Name
+	return req, nil
+}
+
+// pipelineFile is the pipeline a run names: --file, or the name in the
+// pipelines directory.
+func pipelineFile(file string, args []string) (name, path string, err error) {
+	switch {
+	case file != "" && len(args) == 0:
+		ext := filepath.Ext(file)
+		return strings.TrimSuffix(filepath.Base(file), ext), file, nil
+	case file == "" && len(args) == 1:
+		path, err := pipelinePath(args[0])
+		return args[0], path, err
+	}
+	return "", "", fmt.Errorf("name one pipeline, or pass --file")
+}
+
+// pipelineArgs loads the pipeline the arguments of a pipeline subcommand
+// name. Flags may follow the name too: pipeline run name --var k=v.
+func pipelineArgs(fs *flag.FlagSet, file string, args []string) (string, string, *Pipeline) {
+	if len(args) > 1 {
+		fs.Parse(args[1:])
+		args = append(args[:1], fs.Args()...)
+	}
+	name, path, err := pipelineFile(file, args)
+	if err != nil {
+		fatal(configError(err))
+	}
+	p, err := loadPipeline(path)
+	if err != nil {
+		fatal(configError(err))
+	}
+	return name, path, p
+}
+
+// pipelineRunCommand implements `pipeline run name --var k=v`.
+func pipelineRunCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "", "Run the pipeline in this YAML or JSON file instead of a named one")
+	vars := varFlag{}
+	fs.Var(vars, "var", "Template variable key=value, overriding the pipeline's vars (repeatable)")
+	templateShell := fs.Bool("template-shell", false, "Let the pipeline's templates run shell commands with sh")
+	asJSON := fs.Bool("json", false, "Print every stage's result as JSON")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func(args []string) {
+		name, path, p := pipelineArgs(fs, *file, args)
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		ctx, stop := shutdownSignal()
+		defer stop()
+
+		tmpl := taskTemplate{dir: filepath.Dir(path), shell: *templateShell}
+		res, err := newPipelineRun(r, name, p, tmpl, vars).run(ctx)
+		if err != nil {
+			res.Error, res.ErrorKind = err.Error(), errorKind(err)
+		}
+		if *asJSON {
+			printJSON(res)
+			if err != nil {
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(res.Output)
+	}
+}
+
+// pipelineListCommand implements `pipeline list`.
+func pipelineListCommand(fs *flag.FlagSet) func(args []string) {
+	return func([]string) {
+		names := pipelineNames()
+		if len(names) == 0 {
+			fmt.Printf("No pipelines; add <name>.yaml files to %s.\n", pipelinesDir())
+			return
+		}
+		for _, name := range names {
+			path, err := pipelinePath(name)
+			if err != nil {
+				fatal(configError(err))
+			}
+			p, err := loadPipeline(path)
+			if err != nil {
+				fmt.Printf("%-24s invalid: %v\n", name, err)
+				continue
+			}
+			types := make([]string, len(p.Stages))
+			for i, st := range p.Stages {
+				types[i] = st.Type
+			}
+			fmt.Printf("%-24s %-40s %s\n", name, strings.Join(types, " -> "), p.Description)
+		}
+	}
+}
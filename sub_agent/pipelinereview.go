@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Formats of `pipeline graph`.
+const (
+	GraphDOT     = "dot"
+	GraphMermaid = "mermaid"
+)
+
+// pipelineEdge is an arrow of a pipeline's graph.
+type pipelineEdge struct {
+	from, to int // stage indexes; -1 is the start and len(stages) the end
+	label    string
+	kind     string // "next", "skip", "retry" or "data"
+}
+
+// stageRefRe finds the stages a template reads: {{.stages.name.output}}
+// and {{index .stages "name"}}.
+var stageRefRe = regexp.MustCompile(`\.stages\.([A-Za-z0-9_]+)|index\s+\.stages\s+"([^"]+)"`)
+
+// edges lists the arrows of p: each stage to the next, around stages whose
+// if may be false, back to where a loop retries from, and from each stage
+// to the later ones whose templates read it.
+func (p *Pipeline) edges() []pipelineEdge {
+	n := len(p.Stages)
+	var edges []pipelineEdge
+	for i := -1; i < n; i++ {
+		e := pipelineEdge{from: i, to: i + 1, kind: "next"}
+		if next := i + 1; next < n && p.Stages[next].cond != nil {
+			e.label = "if " + p.Stages[next].If
+			edges = append(edges, e, pipelineEdge{from: i, to: next + 1, label: "else", kind: "skip"})
+			continue
+		}
+		edges = append(edges, e)
+	}
+	for i, st := range p.Stages {
+		if st.until != nil {
+			from := i
+			if st.RetryFrom != "" {
+				from = p.stageIndex(st.RetryFrom)
+			}
+			edges = append(edges, pipelineEdge{from: i, to: from, label: fmt.Sprintf("until %s (at most %d)", st.Until, st.MaxAttempts), kind: "retry"})
+		}
+		seen := map[int]bool{}
+		for _, text := range []string{st.Prompt, st.Input, st.Reference} {
+			for _, m := range stageRefRe.FindAllStringSubmatch(text, -1) {
+				j := p.stageIndex(m[1] + m[2])
+				// The arrow to the next stage already says as much.
+				if j < 0 || j == i-1 || j == i || seen[j] {
+					continue
+				}
+				seen[j] = true
+				edges = append(edges, pipelineEdge{from: j, to: i, label: "output", kind: "data"})
+			}
+		}
+	}
+	return edges
+}
+
+// stageModel is the model a stage names, or "".
+func (p *Pipeline) stageModel(st PipelineStage) string {
+	provider, model := st.Provider, st.Model
+	if provider == "" && model == "" {
+		provider, model = p.Provider, p.Model
+	}
+	if provider == "" {
+		return model
+	}
+	return modelChoice{provider, model}.String()
+}
+
+func (p *Pipeline) nodeLabel(i int) string {
+	switch {
+	case i < 0:
+		return "start"
+	case i >= len(p.Stages):
+		return "end"
+	}
+	st := p.Stages[i]
+	label := st.Name + "\n" + st.Type
+	if m := p.stageModel(st); m != "" && st.Type != StagePost && st.Type != StageRetrieve {
+		label += " · " + m
+	}
+	if st.Type == StageRetrieve && st.KB != "" {
+		label += " · kb " + st.KB
+	}
+	return label
+}
+
+// dot renders p for Graphviz.
+func (p *Pipeline) dot(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n  rankdir=TB;\n  node [shape=box, style=rounded];\n", name)
+	fmt.Fprintf(&b, "  start [label=\"start\", shape=circle];\n  end [label=\"end\", shape=doublecircle];\n")
+	for i := range p.Stages {
+		fmt.Fprintf(&b, "  n%d [label=%q];\n", i, p.nodeLabel(i))
+	}
+	for _, e := range p.edges() {
+		var attrs []string
+		if e.label != "" {
+			attrs = append(attrs, fmt.Sprintf("label=%q", e.label))
+		}
+		switch e.kind {
+		case "skip":
+			attrs = append(attrs, "style=dashed")
+		case "retry":
+			attrs = append(attrs, "style=bold", "color=orange", "constraint=false")
+		case "data":
+			attrs = append(attrs, "style=dotted", "color=gray")
+		}
+		fmt.Fprintf(&b, "  %s -> %s", p.nodeID(e.from), p.nodeID(e.to))
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// mermaid renders p as a Mermaid flowchart.
+func (p *Pipeline) mermaid() string {
+	var b strings.Builder
+	b.WriteString("flowchart TD\n  start((start))\n  end_((end))\n")
+	for i := range p.Stages {
+		fmt.Fprintf(&b, "  n%d[\"%s\"]\n", i, mermaidText(p.nodeLabel(i)))
+	}
+	for _, e := range p.edges() {
+		arrow := "-->"
+		switch e.kind {
+		case "skip", "data":
+			arrow = "-.->"
+		case "retry":
+			arrow = "==>"
+		}
+		from, to := p.nodeID(e.from), p.nodeID(e.to)
+		if e.to >= len(p.Stages) {
+			to = "end_"
+		}
+		if e.label != "" {
+			fmt.Fprintf(&b, "  %s %s|\"%s\"| %s\n", from, arrow, mermaidText(e.label), to)
+		} else {
+			fmt.Fprintf(&b, "  %s %s %s\n", from, arrow, to)
+		}
+	}
+	return b.String()
+}
+
+func (p *Pipeline) nodeID(i int) string {
+	switch {
+	case i < 0:
+		return "start"
+	case i >= len(p.Stages):
+		return "end"
+	}
+	return fmt.Sprintf("n%d", i)
+}
+
+// mermaidText escapes s for a quoted Mermaid label.
+func mermaidText(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", "<br/>", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+// pipelineGraphCommand implements `pipeline graph name`.
+func pipelineGraphCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "", "Draw the pipeline in this YAML or JSON file instead of a named one")
+	format := fs.String("format", GraphMermaid, "Graph format: 'mermaid' or 'dot' (Graphviz)")
+	return func(args []string) {
+		name, _, p := pipelineArgs(fs, *file, args)
+		switch *format {
+		case GraphMermaid:
+			fmt.Print(p.mermaid())
+		case GraphDOT:
+			fmt.Print(p.dot(name))
+		default:
+			fatal(kindError(ErrConfig, "invalid --format %q: expected mermaid or dot", *format))
+		}
+	}
+}
+
+// PipelinePreview is what `pipeline dry-run` reports: each stage's
+// resolved prompts and models, from one pass with every condition taken
+// as true and placeholders for what earlier stages would produce (judges
+// score 10 and generate answers are valid).
+type PipelinePreview struct {
+	Pipeline      string         `json:"pipeline"`
+	Stages        []StagePreview `json:"stages"`
+	EstimatedCost float64        `json:"estimated_cost_usd"` // of one pass of the generate stages
+}
+
+// StagePreview is one stage of a dry run.
+type StagePreview struct {
+	Name     string         `json:"name"`
+	Type     string         `json:"type"`
+	Model    string         `json:"model,omitempty"`
+	Route    *RouteDecision `json:"route,omitempty"`
+	If       string         `json:"if,omitempty"`
+	Until    string         `json:"until,omitempty"`
+	Retry    string         `json:"retry,omitempty"` // where and how often an until retries
+	Prompt   string         `json:"prompt,omitempty"`
+	Input    string         `json:"input,omitempty"`
+	Request  *DryRun        `json:"request,omitempty"` // generate
+	Detail   string         `json:"detail,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// preview walks the stages once without calling providers.
+func (pr *pipelineRun) preview(ctx context.Context) PipelinePreview {
+	// Retrieval would embed the query, and history would record the
+	// previews as runs.
+	dr := *pr.r
+	dr.retrieval.kb, dr.history = "", nil
+	out := PipelinePreview{Pipeline: pr.name}
+	for _, st := range pr.p.Stages {
+		pr.attempt = 1
+		sp := StagePreview{Name: st.Name, Type: st.Type, If: st.If, Until: st.Until}
+		if st.until != nil {
+			from := st.Name
+			if st.RetryFrom != "" {
+				from = st.RetryFrom
+			}
+			sp.Retry = fmt.Sprintf("from %s, at most %d attempt(s)", from, st.MaxAttempts)
+		}
+		warn := func(err error) { sp.Warnings = append(sp.Warnings, err.Error()) }
+		provider, model := pr.modelOf(st)
+		switch st.Type {
+		case StageRetrieve:
+			query, err := pr.render(st.Prompt)
+			if err != nil {
+				warn(err)
+			}
+			kb := st.KB
+			if kb == "" {
+				kb = pr.r.retrieval.kb
+			}
+			top := pr.r.retrieval.topN
+			if st.Top > 0 {
+				top = st.Top
+			}
+			sp.Prompt, sp.Detail = query, fmt.Sprintf("the best %d chunk(s) of knowledge base %s", top, kb)
+			if kb == "" {
+				sp.Warnings = append(sp.Warnings, "no knowledge base: set kb on the stage or pass --kb")
+			}
+
+		case StageGenerate:
+			req, err := pr.stageRequest(st)
+			if err != nil {
+				warn(err)
+				break
+			}
+			if req.KB != "" {
+				sp.Warnings = append(sp.Warnings, fmt.Sprintf("knowledge base %s is searched when the stage runs; its chunks aren't in the preview", req.KB))
+				req.KB = ""
+			}
+			req.DryRun = true
+			res, err := dr.run(ctx, req)
+			sp.Model, sp.Route, sp.Request, sp.Prompt = modelChoice{res.Provider, res.Model}.String(), res.Route, res.DryRun, req.Task
+			sp.Input = req.Input
+			sp.Warnings = append(sp.Warnings, res.Warnings...)
+			if err != nil {
+				warn(err)
+			}
+			if res.DryRun != nil {
+				out.EstimatedCost += res.DryRun.EstimatedCost
+			}
+			pr.task, pr.provider, pr.model = req.Task, res.Provider, res.Model
+
+		case StageVerify, StageJudge:
+			input, err := pr.input(st)
+			if err != nil {
+				warn(err)
+			}
+			task, err := pr.checkedTask(st)
+			if err != nil {
+				warn(err)
+			}
+			sp.Prompt, sp.Input = task, input
+			if st.Type == StageVerify {
+				base := TaskRequest{Provider: pr.provider, Model: pr.model}
+				if base.Provider == "" {
+					base.Provider = "local"
+				}
+				p, m := withDefaults(provider, model, base)
+				rounds := max(st.Rounds, 1)
+				sp.Model, sp.Detail = modelChoice{p, m}.String(), fmt.Sprintf("up to %d round(s)", rounds)
+				break
+			}
+			spec := ""
+			if provider != "" {
+				spec = modelChoice{provider, model}.String()
+			}
+			j, err := newJudge(spec, pr.provider, pr.model, pr.r.key)
+			if err != nil {
+				warn(err)
+				break
+			}
+			criteria := st.Criteria
+			if len(criteria) == 0 {
+				criteria = defaultCriteria
+			}
+			names := make([]string, len(criteria))
+			for i, c := range criteria {
+				names[i] = c.Name
+			}
+			sp.Model, sp.Detail = j.name(), "scores "+strings.Join(names, ", ")
+
+		case StagePost:
+			input, err := pr.input(st)
+			if err != nil {
+				warn(err)
+			}
+			sp.Input, sp.Detail = input, "post-processes with "+st.Post
+		}
+		out.Stages = append(out.Stages, sp)
+
+		// Later stages see placeholders for what this one would produce.
+		pr.stages[st.Name] = map[string]interface{}{"output": fmt.Sprintf("<output of %s>", st.Name), "attempts": 1}
+		switch st.Type {
+		case StageJudge:
+			// A judge passes its input on, and scores it the best.
+			pr.stages[st.Name]["output"], pr.stages[st.Name]["score"] = sp.Input, 10.0
+		case StageVerify:
+			pr.stages[st.Name]["approved"] = true
+		case StageGenerate:
+			pr.stages[st.Name]["valid"] = true
+		}
+		pr.prev = pr.stages[st.Name]["output"].(string)
+	}
+	return out
+}
+
+// pipelineDryRunCommand implements `pipeline dry-run name --var k=v`.
+func pipelineDryRunCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "", "Preview the pipeline in this YAML or JSON file instead of a named one")
+	vars := varFlag{}
+	fs.Var(vars, "var", "Template variable key=value, overriding the pipeline's vars (repeatable)")
+	templateShell := fs.Bool("template-shell", false, "Let the pipeline's templates run shell commands with sh")
+	asJSON := fs.Bool("json", false, "Print the preview as JSON")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func(args []string) {
+		name, path, p := pipelineArgs(fs, *file, args)
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+		tmpl := taskTemplate{dir: filepath.Dir(path), shell: *templateShell}
+		pv := newPipelineRun(r, name, p, tmpl, vars).preview(context.Background())
+		if *asJSON {
+			printJSON(pv)
+			return
+		}
+		for i, sp := range pv.Stages {
+			fmt.Printf("Stage %d/%d %s (%s)", i+1, len(pv.Stages), sp.Name, sp.Type)
+			if sp.Model != "" {
+				fmt.Printf(" on %s", sp.Model)
+			}
+			fmt.Println()
+			if sp.Route != nil {
+				fmt.Printf("  route:   %s: %s\n", sp.Route.Policy, sp.Route.Reason)
+			}
+			if sp.If != "" {
+				fmt.Printf("  if:      %s\n", sp.If)
+			}
+			if sp.Until != "" {
+				fmt.Printf("  until:   %s (retry %s)\n", sp.Until, sp.Retry)
+			}
+			if sp.Detail != "" {
+				fmt.Printf("  does:    %s\n", sp.Detail)
+			}
+			if sp.Request != nil {
+				fmt.Printf("  sends:   %s, ~%d prompt token(s), ~$%.4f\n", sp.Request.Endpoint, sp.Request.PromptTokens, sp.Request.EstimatedCost)
+			}
+			for _, w := range sp.Warnings {
+				fmt.Printf("  warning: %s\n", w)
+			}
+			prompt := sp.Prompt
+			if sp.Request != nil {
+				prompt = sp.Request.Prompt
+			}
+			if prompt != "" {
+				fmt.Printf("  prompt:\n%s\n", indentLines(prompt, "    "))
+			}
+			if sp.Input != "" && sp.Request == nil {
+				fmt.Printf("  input:\n%s\n", indentLines(sp.Input, "    "))
+			}
+		}
+		fmt.Printf("Estimated cost of one pass: ~$%.4f\n", pv.EstimatedCost)
+	}
+}
+
+// indentLines puts prefix before every line of s.
+func indentLines(s, prefix string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = prefix + l
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"helix-agent-go/orchestrator"
+)
+
+// Plan is the planner's decomposition of a task and the result of each step.
+type Plan struct {
+	Provider string     `json:"provider"`
+	Model    string     `json:"model,omitempty"`
+	Steps    []PlanStep `json:"steps"`
+}
+
+// PlanStep is one subtask dispatched as its own sub-agent call.
+type PlanStep struct {
+	Task     string `json:"task"`
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// ToolCalls are the step's calls when the run has tools.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// Injection flags tool results of the step that read like instructions.
+	Injection []InjectionFinding `json:"injection,omitempty"`
+}
+
+// planConfig controls the --plan stage. Empty provider/model fall back to the
+// task's own.
+type planConfig struct {
+	enabled  bool
+	provider string
+	model    string
+	choices  []modelChoice // models the planner may assign to subtasks
+	maxSteps int
+	// autoApprove runs plans that may have side effects without asking.
+	autoApprove bool
+}
+
+// modelChoice is a provider/model pair such as local/llama3 or cloud.
+type modelChoice struct {
+	provider string
+	model    string
+}
+
+func (c modelChoice) String() string {
+	if c.model == "" {
+		return c.provider
+	}
+	return c.provider + "/" + c.model
+}
+
+// parseModelChoices parses "local/llama3,cloud". Only the first slash
+// separates the provider, so model names may contain slashes themselves.
+func parseModelChoices(spec string) ([]modelChoice, error) {
+	var choices []modelChoice
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p, m, _ := strings.Cut(item, "/")
+		if p == "" {
+			return nil, fmt.Errorf("invalid model choice %q: expected provider/model", item)
+		}
+		choices = append(choices, modelChoice{provider: p, model: m})
+	}
+	return choices, nil
+}
+
+// withDefaults fills an unset provider or model from the task. A model is
+// only inherited when the provider is the same, since names don't carry over.
+func withDefaults(provider, model string, req TaskRequest) (string, string) {
+	if provider == "" {
+		provider = req.Provider
+	}
+	if model == "" && provider == req.Provider {
+		model = req.Model
+	}
+	model = defaultModel(provider, model)
+	return provider, model
+}
+
+const planPrompt = `Break the following task into at most %d ordered subtasks. Each subtask will be handed to a separate assistant that sees the overall task and the results of earlier subtasks, but nothing else.
+%s
+Reply with only a JSON array of objects with a "task" field, for example:
+[{"task": "..."}, {"task": "..."}]
+
+Task:
+%s`
+
+const planStepPrompt = `You are completing one step of a larger task.
+
+Overall task:
+%s
+%s
+Your step:
+%s
+
+Reply with the result of your step only.`
+
+const planSynthesisPrompt = `Combine the results of the steps below into a single, complete answer to the overall task.
+
+Overall task:
+%s
+%s`
+
+// runPlan asks the planner for subtasks, runs them in order, and synthesizes
+// the final answer. The returned plan is populated even on failure so callers
+// can show how far it got. Progress is checkpointed after every step; a
+// resumed run skips planning and the steps already done.
+func (r *runner) runPlan(ctx context.Context, req TaskRequest) (*Plan, string, error) {
+	cfg := r.plan
+	cp := r.checkpoint(req, checkpointPlan)
+	if cp != nil && cp.Plan != nil {
+		return r.runPlanSteps(ctx, req, cp.Plan, cp)
+	}
+	plan := &Plan{}
+	plan.Provider, plan.Model = withDefaults(cfg.provider, cfg.model, req)
+
+	var routing string
+	if len(cfg.choices) > 0 {
+		names := make([]string, len(cfg.choices))
+		for i, c := range cfg.choices {
+			names[i] = c.String()
+		}
+		routing = fmt.Sprintf("\nYou may add a \"model\" field to a subtask to send it to one of: %s. Prefer cheaper models for simple steps.\n", strings.Join(names, ", "))
+	}
+
+	out, err := generate(ctx, plan.Provider, plan.Model, fmt.Sprintf(planPrompt, cfg.maxSteps, routing, req.Task), r.key)
+	if err != nil {
+		return plan, "", fmt.Errorf("planning: %w", err)
+	}
+	steps, err := parsePlanSteps(cleanOutput(out))
+	if err != nil {
+		return plan, "", fmt.Errorf("planning: %v", err)
+	}
+	if len(steps) > cfg.maxSteps {
+		steps = steps[:cfg.maxSteps]
+	}
+
+	for _, s := range steps {
+		step := PlanStep{Task: s.Task}
+		step.Provider, step.Model = withDefaults("", "", req)
+		for _, c := range cfg.choices {
+			if c.String() == s.Model {
+				step.Provider, step.Model = withDefaults(c.provider, c.model, req)
+			}
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	if err := r.approvePlan(ctx, plan); err != nil {
+		return plan, "", err
+	}
+	if cp != nil {
+		cp.Plan = plan
+		r.saveCheckpoint(cp)
+	}
+	return r.runPlanSteps(ctx, req, plan, cp)
+}
+
+// runPlanSteps runs the steps not yet done and synthesizes the answer.
+func (r *runner) runPlanSteps(ctx context.Context, req TaskRequest, plan *Plan, cp *Checkpoint) (*Plan, string, error) {
+	done := 0
+	if cp != nil {
+		done = cp.StepsDone
+	}
+	for i := done; i < len(plan.Steps); i++ {
+		step := &plan.Steps[i]
+		setStep(ctx, i+1)
+		prompt := fmt.Sprintf(planStepPrompt, req.Task, previousSteps(plan.Steps[:i]), step.Task)
+		var err error
+		if len(r.tools) > 0 {
+			// Each step is its own tool loop; the plan's checkpoint
+			// tracks the steps, so the loops keep none of their own.
+			stepReq := req
+			stepReq.Task, stepReq.Provider, stepReq.Model, stepReq.noCheckpoint = prompt, step.Provider, step.Model, true
+			var stepRes TaskResult
+			step.Output, err = r.callTools(ctx, stepReq, &stepRes)
+			step.ToolCalls, step.Injection = stepRes.ToolCalls, stepRes.Injection
+		} else {
+			var reply orchestrator.Reply
+			reply, err = r.agent(step.Provider, step.Model).Ask(ctx, prompt)
+			step.Output = reply.Output
+		}
+		if err != nil {
+			step.Error = err.Error()
+			// Report up to the failed step without trimming the checkpoint's plan.
+			failed := *plan
+			failed.Steps = plan.Steps[:i+1]
+			return &failed, "", fmt.Errorf("plan step %d: %w", i+1, err)
+		}
+		if cp != nil {
+			cp.StepsDone = i + 1
+			r.saveCheckpoint(cp)
+		}
+	}
+
+	out, err := generate(ctx, plan.Provider, plan.Model, fmt.Sprintf(planSynthesisPrompt, req.Task, previousSteps(plan.Steps)), r.key)
+	if err != nil {
+		return plan, "", fmt.Errorf("synthesizing plan results: %w", err)
+	}
+	return plan, cleanOutput(out), nil
+}
+
+// planReply is the planner's JSON shape for one subtask.
+type planReply struct {
+	Task  string `json:"task"`
+	Model string `json:"model,omitempty"`
+}
+
+// parsePlanSteps extracts the JSON array from the planner's reply, tolerating
+// surrounding prose or code fences.
+func parsePlanSteps(reply string) ([]planReply, error) {
+	start, end := strings.Index(reply, "["), strings.LastIndex(reply, "]")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("planner did not return a JSON array")
+	}
+	var steps []planReply
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &steps); err != nil {
+		return nil, fmt.Errorf("parsing plan: %v", err)
+	}
+
+	kept := steps[:0]
+	for _, s := range steps {
+		if strings.TrimSpace(s.Task) != "" {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("planner returned no subtasks")
+	}
+	return kept, nil
+}
+
+func previousSteps(steps []PlanStep) string {
+	if len(steps) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\nResults of previous steps:\n")
+	for i, s := range steps {
+		fmt.Fprintf(&b, "\nStep %d: %s\n%s\n", i+1, s.Task, s.Output)
+	}
+	return b.String()
+}
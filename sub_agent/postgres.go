@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small PostgreSQL client, enough for the history tables: the v3 wire
+// protocol with TLS, cleartext, MD5 and SCRAM-SHA-256 authentication, and
+// parameterized queries whose values travel as text.
+
+// pgError is an error the server reported.
+type pgError struct {
+	Severity, Code, Message string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("postgres: %s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// pgDB is a connection to one database, reopened when it breaks. Queries
+// take turns on it.
+type pgDB struct {
+	dsn *url.URL
+
+	mu   sync.Mutex
+	conn *pgConn
+}
+
+type pgConn struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+var (
+	historyDBOnce sync.Once
+	historyDB     *pgDB
+	historyDBErr  error
+)
+
+// historyDatabase opens history.postgres, or $HELIX_HISTORY_DSN: a
+// postgres:// URL, or a vault:// or exec: reference to one.
+func historyDatabase() (*pgDB, error) {
+	historyDBOnce.Do(func() {
+		dsn := os.Getenv("HELIX_HISTORY_DSN")
+		if dsn == "" {
+			dsn = liveConfig().History.Postgres
+		}
+		if dsn == "" {
+			historyDBErr = fmt.Errorf("history.backend is postgres but history.postgres is not set")
+			return
+		}
+		historyDB, historyDBErr = openPgDB(dsn, "history.postgres")
+	})
+	return historyDB, historyDBErr
+}
+
+// openPgDB resolves dsn, the setting's value, and parses it; connecting
+// waits for the first query.
+func openPgDB(dsn, setting string) (*pgDB, error) {
+	dsn, err := resolveSecretValue(dsn)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return nil, fmt.Errorf("%s: expected a postgres:// URL", setting)
+	}
+	if pw, ok := u.User.Password(); ok {
+		registerSecret(pw)
+	}
+	return &pgDB{dsn: u}, nil
+}
+
+// query runs sql with args as $1, $2... and returns the rows, each column
+// as text or nil for NULL. A broken connection is reopened and the query
+// tried once more.
+func (db *pgDB) query(sql string, args ...string) ([][][]byte, error) {
+	var rows [][][]byte
+	err := db.do(func(c *pgConn) (err error) {
+		_, rows, _, err = c.query(sql, args, 0)
+		return err
+	})
+	return rows, err
+}
+
+// do runs fn on the connection, opening it first if need be; when it
+// breaks it is reopened and fn run once more.
+func (db *pgDB) do(fn func(c *pgConn) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if db.conn == nil {
+			c, err := pgConnect(db.dsn)
+			if err != nil {
+				return err
+			}
+			db.conn = c
+		}
+		err := fn(db.conn)
+		var pe *pgError
+		if err == nil || errors.As(err, &pe) {
+			return err
+		}
+		db.conn.c.Close()
+		db.conn = nil
+		if attempt > 0 {
+			return fmt.Errorf("postgres: %v", err)
+		}
+	}
+}
+
+func pgConnect(u *url.URL) (*pgConn, error) {
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "5432"
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	password, _ := u.User.Password()
+	database := strings.TrimPrefix(u.Path, "/")
+	if database == "" {
+		database = user
+	}
+	sslmode := u.Query().Get("sslmode")
+	if sslmode == "" {
+		sslmode = "prefer"
+	}
+	switch sslmode {
+	case "disable", "prefer", "require", "verify-full":
+	default:
+		return nil, fmt.Errorf("postgres: unsupported sslmode %q: use disable, prefer, require or verify-full", sslmode)
+	}
+
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: %v", err)
+	}
+	if sslmode != "disable" {
+		// SSLRequest: the server answers S to go on in TLS, N to refuse.
+		c.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f})
+		answer := make([]byte, 1)
+		if _, err := io.ReadFull(c, answer); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("postgres: %v", err)
+		}
+		switch {
+		case answer[0] == 'S':
+			tc := tls.Client(c, &tls.Config{ServerName: host, InsecureSkipVerify: sslmode != "verify-full"})
+			if err := tc.Handshake(); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("postgres: TLS: %v", err)
+			}
+			c = tc
+		case sslmode != "prefer":
+			c.Close()
+			return nil, fmt.Errorf("postgres: the server doesn't offer TLS (sslmode=%s)", sslmode)
+		}
+	}
+	pc := &pgConn{c: c, r: bufio.NewReader(c)}
+	if err := pc.startup(user, password, database); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// pgMessage builds a frontend message: a type byte (none for startup),
+// then the length and body.
+type pgMessage struct {
+	typ byte
+	buf []byte
+}
+
+func (m *pgMessage) str(s string) *pgMessage {
+	m.buf = append(append(m.buf, s...), 0)
+	return m
+}
+
+func (m *pgMessage) int16(n int) *pgMessage {
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	return m
+}
+
+func (m *pgMessage) int32(n int) *pgMessage {
+	m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	return m
+}
+
+func (m *pgMessage) bytes(b []byte) *pgMessage {
+	m.buf = append(m.buf, b...)
+	return m
+}
+
+func (m *pgMessage) encode() []byte {
+	var out []byte
+	if m.typ != 0 {
+		out = append(out, m.typ)
+	}
+	out = binary.BigEndian.AppendUint32(out, uint32(len(m.buf)+4))
+	return append(out, m.buf...)
+}
+
+func (c *pgConn) send(msgs ...*pgMessage) error {
+	var out []byte
+	for _, m := range msgs {
+		out = append(out, m.encode()...)
+	}
+	c.c.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := c.c.Write(out)
+	return err
+}
+
+func (c *pgConn) receive() (byte, []byte, error) {
+	c.c.SetReadDeadline(time.Now().Add(60 * time.Second))
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(head[1:])) - 4
+	if n < 0 || n > 1<<30 {
+		return 0, nil, fmt.Errorf("invalid message length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return head[0], body, nil
+}
+
+func parsePgError(body []byte) *pgError {
+	e := &pgError{}
+	for len(body) > 1 {
+		code := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		v := string(body[1 : 1+end])
+		body = body[2+end:]
+		switch code {
+		case 'S':
+			e.Severity = v
+		case 'C':
+			e.Code = v
+		case 'M':
+			e.Message = v
+		}
+	}
+	return e
+}
+
+func (c *pgConn) startup(user, password, database string) error {
+	start := (&pgMessage{}).int32(196608).str("user").str(user).str("database").str(database).str("application_name").str("helix").str("")
+	if err := c.send(start); err != nil {
+		return fmt.Errorf("postgres: %v", err)
+	}
+	var scram *scramClient
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return fmt.Errorf("postgres: %v", err)
+		}
+		switch typ {
+		case 'E':
+			return parsePgError(body)
+		case 'Z':
+			return nil
+		case 'R':
+			if len(body) < 4 {
+				return fmt.Errorf("postgres: invalid authentication request")
+			}
+			var reply *pgMessage
+			switch code := binary.BigEndian.Uint32(body); code {
+			case 0: // ok
+			case 3: // cleartext
+				reply = (&pgMessage{typ: 'p'}).str(password)
+			case 5: // md5
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), body[4:8]...))
+				reply = (&pgMessage{typ: 'p'}).str("md5" + hex.EncodeToString(outer[:]))
+			case 10: // SASL
+				if !strings.Contains(string(body[4:]), "SCRAM-SHA-256\x00") {
+					return fmt.Errorf("postgres: the server offers no supported SASL mechanism")
+				}
+				scram = newScramClient(password)
+				first := scram.first()
+				reply = (&pgMessage{typ: 'p'}).str("SCRAM-SHA-256").int32(len(first)).bytes([]byte(first))
+			case 11: // SASL continue
+				if scram == nil {
+					return fmt.Errorf("postgres: unexpected SASL message")
+				}
+				final, err := scram.final(string(body[4:]))
+				if err != nil {
+					return err
+				}
+				reply = (&pgMessage{typ: 'p'}).bytes([]byte(final))
+			case 12: // SASL final
+				if scram == nil || !scram.verify(string(body[4:])) {
+					return fmt.Errorf("postgres: the server's SCRAM signature doesn't match")
+				}
+			default:
+				return fmt.Errorf("postgres: unsupported authentication method %d", code)
+			}
+			if reply != nil {
+				if err := c.send(reply); err != nil {
+					return fmt.Errorf("postgres: %v", err)
+				}
+			}
+		}
+		// ParameterStatus, BackendKeyData and notices need no answer.
+	}
+}
+
+// query runs one parameterized statement with the extended protocol and
+// returns its column names and rows. With maxRows > 0 at most that many
+// rows are fetched, and more reports whether there were others.
+func (c *pgConn) query(sql string, args []string, maxRows int) (cols []string, rows [][][]byte, more bool, err error) {
+	bind := (&pgMessage{typ: 'B'}).str("").str("").int16(0).int16(len(args))
+	for _, a := range args {
+		bind.int32(len(a)).bytes([]byte(a))
+	}
+	bind.int16(0)
+	err = c.send(
+		(&pgMessage{typ: 'P'}).str("").str(sql).int16(0),
+		bind,
+		(&pgMessage{typ: 'D'}).bytes([]byte{'P'}).str(""),
+		(&pgMessage{typ: 'E'}).str("").int32(maxRows),
+		&pgMessage{typ: 'S'},
+	)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var qerr error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		switch typ {
+		case 'E':
+			qerr = parsePgError(body)
+		case 'T':
+			if cols, err = parsePgRowDescription(body); err != nil {
+				return nil, nil, false, err
+			}
+		case 'D':
+			if len(body) < 2 {
+				return nil, nil, false, fmt.Errorf("invalid data row")
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			body = body[2:]
+			row := make([][]byte, n)
+			for i := range row {
+				if len(body) < 4 {
+					return nil, nil, false, fmt.Errorf("invalid data row")
+				}
+				size := int32(binary.BigEndian.Uint32(body))
+				body = body[4:]
+				if size < 0 {
+					continue
+				}
+				if int(size) > len(body) {
+					return nil, nil, false, fmt.Errorf("invalid data row")
+				}
+				row[i], body = body[:size], body[size:]
+			}
+			rows = append(rows, row)
+		case 's': // PortalSuspended: maxRows reached
+			more = true
+		case 'Z':
+			return cols, rows, more, qerr
+		}
+	}
+}
+
+// parsePgRowDescription reads the column names of a RowDescription.
+func parsePgRowDescription(body []byte) ([]string, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("invalid row description")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	cols := make([]string, n)
+	for i := range cols {
+		end := bytes.IndexByte(body, 0)
+		// Each name is followed by table, column, type, size, modifier and format.
+		if end < 0 || len(body) < end+1+18 {
+			return nil, fmt.Errorf("invalid row description")
+		}
+		cols[i], body = string(body[:end]), body[end+1+18:]
+	}
+	return cols, nil
+}
+
+// scramClient is the client side of SCRAM-SHA-256 (RFC 7677). The user
+// name is the startup message's, so it is left empty here as PostgreSQL
+// expects.
+type scramClient struct {
+	password, nonce    string
+	firstBare, authMsg string
+	serverSignature    []byte
+}
+
+func newScramClient(password string) *scramClient {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return &scramClient{password: password, nonce: base64.RawStdEncoding.EncodeToString(b)}
+}
+
+func (s *scramClient) first() string {
+	s.firstBare = "n=,r=" + s.nonce
+	return "n,," + s.firstBare
+}
+
+func (s *scramClient) final(serverFirst string) (string, error) {
+	var nonce, salt string
+	iter := 0
+	for _, kv := range strings.Split(serverFirst, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "r":
+			nonce = v
+		case "s":
+			salt = v
+		case "i":
+			iter, _ = strconv.Atoi(v)
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iter <= 0 {
+		return "", fmt.Errorf("postgres: invalid SCRAM challenge")
+	}
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iter)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMsg = s.firstBare + "," + serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], s.authMsg)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	s.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), s.authMsg)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *scramClient) verify(serverFinal string) bool {
+	v, ok := strings.CutPrefix(serverFinal, "v=")
+	if !ok {
+		return false
+	}
+	got, err := base64.StdEncoding.DecodeString(v)
+	return err == nil && hmac.Equal(got, s.serverSignature)
+}
+
+// pbkdf2SHA256 derives one SHA-256-sized block, all SCRAM needs.
+func pbkdf2SHA256(password, salt []byte, iter int) []byte {
+	h := hmac.New(sha256.New, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+	out := append([]byte{}, u...)
+	for i := 1; i < iter; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// pgRecords keeps records in a table of their own, created on first use:
+// (id text primary key, written timestamptz, data bytea).
+type pgRecords struct {
+	db    *pgDB
+	table string
+
+	once    sync.Once
+	initErr error
+}
+
+func (p *pgRecords) init() error {
+	p.once.Do(func() {
+		_, err := p.db.query(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id text PRIMARY KEY, written timestamptz NOT NULL, data bytea NOT NULL)`, p.table))
+		var pe *pgError
+		// Instances starting together race to create it.
+		if errors.As(err, &pe) && (pe.Code == "23505" || pe.Code == "42P07") {
+			err = nil
+		}
+		p.initErr = err
+	})
+	return p.initErr
+}
+
+func (p *pgRecords) put(id string, t time.Time, data []byte) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+	_, err := p.db.query(fmt.Sprintf(`INSERT INTO %s (id, written, data) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET written = EXCLUDED.written, data = EXCLUDED.data`, p.table),
+		id, t.UTC().Format(time.RFC3339Nano), `\x`+hex.EncodeToString(data))
+	return err
+}
+
+func (p *pgRecords) get(id string) ([]byte, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	rows, err := p.db.query(fmt.Sprintf(`SELECT data FROM %s WHERE id = $1`, p.table), id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errNoRecord
+	}
+	return pgBytea(rows[0][0])
+}
+
+func (p *pgRecords) list(columns string) ([]record, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	rows, err := p.db.query(fmt.Sprintf(`SELECT id, (extract(epoch FROM written) * 1000000)::bigint, %s FROM %s`, columns, p.table))
+	if err != nil {
+		return nil, err
+	}
+	var out []record
+	for _, row := range rows {
+		us, _ := strconv.ParseInt(string(row[1]), 10, 64)
+		r := record{id: string(row[0]), time: time.UnixMicro(us)}
+		if columns == "data" {
+			if r.data, err = pgBytea(row[2]); err != nil {
+				return nil, err
+			}
+			r.size = int64(len(r.data))
+		} else {
+			r.size, _ = strconv.ParseInt(string(row[2]), 10, 64)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (p *pgRecords) stat() ([]record, error) { return p.list("length(data)") }
+
+func (p *pgRecords) all() ([]record, error) { return p.list("data") }
+
+func (p *pgRecords) remove(id string) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+	_, err := p.db.query(fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, p.table), id)
+	return err
+}
+
+func (p *pgRecords) where() string {
+	return fmt.Sprintf("table %s of %s", p.table, p.db.dsn.Redacted())
+}
+
+// pgBytea decodes bytea in the hex text format.
+func pgBytea(v []byte) ([]byte, error) {
+	s, ok := strings.CutPrefix(string(v), `\x`)
+	if !ok {
+		return nil, fmt.Errorf("postgres: expected hex bytea output (bytea_output = hex)")
+	}
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// postStep is one stage of the output post-processing chain. Steps run in
+// order after cleanOutput, each receiving the previous step's text.
+type postStep struct {
+	name string
+	fn   func(ctx context.Context, text string) (string, error)
+}
+
+// postChainHelp documents the --post syntax.
+const postChainHelp = "Comma-separated post-processors: extract-code, trim-fences, trim-lines:N, replace:/regex/repl/, exec:command (quote commas in its arguments)"
+
+// parsePostChain parses a --post spec such as "extract-code,trim-lines:20".
+// Arguments follow the step name after a colon.
+func parsePostChain(spec string) ([]postStep, error) {
+	items, err := splitPostChain(spec)
+	if err != nil {
+		return nil, err
+	}
+	var steps []postStep
+	for _, item := range items {
+		name, arg, _ := strings.Cut(item, ":")
+		step, err := newPostStep(name, arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid post-processor %q: %v", item, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// splitPostChain splits a --post spec at the commas between its steps. A
+// replace step runs to its third delimiter, so its regex and replacement
+// may hold commas, and an exec step may quote them.
+func splitPostChain(spec string) ([]string, error) {
+	var items []string
+	for i := 0; i < len(spec); i++ {
+		start := i
+		for i < len(spec) && spec[i] != ':' && spec[i] != ',' {
+			i++
+		}
+		if i < len(spec) && spec[i] == ':' {
+			i++
+			switch strings.TrimSpace(spec[start : i-1]) {
+			case "replace":
+				delims := 0
+				if i < len(spec) {
+					for d := spec[i]; i < len(spec) && delims < 3; i++ {
+						if spec[i] == d {
+							delims++
+						}
+					}
+				}
+				if delims < 3 {
+					return nil, fmt.Errorf("invalid post-processor %q: expected /regex/replacement/", strings.TrimSpace(spec[start:]))
+				}
+			case "exec":
+				var quote byte
+				for ; i < len(spec) && (quote != 0 || spec[i] != ','); i++ {
+					switch c := spec[i]; {
+					case c == quote:
+						quote = 0
+					case quote == 0 && (c == '\'' || c == '"'):
+						quote = c
+					}
+				}
+				if quote != 0 {
+					return nil, fmt.Errorf("invalid post-processor %q: unterminated %c quote", strings.TrimSpace(spec[start:]), quote)
+				}
+			}
+		}
+		for i < len(spec) && spec[i] != ',' {
+			i++
+		}
+		if item := strings.TrimSpace(spec[start:i]); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// commandFields splits an exec step's command line into its words at
+// whitespace, except within single or double quotes, which it drops.
+func commandFields(cmd string) ([]string, error) {
+	var words []string
+	var w strings.Builder
+	var quote byte
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			w.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+		default:
+			w.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words, nil
+}
+
+// postStepNames are the steps newPostStep knows.
+var postStepNames = map[string]bool{"extract-code": true, "trim-fences": true, "trim-lines": true, "replace": true, "exec": true}
+
+// parsePostSteps parses a --request-post list of step names. exec is
+// refused: from a request it would run any command on the server.
+func parsePostSteps(list string) (map[string]bool, error) {
+	steps := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "exec" {
+			return nil, fmt.Errorf("--request-post can't allow exec: it would let any client run commands on the server")
+		}
+		if !postStepNames[name] {
+			return nil, fmt.Errorf("--request-post: unknown post-processor %q", name)
+		}
+		steps[name] = true
+	}
+	return steps, nil
+}
+
+// checkRequestPost checks the post chain a task API request asks for
+// against the steps allowed to requests.
+func checkRequestPost(spec string, allowed map[string]bool) error {
+	items, err := splitPostChain(spec)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		name, _, _ := strings.Cut(item, ":")
+		if name == "exec" {
+			return fmt.Errorf("post-processor exec can't be set by a request")
+		}
+		if !allowed[name] {
+			return fmt.Errorf("post-processor %s can't be set by a request (see --request-post)", name)
+		}
+	}
+	return nil
+}
+
+func newPostStep(name, arg string) (postStep, error) {
+	switch name {
+	case "extract-code":
+		return postStep{name, func(_ context.Context, s string) (string, error) { return extractFirstCodeBlock(s), nil }}, nil
+	case "trim-fences":
+		return postStep{name, func(_ context.Context, s string) (string, error) { return stripFences(s), nil }}, nil
+	case "trim-lines":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return postStep{}, fmt.Errorf("expected a positive line count")
+		}
+		return postStep{name, func(_ context.Context, s string) (string, error) { return trimLines(s, n), nil }}, nil
+	case "replace":
+		re, repl, err := parseReplace(arg)
+		if err != nil {
+			return postStep{}, err
+		}
+		return postStep{name, func(_ context.Context, s string) (string, error) { return re.ReplaceAllString(s, repl), nil }}, nil
+	case "exec":
+		argv, err := commandFields(arg)
+		if err != nil {
+			return postStep{}, err
+		}
+		if len(argv) == 0 {
+			return postStep{}, fmt.Errorf("missing command")
+		}
+		return postStep{name, func(ctx context.Context, s string) (string, error) { return pipeThrough(ctx, argv, s) }}, nil
+	}
+	return postStep{}, fmt.Errorf("unknown post-processor")
+}
+
+// applyPostChain runs every step over text.
+func applyPostChain(ctx context.Context, steps []postStep, text string) (string, error) {
+	for _, step := range steps {
+		out, err := step.fn(ctx, text)
+		if err != nil {
+			return "", fmt.Errorf("post-processor %s: %v", step.name, err)
+		}
+		text = out
+	}
+	return text, nil
+}
+
+// extractFirstCodeBlock returns the body of the first fenced code block, or
+// the text unchanged if there is none.
+func extractFirstCodeBlock(text string) string {
+	var body []string
+	inside := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inside {
+				return strings.Join(body, "\n")
+			}
+			inside = true
+			continue
+		}
+		if inside {
+			body = append(body, line)
+		}
+	}
+	if inside {
+		// Unterminated fence: keep what followed it.
+		return strings.Join(body, "\n")
+	}
+	return text
+}
+
+// stripFences drops the ``` fence lines but keeps everything between them.
+func stripFences(text string) string {
+	var kept []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+func trimLines(text string, n int) string {
+	lines := strings.Split(text, "\n")
+	if len(lines) <= n {
+		return text
+	}
+	return strings.Join(lines[:n], "\n")
+}
+
+// parseReplace parses sed-style /regex/replacement/; any delimiter works.
+func parseReplace(arg string) (*regexp.Regexp, string, error) {
+	if len(arg) < 3 {
+		return nil, "", fmt.Errorf("expected /regex/replacement/")
+	}
+	delim := arg[:1]
+	parts := strings.Split(strings.TrimSuffix(arg[1:], delim), delim)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("expected /regex/replacement/")
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return re, parts[1], nil
+}
+
+// pipeThrough feeds text to an external command on stdin and returns its stdout.
+func pipeThrough(ctx context.Context, argv []string, text string) (string, error) {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\n"), nil
+}
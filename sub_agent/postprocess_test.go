@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPostChain(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{"extract-code, trim-lines:20", []string{"extract-code", "trim-lines:20"}, false},
+		{"replace:/a,b/c,d/,trim-lines:2", []string{"replace:/a,b/c,d/", "trim-lines:2"}, false},
+		{"replace:|x,|y|", []string{"replace:|x,|y|"}, false},
+		{"replace:/a/exec:x/,trim-fences", []string{"replace:/a/exec:x/", "trim-fences"}, false},
+		{`exec:tr "a,b" x,trim-fences`, []string{`exec:tr "a,b" x`, "trim-fences"}, false},
+		{"exec:sed 's/,/;/g'", []string{"exec:sed 's/,/;/g'"}, false},
+		{",,trim-fences,", []string{"trim-fences"}, false},
+		{"replace:/a,b", nil, true},
+		{`exec:tr "a,b x`, nil, true},
+	} {
+		got, err := splitPostChain(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("splitPostChain(%q) error = %v, want error %v", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitPostChain(%q) = %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestCommandFields(t *testing.T) {
+	got, err := commandFields(`tr  "a, b" 'c'd` + "\tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tr", "a, b", "cd", "x"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("commandFields = %q, want %q", got, want)
+	}
+}
+
+func TestPostChainCommas(t *testing.T) {
+	steps, err := parsePostChain("replace:/a,b/c,d/,replace:|x|y|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("got %d steps, want 2", len(steps))
+	}
+	out, err := applyPostChain(context.Background(), steps, "a,b x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "c,d y" {
+		t.Fatalf("applyPostChain = %q, want %q", out, "c,d y")
+	}
+}
+
+func TestCheckRequestPost(t *testing.T) {
+	allowed := map[string]bool{"replace": true, "trim-fences": true}
+	for _, tc := range []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"replace:/a,b/c/,trim-fences", false},
+		{"replace:/a/exec:x/", false},
+		{"replace:/a/b/,exec:sh", true},
+		{"trim-fences,trim-lines:2", true},
+		{"replace:/a,b", true},
+	} {
+		if err := checkRequestPost(tc.spec, allowed); (err != nil) != tc.wantErr {
+			t.Errorf("checkRequestPost(%q) error = %v, want error %v", tc.spec, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderCheck is the outcome of one provider preflight.
+type ProviderCheck struct {
+	OK        bool      `json:"ok"`
+	LatencyMS int64     `json:"latency_ms"`
+	Detail    string    `json:"detail,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Kind      ErrorKind `json:"error_kind,omitempty"`
+}
+
+const preflightTimeout = 5 * time.Second
+
+// preflight makes the cheapest request that shows a provider is reachable
+// and accepts our credentials: Ollama's model list, Gemini's metadata for
+// its model, an OpenAI-compatible API's model list.
+func preflight(ctx context.Context, providerName, key string) ProviderCheck {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	start := time.Now()
+	var detail string
+	var err error
+	switch providerName {
+	case "", "local":
+		detail, err = preflightOllama(ctx)
+	case "cloud":
+		detail, err = preflightGemini(ctx, key)
+	case "azure-openai", "bedrock":
+		return ProviderCheck{OK: true, Detail: "no preflight for this provider; not checked"}
+	default:
+		a, ok := lookupAdapter(providerName)
+		if !ok {
+			err = kindError(ErrConfig, "unknown provider %q", providerName)
+			break
+		}
+		detail, err = preflightAdapter(ctx, providerName, a)
+	}
+	c := ProviderCheck{OK: err == nil, LatencyMS: time.Since(start).Milliseconds(), Detail: detail}
+	if err != nil {
+		c.Error, c.Kind = redactErr(err).Error(), errorKind(err)
+	}
+	return c
+}
+
+func preflightOllama(ctx context.Context) (string, error) {
+	models, err := ollamaModels(ctx, ollamaHost())
+	if err != nil {
+		return "", err
+	}
+	if want := defaultModel("local", ""); !hasOllamaModel(models, want) {
+		return fmt.Sprintf("%d models; default model %s is not pulled", len(models), want), nil
+	}
+	return fmt.Sprintf("%d models", len(models)), nil
+}
+
+// ollamaModels lists the models pulled into the Ollama at host.
+func ollamaModels(ctx context.Context, host string) ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if err := getJSON(ctx, "Ollama", host+"/api/tags", headers, &tags); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(tags.Models))
+	for i, m := range tags.Models {
+		names[i] = m.Name
+	}
+	return names, nil
+}
+
+// hasOllamaModel reports whether name is among models, where an untagged
+// name means :latest.
+func hasOllamaModel(models []string, name string) bool {
+	for _, m := range models {
+		if m == name || m == name+":latest" {
+			return true
+		}
+	}
+	return false
+}
+
+func preflightGemini(ctx context.Context, key string) (string, error) {
+	if geminiConfig().Vertex {
+		// Getting an ADC token is the part that fails when Vertex is misconfigured.
+		if _, _, err := vertexEndpoint(ctx, geminiConfig(), ""); err != nil {
+			return "", err
+		}
+		return "Vertex AI credentials", nil
+	}
+	key, err := geminiKey(key)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var, or GOOGLE_GENAI_USE_VERTEXAI=true to use Vertex AI")
+	}
+	var model struct {
+		Name string `json:"name"`
+	}
+	url := strings.TrimSuffix(GeminiBaseURL, ":generateContent") + "?key=" + key
+	if err := getJSON(ctx, "Gemini API", url, nil, &model); err != nil {
+		return "", err
+	}
+	return model.Name, nil
+}
+
+func preflightAdapter(ctx context.Context, name string, a OpenAICompatibleProvider) (string, error) {
+	models, err := adapterModels(ctx, name, a)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d models", len(models)), nil
+}
+
+// adapterModels lists the models an OpenAI-compatible API offers.
+func adapterModels(ctx context.Context, name string, a OpenAICompatibleProvider) ([]string, error) {
+	headers, err := a.headers(name)
+	if err != nil {
+		return nil, err
+	}
+	var models struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, name, strings.TrimSuffix(a.BaseURL, "/")+"/models", headers, &models); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(models.Data))
+	for i, m := range models.Data {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+func getJSON(ctx context.Context, name, url string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("building %s request: %v", name, err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return kindError(ErrUnreachable, "connecting to %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return providerError(name, resp, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("parsing %s response: %v", name, err)
+	}
+	return nil
+}
+
+// configuredProviders are the providers this install is set up for:
+// local, cloud when Gemini credentials are present, Azure OpenAI when it
+// has an endpoint, and each openai_compatible entry.
+func configuredProviders(key string) []string {
+	names := []string{"local"}
+	if k, _ := geminiKey(key); k != "" || geminiConfig().Vertex {
+		names = append(names, "cloud")
+	}
+	if liveConfig().AzureOpenAI.Endpoint != "" {
+		names = append(names, "azure-openai")
+	}
+	var adapters []string
+	for name := range liveConfig().OpenAICompatible {
+		adapters = append(adapters, name)
+	}
+	sort.Strings(adapters)
+	return append(names, adapters...)
+}
+
+// readinessTTL is how long /readyz reuses a preflight, so frequent probes
+// from load balancers don't each reach every provider.
+const readinessTTL = 10 * time.Second
+
+// readiness runs and caches the preflights behind /readyz.
+type readiness struct {
+	providers []string
+	key       string
+
+	mu      sync.Mutex
+	checked time.Time
+	last    map[string]ProviderCheck
+}
+
+// check returns each provider's status and whether all are up.
+func (rd *readiness) check(ctx context.Context) (map[string]ProviderCheck, bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.last == nil || time.Since(rd.checked) > readinessTTL {
+		results := make([]ProviderCheck, len(rd.providers))
+		var wg sync.WaitGroup
+		for i, p := range rd.providers {
+			wg.Add(1)
+			go func(i int, p string) {
+				defer wg.Done()
+				results[i] = preflight(ctx, p, rd.key)
+			}(i, p)
+		}
+		wg.Wait()
+		rd.last = map[string]ProviderCheck{}
+		for i, p := range rd.providers {
+			rd.last[p] = results[i]
+		}
+		rd.checked = time.Now()
+	}
+	ok := true
+	for _, c := range rd.last {
+		ok = ok && c.OK
+	}
+	return rd.last, ok
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Task statuses reported by GET /v1/tasks/{id}.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+	StatusRequeued  = "requeued" // cut off by shutdown and spooled to the queue
+	// StatusAwaitingApproval is a plan or a dangerous command waiting for
+	// POST /v1/tasks/{id}/approve or /reject.
+	StatusAwaitingApproval = "awaiting_approval"
+)
+
+// TaskProgress is a snapshot of a task, as GET /v1/tasks/{id} and the
+// heartbeat lines report it. Tokens counts output and thinking tokens:
+// those of finished calls plus an estimate for an answer still streaming.
+// Result is set once an async task has finished.
+type TaskProgress struct {
+	ID           string      `json:"id"`
+	Status       string      `json:"status"`
+	Stage        string      `json:"stage"`
+	Step         int         `json:"step,omitempty"` // current tool or plan step, from 1
+	Calls        int         `json:"calls"`
+	Tokens       int         `json:"tokens"`
+	Started      time.Time   `json:"started"`
+	LastActivity time.Time   `json:"last_activity"`
+	ElapsedMS    int64       `json:"elapsed_ms"`
+	Result       *TaskResult `json:"result,omitempty"`
+	// Plan and Tools are what awaits approval, while it does.
+	Plan  *Plan    `json:"plan,omitempty"`
+	Tools []string `json:"tools,omitempty"`
+	// Command is the dangerous command awaiting confirmation, while it does.
+	Command *CommandReview `json:"command,omitempty"`
+}
+
+// progressTracker follows one run. A stage change, a step, a finished call
+// or streamed text all count as activity, so a caller can tell a slow task
+// (recent activity) from a stuck one.
+type progressTracker struct {
+	tenant string
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	p         TaskProgress
+	streamed  int // tokens of the call in flight
+	cancelled bool
+	finished  time.Time
+	decision  chan bool // set while a plan or command awaits approval
+}
+
+func newProgressTracker(id, tenant string) *progressTracker {
+	now := time.Now()
+	return &progressTracker{tenant: tenant, p: TaskProgress{ID: id, Status: StatusRunning, Stage: "starting", Started: now, LastActivity: now}}
+}
+
+type progressKey struct{}
+
+// withProgress attaches a tracker for the run under ctx.
+func withProgress(ctx context.Context, t *progressTracker) context.Context {
+	return context.WithValue(ctx, progressKey{}, t)
+}
+
+func progressFrom(ctx context.Context) *progressTracker {
+	t, _ := ctx.Value(progressKey{}).(*progressTracker)
+	return t
+}
+
+func (t *progressTracker) update(fn func(p *TaskProgress)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(&t.p)
+	t.p.LastActivity = time.Now()
+}
+
+// setStage records the stage the run under ctx has reached.
+func setStage(ctx context.Context, stage string) {
+	progressFrom(ctx).update(func(p *TaskProgress) { p.Stage, p.Step = stage, 0 })
+}
+
+// setStep records the tool or plan step the run under ctx is on.
+func setStep(ctx context.Context, step int) {
+	progressFrom(ctx).update(func(p *TaskProgress) { p.Step = step })
+}
+
+// streaming records the estimated tokens streamed so far by the call in flight.
+func (t *progressTracker) streaming(tokens int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.streamed = tokens
+	t.p.LastActivity = time.Now()
+}
+
+// callDone counts a finished call, whose reported usage replaces the
+// streaming estimate.
+func (t *progressTracker) callDone(u Usage) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Calls++
+	t.p.Tokens += u.OutputTokens + u.ThinkingTokens
+	t.streamed = 0
+	t.p.LastActivity = time.Now()
+}
+
+// stop cancels a running task. It returns false if the task has finished.
+func (t *progressTracker) stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.p.Status != StatusRunning && t.p.Status != StatusAwaitingApproval {
+		return false
+	}
+	t.cancelled = true
+	t.cancel()
+	return true
+}
+
+// awaitApproval is the planApprover of a served task: the plan is shown
+// by GET /v1/tasks/{id} until decide is called or the task is cancelled.
+func (t *progressTracker) awaitApproval(ctx context.Context, plan *Plan, tools []string) (bool, error) {
+	return t.await(ctx, func(p *TaskProgress) { p.Plan, p.Tools = plan, tools })
+}
+
+// confirmCommand is the commandConfirmer of a served task, which works
+// the same way.
+func (t *progressTracker) confirmCommand(ctx context.Context, review CommandReview) (bool, error) {
+	return t.await(ctx, func(p *TaskProgress) { p.Command = &review })
+}
+
+// await shows what show sets until decide is called.
+func (t *progressTracker) await(ctx context.Context, show func(p *TaskProgress)) (bool, error) {
+	decision := make(chan bool, 1)
+	t.mu.Lock()
+	stage := t.p.Stage
+	t.p.Status, t.p.Stage = StatusAwaitingApproval, "approval"
+	show(&t.p)
+	t.p.LastActivity = time.Now()
+	t.decision = decision
+	t.mu.Unlock()
+	defer t.update(func(p *TaskProgress) {
+		p.Status, p.Stage, p.Plan, p.Tools, p.Command = StatusRunning, stage, nil, nil, nil
+	})
+	select {
+	case ok := <-decision:
+		return ok, nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		t.decision = nil
+		t.mu.Unlock()
+		return false, ctx.Err()
+	}
+}
+
+// decide answers a pending approval. It returns false if none is pending.
+func (t *progressTracker) decide(approve bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.decision == nil {
+		return false
+	}
+	t.decision <- approve
+	t.decision = nil
+	return true
+}
+
+func (t *progressTracker) wasCancelled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancelled
+}
+
+// complete records the outcome of a finished task.
+func (t *progressTracker) complete(status string, res *TaskResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Status, t.p.Result = status, res
+	t.p.Stage, t.p.Step = "done", 0
+	t.streamed = 0
+	t.finished = time.Now()
+	t.p.LastActivity = t.finished
+}
+
+func (t *progressTracker) snapshot() TaskProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.p
+	p.Tokens += t.streamed
+	end := time.Now()
+	if !t.finished.IsZero() {
+		end = t.finished
+	}
+	p.ElapsedMS = end.Sub(p.Started).Milliseconds()
+	return p
+}
+
+// taskRegistry holds the trackers of the tasks a server or worker is
+// running, and of finished async tasks until they expire.
+type taskRegistry struct {
+	keep time.Duration // how long finished tasks are kept
+
+	mu    sync.Mutex
+	tasks map[string]*progressTracker
+}
+
+func newTaskRegistry(keep time.Duration) *taskRegistry {
+	return &taskRegistry{keep: keep, tasks: map[string]*progressTracker{}}
+}
+
+// start registers a task and returns ctx carrying its tracker; cancelling
+// the tracker cancels ctx.
+func (g *taskRegistry) start(ctx context.Context, id, tenant string) (context.Context, *progressTracker) {
+	t := newProgressTracker(id, tenant)
+	ctx, t.cancel = context.WithCancel(ctx)
+	g.mu.Lock()
+	g.expire()
+	g.tasks[id] = t
+	g.mu.Unlock()
+	return withProgress(ctx, t), t
+}
+
+// has reports whether id is running or kept.
+func (g *taskRegistry) has(id string) bool {
+	return g.get(id) != nil
+}
+
+// expire drops finished tasks older than g.keep. g.mu must be held.
+func (g *taskRegistry) expire() {
+	for id, t := range g.tasks {
+		t.mu.Lock()
+		old := !t.finished.IsZero() && time.Since(t.finished) > g.keep
+		t.mu.Unlock()
+		if old {
+			delete(g.tasks, id)
+		}
+	}
+}
+
+// finish forgets t, unless a later task with the same ID replaced it.
+func (g *taskRegistry) finish(t *progressTracker) {
+	t.cancel()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.tasks[t.p.ID] == t {
+		delete(g.tasks, t.p.ID)
+	}
+}
+
+func (g *taskRegistry) get(id string) *progressTracker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire()
+	return g.tasks[id]
+}
+
+// running returns snapshots of the tasks still running.
+func (g *taskRegistry) running() []TaskProgress {
+	g.mu.Lock()
+	trackers := make([]*progressTracker, 0, len(g.tasks))
+	for _, t := range g.tasks {
+		trackers = append(trackers, t)
+	}
+	g.mu.Unlock()
+	var out []TaskProgress
+	for _, t := range trackers {
+		if p := t.snapshot(); p.Status == StatusRunning || p.Status == StatusAwaitingApproval {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// heartbeat prints the progress of every running task each interval until
+// ctx is done. every <= 0 disables it.
+func (g *taskRegistry) heartbeat(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for _, p := range g.running() {
+			fmt.Printf("[Sub-Agent] %s\n", p.line())
+		}
+	}
+}
+
+// line formats p for a heartbeat.
+func (p TaskProgress) line() string {
+	stage := p.Stage
+	if p.Step > 0 {
+		stage = fmt.Sprintf("%s step %d", p.Stage, p.Step)
+	}
+	idle := time.Since(p.LastActivity).Round(time.Second)
+	return fmt.Sprintf("Task %s: %s, %d tokens over %d call(s), %s elapsed, last activity %s ago",
+		p.ID, stage, p.Tokens, p.Calls, (time.Duration(p.ElapsedMS) * time.Millisecond).Round(time.Second), idle)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+)
+
+// PromptAdapter dresses a prompt for a model family: instructions the
+// family needs to answer cleanly, the stop tokens it ends turns with and,
+// for raw completion, its chat template.
+type PromptAdapter struct {
+	Prefix string   `json:"prefix,omitempty"` // put before the prompt
+	Suffix string   `json:"suffix,omitempty"` // put after it, e.g. "no preamble" instructions
+	Stop   []string `json:"stop,omitempty"`   // added to every call's stop sequences
+	// Template is a chat template with {prompt} where the prompt goes. Ollama
+	// is then sent the rendered text raw, bypassing the model's own template.
+	Template string `json:"template,omitempty"`
+}
+
+const noPreamble = "\n\nStart with the answer itself: no preamble such as \"Sure\" or \"Certainly\", and don't restate the question."
+
+// builtinPromptAdapters maps model name prefixes to their adapters; as in
+// the model registry the longest prefix wins, and entries in the config's
+// "prompt_adapters" section replace these (an empty entry disables one).
+var builtinPromptAdapters = map[string]PromptAdapter{
+	// DeepSeek recommends putting every instruction in the user turn and
+	// no system prompt, which is how helix already sends it; extra
+	// instructions only make R1 reason about them.
+	"deepseek-r1": {Stop: []string{"<｜end▁of▁sentence｜>"}},
+	"llama3":      {Suffix: noPreamble, Stop: []string{"<|eot_id|>", "<|end_of_text|>"}},
+	"llama-3":     {Suffix: noPreamble, Stop: []string{"<|eot_id|>", "<|end_of_text|>"}},
+	"gemini":      {Suffix: noPreamble},
+	// Claude follows instructions best when they are set apart in tags.
+	"claude":           {Prefix: "<task>\n", Suffix: "\n</task>" + noPreamble},
+	"anthropic.claude": {Prefix: "<task>\n", Suffix: "\n</task>" + noPreamble},
+}
+
+// lookupPromptAdapter returns the adapter for a provider/model. Aggregator
+// names such as meta-llama/llama-3.3-70b and Bedrock's cross-region IDs
+// such as us.anthropic.claude-... are matched without their prefix too.
+func lookupPromptAdapter(providerName, modelName string) (PromptAdapter, bool) {
+	name := strings.ToLower(registryName(providerName, defaultModel(providerName, modelName)))
+	names := []string{name}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		names = append(names, name[i+1:])
+	}
+	if region, rest, ok := strings.Cut(name, "."); ok && len(region) <= 4 && strings.Contains(rest, ".") {
+		names = append(names, rest)
+	}
+	entries := make(map[string]PromptAdapter, len(builtinPromptAdapters)+len(config.PromptAdapters))
+	for k, v := range builtinPromptAdapters {
+		entries[k] = v
+	}
+	for k, v := range config.PromptAdapters {
+		entries[k] = v
+	}
+	best := ""
+	var adapter PromptAdapter
+	for prefix, a := range entries {
+		for _, n := range names {
+			if strings.HasPrefix(n, prefix) && len(prefix) > len(best) {
+				best, adapter = prefix, a
+			}
+		}
+	}
+	return adapter, best != ""
+}
+
+// adaptPrompt applies g's model's prompt adapter.
+func adaptPrompt(g genRequest) genRequest {
+	a, ok := lookupPromptAdapter(g.Provider, g.Model)
+	if !ok {
+		return g
+	}
+	g.Prompt = a.Prefix + g.Prompt + a.Suffix
+	if len(a.Stop) > 0 {
+		g.Stop = append(append([]string(nil), g.Stop...), a.Stop...)
+	}
+	if a.Template != "" && (g.Provider == "" || g.Provider == "local") {
+		g.Prompt, g.raw = strings.ReplaceAll(a.Template, "{prompt}", g.Prompt), true
+	}
+	return g
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Prompt sections, in the order assemblePrompt joins them. The order is
+// fixed, whatever order the stages that fill them in run, so the same
+// inputs always give the same prompt: audits can compare prompts and
+// hashes of them make stable cache keys. The locale section holds the
+// current time, so it is kept apart from the system instructions and
+// changes from minute to minute; the others don't. Empty sections are
+// left out.
+const (
+	SectionSystem      = "system"      // style, language and length instructions
+	SectionLocale      = "locale"      // the user's locale and the time there
+	SectionMemory      = "memory"      // memories recalled for --memory
+	SectionKnowledge   = "knowledge"   // excerpts retrieved from --kb
+	SectionExamples    = "examples"    // --examples
+	SectionTask        = "task"        // the task itself
+	SectionAttachments = "attachments" // piped input, then --context files
+)
+
+var promptOrder = []string{SectionSystem, SectionLocale, SectionMemory, SectionKnowledge, SectionExamples, SectionTask, SectionAttachments}
+
+// PromptSection is one section of an assembled prompt, as --dry-run
+// reports it.
+type PromptSection struct {
+	Name   string `json:"name"`
+	Tokens int    `json:"tokens"`
+	SHA256 string `json:"sha256"`
+}
+
+// attach appends an attachment block to the task, noting where the
+// attachments start.
+func (req *TaskRequest) attach(block string) {
+	if req.attachAt == 0 {
+		req.attachAt = len(req.Task) + 1
+	}
+	req.Task += "\n\n" + block
+}
+
+// promptPart is the text of one prompt section.
+type promptPart struct {
+	name, text string
+}
+
+// promptParts gathers the sections of req's prompt in promptOrder.
+func (r *runner) promptParts(ctx context.Context, req TaskRequest) ([]promptPart, error) {
+	task, attachments := req.Task, ""
+	if req.attachAt > 0 && req.attachAt <= len(req.Task)+1 {
+		task, attachments = req.Task[:req.attachAt-1], strings.TrimPrefix(req.Task[req.attachAt-1:], "\n\n")
+	}
+	var system []string
+	if style := r.styleFor(req); style != "" {
+		p, err := lookupStyle(style)
+		if err != nil {
+			return nil, kindError(ErrConfig, "%v", err)
+		}
+		system = append(system, p.instruction())
+	}
+	if lang := r.langFor(req); lang != "" {
+		system = append(system, languageInstruction(lang))
+	}
+	if req.LengthEnforce != "" && !validLengthEnforce(req.LengthEnforce) {
+		return nil, kindError(ErrConfig, "invalid length_enforce %q: expected truncate or condense", req.LengthEnforce)
+	}
+	if l := r.lengthFor(req); l.set() {
+		system = append(system, l.instruction())
+	}
+	text := map[string]string{
+		SectionSystem:      strings.Join(system, "\n\n"),
+		SectionKnowledge:   strings.TrimSpace(req.Knowledge),
+		SectionTask:        task,
+		SectionAttachments: attachments,
+	}
+	if lc := r.localeFor(req); lc.on {
+		locale, err := lc.instruction(time.Now())
+		if err != nil {
+			return nil, kindError(ErrConfig, "%v", err)
+		}
+		text[SectionLocale] = locale
+	}
+	if r.memory != nil {
+		text[SectionMemory] = strings.TrimSpace(r.memory.recall(ctx, req.Task))
+	}
+	if spec := r.examplesFor(req); spec != "" {
+		examples, n, err := exampleBlock(spec)
+		if err != nil {
+			return nil, kindError(ErrConfig, "%v", err)
+		}
+		if n > 0 {
+			logf(ctx, "Added %d example(s) from %s", n, spec)
+			text[SectionExamples] = examples
+			text[SectionTask] = "Now the actual task:\n" + task
+		}
+	}
+	var parts []promptPart
+	for _, name := range promptOrder {
+		if text[name] != "" {
+			parts = append(parts, promptPart{name, text[name]})
+		}
+	}
+	return parts, nil
+}
+
+// joinPrompt joins parts into the prompt and hashes each of them.
+func joinPrompt(parts []promptPart) (string, []PromptSection) {
+	texts := make([]string, len(parts))
+	sections := make([]PromptSection, len(parts))
+	for i, p := range parts {
+		texts[i] = p.text
+		sections[i] = PromptSection{Name: p.name, Tokens: estimateTokens(p.text), SHA256: sha256Hex(p.text)}
+	}
+	return strings.Join(texts, "\n\n"), sections
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --provenance modes: how generated files record the run that wrote them.
+const (
+	ProvenanceOff     = "off"
+	ProvenanceComment = "comment" // a trailing comment; a sidecar for files without comments
+	ProvenanceSidecar = "sidecar" // <file>.provenance.json next to the file
+)
+
+// Provenance identifies the run that produced a result or a file.
+type Provenance struct {
+	RunID     string    `json:"run_id"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model,omitempty"`
+	Generated time.Time `json:"generated"`
+	Version   string    `json:"helix_version"`
+}
+
+const provenanceSidecarExt = ".provenance.json"
+
+func validProvenance(mode string) bool {
+	switch mode {
+	case ProvenanceOff, ProvenanceComment, ProvenanceSidecar:
+		return true
+	}
+	return false
+}
+
+// commentSyntax is the line comment of a file type, by extension; an empty
+// end means the comment runs to the end of the line.
+var commentSyntax = map[string][2]string{}
+
+func init() {
+	for syntax, exts := range map[[2]string][]string{
+		{"<!--", "-->"}: {".html", ".htm", ".md", ".markdown", ".xml", ".svg", ".vue"},
+		{"//", ""}:      {".go", ".js", ".mjs", ".ts", ".jsx", ".tsx", ".java", ".c", ".h", ".cc", ".cpp", ".hpp", ".cs", ".rs", ".swift", ".kt", ".scala", ".php", ".dart", ".proto"},
+		{"#", ""}:       {".py", ".sh", ".bash", ".zsh", ".rb", ".pl", ".yaml", ".yml", ".toml", ".r", ".tf", ".conf", ".dockerfile"},
+		{"/*", "*/"}:    {".css", ".scss", ".less"},
+		{"--", ""}:      {".sql", ".lua", ".hs"},
+	} {
+		for _, ext := range exts {
+			commentSyntax[ext] = syntax
+		}
+	}
+}
+
+// provenanceLineRe matches a trailer written by stamp, so that a file a
+// later run rewrites unchanged isn't taken for changed.
+var provenanceLineRe = regexp.MustCompile(`\n?[^\n]*helix-provenance: \{[^\n]*\}[^\n]*\n?$`)
+
+// stripProvenance removes a trailing provenance comment.
+func stripProvenance(content string) string {
+	return provenanceLineRe.ReplaceAllString(content, "")
+}
+
+// stamp adds p to content as a trailing comment for path's type. ok is
+// false when the type has no comments, for a sidecar instead.
+func (p *Provenance) stamp(path, content string) (stamped string, ok bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" && strings.EqualFold(filepath.Base(path), "Dockerfile") {
+		ext = ".dockerfile"
+	}
+	syntax, ok := commentSyntax[ext]
+	if !ok {
+		return content, false
+	}
+	data, _ := json.Marshal(p)
+	line := syntax[0] + " helix-provenance: " + string(data)
+	if syntax[1] != "" {
+		line += " " + syntax[1]
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + line + "\n", true
+}
+
+// sidecar writes p next to path.
+func (p *Provenance) sidecar(path string) error {
+	data, _ := json.MarshalIndent(p, "", "  ")
+	if err := writeFileAtomic(path+provenanceSidecarExt, append(data, '\n')); err != nil {
+		return fmt.Errorf("writing provenance of %s: %v", path, err)
+	}
+	return nil
+}
+
+// usesSidecar reports whether mode records path's provenance in a sidecar.
+func usesSidecar(mode, path string) bool {
+	switch mode {
+	case ProvenanceSidecar:
+		return true
+	case ProvenanceComment:
+		_, ok := (&Provenance{}).stamp(path, "")
+		return !ok
+	}
+	return false
+}
+
+// mark records p for the file at path with the given content under mode;
+// it returns the content to write.
+func (p *Provenance) mark(mode, path, content string) (string, error) {
+	if p == nil || mode == ProvenanceOff || mode == "" {
+		return content, nil
+	}
+	if mode == ProvenanceComment {
+		if stamped, ok := p.stamp(path, content); ok {
+			return stamped, nil
+		}
+	}
+	return content, p.sidecar(path)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientTLSConfig is the client certificate helix presents to a provider,
+// for self-hosted gateways that require mutual TLS. The files are read
+// again when they change, so rotated certificates are picked up without a
+// restart.
+type ClientTLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile is the PEM root the gateway's certificate must chain to, in
+	// place of the system's and network.ca_files.
+	CAFile string `json:"ca_file,omitempty"`
+	// ServerName is the name expected in the gateway's certificate when it
+	// isn't the host in the URL.
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// SigningConfig signs a provider's requests with HMAC-SHA256. The
+// signature is the hex HMAC under Key of
+//
+//	<unix seconds>\n<method>\n<path and query>\n<hex SHA-256 of the body>
+//
+// sent in Header, with the timestamp in X-Signature-Timestamp and KeyID,
+// if set, in X-Signature-Key-Id.
+type SigningConfig struct {
+	Key    string `json:"key"`              // may be a secret reference
+	KeyID  string `json:"key_id,omitempty"` // lets the gateway rotate keys
+	Header string `json:"header,omitempty"` // default X-Signature
+}
+
+// providerTransport sends each provider's requests through its own
+// transport, and everything else through fallback.
+type providerTransport struct {
+	fallback http.RoundTripper
+	routes   []providerRoundTripper
+}
+
+type providerRoundTripper struct {
+	provider string
+	rt       http.RoundTripper
+}
+
+func (t *providerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	for _, r := range t.routes {
+		if providerOwnsHost(r.provider, host) {
+			return r.rt.RoundTrip(req)
+		}
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// providerTransports builds the transports of the providers with client
+// certificates or signing keys from base, nil if there are none.
+func providerTransports(base *http.Transport, c NetworkConfig) (http.RoundTripper, error) {
+	seen := map[string]bool{}
+	for name := range c.ClientTLS {
+		seen[name] = true
+	}
+	for name := range c.Signing {
+		seen[name] = true
+	}
+	if len(seen) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pt := &providerTransport{fallback: base}
+	for _, name := range names {
+		if !knownProvider(name) {
+			field := "signing"
+			if _, ok := c.ClientTLS[name]; ok {
+				field = "client_tls"
+			}
+			return nil, fmt.Errorf("network.%s: unknown provider %q", field, name)
+		}
+		var rt http.RoundTripper = base
+		if ct, ok := c.ClientTLS[name]; ok {
+			cfg, err := ct.tlsConfig(base.TLSClientConfig)
+			if err != nil {
+				return nil, fmt.Errorf("network.client_tls.%s: %v", name, err)
+			}
+			t := base.Clone()
+			t.TLSClientConfig = cfg
+			rt = t
+		}
+		if s, ok := c.Signing[name]; ok {
+			if s.Key == "" {
+				return nil, fmt.Errorf("network.signing.%s: key is required", name)
+			}
+			header := s.Header
+			if header == "" {
+				header = "X-Signature"
+			}
+			rt = &signingTransport{base: rt, key: s.Key, keyID: s.KeyID, header: header}
+		}
+		pt.routes = append(pt.routes, providerRoundTripper{name, rt})
+	}
+	return pt, nil
+}
+
+// tlsConfig returns the TLS config presenting c's certificate, starting
+// from shared (network.ca_files), which may be nil.
+func (c ClientTLSConfig) tlsConfig(shared *tls.Config) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file are required")
+	}
+	cl := &certLoader{certFile: c.CertFile, keyFile: c.KeyFile}
+	if _, err := cl.load(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if shared != nil {
+		cfg = shared.Clone()
+	}
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cl.load()
+	}
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("CA file %s holds no PEM certificate", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	cfg.ServerName = c.ServerName
+	return cfg, nil
+}
+
+// certLoader reads a certificate and key pair, again whenever either file
+// changes.
+type certLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime [2]time.Time
+}
+
+func (l *certLoader) load() (*tls.Certificate, error) {
+	var mod [2]time.Time
+	for i, f := range []string{l.certFile, l.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		mod[i] = fi.ModTime()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cert != nil && mod == l.modTime {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			// Mid-rotation one file may be new and the other old.
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("loading client certificate: %v", err)
+	}
+	l.cert, l.modTime = &cert, mod
+	return l.cert, nil
+}
+
+// signingTransport adds an HMAC signature (see SigningConfig) to every
+// request.
+type signingTransport struct {
+	base   http.RoundTripper
+	key    string // or a secret reference, resolved on first use
+	keyID  string
+	header string
+
+	mu       sync.Mutex
+	resolved string
+}
+
+func (t *signingTransport) secret() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resolved == "" {
+		v, err := resolveSecretValue(t.key)
+		if err != nil {
+			return "", fmt.Errorf("resolving the signing key: %v", err)
+		}
+		t.resolved = v
+	}
+	return t.resolved, nil
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := t.secret()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	req = req.Clone(req.Context())
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", ts, req.Method, req.URL.RequestURI(), hex.EncodeToString(bodySum[:]))
+	req.Header.Set("X-Signature-Timestamp", ts)
+	req.Header.Set(t.header, hex.EncodeToString(mac.Sum(nil)))
+	if t.keyID != "" {
+		req.Header.Set("X-Signature-Key-Id", t.keyID)
+	}
+	return t.base.RoundTrip(req)
+}
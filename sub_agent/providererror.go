@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// providerError is the error for a non-200 response from name: the message
+// the provider put in its JSON error body rather than the body itself, and
+// a kind that goes by the error code where the status alone misleads, as
+// with Gemini's 400 for a bad API key.
+func providerError(name string, resp *http.Response, body []byte) error {
+	msg, code := parseErrorBody(body)
+	if t := resp.Header.Get("X-Amzn-Errortype"); code == "" && t != "" {
+		// Bedrock, as in ValidationException:http://internal.amazon.com/...
+		code, _, _ = strings.Cut(t, ":")
+	}
+	kind := statusKind(resp.StatusCode)
+	if k := errorCodeKind(code, msg); k != "" {
+		kind = k
+	}
+	if msg == "" {
+		msg = truncateRunes(strings.Join(strings.Fields(string(body)), " "), 300)
+	}
+	if code != "" && !strings.Contains(msg, code) {
+		msg += " (" + code + ")"
+	}
+	var retry time.Duration
+	if kind == ErrRateLimited {
+		var quota string
+		retry, quota = parseRateLimit(resp.Header, body)
+		if quota != "" {
+			msg += " [quota " + quota + "]"
+		}
+	}
+	err := fmt.Errorf("%s returned status: %s", name, resp.Status)
+	if msg != "" {
+		err = fmt.Errorf("%s returned status: %s: %s", name, resp.Status, msg)
+	}
+	return &TaskError{Kind: kind, Err: err, RetryAfter: retry}
+}
+
+// parseRateLimit reads what a rate-limited response says of when to come
+// back: Gemini's RetryInfo and QuotaFailure details, else the Retry-After
+// (or Azure and OpenAI's retry-after-ms) header.
+func parseRateLimit(h http.Header, body []byte) (retry time.Duration, quota string) {
+	var e struct {
+		Error struct {
+			Details []struct {
+				RetryDelay string `json:"retryDelay"`
+				Violations []struct {
+					QuotaID string `json:"quotaId"`
+				} `json:"violations"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil {
+		for _, d := range e.Error.Details {
+			if t, err := time.ParseDuration(d.RetryDelay); err == nil {
+				retry = t
+			}
+			for _, v := range d.Violations {
+				if v.QuotaID != "" {
+					quota = v.QuotaID
+				}
+			}
+		}
+	}
+	if retry > 0 {
+		return retry, quota
+	}
+	if ms, err := strconv.Atoi(h.Get("Retry-After-Ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond, quota
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second, quota
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(time.Until(t), 0), quota
+		}
+	}
+	return 0, quota
+}
+
+// retryAfter is how long the provider that rate-limited err asked callers
+// to wait, or 0 if it didn't say.
+func retryAfter(err error) time.Duration {
+	var te *TaskError
+	for errors.As(err, &te) {
+		if te.RetryAfter > 0 {
+			return te.RetryAfter
+		}
+		err = te.Err
+	}
+	return 0
+}
+
+// parseErrorBody reads the error bodies of the providers helix talks to:
+//
+//	{"error": "model \"x\" not found, try pulling it first"}               Ollama
+//	{"error": {"code": 400, "message": "...", "status": "INVALID_ARGUMENT",
+//	  "details": [{"reason": "API_KEY_INVALID"}]}}                        Gemini
+//	{"error": {"message": "...", "type": "...", "code": "invalid_api_key"}} OpenAI
+//	{"message": "..."}                                                    Bedrock
+//
+// code is the most specific machine-readable code among them.
+func parseErrorBody(body []byte) (msg, code string) {
+	var e struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+		Type    string          `json:"__type"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return "", ""
+	}
+	msg, code = e.Message, e.Type
+	var s string
+	if json.Unmarshal(e.Error, &s) == nil {
+		return s, code
+	}
+	var o struct {
+		Message string          `json:"message"`
+		Code    json.RawMessage `json:"code"` // a number on Gemini
+		Status  string          `json:"status"`
+		Type    string          `json:"type"`
+		Details []struct {
+			Reason string `json:"reason"`
+		} `json:"details"`
+	}
+	if json.Unmarshal(e.Error, &o) != nil {
+		return msg, code
+	}
+	if o.Message != "" {
+		msg = o.Message
+	}
+	var c string
+	json.Unmarshal(o.Code, &c)
+	for _, v := range []string{o.Status, o.Type, c} {
+		if v != "" {
+			code = v
+		}
+	}
+	for _, d := range o.Details {
+		if d.Reason != "" {
+			code = d.Reason
+		}
+	}
+	return msg, code
+}
+
+// errorCodeKind classifies a provider's error code, or its message where it
+// has none; "" leaves it to the status.
+func errorCodeKind(code, msg string) ErrorKind {
+	switch code {
+	case "API_KEY_INVALID", "UNAUTHENTICATED", "PERMISSION_DENIED", "invalid_api_key",
+		"AccessDeniedException", "UnrecognizedClientException", "ExpiredTokenException":
+		return ErrAuth
+	case "RESOURCE_EXHAUSTED", "insufficient_quota", "rate_limit_exceeded",
+		"ThrottlingException", "ServiceQuotaExceededException":
+		return ErrRateLimited
+	case "model_not_found", "ResourceNotFoundException":
+		return ErrConfig
+	}
+	m := strings.ToLower(msg)
+	switch {
+	case strings.Contains(m, "api key not valid"), strings.Contains(m, "invalid api key"), strings.Contains(m, "incorrect api key"):
+		return ErrAuth
+	case strings.Contains(m, "quota"):
+		return ErrRateLimited
+	case strings.Contains(m, "model") && strings.Contains(m, "not found"):
+		// A model that isn't pulled or doesn't exist; retrying won't help.
+		return ErrConfig
+	}
+	return ""
+}
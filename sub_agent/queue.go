@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// taskQueue is a directory-backed queue shared by serve and worker modes.
+// Tasks move pending/ -> running/ -> done/ via renames, so several workers can
+// share one directory (e.g. a mounted volume) without extra coordination.
+// A file in cancel/ is a tombstone: the task is dropped if pending and
+// stopped by whichever worker runs it.
+type taskQueue struct {
+	dir string
+}
+
+func openQueue(dir string) (*taskQueue, error) {
+	for _, sub := range []string{"pending", "running", "done", "cancel"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("creating queue directory: %v", err)
+		}
+	}
+	return &taskQueue{dir: dir}, nil
+}
+
+func (q *taskQueue) path(state, id string) string {
+	return filepath.Join(q.dir, state, id+".json")
+}
+
+// enqueue persists a task into pending/, assigning an ID if it has none.
+func (q *taskQueue) enqueue(req TaskRequest) (string, error) {
+	if req.ID == "" {
+		req.ID = newID()
+	}
+	if !runIDRe.MatchString(req.ID) {
+		return "", fmt.Errorf("invalid task ID %q", req.ID)
+	}
+	data, err := json.Marshal(req)
+	if err == nil {
+		data, err = sealAtRest(data)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(q.path("pending", req.ID), data); err != nil {
+		return "", fmt.Errorf("enqueueing task %s: %v", req.ID, err)
+	}
+	return req.ID, nil
+}
+
+// pendingTask is a pending entry, ordered by priority and then age.
+type pendingTask struct {
+	id       string
+	priority int
+	mod      time.Time
+}
+
+// pending lists pending/ highest priority first, oldest first within a
+// priority. Entries that can't be read sort last; claim reports them.
+func (q *taskQueue) pending() ([]pendingTask, error) {
+	entries, err := os.ReadDir(filepath.Join(q.dir, "pending"))
+	if err != nil {
+		return nil, fmt.Errorf("reading queue: %v", err)
+	}
+	var tasks []pendingTask
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		t := pendingTask{id: strings.TrimSuffix(e.Name(), ".json"), priority: math.MinInt}
+		if info, err := e.Info(); err == nil {
+			t.mod = info.ModTime()
+		}
+		var req struct {
+			Priority int `json:"priority"`
+		}
+		if data, err := readAtRest(q.path("pending", t.id)); err == nil && json.Unmarshal(data, &req) == nil {
+			t.priority = req.Priority
+		}
+		tasks = append(tasks, t)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if tasks[i].priority != tasks[j].priority {
+			return tasks[i].priority > tasks[j].priority
+		}
+		if !tasks[i].mod.Equal(tasks[j].mod) {
+			return tasks[i].mod.Before(tasks[j].mod)
+		}
+		return tasks[i].id < tasks[j].id
+	})
+	return tasks, nil
+}
+
+// topPriority returns the priority of the next task claim would take.
+func (q *taskQueue) topPriority() (priority int, ok bool) {
+	tasks, err := q.pending()
+	if err != nil || len(tasks) == 0 {
+		return 0, false
+	}
+	return tasks[0].priority, true
+}
+
+// claim moves the highest-priority pending task, the oldest among equals,
+// into running/. It returns nil when the queue is empty. Losing a rename
+// race to another worker is not an error.
+func (q *taskQueue) claim() (*TaskRequest, error) {
+	tasks, err := q.pending()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tasks {
+		id := t.id
+		if err := os.Rename(q.path("pending", id), q.path("running", id)); err != nil {
+			continue
+		}
+		data, err := readAtRest(q.path("running", id))
+		if err != nil {
+			return nil, fmt.Errorf("reading task %s: %v", id, err)
+		}
+		var req TaskRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			q.finish(TaskResult{ID: id, Error: fmt.Sprintf("parsing task: %v", err)})
+			continue
+		}
+		if q.tombstoned(id) {
+			q.finish(cancelledResult(req))
+			continue
+		}
+		req.ID = id
+		return &req, nil
+	}
+	return nil, nil
+}
+
+// finish records a result in done/ and drops the running entry.
+func (q *taskQueue) finish(res TaskResult) error {
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err == nil {
+		data, err = sealAtRest(data)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(q.path("done", res.ID), data); err != nil {
+		return fmt.Errorf("writing result for %s: %v", res.ID, err)
+	}
+	os.Remove(q.path("cancel", res.ID))
+	return os.Remove(q.path("running", res.ID))
+}
+
+// cancel leaves a tombstone for a pending or running task, returning which
+// it was.
+func (q *taskQueue) cancel(id string) (string, error) {
+	if !runIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid task ID %q", id)
+	}
+	state := ""
+	for _, s := range []string{"pending", "running"} {
+		if _, err := os.Stat(q.path(s, id)); err == nil {
+			state = s
+		}
+	}
+	if state == "" {
+		if _, err := os.Stat(q.path("done", id)); err == nil {
+			return "", fmt.Errorf("task %s has finished", id)
+		}
+		return "", fmt.Errorf("no task %s in the queue", id)
+	}
+	return state, writeFileAtomic(q.path("cancel", id), nil)
+}
+
+func (q *taskQueue) tombstoned(id string) bool {
+	_, err := os.Stat(q.path("cancel", id))
+	return err == nil
+}
+
+// tombstones lists the IDs of the tasks to cancel.
+func (q *taskQueue) tombstones() []string {
+	paths, _ := filepath.Glob(filepath.Join(q.dir, "cancel", "*.json"))
+	ids := make([]string, len(paths))
+	for i, p := range paths {
+		ids[i] = strings.TrimSuffix(filepath.Base(p), ".json")
+	}
+	return ids
+}
+
+// cancelledResult is the result recorded for a cancelled task.
+func cancelledResult(req TaskRequest) TaskResult {
+	return TaskResult{ID: req.ID, Tags: req.Tags, Provider: req.Provider, Model: req.Model, Error: "task cancelled", ErrorKind: ErrCancelled}
+}
+
+// requeue returns a running task to pending/ so another worker can pick it
+// up. The rename keeps its modification time, and so its place in line.
+func (q *taskQueue) requeue(id string) error {
+	return os.Rename(q.path("running", id), q.path("pending", id))
+}
+
+// writeFileAtomic writes data next to path and renames it into place, so
+// readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp uses 0600; match what os.WriteFile would have produced.
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
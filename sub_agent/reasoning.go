@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Reasoning efforts for --reasoning-effort.
+const (
+	EffortNone   = "none"
+	EffortLow    = "low"
+	EffortMedium = "medium"
+	EffortHigh   = "high"
+)
+
+// reasoningConfig limits how long reasoning models think before answering.
+type reasoningConfig struct {
+	budget int    // thinking tokens; 0 keeps the provider's default
+	effort string // "" keeps the provider's default
+}
+
+func validEffort(e string) bool {
+	switch e {
+	case "", EffortNone, EffortLow, EffortMedium, EffortHigh:
+		return true
+	}
+	return false
+}
+
+// thinkingBudget is the token budget for APIs that only take one (Gemini,
+// Claude on Bedrock): the explicit budget, else one derived from the
+// effort. ok is false when neither is set.
+func (c reasoningConfig) thinkingBudget() (n int, ok bool) {
+	if c.budget > 0 {
+		return c.budget, true
+	}
+	switch c.effort {
+	case EffortNone:
+		return 0, true
+	case EffortLow:
+		return 1024, true
+	case EffortMedium:
+		return 8192, true
+	case EffortHigh:
+		return 24576, true
+	}
+	return 0, false
+}
+
+// reasoningWarning says which part of c the provider can't honour, or "".
+func reasoningWarning(providerName string, c reasoningConfig) string {
+	switch providerName {
+	case "cloud", "bedrock":
+		return ""
+	case "", "local":
+		if c.budget > 0 {
+			return "Ollama can't cap thinking tokens; --think-budget ignored (use --reasoning-effort)"
+		}
+		return ""
+	}
+	if c.budget > 0 {
+		return fmt.Sprintf("provider %s takes a reasoning effort, not a budget; --think-budget ignored", providerName)
+	}
+	return ""
+}
+
+// reason sets g's reasoning from req, or else the runner's, and returns a
+// warning if the provider can't honour all of it.
+func (r *runner) reason(g *genRequest, req TaskRequest) string {
+	g.Reasoning = r.reasoning
+	if req.ThinkBudget > 0 {
+		g.Reasoning.budget = req.ThinkBudget
+	}
+	if req.ReasoningEffort != "" {
+		g.Reasoning.effort = req.ReasoningEffort
+	}
+	return reasoningWarning(g.Provider, g.Reasoning)
+}
+
+// Usage is the token use of a run's provider calls, as the providers
+// report it; thinking tokens are counted apart from the answer's.
+type Usage struct {
+	Calls          int `json:"calls"`
+	PromptTokens   int `json:"prompt_tokens"`
+	OutputTokens   int `json:"output_tokens"`
+	ThinkingTokens int `json:"thinking_tokens,omitempty"`
+	// CachedTokens is how many of the prompt tokens came from a context cache.
+	CachedTokens int `json:"cached_tokens,omitempty"`
+	// Local is Ollama's timing of the calls it served.
+	Local *LocalStats `json:"local,omitempty"`
+}
+
+// usageMeter adds up the usage of one run's calls, which may be concurrent.
+type usageMeter struct {
+	mu sync.Mutex
+	u  Usage
+}
+
+func (m *usageMeter) usage() *Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.u.Calls == 0 {
+		return nil
+	}
+	u := m.u
+	if u.Local != nil {
+		l := *u.Local
+		u.Local = &l
+	}
+	return &u
+}
+
+type usageKey struct{}
+
+// withUsage attaches a run's meter for the provider calls made under ctx.
+func withUsage(ctx context.Context, m *usageMeter) context.Context {
+	return context.WithValue(ctx, usageKey{}, m)
+}
+
+// recordUsage adds one call's usage to the run's meter and progress, if any.
+func recordUsage(ctx context.Context, u Usage) {
+	progressFrom(ctx).callDone(u)
+	m, _ := ctx.Value(usageKey{}).(*usageMeter)
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.u.Calls++
+	m.u.PromptTokens += u.PromptTokens
+	m.u.OutputTokens += u.OutputTokens
+	m.u.ThinkingTokens += u.ThinkingTokens
+	m.u.CachedTokens += u.CachedTokens
+	if u.Local != nil {
+		if m.u.Local == nil {
+			m.u.Local = &LocalStats{}
+		}
+		m.u.Local.add(*u.Local)
+	}
+}
+
+// withThinking puts reasoning a provider returned apart back in front of
+// the answer as a <think> block, the form splitThinking takes apart.
+func withThinking(thinking, answer string) string {
+	if thinking == "" {
+		return answer
+	}
+	return "<think>" + thinking + "</think>\n" + answer
+}
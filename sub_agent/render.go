@@ -0,0 +1,244 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ANSI styles used by the markdown renderer.
+const (
+	ansiReset     = "\x1b[0m"
+	ansiBold      = "\x1b[1m"
+	ansiItalic    = "\x1b[3m"
+	ansiUnderline = "\x1b[4m"
+	ansiRed       = "\x1b[31m"
+	ansiGreen     = "\x1b[32m"
+	ansiYellow    = "\x1b[33m"
+	ansiBlue      = "\x1b[34m"
+	ansiMagenta   = "\x1b[35m"
+	ansiCyan      = "\x1b[36m"
+	ansiGray      = "\x1b[90m"
+)
+
+// isTerminal reports whether f is a character device such as a TTY.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// useMarkdown reports whether answers should be rendered: stdout is a
+// terminal, --raw was not given and NO_COLOR is unset.
+func useMarkdown(raw bool) bool {
+	return !raw && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+}
+
+var (
+	mdHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBullet   = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	mdNumbered = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	mdRule     = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	mdFence    = regexp.MustCompile("^\\s*(```|~~~)\\s*([\\w+#.-]*)")
+
+	mdCode   = regexp.MustCompile("`([^`]+)`")
+	mdBold   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalic = regexp.MustCompile(`(^|[^*\w])\*([^*\s][^*]*)\*|(^|[^_\w])_([^_\s][^_]*)_`)
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// renderMarkdown turns markdown into ANSI-styled text for a terminal:
+// headings, lists, quotes, rules, inline styles, and highlighted fenced code.
+func renderMarkdown(text string) string {
+	var out strings.Builder
+	var fence, lang string
+	var hl *highlighter
+	for _, line := range strings.Split(text, "\n") {
+		if m := mdFence.FindStringSubmatch(line); m != nil {
+			if fence == "" {
+				fence, lang = m[1], strings.ToLower(m[2])
+				hl = newHighlighter(lang)
+				label := lang
+				if label == "" {
+					label = "code"
+				}
+				out.WriteString(ansiGray + "┌─ " + label + ansiReset + "\n")
+				continue
+			}
+			if m[1] == fence && strings.TrimSpace(line) == fence {
+				fence = ""
+				out.WriteString(ansiGray + "└─" + ansiReset + "\n")
+				continue
+			}
+		}
+		if fence != "" {
+			out.WriteString(ansiGray + "│ " + ansiReset + hl.line(line) + "\n")
+			continue
+		}
+
+		switch {
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			style := ansiBold + ansiBlue
+			if len(m[1]) == 1 {
+				style += ansiUnderline
+			}
+			out.WriteString(style + renderInline(m[2], style) + ansiReset)
+		case mdRule.MatchString(line):
+			out.WriteString(ansiGray + strings.Repeat("─", 40) + ansiReset)
+		case mdBullet.MatchString(line):
+			m := mdBullet.FindStringSubmatch(line)
+			out.WriteString(m[1] + ansiCyan + "•" + ansiReset + " " + renderInline(m[2], ""))
+		case mdNumbered.MatchString(line):
+			m := mdNumbered.FindStringSubmatch(line)
+			out.WriteString(m[1] + ansiCyan + m[2] + ansiReset + " " + renderInline(m[3], ""))
+		case strings.HasPrefix(strings.TrimSpace(line), ">"):
+			body := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), ">"))
+			out.WriteString(ansiGray + "▌ " + ansiReset + ansiItalic + renderInline(body, ansiItalic) + ansiReset)
+		default:
+			out.WriteString(renderInline(line, ""))
+		}
+		out.WriteString("\n")
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// renderInline styles code spans, bold, italics and links. base is the
+// style to restore after each span.
+func renderInline(s, base string) string {
+	// Code spans first, with their contents protected from other rules.
+	var spans []string
+	s = mdCode.ReplaceAllStringFunc(s, func(m string) string {
+		spans = append(spans, m[1:len(m)-1])
+		return "\x00" + string(rune('0'+len(spans)-1)) + "\x00"
+	})
+	restore := ansiReset + base
+	s = mdLink.ReplaceAllString(s, ansiUnderline+"$1"+restore+" "+ansiGray+"($2)"+restore)
+	s = mdBold.ReplaceAllString(s, ansiBold+"$1$2"+restore)
+	s = mdItalic.ReplaceAllString(s, "$1$3"+ansiItalic+"$2$4"+restore)
+	for i, code := range spans {
+		s = strings.Replace(s, "\x00"+string(rune('0'+i))+"\x00", ansiYellow+code+restore, 1)
+	}
+	return s
+}
+
+// highlighter colours code line by line, carrying block-comment state.
+type highlighter struct {
+	keywords     map[string]bool
+	lineComment  string
+	blockComment [2]string // empty when the language has none
+	inBlock      bool
+}
+
+var languageKeywords = map[string]string{
+	"go":     "break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false",
+	"python": "and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self",
+	"js":     "await break case catch class const continue default delete do else export extends finally for function if import in instanceof let new of return super switch this throw try typeof var void while yield null undefined true false async interface type enum implements",
+	"rust":   "as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while",
+	"sh":     "if then else elif fi case esac for while until do done in function return local export echo exit",
+	"c":      "auto break case char const continue default do double else enum extern float for goto if int long register return short signed sizeof static struct switch typedef union unsigned void volatile while class public private protected new delete namespace template this true false nullptr",
+	"sql":    "select from where insert into values update set delete create table drop alter index join left right inner outer on group by order having limit and or not null as distinct union",
+}
+
+var languageAliases = map[string]string{
+	"golang": "go", "py": "python", "javascript": "js", "ts": "js", "typescript": "js", "jsx": "js", "tsx": "js",
+	"rs": "rust", "bash": "sh", "shell": "sh", "zsh": "sh", "console": "sh",
+	"cpp": "c", "c++": "c", "h": "c", "java": "c", "cs": "c", "csharp": "c", "kotlin": "c", "swift": "c",
+}
+
+func newHighlighter(lang string) *highlighter {
+	if alias, ok := languageAliases[lang]; ok {
+		lang = alias
+	}
+	h := &highlighter{keywords: map[string]bool{}}
+	words, ok := languageKeywords[lang]
+	if !ok {
+		return h // unknown language: strings and numbers only
+	}
+	for _, w := range strings.Fields(words) {
+		h.keywords[w] = true
+	}
+	switch lang {
+	case "python", "sh":
+		h.lineComment = "#"
+	case "sql":
+		h.lineComment = "--"
+	default:
+		h.lineComment = "//"
+		h.blockComment = [2]string{"/*", "*/"}
+	}
+	if lang == "sql" {
+		// SQL keywords are case-insensitive.
+		for w := range h.keywords {
+			h.keywords[strings.ToUpper(w)] = true
+		}
+	}
+	return h
+}
+
+func (h *highlighter) line(s string) string {
+	var b strings.Builder
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		rest := string(rs[i:])
+		switch {
+		case h.inBlock:
+			end := strings.Index(rest, h.blockComment[1])
+			if end < 0 {
+				b.WriteString(ansiGray + rest + ansiReset)
+				return b.String()
+			}
+			seg := rest[:end+len(h.blockComment[1])]
+			b.WriteString(ansiGray + seg + ansiReset)
+			h.inBlock = false
+			i += len([]rune(seg))
+		case h.blockComment[0] != "" && strings.HasPrefix(rest, h.blockComment[0]):
+			h.inBlock = true
+			b.WriteString(ansiGray + h.blockComment[0] + ansiReset)
+			i += len([]rune(h.blockComment[0]))
+		case h.lineComment != "" && strings.HasPrefix(rest, h.lineComment):
+			b.WriteString(ansiGray + rest + ansiReset)
+			return b.String()
+		case rs[i] == '"' || rs[i] == '\'' || rs[i] == '`':
+			j := i + 1
+			for j < len(rs) && rs[j] != rs[i] {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				j = len(rs) - 1
+			}
+			b.WriteString(ansiGreen + string(rs[i:j+1]) + ansiReset)
+			i = j + 1
+		case unicode.IsDigit(rs[i]) && (i == 0 || !isIdent(rs[i-1])):
+			j := i
+			for j < len(rs) && (isIdent(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			b.WriteString(ansiMagenta + string(rs[i:j]) + ansiReset)
+			i = j
+		case isIdent(rs[i]):
+			j := i
+			for j < len(rs) && isIdent(rs[j]) {
+				j++
+			}
+			word := string(rs[i:j])
+			if h.keywords[word] {
+				b.WriteString(ansiRed + word + ansiReset)
+			} else {
+				b.WriteString(word)
+			}
+			i = j
+		default:
+			b.WriteRune(rs[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
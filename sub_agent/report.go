@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dimensions `helix report` groups runs by.
+const (
+	ReportProvider = "provider"
+	ReportModel    = "model" // provider/model
+	ReportTag      = "tag"   // each key=value tag; tag:KEY for one key
+	ReportTenant   = "tenant"
+)
+
+// ReportRow is the usage and estimated cost of the runs sharing one value
+// of a dimension.
+type ReportRow struct {
+	Dimension      string  `json:"dimension"`
+	Key            string  `json:"key"`
+	Runs           int     `json:"runs"`
+	Failed         int     `json:"failed"`
+	Calls          int     `json:"calls"`
+	PromptTokens   int     `json:"prompt_tokens"`
+	OutputTokens   int     `json:"output_tokens"`
+	ThinkingTokens int     `json:"thinking_tokens"`
+	Cost           float64 `json:"estimated_cost_usd"`
+	// Unpriced counts runs on models the registry has no prices for, which
+	// Cost leaves out.
+	Unpriced int `json:"unpriced,omitempty"`
+}
+
+func (r *ReportRow) add(e *HistoryEntry) {
+	res := e.Result
+	r.Runs++
+	if res.Error != "" {
+		r.Failed++
+	}
+	u := res.Usage
+	if u == nil {
+		return
+	}
+	r.Calls += u.Calls
+	r.PromptTokens += u.PromptTokens
+	r.OutputTokens += u.OutputTokens
+	r.ThinkingTokens += u.ThinkingTokens
+	if info, ok := lookupModel(res.Provider, res.Model); ok {
+		r.Cost += estimateCost(info, u.PromptTokens, u.OutputTokens+u.ThinkingTokens)
+	} else {
+		r.Unpriced++
+	}
+}
+
+// UsageReport is the JSON output of `helix report`.
+type UsageReport struct {
+	Since time.Time   `json:"since"`
+	Until time.Time   `json:"until"`
+	Total ReportRow   `json:"total"`
+	Rows  []ReportRow `json:"rows"`
+}
+
+// reportKeys are the values of dim that e counts under; none leaves e out
+// of the dimension's table.
+func reportKeys(dim string, e *HistoryEntry) []string {
+	switch dim {
+	case ReportProvider:
+		return []string{e.Result.Provider}
+	case ReportModel:
+		return []string{modelChoice{e.Result.Provider, e.Result.Model}.String()}
+	case ReportTenant:
+		if e.Request.Tenant == "" {
+			return nil
+		}
+		return []string{e.Request.Tenant}
+	case ReportTag:
+		var keys []string
+		for _, k := range sortedKeys(e.Request.Tags) {
+			keys = append(keys, k+"="+e.Request.Tags[k])
+		}
+		return keys
+	}
+	if k, ok := strings.CutPrefix(dim, ReportTag+":"); ok {
+		if v, ok := e.Request.Tags[k]; ok {
+			return []string{v}
+		}
+	}
+	return nil
+}
+
+// buildReport aggregates entries by each dimension, costliest first.
+func buildReport(entries []*HistoryEntry, dims []string) (ReportRow, []ReportRow) {
+	total := ReportRow{Dimension: "total", Key: "all runs"}
+	var rows []ReportRow
+	for _, dim := range dims {
+		groups := map[string]*ReportRow{}
+		for _, e := range entries {
+			for _, k := range reportKeys(dim, e) {
+				if groups[k] == nil {
+					groups[k] = &ReportRow{Dimension: dim, Key: k}
+				}
+				groups[k].add(e)
+			}
+		}
+		var table []ReportRow
+		for _, r := range groups {
+			table = append(table, *r)
+		}
+		sort.Slice(table, func(i, j int) bool {
+			a, b := table[i], table[j]
+			if a.Cost != b.Cost {
+				return a.Cost > b.Cost
+			}
+			if a.Runs != b.Runs {
+				return a.Runs > b.Runs
+			}
+			return a.Key < b.Key
+		})
+		rows = append(rows, table...)
+	}
+	for _, e := range entries {
+		total.add(e)
+	}
+	return total, rows
+}
+
+func writeReportCSV(w io.Writer, total ReportRow, rows []ReportRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"dimension", "key", "runs", "failed", "calls", "prompt_tokens", "output_tokens", "thinking_tokens", "estimated_cost_usd", "unpriced"})
+	for _, r := range append(rows, total) {
+		cw.Write([]string{r.Dimension, r.Key, strconv.Itoa(r.Runs), strconv.Itoa(r.Failed), strconv.Itoa(r.Calls),
+			strconv.Itoa(r.PromptTokens), strconv.Itoa(r.OutputTokens), strconv.Itoa(r.ThinkingTokens),
+			strconv.FormatFloat(r.Cost, 'f', 6, 64), strconv.Itoa(r.Unpriced)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeReportText prints one table per dimension, then the total.
+func writeReportText(w io.Writer, rep UsageReport) {
+	fmt.Fprintf(w, "Usage from %s to %s\n", rep.Since.Local().Format("2006-01-02 15:04"), rep.Until.Local().Format("2006-01-02 15:04"))
+	row := func(r ReportRow) {
+		cost := fmt.Sprintf("$%.4f", r.Cost)
+		if r.Unpriced > 0 {
+			cost += fmt.Sprintf(" (+%d unpriced)", r.Unpriced)
+		}
+		fmt.Fprintf(w, "%-32s %6d %6d %12d %12d %10d  %s\n", truncateRunes(r.Key, 32), r.Runs, r.Failed, r.PromptTokens, r.OutputTokens, r.ThinkingTokens, cost)
+	}
+	dim := ""
+	for _, r := range rep.Rows {
+		if r.Dimension != dim {
+			dim = r.Dimension
+			fmt.Fprintf(w, "\n%-32s %6s %6s %12s %12s %10s  %s\n", strings.ToUpper(dim), "RUNS", "FAILED", "PROMPT TOK", "OUTPUT TOK", "THINKING", "EST. COST")
+		}
+		row(r)
+	}
+	fmt.Fprintln(w)
+	row(rep.Total)
+}
+
+// reportCommand implements `report`: aggregate the run history into usage
+// and cost tables by provider, model, tag and tenant.
+func reportCommand(fs *flag.FlagSet) func(args []string) {
+	since := fs.String("since", "30d", "Only runs from this date or time, or this long ago (e.g. 7d)")
+	until := fs.String("until", "", "Only runs before this date or time, or this long ago (default now)")
+	by := fs.String("by", "provider,model,tag,tenant", "Comma-separated tables: provider, model, tag (every key=value) or tag:KEY (one tag's values), and tenant")
+	format := fs.String("format", "text", "Output format: 'text', 'csv' or 'json'")
+	out := fs.String("out", "", "File to write (default stdout)")
+	tagFilter := tagFlag{}
+	fs.Var(tagFilter, "tag", "Only runs with this key=value tag (repeatable)")
+	return func([]string) {
+		switch *format {
+		case "text", "csv", "json":
+		default:
+			fatal(kindError(ErrConfig, "invalid --format %q: expected text, csv or json", *format))
+		}
+		var dims []string
+		for _, d := range strings.Split(*by, ",") {
+			d = strings.TrimSpace(d)
+			switch {
+			case d == ReportProvider, d == ReportModel, d == ReportTag, d == ReportTenant:
+			case strings.HasPrefix(d, ReportTag+":") && len(d) > len(ReportTag)+1:
+			default:
+				fatal(kindError(ErrConfig, "invalid --by %q: expected provider, model, tag, tag:KEY or tenant", d))
+			}
+			dims = append(dims, d)
+		}
+		rep := UsageReport{Until: time.Now()}
+		var err error
+		if rep.Since, err = parseSince(*since); err != nil {
+			fatal(kindError(ErrConfig, "invalid --since: %v", err))
+		}
+		if *until != "" {
+			if rep.Until, err = parseSince(*until); err != nil {
+				fatal(kindError(ErrConfig, "invalid --until: %v", err))
+			}
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		all, err := selectEntries(store, nil, tagFilter)
+		if err != nil {
+			fatal(err)
+		}
+		// Imported runs didn't spend anything here.
+		var entries []*HistoryEntry
+		for _, e := range all {
+			if !e.Imported && !e.Time.Before(rep.Since) && e.Time.Before(rep.Until) {
+				entries = append(entries, e)
+			}
+		}
+		rep.Total, rep.Rows = buildReport(entries, dims)
+		if rep.Rows == nil {
+			rep.Rows = []ReportRow{}
+		}
+
+		w := io.Writer(os.Stdout)
+		if *out != "" && *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				fatal(configError(err))
+			}
+			defer f.Close()
+			w = f
+		}
+		switch *format {
+		case "csv":
+			err = writeReportCSV(w, rep.Total, rep.Rows)
+		case "json":
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(rep)
+		default:
+			if len(entries) == 0 {
+				fmt.Fprintln(w, "No runs recorded in that time.")
+				return
+			}
+			writeReportText(w, rep)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if *out != "" && *out != "-" {
+			statusf("[Sub-Agent] Wrote the report of %d run(s) to %s\n", len(entries), *out)
+		}
+	}
+}
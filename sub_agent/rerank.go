@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RerankConfig is the optional reranker between a knowledge base's search
+// and the prompt. "ollama" has a local model score each chunk against the
+// query, which suits cross-encoder rerankers served by Ollama; "api" posts to a Cohere-style /rerank endpoint, which Cohere, Jina,
+// Voyage, vLLM and llama.cpp's server all provide.
+type RerankConfig struct {
+	Provider  string `json:"provider,omitempty"` // "ollama" or "api"; empty disables reranking
+	Model     string `json:"model,omitempty"`
+	URL       string `json:"url,omitempty"` // the /rerank endpoint for "api"
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// Concurrency is how many chunks "ollama" scores at once (default 4).
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// reranker scores chunks against a query; higher is more relevant.
+type reranker interface {
+	name() string
+	score(ctx context.Context, query string, docs []string) ([]float64, error)
+}
+
+func newReranker(provider string) (reranker, error) {
+	c := config.Knowledge.Rerank
+	switch provider {
+	case "", "off":
+		return nil, nil
+	case "ollama":
+		if c.Model == "" {
+			return nil, fmt.Errorf("--rerank ollama needs knowledge.rerank.model, e.g. a cross-encoder such as bge-reranker-v2-m3 pulled into Ollama")
+		}
+		return ollamaReranker{model: c.Model, concurrency: max(c.Concurrency, 1)}, nil
+	case "api":
+		if c.URL == "" {
+			return nil, fmt.Errorf("--rerank api needs knowledge.rerank.url, e.g. https://api.cohere.com/v2/rerank")
+		}
+		return apiReranker{url: c.URL, model: c.Model, keyEnv: c.APIKeyEnv}, nil
+	}
+	return nil, fmt.Errorf("invalid --rerank %q: expected ollama, api or off", provider)
+}
+
+// rerankChunks orders hits by the reranker's scores, best first.
+func rerankChunks(ctx context.Context, rr reranker, query string, hits []scoredChunk) ([]scoredChunk, error) {
+	docs := make([]string, len(hits))
+	for i, h := range hits {
+		docs[i] = h.Text
+	}
+	scores, err := rr.score(ctx, query, docs)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]scoredChunk(nil), hits...)
+	for i := range out {
+		out[i].RerankScore = scores[i]
+	}
+	// Stable, so that ties keep search order.
+	sort.SliceStable(out, func(i, j int) bool { return out[i].RerankScore > out[j].RerankScore })
+	return out, nil
+}
+
+const rerankPrompt = `Judge how relevant the passage is to the query. Reply with a single number from 0 (unrelated) to 10 (answers it directly) and nothing else.
+
+Query: %s
+
+Passage:
+%s`
+
+var scoreRe = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// ollamaReranker prompts a local model for a relevance score per chunk.
+type ollamaReranker struct {
+	model       string
+	concurrency int
+}
+
+func (o ollamaReranker) name() string { return "ollama/" + o.model }
+
+func (o ollamaReranker) score(ctx context.Context, query string, docs []string) ([]float64, error) {
+	scores := make([]float64, len(docs))
+	errs := make([]error, len(docs))
+	sem := make(chan struct{}, o.concurrency)
+	var wg sync.WaitGroup
+	for i, d := range docs {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			out, err := generate(ctx, "local", o.model, fmt.Sprintf(rerankPrompt, query, d), "")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			m := scoreRe.FindString(cleanOutput(out))
+			if m == "" {
+				errs[i] = fmt.Errorf("%s gave no score: %q", o.model, truncateRunes(out, 80))
+				return
+			}
+			scores[i], _ = strconv.ParseFloat(m, 64)
+			scores[i] /= 10
+		}(i, d)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
+
+// apiReranker calls a Cohere-style rerank API.
+type apiReranker struct {
+	url    string
+	model  string
+	keyEnv string
+}
+
+func (a apiReranker) name() string {
+	if a.model != "" {
+		return "api/" + a.model
+	}
+	return "api"
+}
+
+func (a apiReranker) score(ctx context.Context, query string, docs []string) ([]float64, error) {
+	payload := map[string]interface{}{"query": query, "documents": docs, "top_n": len(docs)}
+	if a.model != "" {
+		payload["model"] = a.model
+	}
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("building rerank request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.keyEnv != "" {
+		key, err := lookupSecret("rerank", a.keyEnv)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing rerank API key. Set %s or run `helix auth login --provider rerank`", a.keyEnv)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, kindError(ErrUnreachable, "connecting to the rerank endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, kindError(statusKind(resp.StatusCode), "rerank endpoint returned status: %s, body: %s", resp.Status, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	// Cohere and Jina answer "results", Voyage "data"; llama.cpp's server
+	// and some others say "score" for "relevance_score".
+	type result struct {
+		Index          int      `json:"index"`
+		RelevanceScore *float64 `json:"relevance_score"`
+		Score          *float64 `json:"score"`
+	}
+	var out struct {
+		Results []result `json:"results"`
+		Data    []result `json:"data"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("parsing rerank response: %v", err)
+	}
+	results := append(out.Results, out.Data...)
+	if len(results) == 0 {
+		return nil, fmt.Errorf("rerank endpoint returned no results")
+	}
+	scores := make([]float64, len(docs))
+	for i := range scores {
+		// Documents the API left out rank last.
+		scores[i] = -1
+	}
+	for _, r := range results {
+		if r.Index < 0 || r.Index >= len(docs) {
+			return nil, fmt.Errorf("rerank endpoint returned index %d for %d documents", r.Index, len(docs))
+		}
+		switch {
+		case r.RelevanceScore != nil:
+			scores[r.Index] = *r.RelevanceScore
+		case r.Score != nil:
+			scores[r.Index] = *r.Score
+		}
+	}
+	return scores, nil
+}
+
+// retrievalFlags set how many chunks are retrieved and how they're reranked.
+type retrievalFlags struct {
+	mode   *string
+	topK   *int
+	topN   *int
+	rerank *string
+}
+
+func addRetrievalFlags(fs *flag.FlagSet) *retrievalFlags {
+	c := config.Knowledge
+	topK, topN := c.TopK, c.TopN
+	if topK == 0 {
+		topK = kbTopK
+	}
+	if topN == 0 {
+		topN = kbTopN
+	}
+	mode := c.Search
+	if mode == "" {
+		mode = SearchHybrid
+	}
+	return &retrievalFlags{
+		mode:   fs.String("kb-search", mode, "How knowledge base chunks are found: 'hybrid' (BM25 and vector rankings fused with RRF), 'vector' or 'keyword'"),
+		topK:   fs.Int("kb-top-k", topK, "Chunks search hands to the reranker"),
+		topN:   fs.Int("kb-top-n", topN, "Chunks put in the prompt"),
+		rerank: fs.String("rerank", c.Rerank.Provider, "Rerank retrieved chunks with 'ollama' (a local model) or 'api' (a Cohere-style rerank endpoint), or 'off' (see knowledge.rerank in the config)"),
+	}
+}
+
+// config validates the flags into the retrieval settings for kb.
+func (f *retrievalFlags) config(kb string) (retrievalConfig, error) {
+	if !validSearchMode(*f.mode) {
+		return retrievalConfig{}, fmt.Errorf("invalid --kb-search %q: expected hybrid, vector or keyword", *f.mode)
+	}
+	if *f.topN < 1 {
+		return retrievalConfig{}, fmt.Errorf("--kb-top-n must be at least 1")
+	}
+	if *f.topK < *f.topN {
+		return retrievalConfig{}, fmt.Errorf("--kb-top-k (%d) must be at least --kb-top-n (%d)", *f.topK, *f.topN)
+	}
+	rr, err := newReranker(*f.rerank)
+	if err != nil {
+		return retrievalConfig{}, err
+	}
+	return retrievalConfig{kb: kb, mode: *f.mode, topK: *f.topK, topN: *f.topN, rerank: rr}, nil
+}
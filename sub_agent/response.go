@@ -0,0 +1,137 @@
+package main
+
+import "encoding/json"
+
+// Response is one answer of a provider call in the same shape whichever
+// provider gave it, so nothing downstream needs to know Ollama's fields
+// from Gemini's.
+type Response struct {
+	// Text is the answer, with any thinking in a <think> block in front.
+	Text         string
+	FinishReason string // one of the Finish constants
+	// Usage is that of the whole call, which all its candidates share.
+	Usage     Usage
+	Safety    *SafetyInfo        // set when the provider rated or filtered it
+	ToolCalls []ProviderToolCall // functions the model asked to call natively
+	// Raw is the provider's response as it came, or as reassembled from a
+	// stream.
+	Raw json.RawMessage
+}
+
+// Normalized finish reasons.
+const (
+	FinishStop      = "stop"       // the model ended the answer, or hit a stop sequence
+	FinishLength    = "length"     // cut off at the output token limit
+	FinishSafety    = "safety"     // stopped by a content filter
+	FinishToolCalls = "tool_calls" // stopped to call tools
+	FinishOther     = "other"
+)
+
+// SafetyInfo is what a provider's content filter made of an answer.
+type SafetyInfo struct {
+	Blocked bool   `json:"blocked"`
+	Reason  string `json:"reason,omitempty"` // the provider's own word for it
+	// Ratings are per-category verdicts, such as HARM_CATEGORY_HARASSMENT:
+	// LOW, where the provider gives them.
+	Ratings map[string]string `json:"ratings,omitempty"`
+}
+
+// ProviderToolCall is a function call the provider returned in its own
+// structured form, as opposed to the JSON tool calls helix parses from the
+// text.
+type ProviderToolCall struct {
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// texts are the answers of rs.
+func texts(rs []Response) []string {
+	out := make([]string, len(rs))
+	for i, r := range rs {
+		out[i] = r.Text
+	}
+	return out
+}
+
+// rawJSON is body if it is JSON, v marshalled otherwise (a streamed
+// response has no single body).
+func rawJSON(body []byte, v interface{}) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// ollamaFinish normalizes Ollama's done_reason.
+func ollamaFinish(reason string) string {
+	switch reason {
+	case "", "stop":
+		return FinishStop
+	case "length":
+		return FinishLength
+	}
+	return FinishOther
+}
+
+// geminiFinish normalizes a Gemini candidate's finishReason.
+func geminiFinish(reason string) string {
+	switch reason {
+	case "", "STOP":
+		return FinishStop
+	case "MAX_TOKENS":
+		return FinishLength
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return FinishSafety
+	case "MALFORMED_FUNCTION_CALL", "UNEXPECTED_TOOL_CALL":
+		return FinishToolCalls
+	}
+	return FinishOther
+}
+
+// openAIFinish normalizes a chat completion choice's finish_reason.
+func openAIFinish(reason string) string {
+	switch reason {
+	case "", "stop":
+		return FinishStop
+	case "length":
+		return FinishLength
+	case "content_filter":
+		return FinishSafety
+	case "tool_calls", "function_call":
+		return FinishToolCalls
+	}
+	return FinishOther
+}
+
+// bedrockFinish normalizes Converse's stopReason.
+func bedrockFinish(reason string) string {
+	switch reason {
+	case "", "end_turn", "stop_sequence":
+		return FinishStop
+	case "max_tokens":
+		return FinishLength
+	case "guardrail_intervened", "content_filtered":
+		return FinishSafety
+	case "tool_use":
+		return FinishToolCalls
+	}
+	return FinishOther
+}
+
+// geminiSafety reads a candidate's safety ratings.
+func geminiSafety(c GeminiCandidate) *SafetyInfo {
+	if len(c.SafetyRatings) == 0 && geminiFinish(c.FinishReason) != FinishSafety {
+		return nil
+	}
+	s := &SafetyInfo{Blocked: geminiFinish(c.FinishReason) == FinishSafety, Ratings: map[string]string{}}
+	if s.Blocked {
+		s.Reason = c.FinishReason
+	}
+	for _, r := range c.SafetyRatings {
+		s.Ratings[r.Category] = r.Probability
+		s.Blocked = s.Blocked || r.Blocked
+	}
+	return s
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryRetention overrides history.max_age for the runs with a tag; the
+// first rule a run matches applies.
+type HistoryRetention struct {
+	Tag    string `json:"tag"`               // key=value
+	MaxAge string `json:"max_age,omitempty"` // empty keeps the runs however old
+}
+
+// retentionInterval is how often the daemon applies the retention policy.
+const retentionInterval = time.Hour
+
+// parseAge reads a duration, in days as "30d" too.
+func parseAge(s string) (time.Duration, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		if days, err := strconv.Atoi(n); err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// retentionPolicy is the history section's retention settings, parsed.
+type retentionPolicy struct {
+	keep     int
+	maxAge   time.Duration // 0: no limit
+	maxBytes int64
+	rules    []retentionRule
+}
+
+type retentionRule struct {
+	key, value string
+	maxAge     time.Duration // 0: no limit
+}
+
+func (p retentionPolicy) set() bool {
+	return p.maxAge > 0 || p.maxBytes > 0 || len(p.rules) > 0
+}
+
+func historyRetention(h HistoryConfig) (retentionPolicy, error) {
+	p := retentionPolicy{keep: h.Keep, maxBytes: h.MaxBytes}
+	if p.keep <= 0 {
+		p.keep = defaultHistoryKeep
+	}
+	if p.maxBytes < 0 {
+		return p, fmt.Errorf("history.max_bytes can't be negative")
+	}
+	if h.MaxAge != "" {
+		d, err := parseAge(h.MaxAge)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("history.max_age: invalid duration %q", h.MaxAge)
+		}
+		p.maxAge = d
+	}
+	for i, r := range h.Retention {
+		k, v, ok := strings.Cut(r.Tag, "=")
+		if !ok || k == "" {
+			return p, fmt.Errorf("history.retention[%d]: expected a key=value tag, got %q", i, r.Tag)
+		}
+		rule := retentionRule{key: k, value: v}
+		if r.MaxAge != "" {
+			d, err := parseAge(r.MaxAge)
+			if err != nil || d < 0 {
+				return p, fmt.Errorf("history.retention[%d].max_age: invalid duration %q", i, r.MaxAge)
+			}
+			rule.maxAge = d
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// maxAgeOf is how long p keeps a run with tags.
+func (p retentionPolicy) maxAgeOf(tags map[string]string) time.Duration {
+	for _, r := range p.rules {
+		if v, ok := tags[r.key]; ok && v == r.value {
+			return r.maxAge
+		}
+	}
+	return p.maxAge
+}
+
+// PrunedRun is a run the retention policy removed, or would remove.
+type PrunedRun struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Bytes  int64     `json:"bytes"`
+	Reason string    `json:"reason"`
+}
+
+// retain removes the runs p doesn't keep: past keep, older than their
+// max age, and the oldest past max_bytes. A run that can't be read is
+// dated by when it was written and has no tags.
+func (s *historyStore) retain(p retentionPolicy, now time.Time, dryRun bool) ([]PrunedRun, error) {
+	recs, err := s.records.stat()
+	if err != nil {
+		return nil, err
+	}
+	type run struct {
+		PrunedRun
+		tags map[string]string
+	}
+	var runs []run
+	for _, rec := range recs {
+		r := run{PrunedRun: PrunedRun{ID: rec.id, Time: rec.time, Bytes: rec.size}}
+		if e, err := s.load(r.ID); err == nil {
+			r.Time, r.tags = e.Time, e.Request.Tags
+		}
+		runs = append(runs, r)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Time.After(runs[j].Time) })
+
+	var pruned []PrunedRun
+	var kept int64
+	for i, r := range runs {
+		age := p.maxAgeOf(r.tags)
+		switch {
+		case i >= p.keep:
+			r.Reason = fmt.Sprintf("more than %d runs", p.keep)
+		case age > 0 && now.Sub(r.Time) > age:
+			r.Reason = "older than " + formatAge(age)
+		case p.maxBytes > 0 && kept+r.Bytes > p.maxBytes:
+			r.Reason = fmt.Sprintf("over %d bytes", p.maxBytes)
+		default:
+			kept += r.Bytes
+			continue
+		}
+		if !dryRun {
+			if err := s.records.remove(r.ID); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, r.PrunedRun)
+	}
+	return pruned, nil
+}
+
+// formatAge prints d in days when it is whole days.
+func formatAge(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// enforceRetention applies the history's retention policy now and every
+// retentionInterval, for the daemon.
+func enforceRetention() {
+	apply := func() {
+		p, err := historyRetention(liveConfig().History)
+		if err != nil || !p.set() {
+			return
+		}
+		store, err := openHistory()
+		if err != nil {
+			return
+		}
+		pruned, err := store.retain(p, time.Now(), false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: pruning the history: %v\n", err)
+		}
+		if len(pruned) > 0 {
+			statusf("[Sub-Agent] Pruned %d run(s) from the history\n", len(pruned))
+		}
+	}
+	apply()
+	go func() {
+		for range time.Tick(retentionInterval) {
+			apply()
+		}
+	}()
+}
+
+// historyPruneCommand implements `history prune`: remove the runs the
+// retention policy in the history section doesn't keep.
+func historyPruneCommand(fs *flag.FlagSet) func(args []string) {
+	dryRun := fs.Bool("dry-run", false, "List the runs that would be removed without removing them")
+	maxAge := fs.String("max-age", "", "Remove runs older than this (e.g. 30d), instead of history.max_age")
+	fs.BoolVar(&jsonOut, "json", false, "Print the removed runs as JSON")
+	return func([]string) {
+		h := liveConfig().History
+		if *maxAge != "" {
+			h.MaxAge = *maxAge
+		}
+		p, err := historyRetention(h)
+		if err != nil {
+			fatal(configError(err))
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		pruned, err := store.retain(p, time.Now(), *dryRun)
+		if err != nil {
+			fatal(err)
+		}
+		if jsonOut {
+			if pruned == nil {
+				pruned = []PrunedRun{}
+			}
+			printJSON(pruned)
+			return
+		}
+		var freed int64
+		for _, r := range pruned {
+			freed += r.Bytes
+			fmt.Printf("%-18s %s  %s\n", r.ID, r.Time.Local().Format("2006-01-02 15:04"), r.Reason)
+		}
+		verb := "Removed"
+		if *dryRun {
+			verb = "Would remove"
+		}
+		statusf("[Sub-Agent] %s %d run(s), %d bytes\n", verb, len(pruned), freed)
+	}
+}
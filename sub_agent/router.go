@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Routing policies for --route.
+const (
+	RouteCheapest = "cheapest"
+	RouteFastest  = "fastest"
+	RouteBest     = "best"
+)
+
+// RouteDecision records why the router picked a model.
+type RouteDecision struct {
+	Policy  string   `json:"policy"`
+	Chosen  string   `json:"chosen"`
+	Reason  string   `json:"reason"`
+	Skipped []string `json:"skipped,omitempty"` // candidates ruled out, with why
+}
+
+func validRoute(policy string) bool {
+	switch policy {
+	case "", RouteCheapest, RouteFastest, RouteBest:
+		return true
+	}
+	return false
+}
+
+// routeCandidates returns the configured candidates, or the local default
+// model plus cloud when the config lists none.
+func routeCandidates() ([]modelChoice, error) {
+	candidates := liveConfig().Routing.Candidates
+	if len(candidates) == 0 {
+		return []modelChoice{{provider: "local", model: resolveModel("")}, {provider: "cloud"}}, nil
+	}
+	return parseModelChoices(strings.Join(candidates, ","))
+}
+
+// route picks a provider/model for req under policy. Candidates are filtered
+// by hard requirements (context window, image support, credentials) and the
+// survivors ranked by the policy using the model registry. If req already
+// names a provider, only that provider's candidates are considered.
+func (r *runner) routeTask(req TaskRequest, policy string) (modelChoice, *RouteDecision, error) {
+	candidates, err := routeCandidates()
+	if err != nil {
+		return modelChoice{}, nil, err
+	}
+	dec := &RouteDecision{Policy: policy}
+
+	promptTokens := estimateTokens(req.Task) + estimateTokens(req.Input)
+	need := promptTokens + r.context.reserveTokens
+	// Without a better estimate, assume the answer is about as long as the
+	// reserve; this only matters for comparing cloud prices.
+	outTokens := r.context.reserveTokens
+
+	var best modelChoice
+	var bestInfo ModelInfo
+	var bestScore float64
+	found := false
+	for _, c := range candidates {
+		if req.Provider != "" && c.provider != req.Provider {
+			continue
+		}
+		info, _ := lookupModel(c.provider, c.model)
+		if req.allow != nil && req.allow(c.provider, defaultModel(c.provider, c.model)) != nil {
+			dec.Skipped = append(dec.Skipped, c.String()+": not allowed for tenant")
+			continue
+		}
+		if rotation.disabled(c.provider) {
+			dec.Skipped = append(dec.Skipped, c.String()+": out of rotation")
+			continue
+		}
+		if why := r.unavailable(c); why != "" {
+			dec.Skipped = append(dec.Skipped, c.String()+": "+why)
+			continue
+		}
+		switch {
+		case len(req.Images) > 0 && !info.Vision:
+			dec.Skipped = append(dec.Skipped, c.String()+": no image support")
+			continue
+		case len(req.Files) > 0 && c.provider != "cloud":
+			dec.Skipped = append(dec.Skipped, c.String()+": no file support")
+			continue
+		case (req.Ground || r.ground) && c.provider != "cloud":
+			dec.Skipped = append(dec.Skipped, c.String()+": no search grounding")
+			continue
+		case need > info.ContextWindow && r.context.strategy == ContextError:
+			dec.Skipped = append(dec.Skipped, fmt.Sprintf("%s: %d-token window too small", c, info.ContextWindow))
+			continue
+		}
+
+		score := routeScore(policy, info, promptTokens, outTokens)
+		// Prefer models whose window fits the prompt without truncation.
+		if need > info.ContextWindow {
+			score -= 1000
+		}
+		if !found || score > bestScore {
+			best, bestInfo, bestScore, found = c, info, score, true
+		}
+	}
+	if !found {
+		return modelChoice{}, dec, fmt.Errorf("no routing candidate can serve this task (%s)", strings.Join(dec.Skipped, "; "))
+	}
+
+	dec.Chosen = best.String()
+	switch policy {
+	case RouteCheapest:
+		dec.Reason = fmt.Sprintf("lowest estimated cost ($%.4f)", estimateCost(bestInfo, promptTokens, outTokens))
+	case RouteFastest:
+		dec.Reason = fmt.Sprintf("highest speed rating (%d)", bestInfo.Speed)
+	default:
+		dec.Reason = fmt.Sprintf("highest quality rating (%d)", bestInfo.Quality)
+	}
+	return best, dec, nil
+}
+
+// unavailable explains why a candidate's provider cannot be used as
+// configured, or returns "" if it can.
+func (r *runner) unavailable(c modelChoice) string {
+	switch c.provider {
+	case "local":
+		return ""
+	case "cloud":
+		if key, _ := geminiKey(r.key); key == "" && !geminiConfig().Vertex {
+			return "no Gemini API key"
+		}
+	case "azure-openai":
+		if azureConfig().Endpoint == "" {
+			return "no Azure OpenAI endpoint"
+		}
+	case "bedrock":
+		if c.model == "" && bedrockModel() == "" {
+			return "no Bedrock model ID"
+		}
+	default:
+		a, ok := lookupAdapter(c.provider)
+		if !ok {
+			return "unknown provider"
+		}
+		if key, _ := lookupSecret(c.provider, a.APIKeyEnv); a.APIKeyEnv != "" && key == "" {
+			return "no API key in " + a.APIKeyEnv
+		}
+		if c.model == "" && a.DefaultModel == "" {
+			return "no model"
+		}
+	}
+	return ""
+}
+
+// routeScore ranks a model under a policy; higher is better. Ties on the
+// primary criterion are broken by quality.
+func routeScore(policy string, info ModelInfo, promptTokens, outTokens int) float64 {
+	tiebreak := float64(info.Quality) / 100
+	switch policy {
+	case RouteCheapest:
+		return -estimateCost(info, promptTokens, outTokens)*1000 + tiebreak
+	case RouteFastest:
+		return float64(info.Speed) + tiebreak
+	default:
+		return float64(info.Quality) + float64(info.Speed)/100
+	}
+}
+
+// estimateCost returns the USD cost of a call from registry prices.
+func estimateCost(info ModelInfo, inTokens, outTokens int) float64 {
+	return (float64(inTokens)*info.InputPrice + float64(outTokens)*info.OutputPrice) / 1e6
+}
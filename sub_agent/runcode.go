@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunCodeConfig configures the run_code tool's container.
+type RunCodeConfig struct {
+	Docker  string            `json:"docker,omitempty"`  // binary, default "docker"
+	Images  map[string]string `json:"images,omitempty"`  // language -> image overrides
+	CPUs    string            `json:"cpus,omitempty"`    // default "1"
+	Memory  string            `json:"memory,omitempty"`  // default "512m"
+	Timeout string            `json:"timeout,omitempty"` // default "30s"
+	// Workspace is how --workspace is mounted at /workspace: "ro" (the
+	// default), "rw", or "off" to not mount it.
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// codeRuntime is how one language's snippet is run; the code arrives on stdin.
+type codeRuntime struct {
+	image string
+	cmd   []string
+}
+
+var codeRuntimes = map[string]codeRuntime{
+	"python":     {"python:3.12-alpine", []string{"python3", "-"}},
+	"javascript": {"node:22-alpine", []string{"node", "-"}},
+	"sh":         {"alpine:3.20", []string{"sh", "-s"}},
+	"bash":       {"bash:5", []string{"bash", "-s"}},
+	"ruby":       {"ruby:3.3-alpine", []string{"ruby", "-"}},
+	"go":         {"golang:1.22-alpine", []string{"sh", "-c", "cat > /tmp/main.go && cd /tmp && go run main.go"}},
+}
+
+// maxToolOutput bounds each of stdout and stderr returned to the model.
+const maxToolOutput = 16 << 10
+
+// runCodeTool runs snippets in a throwaway container with no network,
+// a read-only root, dropped capabilities and CPU, memory, process and time
+// limits.
+type runCodeTool struct {
+	docker    string
+	images    map[string]string
+	cpus      string
+	memory    string
+	timeout   time.Duration
+	workspace string // host directory to mount, "" for none
+	writable  bool
+}
+
+func newRunCodeTool(workspace string) (tool, error) {
+	c := config.Tools.RunCode
+	t := &runCodeTool{docker: c.Docker, images: c.Images, cpus: c.CPUs, memory: c.Memory, timeout: 30 * time.Second}
+	if t.docker == "" {
+		t.docker = "docker"
+	}
+	if t.cpus == "" {
+		t.cpus = "1"
+	}
+	if t.memory == "" {
+		t.memory = "512m"
+	}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+		}
+		t.timeout = d
+	}
+	switch c.Workspace {
+	case "", "ro":
+		t.workspace = workspace
+	case "rw":
+		t.workspace, t.writable = workspace, true
+	case "off":
+	default:
+		return nil, fmt.Errorf("invalid workspace %q: expected ro, rw or off", c.Workspace)
+	}
+	if _, err := exec.LookPath(t.docker); err != nil {
+		return nil, fmt.Errorf("%s not found; run_code needs Docker", t.docker)
+	}
+	return t, nil
+}
+
+func (t *runCodeTool) languages() []string {
+	var langs []string
+	for l := range codeRuntimes {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func (t *runCodeTool) spec() toolSpec {
+	mount := "The workspace is not available."
+	if t.workspace != "" {
+		mode := "read-only"
+		if t.writable {
+			mode = "writable"
+		}
+		mount = "The workspace is mounted " + mode + " at /workspace, the working directory."
+	}
+	langs, _ := json.Marshal(t.languages())
+	return toolSpec{
+		Name: "run_code",
+		Description: fmt.Sprintf("Run a code snippet in a sandbox without network access and return its exit code, stdout and stderr. Runs are limited to %s; only /tmp is writable. %s",
+			t.timeout, mount),
+		InputSchema: json.RawMessage(fmt.Sprintf(`{"type":"object","properties":{"language":{"type":"string","enum":%s},"code":{"type":"string"}},"required":["language","code"]}`, langs)),
+	}
+}
+
+func (t *runCodeTool) describe(input json.RawMessage) string {
+	var in struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+	}
+	if json.Unmarshal(input, &in) != nil || in.Language == "" {
+		return ""
+	}
+	return fmt.Sprintf("Running %s code: %s", in.Language, truncateRunes(firstLine(in.Code), 60))
+}
+
+func (t *runCodeTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	var in struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %v", err)
+	}
+	lang := strings.ToLower(in.Language)
+	switch lang {
+	case "py", "python3":
+		lang = "python"
+	case "js", "node":
+		lang = "javascript"
+	case "shell":
+		lang = "sh"
+	}
+	rt, ok := codeRuntimes[lang]
+	if !ok {
+		return "", fmt.Errorf("unsupported language %q: expected one of %s", in.Language, strings.Join(t.languages(), ", "))
+	}
+	if img := t.images[lang]; img != "" {
+		rt.image = img
+	}
+
+	name := "helix-run-" + newID()
+	args := []string{"run", "--rm", "-i", "--name", name,
+		"--network", "none",
+		"--cpus", t.cpus, "--memory", t.memory, "--memory-swap", t.memory, "--pids-limit", "256",
+		"--read-only", "--tmpfs", "/tmp:rw,exec,size=256m",
+		"--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+		"--user", "65534:65534", "-e", "HOME=/tmp", "-e", "GOCACHE=/tmp/.cache", "-e", "GOPATH=/tmp/go",
+	}
+	// Name only: docker takes the values from its own environment, so they
+	// stay out of the process list.
+	for _, kv := range toolEnv(ctx) {
+		name, _, _ := strings.Cut(kv, "=")
+		args = append(args, "-e", name)
+	}
+	if t.workspace != "" {
+		abs, err := filepath.Abs(t.workspace)
+		if err != nil {
+			return "", err
+		}
+		mount := abs + ":/workspace:ro"
+		if t.writable {
+			mount = abs + ":/workspace"
+		}
+		args = append(args, "-v", mount, "-w", "/workspace")
+	}
+	args = append(args, rt.image)
+	args = append(args, rt.cmd...)
+
+	runCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, t.docker, args...)
+	cmd.Stdin = strings.NewReader(in.Code)
+	cmd.Env = toolProcessEnv(ctx)
+	stdout, stderr := &cappedBuffer{max: maxToolOutput}, &cappedBuffer{max: maxToolOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+
+	// Killing the docker client does not stop the container.
+	if runCtx.Err() != nil {
+		exec.Command(t.docker, "rm", "-f", name).Run()
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return fmt.Sprintf("timed out after %s\nstdout:\n%s\nstderr:\n%s", t.timeout, stdout, stderr), nil
+	}
+	code := 0
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		code = ee.ExitCode()
+	} else if err != nil {
+		return "", fmt.Errorf("running %s: %v", t.docker, err)
+	}
+	return fmt.Sprintf("exit code: %d\nstdout:\n%s\nstderr:\n%s", code, stdout, stderr), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// runLog keeps the diagnostics printed during one run, so the JSON result
+// can carry them in its logs channel.
+type runLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+type runLogKey struct{}
+
+// withRunLog attaches a run's log for logf.
+func withRunLog(ctx context.Context, l *runLog) context.Context {
+	return context.WithValue(ctx, runLogKey{}, l)
+}
+
+// logf prints a status line and records it in the run's log.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	statusf("[Sub-Agent] %s\n", msg)
+	if l, _ := ctx.Value(runLogKey{}).(*runLog); l != nil {
+		l.mu.Lock()
+		l.lines = append(l.lines, msg)
+		l.mu.Unlock()
+	}
+}
+
+// progressf prints a --verbose progress line.
+func progressf(format string, args ...interface{}) {
+	if verbose {
+		statusf("[Sub-Agent] "+format+"\n", args...)
+	}
+}
+
+func (l *runLog) entries() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
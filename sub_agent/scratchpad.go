@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Scratchpad limits; the notes are repeated in every prompt.
+const (
+	maxScratchpadNotes = 64
+	maxScratchpadValue = 4 << 10
+)
+
+// scratchpad is the per-run key-value notes behind the scratchpad tool.
+type scratchpad struct {
+	mu    sync.Mutex
+	notes map[string]string
+}
+
+func newScratchpad(notes map[string]string) *scratchpad {
+	p := &scratchpad{notes: map[string]string{}}
+	for k, v := range notes {
+		p.notes[k] = v
+	}
+	return p
+}
+
+// snapshot returns a copy of the notes, nil when there are none.
+func (p *scratchpad) snapshot() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.notes) == 0 {
+		return nil
+	}
+	notes := make(map[string]string, len(p.notes))
+	for k, v := range p.notes {
+		notes[k] = v
+	}
+	return notes
+}
+
+func (p *scratchpad) keys() []string {
+	var keys []string
+	for k := range p.notes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// render lists the notes for the end of each tool-loop prompt, where every
+// context strategy keeps them even if the conversation above is trimmed.
+func (p *scratchpad) render() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.notes) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\n[Your scratchpad notes]\n")
+	for _, k := range p.keys() {
+		fmt.Fprintf(&b, "%s: %s\n", k, p.notes[k])
+	}
+	return b.String()
+}
+
+type scratchpadKey struct{}
+
+// withScratchpad attaches a run's scratchpad for the scratchpad tool.
+func withScratchpad(ctx context.Context, p *scratchpad) context.Context {
+	return context.WithValue(ctx, scratchpadKey{}, p)
+}
+
+// scratchpadTool reads and writes the scratchpad of the run calling it. The
+// notes live with the run, not the tool, since a runner serves many runs.
+type scratchpadTool struct{}
+
+func newScratchpadTool(string) (tool, error) {
+	return scratchpadTool{}, nil
+}
+
+func (scratchpadTool) spec() toolSpec {
+	return toolSpec{
+		Name: "scratchpad",
+		Description: fmt.Sprintf("Keep working notes for this task: set stores a value under a key, get reads one, delete removes one and list shows every key. Your notes are shown at the end of each prompt, so record findings here instead of relying on earlier messages. At most %d notes of %d bytes each.",
+			maxScratchpadNotes, maxScratchpadValue),
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"action":{"type":"string","enum":["set","get","delete","list"]},"key":{"type":"string"},"value":{"type":"string"}},"required":["action"]}`),
+	}
+}
+
+func (scratchpadTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	var in struct {
+		Action string `json:"action"`
+		Key    string `json:"key"`
+		Value  string `json:"value"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", fmt.Errorf("invalid input: %v", err)
+	}
+	p, _ := ctx.Value(scratchpadKey{}).(*scratchpad)
+	if p == nil {
+		return "", fmt.Errorf("no scratchpad for this run")
+	}
+	key := strings.TrimSpace(in.Key)
+	if in.Action != "list" && key == "" {
+		return "", fmt.Errorf("%s needs a key", in.Action)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch in.Action {
+	case "set":
+		if len(in.Value) > maxScratchpadValue {
+			return "", fmt.Errorf("value is %d bytes; the limit is %d", len(in.Value), maxScratchpadValue)
+		}
+		if _, ok := p.notes[key]; !ok && len(p.notes) >= maxScratchpadNotes {
+			return "", fmt.Errorf("scratchpad is full (%d notes); delete some first", maxScratchpadNotes)
+		}
+		p.notes[key] = in.Value
+		return "Saved " + key + ".", nil
+	case "get":
+		v, ok := p.notes[key]
+		if !ok {
+			return "", fmt.Errorf("no note named %q", key)
+		}
+		return v, nil
+	case "delete":
+		if _, ok := p.notes[key]; !ok {
+			return "", fmt.Errorf("no note named %q", key)
+		}
+		delete(p.notes, key)
+		return "Deleted " + key + ".", nil
+	case "list":
+		if len(p.notes) == 0 {
+			return "The scratchpad is empty.", nil
+		}
+		return strings.Join(p.keys(), "\n"), nil
+	}
+	return "", fmt.Errorf("unknown action %q: expected set, get, delete or list", in.Action)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultSecretRefresh is how long a resolved secret reference is used
+// before it is fetched again, so rotated values are picked up without a
+// restart. Vault leases shorter than this win.
+const defaultSecretRefresh = 5 * time.Minute
+
+// secretRef is a resolved reference and when it must be fetched again.
+type secretRef struct {
+	value   string
+	expires time.Time
+}
+
+var secretRefs = map[string]secretRef{} // guarded by secretsMu
+
+// isSecretRef reports whether v is a vault:// or exec: reference rather
+// than a literal value.
+func isSecretRef(v string) bool {
+	return strings.HasPrefix(v, "vault://") || strings.HasPrefix(v, "exec:")
+}
+
+// configSecret resolves the reference configured for name in the "secrets"
+// config section. A failed refresh keeps serving the previous value so a
+// blip in the backend does not fail every task.
+func configSecret(name string) (string, error) {
+	ref, ok := liveConfig().Secrets[name]
+	if !ok {
+		return "", nil
+	}
+	if !isSecretRef(ref) {
+		registerSecret(ref)
+		return ref, nil
+	}
+
+	secretsMu.Lock()
+	cached, ok := secretRefs[name]
+	secretsMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	value, ttl, err := resolveSecretRef(context.Background(), ref)
+	if err != nil {
+		if ok {
+			fmt.Fprintf(os.Stderr, "[Sub-Agent] Warning: refreshing secret %s: %v; keeping previous value\n", name, err)
+			return cached.value, nil
+		}
+		return "", fmt.Errorf("secret %s: %v", name, err)
+	}
+	registerSecret(value)
+
+	refresh := defaultSecretRefresh
+	if s := liveConfig().SecretRefresh; s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			refresh = d
+		}
+	}
+	if ttl > 0 && ttl < refresh {
+		refresh = ttl
+	}
+	secretsMu.Lock()
+	secretRefs[name] = secretRef{value: value, expires: time.Now().Add(refresh)}
+	secretsMu.Unlock()
+	return value, nil
+}
+
+// prefetchSecrets resolves every configured reference so that serve and
+// worker fail at startup rather than on their first task.
+func prefetchSecrets() error {
+	for name := range liveConfig().Secrets {
+		if _, err := configSecret(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveSecretValue returns v, or what it refers to if it is a secret
+// reference; either way the value is masked in output from then on.
+func resolveSecretValue(v string) (string, error) {
+	if isSecretRef(v) {
+		var err error
+		if v, _, err = resolveSecretRef(context.Background(), v); err != nil {
+			return "", err
+		}
+	}
+	registerSecret(v)
+	return v, nil
+}
+
+// resolveSecretRef fetches a vault://path#field or exec:command reference,
+// returning the value and, for Vault, the lease duration.
+func resolveSecretRef(ctx context.Context, ref string) (string, time.Duration, error) {
+	if cmdline, ok := strings.CutPrefix(ref, "exec:"); ok {
+		v, err := execSecret(ctx, cmdline)
+		return v, 0, err
+	}
+	path, field, _ := strings.Cut(strings.TrimPrefix(ref, "vault://"), "#")
+	return vaultSecret(ctx, path, field)
+}
+
+// execSecret runs cmdline through the shell and uses its trimmed stdout.
+func execSecret(ctx context.Context, cmdline string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdline)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running secret command: %v", err)
+	}
+	v := strings.TrimSpace(string(out))
+	if v == "" {
+		return "", fmt.Errorf("secret command printed nothing")
+	}
+	return v, nil
+}
+
+type vaultResponse struct {
+	Data          map[string]any `json:"data"`
+	LeaseDuration int            `json:"lease_duration"`
+	Errors        []string       `json:"errors"`
+}
+
+// vaultSecret reads field from the Vault secret at path, using VAULT_ADDR,
+// VAULT_TOKEN (or ~/.vault-token) and VAULT_NAMESPACE. KV version 2
+// responses, which nest the values under data.data, are unwrapped. field may
+// be omitted when the secret has a single key.
+func vaultSecret(ctx context.Context, path, field string) (string, time.Duration, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", 0, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	if token == "" {
+		return "", 0, fmt.Errorf("no Vault token. Set VAULT_TOKEN or run `vault login`")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("connecting to Vault: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var vr vaultResponse
+	json.Unmarshal(body, &vr)
+	if resp.StatusCode != http.StatusOK {
+		if len(vr.Errors) > 0 {
+			return "", 0, fmt.Errorf("vault returned %s for %s: %s", resp.Status, path, strings.Join(vr.Errors, "; "))
+		}
+		return "", 0, fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	data := vr.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, kv2 := data["metadata"]; kv2 {
+			data = inner
+		}
+	}
+	if field == "" {
+		if len(data) != 1 {
+			return "", 0, fmt.Errorf("vault secret %s has %d keys; name one with #field", path, len(data))
+		}
+		for k := range data {
+			field = k
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok || v == "" {
+		return "", 0, fmt.Errorf("vault secret %s has no string field %q", path, field)
+	}
+	return v, time.Duration(vr.LeaseDuration) * time.Second, nil
+}
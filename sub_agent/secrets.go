@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// keyringService is the service name entries are stored under in the OS
+// keyring; the account is the secret's name (e.g. "gemini", "openrouter").
+const keyringService = "helix"
+
+// keyFlags are the Gemini key flags shared by every mode.
+type keyFlags struct {
+	key  *string
+	file *string
+}
+
+func addKeyFlags(fs *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		key:  fs.String("api-key", "", "Gemini API Key (visible in process listings; prefer --api-key-file, GEMINI_API_KEY or 'helix auth login')"),
+		file: fs.String("api-key-file", "", "File containing the Gemini API Key"),
+	}
+}
+
+// resolve returns the Gemini key given by --api-key or --api-key-file. An
+// empty key means geminiKey looks it up per call, which lets referenced
+// secrets rotate.
+func (kf *keyFlags) resolve() (string, error) {
+	if *kf.key != "" {
+		registerSecret(*kf.key)
+		return *kf.key, nil
+	}
+	if *kf.file != "" {
+		return readSecretFile(*kf.file)
+	}
+	return "", nil
+}
+
+// geminiKey returns explicit if set, otherwise the next of gemini.keys or,
+// without them, the "gemini" secret.
+func geminiKey(explicit string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+	if len(geminiConfig().Keys) > 0 {
+		return rotatedGeminiKey()
+	}
+	return lookupSecret("gemini", "GEMINI_API_KEY")
+}
+
+var (
+	secretsMu   sync.Mutex
+	secrets     = map[string]bool{}
+	secretCache = map[string]string{}
+)
+
+// lookupSecret finds a named secret in the environment variable env, the
+// "secrets" config section (which may hold vault:// or exec: references), a
+// systemd credential called name ($CREDENTIALS_DIRECTORY/name), or the OS
+// keyring, in that order. Results are cached and registered for redaction.
+// A secret that is not found anywhere is "" without an error.
+func lookupSecret(name, env string) (string, error) {
+	if env != "" {
+		if v := os.Getenv(env); v != "" {
+			registerSecret(v)
+			return v, nil
+		}
+	}
+	if _, ok := liveConfig().Secrets[name]; ok {
+		return configSecret(name)
+	}
+
+	secretsMu.Lock()
+	v, ok := secretCache[name]
+	secretsMu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		v, _ = readSecretFile(filepath.Join(dir, name))
+	}
+	if v == "" {
+		v, _ = keyringGet(name)
+		registerSecret(v)
+	}
+	secretsMu.Lock()
+	secretCache[name] = v
+	secretsMu.Unlock()
+	return v, nil
+}
+
+// readSecretFile reads a single secret from path, dropping surrounding whitespace.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading secret: %v", err)
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	registerSecret(v)
+	return v, nil
+}
+
+// registerSecret marks v to be scrubbed by redact. Short values are ignored
+// so that redaction cannot mangle ordinary words.
+func registerSecret(v string) {
+	if len(v) < 8 {
+		return
+	}
+	secretsMu.Lock()
+	secrets[v] = true
+	secretsMu.Unlock()
+}
+
+// redact replaces every registered secret in s.
+func redact(s string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for v := range secrets {
+		s = strings.ReplaceAll(s, v, "[REDACTED]")
+	}
+	return s
+}
+
+// redactErr returns err with any registered secrets removed from its message.
+func redactErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := redact(err.Error()); msg != err.Error() {
+		if kind := errorKind(err); kind != "" {
+			return &TaskError{Kind: kind, Err: errors.New(msg), RetryAfter: retryAfter(err)}
+		}
+		return errors.New(msg)
+	}
+	return err
+}
+
+// keyringGet reads a secret from the macOS Keychain or, elsewhere, the
+// Secret Service via secret-tool.
+func keyringGet(name string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", name, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", name)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keyring lookup for %s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func keyringSet(name, secret string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		// -U updates an existing entry instead of failing.
+		cmd = exec.Command("security", "add-generic-password", "-U", "-s", keyringService, "-a", name, "-w", secret)
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label", "helix "+name, "service", keyringService, "account", name)
+		cmd.Stdin = strings.NewReader(secret)
+	}
+	return runKeyring(cmd, "store", name)
+}
+
+func keyringDelete(name string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", name)
+	} else {
+		cmd = exec.Command("secret-tool", "clear", "service", keyringService, "account", name)
+	}
+	return runKeyring(cmd, "delete", name)
+}
+
+func runKeyring(cmd *exec.Cmd, action, name string) error {
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("keyring %s for %s: %v: %s", action, name, err, redact(msg))
+	}
+	return fmt.Errorf("keyring %s for %s: %v", action, name, err)
+}
+
+// authLoginCommand implements `auth login`, which stores a provider key in
+// the OS keyring.
+func authLoginCommand(fs *flag.FlagSet) func(args []string) {
+	prov := addAuthProviderFlag(fs)
+	return func([]string) {
+		name := secretName(*prov)
+		key, err := readKeyFromStdin(fmt.Sprintf("Enter %s API key: ", name))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := keyringSet(name, key); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[Sub-Agent] Stored %s key in the keyring\n", name)
+	}
+}
+
+// authLogoutCommand implements `auth logout`.
+func authLogoutCommand(fs *flag.FlagSet) func(args []string) {
+	prov := addAuthProviderFlag(fs)
+	return func([]string) {
+		name := secretName(*prov)
+		if err := keyringDelete(name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[Sub-Agent] Removed %s key from the keyring\n", name)
+	}
+}
+
+func addAuthProviderFlag(fs *flag.FlagSet) *string {
+	return fs.String("provider", "cloud", "Provider whose key to store: 'cloud' (Gemini), 'local' (Ollama behind an authenticating proxy) or an OpenAI-compatible adapter")
+}
+
+// secretName maps a provider to the name its key is stored under.
+func secretName(providerName string) string {
+	switch providerName {
+	case "cloud":
+		return "gemini"
+	case "local":
+		return "ollama"
+	}
+	return providerName
+}
+
+// readKeyFromStdin reads one line from stdin, turning off terminal echo
+// while the user types.
+func readKeyFromStdin(prompt string) (string, error) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, prompt)
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading key: %v", err)
+	}
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return "", fmt.Errorf("no key entered")
+	}
+	return key, nil
+}
+
+// stty changes the terminal settings of stdin.
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
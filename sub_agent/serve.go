@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server is the HTTP front end of `serve`.
+type server struct {
+	drain  *drainer
+	queue  *taskQueue // optional; receives tasks cut off by shutdown
+	runner *runner
+	tasks  *taskRegistry
+	ready  *readiness
+	idem   *idempotencyStore // nil when server.idempotency_window is 0
+
+	// tenants and admin are replaced when the config is reloaded.
+	authMu  sync.RWMutex
+	tenants []*tenant // empty disables auth
+	admin   *[32]byte // hash of the admin token; nil disables /admin
+
+	socketAuth bool // the daemon, where the socket's mode is the only auth
+
+	// postSteps are the post-processors a request's "post" may use.
+	postSteps map[string]bool
+}
+
+// serveCommand implements `serve`: an HTTP task API, synchronous or async. SIGHUP or
+// a config file change reloads the config; on SIGINT/SIGTERM
+// it stops accepting tasks, lets in-flight generations finish up to the drain
+// timeout, and spools anything still running into --queue-dir if configured.
+func serveCommand(fs *flag.FlagSet) func(args []string) {
+	addr := fs.String("addr", ":8080", "Address to listen on: host:port, or unix:///path/to/helix.sock for a unix socket (unused when systemd passes a socket)")
+	drainTimeout := fs.Duration("drain-timeout", 30*time.Second, "How long in-flight tasks may run after shutdown starts")
+	queueDir := fs.String("queue-dir", "", "Queue directory where unfinished tasks are persisted on shutdown")
+	heartbeat := fs.Duration("heartbeat", 30*time.Second, "How often to print the progress of running tasks (0 disables)")
+	keepResults := fs.Duration("keep-results", time.Hour, "How long the results of async tasks stay available after they finish")
+	readyProviders := fs.String("ready-providers", "", "Comma-separated providers /readyz must reach (default: local plus every configured provider)")
+	configPoll := fs.Duration("config-poll", configPollInterval, "How often to check the config file for changes to apply without a restart (0 only reloads on SIGHUP or POST /admin/reload)")
+	requestPost := fs.String("request-post", "", "Comma-separated post-processors a request's \"post\" may use, e.g. extract-code,trim-lines (none by default; exec is never allowed)")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+
+		providers := configuredProviders(key)
+		if *readyProviders != "" {
+			providers = nil
+			for _, p := range strings.Split(*readyProviders, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					providers = append(providers, p)
+				}
+			}
+		}
+		window, err := parseIdempotencyWindow(config.Server.IdempotencyWindow)
+		if err != nil {
+			fatal(configError(err))
+		}
+		postSteps, err := parsePostSteps(*requestPost)
+		if err != nil {
+			fatal(configError(err))
+		}
+		s := &server{drain: newDrainer(), runner: r, tasks: newTaskRegistry(*keepResults), ready: &readiness{providers: providers, key: key}, idem: newIdempotencyStore(window), postSteps: postSteps}
+		if err := s.loadAuth(); err != nil {
+			fatal(configError(err))
+		}
+		if *queueDir != "" {
+			q, err := openQueue(*queueDir)
+			if err != nil {
+				fatal(configError(err))
+			}
+			s.queue = q
+		}
+
+		ln, where, err := listenService(*addr)
+		if err != nil {
+			fatal(configError(err))
+		}
+		s.serve(ln, where, *drainTimeout, *heartbeat, *configPoll)
+	}
+}
+
+// serve answers the task API on ln until SIGINT or SIGTERM, then drains.
+func (s *server) serve(ln net.Listener, addr string, drainTimeout, heartbeat, configPoll time.Duration) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reload", s.handleReload)
+	mux.HandleFunc("/admin/", s.handleAdmin)
+	mux.HandleFunc("/v1/tasks", s.handleTasks)
+	mux.HandleFunc("/v1/tasks/", s.handleTask)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	srv := &http.Server{Handler: versionHeader(mux)}
+
+	sigCtx, stop := shutdownSignal()
+	defer stop()
+	go s.tasks.heartbeat(sigCtx, heartbeat)
+	go watchConfig(sigCtx, configPoll, s.applyReload)
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go sdWatchdog(watchdogCtx)
+
+	errCh := make(chan error, 1)
+	go func() {
+		fmt.Printf("[Sub-Agent] Serving on %s\n", addr)
+		errCh <- srv.Serve(ln)
+	}()
+	// The listener is bound, so requests queue from here on.
+	sdNotify("READY=1")
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case <-sigCtx.Done():
+	}
+
+	fmt.Printf("[Sub-Agent] Shutting down, draining in-flight tasks (up to %s)\n", drainTimeout)
+	sdNotify("STOPPING=1")
+	// Draining and listener shutdown run side by side: requests that race the
+	// shutdown get a 503 while in-flight handlers finish their generations.
+	drained := make(chan bool, 1)
+	go func() { drained <- s.drain.drain(drainTimeout) }()
+
+	// Handlers return promptly once their work is cancelled, so doubling the
+	// drain timeout is enough for them to write their responses.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("Error: shutting down: %v\n", err)
+	}
+	if !<-drained {
+		fmt.Println("[Sub-Agent] Drain timeout reached; unfinished tasks were cancelled")
+	}
+}
+
+// handleTasks serves POST /v1/tasks. With ?async=true the task runs in the
+// background and the response is its ID, to poll with GET /v1/tasks/{id};
+// with ?stream=true or Accept: text/event-stream its events are streamed.
+func (s *server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	t, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	limits := liveConfig().Server.Limits
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limits.bodyBytes()))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, LimitError{
+				Error:     fmt.Sprintf("the request body is over the server's limit of %d bytes", tooBig.Limit),
+				ErrorKind: ErrTooLarge, Limit: "max_body_bytes", Max: tooBig.Limit, Actual: r.ContentLength,
+			})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("reading request body: %v", err)})
+		return
+	}
+	var req TaskRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if req.Contract != nil {
+		if err := applyContract(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if req.Task == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "task or contract is required"})
+		return
+	}
+	if err := s.vetRequest(&req, t); err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	if le := limits.check(&req, s.runner.maxToolSteps); le != nil {
+		writeJSON(w, le.status(), le)
+		return
+	}
+	async := r.URL.Query().Get("async") == "true"
+	stream := r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if async && stream {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "async and streamed responses are exclusive; poll GET /v1/tasks/{id} for async progress"})
+		return
+	}
+
+	// A retried request with the same Idempotency-Key gets the first
+	// response, waiting for it if the first is still running. The task
+	// then outlives a disconnecting client, whose retry will want it.
+	key := r.Header.Get("Idempotency-Key")
+	idempotent := key != "" && s.idem != nil
+	if idempotent {
+		if len(key) > maxIdempotencyKey {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Idempotency-Key is longer than %d bytes", maxIdempotencyKey)})
+			return
+		}
+		tenantName := ""
+		if t != nil {
+			tenantName = t.Name
+		}
+		e, first, err := s.idem.begin(tenantName, key, append([]byte(r.URL.RawQuery+"\n"), raw...))
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		if !first {
+			select {
+			case <-e.done:
+				e.replay(w)
+			case <-r.Context().Done():
+			}
+			return
+		}
+		rec := &recordingWriter{ResponseWriter: w}
+		defer s.idem.finish(tenantName, key, e, rec)
+		w = rec
+	}
+	if req.ID == "" {
+		req.ID = newID()
+	} else if async && s.tasks.has(req.ID) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "task " + req.ID + " already exists"})
+		return
+	}
+	req.Tenant = ""
+	if t != nil {
+		if wait, ok := t.reserve(time.Now()); !ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "quota exceeded for tenant " + t.Name})
+			return
+		}
+		req.Tenant, req.allow = t.Name, t.allow
+	}
+
+	// A disconnecting client cancels its own task, unless it is async; the
+	// drainer cancels everything still running once the drain timeout expires.
+	parent := r.Context()
+	if async || idempotent {
+		parent = context.Background()
+	}
+	ctx, done, ok := s.drain.begin(parent)
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server is shutting down"})
+		return
+	}
+	ctx, tracker := s.tasks.start(ctx, req.ID, req.Tenant)
+	ctx = withApprover(ctx, tracker.awaitApproval)
+	ctx = withCommandConfirmer(ctx, tracker.confirmCommand)
+	if async {
+		go func() {
+			defer done()
+			defer tracker.cancel()
+			s.execute(ctx, t, req, tracker)
+		}()
+		w.Header().Set("Location", "/v1/tasks/"+req.ID)
+		writeJSON(w, http.StatusAccepted, tracker.snapshot())
+		return
+	}
+	defer done()
+	defer s.tasks.finish(tracker)
+	if stream {
+		// The answer's text and tool calls as server-sent events, then the
+		// response body as a result (or error) event.
+		sse := newSSEWriter(w)
+		ctx = withEvents(ctx, func(e TaskEvent) { sse.send(e.Type, e) })
+		status, body := s.execute(ctx, t, req, tracker)
+		if status == http.StatusOK {
+			res := body.(TaskResult)
+			sse.send(EventResult, TaskEvent{Type: EventResult, Result: &res})
+		} else {
+			sse.send("error", body)
+		}
+		return
+	}
+	status, body := s.execute(ctx, t, req, tracker)
+	writeJSON(w, status, body)
+}
+
+// vetRequest refuses what a task API request may not ask for of the
+// server: post-processors beyond --request-post, tool environment beyond
+// server.request_env and tool profiles beyond server.request_tool_profiles.
+// It marks req as remote; t, when set, is its tenant.
+func (s *server) vetRequest(req *TaskRequest, t *tenant) error {
+	if err := checkRequestPost(req.Post, s.postSteps); err != nil {
+		return err
+	}
+	sc := liveConfig().Server
+	if t != nil && t.ToolProfile != "" {
+		req.ToolProfile, req.toolCeiling = t.ToolProfile, t.ToolProfile
+	} else if req.ToolProfile != "" && !slices.Contains(sc.RequestToolProfiles, req.ToolProfile) {
+		return fmt.Errorf("tool profile %s can't be set by a request (see server.request_tool_profiles)", req.ToolProfile)
+	}
+	if req.Contract != nil {
+		if err := checkRequestEnv(req.Contract.Env, sc.RequestEnv); err != nil {
+			return err
+		}
+	}
+	req.remote = true
+	return nil
+}
+
+// execute runs req, records its outcome on tracker and returns the HTTP
+// status and body that report it.
+func (s *server) execute(ctx context.Context, t *tenant, req TaskRequest, tracker *progressTracker) (int, interface{}) {
+	res, err := s.runner.run(ctx, req)
+	if t != nil {
+		t.record(estimateTokens(req.Task) + estimateTokens(req.Input) + estimateTokens(res.Output))
+	}
+	if err != nil && s.drain.aborted() {
+		body := map[string]string{"id": req.ID, "error": "task interrupted by shutdown"}
+		status := StatusFailed
+		if s.queue != nil {
+			if _, qerr := s.queue.enqueue(req); qerr == nil {
+				body["status"], status = "requeued", StatusRequeued
+			} else {
+				fmt.Printf("Error: %v\n", qerr)
+			}
+		}
+		res.Error = body["error"]
+		tracker.complete(status, &res)
+		return http.StatusServiceUnavailable, body
+	}
+	if err != nil && tracker.wasCancelled() {
+		res.Error = "task cancelled"
+		tracker.complete(StatusCancelled, &res)
+		return http.StatusConflict, res
+	}
+	if err != nil {
+		tracker.complete(StatusFailed, &res)
+		if errors.Is(err, errNotAllowed) || errors.Is(err, errPlanRejected) {
+			return http.StatusForbidden, res
+		}
+		return http.StatusBadGateway, res
+	}
+	tracker.complete(StatusSucceeded, &res)
+	return http.StatusOK, res
+}
+
+// handleTask serves /v1/tasks/{id}: GET reports the progress of a task, and
+// its result once an async task has finished; DELETE cancels a running task,
+// or forgets a finished one. POST /v1/tasks/{id}/approve or /reject decides
+// on a plan awaiting approval.
+func (s *server) handleTask(w http.ResponseWriter, r *http.Request) {
+	if id, decision, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/tasks/"), "/"); ok {
+		s.handleApproval(w, r, id, decision)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	t, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/tasks/")
+	tracker := s.tasks.get(id)
+	// Another tenant's task is reported as missing, not as forbidden.
+	if tracker == nil || (t != nil && tracker.tenant != t.Name) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no task " + id})
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, tracker.snapshot())
+		return
+	}
+	if tracker.stop() {
+		writeJSON(w, http.StatusAccepted, tracker.snapshot())
+		return
+	}
+	s.tasks.finish(tracker)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleApproval(w http.ResponseWriter, r *http.Request, id, decision string) {
+	if decision != "approve" && decision != "reject" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	t, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	tracker := s.tasks.get(id)
+	if tracker == nil || (t != nil && tracker.tenant != t.Name) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no task " + id})
+		return
+	}
+	if !tracker.decide(decision == "approve") {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "task " + id + " is not awaiting approval"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "decision": decision + "d"})
+}
+
+// handleHealth serves /healthz: the process is up and serving. It needs no
+// token, like /readyz, so probes can reach it.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady serves /readyz: 200 when every readiness provider answers a
+// preflight, 503 with per-provider status when one doesn't or while
+// draining.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.drain.isDraining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	checks, ok := s.ready.check(r.Context())
+	body := map[string]interface{}{"status": "ready", "providers": checks}
+	status := http.StatusOK
+	if !ok {
+		body["status"], status = "not ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, body)
+}
+
+// authenticate returns the caller's tenant, or nil when auth is disabled.
+// ok is false once it has written a 401.
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) (t *tenant, ok bool) {
+	s.authMu.RLock()
+	tenants := s.tenants
+	s.authMu.RUnlock()
+	if len(tenants) == 0 {
+		return nil, true
+	}
+	if t = authenticate(tenants, r); t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="helix"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid bearer token"})
+		return nil, false
+	}
+	return t, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
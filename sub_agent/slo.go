@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SLOConfig sets latency objectives for provider calls. Every call's
+// first-token (streamed calls only) and total latency is kept per
+// provider/model for Window; once a model has MinSamples calls, a
+// percentile over a target logs a warning and posts to Webhook, and so
+// does its recovery.
+type SLOConfig struct {
+	Window     string `json:"window,omitempty"`      // default 15m
+	MinSamples int    `json:"min_samples,omitempty"` // default 20
+	// Webhook receives a JSON SLOAlert on every breach and recovery; it
+	// may be a secret reference.
+	Webhook string `json:"webhook,omitempty"`
+	// Targets are keyed by provider, or by a provider/model glob such as
+	// "cloud/gemini-*"; a model may match several.
+	Targets map[string]SLOTarget `json:"targets,omitempty"`
+}
+
+// SLOTarget is the latencies, as durations such as "1.5s", a model's
+// calls should stay under; unset ones aren't checked.
+type SLOTarget struct {
+	FirstTokenP50 string `json:"first_token_p50,omitempty"`
+	FirstTokenP95 string `json:"first_token_p95,omitempty"`
+	TotalP50      string `json:"total_p50,omitempty"`
+	TotalP95      string `json:"total_p95,omitempty"`
+}
+
+// SLOAlert is what the webhook is sent.
+type SLOAlert struct {
+	Event       string    `json:"event"` // slo_breached or slo_recovered
+	Model       string    `json:"model"` // provider/model
+	Target      string    `json:"target"`
+	Metric      string    `json:"metric"` // e.g. first_token_p95
+	ThresholdMS int64     `json:"threshold_ms"`
+	ObservedMS  int64     `json:"observed_ms"`
+	Samples     int       `json:"samples"`
+	Window      string    `json:"window"`
+	Time        time.Time `json:"time"`
+
+	threshold, observed time.Duration
+}
+
+// LatencyStats is a model's latency over the window, as GET /admin/latency
+// reports it.
+type LatencyStats struct {
+	Model           string   `json:"model"`
+	Calls           int      `json:"calls"`
+	FirstTokenCalls int      `json:"first_token_calls"` // streamed calls
+	FirstTokenP50MS int64    `json:"first_token_p50_ms"`
+	FirstTokenP95MS int64    `json:"first_token_p95_ms"`
+	TotalP50MS      int64    `json:"total_p50_ms"`
+	TotalP95MS      int64    `json:"total_p95_ms"`
+	Breached        []string `json:"breached,omitempty"` // target:metric
+}
+
+const (
+	defaultSLOWindow     = 15 * time.Minute
+	defaultSLOMinSamples = 20
+	// maxLatencySamples bounds the memory of a busy model's window.
+	maxLatencySamples = 2000
+)
+
+// latency is the process's latency tracker.
+var latency = &latencyTracker{samples: map[string][]latencySample{}, breached: map[string]bool{}}
+
+type latencySample struct {
+	at         time.Time
+	firstToken time.Duration // 0 when the call didn't stream
+	total      time.Duration
+}
+
+type latencyTracker struct {
+	mu       sync.Mutex
+	samples  map[string][]latencySample // by provider/model
+	breached map[string]bool            // model|target|metric
+}
+
+// validateSLOConfig checks the durations and globs of c.
+func validateSLOConfig(c SLOConfig) error {
+	if c.Window != "" {
+		if d, err := time.ParseDuration(c.Window); err != nil || d <= 0 {
+			return fmt.Errorf("slo.window: invalid duration %q", c.Window)
+		}
+	}
+	if c.MinSamples < 0 {
+		return fmt.Errorf("slo.min_samples must not be negative")
+	}
+	for key, t := range c.Targets {
+		if _, err := path.Match(key, ""); err != nil {
+			return fmt.Errorf("slo.targets: invalid pattern %q", key)
+		}
+		for metric, v := range t.thresholds() {
+			if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+				return fmt.Errorf("slo.targets.%s.%s: invalid duration %q", key, metric, v)
+			}
+		}
+	}
+	return nil
+}
+
+// thresholds are t's set targets by metric name.
+func (t SLOTarget) thresholds() map[string]string {
+	m := map[string]string{}
+	for metric, v := range map[string]string{"first_token_p50": t.FirstTokenP50, "first_token_p95": t.FirstTokenP95, "total_p50": t.TotalP50, "total_p95": t.TotalP95} {
+		if v != "" {
+			m[metric] = v
+		}
+	}
+	return m
+}
+
+// sloMatches reports whether an SLO target key covers model (provider/model).
+func sloMatches(key, model string) bool {
+	provider, _, _ := strings.Cut(model, "/")
+	if key == provider {
+		return true
+	}
+	ok, _ := path.Match(key, model)
+	return ok
+}
+
+func (c SLOConfig) window() time.Duration {
+	if d, err := time.ParseDuration(c.Window); err == nil && d > 0 {
+		return d
+	}
+	return defaultSLOWindow
+}
+
+// percentile is the nearest-rank p (0-100) of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i, 1)-1]
+}
+
+// latencies returns the sorted first-token and total latencies of samples.
+func latencies(samples []latencySample) (first, total []time.Duration) {
+	for _, s := range samples {
+		if s.firstToken > 0 {
+			first = append(first, s.firstToken)
+		}
+		total = append(total, s.total)
+	}
+	sort.Slice(first, func(i, j int) bool { return first[i] < first[j] })
+	sort.Slice(total, func(i, j int) bool { return total[i] < total[j] })
+	return first, total
+}
+
+// observe records a call to model and checks its SLOs.
+func (t *latencyTracker) observe(model string, firstToken, total time.Duration) {
+	c := liveConfig().SLO
+	now := time.Now()
+	window := c.window()
+
+	t.mu.Lock()
+	samples := append(t.samples[model], latencySample{now, firstToken, total})
+	drop := 0
+	for drop < len(samples) && (now.Sub(samples[drop].at) > window || len(samples)-drop > maxLatencySamples) {
+		drop++
+	}
+	samples = samples[drop:]
+	t.samples[model] = samples
+	if len(c.Targets) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	minSamples := c.MinSamples
+	if minSamples == 0 {
+		minSamples = defaultSLOMinSamples
+	}
+	first, all := latencies(samples)
+	var alerts []SLOAlert
+	for key, target := range c.Targets {
+		if !sloMatches(key, model) {
+			continue
+		}
+		for metric, v := range target.thresholds() {
+			threshold, _ := time.ParseDuration(v)
+			values, p := all, 50
+			if strings.HasPrefix(metric, "first_token") {
+				values = first
+			}
+			if strings.HasSuffix(metric, "p95") {
+				p = 95
+			}
+			if len(values) < minSamples {
+				continue
+			}
+			observed := percentile(values, p)
+			id := model + "|" + key + "|" + metric
+			if breached := observed > threshold; breached != t.breached[id] {
+				t.breached[id] = breached
+				event := "slo_recovered"
+				if breached {
+					event = "slo_breached"
+				}
+				alerts = append(alerts, SLOAlert{Event: event, Model: model, Target: key, Metric: metric, ThresholdMS: threshold.Milliseconds(),
+					ObservedMS: observed.Milliseconds(), Samples: len(values), Window: window.String(), Time: now.UTC(), threshold: threshold, observed: observed})
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, a := range alerts {
+		if a.Event == "slo_breached" {
+			statusf("[Sub-Agent] Warning: SLO breached: %s %s is %s, over the %s target (%d calls in %s)\n", a.Model, a.Metric,
+				a.observed.Round(time.Millisecond), a.threshold, a.Samples, a.Window)
+		} else {
+			statusf("[Sub-Agent] SLO recovered: %s %s is %s, within the %s target\n", a.Model, a.Metric, a.observed.Round(time.Millisecond), a.threshold)
+		}
+		if c.Webhook != "" {
+			go postSLOAlert(c.Webhook, a)
+		}
+	}
+}
+
+// postSLOAlert sends a to the webhook; failures are only logged.
+func postSLOAlert(webhook string, a SLOAlert) {
+	u, err := resolveSecretValue(webhook)
+	if err != nil {
+		statusf("[Sub-Agent] Warning: SLO webhook: %v\n", err)
+		return
+	}
+	data, _ := json.Marshal(a)
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Post(u, "application/json", bytes.NewReader(data))
+	if err != nil {
+		statusf("[Sub-Agent] Warning: SLO webhook: %v\n", redactErr(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		statusf("[Sub-Agent] Warning: SLO webhook: %s\n", resp.Status)
+	}
+}
+
+// stats reports every model's latency over the window, by model.
+func (t *latencyTracker) stats() []LatencyStats {
+	window := liveConfig().SLO.window()
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []LatencyStats{}
+	for model, samples := range t.samples {
+		var recent []latencySample
+		for _, s := range samples {
+			if now.Sub(s.at) <= window {
+				recent = append(recent, s)
+			}
+		}
+		if len(recent) == 0 {
+			continue
+		}
+		first, all := latencies(recent)
+		st := LatencyStats{Model: model, Calls: len(all), FirstTokenCalls: len(first),
+			FirstTokenP50MS: percentile(first, 50).Milliseconds(), FirstTokenP95MS: percentile(first, 95).Milliseconds(),
+			TotalP50MS: percentile(all, 50).Milliseconds(), TotalP95MS: percentile(all, 95).Milliseconds()}
+		for id, b := range t.breached {
+			if m, rest, _ := strings.Cut(id, "|"); b && m == model {
+				st.Breached = append(st.Breached, strings.Replace(rest, "|", ":", 1))
+			}
+		}
+		sort.Strings(st.Breached)
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
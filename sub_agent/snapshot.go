@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A workspace snapshot records the workspace before a run whose tools may
+// change it, so that `helix rollback` can put everything back in one go.
+// In a git work tree the snapshot is a commit under refs/helix/snapshots/
+// holding the working tree (untracked files included, ignored ones not),
+// plus the staged tree and HEAD; elsewhere the files are copied.
+// Manifests live in the state directory, not in the workspace.
+
+// maxSnapshots is how many snapshots are kept; older ones are dropped.
+const maxSnapshots = 50
+
+// maxCopySnapshotBytes bounds a copied snapshot: a workspace larger than
+// this, outside git, runs without one.
+const maxCopySnapshotBytes = 1 << 30
+
+// workspaceSnapshot is the manifest of one snapshot.
+type workspaceSnapshot struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	RunID     string    `json:"run_id,omitempty"`
+	Task      string    `json:"task,omitempty"`
+	Workspace string    `json:"workspace"` // absolute
+	// Commit (of the working tree), Index and Head are set for git
+	// snapshots; Head is empty in a repository without commits.
+	Commit string `json:"commit,omitempty"`
+	Index  string `json:"index,omitempty"`
+	Head   string `json:"head,omitempty"`
+	// Files counts a copied snapshot's files, kept in files/ beside it.
+	Files int `json:"files,omitempty"`
+}
+
+func snapshotsDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "snapshots"), nil
+}
+
+// snapshotWorkspace records the runner's workspace before req runs.
+func (r *runner) snapshotWorkspace(ctx context.Context, req TaskRequest) (string, error) {
+	ws, err := filepath.Abs(r.workspace)
+	if err != nil {
+		return "", err
+	}
+	root, err := snapshotsDir()
+	if err != nil {
+		return "", err
+	}
+	s := workspaceSnapshot{
+		ID:        fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405.000000"), newID()[:6]),
+		Time:      time.Now().UTC(),
+		RunID:     req.ID,
+		Task:      truncateRunes(req.Task, 200),
+		Workspace: ws,
+	}
+	dir := filepath.Join(root, s.ID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("creating snapshot: %v", err)
+	}
+	if inGitWorkTree(ws) {
+		err = snapshotGit(ws, &s)
+	} else {
+		s.Files, err = copyTree(ws, filepath.Join(dir, "files"), maxCopySnapshotBytes)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("snapshotting %s: %v", ws, err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "snapshot.json"), data); err != nil {
+		return "", err
+	}
+	pruneSnapshots(root)
+	logf(ctx, "Snapshot %s of %s taken; helix rollback restores it", s.ID, ws)
+	return s.ID, nil
+}
+
+// gitIn runs git in dir with extra environment, returning its trimmed output.
+func gitIn(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func inGitWorkTree(dir string) bool {
+	out, err := gitIn(dir, nil, "rev-parse", "--is-inside-work-tree")
+	return err == nil && out == "true"
+}
+
+// snapshotGit stages the workspace into a scratch index, leaving the real
+// index and HEAD alone, and pins the result with a ref so gc keeps it.
+func snapshotGit(ws string, s *workspaceSnapshot) error {
+	index, err := gitIn(ws, nil, "write-tree")
+	if err != nil {
+		return err
+	}
+	s.Index = index
+	s.Head, _ = gitIn(ws, nil, "rev-parse", "--verify", "-q", "HEAD")
+
+	tmp, err := os.CreateTemp("", "helix-index-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	env := []string{"GIT_INDEX_FILE=" + tmp.Name(),
+		"GIT_AUTHOR_NAME=helix", "GIT_AUTHOR_EMAIL=helix@localhost",
+		"GIT_COMMITTER_NAME=helix", "GIT_COMMITTER_EMAIL=helix@localhost"}
+	if _, err := gitIn(ws, env, "read-tree", index); err != nil {
+		return err
+	}
+	if _, err := gitIn(ws, env, "add", "-A", "--", "."); err != nil {
+		return err
+	}
+	tree, err := gitIn(ws, env, "write-tree")
+	if err != nil {
+		return err
+	}
+	if s.Commit, err = gitIn(ws, env, "commit-tree", tree, "-m", "helix snapshot "+s.ID); err != nil {
+		return err
+	}
+	_, err = gitIn(ws, nil, "update-ref", "refs/helix/snapshots/"+s.ID, s.Commit)
+	return err
+}
+
+// restoreGit makes the workspace, index and HEAD what they were.
+func restoreGit(s workspaceSnapshot) (restored, removed int, err error) {
+	ws := s.Workspace
+	if s.Head != "" {
+		if head, _ := gitIn(ws, nil, "rev-parse", "--verify", "-q", "HEAD"); head != s.Head {
+			if _, err := gitIn(ws, nil, "reset", "-q", "--soft", s.Head); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	want, err := gitIn(ws, nil, "ls-tree", "-r", "-z", "--name-only", s.Commit, "--", ".")
+	if err != nil {
+		return 0, 0, err
+	}
+	have, err := gitIn(ws, nil, "ls-files", "-z", "-c", "-o", "--exclude-standard", "--", ".")
+	if err != nil {
+		return 0, 0, err
+	}
+	keep := map[string]bool{}
+	for _, p := range strings.Split(want, "\x00") {
+		if p != "" {
+			keep[p] = true
+		}
+	}
+	for _, p := range strings.Split(have, "\x00") {
+		if p != "" && !keep[p] {
+			if err := os.Remove(filepath.Join(ws, p)); err == nil {
+				removed++
+			}
+		}
+	}
+	if len(keep) > 0 {
+		if _, err := gitIn(ws, nil, "checkout", s.Commit, "--", "."); err != nil {
+			return 0, removed, err
+		}
+	}
+	if _, err := gitIn(ws, nil, "read-tree", s.Index); err != nil {
+		return len(keep), removed, err
+	}
+	gitIn(ws, nil, "update-index", "-q", "--refresh")
+	return len(keep), removed, nil
+}
+
+// skipSnapshotDir reports whether a copied snapshot leaves out a directory.
+func skipSnapshotDir(name string) bool {
+	return name == ".git" || name == ".helix"
+}
+
+// copyTree copies the regular files and symlinks under src into dst,
+// failing once they add up to more than max bytes.
+func copyTree(src, dst string, max int64) (int, error) {
+	var n int
+	var total int64
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			if p != src && skipSnapshotDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			n++
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if total += fi.Size(); total > max {
+			return fmt.Errorf("the workspace is over %d MiB; use git or a smaller --workspace", max>>20)
+		}
+		n++
+		return copyFile(p, target, fi.Mode().Perm())
+	})
+	return n, err
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+// restoreCopy removes what wasn't in the workspace and copies the rest back.
+func restoreCopy(s workspaceSnapshot, dir string) (restored, removed int, err error) {
+	files := filepath.Join(dir, "files")
+	var extra []string
+	err = filepath.WalkDir(s.Workspace, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.Workspace, p)
+		if d.IsDir() {
+			if p != s.Workspace && skipSnapshotDir(d.Name()) {
+				return filepath.SkipDir
+			}
+		}
+		if rel == "." {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(files, rel)); os.IsNotExist(err) {
+			extra = append(extra, p)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range extra {
+		if err := os.RemoveAll(p); err != nil {
+			return 0, removed, err
+		}
+		removed++
+	}
+	err = filepath.WalkDir(files, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(files, p)
+		target := filepath.Join(s.Workspace, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		os.Remove(target)
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			restored++
+			return os.Symlink(link, target)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		restored++
+		return copyFile(p, target, fi.Mode().Perm())
+	})
+	return restored, removed, err
+}
+
+// listSnapshots returns the manifests under root, oldest first.
+func listSnapshots(root string) ([]workspaceSnapshot, error) {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []workspaceSnapshot
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(root, e.Name(), "snapshot.json"))
+		if err != nil {
+			continue
+		}
+		var s workspaceSnapshot
+		if json.Unmarshal(data, &s) == nil {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// dropSnapshot deletes a snapshot and, for git ones, its ref.
+func dropSnapshot(root string, s workspaceSnapshot) error {
+	if s.Commit != "" {
+		gitIn(s.Workspace, nil, "update-ref", "-d", "refs/helix/snapshots/"+s.ID)
+	}
+	return os.RemoveAll(filepath.Join(root, s.ID))
+}
+
+func pruneSnapshots(root string) {
+	all, err := listSnapshots(root)
+	if err != nil {
+		return
+	}
+	for len(all) > maxSnapshots {
+		dropSnapshot(root, all[0])
+		all = all[1:]
+	}
+}
+
+// rollbackCommand implements `rollback`: restore the workspace to how it
+// was before the latest run that snapshotted it. Repeating it walks
+// further back.
+func rollbackCommand(fs *flag.FlagSet) func(args []string) {
+	workspace := fs.String("workspace", ".", "Workspace to restore")
+	id := fs.String("id", "", "Snapshot or run ID to restore (default: the workspace's latest)")
+	list := fs.Bool("list", false, "List the workspace's snapshots, newest first")
+	return func([]string) {
+		ws, err := filepath.Abs(*workspace)
+		if err != nil {
+			fatal(configError(err))
+		}
+		root, err := snapshotsDir()
+		if err != nil {
+			fatal(configError(err))
+		}
+		all, err := listSnapshots(root)
+		if err != nil {
+			fatal(err)
+		}
+		var mine []workspaceSnapshot
+		for _, s := range all {
+			if s.Workspace == ws && (*id == "" || s.ID == *id || s.RunID == *id) {
+				mine = append(mine, s)
+			}
+		}
+		if *list {
+			for i := len(mine) - 1; i >= 0; i-- {
+				s := mine[i]
+				fmt.Printf("%s  %s  run %s  %s\n", s.ID, s.Time.Local().Format("2006-01-02 15:04:05"), s.RunID, s.Task)
+			}
+			return
+		}
+		if len(mine) == 0 {
+			if *id != "" {
+				fatal(kindError(ErrConfig, "no snapshot %s of %s", *id, ws))
+			}
+			fatal(kindError(ErrConfig, "no snapshots of %s", ws))
+		}
+		s := mine[len(mine)-1]
+		var restored, removed int
+		if s.Commit != "" {
+			restored, removed, err = restoreGit(s)
+		} else {
+			restored, removed, err = restoreCopy(s, filepath.Join(root, s.ID))
+		}
+		if err != nil {
+			fatal(fmt.Errorf("rolling back %s: %v", ws, err))
+		}
+		if err := dropSnapshot(root, s); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("[Sub-Agent] Restored %s to before run %s (%s): %d file(s) restored, %d removed\n",
+			ws, s.RunID, s.Time.Local().Format("2006-01-02 15:04:05"), restored, removed)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Quality gates for --speculate.
+const (
+	GateHeuristic = "heuristic" // cheap checks for empty, refused and degenerate answers
+	GateJudge     = "judge"     // a model grades the fast answer
+)
+
+// speculateConfig races a fast model against a strong one; the fast
+// answer is kept when it passes the gate, which saves waiting for the
+// strong one. enabled false disables it.
+type speculateConfig struct {
+	enabled bool
+	models  string // "fast,strong" as provider/model choices
+	gate    string
+	judge   string // provider/model for GateJudge; "" uses judge.model or the fast model
+}
+
+// Speculation reports a --speculate race.
+type Speculation struct {
+	Fast     string `json:"fast"`
+	Strong   string `json:"strong"`
+	Winner   string `json:"winner"` // "fast" or "strong"
+	Gate     string `json:"gate"`
+	Passed   bool   `json:"passed"`           // whether the fast answer passed the gate
+	Reason   string `json:"reason,omitempty"` // why it didn't, or why strong won
+	FastMS   int64  `json:"fast_ms,omitempty"`
+	StrongMS int64  `json:"strong_ms,omitempty"` // 0 when it was cancelled
+}
+
+func validGate(g string) bool { return g == GateHeuristic || g == GateJudge }
+
+// speculatePassScore is the overall judge score a fast answer needs.
+const speculatePassScore = 7
+
+var (
+	refusalRe = regexp.MustCompile(`(?i)^\W*(?:i(?:'m| am) (?:not sure|unable|sorry)|i (?:can(?:'|no)t|don't know|do not know|do not have)|as an ai\b|sorry,)`)
+	fenceRe   = regexp.MustCompile("(?m)^\\s*```")
+)
+
+// heuristicGate rejects answers that are obviously not worth keeping:
+// empty, refusing, cut off or stuck repeating itself.
+func heuristicGate(task, answer string) (bool, string) {
+	answer = strings.TrimSpace(answer)
+	switch {
+	case answer == "":
+		return false, "empty answer"
+	case refusalRe.MatchString(answer):
+		return false, "the answer refuses or hedges"
+	case len(fenceRe.FindAllString(answer, -1))%2 == 1:
+		return false, "unterminated code block"
+	case utf8.RuneCountInString(task) > 200 && len(strings.Fields(answer)) < 5:
+		return false, "the answer is too short for the task"
+	}
+	seen := map[string]int{}
+	for _, l := range strings.Split(answer, "\n") {
+		if l = strings.TrimSpace(l); utf8.RuneCountInString(l) < 20 {
+			continue
+		}
+		if seen[l]++; seen[l] >= 3 {
+			return false, "the answer repeats itself"
+		}
+	}
+	return true, ""
+}
+
+// raceResult is one side of the race.
+type raceResult struct {
+	answer string
+	res    TaskResult
+	err    error
+	took   time.Duration
+}
+
+// race sends prompt to the fast and strong models at once. A fast
+// answer that passes the gate is returned right away and the strong call is
+// cancelled; otherwise the strong answer is awaited. A strong answer that
+// arrives first wins outright. It returns the winning model.
+func (r *runner) race(ctx context.Context, req TaskRequest, prompt string, res *TaskResult) (string, modelChoice, error) {
+	cfg := r.speculate
+	if !validGate(cfg.gate) {
+		return "", modelChoice{}, kindError(ErrConfig, "invalid --speculate-gate %q: expected heuristic or judge", cfg.gate)
+	}
+	if req.Candidates > 1 || r.candidates.n > 1 {
+		return "", modelChoice{}, kindError(ErrConfig, "--speculate can't be combined with --candidates")
+	}
+	choices, err := parseModelChoices(cfg.models)
+	if err != nil {
+		return "", modelChoice{}, kindError(ErrConfig, "%v", err)
+	}
+	if len(choices) != 2 {
+		return "", modelChoice{}, kindError(ErrConfig, "--speculate-models takes two models, fast then strong, such as local,cloud")
+	}
+	var side [2]modelChoice
+	for i, c := range choices {
+		side[i].provider, side[i].model = withDefaults(c.provider, c.model, req)
+	}
+	sp := &Speculation{Fast: side[0].String(), Strong: side[1].String(), Gate: cfg.gate}
+	res.Speculation = sp
+
+	strongCtx, cancelStrong := context.WithCancel(ctx)
+	defer cancelStrong()
+	fastCtx, cancelFast := context.WithCancel(ctx)
+	defer cancelFast()
+	results := [2]chan raceResult{make(chan raceResult, 1), make(chan raceResult, 1)}
+	start := time.Now()
+	for i, c := range [2]context.Context{fastCtx, strongCtx} {
+		go func(i int, ctx context.Context) {
+			sreq := req
+			sreq.Provider, sreq.Model = side[i].provider, side[i].model
+			var out raceResult
+			out.answer, out.err = r.answer(ctx, sreq, prompt, &out.res)
+			out.took = time.Since(start)
+			results[i] <- out
+		}(i, c)
+	}
+
+	finish := func(i int, out raceResult) (string, modelChoice, error) {
+		if i == 0 {
+			sp.Winner, sp.FastMS = "fast", out.took.Milliseconds()
+		} else {
+			sp.Winner, sp.StrongMS = "strong", out.took.Milliseconds()
+		}
+		res.Thinking, res.Truncated = out.res.Thinking, out.res.Truncated
+		res.Warnings = append(res.Warnings, out.res.Warnings...)
+		return out.answer, side[i], out.err
+	}
+
+	var fast raceResult
+	select {
+	case fast = <-results[0]:
+	case strong := <-results[1]:
+		if strong.err == nil {
+			cancelFast()
+			sp.Reason = "the strong model answered first"
+			return finish(1, strong)
+		}
+		// Fall back on the fast answer, gate or not, rather than fail.
+		fast = <-results[0]
+		if fast.err != nil {
+			return finish(1, strong)
+		}
+		sp.FastMS = fast.took.Milliseconds()
+		sp.Passed, sp.Reason = r.gate(ctx, req, side[0], fast.answer)
+		res.Warnings = append(res.Warnings, fmt.Sprintf("strong model %s failed (%v); kept the fast answer", sp.Strong, strong.err))
+		return finish(0, fast)
+	}
+	sp.FastMS = fast.took.Milliseconds()
+	if fast.err != nil {
+		sp.Reason = fmt.Sprintf("the fast model failed: %v", fast.err)
+	} else if sp.Passed, sp.Reason = r.gate(ctx, req, side[0], fast.answer); sp.Passed {
+		cancelStrong()
+		return finish(0, fast)
+	}
+	statusf("[Sub-Agent] Fast answer from %s rejected (%s); waiting for %s\n", sp.Fast, sp.Reason, sp.Strong)
+	strong := <-results[1]
+	if strong.err != nil && fast.err == nil {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("strong model %s failed (%v); kept the fast answer the gate rejected", sp.Strong, strong.err))
+		return finish(0, fast)
+	}
+	return finish(1, strong)
+}
+
+// gate grades a fast answer. A judge that can't be reached fails it, so
+// that the strong answer is used.
+func (r *runner) gate(ctx context.Context, req TaskRequest, fast modelChoice, answer string) (bool, string) {
+	if ok, why := heuristicGate(req.Task, answer); !ok || r.speculate.gate == GateHeuristic {
+		return ok, why
+	}
+	j, err := newJudge(r.speculate.judge, fast.provider, fast.model, r.key)
+	if err != nil {
+		return false, fmt.Sprintf("invalid --speculate-judge: %v", err)
+	}
+	jm, err := j.score(ctx, req.Task, answer, "", nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	if jm.Overall >= speculatePassScore {
+		return true, ""
+	}
+	worst := jm.Scores[0]
+	for _, s := range jm.Scores {
+		if s.Score < worst.Score {
+			worst = s
+		}
+	}
+	return false, fmt.Sprintf("judge scored it %.1f; %s %.0f: %s", jm.Overall, worst.Name, worst.Score, worst.Reason)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SpeechConfig is the text-to-speech backend behind --speak and --tts-out:
+// any OpenAI-style /v1/audio/speech API, such as OpenAI's or a local
+// Kokoro-FastAPI or openedai-speech server.
+type SpeechConfig struct {
+	// Endpoint defaults to a local Kokoro-FastAPI server.
+	Endpoint  string `json:"endpoint,omitempty"`
+	Model     string `json:"model,omitempty"` // default "tts-1"
+	Voice     string `json:"voice,omitempty"` // default "alloy"
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// Player plays --speak audio; the file is appended to it. Default: the
+	// first of ffplay, mpv, afplay and paplay found on PATH.
+	Player string `json:"player,omitempty"`
+}
+
+const defaultSpeechEndpoint = "http://127.0.0.1:8880/v1/audio/speech"
+
+// speechFormats are the response formats of /v1/audio/speech, by extension.
+var speechFormats = map[string]string{".mp3": "mp3", ".wav": "wav", ".opus": "opus", ".aac": "aac", ".flac": "flac", ".pcm": "pcm"}
+
+// speechFlags read the answer aloud or save it as audio.
+type speechFlags struct {
+	speak *bool
+	out   *string
+}
+
+func addSpeechFlags(fs *flag.FlagSet) *speechFlags {
+	return &speechFlags{
+		speak: fs.Bool("speak", false, "Read the answer aloud through the text-to-speech backend (see speech in the config)"),
+		out:   fs.String("tts-out", "", "Save the answer as speech to this file; the extension picks the format (mp3, wav, opus, aac, flac)"),
+	}
+}
+
+// format is the audio format to request, checking --tts-out's extension.
+func (s *speechFlags) format() (string, error) {
+	if *s.out == "" {
+		return "mp3", nil
+	}
+	f, ok := speechFormats[strings.ToLower(filepath.Ext(*s.out))]
+	if !ok {
+		return "", kindError(ErrConfig, "--tts-out: unsupported extension %q: expected mp3, wav, opus, aac, flac or pcm", filepath.Ext(*s.out))
+	}
+	return f, nil
+}
+
+// deliver speaks text and/or saves it as audio, as the flags ask. Markdown
+// is stripped first so that its syntax is not read out.
+func (s *speechFlags) deliver(text string) {
+	if !*s.speak && *s.out == "" {
+		return
+	}
+	text = markdownToPlain(text)
+	if strings.TrimSpace(text) == "" {
+		statusf("[Sub-Agent] Warning: no answer text to speak\n")
+		return
+	}
+	format, err := s.format()
+	if err != nil {
+		fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	audio, err := synthesizeSpeech(ctx, text, format)
+	if err != nil {
+		fatal(redactErr(err))
+	}
+	if *s.out != "" {
+		if err := writeOutputFile(*s.out, audio, false); err != nil {
+			fatal(fmt.Errorf("writing %s: %v", *s.out, err))
+		}
+		statusf("[Sub-Agent] Wrote speech to %s\n", *s.out)
+	}
+	if *s.speak {
+		if err := playAudio(ctx, audio, format); err != nil {
+			fatal(configError(err))
+		}
+	}
+}
+
+func synthesizeSpeech(ctx context.Context, text, format string) ([]byte, error) {
+	c := config.Speech
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = defaultSpeechEndpoint
+	}
+	model, voice := c.Model, c.Voice
+	if model == "" {
+		model = "tts-1"
+	}
+	if voice == "" {
+		voice = "alloy"
+	}
+	payload, _ := json.Marshal(map[string]string{"model": model, "voice": voice, "input": text, "response_format": format})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("building speech request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKeyEnv != "" {
+		key, err := lookupSecret("speech", c.APIKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, kindError(ErrAuth, "missing speech API key. Set %s or run `helix auth login --provider speech`", c.APIKeyEnv)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, kindError(ErrUnreachable, "connecting to the speech endpoint: %w. Is a TTS server running, or speech.endpoint set?", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading speech response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, kindError(statusKind(resp.StatusCode), "speech endpoint returned status: %s, body: %s", resp.Status, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil, fmt.Errorf("speech endpoint returned JSON instead of audio: %s", truncateRunes(string(data), 200))
+	}
+	return data, nil
+}
+
+// playAudio plays audio through the configured or a detected player.
+func playAudio(ctx context.Context, audio []byte, format string) error {
+	argv := strings.Fields(config.Speech.Player)
+	if len(argv) == 0 {
+		for _, p := range [][]string{{"ffplay", "-nodisp", "-autoexit", "-loglevel", "quiet"}, {"mpv", "--really-quiet"}, {"afplay"}, {"paplay"}} {
+			if _, err := exec.LookPath(p[0]); err == nil {
+				argv = p
+				break
+			}
+		}
+		if len(argv) == 0 {
+			return fmt.Errorf("no audio player found: install ffplay or mpv, set speech.player, or use --tts-out")
+		}
+	}
+	f, err := os.CreateTemp("", "helix-speech-*."+format)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(audio)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, argv[0], append(argv[1:], f.Name())...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("playing speech with %s: %v", argv[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckReadOnlySQL(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dialect sqlDialect
+		query   string
+		want    string // the statement run, or "" for refused
+	}{
+		{"select", dialectPostgres, "SELECT 1;", "SELECT 1"},
+		{"cte", dialectPostgres, "WITH a AS (SELECT 1) SELECT * FROM a", "WITH a AS (SELECT 1) SELECT * FROM a"},
+		{"insert", dialectPostgres, "INSERT INTO t VALUES (1)", ""},
+		{"two statements", dialectPostgres, "SELECT 1; DROP TABLE t", ""},
+		{"semicolon in string", dialectPostgres, "SELECT ';DROP TABLE t'", "SELECT ';DROP TABLE t'"},
+		{"doubled quote", dialectPostgres, "SELECT 'it''s; DROP TABLE t'", "SELECT 'it''s; DROP TABLE t'"},
+		{"unterminated string", dialectPostgres, "SELECT 'x; DROP TABLE t", ""},
+		{"quoted write word", dialectPostgres, `SELECT "delete", 'update' FROM t`, `SELECT "delete", 'update' FROM t`},
+		{"qualified column", dialectPostgres, "SELECT t.update FROM t", "SELECT t.update FROM t"},
+		{"line comment", dialectPostgres, "SELECT 1 -- ; DROP TABLE t", "SELECT 1"},
+		{"block comment", dialectPostgres, "SELECT /* ; */ 1", "SELECT   1"},
+		{"nested comment", dialectPostgres, "SELECT /* /* */ ; DROP TABLE t */ 1", "SELECT   1"},
+		{"unterminated comment", dialectPostgres, "SELECT 1 /* DROP TABLE t", ""},
+		{"dollar quote", dialectPostgres, "SELECT $x$ ; DROP TABLE t $x$", "SELECT $x$ ; DROP TABLE t $x$"},
+		{"unterminated dollar quote", dialectPostgres, "SELECT $x$ ; DROP TABLE t", ""},
+		{"e string escapes", dialectPostgres, `SELECT E'\'; DROP TABLE t; --'`, `SELECT E'\'; DROP TABLE t; --'`},
+		{"plain string doesn't escape", dialectPostgres, `SELECT '\'; DROP TABLE t`, ""},
+		{"writing cte", dialectPostgres, "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", ""},
+		{"writing cte update", dialectPostgres, "WITH u AS (UPDATE t SET x = 1 RETURNING x) SELECT x FROM u", ""},
+		{"writing cte insert", dialectSQLite, "WITH i AS (INSERT INTO t VALUES (1) RETURNING *) SELECT 1", ""},
+		{"select into", dialectPostgres, "SELECT * INTO copy FROM t", ""},
+		{"pg_read_file", dialectPostgres, "SELECT pg_read_file ('/etc/passwd')", ""},
+		{"mysql into outfile", dialectMySQL, "SELECT * FROM t INTO OUTFILE '/tmp/x'", ""},
+		{"mysql into dumpfile", dialectMySQL, "SELECT 'x' INTO DUMPFILE '/var/www/x.php'", ""},
+		{"mysql load_file", dialectMySQL, "SELECT LOAD_FILE('/etc/passwd')", ""},
+		{"mysql hash comment", dialectMySQL, "SELECT 1 # ; DROP TABLE t", "SELECT 1"},
+		{"mysql dash needs space", dialectMySQL, "SELECT 1 --1; DROP TABLE t", ""},
+		{"mysql dash comment", dialectMySQL, "SELECT 1 -- ; DROP TABLE t", "SELECT 1"},
+		{"mysql backslash escape", dialectMySQL, `SELECT '\'; DROP TABLE t; #'`, `SELECT '\'; DROP TABLE t; #'`},
+		{"mysql executable comment", dialectMySQL, "SELECT 1 /*!; DROP TABLE t */", ""},
+		{"mysql client command", dialectMySQL, `SELECT 1 \! rm -rf /`, ""},
+		{"mysql backtick", dialectMySQL, "SELECT `into` FROM t", "SELECT `into` FROM t"},
+		{"sqlite hash isn't a comment", dialectSQLite, "SELECT 1 # ; DROP TABLE t", ""},
+		{"empty", dialectSQLite, " ; -- nothing", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := checkReadOnlySQL(tc.query, tc.dialect)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("checkReadOnlySQL(%q) = %q, want it refused", tc.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkReadOnlySQL(%q): %v", tc.query, err)
+			}
+			if got != tc.want {
+				t.Errorf("checkReadOnlySQL(%q) = %q, want %q", tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitSQL(t *testing.T) {
+	stmts, err := splitSQL("SELECT 1;\n-- x; y\nSELECT 'a;b';;SELECT $$;$$", dialectPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SELECT 1", "SELECT 'a;b'", "SELECT $$;$$"}
+	if strings.Join(stmts, "|") != strings.Join(want, "|") {
+		t.Errorf("splitSQL = %q, want %q", stmts, want)
+	}
+}
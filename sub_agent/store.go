@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// History backends: where runs and checkpoints are kept.
+const (
+	BackendFile     = "file"     // one file per record under the state and cache directories
+	BackendPostgres = "postgres" // rows shared by every instance using the database
+)
+
+// recordStore keeps the records of one kind, runs or checkpoints, as
+// opaque bytes by ID. The history and checkpoint stores sit on one.
+type recordStore interface {
+	put(id string, t time.Time, data []byte) error
+	get(id string) ([]byte, error) // errNoRecord if there is none
+	// stat lists the records without their data.
+	stat() ([]record, error)
+	all() ([]record, error)
+	remove(id string) error
+	where() string // for messages: a directory or a table
+}
+
+// record is one stored record; data is nil from stat.
+type record struct {
+	id   string
+	time time.Time // when it was written
+	size int64
+	data []byte
+}
+
+var errNoRecord = errors.New("no such record")
+
+// openRecords returns the store of kind ("runs" or "checkpoints") on the
+// configured backend; dir is where the file backend keeps it.
+func openRecords(kind, dir string) (recordStore, error) {
+	switch b := liveConfig().History.Backend; b {
+	case "", BackendFile:
+		return fileRecords{dir: dir}, nil
+	case BackendPostgres:
+		db, err := historyDatabase()
+		if err != nil {
+			return nil, err
+		}
+		return &pgRecords{db: db, table: "helix_" + kind}, nil
+	default:
+		return nil, fmt.Errorf("history.backend: unknown backend %q: use file or postgres", b)
+	}
+}
+
+// fileRecords keeps each record in <dir>/<id>.json, dated by its
+// modification time.
+type fileRecords struct {
+	dir string
+}
+
+func (f fileRecords) path(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+func (f fileRecords) put(id string, t time.Time, data []byte) error {
+	// Records hold whole tasks, so keep the directory to the user.
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.path(id), data); err != nil {
+		return err
+	}
+	os.Chtimes(f.path(id), t, t)
+	return nil
+}
+
+func (f fileRecords) get(id string) ([]byte, error) {
+	data, err := os.ReadFile(f.path(id))
+	if os.IsNotExist(err) {
+		return nil, errNoRecord
+	}
+	return data, err
+}
+
+func (f fileRecords) stat() ([]record, error) {
+	paths, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []record
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			out = append(out, record{id: strings.TrimSuffix(filepath.Base(p), ".json"), time: info.ModTime(), size: info.Size()})
+		}
+	}
+	return out, nil
+}
+
+func (f fileRecords) all() ([]record, error) {
+	recs, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+	for i := range recs {
+		if recs[i].data, err = os.ReadFile(f.path(recs[i].id)); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+func (f fileRecords) remove(id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f fileRecords) where() string { return f.dir }
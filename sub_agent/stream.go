@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Streaming is used when a run has a deadline: the text received so far
+// is handed to genRequest.OnText, so a cut-off answer isn't lost.
+
+// readOllamaStream reads Ollama's newline-delimited JSON chunks into one
+// response. The counts come with the final chunk.
+func readOllamaStream(r io.Reader, onText func(string)) (OllamaResponse, error) {
+	var all OllamaResponse
+	dec := json.NewDecoder(r)
+	for {
+		var c struct {
+			OllamaResponse
+			Done  bool   `json:"done"`
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&c); err == io.EOF {
+			return all, nil
+		} else if err != nil {
+			return all, fmt.Errorf("reading Ollama stream: %w", err)
+		}
+		if c.Error != "" {
+			return all, kindError(ErrProvider, "ollama: %s", c.Error)
+		}
+		all.Response += c.Response
+		all.Thinking += c.Thinking
+		onText(withThinking(all.Thinking, all.Response))
+		if c.Done {
+			all.PromptEvalCount, all.EvalCount = c.PromptEvalCount, c.EvalCount
+			all.TotalDuration, all.LoadDuration = c.TotalDuration, c.LoadDuration
+			all.PromptEvalDuration, all.EvalDuration = c.PromptEvalDuration, c.EvalDuration
+			return all, nil
+		}
+	}
+}
+
+// readSSE calls fn with the data of each server-sent event until the
+// stream ends or sends [DONE].
+func readSSE(r io.Reader, fn func(data []byte) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+			payload := strings.Join(data, "\n")
+			data = data[:0]
+			if payload == "[DONE]" {
+				return nil
+			}
+			if err := fn([]byte(payload)); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 && strings.Join(data, "\n") != "[DONE]" {
+		return fn([]byte(strings.Join(data, "\n")))
+	}
+	return nil
+}
+
+// readOpenAIStream assembles a streamed chat completion into the shape of
+// a non-streamed one.
+func readOpenAIStream(name string, r io.Reader, onText func(string)) (OpenAIChatResponse, error) {
+	var resp OpenAIChatResponse
+	var msg OpenAIResponseMessage
+	finish := ""
+	err := readSSE(r, func(data []byte) error {
+		var c struct {
+			Choices []struct {
+				Delta        OpenAIResponseMessage `json:"delta"`
+				FinishReason string                `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *json.RawMessage `json:"usage"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("parsing %s stream: %v", name, err)
+		}
+		if c.Error != nil {
+			return kindError(ErrProvider, "%s: %s", name, c.Error.Message)
+		}
+		if c.Usage != nil {
+			json.Unmarshal(*c.Usage, &resp.Usage)
+		}
+		if len(c.Choices) == 0 {
+			return nil
+		}
+		d := c.Choices[0].Delta
+		msg.Content += d.Content
+		msg.ReasoningContent += d.ReasoningContent
+		msg.Reasoning += d.Reasoning
+		for _, tc := range d.ToolCalls {
+			// A call's name and ID come first, its arguments in pieces.
+			for len(msg.ToolCalls) <= tc.Index {
+				msg.ToolCalls = append(msg.ToolCalls, OpenAIToolCall{Index: len(msg.ToolCalls)})
+			}
+			m := &msg.ToolCalls[tc.Index]
+			if tc.ID != "" {
+				m.ID = tc.ID
+			}
+			if tc.Function.Name != "" {
+				m.Function.Name = tc.Function.Name
+			}
+			m.Function.Arguments += tc.Function.Arguments
+		}
+		if f := c.Choices[0].FinishReason; f != "" {
+			finish = f
+		}
+		onText(msg.text())
+		return nil
+	})
+	resp.Choices = []OpenAIChoice{{Message: msg, FinishReason: finish}}
+	if err != nil {
+		return resp, fmt.Errorf("reading %s stream: %w", name, err)
+	}
+	return resp, nil
+}
+
+// readGeminiStream merges Gemini's streamed chunks into one response with
+// a single candidate.
+func readGeminiStream(r io.Reader, onText func(string)) (GeminiResponse, error) {
+	var resp GeminiResponse
+	var thought, text strings.Builder
+	finish := ""
+	var grounding *GeminiGroundingMetadata
+	var calls []GeminiPart
+	var ratings []GeminiSafetyRating
+	err := readSSE(r, func(data []byte) error {
+		var c GeminiResponse
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("parsing Gemini stream: %v", err)
+		}
+		if c.PromptFeedback != nil {
+			resp.PromptFeedback = c.PromptFeedback
+		}
+		resp.UsageMetadata = c.UsageMetadata
+		if len(c.Candidates) == 0 {
+			return nil
+		}
+		for _, p := range c.Candidates[0].Content.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				calls = append(calls, p)
+			case p.Thought:
+				thought.WriteString(p.Text)
+			default:
+				text.WriteString(p.Text)
+			}
+		}
+		if r := c.Candidates[0].SafetyRatings; len(r) > 0 {
+			ratings = r
+		}
+		if f := c.Candidates[0].FinishReason; f != "" {
+			finish = f
+		}
+		if m := c.Candidates[0].GroundingMetadata; m != nil {
+			grounding = m
+		}
+		onText(withThinking(thought.String(), text.String()))
+		return nil
+	})
+	parts := append([]GeminiPart{{Text: text.String()}}, calls...)
+	if thought.Len() > 0 {
+		parts = append([]GeminiPart{{Text: thought.String(), Thought: true}}, parts...)
+	}
+	resp.Candidates = []GeminiCandidate{{Content: GeminiContent{Role: "model", Parts: parts}, FinishReason: finish, GroundingMetadata: grounding, SafetyRatings: ratings}}
+	if err != nil {
+		return resp, fmt.Errorf("reading Gemini stream: %w", err)
+	}
+	return resp, nil
+}
+
+// geminiStreamURL turns a generateContent URL into its SSE streaming form.
+func geminiStreamURL(u string) string {
+	u = strings.Replace(u, ":generateContent", ":streamGenerateContent", 1)
+	if strings.Contains(u, "?") {
+		return u + "&alt=sse"
+	}
+	return u + "?alt=sse"
+}
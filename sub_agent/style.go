@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StyleProfile is a named output shape for --style: the tone, the length
+// and the formatting rules every answer follows.
+type StyleProfile struct {
+	Tone      string   `json:"tone,omitempty"`      // e.g. "neutral and direct"
+	Verbosity string   `json:"verbosity,omitempty"` // e.g. "as short as the task allows"
+	Rules     []string `json:"rules,omitempty"`     // formatting rules, one instruction each
+}
+
+// builtinStyles are the profiles every install has; entries in the
+// config's "styles" section replace or add to them.
+var builtinStyles = map[string]StyleProfile{
+	"terse": {
+		Tone:      "neutral and direct",
+		Verbosity: "as short as the task allows; no introduction, summary or caveats unless they change the answer",
+		Rules:     []string{"Prefer a single sentence, command or code block to a list.", "Don't explain what wasn't asked."},
+	},
+	"runbook": {
+		Tone:      "imperative, like an operations runbook",
+		Verbosity: "complete enough to follow without other documentation",
+		Rules: []string{
+			"Start with a one-line summary of what the procedure does.",
+			"Give numbered steps, one action each, with the exact command in a code block.",
+			"After each step that changes something, say how to check it worked.",
+			"End with how to roll back.",
+		},
+	},
+	"explainer": {
+		Tone:      "friendly and patient, for a reader new to the subject",
+		Verbosity: "thorough; explain the why as well as the how",
+		Rules: []string{
+			"Define terms the first time they appear.",
+			"Build from the simplest idea to the full picture, with a short example.",
+			"End with a brief recap.",
+		},
+	},
+}
+
+// lookupStyle returns the named profile from the config or the built-ins.
+func lookupStyle(name string) (StyleProfile, error) {
+	if p, ok := config.Styles[name]; ok {
+		return p, nil
+	}
+	if p, ok := builtinStyles[name]; ok {
+		return p, nil
+	}
+	return StyleProfile{}, fmt.Errorf("unknown style %q: expected one of %s", name, strings.Join(styleNames(), ", "))
+}
+
+func styleNames() []string {
+	var names []string
+	for n := range builtinStyles {
+		names = append(names, n)
+	}
+	for n := range config.Styles {
+		if _, ok := builtinStyles[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instruction is the guidance appended to the task.
+func (p StyleProfile) instruction() string {
+	var b strings.Builder
+	b.WriteString("Style for the answer:")
+	if p.Tone != "" {
+		fmt.Fprintf(&b, "\n- Tone: %s.", strings.TrimSuffix(p.Tone, "."))
+	}
+	if p.Verbosity != "" {
+		fmt.Fprintf(&b, "\n- Length: %s.", strings.TrimSuffix(p.Verbosity, "."))
+	}
+	for _, r := range p.Rules {
+		fmt.Fprintf(&b, "\n- %s", r)
+	}
+	return b.String()
+}
+
+// styleFor is req's style profile name, or else the runner's.
+func (r *runner) styleFor(req TaskRequest) string {
+	if req.Style != "" {
+		return req.Style
+	}
+	return r.style
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SummaryResult is the JSON output of `summarize`.
+type SummaryResult struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Chunks   int    `json:"chunks"`
+	Rounds   int    `json:"rounds"` // reduce rounds after the map pass
+	Output   string `json:"output"`
+}
+
+const mapPrompt = `Summarize the following part (%d of %d) of a larger document. Keep concrete facts, names, numbers and conclusions; omit filler.%s
+
+%s`
+
+const reducePrompt = `The following are summaries of consecutive parts of one document. Merge them into a single coherent summary without repeating points.%s
+
+%s`
+
+// summarizer map-reduces a document that may be far larger than one prompt.
+type summarizer struct {
+	provider     string
+	model        string
+	key          string
+	chunkTokens  int
+	concurrency  int
+	instructions string
+}
+
+// summarizeCommand implements `summarize --file big.txt`.
+func summarizeCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "", "Document to summarize ('-' for stdin)")
+	prov := fs.String("provider", "local", "Provider: 'local', 'cloud', 'azure-openai', 'bedrock' or an OpenAI-compatible adapter")
+	mdl := fs.String("model", "", "Model name")
+	kf := addKeyFlags(fs)
+	chunkTokens := fs.Int("chunk-tokens", 3000, "Approximate tokens per chunk; keep well under the model's context window")
+	concurrency := fs.Int("concurrency", 4, "Chunks summarized in parallel")
+	instructions := fs.String("instructions", "", "Extra guidance for the summary (focus, length, format)")
+	asJSON := fs.Bool("json", false, "Print the result as JSON instead of text")
+	raw := fs.Bool("raw", false, "Print the summary as-is instead of rendering markdown on a terminal")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the summary: no status lines")
+	return func([]string) {
+		if *file == "" {
+			fatal(kindError(ErrConfig, "--file flag is required"))
+		}
+		text, err := readInput(*file)
+		if err != nil {
+			fatal(configError(err))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if *concurrency < 1 {
+			*concurrency = 1
+		}
+
+		s := &summarizer{provider: *prov, model: *mdl, key: key, chunkTokens: *chunkTokens, concurrency: *concurrency}
+		if *instructions != "" {
+			s.instructions = "\n" + *instructions
+		}
+		s.model = defaultModel(s.provider, s.model)
+
+		res, err := s.summarize(context.Background(), text)
+		if err != nil {
+			fatal(redactErr(err))
+		}
+		if *asJSON {
+			printJSON(res)
+			return
+		}
+		statusf("[Sub-Agent] Summarized %d chunk(s) in %d reduce round(s)\n", res.Chunks, res.Rounds)
+		statusf("--- Result ---\n")
+		if useMarkdown(*raw) {
+			fmt.Println(renderMarkdown(res.Output))
+			return
+		}
+		fmt.Println(res.Output)
+	}
+}
+
+// readInput reads a file, or stdin for "-".
+func readInput(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	return string(data), nil
+}
+
+func (s *summarizer) summarize(ctx context.Context, text string) (SummaryResult, error) {
+	res := SummaryResult{Provider: s.provider, Model: s.model}
+	chunks := splitByTokens(text, s.chunkTokens)
+	res.Chunks = len(chunks)
+	if len(chunks) == 0 {
+		return res, fmt.Errorf("nothing to summarize")
+	}
+
+	parts, err := s.mapChunks(ctx, chunks, func(i int, c string) string {
+		return fmt.Sprintf(mapPrompt, i+1, len(chunks), s.instructions, c)
+	})
+	if err != nil {
+		return res, err
+	}
+
+	// Reduce until everything fits in one prompt. Each round merges groups of
+	// partial summaries that fit the chunk budget together.
+	for len(parts) > 1 {
+		res.Rounds++
+		groups := splitByTokens(strings.Join(parts, "\n\n"), s.chunkTokens)
+		if len(groups) >= len(parts) {
+			// Summaries are individually too large to pair up; merge them two
+			// at a time so the loop always makes progress.
+			groups = pairUp(parts)
+		}
+		parts, err = s.mapChunks(ctx, groups, func(_ int, g string) string {
+			return fmt.Sprintf(reducePrompt, s.instructions, g)
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+	res.Output = parts[0]
+	return res, nil
+}
+
+// mapChunks runs one prompt per input with bounded concurrency, preserving order.
+func (s *summarizer) mapChunks(ctx context.Context, inputs []string, prompt func(int, string) string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := make([]string, len(inputs))
+	errs := make([]error, len(inputs))
+	sem := make(chan struct{}, s.concurrency)
+	var wg sync.WaitGroup
+	for i, in := range inputs {
+		wg.Add(1)
+		go func(i int, in string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			text, err := generate(ctx, s.provider, s.model, prompt(i, in), s.key)
+			if err != nil {
+				errs[i] = fmt.Errorf("chunk %d: %w", i+1, err)
+				cancel()
+				return
+			}
+			out[i] = strings.TrimSpace(cleanOutput(text))
+		}(i, in)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func pairUp(parts []string) []string {
+	var groups []string
+	for i := 0; i < len(parts); i += 2 {
+		if i+1 < len(parts) {
+			groups = append(groups, parts[i]+"\n\n"+parts[i+1])
+		} else {
+			groups = append(groups, parts[i])
+		}
+	}
+	return groups
+}
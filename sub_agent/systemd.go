@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd integration for serve and daemon, following sd_notify(3) and
+// sd_listen_fds(3) without libsystemd. Each part is active only when
+// systemd sets it up in the environment, so the same binary runs under
+// any supervisor. contrib/systemd has units that use all of it.
+
+// sdListenFDsStart is the first file descriptor systemd passes.
+const sdListenFDsStart = 3
+
+// sdNotify sends state (READY=1, STOPPING=1, WATCHDOG=1) to the service
+// manager. Without NOTIFY_SOCKET it does nothing.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// A leading @ names an abstract socket, which Go writes as a NUL.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// systemdListener returns the socket systemd passed for socket
+// activation, or nil when it passed none. Only the first is used.
+func systemdListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// Children such as tool subprocesses must not take the socket as theirs.
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+	f := os.NewFile(sdListenFDsStart, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// listenService is systemd's socket when activated, else a listener on
+// addr (host:port or unix:), and the address to report.
+func listenService(addr string) (net.Listener, string, error) {
+	ln, err := systemdListener()
+	if err != nil {
+		return nil, "", err
+	}
+	if ln != nil {
+		return ln, ln.Addr().String() + " (systemd socket)", nil
+	}
+	ln, err = listenAddr(addr)
+	return ln, addr, err
+}
+
+// sdWatchdogInterval is how often to ping the watchdog: half the
+// WatchdogSec systemd set, or 0 when it set none for this process.
+func sdWatchdogInterval() time.Duration {
+	if p := os.Getenv("WATCHDOG_PID"); p != "" && p != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog pings the watchdog until ctx ends.
+func sdWatchdog(ctx context.Context) {
+	every := sdWatchdogInterval()
+	if every == 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Run IDs name checkpoint and queue files, so they are kept to safe
+// characters; tag keys likewise, so they read cleanly in logs.
+var (
+	runIDRe  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+	tagKeyRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+const maxTags = 32
+
+// tagFlag is the repeatable --tag key=value flag.
+type tagFlag map[string]string
+
+func (t tagFlag) String() string { return formatTags(t) }
+
+func (t tagFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	t[k] = val
+	return validateTags(t)
+}
+
+// validateTags checks caller-supplied tags.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("too many tags: %d (at most %d)", len(tags), maxTags)
+	}
+	for k, v := range tags {
+		if !tagKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid tag key %q: use letters, digits, '.', '_' and '-'", k)
+		}
+		if len(v) > 256 {
+			return fmt.Errorf("tag %s: value longer than 256 bytes", k)
+		}
+	}
+	return nil
+}
+
+// formatTags renders tags as sorted key=value pairs for log lines.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + tags[k]
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,1303 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"helix-agent-go/orchestrator"
+)
+
+// TaskRequest is the unit of work accepted by serve and worker modes.
+type TaskRequest struct {
+	ID       string `json:"id,omitempty"`
+	Task     string `json:"task"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+
+	// Input is text the task works on, such as piped stdin. It is appended
+	// to the task in a delimited block, trimmed to fit the window.
+	Input string `json:"input,omitempty"`
+	// ContextFiles are packed into the prompt, most relevant first, for as
+	// many as fit the window.
+	ContextFiles []ContextFile `json:"context_files,omitempty"`
+
+	// Images are sent alongside the task; the model must support vision.
+	Images []ImageInput `json:"images,omitempty"`
+
+	// Files are documents and media sent as-is, which only Gemini takes.
+	Files []FileInput `json:"files,omitempty"`
+	// Audio is transcribed into Input before the task runs.
+	Audio []AudioInput `json:"audio,omitempty"`
+
+	// Route picks provider/model automatically (cheapest, fastest, best)
+	// when Model is empty; a set Provider restricts the choice to it.
+	Route string `json:"route,omitempty"`
+
+	// Artifacts overrides the artifact mode for this run (auto/always/never).
+	Artifacts string `json:"artifacts,omitempty"`
+	// Post overrides the post-processing chain for this run (see --post).
+	Post string `json:"post,omitempty"`
+	// VerifyRounds overrides the number of --verify rounds (0 keeps the default).
+	VerifyRounds int `json:"verify_rounds,omitempty"`
+	// Plan runs the task through the planner even if --plan is not set.
+	Plan bool `json:"plan,omitempty"`
+	// Debate overrides the number of --debate agents (0 keeps the default).
+	Debate int `json:"debate,omitempty"`
+	// Stop, Candidates and Select override --stop, --candidates and --select.
+	Stop       []string `json:"stop,omitempty"`
+	Candidates int      `json:"candidates,omitempty"`
+	Select     string   `json:"select,omitempty"`
+	// Binary and Degrade override --binary and --degrade.
+	Binary  string `json:"binary,omitempty"`
+	Degrade string `json:"degrade,omitempty"`
+	// SelfConsistency overrides --self-consistency.
+	SelfConsistency int `json:"self_consistency,omitempty"`
+	// Format and Grammar override --format and --grammar: "json", a JSON
+	// schema or "md", "plain" or "html", and the text of a GBNF grammar.
+	Format  json.RawMessage `json:"format,omitempty"`
+	Grammar string          `json:"grammar,omitempty"`
+	// ThinkBudget and ReasoningEffort override --think-budget and
+	// --reasoning-effort.
+	ThinkBudget     int    `json:"think_budget,omitempty"`
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+
+	// Tags are caller metadata, such as an orchestrator's job ID, echoed in
+	// the result, the audit log and worker logs for correlation.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Priority orders a worker's queue: higher runs first, and with
+	// --preempt may cancel and requeue a lower-priority local task.
+	Priority int `json:"priority,omitempty"`
+
+	// KB overrides --kb.
+	KB string `json:"kb,omitempty"`
+	// Knowledge is the block retrieved from the knowledge base, which goes
+	// ahead of the task. Given (as on a replay), it is used instead of
+	// retrieving again.
+	Knowledge string `json:"knowledge,omitempty"`
+
+	// Compress turns on --compress.
+	Compress bool `json:"compress,omitempty"`
+
+	// GeminiCache overrides --gemini-cache.
+	GeminiCache string `json:"gemini_cache,omitempty"`
+
+	// Ground, or --ground, lets Gemini search Google for the answer.
+	Ground bool `json:"ground,omitempty"`
+
+	// Speculate, or --speculate, races the fast and strong models.
+	Speculate bool `json:"speculate,omitempty"`
+
+	// Escalate and EscalateMinScore override --escalate and
+	// --escalate-min-score.
+	Escalate         string  `json:"escalate,omitempty"`
+	EscalateMinScore float64 `json:"escalate_min_score,omitempty"`
+
+	// Lang overrides --lang.
+	Lang string `json:"lang,omitempty"`
+	// Style overrides --style.
+	Style string `json:"style,omitempty"`
+	// Locale and Timezone override --locale and --timezone, and tell the
+	// model the time even without --time-context.
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	// MinConfidence overrides --min-confidence.
+	MinConfidence float64 `json:"min_confidence,omitempty"`
+	// Contract, instead of Task, gives the task as a document whose
+	// acceptance criteria the answer is assessed against.
+	Contract *TaskContract `json:"contract,omitempty"`
+	// Examples overrides --examples.
+	Examples string `json:"examples,omitempty"`
+	// MaxWords, MaxLines and LengthEnforce override --max-words,
+	// --max-lines and --length-enforce.
+	MaxWords      int    `json:"max_words,omitempty"`
+	MaxLines      int    `json:"max_lines,omitempty"`
+	LengthEnforce string `json:"length_enforce,omitempty"`
+
+	// Seed overrides --seed: the sampling seed of the answer, for providers
+	// that take one. 0 picks one at random, which the result reports.
+	Seed int64 `json:"seed,omitempty"`
+
+	// MaxToolSteps overrides --max-tool-steps (0 keeps the default).
+	MaxToolSteps int `json:"max_tool_steps,omitempty"`
+	// ToolProfile overrides --tool-profile; from serve it may only be one of
+	// server.request_tool_profiles, and only narrows the server's profile.
+	ToolProfile string `json:"tool_profile,omitempty"`
+
+	// DeadlineMS overrides --deadline, in milliseconds.
+	DeadlineMS int `json:"deadline_ms,omitempty"`
+
+	// DryRun reports the request that would be sent instead of sending it.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Tenant is set by serve from the caller's token, never by the caller.
+	Tenant string `json:"tenant,omitempty"`
+	// allow, when set, vets the provider and model the task ends up on.
+	allow func(provider, model string) error
+	// remote marks a request from the task API, whose contract env is
+	// never resolved as secret references.
+	remote bool
+	// toolCeiling is the profile a remote request's tool_profile can't
+	// widen: its tenant's, or "" for the server's.
+	toolCeiling string
+	// replayOf is the run helix replay is repeating.
+	replayOf string
+	// resume, when set, is the checkpoint of an interrupted run to continue.
+	resume *Checkpoint
+	// noCheckpoint keeps a part of a run, such as a plan step, from
+	// checkpointing on its own.
+	noCheckpoint bool
+	// attachAt is one past the offset in Task where attachments (input and
+	// context files) start; 0 when there are none.
+	attachAt int
+}
+
+// TaskResult is what serve and worker modes report back for a TaskRequest.
+type TaskResult struct {
+	ID       string            `json:"id"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Provider string            `json:"provider"`
+	Model    string            `json:"model,omitempty"`
+	Output   string            `json:"output,omitempty"` // the answer, without thinking
+	// Truncated means the deadline cut the answer off and Output is what
+	// had arrived by then.
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	// Thinking is the reasoning the model gave before its answer, kept
+	// apart from Output; Logs are the diagnostics printed during the run.
+	Thinking string   `json:"thinking,omitempty"`
+	Logs     []string `json:"logs,omitempty"`
+
+	// Set instead of Output when the result was uploaded to the artifact store.
+	ArtifactURL string `json:"artifact_url,omitempty"`
+	OutputBytes int    `json:"output_bytes,omitempty"`
+
+	// Files written by --extract-files.
+	Files []FileChange `json:"files,omitempty"`
+	// Snapshot is the workspace snapshot taken before tools ran, which
+	// helix rollback restores.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	Verification *Verification    `json:"verification,omitempty"`
+	Plan         *Plan            `json:"plan,omitempty"`
+	Debate       *Debate          `json:"debate,omitempty"`
+	Context      *ContextReport   `json:"context,omitempty"`
+	Packed       *PackReport      `json:"context_files,omitempty"`
+	Retrieval    *RetrievalReport `json:"retrieval,omitempty"`
+	Sources      []Source         `json:"sources,omitempty"` // the chunks the answer cites
+	Grounding    *Grounding       `json:"grounding,omitempty"`
+	// Classification is set when guardrails.classification labelled the task.
+	Classification *Classification `json:"classification,omitempty"`
+	Speculation    *Speculation    `json:"speculation,omitempty"`
+	Escalation     *Escalation     `json:"escalation,omitempty"`
+	Route          *RouteDecision  `json:"route,omitempty"`
+
+	// ErrorKind classifies Error (see errors.go) so callers can branch on it.
+	ErrorKind ErrorKind `json:"error_kind,omitempty"`
+
+	Redactions *RedactionReport `json:"redactions,omitempty"`
+	// Injection flags retrieved or fetched content in the prompt that
+	// reads like instructions to the model.
+	Injection  []InjectionFinding `json:"injection,omitempty"`
+	ToolCalls  []ToolCall         `json:"tool_calls,omitempty"`
+	Scratchpad map[string]string  `json:"scratchpad,omitempty"` // notes left by the scratchpad tool
+	Candidates *Candidates        `json:"candidates,omitempty"`
+	Warnings   []string           `json:"warnings,omitempty"`
+	Moderation *ModerationReport  `json:"moderation,omitempty"`
+	Length     *LengthReport      `json:"length,omitempty"`
+	Confidence *Confidence        `json:"confidence,omitempty"`
+	Contract   *ContractResult    `json:"contract,omitempty"`
+	Provenance *Provenance        `json:"provenance,omitempty"` // with --provenance
+	DryRun     *DryRun            `json:"dry_run,omitempty"`
+	Usage      *Usage             `json:"usage,omitempty"`
+	Seed       int64              `json:"seed,omitempty"`    // the answer's sampling seed
+	Version    string             `json:"version,omitempty"` // of helix
+
+	// Compression measures what --compress saved.
+	Compression *CompressionReport `json:"compression,omitempty"`
+	Binary      []BinaryAttachment `json:"binary,omitempty"`
+	Degraded    []Degradation      `json:"degraded,omitempty"`
+
+	// DuplicateOf is, in a batch, the ID of the task that was run for this
+	// duplicate of it.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	// The prompt as assembled, for --write-manifest.
+	promptSHA256 string
+	sections     []PromptSection
+}
+
+// runner holds the settings shared by every task a process executes.
+type runner struct {
+	key string
+
+	artifacts         *artifactStore // nil disables uploads
+	artifactMode      string
+	artifactThreshold int
+
+	post     []postStep
+	postSpec string // --post as given, for the history
+
+	workspace    string
+	extractFiles bool
+	provenance   string // --provenance mode of written files
+
+	verify  verifyConfig // rounds == 0 disables verification
+	plan    planConfig
+	debate  debateConfig
+	context contextConfig
+	compact compactConfig
+	route   string // default --route policy
+
+	compress compressConfig
+	binary   string // --binary
+	degrade  string // --degrade
+
+	stop        []string
+	candidates  candidateConfig
+	constraints constraints
+	reasoning   reasoningConfig
+	lang        string // reply language, "" for the task's own
+	style       string // style profile, "" for none
+	locale      localeContext
+	confidence  confidenceConfig
+	examples    string // few-shot example sets, "" for none
+	length      lengthLimit
+
+	audit *auditLog // nil disables the audit log
+
+	redact     *redactor // nil disables masking
+	secretScan string
+	classifier *classifier // nil without classification rules
+
+	moderation       moderator // nil disables moderation
+	moderationName   string
+	moderationAction string
+
+	dryRun bool
+
+	deadline time.Duration // 0 means none
+
+	seed     int64         // 0 picks one per run
+	history  *historyStore // nil disables the run history
+	manifest string        // --write-manifest, "" for none
+
+	tools        []tool            // empty disables the tool loop
+	toolEnv      map[string]string // --tool-env
+	maxToolSteps int
+	toolOutput   ToolOutputBudget // --tool-output-tokens and --tool-output-overflow
+	toolPolicy   *ToolPolicy      // nil allows every enabled tool
+	toolProfile  string
+
+	checkpoints *checkpointStore // nil disables checkpointing
+	snapshots   bool             // snapshot the workspace before tools with side effects run
+
+	memory *memoryStore // nil disables long-term memory
+
+	retrieval retrievalConfig
+
+	geminiCache string
+	ground      bool
+
+	speculate speculateConfig
+	escalate  escalateConfig
+
+	kube *orchestrator.KubeJob // nil runs sub-agents in process
+}
+
+// runnerFlags are the task settings shared by the CLI, serve and worker.
+type runnerFlags struct {
+	artifacts    *artifactFlags
+	post         *string
+	workspace    *string
+	extractFiles *bool
+	provenance   *string
+
+	verify         *bool
+	verifyRounds   *int
+	verifyProvider *string
+	verifyModel    *string
+
+	plan         *bool
+	planProvider *string
+	planModel    *string
+	planModels   *string
+	planMaxSteps *int
+	autoApprove  *bool
+
+	debate       *int
+	debateModels *string
+	debateRounds *int
+	debateJudge  *string
+
+	contextStrategy *string
+	contextWindow   *int
+	reserveTokens   *int
+
+	compactAt       *float64
+	compactKeep     *int
+	compactProvider *string
+	compactModel    *string
+
+	compress          *bool
+	compressProvider  *string
+	compressModel     *string
+	compressMinTokens *int
+
+	binary  *string
+	degrade *string
+
+	route *string
+
+	speculate       *bool
+	speculateModels *string
+	speculateGate   *string
+	speculateJudge  *string
+
+	escalate         *string
+	escalateMinScore *float64
+	escalateJudge    *string
+
+	stop         *stringList
+	candidates   *int
+	selectPolicy *string
+	selectJudge  *string
+	consistency  *int
+	consistMatch *string
+	consistTemp  *float64
+	format       *string
+	grammar      *string
+	thinkBudget  *int
+	effort       *string
+	lang         *string
+	style        *string
+	locale       *string
+	timezone     *string
+	timeContext  *bool
+	examples     *string
+	maxWords     *int
+	maxLines     *int
+	lengthEnf    *string
+
+	confidence      *bool
+	minConfidence   *float64
+	confidenceJudge *string
+
+	auditLog *string
+
+	redact          *string
+	redactScope     *string
+	redactResponses *bool
+	secretScan      *string
+	allowSecrets    *bool
+	allowClassified *bool
+
+	moderation       *string
+	moderationAction *string
+
+	dryRun *bool
+
+	deadline *time.Duration
+
+	tools        *string
+	toolEnv      *stringList
+	maxToolSteps *int
+	toolTokens   *int
+	toolOverflow *string
+	toolPolicy   *string
+	toolProfile  *string
+
+	noCheckpoint *bool
+	noSnapshot   *bool
+	noHistory    *bool
+	seed         *int64
+	manifest     *string
+
+	memory          *bool
+	memoryNamespace *string
+
+	kb               *string
+	retrieval        *retrievalFlags
+	requireCitations *bool
+
+	geminiCache *string
+	ground      *bool
+
+	kubeJobs *bool
+}
+
+func addRunnerFlags(fs *flag.FlagSet) *runnerFlags {
+	stop := &stringList{}
+	fs.Var(stop, "stop", "Stop generating the answer at this sequence (repeatable)")
+	toolEnv := &stringList{}
+	fs.Var(toolEnv, "tool-env", "Set NAME=VALUE in the processes of exec tools and run_code only; VALUE may be a vault:// or exec: secret reference (repeatable)")
+	return &runnerFlags{
+		stop:         stop,
+		candidates:   fs.Int("candidates", 1, "Generate this many answers and keep one (see --select)"),
+		selectPolicy: fs.String("select", SelectFirst, "How --candidates picks the answer: 'first', 'longest', 'judge' or 'consistent' (the one most candidates agree on)"),
+		selectJudge:  fs.String("select-judge", "", "Provider/model that judges candidates with --select judge (defaults to the task's model)"),
+		consistency:  fs.Int("self-consistency", 0, "Sample this many answers and keep the one most of them agree on, with an agreement score (same as --candidates N --select consistent)"),
+		consistMatch: fs.String("consistency-match", MatchExact, "How --select consistent tells answers agree: 'exact' (the same final answer) or 'embedding' (similar answers, embedded with the knowledge base's model)"),
+		consistTemp:  fs.Float64("consistency-temperature", defaultConsistencyTemperature, "Sampling temperature of --select consistent's answers (above 0, so that they can differ)"),
+		format:       fs.String("format", "", "Answer format: 'md', 'plain' or 'html' (asked for and converted to), or 'json' or the JSON schema in this file (enforced by Ollama and OpenAI-compatible providers, asked for and checked on others; see --degrade)"),
+		thinkBudget:  fs.Int("think-budget", 0, "Cap the thinking tokens of reasoning models on Gemini and Claude on Bedrock (0 keeps the provider's default)"),
+		effort:       fs.String("reasoning-effort", "", "Reasoning effort for reasoning models: 'none', 'low', 'medium' or 'high' (defaults to the provider's)"),
+		lang:         fs.String("lang", "", "Reply in this language whatever the task is written in, as an ISO code or a name (e.g. de, Japanese)"),
+		maxWords:     fs.Int("max-words", 0, "Ask for an answer of at most this many words and enforce it per --length-enforce"),
+		maxLines:     fs.Int("max-lines", 0, "Ask for an answer of at most this many lines and enforce it per --length-enforce"),
+		lengthEnf:    fs.String("length-enforce", LengthTruncate, "What to do with an answer over --max-words or --max-lines: 'truncate' it with a marker, or 'condense' it with the model (truncating if still over)"),
+		style:        fs.String("style", config.DefaultStyle, "Style profile that shapes the answer: 'terse', 'runbook', 'explainer' or one from styles in the config"),
+		locale:       fs.String("locale", defaultLocale(), "Locale the answer's dates, times and numbers are written for (e.g. en_GB)"),
+		timezone:     fs.String("timezone", config.Locale.Timezone, "Time zone relative dates and times in the task are read in, as an IANA name (default: $TZ or the system's)"),
+		timeContext:  fs.Bool("time-context", config.Locale.Inject == nil || *config.Locale.Inject, "Tell the model the current date and time in --timezone, and the --locale"),
+		examples:     fs.String("examples", "", "Comma-separated example sets from the library (see 'helix examples list') whose input/output pairs are put before the task"),
+		grammar:      fs.String("grammar", "", "Constrain the answer to the GBNF grammar in this file (providers that declare grammar support, such as llama.cpp's server)"),
+
+		confidence:      fs.Bool("confidence", false, "Estimate how likely the answer is to be right, from 0 to 1 (in the JSON output as confidence)"),
+		minConfidence:   fs.Float64("min-confidence", 0, "Abstain with \"insufficient information\" instead of answering below this --confidence, from 0 to 1 (0 never abstains)"),
+		confidenceJudge: fs.String("confidence-judge", "", "Provider/model that estimates --confidence (defaults to the task's model)"),
+
+		speculate:       fs.Bool("speculate", false, "Ask the fast and strong models of --speculate-models at once, keeping the fast answer if it passes --speculate-gate"),
+		speculateModels: fs.String("speculate-models", "local,cloud", "Fast then strong provider/model for --speculate"),
+		speculateGate:   fs.String("speculate-gate", GateHeuristic, "How --speculate checks the fast answer: 'heuristic' (empty, refused or degenerate answers fail) or 'judge' (a model grades it)"),
+		speculateJudge:  fs.String("speculate-judge", "", "Provider/model that grades fast answers with --speculate-gate judge (defaults to judge.model in the config, or the fast model)"),
+
+		escalate:         fs.String("escalate", "", "Comma-separated provider/models to retry the answer on in turn when it is empty, refuses, doesn't match --format or scores below --escalate-min-score (e.g. cloud)"),
+		escalateMinScore: fs.Float64("escalate-min-score", 0, "Judge score from 0 to 10 an answer needs to stop --escalate; 0 doesn't judge"),
+		escalateJudge:    fs.String("escalate-judge", "", "Provider/model that judges answers for --escalate-min-score (defaults to judge.model in the config, or the answering model)"),
+
+		artifacts:    addArtifactFlags(fs),
+		post:         fs.String("post", "", postChainHelp),
+		workspace:    fs.String("workspace", ".", "Directory that file-writing features operate in"),
+		extractFiles: fs.Bool("extract-files", false, "Write fenced code blocks that name a file (```go filename=main.go) into the workspace"),
+		provenance:   fs.String("provenance", ProvenanceOff, "Record the run that wrote --extract-files and --output-file files: 'comment' (a trailing comment, or a sidecar for files without comments), 'sidecar' (<file>.provenance.json) or 'off'"),
+
+		verify:         fs.Bool("verify", false, "Have a second pass check the answer and correct it if needed"),
+		verifyRounds:   fs.Int("verify-rounds", 2, "Maximum verification rounds when --verify is set"),
+		verifyProvider: fs.String("verify-provider", "", "Provider for the verifier (defaults to the task's provider)"),
+		verifyModel:    fs.String("verify-model", "", "Model for the verifier (defaults to the task's model)"),
+
+		plan:         fs.Bool("plan", false, "Break the task into subtasks, run each, then synthesize a final answer"),
+		planProvider: fs.String("plan-provider", "", "Provider for planning and synthesis (defaults to the task's provider)"),
+		planModel:    fs.String("plan-model", "", "Model for planning and synthesis (defaults to the task's model)"),
+		planModels:   fs.String("plan-models", "", "Comma-separated provider/model choices the planner may assign to subtasks (e.g. local/llama3,cloud)"),
+		planMaxSteps: fs.Int("plan-max-steps", 6, "Maximum number of subtasks in a plan"),
+		autoApprove:  fs.Bool("auto-approve", false, "Run plans whose steps may use tools with side effects without asking for approval, for trusted pipelines"),
+
+		debate:       fs.Int("debate", 0, "Have this many agents answer independently, critique each other, and pick the best answer"),
+		debateModels: fs.String("debate-models", "", "Comma-separated provider/model choices assigned to debate agents in turn (defaults to the task's model)"),
+		debateRounds: fs.Int("debate-rounds", 1, "Critique rounds in a debate"),
+		debateJudge:  fs.String("debate-judge", "", "Who picks the debate's answer: 'vote' (the agents vote) or a provider/model (defaults to the task's model)"),
+
+		contextStrategy: fs.String("context-strategy", ContextTruncateMiddle, "When the prompt exceeds the model's window: 'error', 'truncate-head', 'truncate-middle' or 'summarize'"),
+		contextWindow:   fs.Int("context-window", 0, "Override the model's context window in tokens"),
+		reserveTokens:   fs.Int("reserve-tokens", 1024, "Tokens of the window kept free for the answer"),
+
+		compactAt:       fs.Float64("compact-at", 0.8, "In chat and the tool loop, summarize older turns once the prompt reaches this fraction of the window (0 disables)"),
+		compactKeep:     fs.Int("compact-keep", 4, "Most recent turns kept verbatim when older ones are summarized"),
+		compactProvider: fs.String("compact-provider", "local", "Provider that summarizes older turns (falls back to the task's provider if it fails)"),
+		compactModel:    fs.String("compact-model", "", "Model that summarizes older turns (defaults to the provider's default)"),
+
+		compress:          fs.Bool("compress", false, "Have a small local model strip boilerplate and repetition from long piped input and .log context files before a task goes to a non-local provider"),
+		compressProvider:  fs.String("compress-provider", "local", "Provider that compresses for --compress"),
+		compressModel:     fs.String("compress-model", "", "Model that compresses for --compress, ideally a small one (defaults to the provider's default)"),
+		compressMinTokens: fs.Int("compress-min-tokens", 4000, "Inputs and .log files shorter than this many tokens are sent uncompressed"),
+
+		degrade: fs.String("degrade", DegradeEmulate, "When the provider lacks a feature the task needs: 'emulate' where helix can (a --format schema is asked for in the prompt and checked after) or 'fail' fast"),
+		binary:  fs.String("binary", BinaryAuto, "What to send of binary context files and piped input: 'auto' (images to vision models, the rest left out), 'skip', 'strings' (their printable strings), 'hex' (a hex dump of the start) or 'refuse' (fail the task)"),
+
+		route: fs.String("route", "", "Pick provider and model automatically when --model is not set: 'cheapest', 'fastest' or 'best'"),
+
+		auditLog: fs.String("audit-log", config.Audit.Path, "Append a hash-chained JSONL record of every task to this file"),
+
+		redact:          fs.String("redact", strings.Join(config.Guardrails.Redact.Entities, ","), "Mask these entities in the task before it is sent: comma-separated email, phone, credit_card, secret, config patterns, or 'all'"),
+		redactScope:     fs.String("redact-scope", config.Guardrails.Redact.Scope, "Which tasks --redact applies to: 'cloud' (non-local providers, the default) or 'all'"),
+		secretScan:      fs.String("secret-scan", secretScanDefault(), "What to do when a task bound for a non-local provider contains credentials: 'block', 'warn' or 'off'"),
+		allowSecrets:    fs.Bool("allow-secrets", false, "Send tasks even if the secret scan finds credentials"),
+		allowClassified: fs.Bool("allow-classified", false, "Let tasks that guardrails.classification labels use non-local providers; the override is audited"),
+		redactResponses: fs.Bool("redact-responses", config.Guardrails.Redact.Responses, "Also mask the response before it is returned or stored"),
+
+		moderation:       fs.String("moderation", config.Guardrails.Moderation.Provider, "Moderate task and answer with 'keywords' (from the config), 'openai', 'exec:<command>' or 'off'"),
+		deadline:         fs.Duration("deadline", 0, "Stop the task after this long (e.g. 20s); a direct answer cut off mid-stream is returned as far as it got, flagged as truncated"),
+		dryRun:           fs.Bool("dry-run", false, "Show the final prompt, provider payload, token estimate and cost without calling the provider"),
+		moderationAction: fs.String("moderation-action", moderationActionDefault(), "What to do with flagged text: 'block', 'flag' (warning in the result) or 'log' (stderr)"),
+
+		tools:        fs.String("tools", strings.Join(config.Tools.Enabled, ","), "Comma-separated tools the model may call while answering (run 'helix tools' to list them, or 'all')"),
+		toolEnv:      toolEnv,
+		maxToolSteps: fs.Int("max-tool-steps", 8, "Maximum tool calls per task before the model must answer"),
+		toolTokens:   fs.Int("tool-output-tokens", config.Tools.Output["*"].MaxTokens, "Tokens of a tool result fed back to the model; 0 is a quarter of the prompt budget (tools.output in the config sets it per tool)"),
+		toolOverflow: fs.String("tool-output-overflow", config.Tools.Output["*"].Overflow, "How a tool result over --tool-output-tokens is cut down: 'tail' (keep the end; the default), 'head' (keep the start) or 'summarize' (a model condenses it)"),
+		toolPolicy:   fs.String("tool-policy", config.Tools.Policy, "JSON file of profiles granting or denying tools, checked at every tool call"),
+		toolProfile:  fs.String("tool-profile", "", "Profile of --tool-policy to apply (default: the policy's default)"),
+
+		noCheckpoint: fs.Bool("no-checkpoint", false, "Don't save the progress of --plan and --tools runs for 'helix resume'"),
+		noSnapshot:   fs.Bool("no-snapshot", false, "Don't snapshot the workspace for 'helix rollback' before tools with side effects run"),
+		noHistory:    fs.Bool("no-history", config.History.Disabled, "Don't record the run for 'helix replay'"),
+		seed:         fs.Int64("seed", 0, "Sampling seed of the answer, where the provider takes one (0 picks one at random; the result reports it)"),
+		manifest:     fs.String("write-manifest", "", "Write a manifest of each run, for 'helix replay --manifest' on any machine, to this .json file or as <run-id>.json in this directory"),
+
+		memory:          fs.Bool("memory", config.Memory.Enabled, "Recall relevant facts from earlier sessions and let the model save new ones (uses the tool loop)"),
+		memoryNamespace: fs.String("memory-namespace", memoryNamespaceDefault(), "Memory namespace; facts in one namespace are never seen from another"),
+
+		kb:               fs.String("kb", "", "Put the chunks of this knowledge base most relevant to the task in the prompt (see helix kb ingest)"),
+		retrieval:        addRetrievalFlags(fs),
+		requireCitations: fs.Bool("require-citations", config.Knowledge.RequireCitations, "Fail a task whose answer cites none of the knowledge base chunks it was given"),
+
+		geminiCache: fs.String("gemini-cache", "", "Gemini context cache (name or display name) the prompt follows on from, billed at the cached rate (see helix cache create)"),
+
+		ground: fs.Bool("ground", false, "Let Gemini search Google for current information; the queries and source links are reported with the result (provider=cloud)"),
+
+		kubeJobs: fs.Bool("kube-jobs", false, "Run debate agents and plan steps as Kubernetes Jobs (see kubernetes in the config)"),
+	}
+}
+
+// checkModel vets the provider and model req is to be answered on: the
+// tenant may use them, the provider is in rotation, and it can do what the
+// task needs.
+func (r *runner) checkModel(ctx context.Context, req TaskRequest) error {
+	if req.allow != nil {
+		if err := req.allow(req.Provider, req.Model); err != nil {
+			return err
+		}
+	}
+	if rotation.disabled(req.Provider) {
+		return kindError(ErrUnreachable, "provider %s is out of rotation", req.Provider)
+	}
+	if err := validateCapabilities(req); err != nil {
+		return err
+	}
+	if err := r.checkProvider(ctx, req); err != nil {
+		return redactErr(err)
+	}
+	return nil
+}
+
+// run executes a single request against its provider and cleans the output.
+func (r *runner) run(ctx context.Context, req TaskRequest) (res TaskResult, err error) {
+	if req.ID == "" {
+		req.ID = newID()
+	}
+	defer func() { res.Tags, res.Version = req.Tags, version }()
+	if !runIDRe.MatchString(req.ID) {
+		err := kindError(ErrConfig, "invalid run ID %q: use up to 128 letters, digits, '.', '_', ':' and '-'", req.ID)
+		return TaskResult{ID: req.ID, Provider: req.Provider, Error: err.Error()}, err
+	}
+	if err := validateTags(req.Tags); err != nil {
+		err = kindError(ErrConfig, "%v", err)
+		return TaskResult{ID: req.ID, Provider: req.Provider, Error: err.Error()}, err
+	}
+	if req.Contract != nil {
+		err := applyContract(&req)
+		if err == nil {
+			err = r.checkContractTools(req.Contract)
+		}
+		if err != nil {
+			err = kindError(ErrConfig, "%v", err)
+			return TaskResult{ID: req.ID, Provider: req.Provider, Error: err.Error()}, err
+		}
+	}
+	if r.audit != nil {
+		defer func() {
+			if aerr := r.audit.record(req, res); aerr != nil {
+				fmt.Fprintf(os.Stderr, "Error: audit: %v\n", aerr)
+			}
+		}()
+	}
+	// Recorded after the deferred usage and logs below are filled in.
+	var recorded *TaskRequest
+	var started time.Time
+	if r.history != nil || r.manifest != "" {
+		defer func() {
+			if recorded == nil {
+				return
+			}
+			if r.history != nil {
+				r.recordHistory(*recorded, res, time.Since(started))
+			}
+			if r.manifest != "" {
+				r.writeManifest(*recorded, res, time.Since(started))
+			}
+		}()
+	}
+	// Runs before the audit record above so that it sees the kind too.
+	meter, log, grounding := &usageMeter{}, &runLog{}, &groundingLog{}
+	ctx = withGrounding(withRunLog(withUsage(ctx, meter), log), grounding)
+	defer func() {
+		if err != nil {
+			res.ErrorKind = errorKind(err)
+		}
+		res.Usage = meter.usage()
+		res.Grounding = grounding.grounding()
+		res.Logs = log.entries()
+	}()
+
+	var decision *RouteDecision
+	if req.Route == "" {
+		req.Route = r.route
+	}
+	if req.Route != "" && req.Model == "" {
+		if !validRoute(req.Route) {
+			err := kindError(ErrConfig, "invalid route %q: expected cheapest, fastest or best", req.Route)
+			return TaskResult{ID: req.ID, Provider: req.Provider, Error: err.Error()}, err
+		}
+		choice, dec, err := r.routeTask(req, req.Route)
+		if err != nil {
+			return TaskResult{ID: req.ID, Provider: req.Provider, Route: dec, Error: err.Error()}, err
+		}
+		req.Provider, req.Model, decision = choice.provider, choice.model, dec
+	}
+
+	if req.Provider == "" {
+		req.Provider = "local"
+	}
+	req.Model = defaultModel(req.Provider, req.Model)
+	res = TaskResult{ID: req.ID, Provider: req.Provider, Model: req.Model, Route: decision}
+	if len(req.Audio) > 0 {
+		setStage(ctx, "transcribe")
+		if err := r.transcribeAudio(ctx, &req); err != nil {
+			err = redactErr(err)
+			res.Error = err.Error()
+			return res, err
+		}
+	}
+	if ctx, res.Classification = r.classifyTask(ctx, &req); res.Classification != nil {
+		res.Provider, res.Model = req.Provider, req.Model
+	}
+	query := req.Task
+	if err := r.handleBinary(&req, &res); err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	r.compressInput(ctx, &req, &res)
+	if w := r.attachInput(&req); w != "" {
+		res.Warnings = append(res.Warnings, w)
+	}
+	res.Packed = r.packContext(&req)
+	if err := r.checkModel(ctx, req); err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	if d := r.deadlineFor(req); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if err := r.checkGrounding(req); err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	req.Ground = req.Ground || r.ground
+	if err := r.resolveGeminiCache(ctx, &req); err != nil {
+		err = redactErr(err)
+		res.Error = err.Error()
+		return res, err
+	}
+	if err := r.retrieveKnowledge(ctx, &req, query, &res); err != nil {
+		err = redactErr(err)
+		res.Error = err.Error()
+		return res, err
+	}
+	if req.Seed == 0 {
+		req.Seed = r.seed
+	}
+	if req.Seed == 0 {
+		req.Seed = newSeed()
+	}
+	res.Seed = req.Seed
+	if (r.history != nil || r.manifest != "") && !r.dryRun && !req.DryRun {
+		eff := r.effectiveRequest(req)
+		recorded, started = &eff, time.Now()
+	}
+	if err := r.execute(ctx, req, &res); err != nil {
+		// Provider errors can echo request URLs and headers.
+		err = redactErr(err)
+		res.Error = err.Error()
+		return res, err
+	}
+	if req.Contract != nil && !r.dryRun && !req.DryRun {
+		cr, err := r.assessContract(ctx, req, res.Output)
+		if err != nil {
+			res.Warnings = append(res.Warnings, redactErr(err).Error())
+			cr = &ContractResult{Contract: *req.Contract}
+		}
+		cr.Contract.Env = hideEnvValues(cr.Contract.Env)
+		res.Contract = cr
+	}
+	if r.checkpoints != nil {
+		r.checkpoints.remove(req.ID)
+	}
+	return res, nil
+}
+
+// execute runs the stages of a task, filling in res as it goes: answer
+// (directly, via a debate or via the planner), verify, extract files, post-process, upload.
+func (r *runner) execute(ctx context.Context, req TaskRequest, res *TaskResult) error {
+	parts, err := r.promptParts(ctx, req)
+	if err != nil {
+		return err
+	}
+	if r.redact != nil && r.redact.appliesTo(r, req) {
+		counts := map[string]int{}
+		for i := range parts {
+			parts[i].text = r.redact.mask(parts[i].text, counts)
+		}
+		if len(counts) > 0 {
+			res.Redactions = &RedactionReport{Prompt: counts}
+		}
+	}
+	var sections []PromptSection
+	req.Task, sections = joinPrompt(parts)
+	res.promptSHA256, res.sections = sha256Hex(req.Task), sections
+
+	cg := &cloudGuard{redact: r.redact, secretScan: r.secretScan, counts: map[string]int{}}
+	if r.secretScan != SecretScanOff && r.leavesMachine(req) {
+		if found := scanSecrets(req.Task); len(found) > 0 {
+			msg := "task appears to contain secrets: " + strings.Join(found, ", ")
+			if r.secretScan == SecretScanBlock {
+				return kindError(ErrSafety, "%s; not sending it off this machine (pass --allow-secrets to override or --redact secret to mask them)", msg)
+			}
+			res.Warnings = append(res.Warnings, msg)
+			cg.warned = true
+		}
+	}
+	ctx = withCloudGuard(ctx, cg)
+	defer cg.report(res)
+
+	if r.dryRun || req.DryRun {
+		return r.preview(ctx, req, sections, res)
+	}
+
+	if r.moderation != nil {
+		setStage(ctx, "moderation")
+		if err := r.moderateStage(ctx, "input", req.Task, res); err != nil {
+			return err
+		}
+	}
+
+	debate := r.debate
+	if req.Debate > 0 {
+		debate.agents = req.Debate
+	}
+	if r.snapshots && debate.agents <= 1 && req.resume == nil && len(r.sideEffectTools()) > 0 {
+		id, err := r.snapshotWorkspace(ctx, req)
+		if err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%v; helix rollback won't be able to undo this run", err))
+		}
+		res.Snapshot = id
+	}
+
+	var cleaned string
+	if debate.agents > 1 {
+		setStage(ctx, "debate")
+		d, answer, err := r.runDebate(ctx, req, debate)
+		res.Debate = d
+		if err != nil {
+			return err
+		}
+		cleaned = answer
+	} else if r.plan.enabled || req.Plan {
+		setStage(ctx, "plan")
+		plan, answer, err := r.runPlan(ctx, req)
+		res.Plan = plan
+		for _, s := range plan.Steps {
+			res.ToolCalls = append(res.ToolCalls, s.ToolCalls...)
+			for _, f := range s.Injection {
+				noteInjection(res, f)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		cleaned = answer
+	} else if len(r.tools) > 0 {
+		setStage(ctx, "tools")
+		answer, err := r.callTools(ctx, req, res)
+		if err != nil {
+			return err
+		}
+		cleaned = answer
+	} else {
+		setStage(ctx, "answer")
+		prompt, report, err := r.fitPrompt(ctx, req, req.Task)
+		res.Context = report
+		if err != nil {
+			return err
+		}
+		if r.speculate.enabled || req.Speculate {
+			var winner modelChoice
+			if cleaned, winner, err = r.race(ctx, req, prompt, res); err != nil {
+				return err
+			}
+			req.Provider, req.Model = winner.provider, winner.model
+			res.Provider, res.Model = winner.provider, winner.model
+		} else if r.escalateFor(req).chain != "" {
+			var used modelChoice
+			if cleaned, used, err = r.answerEscalating(ctx, req, prompt, res); err != nil {
+				return err
+			}
+			req.Provider, req.Model = used.provider, used.model
+			res.Provider, res.Model = used.provider, used.model
+		} else if cleaned, err = r.answer(ctx, req, prompt, res); err != nil {
+			return err
+		}
+	}
+
+	// A truncated answer is kept, so the remaining local stages
+	// must not be cut short by the same deadline; verifying is skipped.
+	if res.Truncated {
+		ctx = context.WithoutCancel(ctx)
+	}
+	verify := r.verify
+	if req.VerifyRounds > 0 {
+		verify.rounds = req.VerifyRounds
+	}
+	if verify.rounds > 0 && !res.Truncated {
+		setStage(ctx, "verify")
+		cleaned, res.Verification, err = r.verifyAnswer(ctx, req.Task, cleaned, req, verify)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cc := r.confidenceFor(req); cc.enabled {
+		setStage(ctx, "confidence")
+		c, err := r.assessConfidence(ctx, req, cleaned, res, cc)
+		switch {
+		case err != nil && cc.min > 0:
+			return err
+		case err != nil:
+			res.Warnings = append(res.Warnings, err.Error())
+		case c.Score < cc.min:
+			c.Abstained, c.Withheld = true, cleaned
+			cleaned = abstainMessage
+		}
+		res.Confidence = c
+	}
+
+	if r.provenance != ProvenanceOff {
+		res.Provenance = &Provenance{RunID: req.ID, Provider: res.Provider, Model: res.Model, Generated: time.Now().UTC(), Version: version}
+	}
+	if r.extractFiles {
+		if res.Files, err = writeExtractedFiles(r.workspace, req.Task, parseFileBlocks(cleaned), res.Provenance, r.provenance); err != nil {
+			return err
+		}
+	}
+
+	if !res.Truncated {
+		setStage(ctx, "length")
+		if cleaned, res.Length, err = r.enforceLength(ctx, req, cleaned); err != nil {
+			return err
+		}
+	}
+
+	post := r.post
+	if req.Post != "" {
+		if post, err = parsePostChain(req.Post); err != nil {
+			return err
+		}
+	}
+	setStage(ctx, "post")
+	if res.Output, err = applyPostChain(ctx, post, cleaned); err != nil {
+		return err
+	}
+	if err := r.citeSources(res.Output, res); err != nil {
+		return err
+	}
+	res.Output = convertAnswer(textFormat(r.answerFormat(req)), res.Output)
+	if r.moderation != nil {
+		if err := r.moderateStage(ctx, "output", res.Output, res); err != nil {
+			res.Output, res.Thinking = "", ""
+			return err
+		}
+	}
+	if r.redact != nil && r.redact.responses {
+		counts := map[string]int{}
+		res.Output = r.redact.mask(res.Output, counts)
+		res.Thinking = r.redact.mask(res.Thinking, counts)
+		if len(counts) > 0 {
+			if res.Redactions == nil {
+				res.Redactions = &RedactionReport{}
+			}
+			res.Redactions.Response = counts
+		}
+	}
+
+	if r.shouldUpload(req, res.Output) {
+		setStage(ctx, "upload")
+		key := fmt.Sprintf("%s/%s.txt", time.Now().UTC().Format("2006-01-02"), req.ID)
+		url, err := r.artifacts.put(ctx, key, []byte(res.Output), "text/plain; charset=utf-8")
+		if err != nil {
+			return err
+		}
+		res.ArtifactURL = url
+		res.OutputBytes = len(res.Output)
+		res.Output = ""
+	}
+	return nil
+}
+
+func (r *runner) shouldUpload(req TaskRequest, output string) bool {
+	if r.artifacts == nil {
+		return false
+	}
+	mode := req.Artifacts
+	if mode == "" {
+		mode = r.artifactMode
+	}
+	switch mode {
+	case ArtifactsAlways:
+		return true
+	case ArtifactsNever:
+		return false
+	default:
+		return len(output) > r.artifactThreshold
+	}
+}
+
+// newRunner builds a runner from the shared flags.
+func newRunner(key string, rf *runnerFlags) (*runner, error) {
+	af := rf.artifacts
+	store, err := af.open()
+	if err != nil {
+		return nil, err
+	}
+	switch *af.mode {
+	case ArtifactsAuto, ArtifactsAlways, ArtifactsNever:
+	default:
+		return nil, fmt.Errorf("invalid --artifacts %q: expected auto, always or never", *af.mode)
+	}
+	post, err := parsePostChain(*rf.post)
+	if err != nil {
+		return nil, err
+	}
+	var verify verifyConfig
+	if *rf.verify {
+		verify = verifyConfig{rounds: *rf.verifyRounds, provider: *rf.verifyProvider, model: *rf.verifyModel}
+	}
+
+	choices, err := parseModelChoices(*rf.planModels)
+	if err != nil {
+		return nil, err
+	}
+	plan := planConfig{
+		enabled:  *rf.plan,
+		provider: *rf.planProvider,
+		model:    *rf.planModel,
+		choices:  choices,
+		maxSteps: *rf.planMaxSteps,
+
+		autoApprove: *rf.autoApprove,
+	}
+
+	debateChoices, err := parseModelChoices(*rf.debateModels)
+	if err != nil {
+		return nil, err
+	}
+	if j := *rf.debateJudge; j != "" && j != debateJudgeVote {
+		if c, err := parseModelChoices(j); err != nil || len(c) != 1 {
+			return nil, fmt.Errorf("invalid --debate-judge %q: expected vote or a single provider/model", j)
+		}
+	}
+	debate := debateConfig{
+		agents:  *rf.debate,
+		choices: debateChoices,
+		rounds:  *rf.debateRounds,
+		judge:   *rf.debateJudge,
+	}
+
+	if !validContextStrategy(*rf.contextStrategy) {
+		return nil, fmt.Errorf("invalid --context-strategy %q", *rf.contextStrategy)
+	}
+	if !validSelectPolicy(*rf.selectPolicy) {
+		return nil, fmt.Errorf("invalid --select %q: expected first, longest, judge or consistent", *rf.selectPolicy)
+	}
+	candidates := candidateConfig{n: *rf.candidates, policy: *rf.selectPolicy, judge: *rf.selectJudge, match: *rf.consistMatch, temperature: *rf.consistTemp}
+	if n := *rf.consistency; n != 0 {
+		if n < 2 {
+			return nil, fmt.Errorf("--self-consistency must be at least 2")
+		}
+		candidates.n, candidates.policy = n, SelectConsistent
+	}
+	if !validConsistencyMatch(*rf.consistMatch) {
+		return nil, fmt.Errorf("invalid --consistency-match %q: expected exact or embedding", *rf.consistMatch)
+	}
+	if t := *rf.consistTemp; t <= 0 || t > 2 {
+		return nil, fmt.Errorf("--consistency-temperature must be above 0 and at most 2")
+	}
+	if *rf.selectJudge != "" {
+		if _, err := parseModelChoices(*rf.selectJudge); err != nil {
+			return nil, fmt.Errorf("invalid --select-judge: %v", err)
+		}
+	}
+	if *rf.minConfidence < 0 || *rf.minConfidence > 1 {
+		return nil, fmt.Errorf("invalid --min-confidence %v: expected 0 to 1", *rf.minConfidence)
+	}
+	if *rf.confidenceJudge != "" {
+		if _, err := parseModelChoices(*rf.confidenceJudge); err != nil {
+			return nil, fmt.Errorf("invalid --confidence-judge: %v", err)
+		}
+	}
+	format, err := parseFormat(*rf.format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format: %v", err)
+	}
+	grammar, err := readGrammar(*rf.grammar)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --grammar: %v", err)
+	}
+	if *rf.thinkBudget < 0 {
+		return nil, fmt.Errorf("--think-budget must not be negative")
+	}
+	if !validEffort(*rf.effort) {
+		return nil, fmt.Errorf("invalid --reasoning-effort %q: expected none, low, medium or high", *rf.effort)
+	}
+	if *rf.compactAt < 0 || *rf.compactAt > 1 {
+		return nil, fmt.Errorf("invalid --compact-at %v: expected a fraction between 0 and 1", *rf.compactAt)
+	}
+	if *rf.compactKeep < 1 {
+		return nil, fmt.Errorf("--compact-keep must be at least 1")
+	}
+	if *rf.compressMinTokens < 0 {
+		return nil, fmt.Errorf("--compress-min-tokens must not be negative")
+	}
+	if !validDegrade(*rf.degrade) {
+		return nil, fmt.Errorf("invalid --degrade %q: expected emulate or fail", *rf.degrade)
+	}
+	if !validBinaryPolicy(*rf.binary) {
+		return nil, fmt.Errorf("invalid --binary %q: expected auto, skip, strings, hex or refuse", *rf.binary)
+	}
+
+	if *rf.maxWords < 0 || *rf.maxLines < 0 {
+		return nil, fmt.Errorf("--max-words and --max-lines must not be negative")
+	}
+	if !validLengthEnforce(*rf.lengthEnf) {
+		return nil, fmt.Errorf("invalid --length-enforce %q: expected truncate or condense", *rf.lengthEnf)
+	}
+
+	if *rf.style != "" {
+		if _, err := lookupStyle(*rf.style); err != nil {
+			return nil, fmt.Errorf("invalid --style: %v", err)
+		}
+	}
+
+	if *rf.examples != "" {
+		if _, _, err := exampleBlock(*rf.examples); err != nil {
+			return nil, fmt.Errorf("invalid --examples: %v", err)
+		}
+	}
+
+	if *rf.toolOverflow != "" && !validOverflow(*rf.toolOverflow) {
+		return nil, fmt.Errorf("invalid --tool-output-overflow %q: expected tail, head or summarize", *rf.toolOverflow)
+	}
+	for name, b := range config.Tools.Output {
+		if b.Overflow != "" && !validOverflow(b.Overflow) {
+			return nil, fmt.Errorf("invalid tools.output.%s.overflow %q: expected tail, head or summarize", name, b.Overflow)
+		}
+	}
+
+	if _, err := parseModelChoices(*rf.escalate); err != nil {
+		return nil, fmt.Errorf("invalid --escalate: %v", err)
+	}
+	if *rf.escalateMinScore < 0 || *rf.escalateMinScore > 10 {
+		return nil, fmt.Errorf("invalid --escalate-min-score %v: expected 0 to 10", *rf.escalateMinScore)
+	}
+
+	if !validRoute(*rf.route) {
+		return nil, fmt.Errorf("invalid --route %q: expected cheapest, fastest or best", *rf.route)
+	}
+	if !validProvenance(*rf.provenance) {
+		return nil, fmt.Errorf("invalid --provenance %q: expected comment, sidecar or off", *rf.provenance)
+	}
+
+	redact, err := newRedactor(*rf.redact, *rf.redactScope, *rf.redactResponses)
+	if err != nil {
+		return nil, err
+	}
+
+	secretScan := *rf.secretScan
+	switch secretScan {
+	case SecretScanBlock, SecretScanWarn, SecretScanOff:
+	default:
+		return nil, fmt.Errorf("invalid --secret-scan %q: expected block, warn or off", secretScan)
+	}
+	if *rf.allowSecrets {
+		secretScan = SecretScanOff
+	}
+	classifier, err := newClassifier(config.Guardrails.Classification, *rf.allowClassified)
+	if err != nil {
+		return nil, err
+	}
+
+	mod, err := newModerator(*rf.moderation)
+	if err != nil {
+		return nil, err
+	}
+	switch *rf.moderationAction {
+	case ModerationBlock, ModerationFlag, ModerationLog:
+	default:
+		return nil, fmt.Errorf("invalid --moderation-action %q: expected block, flag or log", *rf.moderationAction)
+	}
+
+	tools, err := newTools(*rf.tools, *rf.workspace)
+	if err != nil {
+		return nil, err
+	}
+	toolEnv, err := parseToolEnv(*rf.toolEnv)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := loadToolPolicy(*rf.toolPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		if _, _, err := policy.profile(*rf.toolProfile); err != nil {
+			return nil, err
+		}
+	} else if *rf.toolProfile != "" {
+		return nil, fmt.Errorf("--tool-profile needs --tool-policy")
+	}
+	var memory *memoryStore
+	if *rf.memory {
+		if memory, err = openMemory(*rf.memoryNamespace, key); err != nil {
+			return nil, err
+		}
+		tools = append(tools, memoryTool{memory})
+	}
+
+	retrieval, err := rf.retrieval.config(*rf.kb)
+	if err != nil {
+		return nil, err
+	}
+	retrieval.requireCitations = *rf.requireCitations
+
+	var checkpoints *checkpointStore
+	if !*rf.noCheckpoint {
+		if checkpoints, err = openCheckpoints(); err != nil {
+			return nil, err
+		}
+	}
+
+	var history *historyStore
+	if !*rf.noHistory {
+		if history, err = openHistory(); err != nil {
+			return nil, err
+		}
+	}
+
+	var kube *orchestrator.KubeJob
+	if *rf.kubeJobs {
+		if kube, err = newKubeJob(config.Kubernetes); err != nil {
+			return nil, err
+		}
+	}
+
+	var audit *auditLog
+	if *rf.auditLog != "" {
+		if audit, err = openAuditLog(*rf.auditLog, config.Audit.IncludeTask); err != nil {
+			return nil, err
+		}
+	}
+
+	return &runner{
+		key:               key,
+		artifacts:         store,
+		artifactMode:      *af.mode,
+		artifactThreshold: *af.threshold,
+		post:              post,
+		postSpec:          *rf.post,
+		workspace:         *rf.workspace,
+		extractFiles:      *rf.extractFiles,
+		provenance:        *rf.provenance,
+		verify:            verify,
+		plan:              plan,
+		debate:            debate,
+		context: contextConfig{
+			strategy:      *rf.contextStrategy,
+			window:        *rf.contextWindow,
+			reserveTokens: *rf.reserveTokens,
+		},
+		compact: compactConfig{
+			at:       *rf.compactAt,
+			keep:     *rf.compactKeep,
+			provider: *rf.compactProvider,
+			model:    *rf.compactModel,
+		},
+		compress:    compressConfig{enabled: *rf.compress, provider: *rf.compressProvider, model: *rf.compressModel, minTokens: *rf.compressMinTokens},
+		binary:      *rf.binary,
+		degrade:     *rf.degrade,
+		route:       *rf.route,
+		stop:        *rf.stop,
+		speculate:   speculateConfig{enabled: *rf.speculate, models: *rf.speculateModels, gate: *rf.speculateGate, judge: *rf.speculateJudge},
+		escalate:    escalateConfig{chain: *rf.escalate, minScore: *rf.escalateMinScore, judge: *rf.escalateJudge},
+		candidates:  candidates,
+		constraints: constraints{format: format, grammar: grammar},
+		reasoning:   reasoningConfig{budget: *rf.thinkBudget, effort: *rf.effort},
+		lang:        *rf.lang,
+		style:       *rf.style,
+		locale:      localeContext{on: *rf.timeContext, locale: *rf.locale, timezone: *rf.timezone},
+		confidence:  confidenceConfig{enabled: *rf.confidence, min: *rf.minConfidence, judge: *rf.confidenceJudge},
+		examples:    *rf.examples,
+		length:      lengthLimit{words: *rf.maxWords, lines: *rf.maxLines, enforce: *rf.lengthEnf},
+		audit:       audit,
+		redact:      redact,
+		secretScan:  secretScan,
+		classifier:  classifier,
+
+		moderation:       mod,
+		moderationName:   *rf.moderation,
+		moderationAction: *rf.moderationAction,
+
+		dryRun: *rf.dryRun,
+
+		deadline: *rf.deadline,
+
+		seed:     *rf.seed,
+		history:  history,
+		manifest: *rf.manifest,
+
+		tools:        tools,
+		toolEnv:      toolEnv,
+		maxToolSteps: *rf.maxToolSteps,
+		toolOutput:   ToolOutputBudget{MaxTokens: *rf.toolTokens, Overflow: *rf.toolOverflow},
+		toolPolicy:   policy,
+		toolProfile:  *rf.toolProfile,
+
+		checkpoints: checkpoints,
+		snapshots:   !*rf.noSnapshot,
+
+		memory: memory,
+
+		retrieval: retrieval,
+
+		geminiCache: *rf.geminiCache,
+		ground:      *rf.ground,
+
+		kube: kube,
+	}, nil
+}
+
+// deadlineFor is how long req may run, 0 for no limit.
+func (r *runner) deadlineFor(req TaskRequest) time.Duration {
+	if req.DeadlineMS > 0 {
+		return time.Duration(req.DeadlineMS) * time.Millisecond
+	}
+	return r.deadline
+}
+
+// newID returns a random identifier for tasks that were submitted without one.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateShellTimeout bounds each sh call of a task template.
+const templateShellTimeout = 30 * time.Second
+
+// taskTemplate renders --template tasks: Go text/template syntax over the
+// --var values, with functions for assembling a prompt from files,
+// commands and data.
+type taskTemplate struct {
+	dir   string // include and sh paths are relative to it
+	shell bool   // --template-shell allows sh
+}
+
+func (t taskTemplate) funcs() template.FuncMap {
+	return template.FuncMap{
+		// include "notes.md" is the file's text.
+		"include": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(t.dir, path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+		// sh "git log -5 --oneline" is the command's output.
+		"sh": func(command string) (string, error) {
+			if !t.shell {
+				return "", fmt.Errorf("sh is disabled; pass --template-shell to let the template run %q", command)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), templateShellTimeout)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, "sh", "-c", command)
+			cmd.Dir = t.dir
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				return "", fmt.Errorf("sh %q: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+			}
+			return strings.TrimRight(string(out), "\n"), nil
+		},
+		// truncateTokens 500 text keeps about the first 500 tokens, so that
+		// it pipes: {{include "big.log" | truncateTokens 500}}.
+		"truncateTokens": func(n int, s string) string {
+			if estimateTokens(s) <= n {
+				return s
+			}
+			runes := []rune(s)
+			return string(runes[:min(n*charsPerToken, len(runes))]) + "\n[... truncated ...]"
+		},
+		// json v is v as JSON.
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		// now is the time in RFC 3339, or now "2006-01-02" in that layout.
+		"now": func(layout ...string) string {
+			if len(layout) > 0 {
+				return time.Now().Format(layout[0])
+			}
+			return time.Now().Format(time.RFC3339)
+		},
+	}
+}
+
+// render executes text as a template with vars as its data ({{.name}}).
+// A missing variable is an error rather than an empty string.
+func (t taskTemplate) render(text string, vars map[string]string) (string, error) {
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	return t.execute("task", text, vars)
+}
+
+// execute renders text, a template of the given kind, over data.
+func (t taskTemplate) execute(kind, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(kind).Funcs(t.funcs()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s template: %v", kind, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("rendering %s template: %v", kind, err)
+	}
+	return b.String(), nil
+}
+
+// varFlag collects repeated --var key=value flags.
+type varFlag map[string]string
+
+func (v varFlag) String() string { return formatTags(v) }
+
+func (v varFlag) Set(s string) error {
+	k, val, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	v[k] = val
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerConfig is the "server" config section.
+type ServerConfig struct {
+	// Tenants enables bearer-token auth for serve. With none configured the
+	// API is open, as before.
+	Tenants []TenantConfig `json:"tenants,omitempty"`
+	// IdempotencyWindow is how long a POST /v1/tasks Idempotency-Key is
+	// remembered, as a duration (default 24h; 0 ignores the header).
+	IdempotencyWindow string `json:"idempotency_window,omitempty"`
+	// Limits caps the size of each request.
+	Limits RequestLimits `json:"limits"`
+	// AdminToken, given literally or as a vault:// or exec: reference,
+	// enables the admin endpoints such as POST /admin/reload for callers
+	// bearing it.
+	AdminToken string `json:"admin_token,omitempty"`
+	// RequestEnv names the tool environment variables a request's contract
+	// may set, to literal values only; with none, requests set none.
+	RequestEnv []string `json:"request_env,omitempty"`
+	// RequestToolProfiles names the --tool-policy profiles a request's
+	// tool_profile may pick; with none, requests get the server's. A
+	// picked profile only narrows the server's: a call must pass both.
+	RequestToolProfiles []string `json:"request_tool_profiles,omitempty"`
+}
+
+// TenantConfig is one team sharing the service.
+type TenantConfig struct {
+	Name string `json:"name"`
+	// Token is the bearer token, given literally or as a vault:// or exec:
+	// reference.
+	Token string `json:"token"`
+	// Providers and Models restrict what the tenant may use; empty allows
+	// everything. A model ending in "*" matches by prefix.
+	Providers []string    `json:"providers,omitempty"`
+	Models    []string    `json:"models,omitempty"`
+	Quota     TenantQuota `json:"quota"`
+	// ToolProfile, when set, is the --tool-policy profile of all the
+	// tenant's tasks, whatever they ask for.
+	ToolProfile string `json:"tool_profile,omitempty"`
+}
+
+// TenantQuota caps usage per window. Zero means unlimited. Tokens are the
+// estimated prompt plus output tokens of finished tasks. Counters live in
+// memory, so each serve process enforces its own quota.
+type TenantQuota struct {
+	Requests int    `json:"requests,omitempty"`
+	Tokens   int    `json:"tokens,omitempty"`
+	Window   string `json:"window,omitempty"` // duration, default 24h
+}
+
+// tenant is a TenantConfig with its resolved token and usage counters.
+type tenant struct {
+	TenantConfig
+	tokenHash [32]byte
+	window    time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	tokens   int
+}
+
+// loadTenants resolves the configured tenants' tokens.
+func loadTenants(cfgs []TenantConfig) ([]*tenant, error) {
+	var out []*tenant
+	for _, c := range cfgs {
+		if c.Name == "" || c.Token == "" {
+			return nil, fmt.Errorf("server tenants need a name and a token")
+		}
+		token := c.Token
+		if isSecretRef(token) {
+			v, _, err := resolveSecretRef(context.Background(), token)
+			if err != nil {
+				return nil, fmt.Errorf("token for tenant %s: %v", c.Name, err)
+			}
+			token = v
+		}
+		registerSecret(token)
+		t := &tenant{TenantConfig: c, tokenHash: sha256.Sum256([]byte(token)), window: 24 * time.Hour}
+		if c.Quota.Window != "" {
+			d, err := time.ParseDuration(c.Quota.Window)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid quota window %q for tenant %s", c.Quota.Window, c.Name)
+			}
+			t.window = d
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// authenticate returns the tenant owning the request's bearer token.
+// Hashing first keeps the comparison constant-time regardless of length.
+func authenticate(tenants []*tenant, r *http.Request) *tenant {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	h := sha256.Sum256([]byte(token))
+	var found *tenant
+	for _, t := range tenants {
+		if subtle.ConstantTimeCompare(h[:], t.tokenHash[:]) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+// errNotAllowed marks tasks rejected by a tenant's provider/model rules.
+var errNotAllowed = errors.New("not allowed")
+
+// allow reports whether the tenant may use provider and model.
+func (t *tenant) allow(providerName, modelName string) error {
+	if len(t.Providers) > 0 && !slices.Contains(t.Providers, providerName) {
+		return fmt.Errorf("provider %s is %w for tenant %s", providerName, errNotAllowed, t.Name)
+	}
+	if len(t.Models) == 0 {
+		return nil
+	}
+	for _, m := range t.Models {
+		if prefix, ok := strings.CutSuffix(m, "*"); m == modelName || (ok && strings.HasPrefix(modelName, prefix)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("model %s is %w for tenant %s", modelName, errNotAllowed, t.Name)
+}
+
+// reserve counts one request against the quota, or returns how long until
+// the window resets if the tenant is out of requests or tokens.
+func (t *tenant) reserve(now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.start) >= t.window {
+		t.start, t.requests, t.tokens = now, 0, 0
+	}
+	q := t.Quota
+	if (q.Requests > 0 && t.requests >= q.Requests) || (q.Tokens > 0 && t.tokens >= q.Tokens) {
+		return t.start.Add(t.window).Sub(now), false
+	}
+	t.requests++
+	return 0, true
+}
+
+// record adds a finished task's estimated tokens to the current window.
+func (t *tenant) record(tokens int) {
+	t.mu.Lock()
+	t.tokens += tokens
+	t.mu.Unlock()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// diffLine is one line of a diff: op is ' ' for a line both sides have,
+// '-' for one only in the old text and '+' for one only in the new.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// maxDiffCells bounds the table diffLines builds; past it the differing
+// middle is shown as removed and added whole.
+const maxDiffCells = 4 << 20
+
+// diffLines is a shortest edit script from a to b, by longest common
+// subsequence. wordDiff feeds it words instead of lines.
+func diffLines(a, b []string) []diffLine {
+	// Answers that differ usually share a head and a tail; only the middle
+	// needs the table.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	out := make([]diffLine, 0, len(a)+len(b))
+	for _, l := range a[:pre] {
+		out = append(out, diffLine{' ', l})
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	i, j := 0, 0
+	if len(ma)*len(mb) <= maxDiffCells {
+		// lcs[i][j] is the length of the longest common subsequence of
+		// ma[i:] and mb[j:].
+		lcs := make([][]int, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		for i < len(ma) && j < len(mb) {
+			switch {
+			case ma[i] == mb[j]:
+				out = append(out, diffLine{' ', ma[i]})
+				i, j = i+1, j+1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				out = append(out, diffLine{'-', ma[i]})
+				i++
+			default:
+				out = append(out, diffLine{'+', mb[j]})
+				j++
+			}
+		}
+	}
+	for _, l := range ma[i:] {
+		out = append(out, diffLine{'-', l})
+	}
+	for _, l := range mb[j:] {
+		out = append(out, diffLine{'+', l})
+	}
+	for _, l := range a[len(a)-suf:] {
+		out = append(out, diffLine{' ', l})
+	}
+	return out
+}
+
+// textLines splits s into lines for diffLines; "" has none.
+func textLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// unifiedDiff renders the changes from a to b as a unified diff with
+// context lines around each hunk, or "" when the texts are equal.
+func unifiedDiff(a, b, nameA, nameB string, context int) string {
+	lines := diffLines(textLines(a), textLines(b))
+	var changes []int
+	for i, l := range lines {
+		if l.op != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	// posA[i] and posB[i] count the lines of a and b before lines[i].
+	posA, posB := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for i, l := range lines {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+		if l.op != '+' {
+			posA[i+1]++
+		}
+		if l.op != '-' {
+			posB[i+1]++
+		}
+	}
+	var w strings.Builder
+	fmt.Fprintf(&w, "--- %s\n+++ %s\n", nameA, nameB)
+	for k := 0; k < len(changes); {
+		start, end := max(changes[k]-context, 0), changes[k]
+		for k < len(changes) && changes[k]-end <= 2*context {
+			end = changes[k]
+			k++
+		}
+		end = min(end+context+1, len(lines))
+		fmt.Fprintf(&w, "@@ -%s +%s @@\n", hunkRange(posA[start], posA[end]-posA[start]), hunkRange(posB[start], posB[end]-posB[start]))
+		for _, l := range lines[start:end] {
+			w.WriteByte(l.op)
+			w.WriteString(l.text)
+			w.WriteByte('\n')
+		}
+	}
+	return w.String()
+}
+
+// hunkRange formats a hunk's side of an @@ line: n lines after the first
+// skipped ones.
+func hunkRange(skipped, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", skipped)
+	case 1:
+		return fmt.Sprintf("%d", skipped+1)
+	}
+	return fmt.Sprintf("%d,%d", skipped+1, n)
+}
+
+var wordRe = regexp.MustCompile(`\s+|\w+|[^\w\s]`)
+
+// wordDiff renders b with the words changed from a marked inline as
+// [-removed-] and {+added+}, like git diff --word-diff=plain; "" when the
+// texts are equal.
+func wordDiff(a, b string) string {
+	words := diffLines(wordRe.FindAllString(a, -1), wordRe.FindAllString(b, -1))
+	var w strings.Builder
+	changed := false
+	for i := 0; i < len(words); {
+		op := words[i].op
+		var run strings.Builder
+		for ; i < len(words) && words[i].op == op; i++ {
+			run.WriteString(words[i].text)
+		}
+		switch op {
+		case '-':
+			fmt.Fprintf(&w, "[-%s-]", run.String())
+		case '+':
+			fmt.Fprintf(&w, "{+%s+}", run.String())
+		default:
+			w.WriteString(run.String())
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return ""
+	}
+	return w.String()
+}
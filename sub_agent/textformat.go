@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Text formats --format takes besides JSON. The model is asked to write
+// markdown (for html too, since models write it more reliably than HTML)
+// and its answer is converted, so it can be pasted into an email, ticket
+// or web page as is.
+const (
+	FormatMarkdown = "md"
+	FormatPlain    = "plain"
+	FormatHTML     = "html"
+)
+
+var formatInstructions = map[string]string{
+	FormatMarkdown: "Format the answer in Markdown.",
+	FormatPlain:    "Write the answer as plain text: no Markdown headings, emphasis, tables or code fences.",
+	FormatHTML:     "Format the answer in Markdown.",
+}
+
+// textFormat returns the text format format names, or "".
+func textFormat(format json.RawMessage) string {
+	var s string
+	if json.Unmarshal(format, &s) != nil {
+		return ""
+	}
+	if _, ok := formatInstructions[s]; ok {
+		return s
+	}
+	return ""
+}
+
+// convertsMarkdown reports whether answers in format are no longer
+// markdown, so they must not be rendered as such on a terminal.
+func convertsMarkdown(format json.RawMessage) bool {
+	f := textFormat(format)
+	return f == FormatPlain || f == FormatHTML
+}
+
+// convertAnswer turns a markdown answer into format.
+func convertAnswer(format, text string) string {
+	switch format {
+	case FormatPlain:
+		return markdownToPlain(text)
+	case FormatHTML:
+		return markdownToHTML(text)
+	}
+	return text
+}
+
+var (
+	mdTableRow = regexp.MustCompile(`^\s*\|.*\|\s*$`)
+	mdTableSep = regexp.MustCompile(`^\s*\|?(\s*:?-+:?\s*\|)+\s*:?-*:?\s*$`)
+)
+
+func tableCells(line string) []string {
+	cells := strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+// markdownToPlain strips markdown syntax, keeping the text readable: code
+// blocks lose their fences, links become "text (url)", list markers become
+// dashes and table rows tab-separated.
+func markdownToPlain(text string) string {
+	var out []string
+	fence := ""
+	for _, line := range strings.Split(text, "\n") {
+		if m := mdFence.FindStringSubmatch(line); m != nil && (fence == "" || m[1] == fence && strings.TrimSpace(line) == fence) {
+			if fence == "" {
+				fence = m[1]
+			} else {
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			out = append(out, line)
+			continue
+		}
+		switch {
+		case mdHeading.MatchString(line):
+			line = plainInline(mdHeading.FindStringSubmatch(line)[2])
+		case mdRule.MatchString(line):
+			line = ""
+		case mdTableSep.MatchString(line):
+			continue
+		case mdTableRow.MatchString(line):
+			cells := tableCells(line)
+			for i, c := range cells {
+				cells[i] = plainInline(c)
+			}
+			line = strings.Join(cells, "\t")
+		case mdBullet.MatchString(line):
+			m := mdBullet.FindStringSubmatch(line)
+			line = m[1] + "- " + plainInline(m[2])
+		default:
+			line = plainInline(line)
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+func plainInline(s string) string {
+	s = mdLink.ReplaceAllString(s, "$1 ($2)")
+	s = mdBold.ReplaceAllString(s, "$1$2")
+	s = mdItalic.ReplaceAllString(s, "$1$3$2$4")
+	return mdCode.ReplaceAllString(s, "$1")
+}
+
+// markdownToHTML converts markdown to an HTML fragment: headings,
+// paragraphs, lists, quotes, rules, tables, fenced code and inline styles.
+// The text is escaped, so HTML in the answer is shown rather than run.
+func markdownToHTML(text string) string {
+	var b strings.Builder
+	lines := strings.Split(text, "\n")
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + htmlInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case mdFence.MatchString(line):
+			flush()
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != m[1]; i++ {
+				code = append(code, lines[i])
+			}
+			class := ""
+			if m[2] != "" {
+				class = ` class="language-` + html.EscapeString(strings.ToLower(m[2])) + `"`
+			}
+			b.WriteString("<pre><code" + class + ">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case mdHeading.MatchString(line):
+			flush()
+			m := mdHeading.FindStringSubmatch(line)
+			tag := "h" + string(rune('0'+len(m[1])))
+			b.WriteString("<" + tag + ">" + htmlInline(m[2]) + "</" + tag + ">\n")
+		case mdRule.MatchString(line):
+			flush()
+			b.WriteString("<hr>\n")
+		case mdBullet.MatchString(line), mdNumbered.MatchString(line):
+			flush()
+			re, tag := mdBullet, "ul"
+			if !mdBullet.MatchString(line) {
+				re, tag = mdNumbered, "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && re.MatchString(lines[i]); i++ {
+				m := re.FindStringSubmatch(lines[i])
+				b.WriteString("<li>" + htmlInline(m[len(m)-1]) + "</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+		case strings.HasPrefix(strings.TrimSpace(line), ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")))
+			}
+			i--
+			b.WriteString("<blockquote>" + htmlInline(strings.Join(quote, " ")) + "</blockquote>\n")
+		case mdTableRow.MatchString(line) && i+1 < len(lines) && mdTableSep.MatchString(lines[i+1]):
+			flush()
+			b.WriteString("<table>\n<thead><tr>")
+			for _, c := range tableCells(line) {
+				b.WriteString("<th>" + htmlInline(c) + "</th>")
+			}
+			b.WriteString("</tr></thead>\n<tbody>\n")
+			for i += 2; i < len(lines) && mdTableRow.MatchString(lines[i]); i++ {
+				b.WriteString("<tr>")
+				for _, c := range tableCells(lines[i]) {
+					b.WriteString("<td>" + htmlInline(c) + "</td>")
+				}
+				b.WriteString("</tr>\n")
+			}
+			i--
+			b.WriteString("</tbody>\n</table>\n")
+		default:
+			para = append(para, strings.TrimSpace(line))
+		}
+	}
+	flush()
+	return strings.TrimSpace(b.String())
+}
+
+// htmlInline escapes s and converts code spans, links, bold and italics.
+func htmlInline(s string) string {
+	// Code spans first, with their contents protected from other rules.
+	var spans []string
+	s = mdCode.ReplaceAllStringFunc(s, func(m string) string {
+		spans = append(spans, m[1:len(m)-1])
+		return "\x00" + string(rune('0'+len(spans)-1)) + "\x00"
+	})
+	s = html.EscapeString(s)
+	s = mdLink.ReplaceAllStringFunc(s, func(m string) string {
+		// Only web and mail links; a javascript: URL would run on click.
+		sm := mdLink.FindStringSubmatch(m)
+		if u := strings.ToLower(sm[2]); !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "mailto:") {
+			return sm[1]
+		}
+		return `<a href="` + sm[2] + `">` + sm[1] + `</a>`
+	})
+	s = mdBold.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = mdItalic.ReplaceAllString(s, "$1$3<em>$2$4</em>")
+	for i, code := range spans {
+		s = strings.Replace(s, "\x00"+string(rune('0'+i))+"\x00", "<code>"+html.EscapeString(code)+"</code>", 1)
+	}
+	return s
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// charsPerToken is the rough English-text ratio used until a real tokenizer
+// is available for a model.
+const charsPerToken = 4
+
+// estimateTokens approximates the token count of s.
+func estimateTokens(s string) int {
+	n := utf8.RuneCountInString(s)
+	return (n + charsPerToken - 1) / charsPerToken
+}
+
+// splitByTokens splits text into chunks of at most maxTokens (estimated),
+// preferring paragraph boundaries, then line boundaries, then a hard cut.
+func splitByTokens(text string, maxTokens int) []string {
+	if maxTokens < 1 {
+		maxTokens = 1
+	}
+	var chunks []string
+	var cur strings.Builder
+
+	flush := func() {
+		if s := strings.TrimSpace(cur.String()); s != "" {
+			chunks = append(chunks, s)
+		}
+		cur.Reset()
+	}
+	add := func(piece, sep string) {
+		if cur.Len() > 0 && estimateTokens(cur.String()+sep+piece) > maxTokens {
+			flush()
+		}
+		if cur.Len() > 0 {
+			cur.WriteString(sep)
+		}
+		cur.WriteString(piece)
+	}
+
+	for _, para := range strings.Split(text, "\n\n") {
+		if estimateTokens(para) <= maxTokens {
+			add(para, "\n\n")
+			continue
+		}
+		for _, line := range strings.Split(para, "\n") {
+			if estimateTokens(line) <= maxTokens {
+				add(line, "\n")
+				continue
+			}
+			flush()
+			runes := []rune(line)
+			step := maxTokens * charsPerToken
+			for len(runes) > 0 {
+				n := step
+				if n > len(runes) {
+					n = len(runes)
+				}
+				chunks = append(chunks, string(runes[:n]))
+				runes = runes[n:]
+			}
+		}
+	}
+	flush()
+	return chunks
+}
+
+// Token counting methods, from exact to rough.
+const (
+	TokensBPE      = "bpe"      // the model's own tokenizer, run locally
+	TokensAPI      = "api"      // the provider's count for the text
+	TokensEstimate = "estimate" // charsPerToken
+)
+
+// TokenCount is the result of countTokens and `tokens count`.
+type TokenCount struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Tokens   int    `json:"tokens"`
+	Method   string `json:"method"`
+	Encoding string `json:"encoding,omitempty"`
+	Window   int    `json:"window"`
+	Note     string `json:"note,omitempty"` // why a better method wasn't used
+}
+
+// countTokens counts text's tokens for a provider/model without generating
+// anything. OpenAI models use their BPE vocabulary; with exact, Gemini and
+// Ollama are asked for their count. Everything else, or a failed exact
+// method, falls back to the estimate, with the reason in Note.
+func countTokens(ctx context.Context, providerName, modelName, text, key string, exact bool) TokenCount {
+	modelName = defaultModel(providerName, modelName)
+	tc := TokenCount{Provider: providerName, Model: modelName, Method: TokensEstimate, Window: contextWindow(providerName, modelName)}
+	var err error
+	if name := openAIEncoding(modelName); name != "" && providerName != "local" && providerName != "cloud" {
+		var enc *bpeEncoding
+		if enc, err = loadBPE(name); err == nil {
+			tc.Tokens, tc.Method, tc.Encoding = enc.count(text), TokensBPE, name
+			return tc
+		}
+	} else if exact {
+		n := 0
+		switch providerName {
+		case "cloud":
+			n, err = countGeminiTokens(ctx, text, key)
+		case "local":
+			n, err = countOllamaTokens(ctx, modelName, text)
+		default:
+			err = fmt.Errorf("%s has no token counting API", providerName)
+		}
+		if err == nil {
+			tc.Tokens, tc.Method = n, TokensAPI
+			return tc
+		}
+	}
+	if err != nil {
+		tc.Note = redactErr(err).Error()
+	}
+	tc.Tokens = estimateTokens(text)
+	return tc
+}
+
+// countGeminiTokens uses the countTokens method next to generateContent.
+func countGeminiTokens(ctx context.Context, text, key string) (int, error) {
+	gc := geminiConfig()
+	key, err := geminiKey(key)
+	if err != nil {
+		return 0, err
+	}
+	url := GeminiBaseURL + "?key=" + key
+	var headers map[string]string
+	if gc.Vertex {
+		u, bearer, err := vertexEndpoint(ctx, gc, "")
+		if err != nil {
+			return 0, err
+		}
+		url, headers = u, map[string]string{"Authorization": "Bearer " + bearer}
+	} else if key == "" {
+		return 0, kindError(ErrAuth, "missing Gemini API Key. Set GEMINI_API_KEY env var")
+	}
+	url = strings.Replace(url, ":generateContent", ":countTokens", 1)
+	var out struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	payload := geminiPayload(genRequest{Prompt: text})
+	if err := postEmbed(ctx, "Gemini", url, headers, payload, &out); err != nil {
+		return 0, err
+	}
+	return out.TotalTokens, nil
+}
+
+// countOllamaTokens has Ollama evaluate the raw prompt and generate a single
+// token; prompt_eval_count is the prompt's size in the model's tokenizer.
+func countOllamaTokens(ctx context.Context, modelName, text string) (int, error) {
+	options := map[string]int{"num_predict": 1}
+	if n := ollamaNumCtx(modelName, text); n > 0 {
+		options["num_ctx"] = n
+	}
+	var out struct {
+		PromptEvalCount int `json:"prompt_eval_count"`
+	}
+	payload := map[string]interface{}{"model": modelName, "prompt": text, "raw": true, "stream": false, "options": options}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return 0, err
+	}
+	if err := postEmbed(ctx, "Ollama", ollamaHost()+"/api/generate", headers, payload, &out); err != nil {
+		return 0, err
+	}
+	return out.PromptEvalCount, nil
+}
+
+// tokensCountCommand implements `tokens count --file x`.
+func tokensCountCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "-", "File to count ('-' for stdin)")
+	prov := fs.String("provider", "local", "Provider whose tokenizer to use")
+	mdl := fs.String("model", "", "Model whose tokenizer to use (defaults to the provider's)")
+	exact := fs.Bool("exact", false, "Ask Gemini or Ollama for the exact count instead of estimating (sends the text to the provider)")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	kf := addKeyFlags(fs)
+	return func(args []string) {
+		text, err := readInput(*file)
+		if err != nil {
+			fatal(configError(err))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		tc := countTokens(context.Background(), *prov, *mdl, text, key, *exact)
+		if *asJSON {
+			printJSON(tc)
+			return
+		}
+		how := tc.Method
+		if tc.Encoding != "" {
+			how = tc.Encoding + " " + how
+		}
+		fmt.Printf("%d tokens (%s) for %s", tc.Tokens, how, modelChoice{tc.Provider, tc.Model})
+		if tc.Window > 0 {
+			fmt.Printf(", %.1f%% of its %d-token window", 100*float64(tc.Tokens)/float64(tc.Window), tc.Window)
+		}
+		fmt.Println()
+		if tc.Note != "" {
+			fmt.Fprintf(os.Stderr, "[Sub-Agent] Note: %s\n", tc.Note)
+		}
+	}
+}
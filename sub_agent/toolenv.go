@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Tool environment: variables set only in the processes a run's tools
+// start (exec tools and run_code), so the scripts the model runs can
+// authenticate to services without the credentials going anywhere near the
+// prompt. They come from tools.env in the config, --tool-env and the task
+// contract's env, later ones winning; values may be vault:// or exec:
+// references, which keep secrets out of the run history too. What those
+// resolve to is masked in what the tools print. A contract sent to serve
+// may only set the names in server.request_env, and never to a reference:
+// exec: would run a command on the server and vault:// hand out its
+// secrets.
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseToolEnv parses --tool-env NAME=VALUE flags.
+func parseToolEnv(flags []string) (map[string]string, error) {
+	env := map[string]string{}
+	for _, f := range flags {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || !envNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid --tool-env %q: expected NAME=VALUE", f)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// toolEnvFor resolves the tool environment of req as NAME=VALUE pairs,
+// sorted by name.
+func (r *runner) toolEnvFor(req TaskRequest) ([]string, error) {
+	merged := map[string]string{}
+	for _, l := range []map[string]string{config.Tools.Env, r.toolEnv} {
+		for name, v := range l {
+			merged[name] = v
+		}
+	}
+	if req.Contract != nil {
+		if req.remote {
+			if err := checkRequestEnv(req.Contract.Env, liveConfig().Server.RequestEnv); err != nil {
+				return nil, err
+			}
+		}
+		for name, v := range req.Contract.Env {
+			merged[name] = v
+		}
+	}
+	env := make([]string, 0, len(merged))
+	for name, v := range merged {
+		if !envNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid tool environment variable name %q", name)
+		}
+		if isSecretRef(v) {
+			value, err := resolveSecretValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("tool environment variable %s: %v", name, redactErr(err))
+			}
+			v = value
+		}
+		env = append(env, name+"="+v)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// checkRequestEnv checks the env of a task API request's contract: only
+// the names allowed may be set, and only to literal values.
+func checkRequestEnv(env map[string]string, allowed []string) error {
+	for _, name := range sortedKeys(env) {
+		if !slices.Contains(allowed, name) {
+			return fmt.Errorf("tool environment variable %s can't be set by a request (see server.request_env)", name)
+		}
+		if isSecretRef(env[name]) {
+			return fmt.Errorf("tool environment variable %s: a request can't set a secret reference", name)
+		}
+	}
+	return nil
+}
+
+type toolEnvKey struct{}
+
+// withToolEnv has the tools called under ctx run with env.
+func withToolEnv(ctx context.Context, env []string) context.Context {
+	if len(env) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, toolEnvKey{}, env)
+}
+
+// toolEnv is the tool environment set on ctx, if any.
+func toolEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(toolEnvKey{}).([]string)
+	return env
+}
+
+// toolProcessEnv is the environment of a tool process under ctx: helix's
+// own plus the run's tool environment, or nil (inherit) when it has none.
+func toolProcessEnv(ctx context.Context) []string {
+	env := toolEnv(ctx)
+	if len(env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+// hideEnvValues returns env with its literal values masked, for echoing a
+// contract; references stay, as they hold no secret.
+func hideEnvValues(env map[string]string) map[string]string {
+	if len(env) == 0 {
+		return env
+	}
+	out := make(map[string]string, len(env))
+	for name, v := range env {
+		if !isSecretRef(v) {
+			v = "[REDACTED]"
+		}
+		out[name] = v
+	}
+	return out
+}
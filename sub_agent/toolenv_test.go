@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestToolEnvForRemoteContract(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.Server.RequestEnv = []string{"REGION"}
+	pwned := filepath.Join(t.TempDir(), "pwned")
+
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		remote  bool
+		wantErr bool
+	}{
+		{"literal allowed", map[string]string{"REGION": "eu"}, true, false},
+		{"name not allowed", map[string]string{"LD_PRELOAD": "/tmp/x.so"}, true, true},
+		{"exec reference", map[string]string{"REGION": "exec:touch " + pwned}, true, true},
+		{"vault reference", map[string]string{"REGION": "vault://secret/db#password"}, true, true},
+		{"local contract", map[string]string{"PATH_EXTRA": "x"}, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &runner{}
+			req := TaskRequest{Contract: &TaskContract{Env: tc.env}, remote: tc.remote}
+			_, err := r.toolEnvFor(req)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("toolEnvFor(%v) error = %v, want error %v", tc.env, err, tc.wantErr)
+			}
+		})
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Fatal("an exec: reference from a request ran")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ToolPolicy is a --tool-policy file: named profiles granting or denying
+// tools, checked each time the model calls one. For example:
+//
+//	{
+//	  "default": "chat",
+//	  "groups": {"network": ["fetch", "mcp_web.*"]},
+//	  "profiles": {
+//	    "chat": {"allow": ["@read_only"]},
+//	    "ops": {"allow": ["*"], "deny": ["@network"], "paths": {"shell": ["/opt/app"]}}
+//	  }
+//	}
+type ToolPolicy struct {
+	// Default is the profile used when --tool-profile isn't given.
+	Default string `json:"default,omitempty"`
+	// Groups name lists of tools, for use as @name in profiles.
+	Groups   map[string][]string    `json:"groups,omitempty"`
+	Profiles map[string]ToolProfile `json:"profiles"`
+}
+
+// ToolProfile grants the tools matching Allow except those matching Deny.
+// Entries are tool names, globs such as "mcp_web.*", or groups: @read_only
+// and @side_effects are built in. A profile without Allow grants nothing.
+type ToolProfile struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Paths confines the tools matching each key to directories: the
+	// workspace and every path the model passes must be inside one.
+	Paths map[string][]string `json:"paths,omitempty"`
+}
+
+// pathInputRe matches the input fields taken to be paths, besides any
+// absolute path.
+var pathInputRe = regexp.MustCompile(`(?i)(^|_)(path|file|filename|dir|directory|cwd|workdir)s?$`)
+
+// loadToolPolicy reads a --tool-policy file; "" means no policy.
+func loadToolPolicy(file string) (*ToolPolicy, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading tool policy: %v", err)
+	}
+	var p ToolPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("tool policy %s: %v", file, err)
+	}
+	if len(p.Profiles) == 0 {
+		return nil, fmt.Errorf("tool policy %s has no profiles", file)
+	}
+	if p.Default != "" {
+		if _, ok := p.Profiles[p.Default]; !ok {
+			return nil, fmt.Errorf("tool policy %s: default profile %q is not defined", file, p.Default)
+		}
+	}
+	for name, prof := range p.Profiles {
+		for _, e := range append(append(sortedKeys(prof.Paths), prof.Allow...), prof.Deny...) {
+			if err := p.validEntry(e); err != nil {
+				return nil, fmt.Errorf("tool policy %s, profile %s: %v", file, name, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func (p *ToolPolicy) validEntry(e string) error {
+	if g, ok := strings.CutPrefix(e, "@"); ok {
+		if _, ok := p.Groups[g]; !ok && g != "read_only" && g != "side_effects" {
+			return fmt.Errorf("unknown group %s", e)
+		}
+		return nil
+	}
+	if _, err := path.Match(e, ""); err != nil {
+		return fmt.Errorf("bad pattern %q", e)
+	}
+	return nil
+}
+
+// sortedKeys returns m's keys in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// profile returns the named profile, or the default one for "".
+func (p *ToolPolicy) profile(name string) (string, ToolProfile, error) {
+	if name == "" {
+		name = p.Default
+	}
+	if name == "" {
+		return "", ToolProfile{}, fmt.Errorf("the tool policy has no default profile; pass --tool-profile")
+	}
+	prof, ok := p.Profiles[name]
+	if !ok {
+		return "", ToolProfile{}, fmt.Errorf("unknown tool profile %q (the policy defines %s)", name, strings.Join(sortedKeys(p.Profiles), ", "))
+	}
+	return name, prof, nil
+}
+
+// matches reports whether entry e covers tool t, called name.
+func (p *ToolPolicy) matches(e, name string, t tool) bool {
+	switch e {
+	case "@read_only", "@side_effects":
+		ro, ok := t.(readOnlyTool)
+		return (ok && ro.readOnly()) == (e == "@read_only")
+	}
+	if g, ok := strings.CutPrefix(e, "@"); ok {
+		for _, m := range p.Groups[g] {
+			if ok, _ := path.Match(m, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(e, name)
+	return ok
+}
+
+// check vets one call of t under profile, returning the reason to give the
+// model for refusing it, or nil.
+func (p *ToolPolicy) check(profile string, prof ToolProfile, t tool, name string, input json.RawMessage, workspace string) error {
+	for _, e := range prof.Deny {
+		if p.matches(e, name, t) {
+			return fmt.Errorf("%s is denied by the %s tool profile (%s); don't call it again, answer without it", name, profile, e)
+		}
+	}
+	granted := false
+	for _, e := range prof.Allow {
+		if granted = p.matches(e, name, t); granted {
+			break
+		}
+	}
+	if !granted {
+		return fmt.Errorf("%s is not granted by the %s tool profile; don't call it again, answer without it", name, profile)
+	}
+	for _, e := range sortedKeys(prof.Paths) {
+		if !p.matches(e, name, t) {
+			continue
+		}
+		roots := prof.Paths[e]
+		ws, _ := filepath.Abs(workspace)
+		paths := append([]string{ws}, inputPaths(input)...)
+		for _, pth := range paths {
+			if !insideAny(pth, workspace, roots) {
+				return fmt.Errorf("%s may only work in %s under the %s tool profile, not %s", name, strings.Join(roots, ", "), profile, pth)
+			}
+		}
+	}
+	return nil
+}
+
+// inputPaths collects the strings in input that name files: the values of
+// path-like fields, and any absolute path.
+func inputPaths(input json.RawMessage) []string {
+	var v interface{}
+	if json.Unmarshal(input, &v) != nil {
+		return nil
+	}
+	var out []string
+	var walk func(key string, v interface{})
+	walk = func(key string, v interface{}) {
+		switch v := v.(type) {
+		case string:
+			if v != "" && (pathInputRe.MatchString(key) || filepath.IsAbs(v) || strings.HasPrefix(v, "~")) {
+				out = append(out, v)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(key, e)
+			}
+		case map[string]interface{}:
+			for k, e := range v {
+				walk(k, e)
+			}
+		}
+	}
+	walk("", v)
+	sort.Strings(out)
+	return out
+}
+
+// insideAny reports whether p, relative to the workspace, resolves inside
+// one of roots. Symlinks are followed as far as the path exists.
+func insideAny(p, workspace string, roots []string) bool {
+	if home, err := os.UserHomeDir(); err == nil && (p == "~" || strings.HasPrefix(p, "~/")) {
+		p = home + p[1:]
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(workspace, p)
+	}
+	p = resolveExisting(p)
+	for _, root := range roots {
+		root = resolveExisting(root)
+		if rel, err := filepath.Rel(root, p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExisting makes p absolute and resolves symlinks in the longest
+// part of it that exists.
+func resolveExisting(p string) string {
+	p, _ = filepath.Abs(p)
+	rest := ""
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if r, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(r, rest)
+		}
+		if dir == filepath.Dir(dir) {
+			return p
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// toolAllowed applies the run's tool policy, if any, to call of t. A
+// remote request's call must also pass the profile it can't widen.
+func (r *runner) toolAllowed(req TaskRequest, t tool, call ToolCall) error {
+	if r.toolPolicy == nil {
+		return nil
+	}
+	profiles := []string{r.taskToolProfile(req)}
+	if req.remote {
+		ceiling := req.toolCeiling
+		if ceiling == "" {
+			ceiling = r.toolProfile
+		}
+		profiles = append(profiles, ceiling)
+	}
+	for _, p := range profiles {
+		name, prof, err := r.toolPolicy.profile(p)
+		if err != nil {
+			return err
+		}
+		if err := r.toolPolicy.check(name, prof, t, call.Tool, call.Input, r.workspace); err != nil {
+			return fmt.Errorf("denied by tool policy: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *runner) taskToolProfile(req TaskRequest) string {
+	if req.ToolProfile != "" {
+		return req.ToolProfile
+	}
+	return r.toolProfile
+}
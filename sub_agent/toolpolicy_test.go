@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestToolAllowedRemoteProfile(t *testing.T) {
+	r := &runner{toolProfile: "chat", toolPolicy: &ToolPolicy{Profiles: map[string]ToolProfile{
+		"chat":  {Allow: []string{"search", "read_file"}},
+		"ops":   {Allow: []string{"*"}},
+		"read":  {Allow: []string{"read_file"}},
+		"admin": {Allow: []string{"shell", "search"}},
+	}}}
+	for _, tc := range []struct {
+		name    string
+		req     TaskRequest
+		tool    string
+		allowed bool
+	}{
+		{"server profile", TaskRequest{}, "search", true},
+		{"local request widens", TaskRequest{ToolProfile: "ops"}, "shell", true},
+		{"remote request can't widen", TaskRequest{ToolProfile: "ops", remote: true}, "shell", false},
+		{"remote request narrows", TaskRequest{ToolProfile: "read", remote: true}, "search", false},
+		{"remote request within both", TaskRequest{ToolProfile: "read", remote: true}, "read_file", true},
+		{"tenant profile", TaskRequest{ToolProfile: "admin", toolCeiling: "admin", remote: true}, "shell", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := r.toolAllowed(tc.req, nil, ToolCall{Tool: tc.tool, Input: json.RawMessage(`{}`)})
+			if (err == nil) != tc.allowed {
+				t.Fatalf("toolAllowed(%s) = %v, want allowed %v", tc.tool, err, tc.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// How a tool result over its budget is cut down before the model sees it.
+const (
+	OverflowTail      = "tail"      // keep the end, where command output has its errors
+	OverflowHead      = "head"      // keep the start, as of a file
+	OverflowSummarize = "summarize" // have a model condense it for the task, keeping the tail if that fails
+)
+
+// ToolOutputBudget caps what one call of a tool feeds back to the model;
+// the call's full output is still recorded in the result's tool calls.
+type ToolOutputBudget struct {
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	Overflow  string `json:"overflow,omitempty"`
+}
+
+// toolBudgetShare is the part of the prompt budget a tool result gets when
+// no budget is set, so that a few big results still leave room.
+const toolBudgetShare = 4
+
+const toolSummaryInstructions = `
+The text is the output of the tool %s, called while working on this task:
+%s
+Keep what the task needs from it, verbatim where it matters: values, names, paths, line numbers and error messages.`
+
+func validOverflow(s string) bool {
+	return s == OverflowTail || s == OverflowHead || s == OverflowSummarize
+}
+
+// toolBudget is the budget of the tool called name: its entry in
+// tools.output, else the flags, whose defaults are the "*" entry, with the
+// tokens defaulting to a quarter of the prompt budget.
+func (r *runner) toolBudget(req TaskRequest, name string) ToolOutputBudget {
+	b := r.toolOutput
+	if c, ok := config.Tools.Output[name]; ok {
+		if c.MaxTokens > 0 {
+			b.MaxTokens = c.MaxTokens
+		}
+		if c.Overflow != "" {
+			b.Overflow = c.Overflow
+		}
+	}
+	if b.MaxTokens <= 0 {
+		b.MaxTokens = r.promptBudget(req) / toolBudgetShare
+	}
+	if b.Overflow == "" {
+		b.Overflow = OverflowTail
+	}
+	return b
+}
+
+// fitToolResult brings the result of a call of tool name within its
+// budget.
+func (r *runner) fitToolResult(ctx context.Context, req TaskRequest, name, result string) string {
+	b := r.toolBudget(req, name)
+	tokens := estimateTokens(result)
+	if tokens <= b.MaxTokens {
+		return result
+	}
+	if b.Overflow == OverflowSummarize {
+		setStage(ctx, "summarize tool result")
+		s := &summarizer{provider: req.Provider, model: req.Model, key: r.key, chunkTokens: min(3000, r.promptBudget(req)/2), concurrency: 4,
+			instructions: fmt.Sprintf(toolSummaryInstructions, name, truncateRunes(req.Task, 500))}
+		if c := r.compact; c.provider != "" {
+			s.provider, s.model = c.provider, defaultModel(c.provider, c.model)
+		}
+		sum, err := s.summarize(ctx, result)
+		if out := strings.TrimSpace(sum.Output); err == nil && estimateTokens(out) <= b.MaxTokens {
+			logf(ctx, "Summarized the ~%d-token result of %s to ~%d tokens", tokens, name, estimateTokens(out))
+			return fmt.Sprintf("[Summary of the %d-token output]\n%s", tokens, out)
+		}
+		if err != nil {
+			logf(ctx, "Warning: summarizing the result of %s failed (%v); keeping its tail", name, err)
+		}
+		b.Overflow = OverflowTail
+	}
+	end := "last"
+	if b.Overflow == OverflowHead {
+		end = "first"
+	}
+	logf(ctx, "Cut the ~%d-token result of %s to its %s ~%d tokens", tokens, name, end, b.MaxTokens)
+	return cutToTokens(result, b.MaxTokens, b.Overflow == OverflowTail)
+}
+
+// cutToTokens keeps the first, or with tail the last, whole lines of s
+// that fit in max tokens, and marks what was cut.
+func cutToTokens(s string, max int, tail bool) string {
+	lines := strings.Split(s, "\n")
+	budget := max * charsPerToken
+	kept, size := 0, 0
+	for i := range lines {
+		line := lines[i]
+		if tail {
+			line = lines[len(lines)-1-i]
+		}
+		if size+len(line)+1 > budget {
+			break
+		}
+		size += len(line) + 1
+		kept++
+	}
+	if kept == 0 {
+		// One line over the budget on its own: cut inside it.
+		r := []rune(s)
+		n := min(len(r), budget)
+		if tail {
+			return fmt.Sprintf("[... %d earlier characters cut]\n%s", len(r)-n, string(r[len(r)-n:]))
+		}
+		return fmt.Sprintf("%s\n[... %d more characters cut]", string(r[:n]), len(r)-n)
+	}
+	if tail {
+		return fmt.Sprintf("[... %d earlier lines cut]\n%s", len(lines)-kept, strings.Join(lines[len(lines)-kept:], "\n"))
+	}
+	return fmt.Sprintf("%s\n[... %d more lines cut]", strings.Join(lines[:kept], "\n"), len(lines)-kept)
+}
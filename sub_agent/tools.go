@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ToolsConfig configures the tools a task may call (see --tools).
+type ToolsConfig struct {
+	// Enabled is the default for --tools.
+	Enabled []string      `json:"enabled,omitempty"`
+	RunCode RunCodeConfig `json:"run_code"`
+	Wasm    WasmConfig    `json:"wasm"`
+	// Exec declares tools backed by local executables, keyed by tool name.
+	Exec map[string]ExecToolConfig `json:"exec,omitempty"`
+	// Env sets variables in the processes of exec tools and run_code only,
+	// by name; values may be secret references. See toolEnvFor.
+	Env map[string]string `json:"env,omitempty"`
+	// OpenAPI turns the operations of REST APIs into tools, keyed by a
+	// name that --tools uses to enable all of an API's operations.
+	OpenAPI map[string]OpenAPIToolConfig `json:"openapi,omitempty"`
+	// SQL declares databases the model may query read-only, keyed by a
+	// name that --tools uses to enable their query and schema tools.
+	SQL map[string]SQLToolConfig `json:"sql,omitempty"`
+	// Slack lists the channels slack.post may post to, keyed by name.
+	Slack map[string]SlackToolConfig `json:"slack,omitempty"`
+	// Email configures email.draft and sending its drafts.
+	Email EmailToolConfig `json:"email"`
+	// Kubectl scopes the kubectl tool pack.
+	Kubectl KubectlToolConfig `json:"kubectl"`
+	// MCP lists Model Context Protocol servers, keyed by a name that
+	// --tools uses to enable all of a server's tools (or name.tool for one).
+	MCP map[string]MCPServerConfig `json:"mcp,omitempty"`
+	// Policy is the default for --tool-policy.
+	Policy string `json:"policy,omitempty"`
+	// Output budgets tool results by tool name, "*" for every tool,
+	// over --tool-output-tokens and --tool-output-overflow.
+	Output map[string]ToolOutputBudget `json:"output,omitempty"`
+}
+
+// toolSpec describes a tool to the model.
+type toolSpec struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// tool is something the model can call during a task. call returns the
+// text handed back to the model; an error is reported to the model too,
+// so it can correct itself, rather than failing the task.
+type tool interface {
+	spec() toolSpec
+	call(ctx context.Context, input json.RawMessage) (string, error)
+}
+
+// ToolCall is one tool invocation made while answering a task.
+type ToolCall struct {
+	Tool       string          `json:"tool"`
+	Input      json.RawMessage `json:"input"`
+	Output     string          `json:"output,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// toolFactory builds the tools behind one catalog entry; most entries are
+// a single tool, an MCP server is all of its tools. Factories get the
+// runner's workspace.
+type toolFactory func(workspace string) ([]tool, error)
+
+// single adapts a one-tool constructor to a toolFactory.
+func single(mk func(workspace string) (tool, error)) toolFactory {
+	return func(workspace string) ([]tool, error) {
+		t, err := mk(workspace)
+		if err != nil {
+			return nil, err
+		}
+		return []tool{t}, nil
+	}
+}
+
+// builtinTools are always available by name.
+var builtinTools = map[string]toolFactory{
+	"run_code":   single(newRunCodeTool),
+	"scratchpad": single(newScratchpadTool),
+	"kubectl":    kubectlTools,
+	"slack":      slackTools,
+	"email":      single(newEmailTool),
+}
+
+// toolCatalog returns every entry --tools accepts: the built-ins, exec
+// tools, MCP servers, OpenAPI specs and SQL databases from the config, and
+// the plugins found in the tools directory.
+func toolCatalog() (map[string]toolFactory, error) {
+	catalog := map[string]toolFactory{}
+	for name, mk := range builtinTools {
+		catalog[name] = mk
+	}
+	for name, c := range config.Tools.Exec {
+		if _, ok := catalog[name]; ok {
+			return nil, fmt.Errorf("exec tool %q: name is taken by a built-in tool", name)
+		}
+		name, c := name, c
+		catalog[name] = single(func(workspace string) (tool, error) { return newExecTool(name, c, workspace) })
+	}
+	for name, c := range config.Tools.MCP {
+		if _, ok := catalog[name]; ok {
+			return nil, fmt.Errorf("MCP server %q: name is taken by another tool", name)
+		}
+		name, c := name, c
+		catalog[name] = func(string) ([]tool, error) { return mcpTools(name, c) }
+	}
+	for name, c := range config.Tools.OpenAPI {
+		if _, ok := catalog[name]; ok {
+			return nil, fmt.Errorf("OpenAPI tool %q: name is taken by another tool", name)
+		}
+		name, c := name, c
+		catalog[name] = func(string) ([]tool, error) { return openAPITools(name, c) }
+	}
+	for name, c := range config.Tools.SQL {
+		if _, ok := catalog[name]; ok {
+			return nil, fmt.Errorf("SQL database %q: name is taken by another tool", name)
+		}
+		name, c := name, c
+		catalog[name] = func(string) ([]tool, error) { return sqlTools(name, c) }
+	}
+	plugins, err := loadWasmTools()
+	if err != nil {
+		return nil, err
+	}
+	for name, m := range plugins {
+		if _, ok := catalog[name]; ok {
+			return nil, fmt.Errorf("plugin tool %q: name is taken by another tool", name)
+		}
+		m := m
+		catalog[name] = single(func(workspace string) (tool, error) { return newWasmTool(m, workspace) })
+	}
+	return catalog, nil
+}
+
+func sortedToolNames(catalog map[string]toolFactory) []string {
+	var names []string
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newTools resolves a comma-separated --tools value: catalog entries,
+// server.tool for a single MCP tool, or "all".
+func newTools(list, workspace string) ([]tool, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	catalog, err := toolCatalog()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, n := range strings.Split(list, ",") {
+		if n = strings.TrimSpace(n); n == "all" {
+			names = append(names, sortedToolNames(catalog)...)
+		} else if n != "" {
+			names = append(names, n)
+		}
+	}
+	built := map[string][]tool{}
+	build := func(entry string) ([]tool, error) {
+		if ts, ok := built[entry]; ok {
+			return ts, nil
+		}
+		ts, err := catalog[entry](workspace)
+		if err != nil {
+			return nil, fmt.Errorf("tool %s: %v", entry, err)
+		}
+		built[entry] = ts
+		return ts, nil
+	}
+
+	var tools []tool
+	seen := map[string]bool{}
+	add := func(t tool) {
+		if name := t.spec().Name; !seen[name] {
+			seen[name] = true
+			tools = append(tools, t)
+		}
+	}
+	for _, name := range names {
+		entry, one, _ := strings.Cut(name, ".")
+		if _, ok := catalog[entry]; !ok {
+			return nil, fmt.Errorf("unknown tool %q: expected one of %s", name, strings.Join(sortedToolNames(catalog), ", "))
+		}
+		ts, err := build(entry)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, t := range ts {
+			if one == "" || t.spec().Name == name {
+				add(t)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown tool %q: %s has no such tool", name, entry)
+		}
+	}
+	return tools, nil
+}
+
+// toolsCommand implements `tools`: list the tools --tools accepts and
+// whether each can be used here.
+func toolsCommand(fs *flag.FlagSet) func(args []string) {
+	workspace := fs.String("workspace", ".", "Workspace passed to the tools")
+	return func([]string) {
+		catalog, err := toolCatalog()
+		if err != nil {
+			fatal(configError(err))
+		}
+		for _, name := range sortedToolNames(catalog) {
+			ts, err := catalog[name](*workspace)
+			if err != nil {
+				fmt.Printf("%-16s unavailable: %v\n", name, err)
+				continue
+			}
+			for _, t := range ts {
+				s := t.spec()
+				fmt.Printf("%-16s %s\n", s.Name, firstLine(s.Description))
+			}
+		}
+		if dir := wasmToolsDir(); dir != "" {
+			fmt.Printf("\nPlugin manifests are read from %s\n", dir)
+		}
+	}
+}
+
+const toolPreamble = `You can call tools while working on the task. To call one, reply with only a fenced block like this and nothing else:
+
+` + "```tool_call" + `
+{"tool": "<name>", "input": {...}}
+` + "```" + `
+
+The result will be sent back to you, and you may call more tools. When you have everything you need, reply with your final answer and no tool_call block.
+
+Available tools:
+%s
+Task:
+%s`
+
+// toolCallRequest is what the model writes inside a tool_call fence.
+type toolCallRequest struct {
+	Tool  string          `json:"tool"`
+	Input json.RawMessage `json:"input"`
+}
+
+// parseToolCall finds a tool_call fence in out.
+func parseToolCall(out string) (toolCallRequest, bool) {
+	var call toolCallRequest
+	start := strings.Index(out, "```tool_call")
+	if start < 0 {
+		return call, false
+	}
+	body := out[start+len("```tool_call"):]
+	if end := strings.Index(body, "```"); end >= 0 {
+		body = body[:end]
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &call); err != nil || call.Tool == "" {
+		return call, false
+	}
+	return call, true
+}
+
+// callTools answers req with r.tools available, looping until the model
+// stops calling tools or --max-tool-steps is reached. The conversation is
+// checkpointed after every tool call so a resumed run does not repeat them,
+// and older steps are summarized once it nears the context window.
+func (r *runner) callTools(ctx context.Context, req TaskRequest, res *TaskResult) (string, error) {
+	if r.toolPolicy != nil {
+		if _, _, err := r.toolPolicy.profile(r.taskToolProfile(req)); err != nil {
+			return "", kindError(ErrConfig, "%v", err)
+		}
+	}
+	env, err := r.toolEnvFor(req)
+	if err != nil {
+		return "", kindError(ErrConfig, "%v", err)
+	}
+	ctx = withToolEnv(ctx, env)
+	byName := map[string]tool{}
+	var desc strings.Builder
+	for _, t := range contractTools(req, r.tools) {
+		s := t.spec()
+		byName[s.Name] = t
+		fmt.Fprintf(&desc, "- %s: %s\n  Input schema: %s\n", s.Name, s.Description, s.InputSchema)
+	}
+	// head is kept verbatim; the steps after it may be folded into summary.
+	head := fmt.Sprintf(toolPreamble, desc.String(), req.Task)
+	var (
+		steps   []string
+		folded  int
+		summary string
+	)
+	transcript := func() string {
+		var b strings.Builder
+		b.WriteString(head)
+		if summary != "" {
+			b.WriteString("\n\n[Summary of your earlier steps]\n" + summary)
+		}
+		for _, s := range steps[folded:] {
+			b.WriteString("\n\n" + s)
+		}
+		return b.String()
+	}
+	first := 0
+	var notes map[string]string
+
+	cp := r.checkpoint(req, checkpointTools)
+	if cp != nil {
+		if cp.Transcript != "" {
+			head, first, notes = cp.Transcript, cp.ToolSteps, cp.Scratchpad
+			res.ToolCalls = append(res.ToolCalls, cp.ToolCalls...)
+		}
+		cp.Tools = cp.Tools[:0]
+		for _, t := range r.tools {
+			if _, ok := t.(memoryTool); !ok {
+				cp.Tools = append(cp.Tools, t.spec().Name)
+			}
+		}
+		if r.memory != nil {
+			cp.Memory = r.memory.namespace
+		}
+	}
+
+	pad := newScratchpad(notes)
+	ctx = withScratchpad(ctx, pad)
+	defer func() { res.Scratchpad = pad.snapshot() }()
+
+	maxSteps := r.maxToolSteps
+	if req.MaxToolSteps > 0 {
+		maxSteps = req.MaxToolSteps
+	}
+	for step := first; ; step++ {
+		if step == maxSteps {
+			steps = append(steps, "[Tool step limit reached. Give your final answer now, without calling tools.]")
+		}
+		if r.shouldCompact(req, estimateTokens(transcript()+pad.render())) {
+			s, n, err := r.compactTurns(ctx, req, summary, steps[folded:])
+			if err != nil {
+				logf(ctx, "Warning: %v", err)
+			}
+			summary, folded = s, folded+n
+		}
+		prompt, report, err := r.fitPrompt(ctx, req, transcript()+pad.render())
+		res.Context = report
+		if err != nil {
+			return "", err
+		}
+		g := genRequest{Provider: req.Provider, Model: req.Model, Prompt: prompt, Images: req.Images, Files: req.Files, Seed: req.Seed, CachedContent: req.GeminiCache, Ground: req.Ground}
+		if w := r.reason(&g, req); w != "" && step == first {
+			res.Warnings = append(res.Warnings, w)
+		}
+		out, err := generateRequest(ctx, g, r.key)
+		if err != nil {
+			return "", err
+		}
+		thinking, out := splitThinking(out)
+		res.Thinking = thinking
+		call, ok := parseToolCall(out)
+		if !ok || step >= maxSteps {
+			return out, nil
+		}
+
+		rec := ToolCall{Tool: call.Tool, Input: call.Input}
+		progressf("Tool step %d: calling %s", step+1, call.Tool)
+		setStep(ctx, step+1)
+		start := time.Now()
+		var result string
+		t, found := byName[call.Tool]
+		emitEvent(ctx, toolCallEvent(step+1, t, rec))
+		if !found {
+			err = fmt.Errorf("no tool named %q", call.Tool)
+		} else if err = r.toolAllowed(req, t, rec); err != nil {
+			logf(ctx, "Tool policy: %v", err)
+		} else if err = r.reviewCommand(ctx, t, rec); err == nil {
+			if err = r.reviewMessage(ctx, t, rec); err == nil {
+				result, err = t.call(ctx, call.Input)
+				if len(env) > 0 {
+					// The tool may print the variables it was given.
+					result = redact(result)
+				}
+			}
+		}
+		rec.DurationMS = time.Since(start).Milliseconds()
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			rec.Error = err.Error()
+			result = "Error: " + err.Error()
+		} else {
+			rec.Output = result
+			result = r.fitToolResult(ctx, req, call.Tool, result)
+			if _, ok := t.(fetchingTool); ok {
+				flagInjection(res, "the result of "+call.Tool, rec.Output)
+				result = frameUntrusted(call.Tool, result)
+			}
+		}
+		res.ToolCalls = append(res.ToolCalls, rec)
+		emitEvent(ctx, toolResultEvent(step+1, rec))
+		steps = append(steps, fmt.Sprintf("[Your reply]\n%s\n\n[Result of %s]\n%s", out, call.Tool, result))
+		if cp != nil {
+			cp.Transcript, cp.ToolSteps, cp.ToolCalls = transcript(), step+1, res.ToolCalls
+			cp.Scratchpad = pad.snapshot()
+			r.saveCheckpoint(cp)
+		}
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	max     int
+	buf     []byte
+	dropped int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.buf); room > 0 {
+		n := min(room, len(p))
+		b.buf = append(b.buf, p[:n]...)
+		b.dropped += len(p) - n
+	} else {
+		b.dropped += len(p)
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.dropped > 0 {
+		return fmt.Sprintf("%s\n[... %d more bytes]", b.buf, b.dropped)
+	}
+	return string(b.buf)
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
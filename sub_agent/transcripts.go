@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transcript formats of `history export` and `history import`.
+const (
+	TranscriptJSONL    = "jsonl"    // one history entry per line; lossless
+	TranscriptMarkdown = "markdown" // for reading and sharing; task and answer only
+	TranscriptShareGPT = "sharegpt" // one conversation per line, for fine-tuning
+)
+
+// ShareGPTRecord is a run as a ShareGPT conversation.
+type ShareGPTRecord struct {
+	ID            string            `json:"id,omitempty"`
+	Model         string            `json:"model,omitempty"`
+	Conversations []ShareGPTMessage `json:"conversations"`
+}
+
+// ShareGPTMessage is one turn; From is "system", "human" or "gpt".
+type ShareGPTMessage struct {
+	From  string `json:"from"`
+	Value string `json:"value"`
+}
+
+// selectEntries loads the runs ids names, or every run, keeping those with
+// all of tags; oldest first.
+func selectEntries(store *historyStore, ids []string, tags map[string]string) ([]*HistoryEntry, error) {
+	var entries []*HistoryEntry
+	if len(ids) > 0 {
+		for _, id := range ids {
+			e, err := store.load(id)
+			if err != nil {
+				return nil, configError(err)
+			}
+			entries = append(entries, e)
+		}
+	} else {
+		var err error
+		if entries, err = store.list(); err != nil {
+			return nil, err
+		}
+	}
+	var out []*HistoryEntry
+entries:
+	for _, e := range entries {
+		for k, v := range tags {
+			if e.Request.Tags[k] != v {
+				continue entries
+			}
+		}
+		out = append(out, e)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// writeTranscripts writes entries in format, returning how many it wrote:
+// ShareGPT leaves out runs without an answer.
+func writeTranscripts(w io.Writer, format string, entries []*HistoryEntry) (int, error) {
+	n := 0
+	enc := json.NewEncoder(w)
+	for i, e := range entries {
+		var err error
+		switch format {
+		case TranscriptJSONL:
+			err = enc.Encode(e)
+		case TranscriptShareGPT:
+			if e.Result.Output == "" || e.Result.Error != "" {
+				continue
+			}
+			err = enc.Encode(ShareGPTRecord{
+				ID:    e.ID,
+				Model: modelChoice{e.Result.Provider, e.Result.Model}.String(),
+				Conversations: []ShareGPTMessage{
+					{From: "human", Value: e.Request.Task},
+					{From: "gpt", Value: e.Result.Output},
+				},
+			})
+		case TranscriptMarkdown:
+			if i > 0 {
+				if _, err := io.WriteString(w, "---\n\n"); err != nil {
+					return n, err
+				}
+			}
+			_, err = io.WriteString(w, transcriptMarkdown(e))
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// transcriptMarkdown renders a run in the layout of chat's /save, with its
+// metadata as a list under the title.
+func transcriptMarkdown(e *HistoryEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# helix run %s\n\n", e.ID)
+	fmt.Fprintf(&b, "- Time: %s\n", e.Time.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Model: %s\n", modelChoice{e.Result.Provider, e.Result.Model})
+	if tags := formatTags(e.Request.Tags); tags != "" {
+		fmt.Fprintf(&b, "- Tags: %s\n", tags)
+	}
+	if e.Result.Error != "" {
+		fmt.Fprintf(&b, "- Error: %s\n", e.Result.Error)
+	}
+	fmt.Fprintf(&b, "\n## User\n\n%s\n\n", strings.TrimSpace(e.Request.Task))
+	answer := e.Result.Output
+	if answer == "" && e.Result.ArtifactURL != "" {
+		answer = "(uploaded to " + e.Result.ArtifactURL + ")"
+	}
+	if answer != "" {
+		fmt.Fprintf(&b, "## Assistant\n\n%s\n\n", strings.TrimSpace(answer))
+	}
+	return b.String()
+}
+
+// parseTranscripts reads runs written by writeTranscripts, or by chat's
+// /save, whose exchanges become one run each. format "" tells the format
+// from name and the content.
+func parseTranscripts(name string, data []byte, format string) ([]*HistoryEntry, error) {
+	if format == "" {
+		format = detectTranscriptFormat(name, data)
+	}
+	switch format {
+	case TranscriptMarkdown:
+		return parseMarkdownTranscripts(data), nil
+	case TranscriptJSONL, TranscriptShareGPT:
+	default:
+		return nil, fmt.Errorf("invalid --format %q: expected jsonl, markdown or sharegpt", format)
+	}
+	var entries []*HistoryEntry
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if format == TranscriptJSONL {
+			var e HistoryEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				return nil, fmt.Errorf("%s, line %d: %v", name, n, err)
+			}
+			entries = append(entries, &e)
+			continue
+		}
+		var rec ShareGPTRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", name, n, err)
+		}
+		entries = append(entries, shareGPTEntries(rec)...)
+	}
+	return entries, sc.Err()
+}
+
+func detectTranscriptFormat(name string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown":
+		return TranscriptMarkdown
+	}
+	first, _, _ := bytes.Cut(bytes.TrimSpace(data), []byte("\n"))
+	if !bytes.HasPrefix(first, []byte("{")) {
+		return TranscriptMarkdown
+	}
+	var probe struct {
+		Conversations json.RawMessage `json:"conversations"`
+	}
+	if json.Unmarshal(first, &probe) == nil && probe.Conversations != nil {
+		return TranscriptShareGPT
+	}
+	return TranscriptJSONL
+}
+
+// shareGPTEntries turns each human message and the gpt reply after it into
+// a run; a system message goes before the human one.
+func shareGPTEntries(rec ShareGPTRecord) []*HistoryEntry {
+	provider, model := splitModelChoice(rec.Model)
+	var entries []*HistoryEntry
+	var system, task string
+	for _, m := range rec.Conversations {
+		switch m.From {
+		case "system":
+			system = m.Value
+		case "human", "user":
+			task = m.Value
+			if system != "" {
+				task = system + "\n\n" + task
+			}
+		case "gpt", "assistant":
+			if task == "" {
+				continue
+			}
+			e := importedEntry(task, m.Value, provider, model)
+			if len(entries) == 0 {
+				e.ID = rec.ID
+			}
+			entries = append(entries, e)
+			task = ""
+		}
+	}
+	return entries
+}
+
+// parseMarkdownTranscripts splits data at its "# helix" titles and pairs
+// the User and Assistant sections of each.
+func parseMarkdownTranscripts(data []byte) []*HistoryEntry {
+	var entries []*HistoryEntry
+	var id, provider, model, role string
+	var when time.Time
+	var task, body strings.Builder
+	flush := func() {
+		text := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(body.String()), "---"))
+		body.Reset()
+		switch role {
+		case "User":
+			task.Reset()
+			task.WriteString(text)
+		case "Assistant":
+			if task.Len() == 0 {
+				break
+			}
+			e := importedEntry(task.String(), text, provider, model)
+			e.ID, e.Time = id, when
+			id = "" // a chat's later exchanges get IDs of their own
+			entries = append(entries, e)
+			task.Reset()
+		}
+		role = ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# helix "):
+			flush()
+			id, provider, model, when = "", "", "", time.Time{}
+			task.Reset()
+			title := strings.TrimPrefix(line, "# helix ")
+			if rest, ok := strings.CutPrefix(title, "run "); ok {
+				id = strings.TrimSpace(rest)
+			} else if rest, ok := strings.CutPrefix(title, "chat with "); ok {
+				provider, model = splitModelChoice(strings.TrimSpace(rest))
+			}
+		case line == "## User" || line == "## Assistant":
+			flush()
+			role = strings.TrimPrefix(line, "## ")
+		case role == "":
+			if v, ok := strings.CutPrefix(line, "- Model: "); ok {
+				provider, model = splitModelChoice(v)
+			} else if v, ok := strings.CutPrefix(line, "- Time: "); ok {
+				when, _ = time.Parse(time.RFC3339, v)
+			}
+		default:
+			body.WriteString(line + "\n")
+		}
+	}
+	flush()
+	return entries
+}
+
+func splitModelChoice(s string) (provider, model string) {
+	provider, model, _ = strings.Cut(s, "/")
+	return provider, model
+}
+
+// importedEntry is a run known only by its task and answer.
+func importedEntry(task, answer, provider, model string) *HistoryEntry {
+	return &HistoryEntry{
+		Request:  TaskRequest{Task: task, Provider: provider, Model: model},
+		Result:   TaskResult{Provider: provider, Model: model, Output: answer},
+		Imported: true,
+	}
+}
+
+// historyExportCommand implements `history export`.
+func historyExportCommand(fs *flag.FlagSet) func(args []string) {
+	format := fs.String("format", TranscriptJSONL, "Output format: 'jsonl' (whole runs, for import elsewhere), 'markdown' (for reading and sharing) or 'sharegpt' (conversations for fine-tuning)")
+	out := fs.String("out", "", "File to write (default stdout)")
+	tagFilter := tagFlag{}
+	fs.Var(tagFilter, "tag", "Only export runs with this key=value tag (repeatable)")
+	return func(args []string) {
+		switch *format {
+		case TranscriptJSONL, TranscriptMarkdown, TranscriptShareGPT:
+		default:
+			fatal(kindError(ErrConfig, "invalid --format %q: expected jsonl, markdown or sharegpt", *format))
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		entries, err := selectEntries(store, args, tagFilter)
+		if err != nil {
+			fatal(err)
+		}
+		w := io.Writer(os.Stdout)
+		if *out != "" && *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				fatal(configError(err))
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := writeTranscripts(w, *format, entries)
+		if err != nil {
+			fatal(err)
+		}
+		if *out != "" && *out != "-" {
+			statusf("[Sub-Agent] Exported %d run(s) to %s\n", n, *out)
+		}
+		if skipped := len(entries) - n; skipped > 0 {
+			statusf("[Sub-Agent] Left out %d run(s) without an answer\n", skipped)
+		}
+	}
+}
+
+// historyImportCommand implements `history import`.
+func historyImportCommand(fs *flag.FlagSet) func(args []string) {
+	format := fs.String("format", "", "Input format: 'jsonl', 'markdown' or 'sharegpt' (default: from the file name and content)")
+	overwrite := fs.Bool("overwrite", false, "Replace recorded runs that have the same ID instead of skipping them")
+	return func(args []string) {
+		if len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix history import [--format f] <file>... ('-' reads stdin)"))
+		}
+		store, err := openHistory()
+		if err != nil {
+			fatal(configError(err))
+		}
+		var imported, skipped int
+		for _, name := range args {
+			var data []byte
+			if name == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(name)
+			}
+			if err != nil {
+				fatal(configError(err))
+			}
+			entries, err := parseTranscripts(name, data, *format)
+			if err != nil {
+				fatal(configError(err))
+			}
+			for _, e := range entries {
+				if e.ID == "" {
+					e.ID = newID()
+				} else if !validRunID(e.ID) {
+					fatal(configError(fmt.Errorf("%s: invalid run ID %q", name, e.ID)))
+				} else if _, err := store.load(e.ID); err == nil && !*overwrite {
+					skipped++
+					continue
+				}
+				if e.Time.IsZero() {
+					e.Time = time.Now().UTC()
+				}
+				// Pruning goes by when entries were written, so date it as the run.
+				if err := store.saveAt(e, e.Time); err != nil {
+					fatal(fmt.Errorf("history: %v", err))
+				}
+				imported++
+			}
+		}
+		statusf("[Sub-Agent] Imported %d run(s)", imported)
+		if skipped > 0 {
+			statusf(", skipped %d already recorded (pass --overwrite to replace them)", skipped)
+		}
+		statusf("\n")
+		if imported > store.keep {
+			statusf("[Sub-Agent] Warning: history keeps %d runs (history.keep in the config), so the oldest were pruned\n", store.keep)
+		}
+	}
+}
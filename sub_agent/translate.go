@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// languageNames maps ISO 639-1 codes to the names models know best.
+var languageNames = map[string]string{
+	"ar": "Arabic", "cs": "Czech", "da": "Danish", "de": "German", "el": "Greek",
+	"en": "English", "es": "Spanish", "fi": "Finnish", "fr": "French", "he": "Hebrew",
+	"hi": "Hindi", "hu": "Hungarian", "id": "Indonesian", "it": "Italian", "ja": "Japanese",
+	"ko": "Korean", "nl": "Dutch", "no": "Norwegian", "pl": "Polish", "pt": "Portuguese",
+	"ro": "Romanian", "ru": "Russian", "sv": "Swedish", "th": "Thai", "tr": "Turkish",
+	"uk": "Ukrainian", "vi": "Vietnamese", "zh": "Chinese",
+}
+
+// languageName spells out an ISO code; anything else is taken as a name.
+func languageName(lang string) string {
+	if name, ok := languageNames[strings.ToLower(lang)]; ok {
+		return name
+	}
+	return lang
+}
+
+// sameLanguage compares languages given as codes or names.
+func sameLanguage(a, b string) bool {
+	return strings.EqualFold(languageName(a), languageName(b))
+}
+
+// languageInstruction pins the reply to lang whatever the task is written in.
+func languageInstruction(lang string) string {
+	return fmt.Sprintf("Reply in %s, whatever language the task is written in.", languageName(lang))
+}
+
+// langFor is req's reply language, or else the runner's.
+func (r *runner) langFor(req TaskRequest) string {
+	if req.Lang != "" {
+		return req.Lang
+	}
+	return r.lang
+}
+
+// TranslationResult is the JSON output of `translate`.
+type TranslationResult struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Chunks   int    `json:"chunks"`
+	Output   string `json:"output"`
+}
+
+const detectPrompt = `Which language is the following text written in? Reply with its ISO 639-1 code only, such as "en" or "de".
+
+%s`
+
+const translatePrompt = `Translate the following text (part %d of %d) from %s to %s. Keep its formatting: markdown, code blocks, commands, file paths, URLs and placeholders stay unchanged. Output only the translation.
+
+%s`
+
+// translateCommand implements `translate --to de --file runbook.md`.
+func translateCommand(fs *flag.FlagSet) func(args []string) {
+	file := fs.String("file", "", "Document to translate ('-' for stdin)")
+	text := fs.String("text", "", "Text to translate, instead of --file")
+	from := fs.String("from", "", "Source language, as an ISO code or a name (default: detected)")
+	to := fs.String("to", "en", "Target language; with a comma-separated list, the first that isn't the source (e.g. en,de)")
+	prov := fs.String("provider", "local", "Provider: 'local', 'cloud', 'azure-openai', 'bedrock' or an OpenAI-compatible adapter")
+	mdl := fs.String("model", "", "Model name")
+	kf := addKeyFlags(fs)
+	chunkTokens := fs.Int("chunk-tokens", 2000, "Approximate tokens per chunk; the translation must fit the model's output too")
+	concurrency := fs.Int("concurrency", 4, "Chunks translated in parallel")
+	asJSON := fs.Bool("json", false, "Print the result as JSON instead of text")
+	fs.BoolVar(&quiet, "quiet", false, "Print only the translation: no status lines")
+	return func([]string) {
+		input := *text
+		if input == "" {
+			if *file == "" {
+				fatal(kindError(ErrConfig, "--file or --text is required"))
+			}
+			var err error
+			if input, err = readInput(*file); err != nil {
+				fatal(configError(err))
+			}
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		var targets []string
+		for _, t := range strings.Split(*to, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) == 0 {
+			fatal(kindError(ErrConfig, "--to names no language"))
+		}
+
+		s := &summarizer{provider: *prov, model: defaultModel(*prov, *mdl), key: key, chunkTokens: *chunkTokens, concurrency: max(*concurrency, 1)}
+		res, err := s.translate(context.Background(), input, *from, targets)
+		if err != nil {
+			fatal(redactErr(err))
+		}
+		if *asJSON {
+			printJSON(res)
+			return
+		}
+		if res.Chunks == 0 {
+			statusf("[Sub-Agent] Already in %s; nothing to translate\n", languageName(res.Target))
+		} else {
+			statusf("[Sub-Agent] Translated %d chunk(s) from %s to %s\n", res.Chunks, languageName(res.Source), languageName(res.Target))
+		}
+		fmt.Println(res.Output)
+	}
+}
+
+// translate detects the source language unless from is set, picks the
+// first target that differs from it, and translates chunk by chunk.
+func (s *summarizer) translate(ctx context.Context, text, from string, targets []string) (TranslationResult, error) {
+	res := TranslationResult{Provider: s.provider, Model: s.model, Source: from}
+	chunks := splitByTokens(text, s.chunkTokens)
+	if len(chunks) == 0 {
+		return res, fmt.Errorf("nothing to translate")
+	}
+	if from == "" {
+		lang, err := s.detectLanguage(ctx, text)
+		if err != nil {
+			return res, err
+		}
+		res.Source = lang
+	}
+	res.Target = targets[0]
+	for _, t := range targets {
+		if !sameLanguage(t, res.Source) {
+			res.Target = t
+			break
+		}
+	}
+	if sameLanguage(res.Source, res.Target) {
+		// Already in the only target: nothing to do.
+		res.Output = text
+		return res, nil
+	}
+
+	res.Chunks = len(chunks)
+	parts, err := s.mapChunks(ctx, chunks, func(i int, c string) string {
+		return fmt.Sprintf(translatePrompt, i+1, len(chunks), languageName(res.Source), languageName(res.Target), c)
+	})
+	if err != nil {
+		return res, err
+	}
+	res.Output = strings.Join(parts, "\n\n")
+	return res, nil
+}
+
+// detectLanguage asks the model for the ISO code of text's language,
+// judging by its beginning.
+func (s *summarizer) detectLanguage(ctx context.Context, text string) (string, error) {
+	out, err := generate(ctx, s.provider, s.model, fmt.Sprintf(detectPrompt, truncateRunes(text, 1000)), s.key)
+	if err != nil {
+		return "", fmt.Errorf("detecting the language: %w", err)
+	}
+	code := strings.ToLower(strings.TrimFunc(strings.TrimSpace(cleanOutput(out)), func(r rune) bool { return !unicode.IsLetter(r) }))
+	if i := strings.IndexFunc(code, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		code = code[:i]
+	}
+	if code == "" {
+		return "", fmt.Errorf("detecting the language: the model gave no answer")
+	}
+	return code, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// undoDir holds one bundle per agent edit, under the workspace.
+const undoDir = ".helix/undo"
+
+// undoBundle records the state of the files an edit touched, so that
+// `helix undo` can put them back.
+type undoBundle struct {
+	ID    string     `json:"id"`
+	Time  time.Time  `json:"time"`
+	Task  string     `json:"task,omitempty"`
+	Files []undoFile `json:"files"`
+}
+
+type undoFile struct {
+	Path    string      `json:"path"`    // relative to the workspace
+	Existed bool        `json:"existed"` // false: the edit created it, undo removes it
+	Mode    os.FileMode `json:"mode,omitempty"`
+}
+
+// saveUndo snapshots rels (relative to root) before they are modified.
+// Bundle directories sort by creation time, so the last is the latest.
+func saveUndo(root, task string, rels []string) error {
+	if len(rels) == 0 {
+		return nil
+	}
+	id := fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405.000000"), newID()[:6])
+	dir := filepath.Join(root, undoDir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating undo bundle: %v", err)
+	}
+	b := undoBundle{ID: id, Time: time.Now().UTC(), Task: truncateRunes(task, 200)}
+	for i, rel := range rels {
+		f := undoFile{Path: filepath.ToSlash(rel)}
+		if fi, err := os.Stat(filepath.Join(root, rel)); err == nil {
+			data, err := os.ReadFile(filepath.Join(root, rel))
+			if err == nil {
+				data, err = sealAtRest(data)
+			}
+			if err != nil {
+				return fmt.Errorf("saving %s for undo: %v", rel, err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, strconv.Itoa(i)), data, 0o600); err != nil {
+				return fmt.Errorf("saving %s for undo: %v", rel, err)
+			}
+			f.Existed, f.Mode = true, fi.Mode().Perm()
+		}
+		b.Files = append(b.Files, f)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err == nil {
+		data, err = sealAtRest(data)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "bundle.json"), data)
+}
+
+// listUndo returns the bundle IDs under root, oldest first.
+func listUndo(root string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, undoDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func readUndo(root, id string) (undoBundle, error) {
+	var b undoBundle
+	data, err := readAtRest(filepath.Join(root, undoDir, id, "bundle.json"))
+	if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, fmt.Errorf("undo bundle %s: %v", id, err)
+	}
+	if b.ID != id {
+		return b, fmt.Errorf("undo bundle %s has ID %q", id, b.ID)
+	}
+	return b, nil
+}
+
+// restoreUndo reverts the files of b and then discards the bundle. A
+// bundle with a path outside the workspace is refused whole.
+func restoreUndo(root string, b undoBundle) error {
+	if b.ID == "" || filepath.Base(b.ID) != b.ID || b.ID == ".." {
+		return fmt.Errorf("invalid undo bundle ID %q", b.ID)
+	}
+	dir := filepath.Join(root, undoDir, b.ID)
+	rels := make([]string, len(b.Files))
+	for i, f := range b.Files {
+		rel, err := workspaceRel(f.Path)
+		if err != nil {
+			return fmt.Errorf("undo bundle %s: %v", b.ID, err)
+		}
+		rels[i] = rel
+	}
+	for i, f := range b.Files {
+		dest := filepath.Join(root, rels[i])
+		if !f.Existed {
+			if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("removing %s: %v", f.Path, err)
+			}
+			continue
+		}
+		data, err := readAtRest(filepath.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			return fmt.Errorf("undo bundle %s: %v", b.ID, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return fmt.Errorf("restoring %s: %v", f.Path, err)
+		}
+		if err := writeFileAtomic(dest, data); err != nil {
+			return fmt.Errorf("restoring %s: %v", f.Path, err)
+		}
+		if f.Mode != 0 {
+			os.Chmod(dest, f.Mode.Perm())
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// undoCommand implements `undo`: revert the most recent agent edit.
+// Repeating it walks further back.
+func undoCommand(fs *flag.FlagSet) func(args []string) {
+	workspace := fs.String("workspace", ".", "Workspace the edit was made in")
+	list := fs.Bool("list", false, "List the edits that can be undone, newest first")
+	return func([]string) {
+		root, err := filepath.Abs(*workspace)
+		if err != nil {
+			fatal(configError(err))
+		}
+		ids, err := listUndo(root)
+		if err != nil {
+			fatal(err)
+		}
+		if *list {
+			for i := len(ids) - 1; i >= 0; i-- {
+				b, err := readUndo(root, ids[i])
+				if err != nil {
+					fatal(err)
+				}
+				fmt.Printf("%s  %d file(s)  %s\n", b.Time.Local().Format("2006-01-02 15:04:05"), len(b.Files), b.Task)
+			}
+			return
+		}
+		if len(ids) == 0 {
+			fatal(kindError(ErrConfig, "nothing to undo in %s", root))
+		}
+		b, err := readUndo(root, ids[len(ids)-1])
+		if err != nil {
+			fatal(err)
+		}
+		if err := restoreUndo(root, b); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("[Sub-Agent] Reverted %d file(s) changed at %s\n", len(b.Files), b.Time.Local().Format("2006-01-02 15:04:05"))
+		for _, f := range b.Files {
+			action := "restored"
+			if !f.Existed {
+				action = "removed"
+			}
+			fmt.Printf("%-9s %s\n", action, f.Path)
+		}
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreUndo(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("before\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUndo(root, "edit", []string{"a.txt", "new.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("after\n"), 0o644)
+	os.WriteFile(filepath.Join(root, "new.txt"), []byte("created\n"), 0o644)
+
+	ids, err := listUndo(root)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("listUndo = %v, %v", ids, err)
+	}
+	b, err := readUndo(root, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreUndo(root, b); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "before\n" {
+		t.Errorf("a.txt = %q after undo", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("new.txt still exists after undo: %v", err)
+	}
+}
+
+func TestRestoreUndoRefusesEscapes(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "ws")
+	victim := filepath.Join(parent, "victim.txt")
+	os.WriteFile(victim, []byte("keep\n"), 0o644)
+	for _, b := range []undoBundle{
+		{ID: "1", Files: []undoFile{{Path: "../victim.txt"}}},
+		{ID: "1", Files: []undoFile{{Path: "ok.txt"}, {Path: victim}}},
+		{ID: "../..", Files: []undoFile{{Path: "ok.txt"}}},
+	} {
+		os.MkdirAll(filepath.Join(root, undoDir, "1"), 0o755)
+		os.WriteFile(filepath.Join(root, "ok.txt"), []byte("x"), 0o644)
+		if err := restoreUndo(root, b); err == nil {
+			t.Errorf("restoreUndo(%+v) succeeded", b)
+		}
+		if _, err := os.Stat(filepath.Join(root, "ok.txt")); err != nil {
+			t.Errorf("restoreUndo(%+v) touched ok.txt before refusing", b)
+		}
+	}
+	if data, err := os.ReadFile(victim); err != nil || string(data) != "keep\n" {
+		t.Errorf("victim.txt = %q, %v", data, err)
+	}
+}
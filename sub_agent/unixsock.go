@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Unix domain sockets. A backend on the same host (Ollama behind a socket
+// proxy, llama.cpp's server, another helix) can be reached without TCP,
+// with the socket file's owner, group and mode deciding who may call it.
+//
+// Anywhere a base URL is taken (ollama.host, OLLAMA_HOST, an adapter's
+// base_url) it may be unix:///path/to/backend.sock, optionally followed by
+// the API's base path: unix:///run/llama.sock/v1. A path that doesn't end
+// in .sock is taken as the socket as a whole.
+
+// unixSockets maps the placeholder hosts of socket URLs to socket paths;
+// the transport's dialer looks them up.
+var unixSockets sync.Map
+
+// isUnixURL reports whether u is a unix: socket address.
+func isUnixURL(u string) bool {
+	return strings.HasPrefix(u, "unix:")
+}
+
+// splitUnixURL splits a unix: address into the socket path and the HTTP
+// path under it.
+func splitUnixURL(u string) (socket, path string) {
+	p := strings.TrimPrefix(strings.TrimPrefix(u, "unix:"), "//")
+	if i := strings.Index(p, ".sock/"); i >= 0 {
+		return p[:i+len(".sock")], p[i+len(".sock"):]
+	}
+	return p, ""
+}
+
+// socketURL rewrites a unix: address as an http URL whose host stands for
+// the socket, so that the rest of helix builds requests as for TCP. Other
+// URLs are returned unchanged. The placeholder is under .localhost, which
+// never resolves and which Ollama's host check accepts.
+func socketURL(u string) string {
+	if !isUnixURL(u) {
+		return u
+	}
+	socket, path := splitUnixURL(u)
+	h := fnv.New32a()
+	h.Write([]byte(socket))
+	host := fmt.Sprintf("sock-%08x.localhost", h.Sum32())
+	unixSockets.Store(host, socket)
+	return "http://" + host + strings.TrimRight(path, "/")
+}
+
+// unixSocketFor is the socket behind a placeholder host, if it is one.
+func unixSocketFor(host string) (string, bool) {
+	s, ok := unixSockets.Load(host)
+	if !ok {
+		return "", false
+	}
+	return s.(string), true
+}
+
+// dialUnixAware wraps dial so that placeholder hosts connect to their
+// socket and everything else dials as before.
+func dialUnixAware(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			if socket, ok := unixSocketFor(host); ok {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// skipProxyForSockets makes proxy return no proxy for socket requests,
+// which never leave the host.
+func skipProxyForSockets(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	if proxy == nil {
+		return nil
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if _, ok := unixSocketFor(req.URL.Hostname()); ok {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+}
+
+// listenAddr listens on a TCP host:port or, for a unix: address, a socket.
+func listenAddr(addr string) (net.Listener, error) {
+	if isUnixURL(addr) {
+		return listenUnix(addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a socket for helix serve. A socket file left by a
+// previous run is removed first; anything else at the path is an error.
+// The mode is 0660, so that access follows the file's group.
+func listenUnix(addr string) (net.Listener, error) {
+	socket, _ := splitUnixURL(addr)
+	if fi, err := os.Lstat(socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		// A socket someone still answers on is in use, not stale.
+		if c, err := net.Dial("unix", socket); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", socket)
+		}
+		os.Remove(socket)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Verification reports the outcome of the --verify loop.
+type Verification struct {
+	Verdict   string `json:"verdict"` // approved, or unapproved when rounds ran out
+	Revisions int    `json:"revisions"`
+	Rounds    int    `json:"rounds"`
+	Provider  string `json:"provider"`
+	Model     string `json:"model,omitempty"`
+}
+
+// verifyConfig selects the model that critiques answers. Empty provider or
+// model means "same as the task".
+type verifyConfig struct {
+	rounds   int
+	provider string
+	model    string
+}
+
+const verifyPrompt = `You are reviewing another assistant's answer.
+
+Task:
+%s
+
+Answer:
+%s
+
+Check the answer against the task for correctness and completeness.
+If it is acceptable, reply with exactly "VERDICT: APPROVED" on the first line.
+Otherwise reply with "VERDICT: REVISED" on the first line, followed by the complete corrected answer and nothing else.`
+
+// verifyAnswer runs up to cfg.rounds critique passes over answer. Each round
+// the verifier either approves or returns a corrected answer, which becomes
+// the subject of the next round.
+func (r *runner) verifyAnswer(ctx context.Context, taskText, answer string, req TaskRequest, cfg verifyConfig) (string, *Verification, error) {
+	v := &Verification{Verdict: "unapproved"}
+	v.Provider, v.Model = withDefaults(cfg.provider, cfg.model, req)
+
+	for v.Rounds < cfg.rounds {
+		v.Rounds++
+		out, err := generate(ctx, v.Provider, v.Model, fmt.Sprintf(verifyPrompt, taskText, answer), r.key)
+		if err != nil {
+			return answer, v, fmt.Errorf("verification round %d: %w", v.Rounds, err)
+		}
+		approved, revised := parseVerdict(cleanOutput(out))
+		if approved {
+			v.Verdict = "approved"
+			break
+		}
+		if revised == "" {
+			// The verifier ignored the format; treat it as an inconclusive round.
+			continue
+		}
+		answer = revised
+		v.Revisions++
+	}
+	return answer, v, nil
+}
+
+// parseVerdict reads the verifier reply. A missing or unrecognised verdict
+// line yields neither approval nor a revision.
+func parseVerdict(reply string) (approved bool, revised string) {
+	reply = strings.TrimSpace(reply)
+	first, rest, _ := strings.Cut(reply, "\n")
+	switch strings.ToUpper(strings.TrimSpace(strings.Trim(first, "*"))) {
+	case "VERDICT: APPROVED":
+		return true, ""
+	case "VERDICT: REVISED":
+		return false, strings.TrimSpace(rest)
+	}
+	return false, ""
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Set at build time along with version:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// A plain go build inside the repository gets the commit and date from the
+// VCS information Go stamps in.
+var (
+	commit    string
+	buildDate string
+)
+
+// BuildInfo is what `helix version` reports.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty tree
+	Go        string `json:"go"`
+	Platform  string `json:"platform"`
+}
+
+func buildInfo() BuildInfo {
+	b := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, Go: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.BuildDate == "" {
+					b.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				b.Modified = s.Value == "true"
+			}
+		}
+	}
+	return b
+}
+
+// String is the one-line form, as in helix v1.2.3 (3f2a1bc, 2025-06-01).
+func (b BuildInfo) String() string {
+	var extra []string
+	if c := b.Commit; c != "" {
+		if len(c) > 7 {
+			c = c[:7]
+		}
+		if b.Modified {
+			c += "-dirty"
+		}
+		extra = append(extra, c)
+	}
+	if b.BuildDate != "" {
+		extra = append(extra, b.BuildDate)
+	}
+	s := "helix " + b.Version
+	if len(extra) > 0 {
+		s += " (" + strings.Join(extra, ", ") + ")"
+	}
+	return s + " " + b.Go + " " + b.Platform
+}
+
+// versionCommand implements `version`.
+func versionCommand(fs *flag.FlagSet) func(args []string) {
+	fs.BoolVar(&jsonOut, "json", false, "Print the build information as JSON")
+	return func([]string) {
+		if jsonOut {
+			printJSON(buildInfo())
+			return
+		}
+		fmt.Println(buildInfo())
+	}
+}
+
+// defaultReleaseURL is where self-update looks for the latest release.
+const defaultReleaseURL = "https://api.github.com/repos/r4vi1/helix-os/releases/latest"
+
+// release is the part of a GitHub release self-update reads.
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// asset returns the download URL of the asset called name.
+func (r release) asset(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// selfUpdateCommand implements `self-update`: replace the running binary
+// with a release's build for this platform, after checking it against the
+// release's checksums file.
+func selfUpdateCommand(fs *flag.FlagSet) func(args []string) {
+	releaseURL := fs.String("url", defaultReleaseURL, "Release API URL (GitHub's format)")
+	tag := fs.String("version", "", "Install this release tag instead of the latest")
+	check := fs.Bool("check", false, "Only report whether a newer release exists")
+	force := fs.Bool("force", false, "Install even if the release is the running version or this is a development build")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	return func([]string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		u := *releaseURL
+		if *tag != "" {
+			u = strings.TrimSuffix(u, "/latest") + "/tags/" + *tag
+		}
+		var rel release
+		if err := getJSON(ctx, "release server", u, map[string]string{"Accept": "application/vnd.github+json"}, &rel); err != nil {
+			fatal(err)
+		}
+		if rel.Tag == "" {
+			fatal(fmt.Errorf("release server returned no tag_name"))
+		}
+		if rel.Tag == version && !*force {
+			fmt.Printf("helix %s is up to date.\n", version)
+			return
+		}
+		if *check {
+			fmt.Printf("helix %s is available (running %s).\n", rel.Tag, version)
+			return
+		}
+		if version == "dev" && !*force {
+			fatal(kindError(ErrConfig, "this is a development build; pass --force to replace it with %s", rel.Tag))
+		}
+		name := fmt.Sprintf("helix-%s-%s", runtime.GOOS, runtime.GOARCH)
+		if runtime.GOOS == "windows" {
+			name += ".exe"
+		}
+		binURL, ok := rel.asset(name)
+		if !ok {
+			fatal(fmt.Errorf("release %s has no build for %s/%s (no asset %s)", rel.Tag, runtime.GOOS, runtime.GOARCH, name))
+		}
+		sumsURL, ok := rel.asset("checksums.txt")
+		if !ok {
+			if sumsURL, ok = rel.asset("SHA256SUMS"); !ok {
+				fatal(fmt.Errorf("release %s has no checksums.txt to verify %s against", rel.Tag, name))
+			}
+		}
+		exe, err := os.Executable()
+		if err == nil {
+			exe, err = filepath.EvalSymlinks(exe)
+		}
+		if err != nil {
+			fatal(fmt.Errorf("finding the running binary: %v", err))
+		}
+		if !*yes {
+			ok, err := confirm(fmt.Sprintf("Replace %s (%s) with %s?", exe, version, rel.Tag), "--yes")
+			if err != nil {
+				fatal(err)
+			}
+			if !ok {
+				return
+			}
+		}
+		sums, err := getBytes(ctx, sumsURL)
+		if err != nil {
+			fatal(kindError(ErrUnreachable, "downloading checksums: %v", err))
+		}
+		want, ok := checksumFor(sums, name)
+		if !ok {
+			fatal(fmt.Errorf("checksums of release %s don't list %s", rel.Tag, name))
+		}
+		statusf("[Sub-Agent] Downloading %s %s\n", name, rel.Tag)
+		bin, err := getBytes(ctx, binURL)
+		if err != nil {
+			fatal(kindError(ErrUnreachable, "downloading %s: %v", name, err))
+		}
+		sum := sha256.Sum256(bin)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			fatal(fmt.Errorf("checksum mismatch for %s: got %s, expected %s; not installed", name, got, want))
+		}
+		if err := replaceExecutable(exe, bin); err != nil {
+			fatal(fmt.Errorf("installing %s: %v", exe, err))
+		}
+		fmt.Printf("Updated %s to %s.\n", exe, rel.Tag)
+	}
+}
+
+// checksumFor finds name in sha256sum output.
+func checksumFor(sums []byte, name string) (string, bool) {
+	sc := bufio.NewScanner(bytes.NewReader(sums))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) == 2 && strings.TrimPrefix(f[1], "*") == name {
+			return strings.ToLower(f[0]), true
+		}
+	}
+	return "", false
+}
+
+// replaceExecutable swaps bin in for exe with a rename, which leaves a
+// running copy of exe unharmed.
+func replaceExecutable(exe string, bin []byte) error {
+	mode := os.FileMode(0o755)
+	if fi, err := os.Stat(exe); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := exe + ".new"
+	if err := os.WriteFile(tmp, bin, mode); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// Windows won't replace a running executable, but it will rename one.
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// versionHeader adds X-Helix-Version to every response of h.
+func versionHeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Helix-Version", version)
+		h.ServeHTTP(w, r)
+	})
+}
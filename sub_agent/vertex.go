@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeminiConfig is the "gemini" config section. Vertex routes Gemini calls
+// through Vertex AI with Application Default Credentials instead of an API
+// key; GOOGLE_GENAI_USE_VERTEXAI, GOOGLE_CLOUD_PROJECT and
+// GOOGLE_CLOUD_LOCATION override it.
+type GeminiConfig struct {
+	Vertex   bool   `json:"vertex,omitempty"`
+	Project  string `json:"project,omitempty"`
+	Location string `json:"location,omitempty"` // e.g. us-central1, europe-west4
+
+	// Keys, when set, replace the "gemini" secret: calls rotate over them
+	// and fail over when one runs out of quota.
+	Keys []GeminiKey `json:"keys,omitempty"`
+}
+
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+func geminiConfig() GeminiConfig {
+	c := liveConfig().Gemini
+	if v := os.Getenv("GOOGLE_GENAI_USE_VERTEXAI"); v != "" {
+		c.Vertex = v == "true" || v == "1"
+	}
+	if v := os.Getenv("GOOGLE_CLOUD_PROJECT"); v != "" {
+		c.Project = v
+	}
+	if v := os.Getenv("GOOGLE_CLOUD_LOCATION"); v != "" {
+		c.Location = v
+	}
+	if c.Location == "" {
+		c.Location = "us-central1"
+	}
+	return c
+}
+
+// vertexEndpoint returns the generateContent URL for modelName on Vertex AI
+// and a bearer token for it.
+func vertexEndpoint(ctx context.Context, c GeminiConfig, modelName string) (string, string, error) {
+	tok, project, err := gcpTokens.get(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if c.Project != "" {
+		project = c.Project
+	}
+	if project == "" {
+		return "", "", kindError(ErrConfig, "missing GCP project for Vertex AI. Set GOOGLE_CLOUD_PROJECT or gemini.project in the config")
+	}
+	return vertexURL(c.Location, project, modelName), tok, nil
+}
+
+func vertexURL(location, project, modelName string) string {
+	if modelName == "" {
+		modelName = geminiModel
+	}
+	host := location + "-aiplatform.googleapis.com"
+	if location == "global" {
+		host = "aiplatform.googleapis.com"
+	}
+	return fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent",
+		host, url.PathEscape(project), url.PathEscape(location), url.PathEscape(modelName))
+}
+
+// gcpTokenCache resolves Application Default Credentials and caches the
+// access token until shortly before it expires.
+type gcpTokenCache struct {
+	mu      sync.Mutex
+	token   string
+	project string
+	expires time.Time
+}
+
+var gcpTokens = &gcpTokenCache{}
+
+// get returns an access token and the project ID the credentials belong to
+// (if they say).
+func (t *gcpTokenCache) get(ctx context.Context) (string, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > 5*time.Minute {
+		return t.token, t.project, nil
+	}
+
+	tok, project, ttl, err := fetchADCToken(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	t.token, t.project, t.expires = tok, project, time.Now().Add(ttl)
+	return tok, project, nil
+}
+
+// adcFile is the subset of a service account key or gcloud ADC file we use.
+type adcFile struct {
+	Type string `json:"type"`
+	// service_account
+	ProjectID    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	// authorized_user (gcloud auth application-default login)
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	RefreshToken   string `json:"refresh_token"`
+	QuotaProjectID string `json:"quota_project_id"`
+}
+
+// fetchADCToken follows the ADC lookup order: GOOGLE_APPLICATION_CREDENTIALS,
+// the gcloud well-known file, then the GCE/GKE metadata server.
+func fetchADCToken(ctx context.Context) (string, string, time.Duration, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			wellKnown := filepath.Join(dir, "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(wellKnown); err == nil {
+				path = wellKnown
+			}
+		}
+	}
+	if path == "" {
+		return metadataToken(ctx)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("reading Google credentials: %v", err)
+	}
+	var f adcFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", "", 0, fmt.Errorf("parsing Google credentials %s: %v", path, err)
+	}
+
+	var form url.Values
+	tokenURI := "https://oauth2.googleapis.com/token"
+	project := f.ProjectID
+	switch f.Type {
+	case "service_account":
+		assertion, err := serviceAccountJWT(f)
+		if err != nil {
+			return "", "", 0, err
+		}
+		if f.TokenURI != "" {
+			tokenURI = f.TokenURI
+		}
+		form = url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	case "authorized_user":
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {f.ClientID},
+			"client_secret": {f.ClientSecret},
+			"refresh_token": {f.RefreshToken},
+		}
+		project = f.QuotaProjectID
+	default:
+		return "", "", 0, fmt.Errorf("unsupported Google credential type %q in %s", f.Type, path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tok, ttl, err := doGCPTokenRequest(req)
+	return tok, project, ttl, err
+}
+
+// serviceAccountJWT builds the signed assertion for the jwt-bearer grant.
+func serviceAccountJWT(f adcFile) (string, error) {
+	block, _ := pem.Decode([]byte(f.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("service account %s has no PEM private key", f.ClientEmail)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parsing service account key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("service account key is not RSA")
+	}
+
+	aud := f.TokenURI
+	if aud == "" {
+		aud = "https://oauth2.googleapis.com/token"
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": f.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   f.ClientEmail,
+		"scope": gcpScope,
+		"aud":   aud,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("signing service account assertion: %v", err)
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+const gceMetadata = "http://metadata.google.internal/computeMetadata/v1"
+
+// metadataToken asks the GCE/GKE metadata server for the attached service
+// account's token and the project it runs in.
+func metadataToken(ctx context.Context) (string, string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gceMetadata+"/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcpScope), nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	tok, ttl, err := doGCPTokenRequest(req)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("no Google credentials found (set GOOGLE_APPLICATION_CREDENTIALS or run `gcloud auth application-default login`): %v", err)
+	}
+
+	var project string
+	if preq, err := http.NewRequestWithContext(ctx, http.MethodGet, gceMetadata+"/project/project-id", nil); err == nil {
+		preq.Header.Set("Metadata-Flavor", "Google")
+		if resp, err := http.DefaultClient.Do(preq); err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				project = strings.TrimSpace(string(body))
+			}
+		}
+	}
+	return tok, project, ttl, nil
+}
+
+func doGCPTokenRequest(req *http.Request) (string, time.Duration, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("requesting Google access token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", 0, kindError(ErrAuth, "google token endpoint returned status: %s, body: %s", resp.Status, string(body))
+	}
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("parsing Google access token: %v", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, kindError(ErrAuth, "google token endpoint returned no access_token")
+	}
+	if tr.ExpiresIn == 0 {
+		tr.ExpiresIn = 3600
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vramOverhead is the memory a loaded model takes beyond its weights, for
+// the KV cache and buffers, as a multiple of its size on disk.
+const vramOverhead = 1.2
+
+// autoSelectTTL is how long a pick stands before memory is looked at again.
+const autoSelectTTL = 30 * time.Second
+
+const gib = 1 << 30
+
+var autoSelect struct {
+	mu     sync.Mutex
+	model  string
+	picked time.Time
+}
+
+// autoSelectModel picks the local model when none is given, from
+// ollama.auto_select in the config: the first listed model that is
+// installed on a host with the memory to hold it, so that a task neither
+// fails to load nor crawls along on the CPU. It returns "" when
+// auto_select is empty or none of it is installed.
+func autoSelectModel() string {
+	prefs := config.Ollama.AutoSelect
+	if len(prefs) == 0 {
+		return ""
+	}
+	autoSelect.mu.Lock()
+	defer autoSelect.mu.Unlock()
+	if autoSelect.model != "" && time.Since(autoSelect.picked) < autoSelectTTL {
+		return autoSelect.model
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	fits := pickByMemory(ctx, prefs)
+	if fits.model == "" {
+		statusf("[Sub-Agent] Warning: no model of ollama.auto_select is installed (%s)\n", strings.Join(prefs, ", "))
+		return ""
+	}
+	if fits.model != autoSelect.model {
+		statusf("[Sub-Agent] %s\n", fits.reason)
+	}
+	autoSelect.model, autoSelect.picked = fits.model, time.Now()
+	return fits.model
+}
+
+type memoryPick struct {
+	model  string
+	reason string
+}
+
+// hostMemory is what a host has for models.
+type hostMemory struct {
+	url       string
+	sizes     map[string]int64 // installed models' sizes on disk
+	loaded    map[string]bool
+	available int64 // -1 when unknown
+	source    string
+}
+
+// pickByMemory chooses among prefs: one already loaded somewhere, else the
+// first that fits a host's memory, else the smallest installed.
+func pickByMemory(ctx context.Context, prefs []string) memoryPick {
+	hosts := ollamaHostURLs()
+	mems := make([]hostMemory, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			mems[i] = probeHostMemory(ctx, h)
+		}(i, h)
+	}
+	wg.Wait()
+
+	for _, m := range prefs {
+		for _, h := range mems {
+			if h.loaded[m] || h.loaded[m+":latest"] {
+				return memoryPick{m, fmt.Sprintf("Auto-selected %s, already loaded on %s", m, h.url)}
+			}
+		}
+	}
+	var smallest string
+	var smallestSize int64
+	unknown := ""
+	for _, m := range prefs {
+		for _, h := range mems {
+			size, ok := h.sizes[m]
+			if !ok {
+				size, ok = h.sizes[m+":latest"]
+			}
+			if !ok {
+				continue
+			}
+			need := int64(float64(size) * vramOverhead)
+			if h.available < 0 {
+				if unknown == "" {
+					unknown = m
+				}
+				continue
+			}
+			if need <= h.available {
+				return memoryPick{m, fmt.Sprintf("Auto-selected %s: needs ~%.1f GiB of the %.1f GiB free on %s (%s)", m, float64(need)/gib, float64(h.available)/gib, h.url, h.source)}
+			}
+			if smallest == "" || size < smallestSize {
+				smallest, smallestSize = m, size
+			}
+		}
+	}
+	if unknown != "" {
+		return memoryPick{unknown, fmt.Sprintf("Auto-selected %s, the first of ollama.auto_select installed; the free memory of the host is unknown (set ollama.vram_gb)", unknown)}
+	}
+	if smallest != "" {
+		return memoryPick{smallest, fmt.Sprintf("Warning: no model of ollama.auto_select fits in the memory free; using the smallest, %s, which may run partly on the CPU", smallest)}
+	}
+	return memoryPick{}
+}
+
+// probeHostMemory asks a host for its models and works out the memory free
+// for them: ollama.vram_gb when set, else the GPUs of a host on this
+// machine. Memory held by loaded models counts as free, as Ollama unloads
+// idle models to make room.
+func probeHostMemory(ctx context.Context, host string) hostMemory {
+	h := hostMemory{url: host, sizes: map[string]int64{}, loaded: map[string]bool{}, available: -1}
+	headers, err := ollamaHeaders()
+	if err != nil {
+		return h
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		} `json:"models"`
+	}
+	if err := getJSON(ctx, "Ollama", host+"/api/tags", headers, &tags); err != nil {
+		progressf("Can't list the models of %s: %v", host, err)
+		return h
+	}
+	for _, m := range tags.Models {
+		h.sizes[m.Name] = m.Size
+	}
+	var ps struct {
+		Models []struct {
+			Name     string `json:"name"`
+			SizeVRAM int64  `json:"size_vram"`
+		} `json:"models"`
+	}
+	var reclaimable int64
+	if err := getJSON(ctx, "Ollama", host+"/api/ps", headers, &ps); err == nil {
+		for _, m := range ps.Models {
+			h.loaded[m.Name] = true
+			reclaimable += m.SizeVRAM
+		}
+	}
+	if gb := config.Ollama.VRAMGB; gb > 0 {
+		h.available, h.source = int64(gb*gib), "ollama.vram_gb"
+		return h
+	}
+	if !isLocalAddress(host) {
+		return h
+	}
+	if free, source, ok := localGPUFree(ctx); ok {
+		h.available, h.source = free+reclaimable, source
+	}
+	return h
+}
+
+// localGPUFree is the GPU memory free on this machine: NVIDIA's, or on
+// Apple silicon the share of RAM Metal lets the GPU have.
+func localGPUFree(ctx context.Context) (int64, string, bool) {
+	if out, err := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=memory.free", "--format=csv,noheader,nounits").Output(); err == nil {
+		var mib int64
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			n, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+			if err != nil {
+				return 0, "", false
+			}
+			mib += n
+		}
+		return mib << 20, "nvidia-smi", true
+	}
+	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
+		out, err := exec.CommandContext(ctx, "sysctl", "-n", "hw.memsize").Output()
+		if err != nil {
+			return 0, "", false
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			return 0, "", false
+		}
+		return n / 4 * 3, "unified memory", true
+	}
+	return 0, "", false
+}
+
+// isLocalAddress reports whether host's URL points at this machine.
+func isLocalAddress(host string) bool {
+	u, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	name := u.Hostname()
+	if name == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ollamaHostURLs is every Ollama host: the pool's, or the one.
+func ollamaHostURLs() []string {
+	p := localPool()
+	if p == nil {
+		return []string{ollamaHost()}
+	}
+	hosts := make([]string, len(p.hosts))
+	for i, b := range p.hosts {
+		hosts[i] = b.url
+	}
+	return hosts
+}
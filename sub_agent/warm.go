@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmResult is one model preloaded, or not, on one host.
+type warmResult struct {
+	Host    string `json:"host"`
+	Model   string `json:"model"`
+	LoadMS  int64  `json:"load_ms"` // 0 when it was already loaded
+	TookMS  int64  `json:"took_ms"`
+	Skipped bool   `json:"skipped,omitempty"` // not installed there
+	Error   string `json:"error,omitempty"`
+}
+
+// warmCommand implements `warm`: load models into memory on every Ollama
+// host ahead of the first task, once or again every --every so they stay
+// loaded. Ollama loads a model with a generate request that has no prompt.
+func warmCommand(fs *flag.FlagSet) func(args []string) {
+	var models stringList
+	fs.Var(&models, "model", "Model to preload; repeat it or separate models with commas (default: the local default model)")
+	keepAlive := fs.String("keep-alive", "30m", "How long Ollama keeps the models loaded after this; negative keeps them until it restarts")
+	every := fs.Duration("every", 0, "Preload again at this interval until interrupted, keeping the models warm (0 preloads once)")
+	fs.BoolVar(&jsonOut, "json", false, "Print the results as JSON")
+	return func([]string) {
+		if _, err := time.ParseDuration(*keepAlive); err != nil {
+			fatal(kindError(ErrConfig, "invalid --keep-alive %q: %v", *keepAlive, err))
+		}
+		if *every < 0 {
+			fatal(kindError(ErrConfig, "invalid --every %s: must not be negative", *every))
+		}
+		var names []string
+		for _, m := range models {
+			for _, name := range strings.Split(m, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		if len(names) == 0 {
+			names = []string{resolveModel("")}
+		}
+		hosts := ollamaHostURLs()
+		if *every == 0 {
+			if !printWarm(warmModels(context.Background(), hosts, names, *keepAlive)) {
+				os.Exit(1)
+			}
+			return
+		}
+		if d, err := time.ParseDuration(*keepAlive); err == nil && d >= 0 && d < *every {
+			statusf("[Sub-Agent] Warning: --keep-alive %s is shorter than --every %s, so models will be unloaded between rounds\n", *keepAlive, *every)
+		}
+		ctx, stop := shutdownSignal()
+		defer stop()
+		tick := time.NewTicker(*every)
+		defer tick.Stop()
+		for {
+			printWarm(warmModels(ctx, hosts, names, *keepAlive))
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}
+}
+
+// warmModels preloads every model on every host that has it, in parallel
+// across hosts and in turn on each, as a host loading several models at
+// once only makes them all slower.
+func warmModels(ctx context.Context, hosts, models []string, keepAlive string) []warmResult {
+	results := make([][]warmResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			installed, err := ollamaModels(ctx, host)
+			for _, m := range models {
+				r := warmResult{Host: host, Model: m}
+				switch {
+				case err != nil:
+					r.Error = redactErr(err).Error()
+				case !hasOllamaModel(installed, m):
+					r.Skipped = true
+				default:
+					start := time.Now()
+					var resp OllamaResponse
+					headers, herr := ollamaHeaders()
+					if herr == nil {
+						herr = postJSON(ctx, "Ollama", host+"/api/generate", headers, map[string]interface{}{"model": m, "keep_alive": keepAlive}, &resp)
+					}
+					r.TookMS = time.Since(start).Milliseconds()
+					r.LoadMS = resp.LoadDuration / 1e6
+					if herr != nil {
+						r.Error = redactErr(herr).Error()
+					}
+				}
+				results[i] = append(results[i], r)
+			}
+		}(i, host)
+	}
+	wg.Wait()
+	var out []warmResult
+	for _, r := range results {
+		out = append(out, r...)
+	}
+	return out
+}
+
+// printWarm reports a round of preloads and whether any model got loaded.
+func printWarm(results []warmResult) bool {
+	ok := false
+	for _, r := range results {
+		if !r.Skipped && r.Error == "" {
+			ok = true
+		}
+	}
+	if jsonOut {
+		printJSON(results)
+		return ok
+	}
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			fmt.Printf("%-32s %-24s failed: %s\n", r.Host, r.Model, r.Error)
+		case r.Skipped:
+			fmt.Printf("%-32s %-24s not installed, skipped\n", r.Host, r.Model)
+		case r.LoadMS >= 1000:
+			fmt.Printf("%-32s %-24s loaded in %s\n", r.Host, r.Model, time.Duration(r.LoadMS)*time.Millisecond)
+		default:
+			fmt.Printf("%-32s %-24s already loaded (%s)\n", r.Host, r.Model, time.Duration(r.TookMS)*time.Millisecond)
+		}
+	}
+	return ok
+}
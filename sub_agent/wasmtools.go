@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WasmConfig configures plugin tools: WASI modules described by a manifest
+// in the tools directory.
+type WasmConfig struct {
+	// Dir holds the manifests; default <user config dir>/helix/tools.
+	Dir string `json:"dir,omitempty"`
+	// Runtime is the WASI runtime binary, default "wasmtime". RuntimeArgs
+	// are passed before the module, e.g. resource limits.
+	Runtime     string   `json:"runtime,omitempty"`
+	RuntimeArgs []string `json:"runtime_args,omitempty"`
+}
+
+// wasmManifest is a <name>.json file in the tools directory:
+//
+//	{"name": "wordcount", "description": "Count words", "module": "wordcount.wasm",
+//	 "input_schema": {"type": "object", "properties": {"text": {"type": "string"}}}}
+//
+// The module reads the tool input as JSON on stdin and writes its result on
+// stdout: either plain text or {"output": "..."} / {"error": "..."}.
+type wasmManifest struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Module      string          `json:"module"` // relative to the manifest; default <name>.wasm
+	InputSchema json.RawMessage `json:"input_schema"`
+	Timeout     string          `json:"timeout,omitempty"` // default 10s
+	// Workspace preopens --workspace as /workspace; otherwise the module
+	// sees no files at all.
+	Workspace bool `json:"workspace,omitempty"`
+}
+
+func wasmToolsDir() string {
+	if d := config.Tools.Wasm.Dir; d != "" {
+		return d
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "helix", "tools")
+}
+
+// loadWasmTools reads the manifests in the tools directory. A missing
+// directory just means no plugins.
+func loadWasmTools() (map[string]wasmManifest, error) {
+	dir := wasmToolsDir()
+	if dir == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	tools := map[string]wasmManifest{}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var m wasmManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("tool manifest %s: %v", p, err)
+		}
+		if m.Name == "" {
+			m.Name = strings.TrimSuffix(filepath.Base(p), ".json")
+		}
+		if m.Module == "" {
+			m.Module = m.Name + ".wasm"
+		}
+		if !filepath.IsAbs(m.Module) {
+			m.Module = filepath.Join(dir, m.Module)
+		}
+		if len(m.InputSchema) == 0 {
+			m.InputSchema = json.RawMessage(`{"type":"object"}`)
+		}
+		tools[m.Name] = m
+	}
+	return tools, nil
+}
+
+type wasmTool struct {
+	manifest  wasmManifest
+	runtime   string
+	args      []string
+	timeout   time.Duration
+	workspace string
+}
+
+func newWasmTool(m wasmManifest, workspace string) (tool, error) {
+	t := &wasmTool{manifest: m, runtime: config.Tools.Wasm.Runtime, args: config.Tools.Wasm.RuntimeArgs, timeout: 10 * time.Second}
+	if t.runtime == "" {
+		t.runtime = "wasmtime"
+	}
+	if m.Timeout != "" {
+		d, err := time.ParseDuration(m.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", m.Timeout, err)
+		}
+		t.timeout = d
+	}
+	if m.Workspace {
+		t.workspace = workspace
+	}
+	if _, err := os.Stat(m.Module); err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(t.runtime); err != nil {
+		return nil, fmt.Errorf("%s not found; WASM tools need a WASI runtime", t.runtime)
+	}
+	return t, nil
+}
+
+func (t *wasmTool) spec() toolSpec {
+	return toolSpec{Name: t.manifest.Name, Description: t.manifest.Description, InputSchema: t.manifest.InputSchema}
+}
+
+// program is the module the tool runs, for its version in a manifest.
+func (t *wasmTool) program() string { return t.manifest.Module }
+
+func (t *wasmTool) call(ctx context.Context, input json.RawMessage) (string, error) {
+	args := append([]string{"run"}, t.args...)
+	if t.workspace != "" {
+		abs, err := filepath.Abs(t.workspace)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--dir", abs+"::/workspace")
+	}
+	args = append(args, t.manifest.Module)
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.runtime, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	// WASI modules only see the environment they are given; keep it empty.
+	cmd.Env = []string{}
+	stdout, stderr := &cappedBuffer{max: maxToolOutput}, &cappedBuffer{max: maxToolOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("timed out after %s", t.timeout)
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return toolOutput(stdout.String())
+}
+
+// toolOutput interprets a plugin's stdout: {"error": ...} fails the call,
+// {"output": ...} is unwrapped, anything else is passed on as is.
+func toolOutput(out string) (string, error) {
+	var msg struct {
+		Output *string `json:"output"`
+		Error  string  `json:"error"`
+	}
+	if json.Unmarshal([]byte(out), &msg) == nil {
+		if msg.Error != "" {
+			return "", fmt.Errorf("%s", msg.Error)
+		}
+		if msg.Output != nil {
+			return *msg.Output, nil
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// watchFlags are --watch and its timings. Like kb sync --watch, it polls
+// rather than relying on inotify or FSEvents.
+type watchFlags struct {
+	paths    stringList
+	interval *time.Duration
+	debounce *time.Duration
+}
+
+func addWatchFlags(fs *flag.FlagSet) *watchFlags {
+	w := &watchFlags{}
+	fs.Var(&w.paths, "watch", "File, directory or glob to watch: run the task again whenever it changes and print how the answer changed (repeatable)")
+	w.interval = fs.Duration("watch-interval", time.Second, "How often --watch checks for changes")
+	w.debounce = fs.Duration("watch-debounce", 500*time.Millisecond, "How long files must stay unchanged before --watch runs the task again")
+	return w
+}
+
+// watchedFiles fingerprints the watched files by size and modification
+// time.
+func (w *watchFlags) watchedFiles(rules []ignoreRule) (map[string]string, error) {
+	files := map[string]string{}
+	for _, arg := range w.paths {
+		paths, err := expandContextArg(rules, arg)
+		if err != nil {
+			return nil, fmt.Errorf("--watch %s: %v", arg, err)
+		}
+		for _, p := range paths {
+			if fi, err := os.Stat(p); err == nil {
+				files[p] = fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano())
+			}
+		}
+	}
+	return files, nil
+}
+
+// watchTask runs the task, then again whenever a watched file changes,
+// printing the first answer and after that a diff against the previous
+// one. Each run is a child helix given the same flags, so --task-file,
+// --context and the config are read afresh, and a failed run doesn't end
+// the watch. Only the latest answer goes to --output-file.
+func watchTask(fs *flag.FlagSet, w *watchFlags, of *outputFlags) {
+	if *w.interval <= 0 || *w.debounce < 0 {
+		fatal(kindError(ErrConfig, "--watch-interval must be positive and --watch-debounce not negative"))
+	}
+	if jsonOut || *of.stream {
+		fatal(kindError(ErrConfig, "--watch prints diffs of the answer and can't be used with --json or --stream"))
+	}
+	if flagWasSet(fs, "apply") {
+		fatal(kindError(ErrConfig, "--watch can't be used with --apply"))
+	}
+	rules, err := loadIgnoreRules()
+	if err != nil {
+		fatal(configError(err))
+	}
+	files, err := w.watchedFiles(rules)
+	if err != nil {
+		fatal(configError(err))
+	}
+	if len(files) == 0 {
+		fatal(kindError(ErrConfig, "--watch %s matches no files", strings.Join(w.paths, ", ")))
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fatal(fmt.Errorf("locating the helix binary: %v", err))
+	}
+	args := append([]string{"--json"}, stripFlags(fs, os.Args[1:], "watch", "watch-interval", "watch-debounce", "output-file", "append")...)
+	// Piped input can only be read once; every run gets a copy.
+	input, err := readPipedInput()
+	if err != nil {
+		fatal(configError(err))
+	}
+
+	ctx, stop := shutdownSignal()
+	defer stop()
+	statusf("[Sub-Agent] Watching %d file(s); Ctrl-C stops\n", len(files))
+	var last *TaskResult
+	for run := 1; ; run++ {
+		if run > 1 {
+			statusf("[Sub-Agent] Files changed; run %d\n", run)
+		}
+		res, err := watchRun(ctx, exe, args, input)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			statusf("[Sub-Agent] Warning: run %d failed: %v\n", run, err)
+		case last == nil:
+			printResult(os.Stdout, res, *of.path == "" && useMarkdown(raw))
+			last = &res
+		default:
+			printResultStatus(res)
+			if d := unifiedDiff(last.Output, res.Output, "previous answer", "new answer", 3); d == "" {
+				statusf("[Sub-Agent] The answer is unchanged\n")
+			} else {
+				printAnswerDiff(d, *of.path == "" && useMarkdown(raw))
+			}
+			last = &res
+		}
+		if err == nil && *of.path != "" {
+			if err := writeOutputFile(*of.path, []byte(res.Output+"\n"), *of.append); err != nil {
+				statusf("[Sub-Agent] Warning: writing %s: %v\n", *of.path, err)
+			} else {
+				statusf("[Sub-Agent] Wrote answer to %s\n", *of.path)
+			}
+		}
+
+		// Wait for a change, then for the files to settle.
+		for {
+			select {
+			case <-time.After(*w.interval):
+			case <-ctx.Done():
+				return
+			}
+			now, err := w.watchedFiles(rules)
+			if err != nil {
+				statusf("[Sub-Agent] Warning: %v\n", err)
+				continue
+			}
+			if !maps.Equal(now, files) {
+				files = now
+				break
+			}
+		}
+		for *w.debounce > 0 {
+			select {
+			case <-time.After(*w.debounce):
+			case <-ctx.Done():
+				return
+			}
+			now, err := w.watchedFiles(rules)
+			if err != nil || maps.Equal(now, files) {
+				break
+			}
+			files = now
+		}
+	}
+}
+
+// watchRun runs one child helix and returns its result.
+func watchRun(ctx context.Context, exe string, args []string, input string) (TaskResult, error) {
+	var res TaskResult
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stderr = os.Stderr
+	out, runErr := cmd.Output()
+	if err := json.Unmarshal(out, &res); err != nil {
+		if runErr != nil {
+			return res, runErr
+		}
+		return res, fmt.Errorf("reading the result: %v", err)
+	}
+	if res.Error != "" {
+		return res, fmt.Errorf("%s", res.Error)
+	}
+	return res, nil
+}
+
+// printAnswerDiff prints a unified diff, coloured on a terminal.
+func printAnswerDiff(diff string, color bool) {
+	for _, l := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		style := ""
+		switch {
+		case strings.HasPrefix(l, "---"), strings.HasPrefix(l, "+++"):
+			style = ansiBold
+		case strings.HasPrefix(l, "@@"):
+			style = ansiCyan
+		case strings.HasPrefix(l, "-"):
+			style = ansiRed
+		case strings.HasPrefix(l, "+"):
+			style = ansiGreen
+		}
+		if color && style != "" {
+			l = style + l + ansiReset
+		}
+		fmt.Println(l)
+	}
+}
+
+// stripFlags returns args without the flags named in drop and their
+// values, going by fs to tell which flags take one.
+func stripFlags(fs *flag.FlagSet, args []string, drop ...string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || a == "-" || !strings.HasPrefix(a, "-") {
+			return append(out, args[i:]...)
+		}
+		name, _, inline := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		takesValue := false
+		if f := fs.Lookup(name); f != nil && !inline {
+			b, ok := f.Value.(interface{ IsBoolFlag() bool })
+			takesValue = !ok || !b.IsBoolFlag()
+		}
+		if slices.Contains(drop, name) {
+			if takesValue {
+				i++
+			}
+			continue
+		}
+		out = append(out, a)
+		if takesValue && i+1 < len(args) {
+			i++
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
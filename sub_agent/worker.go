@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// workerCommand implements `worker`: it drains tasks from a queue directory until
+// SIGINT/SIGTERM, then stops claiming and requeues whatever cannot finish
+// within the drain timeout.
+func workerCommand(fs *flag.FlagSet) func(args []string) {
+	queueDir := fs.String("queue-dir", "", "Queue directory to consume tasks from (required)")
+	concurrency := fs.Int("concurrency", 1, "Maximum number of tasks to run at once")
+	poll := fs.Duration("poll", 2*time.Second, "How often to check an empty queue")
+	drainTimeout := fs.Duration("drain-timeout", 30*time.Second, "How long in-flight tasks may run after shutdown starts")
+	heartbeat := fs.Duration("heartbeat", 30*time.Second, "How often to print the progress of running tasks (0 disables)")
+	preempt := fs.Bool("preempt", false, "When every slot is busy, cancel and requeue the lowest-priority local task for a higher-priority pending one")
+	configPoll := fs.Duration("config-poll", configPollInterval, "How often to check the config file for changes to apply without a restart (0 only reloads on SIGHUP)")
+	adaptive := fs.Bool("adaptive-concurrency", false, "Adapt how many Ollama calls run at once, between 1 and --concurrency, to how long they queue in Ollama (AIMD)")
+	kf := addKeyFlags(fs)
+	rf := addRunnerFlags(fs)
+	return func([]string) {
+		if *queueDir == "" {
+			fatal(kindError(ErrConfig, "--queue-dir flag is required"))
+		}
+		key, err := kf.resolve()
+		if err != nil {
+			fatal(configError(err))
+		}
+		if *concurrency < 1 {
+			*concurrency = 1
+		}
+		if err := prefetchSecrets(); err != nil {
+			fatal(configError(err))
+		}
+		if *adaptive {
+			ollamaLimiter = newAIMDLimiter(*concurrency)
+		}
+		r, err := newRunner(key, rf)
+		if err != nil {
+			fatal(configError(err))
+		}
+
+		q, err := openQueue(*queueDir)
+		if err != nil {
+			fatal(configError(err))
+		}
+
+		sigCtx, stop := shutdownSignal()
+		defer stop()
+
+		d := newDrainer()
+		tasks := newTaskRegistry(0)
+		go tasks.heartbeat(sigCtx, *heartbeat)
+		slots := make(chan struct{}, *concurrency)
+		pre := &preemptor{tasks: map[*progressTracker]int{}}
+		var preemptTick <-chan time.Time
+		if *preempt {
+			t := time.NewTicker(*poll)
+			defer t.Stop()
+			preemptTick = t.C
+		}
+		go watchTombstones(sigCtx, q, tasks, *poll)
+		go watchConfig(sigCtx, *configPoll, nil)
+		if *adaptive {
+			fmt.Printf("[Sub-Agent] Worker consuming %s (concurrency up to %d, adapting local calls to Ollama's load)\n", *queueDir, *concurrency)
+		} else {
+			fmt.Printf("[Sub-Agent] Worker consuming %s (concurrency %d)\n", *queueDir, *concurrency)
+		}
+
+		for sigCtx.Err() == nil {
+			select {
+			case slots <- struct{}{}:
+			case <-preemptTick:
+				if len(slots) == cap(slots) {
+					if top, ok := q.topPriority(); ok {
+						pre.preempt(top)
+					}
+				}
+				continue
+			case <-sigCtx.Done():
+				continue
+			}
+
+			req, err := q.claim()
+			if err != nil || req == nil {
+				<-slots
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+				}
+				select {
+				case <-time.After(*poll):
+				case <-sigCtx.Done():
+				}
+				continue
+			}
+
+			// In-flight work is detached from the signal so it can keep running
+			// while we drain; the drainer cancels it once the timeout expires.
+			ctx, done, ok := d.begin(context.Background())
+			if !ok {
+				<-slots
+				q.requeue(req.ID)
+				break
+			}
+			go func(req TaskRequest) {
+				defer func() { <-slots }()
+				defer done()
+				ctx, tracker := tasks.start(ctx, req.ID, req.Tenant)
+				defer tasks.finish(tracker)
+				if !r.leavesMachine(req) {
+					pre.add(tracker, req.Priority)
+					defer pre.remove(tracker)
+				}
+				processQueued(q, d, r, ctx, req)
+			}(*req)
+		}
+
+		fmt.Printf("[Sub-Agent] Shutting down, draining in-flight tasks (up to %s)\n", *drainTimeout)
+		if !d.drain(*drainTimeout) {
+			fmt.Println("[Sub-Agent] Drain timeout reached; unfinished tasks were requeued")
+		}
+	}
+}
+
+// processQueued runs one claimed task. Work cut short by the drain timeout
+// or preempted goes back to pending/ instead of being recorded as a failure.
+func processQueued(q *taskQueue, d *drainer, r *runner, ctx context.Context, req TaskRequest) {
+	if len(req.Tags) > 0 {
+		fmt.Printf("[Sub-Agent] Running task %s (%s)\n", req.ID, formatTags(req.Tags))
+	} else {
+		fmt.Printf("[Sub-Agent] Running task %s\n", req.ID)
+	}
+	res, err := r.run(ctx, req)
+	t := progressFrom(ctx)
+	if err != nil && q.tombstoned(req.ID) {
+		res.Error, res.ErrorKind = "task cancelled", ErrCancelled
+		fmt.Printf("[Sub-Agent] Cancelled task %s\n", req.ID)
+	} else if err != nil && (d.aborted() || t != nil && t.wasCancelled()) {
+		if err := q.requeue(req.ID); err != nil {
+			fmt.Printf("Error: requeueing %s: %v\n", req.ID, err)
+		}
+		return
+	}
+	if err := q.finish(res); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// watchTombstones stops the running tasks given a tombstone, every poll
+// until ctx is done.
+func watchTombstones(ctx context.Context, q *taskQueue, tasks *taskRegistry, poll time.Duration) {
+	tick := time.NewTicker(poll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for _, id := range q.tombstones() {
+			if t := tasks.get(id); t != nil && t.stop() {
+				fmt.Printf("[Sub-Agent] Cancelling task %s\n", id)
+			}
+		}
+	}
+}
+
+// workerCancelCommand implements `worker cancel`.
+func workerCancelCommand(fs *flag.FlagSet) func(args []string) {
+	queueDir := fs.String("queue-dir", "", "Queue directory of the tasks (required)")
+	return func(args []string) {
+		if *queueDir == "" || len(args) == 0 {
+			fatal(kindError(ErrConfig, "usage: helix worker cancel --queue-dir dir <task-id>..."))
+		}
+		q, err := openQueue(*queueDir)
+		if err != nil {
+			fatal(configError(err))
+		}
+		failed := false
+		for _, id := range args {
+			state, err := q.cancel(id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				failed = true
+				continue
+			}
+			if state == "pending" {
+				fmt.Printf("Cancelled task %s; it won't be run\n", id)
+			} else {
+				fmt.Printf("Cancelling task %s; its worker stops it within --poll\n", id)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
+
+// preemptor tracks the local tasks a worker is running by priority, so that
+// a waiting higher-priority task can take the slot of the lowest.
+type preemptor struct {
+	mu      sync.Mutex
+	tasks   map[*progressTracker]int
+	victims int // preempted tasks still unwinding
+}
+
+func (p *preemptor) add(t *progressTracker, priority int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tasks[t] = priority
+}
+
+func (p *preemptor) remove(t *progressTracker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.tasks[t]; !ok {
+		p.victims--
+	}
+	delete(p.tasks, t)
+}
+
+// preempt cancels the lowest-priority task below priority. It waits for an
+// earlier victim to give up its slot first, so one waiting task never
+// preempts two.
+func (p *preemptor) preempt(priority int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.victims > 0 {
+		return
+	}
+	var victim *progressTracker
+	low := priority
+	for t, prio := range p.tasks {
+		if prio < low {
+			victim, low = t, prio
+		}
+	}
+	if victim == nil || !victim.stop() {
+		return
+	}
+	delete(p.tasks, victim)
+	p.victims++
+	fmt.Printf("[Sub-Agent] Preempting task %s (priority %d) for a priority %d task\n", victim.p.ID, low, priority)
+}
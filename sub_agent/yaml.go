@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlToJSON converts a YAML document to JSON, so that it decodes into the
+// same structs and tags as the JSON config. It reads the subset people
+// write by hand: block mappings and sequences, plain and quoted scalars,
+// flow [a, b] and {k: v} collections, | and > block scalars and comments.
+// Anchors, tags and multiple documents are not supported.
+func yamlToJSON(data []byte) ([]byte, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		p.lines = append(p.lines, yamlLine{n: i + 1, raw: raw})
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) && strings.TrimSpace(p.lines[p.pos].raw) == "---" {
+		p.pos++
+	}
+	var v interface{}
+	if l, ok := p.next(); ok {
+		var err error
+		if v, err = p.node(l.indent); err != nil {
+			return nil, err
+		}
+	}
+	if l, ok := p.next(); ok {
+		return nil, fmt.Errorf("line %d: unexpected %q", l.n, l.text)
+	}
+	return json.Marshal(v)
+}
+
+type yamlLine struct {
+	n      int
+	raw    string
+	indent int    // set by next
+	text   string // the content less indent and comment, set by next
+	item   bool   // text is the rest of a "- " sequence item
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		t := strings.TrimSpace(p.lines[p.pos].raw)
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.pos++
+	}
+}
+
+// next is the next line with content, left unconsumed.
+func (p *yamlParser) next() (*yamlLine, bool) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, false
+	}
+	l := &p.lines[p.pos]
+	if !l.item {
+		body := strings.TrimLeft(l.raw, " ")
+		l.indent = len(l.raw) - len(body)
+		l.text = strings.TrimSpace(stripYAMLComment(body))
+	}
+	return l, true
+}
+
+func (l *yamlLine) isItem() bool {
+	return l.text == "-" || strings.HasPrefix(l.text, "- ")
+}
+
+// node parses the block collection or scalar whose first line has indent.
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	l, _ := p.next()
+	if strings.HasPrefix(l.raw, "\t") {
+		return nil, fmt.Errorf("line %d: indent with spaces, not tabs", l.n)
+	}
+	if l.isItem() {
+		return p.sequence(l.indent)
+	}
+	if _, _, ok := splitYAMLKey(l.text); ok {
+		return p.mapping(l.indent)
+	}
+	p.pos++
+	return p.value(l.text, l.indent, l.n)
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	list := []interface{}{}
+	for {
+		l, ok := p.next()
+		if !ok || l.indent != indent || !l.isItem() {
+			break
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		if rest == "" {
+			p.pos++
+			var v interface{}
+			if c, ok := p.next(); ok && c.indent > indent {
+				var err error
+				if v, err = p.node(c.indent); err != nil {
+					return nil, err
+				}
+			}
+			list = append(list, v)
+			continue
+		}
+		// Read the rest of the item as a line of its own, indented to
+		// where it starts, so "- key: v" opens a mapping.
+		offset := strings.Index(l.text, rest)
+		l.indent, l.text, l.item = indent+offset, rest, true
+		v, err := p.node(l.indent)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for {
+		l, ok := p.next()
+		if !ok || l.indent != indent || l.isItem() {
+			break
+		}
+		key, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value, got %q", l.n, l.text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.n, key)
+		}
+		p.pos++
+		if rest != "" {
+			v, err := p.value(rest, indent, l.n)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		m[key] = nil
+		// A nested block, or a sequence at the key's own indent.
+		if c, ok := p.next(); ok && (c.indent > indent || c.indent == indent && c.isItem()) {
+			v, err := p.node(c.indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+	}
+	return m, nil
+}
+
+// value parses the value s on line n, a scalar or the start of a block
+// scalar or flow collection, whose parent has indent.
+func (p *yamlParser) value(s string, indent, n int) (interface{}, error) {
+	switch {
+	case s[0] == '|' || s[0] == '>':
+		return p.blockScalar(s, indent, n)
+	case s[0] == '[' || s[0] == '{':
+		// A flow collection may go on over later lines.
+		for depth := flowDepth(s); depth > 0; depth = flowDepth(s) {
+			if p.pos >= len(p.lines) {
+				return nil, fmt.Errorf("line %d: unclosed %c", n, s[0])
+			}
+			s += " " + strings.TrimSpace(stripYAMLComment(p.lines[p.pos].raw))
+			p.pos++
+		}
+		f := &flowParser{s: s, n: n}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		if f.skipSpace(); f.i < len(f.s) {
+			return nil, fmt.Errorf("line %d: unexpected %q after %c", n, f.s[f.i:], s[0])
+		}
+		return v, nil
+	}
+	return yamlScalar(s, n)
+}
+
+// blockScalar reads the lines of a | (literal) or > (folded) scalar, with
+// the - (strip) or + (keep) chomping indicators.
+func (p *yamlParser) blockScalar(header string, indent, n int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := strings.TrimSpace(header[1:])
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, fmt.Errorf("line %d: unsupported block scalar header %q", n, header)
+	}
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		raw := p.lines[p.pos].raw
+		body := strings.TrimLeft(raw, " ")
+		if body == "" {
+			lines = append(lines, "")
+			continue
+		}
+		ind := len(raw) - len(body)
+		if ind <= indent || blockIndent >= 0 && ind < blockIndent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = ind
+		}
+		lines = append(lines, raw[blockIndent:])
+	}
+	// Trailing blank lines belong to the chomping, not the next key.
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	trailing := len(lines) - end
+	lines = lines[:end]
+
+	var b strings.Builder
+	for i, line := range lines {
+		switch {
+		case i == 0:
+		case !folded || line == "" || lines[i-1] == "" || strings.HasPrefix(line, " "):
+			b.WriteString("\n")
+		default:
+			b.WriteString(" ")
+		}
+		b.WriteString(line)
+	}
+	s := b.String()
+	switch {
+	case len(lines) == 0:
+	case chomp == "-":
+	case chomp == "+":
+		s += strings.Repeat("\n", trailing+1)
+	default:
+		s += "\n"
+	}
+	return s, nil
+}
+
+// splitYAMLKey splits "key: value" (or "key:") at the first colon that is
+// followed by a space or ends the line, outside quotes.
+func splitYAMLKey(s string) (key, rest string, ok bool) {
+	if s == "" || s[0] == '[' || s[0] == '{' || s[0] == '|' || s[0] == '>' {
+		return "", "", false
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		end := quotedEnd(s)
+		if end < 0 || end+1 >= len(s) || s[end+1] != ':' || end+2 < len(s) && s[end+2] != ' ' {
+			return "", "", false
+		}
+		k, err := yamlScalar(s[:end+1], 0)
+		if err != nil {
+			return "", "", false
+		}
+		return fmt.Sprint(k), strings.TrimSpace(s[end+2:]), true
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' && (i+1 == len(s) || s[i+1] == ' ') {
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), i > 0
+		}
+	}
+	return "", "", false
+}
+
+// quotedEnd is the index of the quote closing the string s starts, or -1.
+func quotedEnd(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment cuts a # comment, which starts a line or follows a
+// space, outside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// Quotes only open a scalar at its start.
+			if i == 0 || strings.ContainsRune(" [{,:-", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// flowDepth is how many brackets of s are still open.
+func flowDepth(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// yamlScalar reads a quoted or plain scalar: null, a bool, a number or a
+// string.
+func yamlScalar(s string, n int) (interface{}, error) {
+	switch s[0] {
+	case '"':
+		if quotedEnd(s) != len(s)-1 {
+			return nil, fmt.Errorf("line %d: bad double-quoted string %s", n, s)
+		}
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad double-quoted string %s: %v", n, s, err)
+		}
+		return u, nil
+	case '\'':
+		if quotedEnd(s) != len(s)-1 {
+			return nil, fmt.Errorf("line %d: bad single-quoted string %s", n, s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '&', '*', '!':
+		return nil, fmt.Errorf("line %d: anchors, aliases and tags are not supported", n)
+	}
+	switch s {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXpP_") && s != "Inf" && s != "NaN" {
+		return f, nil
+	}
+	return s, nil
+}
+
+// flowParser reads a [..] or {..} collection.
+type flowParser struct {
+	s string
+	i int
+	n int
+}
+
+func (f *flowParser) skipSpace() {
+	for f.i < len(f.s) && f.s[f.i] == ' ' {
+		f.i++
+	}
+}
+
+func (f *flowParser) value() (interface{}, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, fmt.Errorf("line %d: unexpected end of flow collection", f.n)
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		list := []interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return list, nil
+			}
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		m := map[string]interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return m, nil
+			}
+			k, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			if f.skipSpace(); f.i >= len(f.s) || f.s[f.i] != ':' {
+				return nil, fmt.Errorf("line %d: expected ':' after key %v", f.n, k)
+			}
+			f.i++
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f.scalar(false)
+}
+
+// separator consumes the ',' between entries, leaving the closing bracket.
+func (f *flowParser) separator(closing byte) error {
+	f.skipSpace()
+	if f.i < len(f.s) && f.s[f.i] == ',' {
+		f.i++
+		return nil
+	}
+	if f.i < len(f.s) && f.s[f.i] == closing {
+		return nil
+	}
+	return fmt.Errorf("line %d: expected ',' or '%c' in flow collection", f.n, closing)
+}
+
+// scalar reads a quoted scalar, or a plain one up to the next ',', ']' or
+// '}' (or ':' for a key).
+func (f *flowParser) scalar(key bool) (interface{}, error) {
+	f.skipSpace()
+	start := f.i
+	if f.i < len(f.s) && (f.s[f.i] == '"' || f.s[f.i] == '\'') {
+		end := quotedEnd(f.s[f.i:])
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: unclosed quote", f.n)
+		}
+		f.i += end + 1
+		return yamlScalar(f.s[start:f.i], f.n)
+	}
+	for f.i < len(f.s) && !strings.ContainsRune(",]}", rune(f.s[f.i])) && !(key && f.s[f.i] == ':') {
+		f.i++
+	}
+	s := strings.TrimSpace(f.s[start:f.i])
+	if s == "" {
+		return nil, fmt.Errorf("line %d: empty entry in flow collection", f.n)
+	}
+	return yamlScalar(s, f.n)
+}